@@ -0,0 +1,186 @@
+package admin
+
+import (
+	"flag"
+	"html/template"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// Prefix is where the admin UI is served.
+const Prefix = "/admin"
+
+const layout = `
+<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="UTF-8">
+		<title>Cortex {{ .Component }}: {{ .Title }}</title>
+	</head>
+	<body>
+		<p>
+			<a href="` + Prefix + `/">Status</a>
+			{{ range .Pages }} | <a href="` + Prefix + `/{{ .Path }}">{{ .Title }}</a>{{ end }}
+		</p>
+		<h1>Cortex {{ .Component }}: {{ .Title }}</h1>
+		{{ template "content" .Content }}
+	</body>
+</html>`
+
+const statusContent = `
+{{ define "content" }}
+<table border="1">
+	<tbody>
+		<tr><th align="left">Host</th><td>{{ .Host }}</td></tr>
+		<tr><th align="left">Started</th><td>{{ .Started }}</td></tr>
+		<tr><th align="left">Uptime</th><td>{{ .Uptime }}</td></tr>
+		<tr><th align="left">Go version</th><td>{{ .GoVersion }}</td></tr>
+		<tr><th align="left">Goroutines</th><td>{{ .Goroutines }}</td></tr>
+	</tbody>
+</table>
+<p>See also <a href="/metrics">metrics</a>.</p>
+{{ end }}`
+
+const tableContent = `
+{{ define "content" }}
+{{ if .Message }}<p>{{ .Message }}</p>{{ end }}
+<table width="100%" border="1">
+	<thead>
+		<tr>{{ range .Columns }}<th>{{ . }}</th>{{ end }}</tr>
+	</thead>
+	<tbody>
+		{{ range .Rows }}
+		<tr>{{ range . }}<td>{{ . }}</td>{{ end }}</tr>
+		{{ end }}
+	</tbody>
+</table>
+{{ end }}`
+
+var (
+	statusTemplate = template.Must(template.Must(template.New("layout").Parse(layout)).Parse(statusContent))
+	tableTemplate  = template.Must(template.Must(template.New("layout").Parse(layout)).Parse(tableContent))
+)
+
+// UI is a component's admin UI: a status page, the component's
+// configuration, and whatever pages it registers, e.g. the ring's, linked
+// from each other so operators needn't poke raw endpoints.
+type UI struct {
+	component string
+	flags     *flag.FlagSet
+	started   time.Time
+
+	mtx   sync.RWMutex
+	pages []page
+}
+
+type page struct {
+	Path, Title string
+	handler     http.Handler
+}
+
+// New makes a new UI for the named component, configured by flags.
+func New(component string, flags *flag.FlagSet) *UI {
+	u := &UI{
+		component: component,
+		flags:     flags,
+		started:   time.Now(),
+	}
+	u.Register("config", "Configuration", http.HandlerFunc(u.configHandler))
+	return u
+}
+
+// Register adds a page, served by handler at Prefix/path and below.
+func (u *UI) Register(path, title string, handler http.Handler) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	u.pages = append(u.pages, page{Path: path, Title: title, handler: handler})
+}
+
+// RegisterTable adds a page showing the table returned by rows, with the
+// given columns, each time it's viewed.
+func (u *UI) RegisterTable(path, title string, columns []string, rows func() ([][]string, error)) {
+	u.Register(path, title, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		table, err := rows()
+		message := ""
+		if err != nil {
+			message = "Error: " + err.Error()
+		}
+		u.render(w, tableTemplate, title, tableData{Columns: columns, Rows: table, Message: message})
+	}))
+}
+
+type tableData struct {
+	Columns []string
+	Rows    [][]string
+	Message string
+}
+
+// ServeHTTP implements http.Handler, for requests under Prefix.
+func (u *UI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, Prefix), "/")
+	if path == "" {
+		u.statusHandler(w, r)
+		return
+	}
+	var handler http.Handler = http.NotFoundHandler()
+	u.mtx.RLock()
+	for _, p := range u.pages {
+		if path == p.Path || strings.HasPrefix(path, p.Path+"/") {
+			handler = p.handler
+			break
+		}
+	}
+	u.mtx.RUnlock()
+	handler.ServeHTTP(w, r)
+}
+
+func (u *UI) statusHandler(w http.ResponseWriter, r *http.Request) {
+	host, _ := os.Hostname()
+	u.render(w, statusTemplate, "Status", struct {
+		Host, GoVersion string
+		Started         time.Time
+		Uptime          time.Duration
+		Goroutines      int
+	}{
+		Host:       host,
+		GoVersion:  runtime.Version(),
+		Started:    u.started,
+		Uptime:     time.Since(u.started) / time.Second * time.Second,
+		Goroutines: runtime.NumGoroutine(),
+	})
+}
+
+// configHandler shows the component's flags, with secrets redacted; see
+// util.RedactFlag.
+func (u *UI) configHandler(w http.ResponseWriter, r *http.Request) {
+	var rows [][]string
+	u.flags.VisitAll(func(f *flag.Flag) {
+		rows = append(rows, []string{f.Name, util.RedactFlag(f.Name, f.Value.String()), util.RedactFlag(f.Name, f.DefValue), f.Usage})
+	})
+	sort.Slice(rows, func(i, j int) bool { return rows[i][0] < rows[j][0] })
+	u.render(w, tableTemplate, "Configuration", tableData{
+		Columns: []string{"Flag", "Value", "Default", "Description"},
+		Rows:    rows,
+	})
+}
+
+func (u *UI) render(w http.ResponseWriter, tmpl *template.Template, title string, content interface{}) {
+	u.mtx.RLock()
+	pages := append([]page(nil), u.pages...)
+	u.mtx.RUnlock()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := tmpl.Execute(w, struct {
+		Component, Title string
+		Pages            []page
+		Content          interface{}
+	}{u.component, title, pages, content}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/retrieval"
+	"github.com/prometheus/prometheus/storage/remote"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// Config configures an Agent.
+type Config struct {
+	ConfigFile    string
+	PushURL       string
+	UserID        string
+	Timeout       time.Duration
+	Shards        int
+	QueueCapacity int
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.ConfigFile, "agent.config-file", "", "Prometheus config file of the targets to scrape; only its global section and scrape_configs are used.")
+	f.StringVar(&cfg.PushURL, "agent.push-url", "", "URL to write scraped samples to, e.g. http://distributor/api/prom/push.")
+	f.StringVar(&cfg.UserID, "agent.user", "", "Tenant to write the samples as.")
+	f.DurationVar(&cfg.Timeout, "agent.timeout", 10*time.Second, "Timeout for writes.")
+	f.IntVar(&cfg.Shards, "agent.shards", 10, "Number of writes to make at once.")
+	f.IntVar(&cfg.QueueCapacity, "agent.queue-capacity", 100*1024, "Number of samples to buffer per shard before dropping them, while writes can't keep up.")
+}
+
+// Agent scrapes targets, as configured in a Prometheus config file, and
+// writes the samples to Cortex, for sites which can't run a Prometheus
+// server.  Nothing is stored locally: samples are buffered in memory until
+// written, and dropped if the buffers fill up.
+type Agent struct {
+	targetManager *retrieval.TargetManager
+	queueManager  *remote.QueueManager
+}
+
+// New makes a new Agent, and starts it scraping.
+func New(cfg Config) (*Agent, error) {
+	if cfg.ConfigFile == "" || cfg.PushURL == "" {
+		return nil, fmt.Errorf("both the config file and push URL must be set")
+	}
+	conf, err := config.LoadFile(cfg.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(conf.RuleFiles) > 0 || len(conf.AlertingConfig.AlertmanagerConfigs) > 0 || len(conf.RemoteWriteConfigs) > 0 {
+		log.Warnf("Ignoring the rule_files, alerting and remote_write sections of %s", cfg.ConfigFile)
+	}
+
+	queueManager := remote.NewQueueManager(remote.QueueManagerConfig{
+		QueueCapacity:  cfg.QueueCapacity,
+		Shards:         cfg.Shards,
+		ExternalLabels: conf.GlobalConfig.ExternalLabels,
+		Client: &client{
+			url:    cfg.PushURL,
+			userID: cfg.UserID,
+			client: &http.Client{Timeout: cfg.Timeout},
+		},
+	})
+	queueManager.Start()
+
+	targetManager := retrieval.NewTargetManager(queueManager)
+	if err := targetManager.ApplyConfig(conf); err != nil {
+		queueManager.Stop()
+		return nil, err
+	}
+	go targetManager.Run()
+
+	return &Agent{
+		targetManager: targetManager,
+		queueManager:  queueManager,
+	}, nil
+}
+
+// Stop stops scraping, and writes the samples still buffered.
+func (a *Agent) Stop() {
+	a.targetManager.Stop()
+	a.queueManager.Stop()
+}
+
+// client writes samples to Cortex, implementing remote.StorageClient.
+type client struct {
+	url    string
+	userID string
+	client *http.Client
+}
+
+// Store implements remote.StorageClient.
+func (c *client) Store(samples model.Samples) error {
+	ss := make([]model.Sample, 0, len(samples))
+	for _, s := range samples {
+		ss = append(ss, *s)
+	}
+	buf, err := proto.Marshal(util.ToWriteRequest(ss))
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	w := snappy.NewWriter(&body)
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", c.url, &body)
+	if err != nil {
+		return err
+	}
+	if c.userID != "" {
+		req.Header.Set("X-Scope-OrgID", c.userID)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("push failed with status %d: %s", resp.StatusCode, msg)
+	}
+	return nil
+}
+
+// Name implements remote.StorageClient.
+func (c *client) Name() string {
+	return c.url
+}
@@ -0,0 +1,35 @@
+package agent
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	var (
+		userID string
+		status = http.StatusOK
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID = r.Header.Get("X-Scope-OrgID")
+		_, err := ioutil.ReadAll(snappy.NewReader(r.Body))
+		require.NoError(t, err)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	c := &client{url: server.URL, userID: "1", client: http.DefaultClient}
+	samples := model.Samples{{Metric: model.Metric{model.MetricNameLabel: "foo"}, Value: 1, Timestamp: 1000}}
+	require.NoError(t, c.Store(samples))
+	assert.Equal(t, "1", userID)
+
+	status = http.StatusInternalServerError
+	assert.Error(t, c.Store(samples))
+}
@@ -24,6 +24,8 @@ import (
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/route"
 	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/cortex/util/validation"
 )
 
 const notificationLogMaintenancePeriod = 15 * time.Minute
@@ -37,6 +39,9 @@ type Config struct {
 	MeshRouter  *mesh.Router
 	Retention   time.Duration
 	ExternalURL *url.URL
+	Limits      *validation.Overrides
+	// Sends the notifications.
+	Client *http.Client
 }
 
 // An Alertmanager manages the alerts for one user.
@@ -184,6 +189,7 @@ func (am *Alertmanager) ApplyConfig(conf *config.Config) error {
 		am.nflog,
 		am.marker,
 	)
+	pipeline = newNotificationLimiter(am.cfg.UserID, am.cfg.Limits, am.cfg.Client, pipeline)
 	am.dispatcher = dispatch.NewDispatcher(am.alerts, dispatch.NewRoute(conf.Route, nil), pipeline, am.marker, timeoutFunc)
 
 	go am.dispatcher.Run()
@@ -0,0 +1,132 @@
+package alertmanager
+
+import (
+	gocontext "context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/alertmanager/notify"
+	"github.com/prometheus/alertmanager/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util/validation"
+)
+
+var (
+	rateLimitedNotifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "alertmanager_notifications_rate_limited_total",
+		Help:      "Notifications not sent, for exceeding the user's notification rate limit.",
+	}, []string{"user"})
+	disabledNotifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "alertmanager_notifications_disabled_total",
+		Help:      "Notifications dropped, as the user's notifications are disabled.",
+	}, []string{"user"})
+)
+
+func init() {
+	prometheus.MustRegister(rateLimitedNotifications)
+	prometheus.MustRegister(disabledNotifications)
+}
+
+// notificationLimiter limits the rate of a user's notifications, dropping
+// them while they're disabled, and tags them with the user, for the
+// firewall, and the client to send them with.
+type notificationLimiter struct {
+	userID string
+	limits *validation.Overrides
+	client *http.Client
+	next   notify.Stage
+
+	mtx     sync.Mutex
+	limiter *rate.Limiter
+}
+
+func newNotificationLimiter(userID string, limits *validation.Overrides, client *http.Client, next notify.Stage) *notificationLimiter {
+	return &notificationLimiter{
+		userID: userID,
+		limits: limits,
+		client: client,
+		next:   next,
+	}
+}
+
+// Exec implements notify.Stage.
+func (l *notificationLimiter) Exec(ctx context.Context, alerts ...*types.Alert) (context.Context, []*types.Alert, error) {
+	// Dropped without error, so they aren't retried, nor logged as sent:
+	// they'll be sent if still firing once notifications are enabled again.
+	if l.limits.AlertmanagerNotificationsDisabled(l.userID) {
+		disabledNotifications.WithLabelValues(l.userID).Inc()
+		return ctx, nil, nil
+	}
+	if !l.allow() {
+		rateLimitedNotifications.WithLabelValues(l.userID).Inc()
+		return ctx, nil, fmt.Errorf("notification rate limit (%v/s) exceeded", l.limits.AlertmanagerNotificationRateLimit(l.userID))
+	}
+	if l.client != nil {
+		ctx = notify.WithHTTPClient(ctx, l.client)
+	}
+	return l.next.Exec(user.Inject(ctx, l.userID), alerts...)
+}
+
+func (l *notificationLimiter) allow() bool {
+	limit := l.limits.AlertmanagerNotificationRateLimit(l.userID)
+	if limit <= 0 {
+		return true
+	}
+	burst := l.limits.AlertmanagerNotificationBurstSize(l.userID)
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	// The limits may have been overridden since the limiter was made.
+	if l.limiter == nil || l.limiter.Limit() != rate.Limit(limit) || l.limiter.Burst() != burst {
+		l.limiter = rate.NewLimiter(rate.Limit(limit), burst)
+	}
+	return l.limiter.Allow()
+}
+
+// firewallTransport is like http.DefaultTransport, but refuses to connect
+// notifications to addresses blocked for their user.  Addresses are checked
+// once resolved, and dialled as resolved, so DNS can't be used to get round
+// it.
+func firewallTransport(limits *validation.Overrides) http.RoundTripper {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		// The standard library's context, which the vendored one predates.
+		DialContext: func(ctx gocontext.Context, network, addr string) (net.Conn, error) {
+			userID, err := user.Extract(ctx)
+			if err != nil {
+				return dialer.DialContext(ctx, network, addr)
+			}
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			for _, ip := range ips {
+				if !limits.AlertmanagerReceiverBlocked(userID, ip.IP) {
+					return dialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port))
+				}
+			}
+			return nil, fmt.Errorf("notifications to %s are blocked by the firewall", host)
+		},
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
@@ -12,6 +12,7 @@ import (
 
 	"golang.org/x/net/context"
 
+	"github.com/prometheus/alertmanager/config"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 
@@ -19,6 +20,7 @@ import (
 	"github.com/weaveworks/common/user"
 	"github.com/weaveworks/cortex/configs"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/validation"
 	"github.com/weaveworks/mesh"
 )
 
@@ -56,6 +58,12 @@ type MultitenantAlertmanagerConfig struct {
 	PollInterval  time.Duration
 	ClientTimeout time.Duration
 
+	FallbackConfigFile string
+
+	// The defaults of the notification rate limits and receivers' firewall.
+	Limits          validation.Limits
+	OverridesConfig validation.OverridesConfig
+
 	MeshListenAddr string
 	MeshHWAddr     string
 	MeshNickname   string
@@ -73,6 +81,9 @@ func (cfg *MultitenantAlertmanagerConfig) RegisterFlags(f *flag.FlagSet) {
 	flag.Var(&cfg.ConfigsAPIURL, "alertmanager.configs.url", "URL of configs API server.")
 	flag.DurationVar(&cfg.PollInterval, "alertmanager.configs.poll-interval", 15*time.Second, "How frequently to poll Cortex configs")
 	flag.DurationVar(&cfg.ClientTimeout, "alertmanager.configs.client-timeout", 5*time.Second, "Timeout for requests to Weave Cloud configs service.")
+	cfg.Limits.RegisterAlertmanagerFlags(f)
+	cfg.OverridesConfig.RegisterFlags(f)
+	flag.StringVar(&cfg.FallbackConfigFile, "alertmanager.configs.fallback", "", "Filename of the Alertmanager config to use for users who haven't set one (empty to not serve them).")
 
 	flag.StringVar(&cfg.MeshListenAddr, "alertmanager.mesh.listen-address", net.JoinHostPort("0.0.0.0", strconv.Itoa(mesh.Port)), "Mesh listen address")
 	flag.StringVar(&cfg.MeshHWAddr, "alertmanager.mesh.hardware-address", mustHardwareAddr(), "MAC address, i.e. Mesh peer ID")
@@ -88,6 +99,13 @@ type MultitenantAlertmanager struct {
 
 	configsAPI configs.API
 
+	// Used for users without a config of their own, if set.
+	fallbackConfig *config.Config
+
+	limits *validation.Overrides
+	// Sends every Alertmanager's notifications, through the firewall.
+	client *http.Client
+
 	// All the organization configurations that we have. Only used for instrumentation.
 	cfgs map[string]configs.CortexConfig
 
@@ -110,6 +128,19 @@ func NewMultitenantAlertmanager(cfg *MultitenantAlertmanagerConfig) (*Multitenan
 		return nil, fmt.Errorf("unable to create Alertmanager data directory %q: %s", cfg.DataDir, err)
 	}
 
+	var fallbackConfig *config.Config
+	if cfg.FallbackConfigFile != "" {
+		fallbackConfig, err = config.LoadFile(cfg.FallbackConfigFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load fallback Alertmanager config %q: %s", cfg.FallbackConfigFile, err)
+		}
+	}
+
+	limits, err := validation.NewOverrides(cfg.OverridesConfig, cfg.Limits)
+	if err != nil {
+		return nil, err
+	}
+
 	mrouter := initMesh(cfg.MeshListenAddr, cfg.MeshHWAddr, cfg.MeshNickname, cfg.MeshPassword)
 
 	mrouter.Start()
@@ -123,13 +154,16 @@ func NewMultitenantAlertmanager(cfg *MultitenantAlertmanagerConfig) (*Multitenan
 	}
 
 	return &MultitenantAlertmanager{
-		cfg:           cfg,
-		configsAPI:    configsAPI,
-		cfgs:          map[string]configs.CortexConfig{},
-		alertmanagers: map[string]*Alertmanager{},
-		meshRouter:    mrouter,
-		stop:          make(chan struct{}),
-		done:          make(chan struct{}),
+		cfg:            cfg,
+		configsAPI:     configsAPI,
+		fallbackConfig: fallbackConfig,
+		limits:         limits,
+		client:         &http.Client{Transport: firewallTransport(limits)},
+		cfgs:           map[string]configs.CortexConfig{},
+		alertmanagers:  map[string]*Alertmanager{},
+		meshRouter:     mrouter,
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
 	}, nil
 }
 
@@ -161,6 +195,7 @@ func (am *MultitenantAlertmanager) Stop() {
 	for _, am := range am.alertmanagers {
 		am.Stop()
 	}
+	am.limits.Stop()
 	log.Debugf("MultitenantAlertmanager stopped")
 }
 
@@ -214,8 +249,8 @@ func (am *MultitenantAlertmanager) poll() (map[string]configs.CortexConfigView,
 func (am *MultitenantAlertmanager) addNewConfigs(cfgs map[string]configs.CortexConfigView) {
 	// TODO: instrument how many configs we have, both valid & invalid.
 	log.Debugf("Adding %d configurations", len(cfgs))
-	for userID, config := range cfgs {
-		amConfig, err := config.Config.GetAlertmanagerConfig()
+	for userID, cfg := range cfgs {
+		amConfig, err := am.getAlertmanagerConfig(cfg.Config)
 		if err != nil {
 			// XXX: This means that if a user has a working configuration and
 			// they submit a broken one, we'll keep processing the last known
@@ -226,38 +261,58 @@ func (am *MultitenantAlertmanager) addNewConfigs(cfgs map[string]configs.CortexC
 			continue
 		}
 
+		am.alertmanagersMtx.Lock()
 		// If no Alertmanager instance exists for this user yet, start one.
 		if _, ok := am.alertmanagers[userID]; !ok {
-			newAM, err := New(&Config{
-				UserID:      userID,
-				DataDir:     am.cfg.DataDir,
-				Logger:      log.NewLogger(os.Stderr),
-				MeshRouter:  am.meshRouter,
-				Retention:   am.cfg.Retention,
-				ExternalURL: am.cfg.ExternalURL.URL,
-			})
-			if err != nil {
+			if _, err := am.newAlertmanager(userID, amConfig); err != nil {
+				am.alertmanagersMtx.Unlock()
 				log.Warnf("MultitenantAlertmanager: unable to start Alertmanager for %v: %v", userID, err)
 				continue
 			}
-			am.alertmanagersMtx.Lock()
-			am.alertmanagers[userID] = newAM
-			am.alertmanagersMtx.Unlock()
-		}
-
-		// If the config changed, apply the new one.
-		if am.cfgs[userID].AlertmanagerConfig != config.Config.AlertmanagerConfig {
-			am.cfgs[userID] = config.Config
-			err := am.alertmanagers[userID].ApplyConfig(amConfig)
-			if err != nil {
+		} else if am.cfgs[userID].AlertmanagerConfig != cfg.Config.AlertmanagerConfig {
+			// If the config changed, apply the new one.
+			if err := am.alertmanagers[userID].ApplyConfig(amConfig); err != nil {
 				log.Warnf("MultitenantAlertmanager: unable to apply Alertmanager config for %v: %v", userID, err)
 			}
 		}
-
+		am.cfgs[userID] = cfg.Config
+		am.alertmanagersMtx.Unlock()
 	}
 	totalConfigs.Set(float64(len(am.cfgs)))
 }
 
+// getAlertmanagerConfig returns the fallback config for users who haven't
+// set one, if there is one.
+func (am *MultitenantAlertmanager) getAlertmanagerConfig(cfg configs.CortexConfig) (*config.Config, error) {
+	if cfg.AlertmanagerConfig == "" && am.fallbackConfig != nil {
+		return am.fallbackConfig, nil
+	}
+	return cfg.GetAlertmanagerConfig()
+}
+
+// newAlertmanager starts an Alertmanager for the user, with amConfig.  It
+// must be called with alertmanagersMtx held.
+func (am *MultitenantAlertmanager) newAlertmanager(userID string, amConfig *config.Config) (*Alertmanager, error) {
+	newAM, err := New(&Config{
+		UserID:      userID,
+		DataDir:     am.cfg.DataDir,
+		Logger:      log.NewLogger(os.Stderr),
+		MeshRouter:  am.meshRouter,
+		Retention:   am.cfg.Retention,
+		ExternalURL: am.cfg.ExternalURL.URL,
+		Limits:      am.limits,
+		Client:      am.client,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := newAM.ApplyConfig(amConfig); err != nil {
+		log.Warnf("MultitenantAlertmanager: unable to apply Alertmanager config for %v: %v", userID, err)
+	}
+	am.alertmanagers[userID] = newAM
+	return newAM, nil
+}
+
 // ServeHTTP serves the Alertmanager's web UI and API.
 func (am *MultitenantAlertmanager) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	userID, _, err := user.ExtractFromHTTPRequest(req)
@@ -267,6 +322,15 @@ func (am *MultitenantAlertmanager) ServeHTTP(w http.ResponseWriter, req *http.Re
 	}
 	am.alertmanagersMtx.Lock()
 	userAM, ok := am.alertmanagers[userID]
+	if !ok && am.fallbackConfig != nil {
+		// Users who have never set a config get the fallback one, so alerts
+		// sent for them aren't dropped.
+		userAM, err = am.newAlertmanager(userID, am.fallbackConfig)
+		ok = err == nil
+		if err != nil {
+			log.Warnf("MultitenantAlertmanager: unable to start Alertmanager for %v: %v", userID, err)
+		}
+	}
 	am.alertmanagersMtx.Unlock()
 	if !ok {
 		http.Error(w, fmt.Sprintf("no Alertmanager for this user ID"), http.StatusNotFound)
@@ -0,0 +1,282 @@
+package analytics
+
+import (
+	"bytes"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+)
+
+var (
+	exports = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "analytics_exports_total",
+		Help:      "The total number of query results exported, by whether they succeeded.",
+	}, []string{"result"})
+	lastExport = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cortex",
+		Name:      "analytics_last_export_timestamp_seconds",
+		Help:      "The evaluation time of the last round of exports which all succeeded.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(exports)
+	prometheus.MustRegister(lastExport)
+}
+
+// Config configures an Exporter.
+type Config struct {
+	QueriesFile  string
+	Interval     time.Duration
+	QueryTimeout time.Duration
+	S3           util.URLValue
+	Prefix       string
+
+	// For testing.
+	s3 chunk.S3Client
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.QueriesFile, "analytics.queries-file", "", "YAML file of the queries to evaluate for each tenant, see analytics.Queries.")
+	f.DurationVar(&cfg.Interval, "analytics.interval", time.Hour, "How often to evaluate the queries, at multiples of this since the epoch.")
+	f.DurationVar(&cfg.QueryTimeout, "analytics.query-timeout", time.Minute, "Timeout for evaluating each query.")
+	f.Var(&cfg.S3, "analytics.s3.url", "S3 URL of the bucket to write the results to, like -s3.url; GCS can be used via its S3-compatible API.")
+	f.StringVar(&cfg.Prefix, "analytics.prefix", "", "Prefix of the keys the results are written to.")
+}
+
+// Queries are the queries to evaluate for each tenant, loaded from YAML
+// like:
+//
+//	tenants:
+//	  acme:
+//	  - name: requests_by_service
+//	    query: sum by (service) (rate(requests_total[1h]))
+//
+// Each result is written to
+// <prefix><tenant>/<name>/<YYYY-MM-DD>/<evaluation time>.csv, with a column
+// for the evaluation time, the value, and each label.
+type Queries struct {
+	Tenants map[string][]Query `yaml:"tenants"`
+}
+
+// Query is a query to evaluate, named for where its results are written.
+type Query struct {
+	Name  string `yaml:"name"`
+	Query string `yaml:"query"`
+}
+
+var validName = regexp.MustCompile(`^[a-zA-Z0-9_\-]+$`)
+
+// LoadQueries reads and validates Queries from filename.
+func LoadQueries(filename string) (Queries, error) {
+	var queries Queries
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return queries, err
+	}
+	if err := yaml.Unmarshal(buf, &queries); err != nil {
+		return queries, err
+	}
+	for userID, userQueries := range queries.Tenants {
+		names := map[string]bool{}
+		for _, q := range userQueries {
+			if !validName.MatchString(q.Name) || names[q.Name] {
+				return queries, fmt.Errorf("invalid or duplicate query name %q for tenant %q", q.Name, userID)
+			}
+			names[q.Name] = true
+			if _, err := promql.ParseExpr(q.Query); err != nil {
+				return queries, fmt.Errorf("invalid query %q for tenant %q: %v", q.Name, userID, err)
+			}
+		}
+	}
+	return queries, nil
+}
+
+// Exporter periodically evaluates each tenant's queries, and writes their
+// results to an object store as CSV, for joining with other data in an
+// analytics warehouse.  Intervals missed, while the exporter wasn't running
+// or because their exports failed, aren't exported later.
+type Exporter struct {
+	cfg     Config
+	queries Queries
+	engine  *promql.Engine
+	s3      chunk.S3Client
+	bucket  string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   sync.WaitGroup
+}
+
+// New makes a new Exporter, evaluating queries with engine.
+func New(cfg Config, engine *promql.Engine) (*Exporter, error) {
+	if cfg.Interval <= 0 {
+		return nil, fmt.Errorf("invalid export interval %v", cfg.Interval)
+	}
+	queries, err := LoadQueries(cfg.QueriesFile)
+	if err != nil {
+		return nil, err
+	}
+	e := &Exporter{
+		cfg:     cfg,
+		queries: queries,
+		engine:  engine,
+		s3:      cfg.s3,
+	}
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	if e.s3 == nil {
+		e.s3, e.bucket, err = chunk.NewS3Client(cfg.S3.String())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// Start starts exporting, at the end of the current interval.
+func (e *Exporter) Start() {
+	e.done.Add(1)
+	go e.loop()
+}
+
+// Stop stops exporting, cancelling any exports in progress.
+func (e *Exporter) Stop() {
+	e.cancel()
+	e.done.Wait()
+}
+
+func (e *Exporter) loop() {
+	defer e.done.Done()
+	for {
+		now := time.Now()
+		next := now.Truncate(e.cfg.Interval).Add(e.cfg.Interval)
+		select {
+		case <-time.After(next.Sub(now)):
+			e.exportAll(e.ctx, model.TimeFromUnixNano(next.UnixNano()))
+		case <-e.ctx.Done():
+			return
+		}
+	}
+}
+
+// exportAll exports the result of every query, evaluated at ts, until ctx
+// is cancelled.
+func (e *Exporter) exportAll(ctx context.Context, ts model.Time) {
+	failed := false
+	for userID, userQueries := range e.queries.Tenants {
+		for _, q := range userQueries {
+			if ctx.Err() != nil {
+				return
+			}
+			if err := e.exportWithTimeout(user.Inject(ctx, userID), userID, q, ts); err != nil {
+				log.Errorf("Error exporting %s for %s: %v", q.Name, userID, err)
+				exports.WithLabelValues("failure").Inc()
+				failed = true
+				continue
+			}
+			exports.WithLabelValues("success").Inc()
+		}
+	}
+	if !failed {
+		lastExport.Set(float64(ts.Unix()))
+	}
+}
+
+func (e *Exporter) exportWithTimeout(ctx context.Context, userID string, q Query, ts model.Time) error {
+	if e.cfg.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.cfg.QueryTimeout)
+		defer cancel()
+	}
+	return e.export(ctx, userID, q, ts)
+}
+
+func (e *Exporter) export(ctx context.Context, userID string, q Query, ts model.Time) error {
+	query, err := e.engine.NewInstantQuery(q.Query, ts)
+	if err != nil {
+		return err
+	}
+	result := query.Exec(ctx)
+	if result.Err != nil {
+		return result.Err
+	}
+	var vector model.Vector
+	switch v := result.Value.(type) {
+	case model.Vector:
+		vector = v
+	case *model.Scalar:
+		vector = model.Vector{{Metric: model.Metric{}, Value: v.Value, Timestamp: v.Timestamp}}
+	default:
+		return fmt.Errorf("query returned a %s, not an instant vector or scalar", result.Value.Type())
+	}
+
+	body, err := encodeCSV(vector)
+	if err != nil {
+		return err
+	}
+	t := ts.Time().UTC()
+	_, err = e.s3.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(e.bucket),
+		Key:         aws.String(fmt.Sprintf("%s%s/%s/%s/%s.csv", e.cfg.Prefix, userID, q.Name, t.Format("2006-01-02"), t.Format(time.RFC3339))),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("text/csv"),
+	})
+	return err
+}
+
+// encodeCSV writes vector as CSV, with a header of the columns: timestamp,
+// value, and every label name in any of the samples, sorted.  Labels a
+// sample doesn't have are empty.
+func encodeCSV(vector model.Vector) ([]byte, error) {
+	names := map[model.LabelName]struct{}{}
+	for _, s := range vector {
+		for name := range s.Metric {
+			names[name] = struct{}{}
+		}
+	}
+	columns := make([]string, 0, len(names))
+	for name := range names {
+		columns = append(columns, string(name))
+	}
+	sort.Strings(columns)
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write(append([]string{"timestamp", "value"}, columns...)); err != nil {
+		return nil, err
+	}
+	// Sorted, so the rows are the same order each time.
+	sort.Slice(vector, func(i, j int) bool { return vector[i].Metric.Before(vector[j].Metric) })
+	for _, s := range vector {
+		row := []string{s.Timestamp.Time().UTC().Format(time.RFC3339), strconv.FormatFloat(float64(s.Value), 'g', -1, 64)}
+		for _, name := range columns {
+			row = append(row, string(s.Metric[model.LabelName(name)]))
+		}
+		if err := w.Write(row); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
@@ -0,0 +1,168 @@
+package analytics
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/querier"
+)
+
+// tenantQuerier returns the series of the user in the context.
+type tenantQuerier map[string]model.Matrix
+
+func (q tenantQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return q[userID], nil
+}
+
+func (q tenantQuerier) LabelValuesForLabelName(context.Context, model.LabelName) (model.LabelValues, error) {
+	return nil, nil
+}
+
+func (q tenantQuerier) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
+	return nil, nil
+}
+
+// blockingQuerier blocks queries until their context is done, saying when
+// each starts.
+type blockingQuerier struct {
+	tenantQuerier
+	started chan struct{}
+}
+
+func (q blockingQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	q.started <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+type mockS3 struct {
+	mtx     sync.Mutex
+	objects map[string]string
+}
+
+func (m *mockS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	buf, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.objects[aws.StringValue(input.Key)] = string(buf)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (m *mockS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	panic("not implemented")
+}
+
+func writeQueries(t *testing.T, queries string) string {
+	file, err := ioutil.TempFile("", "queries")
+	require.NoError(t, err)
+	_, err = file.WriteString(queries)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	return file.Name()
+}
+
+func TestExporter(t *testing.T) {
+	filename := writeQueries(t, `
+tenants:
+  "1":
+  - name: requests
+    query: sum by (job, code) (requests_total)
+  - name: count
+    query: scalar(count(requests_total))
+  "2":
+  - name: requests
+    query: requests_total
+`)
+	defer os.Remove(filename)
+
+	series := func(job, code string, value model.SampleValue) *model.SampleStream {
+		metric := model.Metric{model.MetricNameLabel: "requests_total", "job": model.LabelValue(job)}
+		if code != "" {
+			metric["code"] = model.LabelValue(code)
+		}
+		return &model.SampleStream{Metric: metric, Values: []model.SamplePair{{Timestamp: 0, Value: value}}}
+	}
+	queryable := querier.Queryable{Q: querier.MergeQuerier{Queriers: []querier.Querier{tenantQuerier{
+		"1": {series("b", "200", 3), series("a", "500", 1), series("a", "200", 2)},
+		"2": {series("c", "", 4)},
+	}}}}
+	store := &mockS3{objects: map[string]string{}}
+	e, err := New(Config{QueriesFile: filename, Interval: time.Hour, Prefix: "feed/", s3: store}, promql.NewEngine(queryable, nil))
+	require.NoError(t, err)
+
+	e.exportAll(context.Background(), model.TimeFromUnix(60))
+	assert.Equal(t, map[string]string{
+		"feed/1/requests/1970-01-01/1970-01-01T00:01:00Z.csv": `timestamp,value,code,job
+1970-01-01T00:01:00Z,2,200,a
+1970-01-01T00:01:00Z,3,200,b
+1970-01-01T00:01:00Z,1,500,a
+`,
+		"feed/1/count/1970-01-01/1970-01-01T00:01:00Z.csv": `timestamp,value
+1970-01-01T00:01:00Z,3
+`,
+		"feed/2/requests/1970-01-01/1970-01-01T00:01:00Z.csv": `timestamp,value,__name__,job
+1970-01-01T00:01:00Z,4,requests_total,c
+`,
+	}, store.objects)
+}
+
+func TestExporterCancelsExports(t *testing.T) {
+	filename := writeQueries(t, `
+tenants:
+  "1":
+  - name: requests
+    query: requests_total
+`)
+	defer os.Remove(filename)
+
+	q := blockingQuerier{started: make(chan struct{}, 1)}
+	queryable := querier.Queryable{Q: querier.MergeQuerier{Queriers: []querier.Querier{q}}}
+	store := &mockS3{objects: map[string]string{}}
+	e, err := New(Config{QueriesFile: filename, Interval: time.Hour, QueryTimeout: 10 * time.Millisecond, s3: store}, promql.NewEngine(queryable, nil))
+	require.NoError(t, err)
+
+	// Queries time out.
+	e.exportAll(context.Background(), model.TimeFromUnix(60))
+	<-q.started
+	assert.Empty(t, store.objects)
+
+	// And those in progress are cancelled when it's stopped.
+	e.cfg.Interval, e.cfg.QueryTimeout = time.Millisecond, time.Hour
+	e.Start()
+	<-q.started
+	e.Stop()
+	assert.Empty(t, store.objects)
+}
+
+func TestLoadQueries(t *testing.T) {
+	for _, queries := range []string{
+		"tenants:\n  \"1\":\n  - name: a/b\n    query: up\n",
+		"tenants:\n  \"1\":\n  - name: a\n    query: up\n  - name: a\n    query: up\n",
+		"tenants:\n  \"1\":\n  - name: a\n    query: up{\n",
+	} {
+		filename := writeQueries(t, queries)
+		_, err := LoadQueries(filename)
+		os.Remove(filename)
+		assert.Error(t, err, queries)
+	}
+}
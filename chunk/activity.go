@@ -0,0 +1,113 @@
+package chunk
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// TenantActivity records how much of a tenant's index was written to a
+// table on one day (UTC).
+type TenantActivity struct {
+	Day          time.Time `json:"day"`
+	Table        string    `json:"table"`
+	UserID       string    `json:"user"`
+	Chunks       int       `json:"chunks"`
+	IndexEntries int       `json:"index_entries"`
+	Bytes        int       `json:"bytes"`
+}
+
+type activityKey struct {
+	day    time.Time
+	table  string
+	userID string
+}
+
+// activityIndex records the tenants writing to each table, day by day, for
+// as long as the retention.  It's only of the writes through this process,
+// and only in memory, so it starts again empty on every restart.
+type activityIndex struct {
+	retention time.Duration
+
+	mtx        sync.Mutex
+	records    map[activityKey]*TenantActivity
+	lastPruned time.Time
+}
+
+func newActivityIndex(retention time.Duration) *activityIndex {
+	return &activityIndex{
+		retention: retention,
+		records:   map[activityKey]*TenantActivity{},
+	}
+}
+
+// record adds the activity of userID, per table, written at now.
+func (a *activityIndex) record(now time.Time, userID string, tables map[string]*TenantActivity) {
+	day := now.UTC().Truncate(24 * time.Hour)
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for table, written := range tables {
+		key := activityKey{day: day, table: table, userID: userID}
+		record, ok := a.records[key]
+		if !ok {
+			record = &TenantActivity{Day: day, Table: table, UserID: userID}
+			a.records[key] = record
+		}
+		record.Chunks += written.Chunks
+		record.IndexEntries += written.IndexEntries
+		record.Bytes += written.Bytes
+	}
+	// Days only expire when a new one starts.
+	if day.After(a.lastPruned) {
+		a.lastPruned = day
+		for key := range a.records {
+			if day.Sub(key.day) > a.retention {
+				delete(a.records, key)
+			}
+		}
+	}
+}
+
+// list returns the records for userID and table (or all, if empty), by
+// day, table and tenant.
+func (a *activityIndex) list(userID, table string) []TenantActivity {
+	a.mtx.Lock()
+	result := make([]TenantActivity, 0, len(a.records))
+	for key, record := range a.records {
+		if (userID == "" || key.userID == userID) && (table == "" || key.table == table) {
+			result = append(result, *record)
+		}
+	}
+	a.mtx.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		switch {
+		case !result[i].Day.Equal(result[j].Day):
+			return result[i].Day.Before(result[j].Day)
+		case result[i].Table != result[j].Table:
+			return result[i].Table < result[j].Table
+		default:
+			return result[i].UserID < result[j].UserID
+		}
+	})
+	return result
+}
+
+// ActivityHandler lists which tenants wrote how much to which tables, day
+// by day, optionally for one user and table (the user and table
+// parameters).  It's an admin API, so not scoped to a tenant, and must be
+// served behind admin authentication.
+func (c *Store) ActivityHandler(w http.ResponseWriter, r *http.Request) {
+	if c.activity == nil {
+		http.Error(w, "tenant activity isn't being recorded", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.activity.list(r.FormValue("user"), r.FormValue("table"))); err != nil {
+		log.Errorf("Error writing tenant activity: %v", err)
+	}
+}
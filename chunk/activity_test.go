@@ -0,0 +1,81 @@
+package chunk
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+)
+
+func TestActivityHandler(t *testing.T) {
+	dynamoDB := NewMockStorage()
+	setupDynamodb(t, dynamoDB)
+	store, err := NewStore(StoreConfig{
+		mockDynamoDB:      dynamoDB,
+		mockS3:            NewMockS3(),
+		schemaFactory:     v6Schema,
+		ActivityRetention: 24 * time.Hour,
+	})
+	require.NoError(t, err)
+
+	now := model.Now()
+	chunks, _ := chunk.New().Add(model.SamplePair{Timestamp: now, Value: 0})
+	for _, userID := range []string{"1", "2"} {
+		var put []Chunk
+		for i := 0; i < 2; i++ {
+			put = append(put, NewChunk(model.Fingerprint(i), model.Metric{
+				model.MetricNameLabel: "foo",
+				"i":                   model.LabelValue(strconv.Itoa(i)),
+			}, chunks[0], now.Add(-time.Hour), now))
+		}
+		require.NoError(t, store.Put(user.Inject(context.Background(), userID), put))
+	}
+
+	list := func(url string) []TenantActivity {
+		rec := httptest.NewRecorder()
+		store.ActivityHandler(rec, httptest.NewRequest("GET", url, nil))
+		var result []TenantActivity
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+		return result
+	}
+	all := list("/activity")
+	require.Len(t, all, 2)
+	assert.Equal(t, "1", all[0].UserID)
+	assert.Equal(t, "2", all[1].UserID)
+	for _, record := range all {
+		assert.Equal(t, 2, record.Chunks)
+		assert.True(t, record.IndexEntries >= 2, "%d", record.IndexEntries)
+		assert.True(t, record.Bytes > 0)
+		assert.Equal(t, time.Now().UTC().Truncate(24*time.Hour), record.Day.UTC())
+	}
+
+	assert.Len(t, list("/activity?user=2"), 1)
+	assert.Len(t, list("/activity?table="+all[0].Table), 2)
+	assert.Len(t, list("/activity?table=nonexistent"), 0)
+}
+
+func TestActivityRetention(t *testing.T) {
+	a := newActivityIndex(48 * time.Hour)
+	day := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	written := map[string]*TenantActivity{"table": {Chunks: 1, IndexEntries: 3, Bytes: 100}}
+	a.record(day, "1", written)
+	a.record(day.Add(time.Hour), "1", written)
+	a.record(day.Add(24*time.Hour), "2", written)
+	assert.Equal(t, []TenantActivity{
+		{Day: day.Truncate(24 * time.Hour), Table: "table", UserID: "1", Chunks: 2, IndexEntries: 6, Bytes: 200},
+		{Day: day.Add(24 * time.Hour).Truncate(24 * time.Hour), Table: "table", UserID: "2", Chunks: 1, IndexEntries: 3, Bytes: 100},
+	}, a.list("", ""))
+
+	a.record(day.Add(72*time.Hour), "2", written)
+	assert.Len(t, a.list("1", ""), 0)
+	assert.Len(t, a.list("2", ""), 2)
+}
@@ -0,0 +1,388 @@
+package chunk
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/instrument"
+)
+
+const (
+	azureAPIVersion      = "2018-03-28"
+	azureStorageResource = "https://storage.azure.com/"
+	azureIMDSTokenURL    = "http://169.254.169.254/metadata/identity/oauth2/token"
+	azureIMDSAPIVersion  = "2018-02-01"
+
+	// Refresh managed identity tokens this long before they expire.
+	azureTokenRefreshMargin = 5 * time.Minute
+)
+
+var azureRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "cortex",
+	Name:      "azure_blob_request_duration_seconds",
+	Help:      "Time spent doing Azure Blob Storage requests.",
+	Buckets:   []float64{.025, .05, .1, .25, .5, 1, 2},
+}, []string{"operation", "status_code"})
+
+func init() {
+	prometheus.MustRegister(azureRequestDuration)
+}
+
+// AzureBlobConfig configures the Azure Blob Storage chunk client.
+type AzureBlobConfig struct {
+	AccountName        string
+	AccountKey         string
+	UseManagedIdentity bool
+	ContainerName      string
+	ContainerPeriod    time.Duration
+	MaxRetries         int
+	Endpoint           string
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *AzureBlobConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.AccountName, "azure.account-name", "", "Azure storage account name.")
+	f.StringVar(&cfg.AccountKey, "azure.account-key", "", "Azure storage account key (base64).")
+	f.BoolVar(&cfg.UseManagedIdentity, "azure.use-managed-identity", false, "Authenticate using the VM's managed identity instead of an account key.")
+	f.StringVar(&cfg.ContainerName, "azure.container-name", "cortex", "Name of the blob container to store chunks in, or the prefix when using -azure.container-period.")
+	f.DurationVar(&cfg.ContainerPeriod, "azure.container-period", 0, "If non-zero, store chunks in a new container every period, named <container-name>-<period number>.")
+	f.IntVar(&cfg.MaxRetries, "azure.max-retries", 5, "Number of times to retry a failed blob request.")
+	f.StringVar(&cfg.Endpoint, "azure.endpoint", "", "Override the blob service endpoint; defaults to https://<account-name>.blob.core.windows.net.")
+}
+
+type azureBlobClient struct {
+	cfg      AzureBlobConfig
+	endpoint *url.URL
+	key      []byte
+	tokens   *azureTokenSource
+	client   *http.Client
+
+	containersMtx sync.Mutex
+	containers    map[string]struct{}
+}
+
+// NewAzureBlobClient makes a new ObjectClient backed by Azure Blob Storage.
+func NewAzureBlobClient(cfg AzureBlobConfig) (ObjectClient, error) {
+	client, err := newAzureBlobClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return blobObjectClient{client}, nil
+}
+
+func newAzureBlobClient(cfg AzureBlobConfig) (*azureBlobClient, error) {
+	if cfg.AccountName == "" {
+		return nil, fmt.Errorf("-azure.account-name is required")
+	}
+	if cfg.ContainerPeriod < 0 {
+		return nil, fmt.Errorf("-azure.container-period must not be negative")
+	}
+
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", cfg.AccountName)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &azureBlobClient{
+		cfg:        cfg,
+		endpoint:   u,
+		client:     &http.Client{},
+		containers: map[string]struct{}{},
+	}
+	if cfg.UseManagedIdentity {
+		client.tokens = &azureTokenSource{
+			url:    azureIMDSTokenURL,
+			client: client.client,
+		}
+	} else {
+		client.key, err = base64.StdEncoding.DecodeString(cfg.AccountKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -azure.account-key: %v", err)
+		}
+	}
+	return client, nil
+}
+
+func (c *azureBlobClient) putBlob(ctx context.Context, userID string, chunk *Chunk, buf []byte) error {
+	container := c.containerFor(chunk)
+	if err := c.ensureContainer(ctx, container); err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("x-ms-blob-type", "BlockBlob")
+	header.Set("Content-Type", "application/octet-stream")
+	_, err := c.do(ctx, "Azure.PutBlob", "PUT", c.blobURL(container, chunkName(userID, chunk.ID)), header, buf)
+	return err
+}
+
+func (c *azureBlobClient) getBlob(ctx context.Context, userID string, chunk *Chunk) ([]byte, error) {
+	return c.do(ctx, "Azure.GetBlob", "GET", c.blobURL(c.containerFor(chunk), chunkName(userID, chunk.ID)), nil, nil)
+}
+
+func (c *azureBlobClient) containerFor(chunk *Chunk) string {
+	if c.cfg.ContainerPeriod == 0 {
+		return c.cfg.ContainerName
+	}
+	period := int64(c.cfg.ContainerPeriod / time.Millisecond)
+	return fmt.Sprintf("%s-%d", c.cfg.ContainerName, int64(chunk.From)/period)
+}
+
+func (c *azureBlobClient) blobURL(container, blob string) *url.URL {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + container + "/" + blob
+	return &u
+}
+
+// ensureContainer creates the container the first time we write to it.
+func (c *azureBlobClient) ensureContainer(ctx context.Context, container string) error {
+	c.containersMtx.Lock()
+	_, ok := c.containers[container]
+	c.containersMtx.Unlock()
+	if ok {
+		return nil
+	}
+
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + container
+	u.RawQuery = "restype=container"
+	_, err := c.do(ctx, "Azure.CreateContainer", "PUT", &u, nil, nil)
+	if aerr, ok := err.(azureError); err != nil && (!ok || aerr.statusCode != http.StatusConflict) {
+		return err
+	}
+
+	c.containersMtx.Lock()
+	c.containers[container] = struct{}{}
+	c.containersMtx.Unlock()
+	return nil
+}
+
+type azureError struct {
+	statusCode int
+	body       string
+}
+
+func (e azureError) Error() string {
+	return fmt.Sprintf("azure blob request failed: %d %s", e.statusCode, e.body)
+}
+
+func (e azureError) retryable() bool {
+	return e.statusCode == http.StatusTooManyRequests || e.statusCode/100 == 5
+}
+
+// do issues a request, retrying throttled, server and network errors, and
+// returns the response body.
+func (c *azureBlobClient) do(ctx context.Context, operation, method string, u *url.URL, header http.Header, body []byte) ([]byte, error) {
+	var (
+		result  []byte
+		err     error
+		backoff = minBackoff
+	)
+	for tries := 0; ; tries++ {
+		err = instrument.TimeRequestHistogram(ctx, operation, azureRequestDuration, func(ctx context.Context) error {
+			var err error
+			result, err = c.doOnce(ctx, method, u, header, body)
+			return err
+		})
+		if err == nil {
+			return result, nil
+		}
+		if err, ok := err.(azureError); ok && !err.retryable() {
+			return nil, err
+		}
+		if tries >= c.cfg.MaxRetries {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+func (c *azureBlobClient) doOnce(ctx context.Context, method string, u *url.URL, header http.Header, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("x-ms-version", azureAPIVersion)
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+
+	if c.tokens != nil {
+		token, err := c.tokens.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else {
+		req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", c.cfg.AccountName, c.sign(req, len(body))))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, azureError{statusCode: resp.StatusCode, body: string(buf)}
+	}
+	return buf, nil
+}
+
+// sign computes the Shared Key signature for req, see
+// https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func (c *azureBlobClient) sign(req *http.Request, contentLength int) string {
+	length := ""
+	if contentLength > 0 {
+		length = strconv.Itoa(contentLength)
+	}
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date; we send x-ms-date instead.
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}, "\n") + "\n" + canonicalizedHeaders(req.Header) + c.canonicalizedResource(req.URL)
+
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func canonicalizedHeaders(header http.Header) string {
+	names := []string{}
+	for k := range header {
+		if name := strings.ToLower(k); strings.HasPrefix(name, "x-ms-") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		buf.WriteString(name)
+		buf.WriteString(":")
+		buf.WriteString(strings.TrimSpace(header.Get(name)))
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+func (c *azureBlobClient) canonicalizedResource(u *url.URL) string {
+	var buf bytes.Buffer
+	buf.WriteString("/")
+	buf.WriteString(c.cfg.AccountName)
+	buf.WriteString(u.EscapedPath())
+
+	query := u.Query()
+	keys := []string{}
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		buf.WriteString("\n")
+		buf.WriteString(strings.ToLower(k))
+		buf.WriteString(":")
+		buf.WriteString(strings.Join(values, ","))
+	}
+	return buf.String()
+}
+
+// azureTokenSource fetches and caches OAuth tokens from the instance
+// metadata service, for use with managed identities.
+type azureTokenSource struct {
+	url    string
+	client *http.Client
+
+	mtx    sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func (s *azureTokenSource) get(ctx context.Context) (string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.token != "" && time.Now().Add(azureTokenRefreshMargin).Before(s.expiry) {
+		return s.token, nil
+	}
+
+	req, err := http.NewRequest("GET", s.url, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.URL.RawQuery = url.Values{
+		"api-version": []string{azureIMDSAPIVersion},
+		"resource":    []string{azureStorageResource},
+	}.Encode()
+	req.Header.Set("Metadata", "true")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		buf, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("error fetching managed identity token: %d %s", resp.StatusCode, buf)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	expiresOn, err := strconv.ParseInt(token.ExpiresOn, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid managed identity token expiry %q: %v", token.ExpiresOn, err)
+	}
+
+	s.token = token.AccessToken
+	s.expiry = time.Unix(expiresOn, 0)
+	return s.token, nil
+}
@@ -0,0 +1,142 @@
+package chunk
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	prom_chunk "github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// fakeAzure is a minimal in-memory blob service.
+type fakeAzure struct {
+	mtx        sync.Mutex
+	containers map[string]struct{}
+	blobs      map[string][]byte
+	failPuts   int
+	auth       []string
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.auth = append(f.auth, r.Header.Get("Authorization"))
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	switch {
+	case r.Method == "PUT" && r.URL.Query().Get("restype") == "container":
+		if _, ok := f.containers[parts[0]]; ok {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.containers[parts[0]] = struct{}{}
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == "PUT":
+		if f.failPuts > 0 {
+			f.failPuts--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if _, ok := f.containers[parts[0]]; !ok || r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		buf, _ := ioutil.ReadAll(r.Body)
+		f.blobs[r.URL.Path] = buf
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == "GET":
+		buf, ok := f.blobs[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(buf)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func dummyObjectChunk(from model.Time) Chunk {
+	cs, _ := prom_chunk.New().Add(model.SamplePair{Timestamp: from, Value: 0})
+	return NewChunk(
+		model.Fingerprint(1),
+		model.Metric{model.MetricNameLabel: "foo"},
+		cs[0],
+		from,
+		from.Add(time.Minute),
+	)
+}
+
+func newTestAzureClient(t *testing.T, period time.Duration) (*fakeAzure, ObjectClient, func()) {
+	fake := &fakeAzure{
+		containers: map[string]struct{}{},
+		blobs:      map[string][]byte{},
+	}
+	server := httptest.NewServer(fake)
+	client, err := NewAzureBlobClient(AzureBlobConfig{
+		AccountName:     "account",
+		AccountKey:      base64.StdEncoding.EncodeToString([]byte("secret")),
+		ContainerName:   "chunks",
+		ContainerPeriod: period,
+		MaxRetries:      3,
+		Endpoint:        server.URL,
+	})
+	require.NoError(t, err)
+	return fake, client, server.Close
+}
+
+func TestAzureBlobClientRoundTrip(t *testing.T) {
+	fake, client, cleanup := newTestAzureClient(t, 0)
+	defer cleanup()
+	fake.failPuts = 2
+
+	ctx := context.Background()
+	chunk := dummyObjectChunk(model.Now())
+	require.NoError(t, client.PutChunk(ctx, "userID", &chunk))
+
+	fetched := Chunk{ID: chunk.ID, From: chunk.From, Through: chunk.Through}
+	require.NoError(t, client.GetChunk(ctx, "userID", &fetched))
+	assert.Equal(t, chunk.Metric, fetched.Metric)
+	assert.Equal(t, chunk.Data.Len(), fetched.Data.Len())
+
+	assert.Contains(t, fake.containers, "chunks")
+	for _, auth := range fake.auth {
+		assert.True(t, strings.HasPrefix(auth, "SharedKey account:"), auth)
+	}
+}
+
+func TestAzureBlobClientContainerPeriod(t *testing.T) {
+	fake, client, cleanup := newTestAzureClient(t, 24*time.Hour)
+	defer cleanup()
+
+	ctx := context.Background()
+	day := model.Time(24 * time.Hour / time.Millisecond)
+	for _, from := range []model.Time{0, day + 1, day + 2} {
+		chunk := dummyObjectChunk(from)
+		require.NoError(t, client.PutChunk(ctx, "userID", &chunk))
+	}
+	assert.Equal(t, map[string]struct{}{"chunks-0": {}, "chunks-1": {}}, fake.containers)
+}
+
+func TestAzureBlobClientCancelled(t *testing.T) {
+	fake, client, cleanup := newTestAzureClient(t, 0)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	chunk := dummyObjectChunk(model.Now())
+	require.Error(t, client.PutChunk(ctx, "userID", &chunk))
+	assert.Empty(t, fake.auth)
+}
@@ -17,6 +17,17 @@ import (
 	"github.com/weaveworks/cortex/util"
 )
 
+// Snappy readers and writers allocate ~140KiB and ~76KiB of buffers
+// respectively, many times the size of the chunk metadata they're used for.
+var (
+	snappyReaders = util.NewPool("chunk_snappy_reader", func() interface{} {
+		return snappy.NewReader(nil)
+	})
+	snappyWriters = util.NewPool("chunk_snappy_writer", func() interface{} {
+		return snappy.NewWriter(nil)
+	})
+)
+
 // Chunk contains encoded timeseries data
 type Chunk struct {
 	ID      string       `json:"-"`
@@ -67,7 +78,12 @@ func parseChunkID(id string) (model.Fingerprint, model.Time, model.Time, error)
 func (c *Chunk) reader() (io.ReadSeeker, error) {
 	// Encode chunk metadata into snappy-compressed buffer
 	var metadata bytes.Buffer
-	if err := json.NewEncoder(snappy.NewWriter(&metadata)).Encode(c); err != nil {
+	sw := snappyWriters.Get().(*snappy.Writer)
+	sw.Reset(&metadata)
+	err := json.NewEncoder(sw).Encode(c)
+	sw.Reset(nil)
+	snappyWriters.Put(sw)
+	if err != nil {
 		return nil, err
 	}
 
@@ -108,10 +124,14 @@ func (c *Chunk) decode(r io.Reader) error {
 		return err
 	}
 
-	err := json.NewDecoder(snappy.NewReader(&io.LimitedReader{
+	sr := snappyReaders.Get().(*snappy.Reader)
+	sr.Reset(&io.LimitedReader{
 		N: int64(metadataLen),
 		R: r,
-	})).Decode(c)
+	})
+	err := json.NewDecoder(sr).Decode(c)
+	sr.Reset(nil)
+	snappyReaders.Put(sr)
 	if err != nil {
 		return err
 	}
@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"sync"
 	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
@@ -34,12 +35,19 @@ var (
 		// Memecache requests are very quick: smallest bucket is 16us, biggest is 1s
 		Buckets: prometheus.ExponentialBuckets(0.000016, 4, 8),
 	}, []string{"method", "status_code"})
+
+	memcacheQuotaSkipped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "memcache_quota_skipped_total",
+		Help:      "Total count of chunks not stored in memcache, as their tenant was over its quota.",
+	})
 )
 
 func init() {
 	prometheus.MustRegister(memcacheRequests)
 	prometheus.MustRegister(memcacheHits)
 	prometheus.MustRegister(memcacheRequestDuration)
+	prometheus.MustRegister(memcacheQuotaSkipped)
 }
 
 // Memcache caches things
@@ -52,18 +60,26 @@ type Memcache interface {
 type CacheConfig struct {
 	Expiration     time.Duration
 	memcacheConfig MemcacheConfig
+
+	TenantQuotaBytes  int64
+	TenantQuotaPeriod time.Duration
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
 func (cfg *CacheConfig) RegisterFlags(f *flag.FlagSet) {
 	f.DurationVar(&cfg.Expiration, "memcached.expiration", 0, "How long chunks stay in the memcache.")
 	cfg.memcacheConfig.RegisterFlags(f)
+	f.Int64Var(&cfg.TenantQuotaBytes, "memcached.tenant-quota-bytes", 0, "Approximate maximum bytes of chunks each tenant may store in memcache from each process: chunks aren't stored for tenants which have stored more in the last quota period (0 for no quota).  It's counted per process, so divide the tenant's share of memcache by the number of processes writing to it.")
+	f.DurationVar(&cfg.TenantQuotaPeriod, "memcached.tenant-quota-period", time.Hour, "Period over which tenants' bytes stored in memcache are counted towards their quota; about how long chunks stay in memcache before expiring or being evicted.")
 }
 
-// Cache type caches chunks
+// Cache type caches chunks.  Each tenant's are kept under their own prefix
+// of the keyspace, and optionally limited to a quota, so one tenant's giant
+// queries can't evict everyone else's chunks.
 type Cache struct {
 	cfg      CacheConfig
 	memcache Memcache
+	quotas   *tenantQuotas
 }
 
 // NewCache makes a new Cache
@@ -72,10 +88,14 @@ func NewCache(cfg CacheConfig) *Cache {
 	if cfg.memcacheConfig.Host != "" {
 		memcache = NewMemcacheClient(cfg.memcacheConfig)
 	}
-	return &Cache{
+	c := &Cache{
 		cfg:      cfg,
 		memcache: memcache,
 	}
+	if cfg.TenantQuotaBytes > 0 {
+		c.quotas = newTenantQuotas(cfg.TenantQuotaBytes, cfg.TenantQuotaPeriod)
+	}
+	return c
 }
 
 func memcacheStatusCode(err error) string {
@@ -153,6 +173,10 @@ func (c *Cache) StoreChunkData(ctx context.Context, userID string, chunk *Chunk)
 	if err != nil {
 		return err
 	}
+	if !c.quotas.allow(userID, len(buf)) {
+		memcacheQuotaSkipped.Inc()
+		return nil
+	}
 
 	return instrument.TimeRequestHistogramStatus(ctx, "Memcache.Put", memcacheRequestDuration, memcacheStatusCode, func(_ context.Context) error {
 		item := memcache.Item{
@@ -180,3 +204,80 @@ func (c *Cache) StoreChunks(ctx context.Context, userID string, chunks []Chunk)
 	}
 	return errOut
 }
+
+// tenantQuotas approximates how many bytes each tenant has in memcache by
+// how many they've stored in the last period, which is estimated from the
+// bytes stored in this period and the previous one, weighted by how much of
+// the previous one is still within the last period.  It only counts what
+// this process stores.  Tenants which haven't stored anything for two
+// periods are forgotten.  A nil *tenantQuotas allows everything.
+type tenantQuotas struct {
+	quota  int64
+	period time.Duration
+
+	mtx       sync.Mutex
+	tenants   map[string]*tenantUsage
+	lastSweep time.Time
+
+	// For testing.
+	now func() time.Time
+}
+
+type tenantUsage struct {
+	periodStart       time.Time
+	current, previous int64
+}
+
+func newTenantQuotas(quota int64, period time.Duration) *tenantQuotas {
+	return &tenantQuotas{
+		quota:   quota,
+		period:  period,
+		tenants: map[string]*tenantUsage{},
+		now:     time.Now,
+	}
+}
+
+// sweep forgets tenants whose usage has expired, at most once a period.
+// The caller must hold mtx.
+func (q *tenantQuotas) sweep(now time.Time) {
+	if now.Sub(q.lastSweep) < q.period {
+		return
+	}
+	q.lastSweep = now
+	for userID, u := range q.tenants {
+		if now.Sub(u.periodStart) >= 2*q.period {
+			delete(q.tenants, userID)
+		}
+	}
+}
+
+// allow returns whether userID may store size more bytes, counting them if
+// so.
+func (q *tenantQuotas) allow(userID string, size int) bool {
+	if q == nil {
+		return true
+	}
+	now := q.now()
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.sweep(now)
+	u, ok := q.tenants[userID]
+	if !ok {
+		u = &tenantUsage{periodStart: now}
+		q.tenants[userID] = u
+	}
+	if elapsed := now.Sub(u.periodStart); elapsed >= 2*q.period {
+		u.periodStart, u.current, u.previous = now, 0, 0
+	} else if elapsed >= q.period {
+		u.periodStart, u.current, u.previous = u.periodStart.Add(q.period), 0, u.current
+	}
+
+	remaining := 1 - float64(now.Sub(u.periodStart))/float64(q.period)
+	used := u.current + int64(float64(u.previous)*remaining)
+	if used+int64(size) > q.quota {
+		return false
+	}
+	u.current += int64(size)
+	return true
+}
@@ -0,0 +1,90 @@
+package chunk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type mockMemcache map[string]*memcache.Item
+
+func (m mockMemcache) GetMulti(keys []string) (map[string]*memcache.Item, error) {
+	result := map[string]*memcache.Item{}
+	for _, key := range keys {
+		if item, ok := m[key]; ok {
+			result[key] = item
+		}
+	}
+	return result, nil
+}
+
+func (m mockMemcache) Set(item *memcache.Item) error {
+	m[item.Key] = item
+	return nil
+}
+
+func TestTenantQuotas(t *testing.T) {
+	now := time.Unix(0, 0)
+	q := newTenantQuotas(100, time.Hour)
+	q.now = func() time.Time { return now }
+
+	assert.True(t, q.allow("1", 60))
+	assert.False(t, q.allow("1", 60))
+	assert.True(t, q.allow("1", 40))
+	assert.True(t, q.allow("2", 100), "tenants have their own quotas")
+
+	// What was stored in the previous period counts for as much of it as
+	// is still within the last period.
+	now = now.Add(90 * time.Minute)
+	assert.False(t, q.allow("1", 60))
+	assert.True(t, q.allow("1", 50))
+
+	now = now.Add(2 * time.Hour)
+	assert.True(t, q.allow("1", 100))
+
+	var unlimited *tenantQuotas
+	assert.True(t, unlimited.allow("1", 1000))
+}
+
+func TestTenantQuotasForgetIdleTenants(t *testing.T) {
+	now := time.Unix(0, 0)
+	q := newTenantQuotas(100, time.Hour)
+	q.now = func() time.Time { return now }
+
+	assert.True(t, q.allow("1", 10))
+	assert.True(t, q.allow("2", 10))
+	now = now.Add(90 * time.Minute)
+	assert.True(t, q.allow("2", 10))
+	assert.Len(t, q.tenants, 2)
+
+	// 1 hasn't stored anything for two periods.
+	now = now.Add(time.Hour)
+	assert.True(t, q.allow("2", 10))
+	assert.Len(t, q.tenants, 1)
+	assert.Contains(t, q.tenants, "2")
+}
+
+func TestCacheTenantQuota(t *testing.T) {
+	mc := mockMemcache{}
+	cache := &Cache{
+		memcache: mc,
+		quotas:   newTenantQuotas(1, time.Hour),
+	}
+	through := model.Now()
+	chunks, _ := chunk.New().Add(model.SamplePair{Timestamp: through, Value: 0})
+	c := NewChunk(model.Fingerprint(1), model.Metric{model.MetricNameLabel: "foo"}, chunks[0], through, through)
+
+	// Chunks of tenants over their quota aren't stored.
+	require.NoError(t, cache.StoreChunkData(context.Background(), "1", &c))
+	assert.Empty(t, mc)
+
+	cache.quotas = nil
+	require.NoError(t, cache.StoreChunkData(context.Background(), "1", &c))
+	assert.Contains(t, mc, memcacheKey("1", c.ID))
+}
@@ -4,19 +4,19 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"regexp"
 	"sort"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/metric"
-	"github.com/weaveworks/common/instrument"
 	"golang.org/x/net/context"
 
 	"github.com/weaveworks/common/user"
 	"github.com/weaveworks/cortex/util"
+	cortex_errors "github.com/weaveworks/cortex/util/errors"
 )
 
 var (
@@ -53,12 +53,42 @@ func init() {
 type StoreConfig struct {
 	SchemaConfig
 	CacheConfig
+	WriteQueueConfig
+	IndexCacheConfig
 	S3       util.URLValue
+	S3SSE    S3SSEConfig
 	DynamoDB util.URLValue
 
+	// Which stores to keep the index (dynamodb) and chunks (s3, azure or
+	// swift) in.
+	IndexStore  string
+	ObjectStore string
+	Azure       AzureBlobConfig
+	Swift       SwiftConfig
+	Encryption  EncryptionConfig
+
+	S3HedgePercentile float64
+
+	// Shed requests to persistently throttled tables, see circuitBreakers.
+	CircuitBreaker CircuitBreakerConfig
+
+	MaxChunksPerQuery int
+
+	// YAML file of tenants to keep apart from the others, see TenantIsolation.
+	TenantIsolationFile string
+
+	// How long to keep the record of tenants' writes to each table.
+	ActivityRetention time.Duration
+
+	// A secondary store to mirror writes to, see MirrorStore.
+	Mirror MirrorConfig
+
+	// The store chunks were kept in before some time, see CutoverStore.
+	Previous PreviousStoreConfig
+
 	mockS3         S3Client
 	mockBucketName string
-	mockDynamoDB   StorageClient
+	mockDynamoDB   IndexClient
 	mockTableName  string
 
 	// For injecting different schemas in tests.
@@ -69,48 +99,79 @@ type StoreConfig struct {
 func (cfg *StoreConfig) RegisterFlags(f *flag.FlagSet) {
 	cfg.SchemaConfig.RegisterFlags(f)
 	cfg.CacheConfig.RegisterFlags(f)
+	cfg.WriteQueueConfig.RegisterFlags(f)
+	cfg.IndexCacheConfig.RegisterFlags(f)
+	cfg.CircuitBreaker.RegisterFlags(f)
+	cfg.S3SSE.RegisterFlags(f)
+	cfg.Azure.RegisterFlags(f)
+	cfg.Swift.RegisterFlags(f)
+	cfg.Encryption.RegisterFlags(f)
+	cfg.Mirror.RegisterFlags(f)
+	cfg.Previous.RegisterFlags(f)
+	f.StringVar(&cfg.IndexStore, "store.index-store", "dynamodb", "Store to keep the chunk index in: dynamodb.")
+	f.StringVar(&cfg.ObjectStore, "store.object-store", "s3", "Object store to keep chunks in: s3, azure, swift, or dynamodb (in the tables named by -dynamodb.chunk-table.prefix).")
+	f.Float64Var(&cfg.S3HedgePercentile, "s3.hedge-percentile", 0, "Issue a second S3 GET for a chunk if the first takes longer than this percentile of recent GETs, eg 0.95 (0 to disable).")
 
 	f.Var(&cfg.S3, "s3.url", "S3 endpoint URL with escaped Key and Secret encoded. "+
 		"If only region is specified as a host, proper endpoint will be deducted.")
 	f.Var(&cfg.DynamoDB, "dynamodb.url", "DynamoDB endpoint URL with escaped Key and Secret encoded. "+
 		"If only region is specified as a host, proper endpoint will be deducted.")
+	f.IntVar(&cfg.MaxChunksPerQuery, "store.max-chunks-per-query", 0, "Maximum number of chunks a single query may fetch (0 to disable).")
+	f.StringVar(&cfg.TenantIsolationFile, "store.tenant-isolation-config", "", "YAML file of tenants whose chunks and index are stored separately from everyone else's.")
+	f.DurationVar(&cfg.ActivityRetention, "store.activity-retention", 0, "How long to remember which tenants wrote how much to which tables, by day (0 to not record it).  It's kept in memory, of the writes through this process since it started, so costs memory per tenant and table.")
 }
 
 // Store implements Store
 type Store struct {
 	cfg StoreConfig
 
-	storage    StorageClient
-	tableName  string
-	s3         S3Client
-	bucketName string
-	cache      *Cache
-	schema     Schema
+	index     IndexClient
+	tableName string
+	objects   ObjectClient
+	cache     *Cache
+	schema    Schema
+
+	indexCache *indexCache
+	activity   *activityIndex
 }
 
 // NewStore makes a new ChunkStore
 func NewStore(cfg StoreConfig) (*Store, error) {
-	dynamoDBClient, tableName := cfg.mockDynamoDB, cfg.mockTableName
-	if dynamoDBClient == nil {
-		var err error
-		dynamoDBClient, tableName, err = NewDynamoDBClient(cfg.DynamoDB.String())
-		if err != nil {
-			return nil, err
-		}
+	if err := cfg.S3SSE.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.S3HedgePercentile < 0 || cfg.S3HedgePercentile >= 1 {
+		return nil, fmt.Errorf("S3 hedging percentile must be in [0, 1): %v", cfg.S3HedgePercentile)
 	}
 
-	s3Client, bucketName := cfg.mockS3, cfg.mockBucketName
-	if s3Client == nil {
+	var isolation TenantIsolation
+	if cfg.TenantIsolationFile != "" {
 		var err error
-		s3Client, bucketName, err = NewS3Client(cfg.S3.String())
+		isolation, err = LoadTenantIsolation(cfg.TenantIsolationFile)
 		if err != nil {
 			return nil, err
 		}
+		if err := isolation.validate(cfg.TablePrefix); err != nil {
+			return nil, err
+		}
+	}
+
+	index, tableName, err := newIndexClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.WriteQueueConfig.Concurrency > 0 {
+		index = newWriteQueue(cfg.WriteQueueConfig, index)
+	}
+
+	objects, err := newObjectClient(cfg, isolation)
+	if err != nil {
+		return nil, err
 	}
 
 	cfg.SchemaConfig.OriginalTableName = tableName
+	cfg.SchemaConfig.tenantTablePrefixes = isolation.tablePrefixes()
 	var schema Schema
-	var err error
 	if cfg.schemaFactory == nil {
 		schema, err = newCompositeSchema(cfg.SchemaConfig)
 	} else {
@@ -120,15 +181,92 @@ func NewStore(cfg StoreConfig) (*Store, error) {
 		return nil, err
 	}
 
-	return &Store{
-		cfg:        cfg,
-		storage:    dynamoDBClient,
-		tableName:  tableName,
-		s3:         s3Client,
-		bucketName: bucketName,
-		schema:     schema,
-		cache:      NewCache(cfg.CacheConfig),
-	}, nil
+	store := &Store{
+		cfg:       cfg,
+		index:     index,
+		tableName: tableName,
+		objects:   objects,
+		schema:    schema,
+		cache:     NewCache(cfg.CacheConfig),
+	}
+	if cfg.IndexCacheConfig.Size > 0 {
+		store.indexCache = newIndexCache(cfg.IndexCacheConfig)
+	}
+	if cfg.ActivityRetention > 0 {
+		store.activity = newActivityIndex(cfg.ActivityRetention)
+	}
+	return store, nil
+}
+
+func newIndexClient(cfg StoreConfig) (IndexClient, string, error) {
+	switch cfg.IndexStore {
+	case "dynamodb", "":
+		if cfg.mockDynamoDB != nil {
+			return cfg.mockDynamoDB, cfg.mockTableName, nil
+		}
+		client, tableName, err := NewDynamoDBClient(cfg.DynamoDB.String())
+		if err != nil || cfg.CircuitBreaker.Failures <= 0 {
+			return client, tableName, err
+		}
+		adapter := client.(dynamoClientAdapter)
+		adapter.breakers = newCircuitBreakers(cfg.CircuitBreaker)
+		return adapter, tableName, nil
+	default:
+		return nil, "", fmt.Errorf("unknown index store %q", cfg.IndexStore)
+	}
+}
+
+func newObjectClient(cfg StoreConfig, isolation TenantIsolation) (ObjectClient, error) {
+	if cfg.ObjectStore != "s3" && cfg.ObjectStore != "" {
+		for userID, storage := range isolation.Tenants {
+			if storage.Bucket != "" || storage.Prefix != "" {
+				return nil, fmt.Errorf("tenant %q: chunk bucket and prefix isolation is only supported for s3", userID)
+			}
+		}
+	}
+
+	var (
+		blobs blobClient
+		err   error
+	)
+	switch cfg.ObjectStore {
+	case "azure":
+		blobs, err = newAzureBlobClient(cfg.Azure)
+	case "swift":
+		blobs, err = newSwiftClient(cfg.Swift)
+	case "dynamodb":
+		blobs, err = newDynamoDBChunkClient(cfg.DynamoDB.String(), cfg.SchemaConfig.PeriodicTableConfig, cfg.CircuitBreaker)
+	case "s3", "":
+		s3Client, bucketName := cfg.mockS3, cfg.mockBucketName
+		if s3Client == nil {
+			s3Client, bucketName, err = NewS3Client(cfg.S3.String())
+			if err != nil {
+				return nil, err
+			}
+		}
+		if cfg.S3HedgePercentile > 0 {
+			s3Client = newHedgingS3Client(s3Client, cfg.S3HedgePercentile)
+		}
+		blobs = s3ObjectClient{
+			s3:         s3Client,
+			bucketName: bucketName,
+			sse:        cfg.S3SSE,
+			tenants:    isolation.Tenants,
+		}
+	default:
+		return nil, fmt.Errorf("unknown object store %q", cfg.ObjectStore)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Encryption.KeyProvider != "" {
+		blobs, err = newEncryptingBlobClient(cfg.Encryption, blobs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newBlobObjectClient(blobs), nil
 }
 
 func chunkName(userID, chunkID string) string {
@@ -150,6 +288,26 @@ func (c *Store) Put(ctx context.Context, chunks []Chunk) error {
 	return c.updateIndex(ctx, userID, chunks)
 }
 
+// PutChunks writes chunks to the object store, without indexing them; see
+// PutIndex.
+func (c *Store) PutChunks(ctx context.Context, chunks []Chunk) error {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return err
+	}
+	return c.putChunks(ctx, userID, chunks)
+}
+
+// PutIndex writes the index entries for chunks already written with
+// PutChunks.
+func (c *Store) PutIndex(ctx context.Context, chunks []Chunk) error {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return err
+	}
+	return c.updateIndex(ctx, userID, chunks)
+}
+
 // putChunks writes a collection of chunks to S3 in parallel.
 func (c *Store) putChunks(ctx context.Context, userID string, chunks []Chunk) error {
 	incomingErrors := make(chan error)
@@ -169,63 +327,77 @@ func (c *Store) putChunks(ctx context.Context, userID string, chunks []Chunk) er
 	return lastErr
 }
 
-// putChunk puts a chunk into S3.
+// putChunk puts a chunk into the object store.
 func (c *Store) putChunk(ctx context.Context, userID string, chunk *Chunk) error {
-	body, err := chunk.reader()
-	if err != nil {
-		return err
-	}
-
-	err = instrument.TimeRequestHistogram(ctx, "S3.PutObject", s3RequestDuration, func(_ context.Context) error {
-		var err error
-		_, err = c.s3.PutObject(&s3.PutObjectInput{
-			Body:   body,
-			Bucket: aws.String(c.bucketName),
-			Key:    aws.String(chunkName(userID, chunk.ID)),
-		})
-		return err
-	})
-	if err != nil {
+	if err := c.objects.PutChunk(ctx, userID, chunk); err != nil {
 		return err
 	}
 
-	if err = c.cache.StoreChunkData(ctx, userID, chunk); err != nil {
+	if err := c.cache.StoreChunkData(ctx, userID, chunk); err != nil {
 		log.Warnf("Could not store %v in chunk cache: %v", chunk.ID, err)
 	}
 	return nil
 }
 
 func (c *Store) updateIndex(ctx context.Context, userID string, chunks []Chunk) error {
-	writeReqs, err := c.calculateDynamoWrites(userID, chunks)
+	writeReqs, entries, tables, err := c.calculateDynamoWrites(userID, chunks)
 	if err != nil {
 		return err
 	}
 
-	return c.storage.BatchWrite(ctx, writeReqs)
+	if err := c.index.BatchWrite(ctx, writeReqs); err != nil {
+		return err
+	}
+	if c.indexCache != nil {
+		for _, entry := range entries {
+			c.indexCache.invalidate(entry.TableName, entry.HashValue)
+		}
+	}
+	if c.activity != nil {
+		c.activity.record(time.Now(), userID, tables)
+	}
+	return nil
 }
 
 // calculateDynamoWrites creates a set of batched WriteRequests to dynamo for all
-// the chunks it is given.
-func (c *Store) calculateDynamoWrites(userID string, chunks []Chunk) (WriteBatch, error) {
-	writeReqs := c.storage.NewWriteBatch()
+// the chunks it is given, returning the entries they write, and totals what
+// they write to each table.
+func (c *Store) calculateDynamoWrites(userID string, chunks []Chunk) (WriteBatch, []IndexEntry, map[string]*TenantActivity, error) {
+	writeReqs := c.index.NewWriteBatch()
+	var allEntries []IndexEntry
+	tables := map[string]*TenantActivity{}
 	for _, chunk := range chunks {
 		metricName, err := util.ExtractMetricNameFromMetric(chunk.Metric)
 		if err != nil {
-			return nil, err
+			return nil, nil, nil, err
 		}
 
 		entries, err := c.schema.GetWriteEntries(chunk.From, chunk.Through, userID, metricName, chunk.Metric, chunk.ID)
 		if err != nil {
-			return nil, err
+			return nil, nil, nil, err
 		}
 		indexEntriesPerChunk.Observe(float64(len(entries)))
+		allEntries = append(allEntries, entries...)
 
+		chunkTables := map[string]struct{}{}
 		for _, entry := range entries {
 			rowWrites.Observe(entry.HashValue, 1)
 			writeReqs.Add(entry.TableName, entry.HashValue, entry.RangeValue)
+
+			table, ok := tables[entry.TableName]
+			if !ok {
+				table = &TenantActivity{}
+				tables[entry.TableName] = table
+			}
+			if _, ok := chunkTables[entry.TableName]; !ok {
+				chunkTables[entry.TableName] = struct{}{}
+				table.Chunks++
+			}
+			table.IndexEntries++
+			table.Bytes += len(entry.HashValue) + len(entry.RangeValue)
 		}
 	}
-	return writeReqs, nil
+	return writeReqs, allEntries, tables, nil
 }
 
 // Get implements ChunkStore
@@ -255,6 +427,9 @@ func (c *Store) Get(ctx context.Context, from, through model.Time, allMatchers .
 		}
 		filtered = append(filtered, chunk)
 	}
+	if c.cfg.MaxChunksPerQuery > 0 && len(filtered) > c.cfg.MaxChunksPerQuery {
+		return nil, cortex_errors.Errorf(cortex_errors.TooManyChunks, "query would fetch %d chunks, limit is %d", len(filtered), c.cfg.MaxChunksPerQuery)
+	}
 
 	// Now fetch the actual chunk data from Memcache / S3
 	fromCache, missing, err := c.cache.FetchChunkData(ctx, userID, filtered)
@@ -303,7 +478,7 @@ func (c *Store) lookupMatchers(ctx context.Context, userID string, from, through
 		if err != nil {
 			return nil, err
 		}
-		return c.lookupEntries(ctx, entries, nil)
+		return c.lookupEntries(ctx, userID, entries, nil)
 	}
 
 	incomingChunkSets := make(chan ByID)
@@ -312,16 +487,22 @@ func (c *Store) lookupMatchers(ctx context.Context, userID string, from, through
 		go func(matcher *metric.LabelMatcher) {
 			var entries []IndexEntry
 			var err error
-			if matcher.Type != metric.Equal {
-				entries, err = c.schema.GetReadEntriesForMetricLabel(from, through, userID, metricName, matcher.Name)
-			} else {
+			prefix, complete := literalPrefix(matcher)
+			switch {
+			case matcher.Type == metric.Equal:
 				entries, err = c.schema.GetReadEntriesForMetricLabelValue(from, through, userID, metricName, matcher.Name, matcher.Value)
+			case complete:
+				entries, err = c.schema.GetReadEntriesForMetricLabelValue(from, through, userID, metricName, matcher.Name, prefix)
+			case prefix != "":
+				entries, err = c.schema.GetReadEntriesForMetricLabelValuePrefix(from, through, userID, metricName, matcher.Name, prefix)
+			default:
+				entries, err = c.schema.GetReadEntriesForMetricLabel(from, through, userID, metricName, matcher.Name)
 			}
 			if err != nil {
 				incomingErrors <- err
 				return
 			}
-			incoming, err := c.lookupEntries(ctx, entries, matcher)
+			incoming, err := c.lookupEntries(ctx, userID, entries, matcher)
 			if err != nil {
 				incomingErrors <- err
 			} else {
@@ -344,12 +525,27 @@ func (c *Store) lookupMatchers(ctx context.Context, userID string, from, through
 	return nWayIntersect(chunkSets), lastErr
 }
 
-func (c *Store) lookupEntries(ctx context.Context, entries []IndexEntry, matcher *metric.LabelMatcher) (ByID, error) {
+// literalPrefix returns the prefix every value matched by a regex matcher must
+// start with, and whether the regex only matches that literal.  The matched
+// entries are still checked against the matcher.
+func literalPrefix(matcher *metric.LabelMatcher) (model.LabelValue, bool) {
+	if matcher.Type != metric.RegexMatch {
+		return "", false
+	}
+	re, err := regexp.Compile("^(?:" + string(matcher.Value) + ")$")
+	if err != nil {
+		return "", false
+	}
+	prefix, complete := re.LiteralPrefix()
+	return model.LabelValue(prefix), complete
+}
+
+func (c *Store) lookupEntries(ctx context.Context, userID string, entries []IndexEntry, matcher *metric.LabelMatcher) (ByID, error) {
 	incomingChunkSets := make(chan ByID)
 	incomingErrors := make(chan error)
 	for _, entry := range entries {
 		go func(entry IndexEntry) {
-			incoming, err := c.lookupEntry(ctx, entry, matcher)
+			incoming, err := c.cachedLookupEntry(ctx, userID, entry, matcher)
 			if err != nil {
 				incomingErrors <- err
 			} else {
@@ -372,10 +568,27 @@ func (c *Store) lookupEntries(ctx context.Context, entries []IndexEntry, matcher
 	return chunks, lastErr
 }
 
+func (c *Store) cachedLookupEntry(ctx context.Context, userID string, entry IndexEntry, matcher *metric.LabelMatcher) (ByID, error) {
+	if c.indexCache == nil {
+		return c.lookupEntry(ctx, entry, matcher)
+	}
+
+	key := indexCacheKey(entry, matcher)
+	if chunks, ok := c.indexCache.get(key, time.Now()); ok {
+		return chunks, nil
+	}
+	chunks, err := c.lookupEntry(ctx, entry, matcher)
+	if err != nil {
+		return nil, err
+	}
+	c.indexCache.put(key, chunks, bucketEnd(userID, entry), time.Now())
+	return chunks, nil
+}
+
 func (c *Store) lookupEntry(ctx context.Context, entry IndexEntry, matcher *metric.LabelMatcher) (ByID, error) {
 	var chunkSet ByID
 	var processingError error
-	if err := c.storage.QueryPages(ctx, entry, func(resp ReadBatch, lastPage bool) (shouldContinue bool) {
+	if err := c.index.QueryPages(ctx, entry, func(resp ReadBatch, lastPage bool) (shouldContinue bool) {
 		processingError = processResponse(resp, &chunkSet, matcher)
 		return processingError != nil && !lastPage
 	}); err != nil {
@@ -391,11 +604,17 @@ func (c *Store) lookupEntry(ctx context.Context, entry IndexEntry, matcher *metr
 }
 
 func processResponse(resp ReadBatch, chunkSet *ByID, matcher *metric.LabelMatcher) error {
+	required := requiredHint(matcher)
 	for i := 0; i < resp.Len(); i++ {
 		rangeValue := resp.RangeValue(i)
 		if rangeValue == nil {
 			return fmt.Errorf("invalid item: %d", i)
 		}
+		if required != 0 {
+			if hint, ok := rangeValueHint(rangeValue); ok && !hint.mayContain(required) {
+				continue
+			}
+		}
 		value, chunkID, err := parseRangeValue(rangeValue)
 		if err != nil {
 			return err
@@ -421,26 +640,30 @@ func processResponse(resp ReadBatch, chunkSet *ByID, matcher *metric.LabelMatche
 	return nil
 }
 
+// Fetch fetches the data for chunks, which need only have their IDs and
+// time ranges, from the object store.
+func (c *Store) Fetch(ctx context.Context, chunks []Chunk) ([]Chunk, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.fetchChunkData(ctx, userID, chunks)
+}
+
 func (c *Store) fetchChunkData(ctx context.Context, userID string, chunkSet []Chunk) ([]Chunk, error) {
+	if batch, ok := c.objects.(batchObjectClient); ok {
+		chunks := append([]Chunk{}, chunkSet...)
+		if err := batch.GetChunks(ctx, userID, chunks); err != nil {
+			return nil, err
+		}
+		return chunks, nil
+	}
+
 	incomingChunks := make(chan Chunk)
 	incomingErrors := make(chan error)
 	for _, chunk := range chunkSet {
 		go func(chunk Chunk) {
-			var resp *s3.GetObjectOutput
-			err := instrument.TimeRequestHistogram(ctx, "S3.GetObject", s3RequestDuration, func(_ context.Context) error {
-				var err error
-				resp, err = c.s3.GetObject(&s3.GetObjectInput{
-					Bucket: aws.String(c.bucketName),
-					Key:    aws.String(chunkName(userID, chunk.ID)),
-				})
-				return err
-			})
-			if err != nil {
-				incomingErrors <- err
-				return
-			}
-			defer resp.Body.Close()
-			if err := chunk.decode(resp.Body); err != nil {
+			if err := c.objects.GetChunk(ctx, userID, &chunk); err != nil {
 				incomingErrors <- err
 				return
 			}
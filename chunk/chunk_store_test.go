@@ -65,6 +65,7 @@ func TestChunkStore(t *testing.T) {
 		{"v3 schema", v3Schema},
 		{"v4 schema", v4Schema},
 		{"v5 schema", v5Schema},
+		{"v6 schema", v6Schema},
 	}
 
 	nameMatcher := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
@@ -109,6 +110,36 @@ func TestChunkStore(t *testing.T) {
 			[]Chunk{chunk1, chunk2},
 			[]*metric.LabelMatcher{nameMatcher, mustNewLabelMatcher(metric.RegexMatch, "bar", "beep|baz")},
 		},
+		{
+			"Regex literal",
+			[]Chunk{chunk1},
+			[]*metric.LabelMatcher{nameMatcher, mustNewLabelMatcher(metric.RegexMatch, "bar", "baz")},
+		},
+		{
+			"Regex prefix",
+			[]Chunk{chunk2},
+			[]*metric.LabelMatcher{nameMatcher, mustNewLabelMatcher(metric.RegexMatch, "bar", "bee.*")},
+		},
+		{
+			"Regex short prefix",
+			[]Chunk{chunk1, chunk2},
+			[]*metric.LabelMatcher{nameMatcher, mustNewLabelMatcher(metric.RegexMatch, "bar", "b.*")},
+		},
+		{
+			"Regex prefix, no match",
+			[]Chunk{},
+			[]*metric.LabelMatcher{nameMatcher, mustNewLabelMatcher(metric.RegexMatch, "bar", "bo.*")},
+		},
+		{
+			"Regex substring",
+			[]Chunk{chunk2},
+			[]*metric.LabelMatcher{nameMatcher, mustNewLabelMatcher(metric.RegexMatch, "bar", ".*eep.*")},
+		},
+		{
+			"Regex substring, no match",
+			[]Chunk{},
+			[]*metric.LabelMatcher{nameMatcher, mustNewLabelMatcher(metric.RegexMatch, "bar", ".*zzz.*")},
+		},
 		{
 			"Multiple matchers",
 			[]Chunk{chunk1, chunk2},
@@ -0,0 +1,136 @@
+package chunk
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	circuitBreakerOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cortex",
+		Name:      "dynamo_circuit_breaker_open",
+		Help:      "Whether requests to a table are being shed, as it's throttling or failing.",
+	}, []string{tableNameLabel})
+	circuitBreakerRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "dynamo_circuit_breaker_rejected_total",
+		Help:      "The total number of requests to a table failed fast, as its circuit breaker was open.",
+	}, []string{tableNameLabel})
+)
+
+func init() {
+	prometheus.MustRegister(circuitBreakerOpen)
+	prometheus.MustRegister(circuitBreakerRejected)
+}
+
+// CircuitBreakerConfig configures the circuit breakers of DynamoDB tables.
+type CircuitBreakerConfig struct {
+	Failures     int
+	OpenDuration time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *CircuitBreakerConfig) RegisterFlags(f *flag.FlagSet) {
+	f.IntVar(&cfg.Failures, "dynamodb.circuit-breaker.failures", 0, "Number of consecutive throttled or 5xx requests to a table after which its requests fail fast (0 to disable).")
+	f.DurationVar(&cfg.OpenDuration, "dynamodb.circuit-breaker.open-duration", 10*time.Second, "How long to fail requests to a table fast for, before trying one again.")
+}
+
+// circuitOpenError is returned for requests to a table whose circuit breaker
+// is open.  It's retryable: the requests weren't attempted.
+type circuitOpenError struct {
+	tableName string
+}
+
+func (e circuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker open for table %s, not sending request", e.tableName)
+}
+
+// circuitBreakers sheds the load on tables which are persistently throttling
+// or failing, rather than piling up requests backing off and retrying.  A
+// table's breaker opens after a number of consecutive failed requests;
+// requests then fail fast until it's time to try one again, which closes it
+// if it succeeds.  A nil *circuitBreakers allows everything.
+type circuitBreakers struct {
+	cfg CircuitBreakerConfig
+
+	mtx      sync.Mutex
+	breakers map[string]*circuitBreaker
+
+	// For testing.
+	now func() time.Time
+}
+
+type circuitBreaker struct {
+	failures  int
+	openUntil time.Time
+	// Whether a request is trying the table again, after the breaker opened.
+	probing bool
+}
+
+func newCircuitBreakers(cfg CircuitBreakerConfig) *circuitBreakers {
+	return &circuitBreakers{
+		cfg:      cfg,
+		breakers: map[string]*circuitBreaker{},
+		now:      time.Now,
+	}
+}
+
+// allow returns an error if requests to tableName are being shed.
+func (c *circuitBreakers) allow(tableName string) error {
+	if c == nil {
+		return nil
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	b, ok := c.breakers[tableName]
+	if !ok || b.failures < c.cfg.Failures {
+		return nil
+	}
+	if b.probing || c.now().Before(b.openUntil) {
+		circuitBreakerRejected.WithLabelValues(tableName).Inc()
+		return circuitOpenError{tableName}
+	}
+	b.probing = true
+	return nil
+}
+
+// record records the outcome of a request to tableName.  Only throttles and
+// server errors count as failures; other errors are the request's fault, not
+// the table's, so neither count nor close the breaker.  Any outcome ends a
+// probe.
+func (c *circuitBreakers) record(tableName string, err error) {
+	if c == nil {
+		return
+	}
+	code := dynamoErrorCode(err)
+	failed := code == throttledError || code == serverError
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	b, ok := c.breakers[tableName]
+	if !ok {
+		if !failed {
+			return
+		}
+		b = &circuitBreaker{}
+		c.breakers[tableName] = b
+	}
+	b.probing = false
+	if !failed && err != nil {
+		return
+	}
+	if !failed {
+		delete(c.breakers, tableName)
+		circuitBreakerOpen.WithLabelValues(tableName).Set(0)
+		return
+	}
+	b.failures++
+	if b.failures >= c.cfg.Failures {
+		b.openUntil = c.now().Add(c.cfg.OpenDuration)
+		circuitBreakerOpen.WithLabelValues(tableName).Set(1)
+	}
+}
@@ -0,0 +1,120 @@
+package chunk
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestCircuitBreakers(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := newCircuitBreakers(CircuitBreakerConfig{Failures: 2, OpenDuration: time.Minute})
+	c.now = func() time.Time { return now }
+	throttled := awserr.New(provisionedThroughputExceededException, "", nil)
+
+	// Errors which aren't the table's fault don't count.
+	c.record("table", fmt.Errorf("boom"))
+	c.record("table", throttled)
+	c.record("table", awserr.New("ValidationException", "", nil))
+	require.NoError(t, c.allow("table"))
+
+	// Consecutive failures open the breaker, for that table only.
+	c.record("table", throttled)
+	assert.Equal(t, circuitOpenError{"table"}, c.allow("table"))
+	assert.NoError(t, c.allow("other"))
+
+	// Once it's time, one request tries the table again; it failing
+	// reopens the breaker, and it succeeding closes it.
+	now = now.Add(time.Minute)
+	require.NoError(t, c.allow("table"))
+	assert.Error(t, c.allow("table"))
+	c.record("table", throttled)
+	assert.Error(t, c.allow("table"))
+
+	// A probe failing through no fault of the table lets another try.
+	now = now.Add(time.Minute)
+	require.NoError(t, c.allow("table"))
+	c.record("table", awserr.New("ValidationException", "", nil))
+	require.NoError(t, c.allow("table"))
+	c.record("table", nil)
+	assert.NoError(t, c.allow("table"))
+
+	c.record("table", throttled)
+	c.record("table", throttled)
+	now = now.Add(time.Minute)
+	require.NoError(t, c.allow("table"))
+	c.record("table", nil)
+	assert.NoError(t, c.allow("table"))
+	assert.NoError(t, c.allow("table"))
+
+	// A nil *circuitBreakers allows everything.
+	var disabled *circuitBreakers
+	disabled.record("table", throttled)
+	assert.NoError(t, disabled.allow("table"))
+}
+
+func TestDynamoDBClientCircuitBreaker(t *testing.T) {
+	dynamoDB := newMockDynamoDB(0, 0)
+	client := dynamoClientAdapter{
+		DynamoDB: dynamoDB,
+		breakers: newCircuitBreakers(CircuitBreakerConfig{Failures: 1, OpenDuration: time.Minute}),
+	}
+	client.breakers.record("table2", awserr.New(provisionedThroughputExceededException, "", nil))
+
+	batch := client.NewWriteBatch()
+	for _, table := range []string{"table1", "table2"} {
+		dynamoDB.createTable(table)
+		for i := 0; i < 10; i++ {
+			batch.Add(table, fmt.Sprintf("hash%d", i), []byte(fmt.Sprintf("range%d", i)))
+		}
+	}
+
+	// Writes to the open table are shed, and the others written.
+	err := client.BatchWrite(context.Background(), batch)
+	assert.Equal(t, circuitOpenError{"table2"}, err)
+	assert.Len(t, dynamoDB.tables["table1"].items, 10)
+	assert.Empty(t, dynamoDB.tables["table2"].items)
+}
+
+func TestDynamoDBClientCircuitBreakerUnprocessed(t *testing.T) {
+	// Of a BatchWriteItem, only the table none of whose items were
+	// processed counts as throttled.
+	dynamoDB := newMockDynamoDB(15, 0)
+	client := dynamoClientAdapter{
+		DynamoDB: dynamoDB,
+		breakers: newCircuitBreakers(CircuitBreakerConfig{Failures: 1, OpenDuration: time.Minute}),
+	}
+	batch := dynamoDBWriteBatch{}
+	for _, table := range []string{"table1", "table2"} {
+		dynamoDB.createTable(table)
+		for i := 0; i < 10; i++ {
+			batch.Add(table, fmt.Sprintf("hash%d", i), []byte(fmt.Sprintf("range%d", i)))
+		}
+	}
+	resp, err := dynamoDB.BatchWriteItem(&dynamodb.BatchWriteItemInput{RequestItems: batch})
+	require.NoError(t, err)
+	unprocessed := len(resp.UnprocessedItems["table1"])
+	full, partial := "table1", "table2"
+	if unprocessed != 10 {
+		full, partial = partial, full
+	}
+	client.recordBatchWrite(batch, resp, nil)
+	assert.Equal(t, circuitOpenError{full}, client.breakers.allow(full))
+	assert.NoError(t, client.breakers.allow(partial))
+
+	// A failed call of many tables isn't any one's fault, unless it's
+	// throttled.
+	client.breakers = newCircuitBreakers(CircuitBreakerConfig{Failures: 1, OpenDuration: time.Minute})
+	client.recordBatchWrite(batch, nil, awserr.NewRequestFailure(awserr.New("InternalServerError", "", nil), 500, ""))
+	assert.NoError(t, client.breakers.allow("table1"))
+	assert.NoError(t, client.breakers.allow("table2"))
+	client.recordBatchWrite(batch, nil, awserr.New(provisionedThroughputExceededException, "", nil))
+	assert.Error(t, client.breakers.allow("table1"))
+	assert.Error(t, client.breakers.allow("table2"))
+}
@@ -0,0 +1,107 @@
+package chunk
+
+import (
+	"flag"
+	"sort"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// PreviousStoreConfig configures the store chunks were kept in before some
+// cutover time, e.g. while migrating to a new backend without backfilling it.
+// The previous store is the current one's config, with whichever URLs are set
+// here replaced.
+type PreviousStoreConfig struct {
+	S3       util.URLValue
+	DynamoDB util.URLValue
+	Until    util.TimeValue
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *PreviousStoreConfig) RegisterFlags(f *flag.FlagSet) {
+	f.Var(&cfg.S3, "store.previous.s3.url", "S3 endpoint URL of the store chunks were kept in before -store.previous.until.")
+	f.Var(&cfg.DynamoDB, "store.previous.dynamodb.url", "DynamoDB endpoint URL of the store chunks were indexed in before -store.previous.until.")
+	f.Var(&cfg.Until, "store.previous.until", "Time (RFC3339) from which chunks are read from the current store rather than the previous one.")
+}
+
+// Enabled reports whether a previous store is configured.
+func (cfg PreviousStoreConfig) Enabled() bool {
+	return cfg.Until.IsSet() && (cfg.S3.URL != nil || cfg.DynamoDB.URL != nil)
+}
+
+// chunkGetter is the part of a store we read from.
+type chunkGetter interface {
+	Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]Chunk, error)
+}
+
+// CutoverStore reads chunks from before a cutover time from a previous store,
+// and from after it from the current one, merging the two for queries
+// spanning the cutover.
+type CutoverStore struct {
+	cutover  model.Time
+	previous chunkGetter
+	current  chunkGetter
+}
+
+// NewCutoverStore makes a CutoverStore, reading from current and from a
+// previous store configured by cfg.Previous.
+func NewCutoverStore(cfg StoreConfig, current *Store) (*CutoverStore, error) {
+	previousCfg := cfg
+	if cfg.Previous.S3.URL != nil {
+		previousCfg.S3 = cfg.Previous.S3
+	}
+	if cfg.Previous.DynamoDB.URL != nil {
+		previousCfg.DynamoDB = cfg.Previous.DynamoDB
+	}
+	previousCfg.ActivityRetention = 0
+	previous, err := NewStore(previousCfg)
+	if err != nil {
+		return nil, err
+	}
+	return newCutoverStore(cfg.Previous.Until.Time, previous, current), nil
+}
+
+func newCutoverStore(cutover model.Time, previous, current chunkGetter) *CutoverStore {
+	return &CutoverStore{
+		cutover:  cutover,
+		previous: previous,
+		current:  current,
+	}
+}
+
+// Get implements querier.ChunkStore.
+func (s *CutoverStore) Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]Chunk, error) {
+	if through < s.cutover {
+		return s.previous.Get(ctx, from, through, matchers...)
+	}
+	if from >= s.cutover {
+		return s.current.Get(ctx, from, through, matchers...)
+	}
+
+	type result struct {
+		chunks []Chunk
+		err    error
+	}
+	previous := make(chan result, 1)
+	go func() {
+		chunks, err := s.previous.Get(ctx, from, s.cutover-1, matchers...)
+		previous <- result{chunks, err}
+	}()
+	chunks, err := s.current.Get(ctx, s.cutover, through, matchers...)
+	prev := <-previous
+	if err != nil {
+		return nil, err
+	}
+	if prev.err != nil {
+		return nil, prev.err
+	}
+
+	// Chunks spanning the cutover may be in both stores.
+	all := append(ByID(prev.chunks), chunks...)
+	sort.Sort(all)
+	return unique(all), nil
+}
@@ -0,0 +1,58 @@
+package chunk
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// recordingGetter returns its chunks, and records the ranges asked for.
+type recordingGetter struct {
+	chunks []Chunk
+	ranges [][2]model.Time
+}
+
+func (g *recordingGetter) Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]Chunk, error) {
+	g.ranges = append(g.ranges, [2]model.Time{from, through})
+	return g.chunks, nil
+}
+
+func TestCutoverStore(t *testing.T) {
+	const cutover = model.Time(1000)
+	var (
+		old      = Chunk{ID: "a"}
+		spanning = Chunk{ID: "b"}
+		recent   = Chunk{ID: "c"}
+	)
+
+	for _, tc := range []struct {
+		from, through    model.Time
+		previousRanges   [][2]model.Time
+		currentRanges    [][2]model.Time
+		expectedChunkIDs []string
+	}{
+		// Queries entirely before or after the cutover go to one store...
+		{0, 999, [][2]model.Time{{0, 999}}, nil, []string{"a", "b"}},
+		{1000, 2000, nil, [][2]model.Time{{1000, 2000}}, []string{"b", "c"}},
+		// ...and those spanning it are split, and the results deduped.
+		{0, 2000, [][2]model.Time{{0, 999}}, [][2]model.Time{{1000, 2000}}, []string{"a", "b", "c"}},
+	} {
+		previous := &recordingGetter{chunks: []Chunk{old, spanning}}
+		current := &recordingGetter{chunks: []Chunk{spanning, recent}}
+		store := newCutoverStore(cutover, previous, current)
+
+		chunks, err := store.Get(context.Background(), tc.from, tc.through)
+		require.NoError(t, err)
+		ids := []string{}
+		for _, c := range chunks {
+			ids = append(ids, c.ID)
+		}
+		assert.Equal(t, tc.expectedChunkIDs, ids)
+		assert.Equal(t, tc.previousRanges, previous.ranges)
+		assert.Equal(t, tc.currentRanges, current.ranges)
+	}
+}
@@ -0,0 +1,248 @@
+package chunk
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// See http://docs.aws.amazon.com/amazondynamodb/latest/APIReference/API_BatchGetItem.html.
+const dynamoMaxBatchGetSize = 100
+
+// Chunk items are keyed by chunk name alone, but the tables have a range
+// key, so they all have this one.
+var chunkRangeValue = []byte("c")
+
+// dynamoDBChunkClient is a batchBlobClient keeping chunks in DynamoDB, in
+// periodic tables of their own.  A query's chunks are read with a
+// BatchGetItem per 100 chunks in each table, all in parallel, rather than a
+// request per chunk.
+type dynamoDBChunkClient struct {
+	dynamoDB dynamodbiface.DynamoDBAPI
+	cfg      PeriodicTableConfig
+
+	// Nil if tables' requests are never shed.
+	breakers *circuitBreakers
+}
+
+func newDynamoDBChunkClient(dynamoDBURL string, cfg PeriodicTableConfig, breakerCfg CircuitBreakerConfig) (*dynamoDBChunkClient, error) {
+	if cfg.ChunkTablePrefix == "" {
+		return nil, fmt.Errorf("-dynamodb.chunk-table.prefix is required to store chunks in DynamoDB")
+	}
+	url, err := url.Parse(dynamoDBURL)
+	if err != nil {
+		return nil, err
+	}
+	dynamoDBConfig, err := awsConfigFromURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := &dynamoDBChunkClient{
+		dynamoDB: dynamodb.New(session.New(dynamoDBConfig)),
+		cfg:      cfg,
+	}
+	if breakerCfg.Failures > 0 {
+		client.breakers = newCircuitBreakers(breakerCfg)
+	}
+	return client, nil
+}
+
+// tableFor returns the table chunk is stored in, by its start.  Chunks from
+// before the periodic tables start go in the first table.
+func (c *dynamoDBChunkClient) tableFor(chunk *Chunk) string {
+	from := util.Max64(chunk.From.Unix(), c.cfg.PeriodicTableStartAt.Unix())
+	return c.cfg.ChunkTablePrefix + strconv.Itoa(int(from/int64(c.cfg.TablePeriod/time.Second)))
+}
+
+func (c *dynamoDBChunkClient) putBlob(ctx context.Context, userID string, chunk *Chunk, buf []byte) error {
+	table := c.tableFor(chunk)
+	if err := c.breakers.allow(table); err != nil {
+		return err
+	}
+	err := timeDynamoRequest(ctx, "DynamoDB.PutItem", func(_ context.Context) error {
+		resp, err := c.dynamoDB.PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String(table),
+			Item: map[string]*dynamodb.AttributeValue{
+				hashKey:  {S: aws.String(chunkName(userID, chunk.ID))},
+				rangeKey: {B: chunkRangeValue},
+				chunkKey: {B: buf},
+			},
+			ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+		})
+		if resp != nil && resp.ConsumedCapacity != nil {
+			recordConsumedCapacity("DynamoDB.PutItem", dynamoConsumedWriteCapacity, resp.ConsumedCapacity)
+		}
+		return err
+	})
+	c.breakers.record(table, err)
+	return err
+}
+
+func (c *dynamoDBChunkClient) getBlob(ctx context.Context, userID string, chunk *Chunk) ([]byte, error) {
+	bufs, err := c.getBlobs(ctx, userID, []Chunk{*chunk})
+	if err != nil {
+		return nil, err
+	}
+	return bufs[0], nil
+}
+
+func (c *dynamoDBChunkClient) getBlobs(ctx context.Context, userID string, chunks []Chunk) ([][]byte, error) {
+	// The indexes into chunks of each chunk name, by table.
+	tables := map[string]map[string][]int{}
+	for i := range chunks {
+		table, name := c.tableFor(&chunks[i]), chunkName(userID, chunks[i].ID)
+		if tables[table] == nil {
+			tables[table] = map[string][]int{}
+		}
+		tables[table][name] = append(tables[table][name], i)
+	}
+
+	type batch struct {
+		table string
+		names []string
+	}
+	var batches []batch
+	for table, indexes := range tables {
+		names := make([]string, 0, len(indexes))
+		for name := range indexes {
+			names = append(names, name)
+		}
+		for len(names) > 0 {
+			n := util.Min(len(names), dynamoMaxBatchGetSize)
+			batches = append(batches, batch{table, names[:n]})
+			names = names[n:]
+		}
+	}
+
+	bufs := make([][]byte, len(chunks))
+	errs := make(chan error)
+	for _, b := range batches {
+		go func(b batch) {
+			found, err := c.batchGet(ctx, b.table, b.names)
+			if err == nil {
+				for _, name := range b.names {
+					buf, ok := found[name]
+					if !ok {
+						err = fmt.Errorf("chunk %s not found in %s", name, b.table)
+						break
+					}
+					for _, i := range tables[b.table][name] {
+						bufs[i] = buf
+					}
+				}
+			}
+			errs <- err
+		}(b)
+	}
+
+	var lastErr error
+	for range batches {
+		if err := <-errs; err != nil {
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return bufs, nil
+}
+
+// batchGet reads the chunks named from table, retrying unprocessed keys and
+// throttled requests with backoff.  It fails after maxRetries requests in a
+// row which read nothing, or at once if table's circuit breaker is open.
+func (c *dynamoDBChunkClient) batchGet(ctx context.Context, table string, names []string) (map[string][]byte, error) {
+	keys := make([]map[string]*dynamodb.AttributeValue, 0, len(names))
+	for _, name := range names {
+		keys = append(keys, map[string]*dynamodb.AttributeValue{
+			hashKey:  {S: aws.String(name)},
+			rangeKey: {B: chunkRangeValue},
+		})
+	}
+
+	found := make(map[string][]byte, len(names))
+	backoff, numRetries := minBackoff, 0
+	for {
+		if err := c.breakers.allow(table); err != nil {
+			return nil, err
+		}
+		var resp *dynamodb.BatchGetItemOutput
+		err := timeDynamoRequest(ctx, "DynamoDB.BatchGetItem", func(_ context.Context) error {
+			var err error
+			resp, err = c.dynamoDB.BatchGetItem(&dynamodb.BatchGetItemInput{
+				RequestItems: map[string]*dynamodb.KeysAndAttributes{
+					table: {Keys: keys},
+				},
+				ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+			})
+			return err
+		})
+		c.breakers.record(table, batchGetOutcome(table, len(keys), resp, err))
+		if err != nil {
+			recordDynamoError(table, err)
+			if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != provisionedThroughputExceededException {
+				return nil, err
+			}
+			numRetries++
+		} else {
+			for _, cc := range resp.ConsumedCapacity {
+				recordConsumedCapacity("DynamoDB.BatchGetItem", dynamoConsumedReadCapacity, cc)
+			}
+			items := resp.Responses[table]
+			for _, item := range items {
+				value, ok := item[chunkKey]
+				if !ok {
+					return nil, fmt.Errorf("chunk %s in %s has no data", aws.StringValue(item[hashKey].S), table)
+				}
+				found[aws.StringValue(item[hashKey].S)] = value.B
+			}
+
+			unprocessed, ok := resp.UnprocessedKeys[table]
+			if !ok || len(unprocessed.Keys) == 0 {
+				return found, nil
+			}
+			keys = unprocessed.Keys
+			dynamoUnprocessedItems.Add(float64(len(keys)))
+			if len(items) == 0 {
+				numRetries++
+			} else {
+				backoff, numRetries = minBackoff, 0
+			}
+		}
+
+		if numRetries >= maxRetries {
+			return nil, fmt.Errorf("failed to get chunks from %s after %d retries, %d chunks remaining", table, numRetries, len(keys))
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// batchGetOutcome is the outcome of a BatchGetItem of keys from table for its
+// circuit breaker: none of them being processed counts as throttling.
+func batchGetOutcome(table string, keys int, resp *dynamodb.BatchGetItemOutput, err error) error {
+	if err != nil {
+		return err
+	}
+	switch unprocessed, ok := resp.UnprocessedKeys[table]; {
+	case !ok || len(unprocessed.Keys) == 0:
+		return nil
+	case len(unprocessed.Keys) == keys:
+		return errAllUnprocessed
+	default:
+		return errSomeUnprocessed
+	}
+}
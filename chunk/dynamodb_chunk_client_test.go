@@ -0,0 +1,83 @@
+package chunk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestDynamoDBChunkClientBatches(t *testing.T) {
+	dynamoDB := newMockDynamoDB(0, 0)
+	dynamoDB.createTable("chunks_0")
+	dynamoDB.createTable("chunks_1")
+	client := newBlobObjectClient(&dynamoDBChunkClient{
+		dynamoDB: dynamoDB,
+		cfg: PeriodicTableConfig{
+			TablePeriod:      24 * time.Hour,
+			ChunkTablePrefix: "chunks_",
+		},
+	}).(batchObjectClient)
+
+	// 150 chunks in the first day's table, which take two BatchGetItems,
+	// and 10 in the next.
+	ctx := context.Background()
+	day := model.Time(24 * time.Hour / time.Millisecond)
+	var chunks, fetched []Chunk
+	for i := 0; i < 160; i++ {
+		from := model.Time(i)
+		if i >= 150 {
+			from += day
+		}
+		chunk := dummyObjectChunk(from)
+		require.NoError(t, client.PutChunk(ctx, "userID", &chunk))
+		chunks = append(chunks, chunk)
+		fetched = append(fetched, Chunk{ID: chunk.ID, From: chunk.From, Through: chunk.Through})
+	}
+	assert.Len(t, dynamoDB.tables["chunks_0"].items, 150)
+	assert.Len(t, dynamoDB.tables["chunks_1"].items, 10)
+
+	// One request is throttled, and some chunks are unprocessed, so are
+	// retried.
+	dynamoDB.provisionedErr = 1
+	dynamoDB.unprocessed = 5
+	require.NoError(t, client.GetChunks(ctx, "userID", fetched))
+	assert.Equal(t, 5, dynamoDB.batchGets)
+	for i := range chunks {
+		assert.Equal(t, chunks[i].Metric, fetched[i].Metric)
+		assert.Equal(t, chunks[i].Data.Len(), fetched[i].Data.Len())
+	}
+
+	missing := dummyObjectChunk(day + 1000)
+	assert.Error(t, client.GetChunk(ctx, "userID", &missing))
+}
+
+func TestDynamoDBChunkClientCircuitBreaker(t *testing.T) {
+	dynamoDB := newMockDynamoDB(0, 0)
+	dynamoDB.createTable("chunks_0")
+	client := newBlobObjectClient(&dynamoDBChunkClient{
+		dynamoDB: dynamoDB,
+		cfg: PeriodicTableConfig{
+			TablePeriod:      24 * time.Hour,
+			ChunkTablePrefix: "chunks_",
+		},
+		breakers: newCircuitBreakers(CircuitBreakerConfig{Failures: 1, OpenDuration: time.Minute}),
+	}).(batchObjectClient)
+
+	ctx := context.Background()
+	chunk := dummyObjectChunk(0)
+	require.NoError(t, client.PutChunk(ctx, "userID", &chunk))
+
+	// A throttled read opens the table's breaker, so the retry and later
+	// writes fail fast.
+	dynamoDB.provisionedErr = 1
+	fetched := []Chunk{{ID: chunk.ID, From: chunk.From, Through: chunk.Through}}
+	assert.Equal(t, circuitOpenError{"chunks_0"}, client.GetChunks(ctx, "userID", fetched))
+	assert.Equal(t, 1, dynamoDB.batchGets)
+	other := dummyObjectChunk(1)
+	assert.Equal(t, circuitOpenError{"chunks_0"}, client.PutChunk(ctx, "userID", &other))
+	assert.Len(t, dynamoDB.tables["chunks_0"].items, 1)
+}
@@ -1,7 +1,10 @@
 package chunk
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"net/url"
 	"strings"
@@ -9,6 +12,7 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
@@ -31,6 +35,13 @@ const (
 
 	provisionedThroughputExceededException = "ProvisionedThroughputExceededException"
 
+	// Values of the error_code label on dynamoRequestDuration; errors not
+	// covered by these are labelled with their AWS error code.
+	noError                = "none"
+	throttledError         = "throttled"
+	conditionalCheckFailed = "conditional_check_failed"
+	serverError            = "5xx"
+
 	// Backoff for dynamoDB requests, to match AWS lib - see:
 	// https://github.com/aws/aws-sdk-go/blob/master/service/dynamodb/customizations.go
 	minBackoff = 50 * time.Millisecond
@@ -50,12 +61,25 @@ var (
 		// DynamoDB latency seems to range from a few ms to a few sec and is
 		// important.  So use 8 buckets from 64us to 8s.
 		Buckets: prometheus.ExponentialBuckets(0.000128, 4, 8),
-	}, []string{"operation", "status_code"})
+	}, []string{"operation", "status_code", "error_code"})
 	dynamoConsumedCapacity = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "cortex",
 		Name:      "dynamo_consumed_capacity_total",
 		Help:      "The capacity units consumed by operation.",
 	}, []string{"operation"})
+	dynamoConsumedReadCapacity = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "dynamo_consumed_read_capacity_units",
+		Help:      "The read capacity units consumed by each DynamoDB request.",
+		// Half a unit for the smallest query page, up to a full 1MB page.
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+	}, []string{"operation", tableNameLabel})
+	dynamoConsumedWriteCapacity = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "dynamo_consumed_write_capacity_units",
+		Help:      "The write capacity units consumed by each DynamoDB request.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+	}, []string{"operation", tableNameLabel})
 	dynamoFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "cortex",
 		Name:      "dynamo_failures_total",
@@ -71,12 +95,27 @@ var (
 func init() {
 	prometheus.MustRegister(dynamoRequestDuration)
 	prometheus.MustRegister(dynamoConsumedCapacity)
+	prometheus.MustRegister(dynamoConsumedReadCapacity)
+	prometheus.MustRegister(dynamoConsumedWriteCapacity)
 	prometheus.MustRegister(dynamoFailures)
 	prometheus.MustRegister(dynamoUnprocessedItems)
 }
 
+// recordConsumedCapacity records the capacity consumed by a request, for
+// one table.
+func recordConsumedCapacity(operation string, histogram *prometheus.HistogramVec, cc *dynamodb.ConsumedCapacity) {
+	if cc.CapacityUnits == nil {
+		return
+	}
+	dynamoConsumedCapacity.WithLabelValues(operation).Add(*cc.CapacityUnits)
+	histogram.WithLabelValues(operation, aws.StringValue(cc.TableName)).Observe(*cc.CapacityUnits)
+}
+
 type dynamoClientAdapter struct {
 	DynamoDB dynamodbiface.DynamoDBAPI
+
+	// Nil if tables' requests are never shed.
+	breakers *circuitBreakers
 }
 
 // NewDynamoDBClient makes a new DynamoDBClient
@@ -91,7 +130,7 @@ func NewDynamoDBClient(dynamoDBURL string) (StorageClient, string, error) {
 		return nil, "", err
 	}
 
-	dynamoDBClient := dynamoClientAdapter{dynamodb.New(session.New(dynamoDBConfig))}
+	dynamoDBClient := dynamoClientAdapter{DynamoDB: dynamodb.New(session.New(dynamoDBConfig))}
 	tableName := strings.TrimPrefix(url.Path, "/")
 	return dynamoDBClient, tableName, nil
 }
@@ -100,18 +139,35 @@ func (d dynamoClientAdapter) NewWriteBatch() WriteBatch {
 	return dynamoDBWriteBatch(map[string][]*dynamodb.WriteRequest{})
 }
 
-// batchWrite writes requests to the underlying storage, handling retires and backoff.
+// BatchWrite writes requests to the underlying storage, handling retries and
+// backoff.  Requests for different tables, as for chunks spanning a period
+// boundary, are written in the same BatchWriteItem calls, and share the
+// retry budget: it's only spent by calls which write nothing, so one
+// throttled table can't retry forever.  Requests for tables whose circuit
+// breakers are open are dropped, and the write fails once the rest are done.
 func (d dynamoClientAdapter) BatchWrite(ctx context.Context, input WriteBatch) error {
 	outstanding := input.(dynamoDBWriteBatch)
 	unprocessed := map[string][]*dynamodb.WriteRequest{}
 	backoff, numRetries := minBackoff, 0
+	var shed error
 	for dictLen(outstanding)+dictLen(unprocessed) > 0 && numRetries < maxRetries {
 		reqs := map[string][]*dynamodb.WriteRequest{}
 		takeReqs(unprocessed, reqs, dynamoMaxBatchSize)
 		takeReqs(outstanding, reqs, dynamoMaxBatchSize)
+		for tableName := range reqs {
+			if err := d.breakers.allow(tableName); err != nil {
+				shed = err
+				delete(reqs, tableName)
+				delete(outstanding, tableName)
+				delete(unprocessed, tableName)
+			}
+		}
+		if len(reqs) == 0 {
+			continue
+		}
 		var resp *dynamodb.BatchWriteItemOutput
 
-		err := instrument.TimeRequestHistogram(ctx, "DynamoDB.BatchWriteItem", dynamoRequestDuration, func(_ context.Context) error {
+		err := timeDynamoRequest(ctx, "DynamoDB.BatchWriteItem", func(_ context.Context) error {
 			var err error
 			resp, err = d.DynamoDB.BatchWriteItem(&dynamodb.BatchWriteItemInput{
 				RequestItems:           reqs,
@@ -120,8 +176,7 @@ func (d dynamoClientAdapter) BatchWrite(ctx context.Context, input WriteBatch) e
 			return err
 		})
 		for _, cc := range resp.ConsumedCapacity {
-			dynamoConsumedCapacity.WithLabelValues("DynamoDB.BatchWriteItem").
-				Add(float64(*cc.CapacityUnits))
+			recordConsumedCapacity("DynamoDB.BatchWriteItem", dynamoConsumedWriteCapacity, cc)
 		}
 
 		if err != nil {
@@ -129,9 +184,15 @@ func (d dynamoClientAdapter) BatchWrite(ctx context.Context, input WriteBatch) e
 				recordDynamoError(tableName, err)
 			}
 		}
+		d.recordBatchWrite(reqs, resp, err)
 
 		// If there are unprocessed items, backoff and retry those items.
 		if unprocessedItems := resp.UnprocessedItems; unprocessedItems != nil && dictLen(unprocessedItems) > 0 {
+			if dictLen(unprocessedItems) == dictLen(reqs) {
+				numRetries++
+			} else {
+				numRetries = 0
+			}
 			takeReqs(unprocessedItems, unprocessed, -1)
 			time.Sleep(backoff)
 			backoff = nextBackoff(backoff)
@@ -160,7 +221,43 @@ func (d dynamoClientAdapter) BatchWrite(ctx context.Context, input WriteBatch) e
 	if valuesLeft := dictLen(outstanding) + dictLen(unprocessed); valuesLeft > 0 {
 		return fmt.Errorf("failed to write chunk after %d retries, %d values remaining", numRetries, valuesLeft)
 	}
-	return nil
+	return shed
+}
+
+var (
+	// errAllUnprocessed records a table none of whose items in a
+	// BatchWriteItem, or keys in a BatchGetItem, were processed as
+	// throttling.
+	errAllUnprocessed = awserr.New(provisionedThroughputExceededException, "all items unprocessed", nil)
+	// errSomeUnprocessed records a table only some of whose items were
+	// processed, or a failed BatchWriteItem of many tables, as neither a
+	// failure nor a success of the table.
+	errSomeUnprocessed = errors.New("some items unprocessed")
+)
+
+// recordBatchWrite records the outcome of a BatchWriteItem of reqs with each
+// table's circuit breaker, by the table's unprocessed items.  A throttled
+// call is every table's failure, as none had any items processed; other
+// errors can only be told apart by table if there's just one.
+func (d dynamoClientAdapter) recordBatchWrite(reqs map[string][]*dynamodb.WriteRequest, resp *dynamodb.BatchWriteItemOutput, err error) {
+	for tableName, tableReqs := range reqs {
+		if err != nil {
+			if len(reqs) == 1 || dynamoErrorCode(err) == throttledError {
+				d.breakers.record(tableName, err)
+			} else {
+				d.breakers.record(tableName, errSomeUnprocessed)
+			}
+			continue
+		}
+		switch unprocessed := len(resp.UnprocessedItems[tableName]); {
+		case unprocessed == len(tableReqs):
+			d.breakers.record(tableName, errAllUnprocessed)
+		case unprocessed > 0:
+			d.breakers.record(tableName, errSomeUnprocessed)
+		default:
+			d.breakers.record(tableName, nil)
+		}
+	}
 }
 
 func (d dynamoClientAdapter) QueryPages(ctx context.Context, entry IndexEntry, callback func(result ReadBatch, lastPage bool) (shouldContinue bool)) error {
@@ -196,13 +293,16 @@ func (d dynamoClientAdapter) QueryPages(ctx context.Context, entry IndexEntry, c
 	request, _ := d.DynamoDB.QueryRequest(input)
 	backoff := minBackoff
 	for page := request; page != nil; page = page.NextPage() {
-		err := instrument.TimeRequestHistogram(ctx, "DynamoDB.QueryPages", dynamoRequestDuration, func(_ context.Context) error {
+		if err := d.breakers.allow(entry.TableName); err != nil {
+			return err
+		}
+		err := timeDynamoRequest(ctx, "DynamoDB.QueryPages", func(_ context.Context) error {
 			return page.Send()
 		})
+		d.breakers.record(entry.TableName, err)
 
 		if cc := page.Data.(*dynamodb.QueryOutput).ConsumedCapacity; cc != nil {
-			dynamoConsumedCapacity.WithLabelValues("DynamoDB.QueryPages").
-				Add(float64(*cc.CapacityUnits))
+			recordConsumedCapacity("DynamoDB.QueryPages", dynamoConsumedReadCapacity, cc)
 		}
 
 		if err != nil {
@@ -228,6 +328,75 @@ func (d dynamoClientAdapter) QueryPages(ctx context.Context, entry IndexEntry, c
 	return nil
 }
 
+// ScanPages implements IndexScanner.  Throttled pages are retried from the
+// last key read, with backoff, so a throttled scan never skips the rest of
+// the segment; it fails after maxRetries throttled requests in a row.
+func (d dynamoClientAdapter) ScanPages(ctx context.Context, tableName string, segment, totalSegments int, after *ScanCursor, callback func(entries []IndexEntry, next *ScanCursor) (shouldContinue bool)) error {
+	input := &dynamodb.ScanInput{
+		TableName:              aws.String(tableName),
+		Segment:                aws.Int64(int64(segment)),
+		TotalSegments:          aws.Int64(int64(totalSegments)),
+		ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+	}
+	if after != nil {
+		input.ExclusiveStartKey = map[string]*dynamodb.AttributeValue{
+			hashKey:  {S: aws.String(after.HashValue)},
+			rangeKey: {B: after.RangeValue},
+		}
+	}
+
+	backoff, numRetries := minBackoff, 0
+	for {
+		if err := d.breakers.allow(tableName); err != nil {
+			return err
+		}
+		var output *dynamodb.ScanOutput
+		err := timeDynamoRequest(ctx, "DynamoDB.ScanPages", func(_ context.Context) error {
+			var err error
+			output, err = d.DynamoDB.Scan(input)
+			return err
+		})
+		d.breakers.record(tableName, err)
+		if output != nil && output.ConsumedCapacity != nil {
+			recordConsumedCapacity("DynamoDB.ScanPages", dynamoConsumedReadCapacity, output.ConsumedCapacity)
+		}
+
+		if err != nil {
+			recordDynamoError(tableName, err)
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == provisionedThroughputExceededException && numRetries < maxRetries {
+				// Retry the same page: input still starts after the last key read.
+				numRetries++
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				backoff = nextBackoff(backoff)
+				continue
+			}
+			return err
+		}
+		backoff, numRetries = minBackoff, 0
+
+		entries := make([]IndexEntry, 0, len(output.Items))
+		for _, item := range output.Items {
+			entries = append(entries, IndexEntry{
+				TableName:  tableName,
+				HashValue:  aws.StringValue(item[hashKey].S),
+				RangeValue: item[rangeKey].B,
+			})
+		}
+		var next *ScanCursor
+		if key := output.LastEvaluatedKey; len(key) > 0 {
+			next = &ScanCursor{HashValue: aws.StringValue(key[hashKey].S), RangeValue: key[rangeKey].B}
+		}
+		if !callback(entries, next) || next == nil {
+			return nil
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+}
+
 func (d dynamoClientAdapter) ListTables() ([]string, error) {
 	table := []string{}
 	if err := d.DynamoDB.ListTablesPages(&dynamodb.ListTablesInput{}, func(resp *dynamodb.ListTablesOutput, _ bool) bool {
@@ -241,7 +410,7 @@ func (d dynamoClientAdapter) ListTables() ([]string, error) {
 	return table, nil
 }
 
-func (d dynamoClientAdapter) CreateTable(name string, readCapacity, writeCapacity int64) error {
+func (d dynamoClientAdapter) CreateTable(name string, readCapacity, writeCapacity int64, options TableOptions) error {
 	input := &dynamodb.CreateTableInput{
 		TableName: aws.String(name),
 		AttributeDefinitions: []*dynamodb.AttributeDefinition{
@@ -269,8 +438,53 @@ func (d dynamoClientAdapter) CreateTable(name string, readCapacity, writeCapacit
 			WriteCapacityUnits: aws.Int64(writeCapacity),
 		},
 	}
-	_, err := d.DynamoDB.CreateTable(input)
-	return err
+	if options.StreamViewType != "" {
+		input.StreamSpecification = &dynamodb.StreamSpecification{
+			StreamEnabled:  aws.Bool(true),
+			StreamViewType: aws.String(options.StreamViewType),
+		}
+	}
+	req, _ := d.DynamoDB.CreateTableRequest(input)
+	if options.SSEEnabled {
+		sse := map[string]interface{}{"Enabled": true}
+		if options.SSEKMSKeyID != "" {
+			sse["SSEType"] = "KMS"
+			sse["KMSMasterKeyId"] = options.SSEKMSKeyID
+		}
+		req.Handlers.Build.PushBack(addToRequestBody("SSESpecification", sse))
+	}
+	if len(options.Tags) > 0 {
+		tags := make([]map[string]string, 0, len(options.Tags))
+		for k, v := range options.Tags {
+			tags = append(tags, map[string]string{"Key": k, "Value": v})
+		}
+		req.Handlers.Build.PushBack(addToRequestBody("Tags", tags))
+	}
+	return req.Send()
+}
+
+// addToRequestBody adds a field to the JSON body of a request, for settings
+// newer than our version of the AWS SDK.
+func addToRequestBody(field string, value interface{}) func(*request.Request) {
+	return func(r *request.Request) {
+		if r.Error != nil {
+			return
+		}
+		body := map[string]interface{}{}
+		buf, err := ioutil.ReadAll(r.Body)
+		if err == nil {
+			err = json.Unmarshal(buf, &body)
+		}
+		if err == nil {
+			body[field] = value
+			buf, err = json.Marshal(body)
+		}
+		if err != nil {
+			r.Error = err
+			return
+		}
+		r.SetBufferBody(buf)
+	}
 }
 
 func (d dynamoClientAdapter) DescribeTable(name string) (readCapacity, writeCapacity int64, status string, err error) {
@@ -295,6 +509,166 @@ func (d dynamoClientAdapter) UpdateTable(name string, readCapacity, writeCapacit
 	return err
 }
 
+// sendNewerOperation calls an operation newer than our version of the AWS
+// SDK, borrowing a request from one it does know.
+func (d dynamoClientAdapter) sendNewerOperation(name string, input, output interface{}) error {
+	req, _ := d.DynamoDB.DescribeTableRequest(&dynamodb.DescribeTableInput{})
+	req.Operation = &request.Operation{
+		Name:       name,
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}
+	req.Params, req.Data = input, output
+	return req.Send()
+}
+
+type listTagsOfResourceInput struct {
+	_           struct{} `type:"structure"`
+	ResourceArn *string  `type:"string" required:"true"`
+	NextToken   *string  `type:"string"`
+}
+
+type listTagsOfResourceOutput struct {
+	_         struct{}       `type:"structure"`
+	NextToken *string        `type:"string"`
+	Tags      []*resourceTag `type:"list"`
+}
+
+type resourceTag struct {
+	_     struct{} `type:"structure"`
+	Key   *string  `type:"string"`
+	Value *string  `type:"string"`
+}
+
+func (d dynamoClientAdapter) TableTags(name string) (map[string]string, error) {
+	out, err := d.DynamoDB.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: aws.String(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tags := map[string]string{}
+	input := &listTagsOfResourceInput{ResourceArn: out.Table.TableArn}
+	for {
+		output := &listTagsOfResourceOutput{}
+		if err := d.sendNewerOperation("ListTagsOfResource", input, output); err != nil {
+			return nil, err
+		}
+		for _, tag := range output.Tags {
+			tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+		if output.NextToken == nil {
+			return tags, nil
+		}
+		input.NextToken = output.NextToken
+	}
+}
+
+type tableNameInput struct {
+	_         struct{} `type:"structure"`
+	TableName *string  `type:"string" required:"true"`
+}
+
+type describeContinuousBackupsOutput struct {
+	_                            struct{}                      `type:"structure"`
+	ContinuousBackupsDescription *continuousBackupsDescription `type:"structure"`
+}
+
+type continuousBackupsDescription struct {
+	_                              struct{}                        `type:"structure"`
+	PointInTimeRecoveryDescription *pointInTimeRecoveryDescription `type:"structure"`
+}
+
+type pointInTimeRecoveryDescription struct {
+	_                         struct{} `type:"structure"`
+	PointInTimeRecoveryStatus *string  `type:"string"`
+}
+
+func (d dynamoClientAdapter) PointInTimeRecoveryEnabled(name string) (bool, error) {
+	output := &describeContinuousBackupsOutput{}
+	if err := d.sendNewerOperation("DescribeContinuousBackups", &tableNameInput{TableName: aws.String(name)}, output); err != nil {
+		return false, err
+	}
+	if desc := output.ContinuousBackupsDescription; desc != nil && desc.PointInTimeRecoveryDescription != nil {
+		return aws.StringValue(desc.PointInTimeRecoveryDescription.PointInTimeRecoveryStatus) == "ENABLED", nil
+	}
+	return false, nil
+}
+
+type updateContinuousBackupsInput struct {
+	_                                struct{}                          `type:"structure"`
+	TableName                        *string                           `type:"string" required:"true"`
+	PointInTimeRecoverySpecification *pointInTimeRecoverySpecification `type:"structure" required:"true"`
+}
+
+type pointInTimeRecoverySpecification struct {
+	_                          struct{} `type:"structure"`
+	PointInTimeRecoveryEnabled *bool    `type:"boolean" required:"true"`
+}
+
+// emptyOutput is for operations whose output we don't need.
+type emptyOutput struct {
+	_ struct{} `type:"structure"`
+}
+
+func (d dynamoClientAdapter) EnablePointInTimeRecovery(name string) error {
+	return d.sendNewerOperation("UpdateContinuousBackups", &updateContinuousBackupsInput{
+		TableName:                        aws.String(name),
+		PointInTimeRecoverySpecification: &pointInTimeRecoverySpecification{PointInTimeRecoveryEnabled: aws.Bool(true)},
+	}, &emptyOutput{})
+}
+
+type listBackupsInput struct {
+	_                       struct{}   `type:"structure"`
+	TableName               *string    `type:"string"`
+	TimeRangeLowerBound     *time.Time `type:"timestamp" timestampFormat:"unix"`
+	ExclusiveStartBackupArn *string    `type:"string"`
+}
+
+type listBackupsOutput struct {
+	_                      struct{}         `type:"structure"`
+	BackupSummaries        []*backupSummary `type:"list"`
+	LastEvaluatedBackupArn *string          `type:"string"`
+}
+
+type backupSummary struct {
+	_            struct{} `type:"structure"`
+	BackupStatus *string  `type:"string"`
+}
+
+func (d dynamoClientAdapter) HasBackupSince(name string, since time.Time) (bool, error) {
+	input := &listBackupsInput{TableName: aws.String(name), TimeRangeLowerBound: aws.Time(since)}
+	for {
+		output := &listBackupsOutput{}
+		if err := d.sendNewerOperation("ListBackups", input, output); err != nil {
+			return false, err
+		}
+		for _, backup := range output.BackupSummaries {
+			if aws.StringValue(backup.BackupStatus) != "DELETED" {
+				return true, nil
+			}
+		}
+		if output.LastEvaluatedBackupArn == nil {
+			return false, nil
+		}
+		input.ExclusiveStartBackupArn = output.LastEvaluatedBackupArn
+	}
+}
+
+type createBackupInput struct {
+	_          struct{} `type:"structure"`
+	TableName  *string  `type:"string" required:"true"`
+	BackupName *string  `type:"string" required:"true"`
+}
+
+func (d dynamoClientAdapter) CreateBackup(name, backupName string) error {
+	return d.sendNewerOperation("CreateBackup", &createBackupInput{
+		TableName:  aws.String(name),
+		BackupName: aws.String(backupName),
+	}, &emptyOutput{})
+}
+
 type dynamoDBWriteBatch map[string][]*dynamodb.WriteRequest
 
 func (b dynamoDBWriteBatch) Add(tableName, hashValue string, rangeValue []byte) {
@@ -308,6 +682,10 @@ func (b dynamoDBWriteBatch) Add(tableName, hashValue string, rangeValue []byte)
 	})
 }
 
+func (b dynamoDBWriteBatch) Len() int {
+	return dictLen(b)
+}
+
 type dynamoDBReadBatch []map[string]*dynamodb.AttributeValue
 
 func (b dynamoDBReadBatch) Len() int {
@@ -336,6 +714,36 @@ func nextBackoff(lastBackoff time.Duration) time.Duration {
 	return backoff
 }
 
+// timeDynamoRequest is instrument.TimeRequestHistogram for DynamoDB, also
+// labelling the duration with the kind of error, so throttles can be told
+// apart from real failures.
+func timeDynamoRequest(ctx context.Context, operation string, f func(context.Context) error) error {
+	start := time.Now()
+	err := instrument.TimeRequestHistogram(ctx, operation, nil, f)
+	dynamoRequestDuration.WithLabelValues(operation, instrument.ErrorCode(err), dynamoErrorCode(err)).Observe(time.Since(start).Seconds())
+	return err
+}
+
+func dynamoErrorCode(err error) string {
+	if err == nil {
+		return noError
+	}
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return otherError
+	}
+	switch awsErr.Code() {
+	case provisionedThroughputExceededException, "ThrottlingException", "RequestLimitExceeded":
+		return throttledError
+	case "ConditionalCheckFailedException":
+		return conditionalCheckFailed
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() >= 500 {
+		return serverError
+	}
+	return awsErr.Code()
+}
+
 func recordDynamoError(tableName string, err error) {
 	if awsErr, ok := err.(awserr.Error); ok {
 		dynamoFailures.WithLabelValues(tableName, awsErr.Code()).Add(float64(1))
@@ -20,7 +20,15 @@ type mockDynamoDBClient struct {
 	mtx            sync.RWMutex
 	unprocessed    int
 	provisionedErr int
+	batchWrites    int
+	batchGets      int
 	tables         map[string]*mockDynamoDBTable
+
+	// Scans return pages of this many items, and the calls numbered here,
+	// from 0, are throttled.
+	scanPageSize  int
+	scanCalls     int
+	throttleScans map[int]bool
 }
 
 type mockDynamoDBTable struct {
@@ -48,6 +56,7 @@ func (m *mockDynamoDBClient) createTable(name string) {
 func (m *mockDynamoDBClient) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
+	m.batchWrites++
 
 	resp := &dynamodb.BatchWriteItemOutput{
 		UnprocessedItems: map[string][]*dynamodb.WriteRequest{},
@@ -95,6 +104,108 @@ func (m *mockDynamoDBClient) BatchWriteItem(input *dynamodb.BatchWriteItemInput)
 	return resp, nil
 }
 
+func (m *mockDynamoDBClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	table, ok := m.tables[*input.TableName]
+	if !ok {
+		return &dynamodb.PutItemOutput{}, fmt.Errorf("table not found")
+	}
+	hashValue := *input.Item[hashKey].S
+	items := table.items[hashValue]
+	for i, item := range items {
+		if bytes.Equal(item[rangeKey].B, input.Item[rangeKey].B) {
+			items[i] = input.Item
+			return &dynamodb.PutItemOutput{}, nil
+		}
+	}
+	table.items[hashValue] = append(items, input.Item)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (m *mockDynamoDBClient) BatchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.batchGets++
+
+	resp := &dynamodb.BatchGetItemOutput{
+		Responses:       map[string][]map[string]*dynamodb.AttributeValue{},
+		UnprocessedKeys: map[string]*dynamodb.KeysAndAttributes{},
+	}
+	if m.provisionedErr > 0 {
+		m.provisionedErr--
+		return resp, awserr.New(provisionedThroughputExceededException, "", nil)
+	}
+
+	for tableName, keys := range input.RequestItems {
+		if len(keys.Keys) > 100 {
+			return &dynamodb.BatchGetItemOutput{}, fmt.Errorf("too many keys")
+		}
+		table, ok := m.tables[tableName]
+		if !ok {
+			return &dynamodb.BatchGetItemOutput{}, fmt.Errorf("table not found")
+		}
+		for _, key := range keys.Keys {
+			if m.unprocessed > 0 {
+				m.unprocessed--
+				if resp.UnprocessedKeys[tableName] == nil {
+					resp.UnprocessedKeys[tableName] = &dynamodb.KeysAndAttributes{}
+				}
+				resp.UnprocessedKeys[tableName].Keys = append(resp.UnprocessedKeys[tableName].Keys, key)
+				continue
+			}
+			for _, item := range table.items[*key[hashKey].S] {
+				if bytes.Equal(item[rangeKey].B, key[rangeKey].B) {
+					resp.Responses[tableName] = append(resp.Responses[tableName], item)
+				}
+			}
+		}
+	}
+	return resp, nil
+}
+
+// Scan ignores segments, scanning every item in hash and range order.
+func (m *mockDynamoDBClient) Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	call := m.scanCalls
+	m.scanCalls++
+	if m.throttleScans[call] {
+		return &dynamodb.ScanOutput{}, awserr.New(provisionedThroughputExceededException, "", nil)
+	}
+
+	table, ok := m.tables[*input.TableName]
+	if !ok {
+		return &dynamodb.ScanOutput{}, fmt.Errorf("table not found")
+	}
+	var items []mockDynamoDBItem
+	for _, hashItems := range table.items {
+		items = append(items, hashItems...)
+	}
+	less := func(a, b mockDynamoDBItem) bool {
+		if *a[hashKey].S != *b[hashKey].S {
+			return *a[hashKey].S < *b[hashKey].S
+		}
+		return bytes.Compare(a[rangeKey].B, b[rangeKey].B) < 0
+	}
+	sort.Slice(items, func(i, j int) bool { return less(items[i], items[j]) })
+	if start := input.ExclusiveStartKey; start != nil {
+		i := sort.Search(len(items), func(i int) bool { return less(start, items[i]) })
+		items = items[i:]
+	}
+
+	output := &dynamodb.ScanOutput{}
+	for _, item := range items {
+		if len(output.Items) == m.scanPageSize {
+			last := output.Items[len(output.Items)-1]
+			output.LastEvaluatedKey = map[string]*dynamodb.AttributeValue{hashKey: last[hashKey], rangeKey: last[rangeKey]}
+			break
+		}
+		output.Items = append(output.Items, item)
+	}
+	return output, nil
+}
+
 func TestDynamoDBClient(t *testing.T) {
 	dynamoDB := newMockDynamoDB(0, 0)
 	client := dynamoClientAdapter{
@@ -110,3 +221,101 @@ func TestDynamoDBClient(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestDynamoDBClientAcrossTables(t *testing.T) {
+	// Some of the requests are unprocessed, as if a table were throttled.
+	dynamoDB := newMockDynamoDB(5, 0)
+	client := dynamoClientAdapter{
+		DynamoDB: dynamoDB,
+	}
+	batch := client.NewWriteBatch()
+	for _, table := range []string{"table1", "table2"} {
+		dynamoDB.createTable(table)
+		for i := 0; i < 10; i++ {
+			batch.Add(table, fmt.Sprintf("hash%d", i), []byte(fmt.Sprintf("range%d", i)))
+		}
+	}
+
+	if err := client.BatchWrite(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	// Both tables' requests fit in one call, and the unprocessed ones are
+	// retried in another.
+	if dynamoDB.batchWrites != 2 {
+		t.Errorf("expected 2 BatchWriteItem calls, have %d", dynamoDB.batchWrites)
+	}
+	for _, table := range []string{"table1", "table2"} {
+		if have := len(dynamoDB.tables[table].items); have != 10 {
+			t.Errorf("%s: expected 10 items, have %d", table, have)
+		}
+	}
+}
+
+func TestDynamoDBScanPagesThrottled(t *testing.T) {
+	dynamoDB := newMockDynamoDB(0, 0)
+	client := dynamoClientAdapter{
+		DynamoDB: dynamoDB,
+	}
+	dynamoDB.createTable("table")
+	batch := client.NewWriteBatch()
+	for i := 0; i < 10; i++ {
+		batch.Add("table", fmt.Sprintf("hash%d", i), []byte(fmt.Sprintf("range%d", i)))
+	}
+	if err := client.BatchWrite(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second and third pages are throttled once each, partway through
+	// the segment; they're retried, so every entry is still read once.
+	dynamoDB.scanPageSize = 3
+	dynamoDB.throttleScans = map[int]bool{1: true, 3: true}
+	var hashes []string
+	pages := 0
+	err := client.ScanPages(context.Background(), "table", 0, 1, nil, func(entries []IndexEntry, next *ScanCursor) bool {
+		pages++
+		for _, entry := range entries {
+			hashes = append(hashes, entry.HashValue)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 10 || hashes[0] != "hash0" || hashes[9] != "hash9" {
+		t.Errorf("expected hash0..hash9, have %v", hashes)
+	}
+	if pages != 4 || dynamoDB.scanCalls != 6 {
+		t.Errorf("expected 4 pages in 6 calls, have %d pages in %d calls", pages, dynamoDB.scanCalls)
+	}
+
+	// A scan throttled every time fails, rather than ending early.
+	dynamoDB.scanCalls = 0
+	dynamoDB.throttleScans = map[int]bool{}
+	for i := 0; i <= maxRetries; i++ {
+		dynamoDB.throttleScans[i] = true
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = client.ScanPages(ctx, "table", 0, 1, nil, func([]IndexEntry, *ScanCursor) bool { return true })
+	if err == nil {
+		t.Errorf("expected throttled scan to fail")
+	}
+}
+
+func TestDynamoErrorCode(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		expected string
+	}{
+		{nil, noError},
+		{fmt.Errorf("boom"), otherError},
+		{awserr.New(provisionedThroughputExceededException, "", nil), throttledError},
+		{awserr.New("ConditionalCheckFailedException", "", nil), conditionalCheckFailed},
+		{awserr.NewRequestFailure(awserr.New("InternalServerError", "", nil), 500, ""), serverError},
+		{awserr.NewRequestFailure(awserr.New("ValidationException", "", nil), 400, ""), "ValidationException"},
+	} {
+		if have := dynamoErrorCode(tc.err); have != tc.expected {
+			t.Errorf("%v: expected %s, have %s", tc.err, tc.expected, have)
+		}
+	}
+}
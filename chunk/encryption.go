@@ -0,0 +1,303 @@
+package chunk
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+
+	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/cortex/util"
+)
+
+// envelopeMagic starts every encrypted chunk.  Unencrypted chunks start with
+// the length of their metadata, which is never this large.
+var envelopeMagic = []byte("CXE1")
+
+// EncryptionConfig configures envelope encryption of chunks for tenants with
+// their own master keys.
+type EncryptionConfig struct {
+	KeyProvider string
+	KeysFile    string
+	KMS         util.URLValue
+	DataKeyTTL  time.Duration
+
+	mockKMS KMSClient
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *EncryptionConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.KeyProvider, "encryption.key-provider", "", "Where tenants' master keys are kept: kms or static (empty to disable chunk encryption).")
+	f.StringVar(&cfg.KeysFile, "encryption.keys-file", "", "YAML file mapping each tenant whose chunks are encrypted to its master key: a KMS key ID for kms, or a base64 AES-256 key for static.")
+	f.Var(&cfg.KMS, "encryption.kms-url", "KMS endpoint URL with escaped Key and Secret encoded.")
+	f.DurationVar(&cfg.DataKeyTTL, "encryption.data-key-ttl", time.Hour, "How long to encrypt a tenant's chunks with the same data key, and to cache decrypted data keys.")
+}
+
+// tenantKeys is the content of -encryption.keys-file, like:
+//
+//	tenants:
+//	  acme: arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab
+type tenantKeys struct {
+	Tenants map[string]string `yaml:"tenants"`
+}
+
+// KeyProvider generates data keys encrypted under tenants' master keys, and
+// decrypts them again, like a KMS.
+type KeyProvider interface {
+	// GenerateDataKey returns a new AES-256 key for userID, both in plaintext
+	// and encrypted under userID's master key.
+	GenerateDataKey(ctx context.Context, userID string) (key, encryptedKey []byte, err error)
+
+	// DecryptDataKey decrypts an encryptedKey returned by GenerateDataKey.
+	DecryptDataKey(ctx context.Context, userID string, encryptedKey []byte) ([]byte, error)
+}
+
+func newKeyProvider(cfg EncryptionConfig, masterKeys map[string]string) (KeyProvider, error) {
+	switch cfg.KeyProvider {
+	case "kms":
+		kmsClient := cfg.mockKMS
+		if kmsClient == nil {
+			var err error
+			kmsClient, err = NewKMSClient(cfg.KMS.String())
+			if err != nil {
+				return nil, err
+			}
+		}
+		return kmsKeyProvider{kms: kmsClient, keyIDs: masterKeys}, nil
+	case "static":
+		return newStaticKeyProvider(masterKeys)
+	default:
+		return nil, fmt.Errorf("unknown key provider %q", cfg.KeyProvider)
+	}
+}
+
+// newEncryptingBlobClient wraps next so the chunks of tenants listed in
+// cfg.KeysFile are encrypted.
+func newEncryptingBlobClient(cfg EncryptionConfig, next blobClient) (blobClient, error) {
+	if cfg.KeysFile == "" {
+		return nil, fmt.Errorf("-encryption.keys-file is required")
+	}
+	var keys tenantKeys
+	buf, err := ioutil.ReadFile(cfg.KeysFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(buf, &keys); err != nil {
+		return nil, err
+	}
+	provider, err := newKeyProvider(cfg, keys.Tenants)
+	if err != nil {
+		return nil, err
+	}
+	c := &encryptingBlobClient{
+		blobClient:  next,
+		provider:    provider,
+		tenants:     keys.Tenants,
+		ttl:         cfg.DataKeyTTL,
+		current:     map[string]dataKey{},
+		decryptions: map[string]dataKey{},
+	}
+	if batch, ok := next.(batchBlobClient); ok {
+		return batchEncryptingBlobClient{c, batch}, nil
+	}
+	return c, nil
+}
+
+// encryptingBlobClient envelope-encrypts chunks: each is sealed with
+// AES-256-GCM under a data key from the KeyProvider, and stored alongside
+// that data key encrypted under the tenant's master key.  Data keys are
+// reused for a while so we don't call the KMS for every chunk.
+type encryptingBlobClient struct {
+	blobClient
+	provider KeyProvider
+	tenants  map[string]string
+	ttl      time.Duration
+
+	mtx         sync.Mutex
+	current     map[string]dataKey // by tenant
+	decryptions map[string]dataKey // by encrypted key
+}
+
+type dataKey struct {
+	key          []byte
+	encryptedKey []byte
+	expires      time.Time
+}
+
+func (c *encryptingBlobClient) putBlob(ctx context.Context, userID string, chunk *Chunk, buf []byte) error {
+	if _, ok := c.tenants[userID]; !ok {
+		return c.blobClient.putBlob(ctx, userID, chunk, buf)
+	}
+	key, err := c.dataKey(ctx, userID)
+	if err != nil {
+		return err
+	}
+	sealed, err := sealEnvelope(key, userID, chunk.ID, buf)
+	if err != nil {
+		return err
+	}
+	return c.blobClient.putBlob(ctx, userID, chunk, sealed)
+}
+
+func (c *encryptingBlobClient) getBlob(ctx context.Context, userID string, chunk *Chunk) ([]byte, error) {
+	buf, err := c.blobClient.getBlob(ctx, userID, chunk)
+	if err != nil {
+		return nil, err
+	}
+	return c.open(ctx, userID, chunk, buf)
+}
+
+// open decrypts the blob buf of chunk.
+func (c *encryptingBlobClient) open(ctx context.Context, userID string, chunk *Chunk, buf []byte) ([]byte, error) {
+	if !bytes.HasPrefix(buf, envelopeMagic) {
+		// Chunks written before the tenant's encryption was turned on are
+		// still readable.
+		return buf, nil
+	}
+	encryptedKey, err := envelopeKey(buf)
+	if err != nil {
+		return nil, err
+	}
+	key, err := c.decryptDataKey(ctx, userID, encryptedKey)
+	if err != nil {
+		return nil, err
+	}
+	return openEnvelope(key, userID, chunk.ID, buf)
+}
+
+// batchEncryptingBlobClient is an encryptingBlobClient of a
+// batchBlobClient, so fetches stay batched.
+type batchEncryptingBlobClient struct {
+	*encryptingBlobClient
+	next batchBlobClient
+}
+
+func (c batchEncryptingBlobClient) getBlobs(ctx context.Context, userID string, chunks []Chunk) ([][]byte, error) {
+	bufs, err := c.next.getBlobs(ctx, userID, chunks)
+	if err != nil {
+		return nil, err
+	}
+	for i := range bufs {
+		if bufs[i], err = c.open(ctx, userID, &chunks[i], bufs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return bufs, nil
+}
+
+func (c *encryptingBlobClient) dataKey(ctx context.Context, userID string) (dataKey, error) {
+	now := mtime.Now()
+	c.mtx.Lock()
+	key, ok := c.current[userID]
+	c.mtx.Unlock()
+	if ok && now.Before(key.expires) {
+		return key, nil
+	}
+
+	plaintext, encrypted, err := c.provider.GenerateDataKey(ctx, userID)
+	if err != nil {
+		return dataKey{}, err
+	}
+	key = dataKey{key: plaintext, encryptedKey: encrypted, expires: now.Add(c.ttl)}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.current[userID] = key
+	c.decryptions[string(encrypted)] = key
+	return key, nil
+}
+
+func (c *encryptingBlobClient) decryptDataKey(ctx context.Context, userID string, encryptedKey []byte) ([]byte, error) {
+	now := mtime.Now()
+	c.mtx.Lock()
+	key, ok := c.decryptions[string(encryptedKey)]
+	c.mtx.Unlock()
+	if ok && now.Before(key.expires) {
+		return key.key, nil
+	}
+
+	plaintext, err := c.provider.DecryptDataKey(ctx, userID, encryptedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for k, cached := range c.decryptions {
+		if !now.Before(cached.expires) {
+			delete(c.decryptions, k)
+		}
+	}
+	c.decryptions[string(encryptedKey)] = dataKey{key: plaintext, encryptedKey: encryptedKey, expires: now.Add(c.ttl)}
+	return plaintext, nil
+}
+
+// sealEnvelope encrypts buf, as: magic, encrypted data key length (2 bytes),
+// encrypted data key, nonce, ciphertext.  The tenant and chunk ID are
+// authenticated, so a chunk can't be passed off as another.
+func sealEnvelope(key dataKey, userID, chunkID string, buf []byte) ([]byte, error) {
+	aead, err := newAEAD(key.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(key.encryptedKey) > 0xffff {
+		return nil, fmt.Errorf("encrypted data key too long: %d bytes", len(key.encryptedKey))
+	}
+
+	result := make([]byte, 0, len(envelopeMagic)+2+len(key.encryptedKey)+aead.NonceSize()+len(buf)+aead.Overhead())
+	result = append(result, envelopeMagic...)
+	result = append(result, byte(len(key.encryptedKey)>>8), byte(len(key.encryptedKey)))
+	result = append(result, key.encryptedKey...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	result = append(result, nonce...)
+	return aead.Seal(result, nonce, buf, []byte(chunkName(userID, chunkID))), nil
+}
+
+func envelopeKey(buf []byte) ([]byte, error) {
+	buf = buf[len(envelopeMagic):]
+	if len(buf) < 2 {
+		return nil, fmt.Errorf("truncated encrypted chunk")
+	}
+	keyLen := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 2+keyLen {
+		return nil, fmt.Errorf("truncated encrypted chunk")
+	}
+	return buf[2 : 2+keyLen], nil
+}
+
+func openEnvelope(key []byte, userID, chunkID string, buf []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	encryptedKey, err := envelopeKey(buf)
+	if err != nil {
+		return nil, err
+	}
+	buf = buf[len(envelopeMagic)+2+len(encryptedKey):]
+	if len(buf) < aead.NonceSize() {
+		return nil, fmt.Errorf("truncated encrypted chunk")
+	}
+	return aead.Open(nil, buf[:aead.NonceSize()], buf[aead.NonceSize():], []byte(chunkName(userID, chunkID)))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,144 @@
+package chunk
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type mockKMS struct {
+	mtx         sync.Mutex
+	keys        map[string][]byte
+	generations int
+	decryptions int
+}
+
+func (m *mockKMS) GenerateDataKey(input *kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.generations++
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	encrypted := []byte(fmt.Sprintf("%s/%s/%d", *input.KeyId, *input.EncryptionContext["cortex_tenant"], m.generations))
+	m.keys[string(encrypted)] = key
+	return &kms.GenerateDataKeyOutput{Plaintext: key, CiphertextBlob: encrypted}, nil
+}
+
+func (m *mockKMS) Decrypt(input *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.decryptions++
+	if !bytes.Contains(input.CiphertextBlob, []byte("/"+*input.EncryptionContext["cortex_tenant"]+"/")) {
+		return nil, fmt.Errorf("wrong encryption context")
+	}
+	key, ok := m.keys[string(input.CiphertextBlob)]
+	if !ok {
+		return nil, fmt.Errorf("unknown key")
+	}
+	return &kms.DecryptOutput{Plaintext: key}, nil
+}
+
+func rawObject(s3 *MockS3, userID, chunkID string) []byte {
+	return s3.buckets[""].objects[chunkName(userID, chunkID)]
+}
+
+func TestEncryptingBlobClient(t *testing.T) {
+	masterKey := make([]byte, dataKeySize)
+	_, err := rand.Read(masterKey)
+	require.NoError(t, err)
+	filename := writeTempFile(t, fmt.Sprintf("tenants:\n  acme: %s\n", base64.StdEncoding.EncodeToString(masterKey)))
+	defer os.Remove(filename)
+
+	s3 := NewMockS3()
+	blobs, err := newEncryptingBlobClient(EncryptionConfig{
+		KeyProvider: "static",
+		KeysFile:    filename,
+		DataKeyTTL:  time.Hour,
+	}, s3ObjectClient{s3: s3})
+	require.NoError(t, err)
+	client := blobObjectClient{blobs}
+
+	ctx := context.Background()
+	chunk := dummyObjectChunk(model.Now())
+	r, err := chunk.reader()
+	require.NoError(t, err)
+	plaintext, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+
+	for _, userID := range []string{"acme", "other"} {
+		require.NoError(t, client.PutChunk(ctx, userID, &chunk))
+		fetched := Chunk{ID: chunk.ID, From: chunk.From, Through: chunk.Through}
+		require.NoError(t, client.GetChunk(ctx, userID, &fetched))
+		assert.Equal(t, chunk.Metric, fetched.Metric)
+	}
+	assert.True(t, bytes.HasPrefix(rawObject(s3, "acme", chunk.ID), envelopeMagic))
+	assert.False(t, bytes.Contains(rawObject(s3, "acme", chunk.ID), plaintext))
+	assert.Equal(t, plaintext, rawObject(s3, "other", chunk.ID))
+
+	// An encrypted chunk can't be passed off as another.
+	other := dummyObjectChunk(chunk.From.Add(time.Minute))
+	s3.buckets[""].objects[chunkName("acme", other.ID)] = rawObject(s3, "acme", chunk.ID)
+	assert.Error(t, client.GetChunk(ctx, "acme", &other))
+
+	// Chunks written before encryption was enabled are still readable.
+	s3.buckets[""].objects[chunkName("acme", other.ID)] = plaintext
+	require.NoError(t, client.GetChunk(ctx, "acme", &other))
+	assert.Equal(t, chunk.Metric, other.Metric)
+}
+
+func TestEncryptingBlobClientKMS(t *testing.T) {
+	filename := writeTempFile(t, "tenants:\n  acme: alias/acme\n")
+	defer os.Remove(filename)
+
+	s3 := NewMockS3()
+	kmsClient := &mockKMS{keys: map[string][]byte{}}
+	newClient := func() ObjectClient {
+		blobs, err := newEncryptingBlobClient(EncryptionConfig{
+			KeyProvider: "kms",
+			KeysFile:    filename,
+			DataKeyTTL:  time.Hour,
+			mockKMS:     kmsClient,
+		}, s3ObjectClient{s3: s3})
+		require.NoError(t, err)
+		return blobObjectClient{blobs}
+	}
+
+	ctx := context.Background()
+	client := newClient()
+	chunks := []Chunk{dummyObjectChunk(0), dummyObjectChunk(model.TimeFromUnix(60))}
+	for i := range chunks {
+		require.NoError(t, client.PutChunk(ctx, "acme", &chunks[i]))
+		fetched := Chunk{ID: chunks[i].ID, From: chunks[i].From, Through: chunks[i].Through}
+		require.NoError(t, client.GetChunk(ctx, "acme", &fetched))
+	}
+	assert.Equal(t, 1, kmsClient.generations)
+	assert.Equal(t, 0, kmsClient.decryptions)
+
+	// A fresh client has to decrypt the data key, but only once.
+	client = newClient()
+	for _, chunk := range chunks {
+		fetched := Chunk{ID: chunk.ID, From: chunk.From, Through: chunk.Through}
+		require.NoError(t, client.GetChunk(ctx, "acme", &fetched))
+		assert.Equal(t, chunk.Metric, fetched.Metric)
+	}
+	assert.Equal(t, 1, kmsClient.decryptions)
+
+	// Another tenant can't use acme's data key.
+	s3.buckets[""].objects[chunkName("other", chunks[0].ID)] = rawObject(s3, "acme", chunks[0].ID)
+	fetched := Chunk{ID: chunks[0].ID, From: chunks[0].From, Through: chunks[0].Through}
+	assert.Error(t, newClient().GetChunk(ctx, "other", &fetched))
+}
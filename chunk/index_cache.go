@@ -0,0 +1,215 @@
+package chunk
+
+import (
+	"container/list"
+	"flag"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+var (
+	indexCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "index_cache_requests_total",
+		Help:      "Index lookups served from (hit) or missing from (miss) the index cache.",
+	}, []string{"result"})
+	indexCacheNegativeHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "index_cache_negative_hits_total",
+		Help:      "Index lookups served from the index cache which found no chunks.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(indexCacheRequests)
+	prometheus.MustRegister(indexCacheNegativeHits)
+}
+
+// IndexCacheConfig configures the in-process cache of index lookups.
+type IndexCacheConfig struct {
+	Size           int
+	ActiveTTL      time.Duration
+	NegativeTTL    time.Duration
+	ImmutableAfter time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *IndexCacheConfig) RegisterFlags(f *flag.FlagSet) {
+	f.IntVar(&cfg.Size, "store.index-cache-size", 0, "Number of index lookups to cache (0 to disable).")
+	f.DurationVar(&cfg.ActiveTTL, "store.index-cache-active-ttl", time.Minute, "How long to cache lookups of index buckets which may still be written to.")
+	f.DurationVar(&cfg.NegativeTTL, "store.index-cache-negative-ttl", 30*time.Second, "How long to cache lookups finding no chunks, of index buckets which may still be written to (0 to not cache them); as queriers don't see the ingesters' writes, they may miss new series for this long.")
+	f.DurationVar(&cfg.ImmutableAfter, "store.index-cache-immutable-after", 14*time.Hour, "How long after a bucket ends before it is assumed no more chunks will be written to it, and its lookups can be cached until evicted. Must be more than the ingester max chunk age.")
+}
+
+// indexCache is an LRU cache of the chunk IDs found by looking up an index
+// entry with a matcher.  Lookups finding none, as for sparse series, are
+// cached too, for the shorter NegativeTTL while their bucket may be written
+// to, and until the row is written to by this process.  Only the ingesters
+// write the index, so in queriers only the TTLs apply: a series written
+// since a lookup found none is missed until NegativeTTL passes.
+type indexCache struct {
+	cfg IndexCacheConfig
+
+	mtx     sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	// The keys of cached lookups finding no chunks, by row (see rowKey).
+	negatives map[string]map[string]struct{}
+}
+
+type indexCacheEntry struct {
+	key     string
+	chunks  ByID
+	expires time.Time // zero if the bucket is immutable.
+}
+
+func newIndexCache(cfg IndexCacheConfig) *indexCache {
+	return &indexCache{
+		cfg:       cfg,
+		lru:       list.New(),
+		entries:   map[string]*list.Element{},
+		negatives: map[string]map[string]struct{}{},
+	}
+}
+
+func indexCacheKey(entry IndexEntry, matcher *metric.LabelMatcher) string {
+	matcherString := ""
+	if matcher != nil {
+		matcherString = matcher.String()
+	}
+	return strings.Join([]string{
+		entry.TableName,
+		entry.HashValue,
+		string(entry.RangeValuePrefix),
+		string(entry.RangeValueStart),
+		matcherString,
+	}, "\xff")
+}
+
+// rowKey returns the part of an indexCacheKey identifying the row looked up.
+func rowKey(key string) string {
+	if i := strings.IndexByte(key, '\xff'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '\xff'); j >= 0 {
+			return key[:i+1+j]
+		}
+	}
+	return key
+}
+
+func (c *indexCache) get(key string, now time.Time) (ByID, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	elem, ok := c.entries[key]
+	if ok {
+		entry := elem.Value.(*indexCacheEntry)
+		if entry.expires.IsZero() || now.Before(entry.expires) {
+			c.lru.MoveToFront(elem)
+			indexCacheRequests.WithLabelValues("hit").Inc()
+			if len(entry.chunks) == 0 {
+				indexCacheNegativeHits.Inc()
+			}
+			return entry.chunks, true
+		}
+		c.remove(elem)
+	}
+	indexCacheRequests.WithLabelValues("miss").Inc()
+	return nil, false
+}
+
+// put caches chunks for key, which was in a bucket ending at bucketEnd.
+func (c *indexCache) put(key string, chunks ByID, bucketEnd model.Time, now time.Time) {
+	var expires time.Time
+	if bucketEnd.Time().Add(c.cfg.ImmutableAfter).After(now) {
+		ttl := c.cfg.ActiveTTL
+		if len(chunks) == 0 {
+			ttl = c.cfg.NegativeTTL
+		}
+		if ttl <= 0 {
+			return
+		}
+		expires = now.Add(ttl)
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&indexCacheEntry{
+		key:     key,
+		chunks:  chunks,
+		expires: expires,
+	})
+	if len(chunks) == 0 && !expires.IsZero() {
+		row := rowKey(key)
+		keys, ok := c.negatives[row]
+		if !ok {
+			keys = map[string]struct{}{}
+			c.negatives[row] = keys
+		}
+		keys[key] = struct{}{}
+	}
+	for c.lru.Len() > c.cfg.Size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate forgets the cached lookups of a row which found no chunks, as
+// it's been written to by this process; writes by other processes aren't
+// seen.
+func (c *indexCache) invalidate(tableName, hashValue string) {
+	row := rowKey(indexCacheKey(IndexEntry{TableName: tableName, HashValue: hashValue}, nil))
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for key := range c.negatives[row] {
+		c.remove(c.entries[key])
+	}
+}
+
+// remove removes elem from the cache.  c.mtx must be held.
+func (c *indexCache) remove(elem *list.Element) {
+	entry := elem.Value.(*indexCacheEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, entry.key)
+	row := rowKey(entry.key)
+	if keys, ok := c.negatives[row]; ok {
+		delete(keys, entry.key)
+		if len(keys) == 0 {
+			delete(c.negatives, row)
+		}
+	}
+}
+
+// bucketEnd works out the end of the bucket an index entry for userID is in,
+// from its hash key: <userid>:<hour> or <userid>:d<day>, followed by the
+// metric name.  If it can't, it returns model.Latest so the bucket is treated
+// as active.
+func bucketEnd(userID string, entry IndexEntry) model.Time {
+	if !strings.HasPrefix(entry.HashValue, userID+":") {
+		return model.Latest
+	}
+	bucket := entry.HashValue[len(userID)+1:]
+	if i := strings.IndexByte(bucket, ':'); i >= 0 {
+		bucket = bucket[:i]
+	}
+
+	size := millisecondsInHour
+	if strings.HasPrefix(bucket, "d") {
+		bucket = bucket[1:]
+		size = millisecondsInDay
+	}
+	n, err := strconv.ParseInt(bucket, 10, 64)
+	if err != nil {
+		return model.Latest
+	}
+	return model.Time((n + 1) * size)
+}
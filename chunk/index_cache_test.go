@@ -0,0 +1,178 @@
+package chunk
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+)
+
+func TestBucketEnd(t *testing.T) {
+	hour, day := model.Time(millisecondsInHour), model.Time(millisecondsInDay)
+	for _, tc := range []struct {
+		userID, hashValue string
+		expected          model.Time
+	}{
+		{"1", "1:5:foo", 6 * hour},
+		{"1", "1:d5:foo", 6 * day},
+		{"1", "1:d5:foo:bar", 6 * day},
+		{"a:b", "a:b:d5:foo", 6 * day},
+		{"1", "2:d5:foo", model.Latest},
+		{"1", "1:x:foo", model.Latest},
+	} {
+		assert.Equal(t, tc.expected, bucketEnd(tc.userID, IndexEntry{HashValue: tc.hashValue}), tc.hashValue)
+	}
+}
+
+func TestIndexCache(t *testing.T) {
+	cache := newIndexCache(IndexCacheConfig{
+		Size:           2,
+		ActiveTTL:      time.Minute,
+		ImmutableAfter: time.Hour,
+	})
+	now := time.Unix(1000000, 0)
+	old := model.TimeFromUnix(now.Add(-2 * time.Hour).Unix())
+	active := model.TimeFromUnix(now.Unix())
+	chunks := ByID{{ID: "a"}}
+
+	cache.put("old", chunks, old, now)
+	cache.put("active", chunks, active, now)
+
+	_, ok := cache.get("old", now.Add(time.Hour))
+	assert.True(t, ok, "immutable entries don't expire")
+	_, ok = cache.get("active", now.Add(30*time.Second))
+	assert.True(t, ok)
+	_, ok = cache.get("active", now.Add(2*time.Minute))
+	assert.False(t, ok, "active entries expire")
+
+	cache.put("a", chunks, old, now)
+	cache.put("b", chunks, old, now)
+	_, ok = cache.get("old", now)
+	assert.False(t, ok, "least recently used entry is evicted")
+}
+
+func TestIndexCacheNegativeEntries(t *testing.T) {
+	cache := newIndexCache(IndexCacheConfig{
+		Size:           10,
+		ActiveTTL:      time.Minute,
+		NegativeTTL:    10 * time.Second,
+		ImmutableAfter: time.Hour,
+	})
+	now := time.Unix(1000000, 0)
+	active := model.TimeFromUnix(now.Unix())
+	key := indexCacheKey(IndexEntry{TableName: "table", HashValue: "1:d5:foo", RangeValuePrefix: []byte("bar")}, nil)
+	otherKey := indexCacheKey(IndexEntry{TableName: "table", HashValue: "1:d5:baz"}, nil)
+
+	cache.put(key, nil, active, now)
+	_, ok := cache.get(key, now.Add(5*time.Second))
+	assert.True(t, ok)
+	_, ok = cache.get(key, now.Add(20*time.Second))
+	assert.False(t, ok, "negative entries expire sooner")
+
+	// Writing to a row forgets the lookups of it which found nothing.
+	cache.put(key, nil, active, now)
+	cache.put(otherKey, nil, active, now)
+	cache.invalidate("table", "1:d5:foo")
+	_, ok = cache.get(key, now)
+	assert.False(t, ok)
+	_, ok = cache.get(otherKey, now)
+	assert.True(t, ok)
+	assert.Len(t, cache.negatives, 1)
+}
+
+type countingIndexClient struct {
+	StorageClient
+	queries int32
+}
+
+func (c *countingIndexClient) QueryPages(ctx context.Context, entry IndexEntry, callback func(result ReadBatch, lastPage bool) (shouldContinue bool)) error {
+	atomic.AddInt32(&c.queries, 1)
+	return c.StorageClient.QueryPages(ctx, entry, callback)
+}
+
+func TestChunkStoreIndexCache(t *testing.T) {
+	ctx := user.Inject(context.Background(), "0")
+	dynamoDB := NewMockStorage()
+	setupDynamodb(t, dynamoDB)
+	index := &countingIndexClient{StorageClient: dynamoDB}
+	store, err := NewStore(StoreConfig{
+		IndexCacheConfig: IndexCacheConfig{
+			Size:           100,
+			ImmutableAfter: time.Hour,
+		},
+		mockDynamoDB:  index,
+		mockS3:        NewMockS3(),
+		schemaFactory: v5Schema,
+	})
+	require.NoError(t, err)
+
+	// A chunk from a few days ago, in a bucket which won't receive any more
+	// writes.
+	through := model.Now().Add(-72 * time.Hour)
+	chunks, _ := chunk.New().Add(model.SamplePair{Timestamp: through, Value: 0})
+	c := NewChunk(model.Fingerprint(1), model.Metric{model.MetricNameLabel: "foo", "bar": "baz"}, chunks[0], through.Add(-time.Hour), through)
+	require.NoError(t, store.Put(ctx, []Chunk{c}))
+
+	matchers := []*metric.LabelMatcher{
+		mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"),
+		mustNewLabelMatcher(metric.Equal, "bar", "baz"),
+	}
+	var queries int32
+	for i := 0; i < 3; i++ {
+		found, err := store.Get(ctx, through.Add(-time.Hour), through, matchers...)
+		require.NoError(t, err)
+		require.Len(t, found, 1)
+		if i == 0 {
+			queries = atomic.LoadInt32(&index.queries)
+		}
+	}
+	assert.NotZero(t, queries)
+	assert.Equal(t, queries, atomic.LoadInt32(&index.queries), "repeated queries should be served from the cache")
+}
+
+func TestChunkStoreIndexCacheNegativeEntries(t *testing.T) {
+	ctx := user.Inject(context.Background(), "0")
+	dynamoDB := NewMockStorage()
+	setupDynamodb(t, dynamoDB)
+	index := &countingIndexClient{StorageClient: dynamoDB}
+	store, err := NewStore(StoreConfig{
+		IndexCacheConfig: IndexCacheConfig{
+			Size:           100,
+			NegativeTTL:    time.Hour,
+			ImmutableAfter: time.Hour,
+		},
+		mockDynamoDB:  index,
+		mockS3:        NewMockS3(),
+		schemaFactory: v5Schema,
+	})
+	require.NoError(t, err)
+
+	through := model.Now()
+	matchers := []*metric.LabelMatcher{
+		mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"),
+		mustNewLabelMatcher(metric.Equal, "bar", "baz"),
+	}
+	found, err := store.Get(ctx, through.Add(-time.Hour), through, matchers...)
+	require.NoError(t, err)
+	require.Empty(t, found)
+	queries := atomic.LoadInt32(&index.queries)
+	_, err = store.Get(ctx, through.Add(-time.Hour), through, matchers...)
+	require.NoError(t, err)
+	assert.Equal(t, queries, atomic.LoadInt32(&index.queries), "lookups finding nothing should be cached")
+
+	// Writing a chunk to the bucket invalidates them.
+	chunks, _ := chunk.New().Add(model.SamplePair{Timestamp: through, Value: 0})
+	c := NewChunk(model.Fingerprint(1), model.Metric{model.MetricNameLabel: "foo", "bar": "baz"}, chunks[0], through.Add(-time.Hour), through)
+	require.NoError(t, store.Put(ctx, []Chunk{c}))
+	found, err = store.Get(ctx, through.Add(-time.Hour), through, matchers...)
+	require.NoError(t, err)
+	assert.Len(t, found, 1)
+}
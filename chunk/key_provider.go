@@ -0,0 +1,153 @@
+package chunk
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/instrument"
+)
+
+const dataKeySize = 32 // AES-256
+
+var kmsRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "cortex",
+	Name:      "kms_request_duration_seconds",
+	Help:      "Time spent doing KMS requests.",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"operation", "status_code"})
+
+func init() {
+	prometheus.MustRegister(kmsRequestDuration)
+}
+
+// KMSClient is a client for AWS KMS.
+type KMSClient interface {
+	GenerateDataKey(*kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error)
+	Decrypt(*kms.DecryptInput) (*kms.DecryptOutput, error)
+}
+
+// NewKMSClient makes a new KMS client, from a URL like the S3 and DynamoDB ones.
+func NewKMSClient(kmsURL string) (KMSClient, error) {
+	url, err := url.Parse(kmsURL)
+	if err != nil {
+		return nil, err
+	}
+	kmsConfig, err := awsConfigFromURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return kms.New(session.New(kmsConfig)), nil
+}
+
+// kmsKeyProvider keeps tenants' master keys in KMS.  The tenant is bound to
+// its data keys as encryption context.
+type kmsKeyProvider struct {
+	kms    KMSClient
+	keyIDs map[string]string
+}
+
+func kmsEncryptionContext(userID string) map[string]*string {
+	return map[string]*string{"cortex_tenant": aws.String(userID)}
+}
+
+func (p kmsKeyProvider) GenerateDataKey(ctx context.Context, userID string) ([]byte, []byte, error) {
+	keyID, ok := p.keyIDs[userID]
+	if !ok {
+		return nil, nil, fmt.Errorf("no master key for tenant %q", userID)
+	}
+	var resp *kms.GenerateDataKeyOutput
+	err := instrument.TimeRequestHistogram(ctx, "KMS.GenerateDataKey", kmsRequestDuration, func(_ context.Context) error {
+		var err error
+		resp, err = p.kms.GenerateDataKey(&kms.GenerateDataKeyInput{
+			KeyId:             aws.String(keyID),
+			KeySpec:           aws.String(kms.DataKeySpecAes256),
+			EncryptionContext: kmsEncryptionContext(userID),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Plaintext, resp.CiphertextBlob, nil
+}
+
+func (p kmsKeyProvider) DecryptDataKey(ctx context.Context, userID string, encryptedKey []byte) ([]byte, error) {
+	var resp *kms.DecryptOutput
+	err := instrument.TimeRequestHistogram(ctx, "KMS.Decrypt", kmsRequestDuration, func(_ context.Context) error {
+		var err error
+		resp, err = p.kms.Decrypt(&kms.DecryptInput{
+			CiphertextBlob:    encryptedKey,
+			EncryptionContext: kmsEncryptionContext(userID),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
+
+// staticKeyProvider wraps data keys locally with master keys from the keys
+// file, for deployments without a KMS.
+type staticKeyProvider struct {
+	masterKeys map[string][]byte
+}
+
+func newStaticKeyProvider(encodedKeys map[string]string) (staticKeyProvider, error) {
+	p := staticKeyProvider{masterKeys: map[string][]byte{}}
+	for userID, encoded := range encodedKeys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return p, fmt.Errorf("invalid master key for tenant %q: %v", userID, err)
+		}
+		if len(key) != dataKeySize {
+			return p, fmt.Errorf("invalid master key for tenant %q: must be %d bytes, not %d", userID, dataKeySize, len(key))
+		}
+		p.masterKeys[userID] = key
+	}
+	return p, nil
+}
+
+func (p staticKeyProvider) GenerateDataKey(_ context.Context, userID string) ([]byte, []byte, error) {
+	aead, err := p.aead(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	key := make([]byte, dataKeySize)
+	nonce := make([]byte, aead.NonceSize())
+	for _, buf := range [][]byte{key, nonce} {
+		if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+			return nil, nil, err
+		}
+	}
+	return key, aead.Seal(nonce, nonce, key, []byte(userID)), nil
+}
+
+func (p staticKeyProvider) DecryptDataKey(_ context.Context, userID string, encryptedKey []byte) ([]byte, error) {
+	aead, err := p.aead(userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(encryptedKey) < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid encrypted data key")
+	}
+	return aead.Open(nil, encryptedKey[:aead.NonceSize()], encryptedKey[aead.NonceSize():], []byte(userID))
+}
+
+func (p staticKeyProvider) aead(userID string) (cipher.AEAD, error) {
+	key, ok := p.masterKeys[userID]
+	if !ok {
+		return nil, fmt.Errorf("no master key for tenant %q", userID)
+	}
+	return newAEAD(key)
+}
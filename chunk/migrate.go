@@ -0,0 +1,438 @@
+package chunk
+
+import (
+	"container/list"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// migrationSchemas are the schemas the index can be migrated to.
+var migrationSchemas = map[string]func(SchemaConfig) Schema{
+	"v4": v4Schema,
+	"v5": v5Schema,
+	"v6": v6Schema,
+}
+
+// MigrateConfig configures a Migrator.
+type MigrateConfig struct {
+	From, Through  util.DayValue
+	ToSchema       string
+	Workers        int
+	CheckpointFile string
+	Verify         bool
+	SeenChunks     int
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *MigrateConfig) RegisterFlags(f *flag.FlagSet) {
+	f.Var(&cfg.From, "migrate.from", "The first day (in the format YYYY-MM-DD) of the chunks to re-index.")
+	f.Var(&cfg.Through, "migrate.through", "The last day (in the format YYYY-MM-DD) of the chunks to re-index.")
+	f.StringVar(&cfg.ToSchema, "migrate.to-schema", "v6", "The schema to write the chunks' index entries in: v4, v5 or v6.")
+	f.IntVar(&cfg.Workers, "migrate.workers", 16, "The number of segments each table is scanned in, in parallel.")
+	f.StringVar(&cfg.CheckpointFile, "migrate.checkpoint-file", "", "File to record progress in, to resume from if interrupted (empty to not record it).")
+	f.BoolVar(&cfg.Verify, "migrate.verify", false, "Check the chunks' entries are in the new schema, rather than writing them.")
+	f.IntVar(&cfg.SeenChunks, "migrate.seen-chunks", 100000, "The number of chunks most recently migrated to remember, so they aren't migrated again when more of their entries are scanned.")
+}
+
+// MigrationStats counts what a Migrator has done.
+type MigrationStats struct {
+	EntriesScanned int64
+	EntriesSkipped int64
+	Chunks         int64
+	EntriesWritten int64
+	EntriesMissing int64
+}
+
+// Migrator re-indexes the chunks of a period in another schema, so once
+// it's done, the schema can be used to read the period, e.g. by moving
+// -dynamodb.v6-schema-from back to its start.  It scans the index's tables
+// for the period, and writes the entries the new schema gives for each chunk
+// it finds; as writing an entry twice is harmless, an interrupted migration
+// can be resumed from its checkpoint, rescanning at most a page per segment,
+// and only the chunks seen most recently need be remembered.
+type Migrator struct {
+	cfg     MigrateConfig
+	store   *Store
+	scanner IndexScanner
+	schema  Schema
+	from    model.Time
+	through model.Time
+
+	stats MigrationStats
+
+	// The chunks seen most recently, by user and ID, which aren't migrated
+	// again.
+	seenMtx sync.Mutex
+	seen    *seenChunks
+
+	checkpointMtx sync.Mutex
+	checkpoint    migrationCheckpoint
+}
+
+type migrationCheckpoint struct {
+	From, Through model.Time
+	ToSchema      string
+	Segments      int
+	Progress      map[string]*segmentProgress
+}
+
+type segmentProgress struct {
+	After *ScanCursor `json:",omitempty"`
+	Done  bool
+}
+
+// NewMigrator makes a new Migrator, for the index and chunks in store.
+func NewMigrator(cfg MigrateConfig, store *Store) (*Migrator, error) {
+	if !cfg.From.IsSet() || !cfg.Through.IsSet() || cfg.Through.Before(cfg.From.Time) {
+		return nil, fmt.Errorf("invalid migration period %v to %v", cfg.From, cfg.Through)
+	}
+	newSchema, ok := migrationSchemas[cfg.ToSchema]
+	if !ok {
+		return nil, fmt.Errorf("unknown schema %q", cfg.ToSchema)
+	}
+	if cfg.Workers <= 0 {
+		return nil, fmt.Errorf("invalid number of workers %d", cfg.Workers)
+	}
+	if cfg.SeenChunks <= 0 {
+		return nil, fmt.Errorf("invalid number of seen chunks %d", cfg.SeenChunks)
+	}
+	scanner, ok := store.unwrappedIndex().(IndexScanner)
+	if !ok {
+		return nil, fmt.Errorf("index store doesn't support scanning tables")
+	}
+
+	m := &Migrator{
+		cfg:     cfg,
+		store:   store,
+		scanner: scanner,
+		schema:  newSchema(store.cfg.SchemaConfig),
+		from:    cfg.From.Time,
+		through: cfg.Through.Add(24*time.Hour - time.Millisecond),
+		seen:    newSeenChunks(cfg.SeenChunks),
+		checkpoint: migrationCheckpoint{
+			From:     cfg.From.Time,
+			Through:  cfg.Through.Time,
+			ToSchema: cfg.ToSchema,
+			Segments: cfg.Workers,
+			Progress: map[string]*segmentProgress{},
+		},
+	}
+	if err := m.loadCheckpoint(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Stats returns what the Migrator has done so far.
+func (m *Migrator) Stats() MigrationStats {
+	return MigrationStats{
+		EntriesScanned: atomic.LoadInt64(&m.stats.EntriesScanned),
+		EntriesSkipped: atomic.LoadInt64(&m.stats.EntriesSkipped),
+		Chunks:         atomic.LoadInt64(&m.stats.Chunks),
+		EntriesWritten: atomic.LoadInt64(&m.stats.EntriesWritten),
+		EntriesMissing: atomic.LoadInt64(&m.stats.EntriesMissing),
+	}
+}
+
+// Run migrates the period, scanning Workers segments of its tables at
+// once, returning the first error.
+func (m *Migrator) Run(ctx context.Context) error {
+	type segment struct {
+		table string
+		index int
+	}
+	var segments []segment
+	for _, table := range m.tables() {
+		for i := 0; i < m.cfg.Workers; i++ {
+			if !m.progress(table, i).Done {
+				segments = append(segments, segment{table, i})
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	work := make(chan segment)
+	go func() {
+		defer close(work)
+		for _, s := range segments {
+			select {
+			case work <- s:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	errs := make(chan error, m.cfg.Workers)
+	for i := 0; i < m.cfg.Workers; i++ {
+		go func() {
+			for s := range work {
+				if err := m.migrateSegment(ctx, s.table, s.index); err != nil {
+					errs <- fmt.Errorf("table %s segment %d: %v", s.table, s.index, err)
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	var firstErr error
+	for i := 0; i < m.cfg.Workers; i++ {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	return firstErr
+}
+
+// tables returns the tables holding the index for the period, its own and
+// isolated tenants'.
+func (m *Migrator) tables() []string {
+	cfg := m.store.cfg.SchemaConfig
+	users := []string{""}
+	for userID := range cfg.tenantTablePrefixes {
+		users = append(users, userID)
+	}
+	tables := map[string]struct{}{}
+	for day := m.from.Unix(); day <= m.through.Unix(); day += secondsInDay {
+		for _, userID := range users {
+			tables[cfg.tableForBucket(userID, day)] = struct{}{}
+		}
+	}
+	result := make([]string, 0, len(tables))
+	for table := range tables {
+		result = append(result, table)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (m *Migrator) migrateSegment(ctx context.Context, table string, segment int) error {
+	progress := m.progress(table, segment)
+	var pageErr error
+	err := m.scanner.ScanPages(ctx, table, segment, m.cfg.Workers, progress.After, func(entries []IndexEntry, next *ScanCursor) bool {
+		if pageErr = m.migrateEntries(ctx, entries); pageErr != nil {
+			return false
+		}
+		pageErr = m.saveProgress(table, segment, segmentProgress{After: next, Done: next == nil})
+		return pageErr == nil
+	})
+	if err != nil {
+		return err
+	} else if pageErr != nil {
+		return pageErr
+	}
+	if m.progress(table, segment).Done {
+		return nil
+	}
+	return m.saveProgress(table, segment, segmentProgress{Done: true})
+}
+
+// migrateEntries migrates the chunks of the period the entries are for,
+// which haven't been already.
+func (m *Migrator) migrateEntries(ctx context.Context, entries []IndexEntry) error {
+	atomic.AddInt64(&m.stats.EntriesScanned, int64(len(entries)))
+	chunks := map[string][]Chunk{}
+	m.seenMtx.Lock()
+	for _, entry := range entries {
+		i := strings.IndexByte(entry.HashValue, ':')
+		if i < 0 {
+			atomic.AddInt64(&m.stats.EntriesSkipped, 1)
+			continue
+		}
+		userID := entry.HashValue[:i]
+		_, chunkID, err := parseRangeValue(entry.RangeValue)
+		if err != nil {
+			atomic.AddInt64(&m.stats.EntriesSkipped, 1)
+			continue
+		}
+		_, from, through, err := parseChunkID(chunkID)
+		if err != nil {
+			atomic.AddInt64(&m.stats.EntriesSkipped, 1)
+			continue
+		}
+		if through < m.from || m.through < from {
+			continue
+		}
+		if !m.seen.add(userID + "/" + chunkID) {
+			continue
+		}
+		chunks[userID] = append(chunks[userID], Chunk{ID: chunkID, From: from, Through: through})
+	}
+	m.seenMtx.Unlock()
+
+	for userID, userChunks := range chunks {
+		fetched, err := m.store.fetchChunkData(ctx, userID, userChunks)
+		if err != nil {
+			return err
+		}
+		if err := m.migrateChunks(ctx, userID, fetched); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seenChunks is a set of the chunks most recently added to it, up to size,
+// so chunks whose entries are scanned again after being evicted are migrated
+// again, which is harmless.
+type seenChunks struct {
+	size int
+	lru  *list.List
+	keys map[string]*list.Element
+}
+
+func newSeenChunks(size int) *seenChunks {
+	return &seenChunks{
+		size: size,
+		lru:  list.New(),
+		keys: map[string]*list.Element{},
+	}
+}
+
+// add adds key to the set, returning false if it was already there.
+func (s *seenChunks) add(key string) bool {
+	if elem, ok := s.keys[key]; ok {
+		s.lru.MoveToFront(elem)
+		return false
+	}
+	s.keys[key] = s.lru.PushFront(key)
+	for s.lru.Len() > s.size {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.keys, oldest.Value.(string))
+	}
+	return true
+}
+
+func (m *Migrator) migrateChunks(ctx context.Context, userID string, chunks []Chunk) error {
+	batch := m.store.index.NewWriteBatch()
+	for _, chunk := range chunks {
+		metricName, err := util.ExtractMetricNameFromMetric(chunk.Metric)
+		if err != nil {
+			return err
+		}
+		entries, err := m.schema.GetWriteEntries(chunk.From, chunk.Through, userID, metricName, chunk.Metric, chunk.ID)
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&m.stats.Chunks, 1)
+		if !m.cfg.Verify {
+			for _, entry := range entries {
+				batch.Add(entry.TableName, entry.HashValue, entry.RangeValue)
+			}
+			continue
+		}
+		for _, entry := range entries {
+			found, err := m.entryExists(ctx, entry)
+			if err != nil {
+				return err
+			}
+			if !found {
+				log.Warnf("Chunk %s/%s is missing entry %s/%x", userID, chunk.ID, entry.HashValue, entry.RangeValue)
+				atomic.AddInt64(&m.stats.EntriesMissing, 1)
+			}
+		}
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	// Behind flushes, so migrating doesn't hold up ingestion.
+	if err := m.store.index.BatchWrite(WithWriteClass(ctx, RewriteWrite), batch); err != nil {
+		return err
+	}
+	atomic.AddInt64(&m.stats.EntriesWritten, int64(batch.Len()))
+	return nil
+}
+
+func (m *Migrator) entryExists(ctx context.Context, entry IndexEntry) (bool, error) {
+	found := false
+	err := m.store.index.QueryPages(ctx, IndexEntry{
+		TableName:        entry.TableName,
+		HashValue:        entry.HashValue,
+		RangeValuePrefix: entry.RangeValue,
+	}, func(resp ReadBatch, lastPage bool) bool {
+		for i := 0; i < resp.Len(); i++ {
+			if string(resp.RangeValue(i)) == string(entry.RangeValue) {
+				found = true
+			}
+		}
+		return !found && !lastPage
+	})
+	return found, err
+}
+
+func (m *Migrator) progress(table string, segment int) segmentProgress {
+	m.checkpointMtx.Lock()
+	defer m.checkpointMtx.Unlock()
+	if progress, ok := m.checkpoint.Progress[progressKey(table, segment)]; ok {
+		return *progress
+	}
+	return segmentProgress{}
+}
+
+func progressKey(table string, segment int) string {
+	return fmt.Sprintf("%s/%d", table, segment)
+}
+
+// loadCheckpoint resumes from CheckpointFile, if it exists, and was
+// written by a migration of the same period, to the same schema, in as many
+// segments.  Verifying neither resumes nor records progress, so it always
+// checks the whole period.
+func (m *Migrator) loadCheckpoint() error {
+	if m.cfg.CheckpointFile == "" || m.cfg.Verify {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(m.cfg.CheckpointFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var checkpoint migrationCheckpoint
+	if err := json.Unmarshal(buf, &checkpoint); err != nil {
+		return fmt.Errorf("error reading checkpoint %s: %v", m.cfg.CheckpointFile, err)
+	}
+	if checkpoint.From != m.checkpoint.From || checkpoint.Through != m.checkpoint.Through ||
+		checkpoint.ToSchema != m.checkpoint.ToSchema || checkpoint.Segments != m.checkpoint.Segments {
+		return fmt.Errorf("checkpoint %s is for a different migration", m.cfg.CheckpointFile)
+	}
+	if checkpoint.Progress != nil {
+		m.checkpoint.Progress = checkpoint.Progress
+	}
+	return nil
+}
+
+// saveProgress records a segment's progress, in CheckpointFile if set.
+func (m *Migrator) saveProgress(table string, segment int, progress segmentProgress) error {
+	m.checkpointMtx.Lock()
+	defer m.checkpointMtx.Unlock()
+	m.checkpoint.Progress[progressKey(table, segment)] = &progress
+	if m.cfg.CheckpointFile == "" || m.cfg.Verify {
+		return nil
+	}
+	buf, err := json.Marshal(m.checkpoint)
+	if err != nil {
+		return err
+	}
+	tmp := m.cfg.CheckpointFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.cfg.CheckpointFile)
+}
@@ -0,0 +1,158 @@
+package chunk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestMigrator(t *testing.T) {
+	ctx := user.Inject(context.Background(), "0")
+	now := model.Now()
+	newChunk := func(fp model.Fingerprint, bar model.LabelValue, from, through model.Time) Chunk {
+		data, err := chunk.New().Add(model.SamplePair{Timestamp: from, Value: 0})
+		require.NoError(t, err)
+		return NewChunk(fp, model.Metric{model.MetricNameLabel: "foo", "bar": bar}, data[0], from, through)
+	}
+	chunk1 := newChunk(1, "baz", now.Add(-time.Hour), now)
+	chunk2 := newChunk(2, "beep", now.Add(-time.Hour), now)
+	// Outside the period being migrated.
+	chunk3 := newChunk(3, "boop", now.Add(-72*time.Hour), now.Add(-71*time.Hour))
+
+	dynamoDB := NewMockStorage()
+	setupDynamodb(t, dynamoDB)
+	s3 := NewMockS3()
+	newStore := func(schema func(SchemaConfig) Schema) *Store {
+		store, err := NewStore(StoreConfig{
+			mockDynamoDB:  dynamoDB,
+			mockS3:        s3,
+			schemaFactory: schema,
+		})
+		require.NoError(t, err)
+		return store
+	}
+	oldStore := newStore(v3Schema)
+	require.NoError(t, oldStore.Put(ctx, []Chunk{chunk1, chunk2, chunk3}))
+
+	dir, err := ioutil.TempDir("", "migrate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cfg := MigrateConfig{
+		From:           util.NewDayValue(now),
+		Through:        util.NewDayValue(now),
+		ToSchema:       "v6",
+		Workers:        2,
+		CheckpointFile: filepath.Join(dir, "checkpoint.json"),
+		SeenChunks:     100,
+	}
+	run := func(cfg MigrateConfig) MigrationStats {
+		m, err := NewMigrator(cfg, oldStore)
+		require.NoError(t, err)
+		require.NoError(t, m.Run(ctx))
+		return m.Stats()
+	}
+	verify := cfg
+	verify.Verify = true
+
+	// Verifying before migrating finds the new schema's entries missing.
+	stats := run(verify)
+	assert.Equal(t, int64(2), stats.Chunks)
+	assert.NotZero(t, stats.EntriesMissing)
+	assert.Zero(t, stats.EntriesWritten)
+
+	stats = run(cfg)
+	assert.Equal(t, int64(2), stats.Chunks)
+	assert.NotZero(t, stats.EntriesWritten)
+	assert.Zero(t, stats.EntriesSkipped)
+
+	// Afterwards, the chunks can be read with the new schema.
+	chunks, err := newStore(v6Schema).Get(ctx, now.Add(-time.Hour), now, mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"), mustNewLabelMatcher(metric.Equal, "bar", "baz"))
+	require.NoError(t, err)
+	require.Len(t, chunks, 1)
+	assert.Equal(t, chunk1.ID, chunks[0].ID)
+	stats = run(verify)
+	assert.Equal(t, int64(2), stats.Chunks)
+	assert.Zero(t, stats.EntriesMissing)
+
+	// Running again resumes from the checkpoint, so there's nothing left to
+	// do (and MockStorage rejects duplicate writes).
+	stats = run(cfg)
+	assert.Zero(t, stats.EntriesScanned)
+
+	// The checkpoint can't be resumed by a different migration.
+	other := cfg
+	other.ToSchema = "v5"
+	_, err = NewMigrator(other, oldStore)
+	assert.Error(t, err)
+}
+
+func TestMigratorWritesQueueBehindFlushes(t *testing.T) {
+	ctx := user.Inject(context.Background(), "0")
+	now := model.Now()
+	data, err := chunk.New().Add(model.SamplePair{Timestamp: now, Value: 0})
+	require.NoError(t, err)
+	c := NewChunk(1, model.Metric{model.MetricNameLabel: "foo"}, data[0], now, now)
+
+	dynamoDB := NewMockStorage()
+	setupDynamodb(t, dynamoDB)
+	store, err := NewStore(StoreConfig{mockDynamoDB: dynamoDB, mockS3: NewMockS3()})
+	require.NoError(t, err)
+	m, err := NewMigrator(MigrateConfig{From: util.NewDayValue(now), Through: util.NewDayValue(now), ToSchema: "v6", Workers: 1, SeenChunks: 100}, store)
+	require.NoError(t, err)
+
+	storage := &blockingStorage{StorageClient: dynamoDB, unblock: make(chan struct{})}
+	q := newWriteQueue(WriteQueueConfig{Concurrency: 1}, storage)
+	store.index = q
+	waitFor := func(f func() bool) {
+		for {
+			q.mtx.Lock()
+			done := f()
+			q.mtx.Unlock()
+			if done {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// With a flush occupying the only slot, the migration's writes queue
+	// behind a later flush.
+	errs := make(chan error, 3)
+	go func() { errs <- q.BatchWrite(ctx, q.NewWriteBatch()) }()
+	waitFor(func() bool { return q.free == 0 })
+	go func() { errs <- m.migrateChunks(ctx, "0", []Chunk{c}) }()
+	waitFor(func() bool { return q.waiting[RewriteWrite] == 1 })
+	go func() { errs <- q.BatchWrite(ctx, q.NewWriteBatch()) }()
+	waitFor(func() bool { return q.waiting[FlushWrite] == 1 })
+
+	for i := 0; i < 3; i++ {
+		storage.unblock <- struct{}{}
+		require.NoError(t, <-errs)
+	}
+	assert.Equal(t, []WriteClass{FlushWrite, FlushWrite, RewriteWrite}, storage.order)
+}
+
+func TestSeenChunks(t *testing.T) {
+	seen := newSeenChunks(2)
+	require.True(t, seen.add("a"))
+	require.True(t, seen.add("b"))
+	require.False(t, seen.add("a"))
+
+	// b, the least recently seen, is evicted.
+	require.True(t, seen.add("c"))
+	require.Equal(t, 2, len(seen.keys))
+	require.False(t, seen.add("a"))
+	require.True(t, seen.add("b"))
+}
@@ -0,0 +1,164 @@
+package chunk
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+var mirrorWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "chunk_store_mirror_writes_total",
+	Help:      "Total number of chunks flushed to the primary store mirrored to the secondary one, by result.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(mirrorWrites)
+}
+
+// Results of mirroring chunks, for mirrorWrites.
+const (
+	mirrorSuccess = "success"
+	mirrorFailure = "failure"
+	mirrorDropped = "dropped"
+)
+
+// MirrorConfig configures a secondary store every chunk flushed to the
+// primary one is also written to, e.g. to keep it up to date while old
+// chunks are backfilled into it during a migration.  The secondary store is
+// the primary one's config, with whichever URLs are set here replaced.
+type MirrorConfig struct {
+	S3          util.URLValue
+	DynamoDB    util.URLValue
+	Concurrency int
+	QueueLength int
+	Timeout     time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *MirrorConfig) RegisterFlags(f *flag.FlagSet) {
+	f.Var(&cfg.S3, "store.mirror.s3.url", "S3 endpoint URL of a secondary store to mirror flushed chunks to.")
+	f.Var(&cfg.DynamoDB, "store.mirror.dynamodb.url", "DynamoDB endpoint URL of a secondary store to mirror flushed chunks' index to.")
+	f.IntVar(&cfg.Concurrency, "store.mirror.concurrency", 4, "Number of writes to the secondary store to make at once.")
+	f.IntVar(&cfg.QueueLength, "store.mirror.queue-length", 1000, "Maximum number of flushes waiting to be mirrored to the secondary store; more are dropped.")
+	f.DurationVar(&cfg.Timeout, "store.mirror.timeout", time.Minute, "Timeout for each write to the secondary store.")
+}
+
+// Enabled reports whether a secondary store is configured.
+func (cfg MirrorConfig) Enabled() bool {
+	return cfg.S3.URL != nil || cfg.DynamoDB.URL != nil
+}
+
+// chunkPutter is the part of a store we mirror to.
+type chunkPutter interface {
+	Put(ctx context.Context, chunks []Chunk) error
+}
+
+// MirrorStore is a Store which also writes every chunk put to it to a
+// secondary store, in the background: writes to the secondary store never
+// hold up or fail those to the primary one, and are dropped if it can't keep
+// up.
+type MirrorStore struct {
+	*Store
+	cfg       MirrorConfig
+	secondary chunkPutter
+
+	queue chan mirrorWrite
+	wg    sync.WaitGroup
+}
+
+type mirrorWrite struct {
+	userID string
+	chunks []Chunk
+}
+
+// NewMirrorStore makes a MirrorStore, writing to primary and to a secondary
+// store configured by cfg.Mirror.
+func NewMirrorStore(cfg StoreConfig, primary *Store) (*MirrorStore, error) {
+	secondaryCfg := cfg
+	if cfg.Mirror.S3.URL != nil {
+		secondaryCfg.S3 = cfg.Mirror.S3
+	}
+	if cfg.Mirror.DynamoDB.URL != nil {
+		secondaryCfg.DynamoDB = cfg.Mirror.DynamoDB
+	}
+	secondaryCfg.ActivityRetention = 0
+	secondary, err := NewStore(secondaryCfg)
+	if err != nil {
+		return nil, err
+	}
+	return newMirrorStore(cfg.Mirror, primary, secondary), nil
+}
+
+func newMirrorStore(cfg MirrorConfig, primary *Store, secondary chunkPutter) *MirrorStore {
+	s := &MirrorStore{
+		Store:     primary,
+		cfg:       cfg,
+		secondary: secondary,
+		queue:     make(chan mirrorWrite, cfg.QueueLength),
+	}
+	for i := 0; i < cfg.Concurrency; i++ {
+		s.wg.Add(1)
+		go s.loop()
+	}
+	return s
+}
+
+// Stop waits for the writes queued for the secondary store.
+func (s *MirrorStore) Stop() {
+	close(s.queue)
+	s.wg.Wait()
+}
+
+// Put implements ingester.ChunkStore.
+func (s *MirrorStore) Put(ctx context.Context, chunks []Chunk) error {
+	if err := s.Store.Put(ctx, chunks); err != nil {
+		return err
+	}
+	s.mirror(ctx, chunks)
+	return nil
+}
+
+// PutIndex implements ingester.PartialChunkStore; chunks are mirrored once
+// they're indexed in the primary store.
+func (s *MirrorStore) PutIndex(ctx context.Context, chunks []Chunk) error {
+	if err := s.Store.PutIndex(ctx, chunks); err != nil {
+		return err
+	}
+	s.mirror(ctx, chunks)
+	return nil
+}
+
+func (s *MirrorStore) mirror(ctx context.Context, chunks []Chunk) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return
+	}
+	select {
+	case s.queue <- mirrorWrite{userID: userID, chunks: chunks}:
+	default:
+		mirrorWrites.WithLabelValues(mirrorDropped).Add(float64(len(chunks)))
+	}
+}
+
+func (s *MirrorStore) loop() {
+	defer s.wg.Done()
+	for write := range s.queue {
+		ctx, cancel := context.WithTimeout(user.Inject(context.Background(), write.userID), s.cfg.Timeout)
+		err := s.secondary.Put(ctx, write.chunks)
+		cancel()
+		if err != nil {
+			log.Warnf("Error mirroring %d chunks for %s to the secondary store: %v", len(write.chunks), write.userID, err)
+			mirrorWrites.WithLabelValues(mirrorFailure).Add(float64(len(write.chunks)))
+			continue
+		}
+		mirrorWrites.WithLabelValues(mirrorSuccess).Add(float64(len(write.chunks)))
+	}
+}
@@ -0,0 +1,96 @@
+package chunk
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+)
+
+// recordingPutter records the chunks put to it, per user, or fails.
+type recordingPutter struct {
+	mtx    sync.Mutex
+	chunks map[string][]Chunk
+	fail   bool
+}
+
+func (p *recordingPutter) Put(ctx context.Context, chunks []Chunk) error {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return err
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.fail {
+		return fmt.Errorf("secondary store unavailable")
+	}
+	p.chunks[userID] = append(p.chunks[userID], chunks...)
+	return nil
+}
+
+func mirrorWritesValue(t *testing.T, result string) float64 {
+	var m dto.Metric
+	require.NoError(t, mirrorWrites.WithLabelValues(result).Write(&m))
+	return m.GetCounter().GetValue()
+}
+
+func TestMirrorStore(t *testing.T) {
+	dynamoDB := NewMockStorage()
+	setupDynamodb(t, dynamoDB)
+	primary, err := NewStore(StoreConfig{
+		mockDynamoDB:  dynamoDB,
+		mockS3:        NewMockS3(),
+		schemaFactory: v6Schema,
+	})
+	require.NoError(t, err)
+
+	now := model.Now()
+	data, _ := chunk.New().Add(model.SamplePair{Timestamp: now, Value: 0})
+	fp := model.Fingerprint(0)
+	newChunks := func() []Chunk {
+		fp++
+		return []Chunk{NewChunk(fp, model.Metric{model.MetricNameLabel: "foo"}, data[0], now.Add(-time.Hour), now)}
+	}
+	ctx := user.Inject(context.Background(), "1")
+
+	// Chunks are written to both stores, once indexed in the primary.
+	secondary := &recordingPutter{chunks: map[string][]Chunk{}}
+	cfg := MirrorConfig{Concurrency: 1, QueueLength: 10, Timeout: time.Second}
+	store := newMirrorStore(cfg, primary, secondary)
+	put := newChunks()
+	require.NoError(t, store.Put(ctx, put))
+	partial := newChunks()
+	require.NoError(t, store.PutChunks(ctx, partial))
+	require.NoError(t, store.PutIndex(ctx, partial))
+	store.Stop()
+	assert.Equal(t, append(put, partial...), secondary.chunks["1"])
+
+	// Failures writing to the secondary store don't fail the write.
+	secondary.fail = true
+	store = newMirrorStore(cfg, primary, secondary)
+	failures := mirrorWritesValue(t, mirrorFailure)
+	require.NoError(t, store.Put(ctx, newChunks()))
+	store.Stop()
+	assert.Equal(t, failures+1, mirrorWritesValue(t, mirrorFailure))
+
+	fetched, err := primary.Fetch(ctx, put)
+	require.NoError(t, err)
+	assert.Len(t, fetched, 1)
+
+	// If the secondary store can't keep up, its writes are dropped.
+	store = newMirrorStore(MirrorConfig{QueueLength: 1, Timeout: time.Second}, primary, secondary)
+	dropped := mirrorWritesValue(t, mirrorDropped)
+	require.NoError(t, store.Put(ctx, newChunks()))
+	require.NoError(t, store.Put(ctx, newChunks()))
+	assert.Equal(t, dropped+1, mirrorWritesValue(t, mirrorDropped))
+	store.Stop()
+}
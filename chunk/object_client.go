@@ -0,0 +1,148 @@
+package chunk
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/instrument"
+)
+
+// ObjectClient is a client for the store holding chunk data.
+type ObjectClient interface {
+	PutChunk(ctx context.Context, userID string, chunk *Chunk) error
+
+	// GetChunk fetches the data for chunk, and decodes it into chunk.
+	GetChunk(ctx context.Context, userID string, chunk *Chunk) error
+}
+
+// blobClient stores encoded chunks as opaque blobs.  The chunk is only
+// passed for its ID and time range.
+type blobClient interface {
+	putBlob(ctx context.Context, userID string, chunk *Chunk, buf []byte) error
+	getBlob(ctx context.Context, userID string, chunk *Chunk) ([]byte, error)
+}
+
+// batchObjectClient is an ObjectClient which can fetch many chunks at once,
+// cheaper than calling GetChunk for each.
+type batchObjectClient interface {
+	ObjectClient
+
+	// GetChunks fetches the data for chunks, and decodes it into them.
+	GetChunks(ctx context.Context, userID string, chunks []Chunk) error
+}
+
+// batchBlobClient is a blobClient which can fetch many blobs at once.
+type batchBlobClient interface {
+	blobClient
+
+	// getBlobs returns the blobs of chunks, in the same order.
+	getBlobs(ctx context.Context, userID string, chunks []Chunk) ([][]byte, error)
+}
+
+// newBlobObjectClient makes an ObjectClient of blobs, which is a
+// batchObjectClient if blobs is a batchBlobClient.
+func newBlobObjectClient(blobs blobClient) ObjectClient {
+	if batch, ok := blobs.(batchBlobClient); ok {
+		return batchBlobObjectClient{blobObjectClient{blobs}, batch}
+	}
+	return blobObjectClient{blobs}
+}
+
+// blobObjectClient is an ObjectClient which encodes chunks into a blobClient.
+type blobObjectClient struct {
+	blobClient
+}
+
+func (c blobObjectClient) PutChunk(ctx context.Context, userID string, chunk *Chunk) error {
+	body, err := chunk.reader()
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	return c.putBlob(ctx, userID, chunk, buf)
+}
+
+func (c blobObjectClient) GetChunk(ctx context.Context, userID string, chunk *Chunk) error {
+	buf, err := c.getBlob(ctx, userID, chunk)
+	if err != nil {
+		return err
+	}
+	return chunk.decode(bytes.NewReader(buf))
+}
+
+// batchBlobObjectClient is a blobObjectClient of a batchBlobClient.
+type batchBlobObjectClient struct {
+	blobObjectClient
+	blobs batchBlobClient
+}
+
+func (c batchBlobObjectClient) GetChunks(ctx context.Context, userID string, chunks []Chunk) error {
+	bufs, err := c.blobs.getBlobs(ctx, userID, chunks)
+	if err != nil {
+		return err
+	}
+	for i := range chunks {
+		if err := chunks[i].decode(bytes.NewReader(bufs[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type s3ObjectClient struct {
+	s3         S3Client
+	bucketName string
+	sse        S3SSEConfig
+	tenants    map[string]TenantStorage
+}
+
+// location returns the bucket and key userID's chunk is stored at.
+func (c s3ObjectClient) location(userID, chunkID string) (string, string) {
+	bucket, key := c.bucketName, chunkName(userID, chunkID)
+	if storage, ok := c.tenants[userID]; ok {
+		if storage.Bucket != "" {
+			bucket = storage.Bucket
+		}
+		key = storage.Prefix + key
+	}
+	return bucket, key
+}
+
+func (c s3ObjectClient) putBlob(ctx context.Context, userID string, chunk *Chunk, buf []byte) error {
+	bucket, key := c.location(userID, chunk.ID)
+	return instrument.TimeRequestHistogram(ctx, "S3.PutObject", s3RequestDuration, func(_ context.Context) error {
+		input := &s3.PutObjectInput{
+			Body:   bytes.NewReader(buf),
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		}
+		c.sse.apply(input)
+		_, err := c.s3.PutObject(input)
+		return err
+	})
+}
+
+func (c s3ObjectClient) getBlob(ctx context.Context, userID string, chunk *Chunk) ([]byte, error) {
+	bucket, key := c.location(userID, chunk.ID)
+	var resp *s3.GetObjectOutput
+	err := instrument.TimeRequestHistogram(ctx, "S3.GetObject", s3RequestDuration, func(_ context.Context) error {
+		var err error
+		resp, err = c.s3.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
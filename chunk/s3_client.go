@@ -1,6 +1,7 @@
 package chunk
 
 import (
+	"flag"
 	"fmt"
 	"net/url"
 	"strings"
@@ -17,6 +18,40 @@ type S3Client interface {
 	GetObject(*s3.GetObjectInput) (*s3.GetObjectOutput, error)
 }
 
+// S3SSEConfig configures server-side encryption of chunks uploaded to S3.
+type S3SSEConfig struct {
+	Type     string
+	KMSKeyID string
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *S3SSEConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Type, "s3.sse", "", "Server-side encryption for chunks: AES256 for SSE-S3, aws:kms for SSE-KMS, or empty for none.")
+	f.StringVar(&cfg.KMSKeyID, "s3.sse-kms-key-id", "", "KMS key ARN to use with -s3.sse=aws:kms; defaults to the AWS-managed key.")
+}
+
+func (cfg *S3SSEConfig) validate() error {
+	switch cfg.Type {
+	case "", s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms:
+	default:
+		return fmt.Errorf("invalid S3 server-side encryption type %q", cfg.Type)
+	}
+	if cfg.KMSKeyID != "" && cfg.Type != s3.ServerSideEncryptionAwsKms {
+		return fmt.Errorf("S3 KMS key ID requires server-side encryption type %s", s3.ServerSideEncryptionAwsKms)
+	}
+	return nil
+}
+
+func (cfg *S3SSEConfig) apply(input *s3.PutObjectInput) {
+	if cfg.Type == "" {
+		return
+	}
+	input.ServerSideEncryption = aws.String(cfg.Type)
+	if cfg.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(cfg.KMSKeyID)
+	}
+}
+
 // NewS3Client makes a new S3Client
 func NewS3Client(s3URL string) (S3Client, string, error) {
 	url, err := url.Parse(s3URL)
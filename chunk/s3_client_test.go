@@ -4,6 +4,8 @@ import (
 	"net/url"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -87,3 +89,30 @@ func TestAWSConfigFromURL(t *testing.T) {
 		}
 	}
 }
+
+func TestS3SSEConfig(t *testing.T) {
+	for _, tc := range []struct {
+		cfg         S3SSEConfig
+		valid       bool
+		expectedSSE *string
+		expectedKey *string
+	}{
+		{S3SSEConfig{}, true, nil, nil},
+		{S3SSEConfig{Type: "AES256"}, true, aws.String("AES256"), nil},
+		{S3SSEConfig{Type: "aws:kms", KMSKeyID: "arn:key"}, true, aws.String("aws:kms"), aws.String("arn:key")},
+		{S3SSEConfig{Type: "AES256", KMSKeyID: "arn:key"}, false, nil, nil},
+		{S3SSEConfig{Type: "rot13"}, false, nil, nil},
+	} {
+		err := tc.cfg.validate()
+		if !tc.valid {
+			assert.Error(t, err, "%+v", tc.cfg)
+			continue
+		}
+		require.NoError(t, err)
+
+		input := &s3.PutObjectInput{}
+		tc.cfg.apply(input)
+		assert.Equal(t, tc.expectedSSE, input.ServerSideEncryption)
+		assert.Equal(t, tc.expectedKey, input.SSEKMSKeyId)
+	}
+}
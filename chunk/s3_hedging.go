@@ -0,0 +1,124 @@
+package chunk
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+const (
+	// Number of recent GetObject latencies to work out the hedging delay from,
+	// and the number needed before we start hedging.
+	hedgingWindowSize = 1000
+	hedgingMinSamples = 100
+)
+
+var (
+	s3HedgedRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "s3_hedged_requests_total",
+		Help:      "The total number of hedged S3 GetObject requests issued.",
+	})
+	s3HedgeWins = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "s3_hedge_wins_total",
+		Help:      "The total number of hedged S3 GetObject requests which returned first.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(s3HedgedRequests)
+	prometheus.MustRegister(s3HedgeWins)
+}
+
+// hedgingS3Client issues a second GetObject if the first hasn't returned
+// within the given percentile of recent latencies, and uses whichever
+// returns first.  Only the time to the response headers is hedged; the body
+// is streamed from the winner.
+type hedgingS3Client struct {
+	S3Client
+	percentile float64
+	latencies  *util.LatencyWindow
+}
+
+func newHedgingS3Client(client S3Client, percentile float64) *hedgingS3Client {
+	return &hedgingS3Client{
+		S3Client:   client,
+		percentile: percentile,
+		latencies:  util.NewLatencyWindow(hedgingWindowSize, hedgingMinSamples),
+	}
+}
+
+type getObjectResult struct {
+	out    *s3.GetObjectOutput
+	err    error
+	hedged bool
+}
+
+func (c *hedgingS3Client) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	results := make(chan getObjectResult, 2)
+	get := func(hedged bool) {
+		start := time.Now()
+		out, err := c.S3Client.GetObject(input)
+		if err == nil {
+			c.observe(time.Since(start))
+		}
+		results <- getObjectResult{out, err, hedged}
+	}
+	go get(false)
+
+	delay, ok := c.delay()
+	if !ok {
+		r := <-results
+		return r.out, r.err
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	pending := 1
+	select {
+	case r := <-results:
+		return r.out, r.err
+	case <-timer.C:
+		s3HedgedRequests.Inc()
+		go get(true)
+		pending++
+	}
+
+	var lastErr error
+	for ; pending > 0; pending-- {
+		r := <-results
+		if r.err != nil {
+			lastErr = r.err
+			continue
+		}
+		if r.hedged {
+			s3HedgeWins.Inc()
+		}
+		if pending > 1 {
+			go closeLoser(results)
+		}
+		return r.out, nil
+	}
+	return nil, lastErr
+}
+
+// closeLoser waits for the slower request, releasing its connection.
+func closeLoser(results <-chan getObjectResult) {
+	if r := <-results; r.err == nil {
+		r.out.Body.Close()
+	}
+}
+
+func (c *hedgingS3Client) observe(latency time.Duration) {
+	c.latencies.Observe(latency)
+}
+
+// delay returns the configured percentile of recent latencies, if we have
+// seen enough requests.
+func (c *hedgingS3Client) delay() (time.Duration, bool) {
+	return c.latencies.Percentile(c.percentile)
+}
@@ -0,0 +1,50 @@
+package chunk
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowFirstS3 takes a long time to answer its first GetObject.
+type slowFirstS3 struct {
+	S3Client
+	calls int32
+}
+
+func (m *slowFirstS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	call := atomic.AddInt32(&m.calls, 1)
+	if call == 1 {
+		time.Sleep(1 * time.Second)
+	}
+	return &s3.GetObjectOutput{
+		Body: ioutil.NopCloser(bytes.NewReader([]byte{byte(call)})),
+	}, nil
+}
+
+func TestHedgingS3Client(t *testing.T) {
+	mock := &slowFirstS3{}
+	client := newHedgingS3Client(mock, 0.9)
+	for i := 0; i < hedgingMinSamples; i++ {
+		client.observe(time.Millisecond)
+	}
+
+	start := time.Now()
+	out, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("key"),
+	})
+	require.NoError(t, err)
+	assert.True(t, time.Since(start) < 500*time.Millisecond, "hedged request didn't win")
+
+	buf, err := ioutil.ReadAll(out.Body)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{2}, buf)
+}
@@ -29,6 +29,7 @@ var (
 	rangeKeyV2 = []byte{'2'}
 	rangeKeyV3 = []byte{'3'}
 	rangeKeyV4 = []byte{'4'}
+	rangeKeyV5 = []byte{'5'}
 )
 
 // Schema interface defines methods to calculate the hash and range keys needed
@@ -41,6 +42,11 @@ type Schema interface {
 	GetReadEntriesForMetric(from, through model.Time, userID string, metricName model.LabelValue) ([]IndexEntry, error)
 	GetReadEntriesForMetricLabel(from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName) ([]IndexEntry, error)
 	GetReadEntriesForMetricLabelValue(from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName, labelValue model.LabelValue) ([]IndexEntry, error)
+
+	// GetReadEntriesForMetricLabelValuePrefix returns entries which include at
+	// least all the label values starting with prefix - schemas which can't
+	// express that as a range key condition return all values for the label.
+	GetReadEntriesForMetricLabelValuePrefix(from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName, prefix model.LabelValue) ([]IndexEntry, error)
 }
 
 // IndexEntry describes an entry in the chunk index
@@ -76,6 +82,13 @@ type SchemaConfig struct {
 
 	// After this time, we will read and write v5 schemas.
 	V5SchemaFrom util.DayValue
+
+	// After this time, we will read and write v6 schemas.
+	V6SchemaFrom util.DayValue
+
+	// Isolated tenants' index goes in their own periodic tables, named with
+	// these prefixes.
+	tenantTablePrefixes map[string]string
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
@@ -86,9 +99,16 @@ func (cfg *SchemaConfig) RegisterFlags(f *flag.FlagSet) {
 	f.Var(&cfg.Base64ValuesFrom, "dynamodb.base64-buckets-from", "The date (in the format YYYY-MM-DD) after which we will stop querying to non-base64 encoded values.")
 	f.Var(&cfg.V4SchemaFrom, "dynamodb.v4-schema-from", "The date (in the format YYYY-MM-DD) after which we enable v4 schema.")
 	f.Var(&cfg.V5SchemaFrom, "dynamodb.v5-schema-from", "The date (in the format YYYY-MM-DD) after which we enable v5 schema.")
+	f.Var(&cfg.V6SchemaFrom, "dynamodb.v6-schema-from", "The date (in the format YYYY-MM-DD) after which we enable v6 schema.")
 }
 
-func (cfg *SchemaConfig) tableForBucket(bucketStart int64) string {
+func (cfg *SchemaConfig) tableForBucket(userID string, bucketStart int64) string {
+	if prefix, ok := cfg.tenantTablePrefixes[userID]; ok {
+		// Isolated tenants never use the shared legacy table; anything from
+		// before the periodic tables start goes in their first table.
+		bucketStart = util.Max64(bucketStart, cfg.PeriodicTableStartAt.Unix())
+		return prefix + strconv.Itoa(int(bucketStart/int64(cfg.TablePeriod/time.Second)))
+	}
 	if !cfg.UsePeriodicTables || bucketStart < (cfg.PeriodicTableStartAt.Unix()) {
 		return cfg.OriginalTableName
 	}
@@ -108,7 +128,7 @@ func (cfg SchemaConfig) hourlyBuckets(from, through model.Time, userID string, m
 	for i := fromHour; i <= throughHour; i++ {
 		relativeFrom := util.Max64(i*millisecondsInHour, int64(from))
 		relativeThrough := util.Min64((i+1)*millisecondsInHour, int64(through))
-		entries, err := callback(uint32(relativeFrom), uint32(relativeThrough), cfg.tableForBucket(i*secondsInHour), fmt.Sprintf("%s:%d:%s", userID, i, metricName))
+		entries, err := callback(uint32(relativeFrom), uint32(relativeThrough), cfg.tableForBucket(userID, i*secondsInHour), fmt.Sprintf("%s:%d:%s", userID, i, metricName))
 		if err != nil {
 			return nil, err
 		}
@@ -127,7 +147,7 @@ func (cfg SchemaConfig) dailyBuckets(from, through model.Time, userID string, me
 	for i := fromDay; i <= throughDay; i++ {
 		relativeFrom := util.Max64(i*millisecondsInDay, int64(from))
 		relativeThrough := util.Min64((i+1)*millisecondsInDay, int64(through))
-		entries, err := callback(uint32(relativeFrom), uint32(relativeThrough), cfg.tableForBucket(i*secondsInDay), fmt.Sprintf("%s:d%d:%s", userID, i, metricName))
+		entries, err := callback(uint32(relativeFrom), uint32(relativeThrough), cfg.tableForBucket(userID, i*secondsInDay), fmt.Sprintf("%s:d%d:%s", userID, i, metricName))
 		if err != nil {
 			return nil, err
 		}
@@ -174,6 +194,10 @@ func newCompositeSchema(cfg SchemaConfig) (Schema, error) {
 		schemas = append(schemas, compositeSchemaEntry{cfg.V5SchemaFrom.Time, v5Schema(cfg)})
 	}
 
+	if cfg.V6SchemaFrom.IsSet() {
+		schemas = append(schemas, compositeSchemaEntry{cfg.V6SchemaFrom.Time, v6Schema(cfg)})
+	}
+
 	if !sort.IsSorted(byStart(schemas)) {
 		return nil, fmt.Errorf("schemas not in time-sorted order")
 	}
@@ -261,6 +285,12 @@ func (c compositeSchema) GetReadEntriesForMetricLabelValue(from, through model.T
 	})
 }
 
+func (c compositeSchema) GetReadEntriesForMetricLabelValuePrefix(from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName, prefix model.LabelValue) ([]IndexEntry, error) {
+	return c.forSchemas(from, through, func(from, through model.Time, schema Schema) ([]IndexEntry, error) {
+		return schema.GetReadEntriesForMetricLabelValuePrefix(from, through, userID, metricName, labelName, prefix)
+	})
+}
+
 // v1Schema was:
 // - hash key: <userid>:<hour bucket>:<metric name>
 // - range key: <label name>\0<label value>\0<chunk name>
@@ -310,6 +340,16 @@ func v5Schema(cfg SchemaConfig) Schema {
 	}
 }
 
+// v6 schema is an extension of v5, with a hint of the label value's
+// trigrams after the version so regex matchers can skip entries:
+// - range key: <chunk end time>\0<base64(label value)>\0<chunk name>\0<version 5>\0<hex(value hint)>
+func v6Schema(cfg SchemaConfig) Schema {
+	return schema{
+		cfg.dailyBuckets,
+		v6Entries{},
+	}
+}
+
 // schema implements Schema given a bucketing function and and set of range key callbacks
 type schema struct {
 	buckets func(from, through model.Time, userID string, metricName model.LabelValue, callback bucketCallback) ([]IndexEntry, error)
@@ -340,11 +380,18 @@ func (s schema) GetReadEntriesForMetricLabelValue(from, through model.Time, user
 	})
 }
 
+func (s schema) GetReadEntriesForMetricLabelValuePrefix(from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName, prefix model.LabelValue) ([]IndexEntry, error) {
+	return s.buckets(from, through, userID, metricName, func(bucketFrom, bucketThrough uint32, tableName, hashKey string) ([]IndexEntry, error) {
+		return s.entries.GetReadMetricLabelValuePrefixEntries(bucketFrom, bucketThrough, tableName, hashKey, labelName, prefix)
+	})
+}
+
 type entries interface {
 	GetWriteEntries(from, through uint32, tableName, hashKey string, labels model.Metric, chunkID string) ([]IndexEntry, error)
 	GetReadMetricEntries(from, through uint32, tableName, hashKey string) ([]IndexEntry, error)
 	GetReadMetricLabelEntries(from, through uint32, tableName, hashKey string, labelName model.LabelName) ([]IndexEntry, error)
 	GetReadMetricLabelValueEntries(from, through uint32, tableName, hashKey string, labelName model.LabelName, labelValue model.LabelValue) ([]IndexEntry, error)
+	GetReadMetricLabelValuePrefixEntries(from, through uint32, tableName, hashKey string, labelName model.LabelName, prefix model.LabelValue) ([]IndexEntry, error)
 }
 
 type originalEntries struct{}
@@ -401,6 +448,19 @@ func (originalEntries) GetReadMetricLabelValueEntries(_, _ uint32, tableName, ha
 	}, nil
 }
 
+func (originalEntries) GetReadMetricLabelValuePrefixEntries(_, _ uint32, tableName, hashKey string, labelName model.LabelName, prefix model.LabelValue) ([]IndexEntry, error) {
+	if strings.ContainsRune(string(prefix), '\x00') {
+		return nil, fmt.Errorf("label values cannot contain null byte")
+	}
+	return []IndexEntry{
+		{
+			TableName:        tableName,
+			HashValue:        hashKey,
+			RangeValuePrefix: append(buildRangeKey([]byte(labelName)), prefix...),
+		},
+	}, nil
+}
+
 type base64Entries struct {
 	originalEntries
 }
@@ -434,6 +494,16 @@ func (base64Entries) GetReadMetricLabelValueEntries(_, _ uint32, tableName, hash
 	}, nil
 }
 
+func (base64Entries) GetReadMetricLabelValuePrefixEntries(_, _ uint32, tableName, hashKey string, labelName model.LabelName, prefix model.LabelValue) ([]IndexEntry, error) {
+	return []IndexEntry{
+		{
+			TableName:        tableName,
+			HashValue:        hashKey,
+			RangeValuePrefix: append(buildRangeKey([]byte(labelName)), encodeBase64Prefix(prefix)...),
+		},
+	}, nil
+}
+
 type labelNameInHashKeyEntries struct{}
 
 func (labelNameInHashKeyEntries) GetWriteEntries(_, _ uint32, tableName, hashKey string, labels model.Metric, chunkID string) ([]IndexEntry, error) {
@@ -490,6 +560,16 @@ func (labelNameInHashKeyEntries) GetReadMetricLabelValueEntries(_, _ uint32, tab
 	}, nil
 }
 
+func (labelNameInHashKeyEntries) GetReadMetricLabelValuePrefixEntries(_, _ uint32, tableName, hashKey string, labelName model.LabelName, prefix model.LabelValue) ([]IndexEntry, error) {
+	return []IndexEntry{
+		{
+			TableName:        tableName,
+			HashValue:        hashKey + ":" + string(labelName),
+			RangeValuePrefix: append(buildRangeKey(nil), encodeBase64Prefix(prefix)...),
+		},
+	}, nil
+}
+
 // v5Entries includes chunk end time in range key - see #298.
 type v5Entries struct{}
 
@@ -570,6 +650,44 @@ func (v5Entries) GetReadMetricLabelValueEntries(from, _ uint32, tableName, hashK
 	}, nil
 }
 
+// The chunk end time comes before the label value in the range key, so we
+// can't narrow the query by value prefix.
+func (e v5Entries) GetReadMetricLabelValuePrefixEntries(from, through uint32, tableName, hashKey string, labelName model.LabelName, _ model.LabelValue) ([]IndexEntry, error) {
+	return e.GetReadMetricLabelEntries(from, through, tableName, hashKey, labelName)
+}
+
+// v6Entries is v5Entries with a value hint in the label range keys.
+type v6Entries struct {
+	v5Entries
+}
+
+func (v6Entries) GetWriteEntries(_, through uint32, tableName, hashKey string, labels model.Metric, chunkID string) ([]IndexEntry, error) {
+	chunkIDBytes := []byte(chunkID)
+	encodedThroughBytes := encodeTime(through)
+
+	entries := []IndexEntry{
+		{
+			TableName:  tableName,
+			HashValue:  hashKey,
+			RangeValue: buildRangeKey(encodedThroughBytes, nil, chunkIDBytes, rangeKeyV3),
+		},
+	}
+
+	for key, value := range labels {
+		if key == model.MetricNameLabel {
+			continue
+		}
+		encodedValueBytes := encodeBase64Value(value)
+		entries = append(entries, IndexEntry{
+			TableName:  tableName,
+			HashValue:  hashKey + ":" + string(key),
+			RangeValue: buildRangeKey(encodedThroughBytes, encodedValueBytes, chunkIDBytes, rangeKeyV5, encodeValueHint(hintForValue(value))),
+		})
+	}
+
+	return entries, nil
+}
+
 func buildRangeKey(ss ...[]byte) []byte {
 	length := 0
 	for _, s := range ss {
@@ -590,6 +708,12 @@ func encodeBase64Value(value model.LabelValue) []byte {
 	return encoded
 }
 
+// encodeBase64Prefix encodes the longest prefix of prefix whose encoding is
+// also a prefix of the encoding of every value starting with prefix.
+func encodeBase64Prefix(prefix model.LabelValue) []byte {
+	return encodeBase64Value(prefix[:len(prefix)-len(prefix)%3])
+}
+
 func decodeBase64Value(bs []byte) (model.LabelValue, error) {
 	decodedLen := base64.RawStdEncoding.DecodedLen(len(bs))
 	decoded := make([]byte, decodedLen, decodedLen)
@@ -642,6 +766,11 @@ func parseRangeValue(v []byte) (model.LabelValue, string, error) {
 		value, err := decodeBase64Value(components[1])
 		return value, string(components[2]), err
 
+	// v6 schema version 5 range key is chunk end time, label value, chunk ID, version, value hint
+	case bytes.Equal(components[3], rangeKeyV5):
+		value, err := decodeBase64Value(components[1])
+		return value, string(components[2]), err
+
 	default:
 		return "", "", fmt.Errorf("unrecognised version: '%v'", string(components[3]))
 	}
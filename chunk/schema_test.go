@@ -31,6 +31,9 @@ func (mockSchema) GetReadEntriesForMetricLabel(from, through model.Time, userID
 func (mockSchema) GetReadEntriesForMetricLabelValue(from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName, labelValue model.LabelValue) ([]IndexEntry, error) {
 	return nil, nil
 }
+func (mockSchema) GetReadEntriesForMetricLabelValuePrefix(from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName, prefix model.LabelValue) ([]IndexEntry, error) {
+	return nil, nil
+}
 
 func TestSchemaComposite(t *testing.T) {
 	type result struct {
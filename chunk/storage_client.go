@@ -1,28 +1,60 @@
 package chunk
 
 import (
+	"time"
+
 	"golang.org/x/net/context"
 )
 
-// StorageClient is a client for DynamoDB
+// StorageClient is a client for DynamoDB, which holds the index and manages
+// the tables it lives in.
 type StorageClient interface {
+	IndexClient
+	TableClient
+}
+
+// IndexClient is a client for the store holding the chunk index.
+type IndexClient interface {
 	// For the write path
 	NewWriteBatch() WriteBatch
 	BatchWrite(context.Context, WriteBatch) error
 
 	// For the read path
 	QueryPages(ctx context.Context, entry IndexEntry, callback func(result ReadBatch, lastPage bool) (shouldContinue bool)) error
+}
 
-	// For table management
+// TableClient manages the tables holding the index.
+type TableClient interface {
 	ListTables() ([]string, error)
-	CreateTable(name string, readCapacity, writeCapacity int64) error
+	CreateTable(name string, readCapacity, writeCapacity int64, options TableOptions) error
 	DescribeTable(name string) (readCapacity, writeCapacity int64, status string, err error)
 	UpdateTable(name string, readCapacity, writeCapacity int64) error
+	TableTags(name string) (map[string]string, error)
+
+	PointInTimeRecoveryEnabled(name string) (bool, error)
+	EnablePointInTimeRecovery(name string) error
+	HasBackupSince(name string, since time.Time) (bool, error)
+	CreateBackup(name, backupName string) error
+}
+
+// TableOptions are the settings which can only be applied when a table is
+// created.
+type TableOptions struct {
+	// Encrypt the table at rest; if KMSKeyID is empty the AWS-managed key is used.
+	SSEEnabled  bool
+	SSEKMSKeyID string
+
+	// Publish changes to the table's items to a DynamoDB Stream of this view
+	// type (empty for no stream).
+	StreamViewType string
+
+	Tags map[string]string
 }
 
 // WriteBatch represents a batch of writes
 type WriteBatch interface {
 	Add(tableName, hashValue string, rangeValue []byte)
+	Len() int
 }
 
 // ReadBatch represents the results of a QueryPages
@@ -34,3 +66,19 @@ type ReadBatch interface {
 	// metadata was written to the chunk index.
 	Value(index int) []byte
 }
+
+// IndexScanner is an IndexClient which can read every entry in a table, in
+// segments which can be read in parallel, as needed to migrate the index
+// between schemas.
+type IndexScanner interface {
+	// ScanPages calls callback with each page of the segment's entries,
+	// following after if it's not nil, and the cursor to resume from after
+	// the page, nil on the last page.
+	ScanPages(ctx context.Context, tableName string, segment, totalSegments int, after *ScanCursor, callback func(entries []IndexEntry, next *ScanCursor) (shouldContinue bool)) error
+}
+
+// ScanCursor is the last entry read by a scan.
+type ScanCursor struct {
+	HashValue  string
+	RangeValue []byte
+}
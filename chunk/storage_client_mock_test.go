@@ -3,11 +3,14 @@ package chunk
 import (
 	"bytes"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/weaveworks/common/mtime"
 	"golang.org/x/net/context"
 )
 
@@ -19,6 +22,14 @@ type MockStorage struct {
 type mockTable struct {
 	items       map[string][]mockItem
 	write, read int64
+	options     TableOptions
+	pitr        bool
+	backups     []mockBackup
+}
+
+type mockBackup struct {
+	name    string
+	created time.Time
 }
 
 type mockItem []byte
@@ -42,7 +53,7 @@ func (m *MockStorage) ListTables() ([]string, error) {
 	return tableNames, nil
 }
 
-func (m *MockStorage) CreateTable(name string, read, write int64) error {
+func (m *MockStorage) CreateTable(name string, read, write int64, options TableOptions) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
@@ -51,9 +62,10 @@ func (m *MockStorage) CreateTable(name string, read, write int64) error {
 	}
 
 	m.tables[name] = &mockTable{
-		items: map[string][]mockItem{},
-		write: write,
-		read:  read,
+		items:   map[string][]mockItem{},
+		write:   write,
+		read:    read,
+		options: options,
 	}
 
 	return nil
@@ -86,6 +98,73 @@ func (m *MockStorage) UpdateTable(name string, readCapacity, writeCapacity int64
 	return nil
 }
 
+func (m *MockStorage) TableTags(name string) (map[string]string, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	table, ok := m.tables[name]
+	if !ok {
+		return nil, fmt.Errorf("not found")
+	}
+
+	return table.options.Tags, nil
+}
+
+func (m *MockStorage) PointInTimeRecoveryEnabled(name string) (bool, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	table, ok := m.tables[name]
+	if !ok {
+		return false, fmt.Errorf("not found")
+	}
+
+	return table.pitr, nil
+}
+
+func (m *MockStorage) EnablePointInTimeRecovery(name string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	table, ok := m.tables[name]
+	if !ok {
+		return fmt.Errorf("not found")
+	}
+
+	table.pitr = true
+	return nil
+}
+
+func (m *MockStorage) HasBackupSince(name string, since time.Time) (bool, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	table, ok := m.tables[name]
+	if !ok {
+		return false, fmt.Errorf("not found")
+	}
+
+	for _, backup := range table.backups {
+		if !backup.created.Before(since) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MockStorage) CreateBackup(name, backupName string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	table, ok := m.tables[name]
+	if !ok {
+		return fmt.Errorf("not found")
+	}
+
+	table.backups = append(table.backups, mockBackup{name: backupName, created: mtime.Now()})
+	return nil
+}
+
 func (m *MockStorage) NewWriteBatch() WriteBatch {
 	return &mockWriteBatch{}
 }
@@ -185,6 +264,46 @@ func (m *MockStorage) QueryPages(ctx context.Context, entry IndexEntry, callback
 	return nil
 }
 
+// ScanPages implements IndexScanner, with a page per hash value.
+func (m *MockStorage) ScanPages(ctx context.Context, tableName string, segment, totalSegments int, after *ScanCursor, callback func(entries []IndexEntry, next *ScanCursor) (shouldContinue bool)) error {
+	m.mtx.RLock()
+	table, ok := m.tables[tableName]
+	if !ok {
+		m.mtx.RUnlock()
+		return fmt.Errorf("table not found")
+	}
+	var hashValues []string
+	for hashValue := range table.items {
+		h := fnv.New32()
+		h.Write([]byte(hashValue))
+		if int(h.Sum32()%uint32(totalSegments)) == segment && (after == nil || hashValue > after.HashValue) {
+			hashValues = append(hashValues, hashValue)
+		}
+	}
+	sort.Strings(hashValues)
+	pages := make([][]IndexEntry, 0, len(hashValues))
+	for _, hashValue := range hashValues {
+		var entries []IndexEntry
+		for _, item := range table.items[hashValue] {
+			entries = append(entries, IndexEntry{TableName: tableName, HashValue: hashValue, RangeValue: item})
+		}
+		pages = append(pages, entries)
+	}
+	m.mtx.RUnlock()
+
+	// The callback may write to the storage.
+	for i, entries := range pages {
+		var next *ScanCursor
+		if i < len(pages)-1 {
+			next = &ScanCursor{HashValue: entries[0].HashValue, RangeValue: entries[len(entries)-1].RangeValue}
+		}
+		if !callback(entries, next) {
+			return nil
+		}
+	}
+	return nil
+}
+
 type mockWriteBatch []struct {
 	tableName, hashValue string
 	rangeValue           []byte
@@ -197,6 +316,10 @@ func (b *mockWriteBatch) Add(tableName, hashValue string, rangeValue []byte) {
 	}{tableName, hashValue, rangeValue})
 }
 
+func (b *mockWriteBatch) Len() int {
+	return len(*b)
+}
+
 type mockReadBatch [][]byte
 
 func (b mockReadBatch) Len() int {
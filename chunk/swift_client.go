@@ -0,0 +1,345 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/instrument"
+)
+
+// Refresh Keystone tokens this long before they expire.
+const swiftTokenRefreshMargin = 5 * time.Minute
+
+var swiftRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "cortex",
+	Name:      "swift_request_duration_seconds",
+	Help:      "Time spent doing Swift requests.",
+	Buckets:   []float64{.025, .05, .1, .25, .5, 1, 2},
+}, []string{"operation", "status_code"})
+
+func init() {
+	prometheus.MustRegister(swiftRequestDuration)
+}
+
+// SwiftConfig configures the OpenStack Swift chunk client.
+type SwiftConfig struct {
+	AuthURL           string
+	Username          string
+	UserDomainName    string
+	Password          string
+	ProjectName       string
+	ProjectDomainName string
+	RegionName        string
+	ContainerName     string
+	SegmentSize       int
+	MaxRetries        int
+	Timeout           time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *SwiftConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.AuthURL, "swift.auth-url", "", "Keystone v3 URL, eg https://keystone.example.com:5000/v3.")
+	f.StringVar(&cfg.Username, "swift.username", "", "Keystone user name.")
+	f.StringVar(&cfg.UserDomainName, "swift.user-domain-name", "Default", "Keystone domain of the user.")
+	f.StringVar(&cfg.Password, "swift.password", "", "Keystone password.")
+	f.StringVar(&cfg.ProjectName, "swift.project-name", "", "Keystone project to scope the token to.")
+	f.StringVar(&cfg.ProjectDomainName, "swift.project-domain-name", "Default", "Keystone domain of the project.")
+	f.StringVar(&cfg.RegionName, "swift.region-name", "", "Region of the object-store endpoint to use; empty picks the first one.")
+	f.StringVar(&cfg.ContainerName, "swift.container-name", "cortex", "Name of the Swift container to store chunks in.")
+	f.IntVar(&cfg.SegmentSize, "swift.segment-size", 1<<30, "Objects larger than this many bytes are uploaded as segmented large objects.")
+	f.IntVar(&cfg.MaxRetries, "swift.max-retries", 5, "Number of times to retry a failed Swift request.")
+	f.DurationVar(&cfg.Timeout, "swift.timeout", 5*time.Minute, "Timeout for each Swift request, including sending or reading its object.")
+}
+
+type swiftClient struct {
+	cfg    SwiftConfig
+	client *http.Client
+
+	authMtx  sync.Mutex
+	token    string
+	expiry   time.Time
+	endpoint string
+
+	containersMtx sync.Mutex
+	containers    map[string]struct{}
+}
+
+// NewSwiftClient makes a new ObjectClient backed by OpenStack Swift.
+func NewSwiftClient(cfg SwiftConfig) (ObjectClient, error) {
+	client, err := newSwiftClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return blobObjectClient{client}, nil
+}
+
+func newSwiftClient(cfg SwiftConfig) (*swiftClient, error) {
+	if cfg.AuthURL == "" {
+		return nil, fmt.Errorf("-swift.auth-url is required")
+	}
+	if cfg.SegmentSize <= 0 {
+		return nil, fmt.Errorf("-swift.segment-size must be positive")
+	}
+	if cfg.Timeout <= 0 {
+		return nil, fmt.Errorf("-swift.timeout must be positive")
+	}
+	return &swiftClient{
+		cfg:        cfg,
+		client:     &http.Client{Timeout: cfg.Timeout},
+		containers: map[string]struct{}{},
+	}, nil
+}
+
+func (c *swiftClient) putBlob(ctx context.Context, userID string, chunk *Chunk, buf []byte) error {
+	if err := c.ensureContainer(ctx, c.cfg.ContainerName); err != nil {
+		return err
+	}
+	name := chunkName(userID, chunk.ID)
+	if len(buf) <= c.cfg.SegmentSize {
+		_, err := c.do(ctx, "Swift.PutObject", "PUT", c.cfg.ContainerName+"/"+name, nil, buf)
+		return err
+	}
+
+	// Too big for a single object: upload the segments, then a Dynamic
+	// Large Object manifest pointing at them.
+	segments := c.cfg.ContainerName + "_segments"
+	if err := c.ensureContainer(ctx, segments); err != nil {
+		return err
+	}
+	for i := 0; i*c.cfg.SegmentSize < len(buf); i++ {
+		end := (i + 1) * c.cfg.SegmentSize
+		if end > len(buf) {
+			end = len(buf)
+		}
+		segment := fmt.Sprintf("%s/%s/%08d", segments, name, i)
+		if _, err := c.do(ctx, "Swift.PutSegment", "PUT", segment, nil, buf[i*c.cfg.SegmentSize:end]); err != nil {
+			return err
+		}
+	}
+	header := http.Header{}
+	header.Set("X-Object-Manifest", fmt.Sprintf("%s/%s/", segments, name))
+	_, err := c.do(ctx, "Swift.PutManifest", "PUT", c.cfg.ContainerName+"/"+name, header, nil)
+	return err
+}
+
+func (c *swiftClient) getBlob(ctx context.Context, userID string, chunk *Chunk) ([]byte, error) {
+	return c.do(ctx, "Swift.GetObject", "GET", c.cfg.ContainerName+"/"+chunkName(userID, chunk.ID), nil, nil)
+}
+
+func (c *swiftClient) ensureContainer(ctx context.Context, container string) error {
+	c.containersMtx.Lock()
+	_, ok := c.containers[container]
+	c.containersMtx.Unlock()
+	if ok {
+		return nil
+	}
+
+	// Creating a container which already exists is a no-op (202).
+	if _, err := c.do(ctx, "Swift.PutContainer", "PUT", container, nil, nil); err != nil {
+		return err
+	}
+
+	c.containersMtx.Lock()
+	c.containers[container] = struct{}{}
+	c.containersMtx.Unlock()
+	return nil
+}
+
+type swiftError struct {
+	statusCode int
+	body       string
+}
+
+func (e swiftError) Error() string {
+	return fmt.Sprintf("swift request failed: %d %s", e.statusCode, e.body)
+}
+
+func (e swiftError) retryable() bool {
+	return e.statusCode == http.StatusTooManyRequests || e.statusCode/100 == 5
+}
+
+// do issues a request against path (relative to the object-store endpoint),
+// re-authenticating on 401 and retrying throttled, server and network errors.
+func (c *swiftClient) do(ctx context.Context, operation, method, path string, header http.Header, body []byte) ([]byte, error) {
+	var (
+		result  []byte
+		err     error
+		backoff = minBackoff
+	)
+	for tries := 0; ; tries++ {
+		err = instrument.TimeRequestHistogram(ctx, operation, swiftRequestDuration, func(_ context.Context) error {
+			var err error
+			result, err = c.doOnce(method, path, header, body)
+			return err
+		})
+		if err == nil {
+			return result, nil
+		}
+		if err, ok := err.(swiftError); ok {
+			if err.statusCode == http.StatusUnauthorized {
+				c.invalidateToken()
+			} else if !err.retryable() {
+				return nil, err
+			}
+		}
+		if tries >= c.cfg.MaxRetries {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+func (c *swiftClient) doOnce(method, path string, header http.Header, body []byte) ([]byte, error) {
+	token, endpoint, err := c.authenticate()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(endpoint, "/")+"/"+escapePath(path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("X-Auth-Token", token)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, swiftError{statusCode: resp.StatusCode, body: string(buf)}
+	}
+	return buf, nil
+}
+
+func escapePath(path string) string {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+func (c *swiftClient) invalidateToken() {
+	c.authMtx.Lock()
+	defer c.authMtx.Unlock()
+	c.token = ""
+}
+
+// authenticate returns a cached token and object-store endpoint, fetching
+// new ones from Keystone when needed.
+func (c *swiftClient) authenticate() (string, string, error) {
+	c.authMtx.Lock()
+	defer c.authMtx.Unlock()
+
+	if c.token != "" && time.Now().Add(swiftTokenRefreshMargin).Before(c.expiry) {
+		return c.token, c.endpoint, nil
+	}
+
+	type domain struct {
+		Name string `json:"name"`
+	}
+	var authReq struct {
+		Auth struct {
+			Identity struct {
+				Methods  []string `json:"methods"`
+				Password struct {
+					User struct {
+						Name     string `json:"name"`
+						Domain   domain `json:"domain"`
+						Password string `json:"password"`
+					} `json:"user"`
+				} `json:"password"`
+			} `json:"identity"`
+			Scope struct {
+				Project struct {
+					Name   string `json:"name"`
+					Domain domain `json:"domain"`
+				} `json:"project"`
+			} `json:"scope"`
+		} `json:"auth"`
+	}
+	authReq.Auth.Identity.Methods = []string{"password"}
+	authReq.Auth.Identity.Password.User.Name = c.cfg.Username
+	authReq.Auth.Identity.Password.User.Domain.Name = c.cfg.UserDomainName
+	authReq.Auth.Identity.Password.User.Password = c.cfg.Password
+	authReq.Auth.Scope.Project.Name = c.cfg.ProjectName
+	authReq.Auth.Scope.Project.Domain.Name = c.cfg.ProjectDomainName
+
+	buf, err := json.Marshal(authReq)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := c.client.Post(strings.TrimSuffix(c.cfg.AuthURL, "/")+"/auth/tokens", "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		buf, _ := ioutil.ReadAll(resp.Body)
+		return "", "", fmt.Errorf("keystone authentication failed: %d %s", resp.StatusCode, buf)
+	}
+
+	var authResp struct {
+		Token struct {
+			ExpiresAt time.Time `json:"expires_at"`
+			Catalog   []struct {
+				Type      string `json:"type"`
+				Endpoints []struct {
+					Interface string `json:"interface"`
+					Region    string `json:"region"`
+					URL       string `json:"url"`
+				} `json:"endpoints"`
+			} `json:"catalog"`
+		} `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&authResp); err != nil {
+		return "", "", err
+	}
+
+	endpoint := ""
+	for _, service := range authResp.Token.Catalog {
+		if service.Type != "object-store" {
+			continue
+		}
+		for _, ep := range service.Endpoints {
+			if ep.Interface == "public" && (c.cfg.RegionName == "" || ep.Region == c.cfg.RegionName) {
+				endpoint = ep.URL
+				break
+			}
+		}
+	}
+	if endpoint == "" {
+		return "", "", fmt.Errorf("no public object-store endpoint in keystone catalog for region %q", c.cfg.RegionName)
+	}
+
+	c.token = resp.Header.Get("X-Subject-Token")
+	c.expiry = authResp.Token.ExpiresAt
+	c.endpoint = endpoint
+	return c.token, c.endpoint, nil
+}
@@ -0,0 +1,195 @@
+package chunk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// fakeSwift is a minimal Keystone v3 and Swift server, supporting Dynamic
+// Large Objects.
+type fakeSwift struct {
+	url string
+
+	mtx       sync.Mutex
+	auths     int
+	token     string
+	objects   map[string][]byte
+	manifests map[string]string
+}
+
+func (f *fakeSwift) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if r.URL.Path == "/v3/auth/tokens" {
+		f.auths++
+		f.token = fmt.Sprintf("token-%d", f.auths)
+		w.Header().Set("X-Subject-Token", f.token)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token": {"expires_at": %q, "catalog": [
+			{"type": "identity", "endpoints": [{"interface": "public", "region": "one", "url": "%s/v3"}]},
+			{"type": "object-store", "endpoints": [
+				{"interface": "internal", "region": "one", "url": "%s/internal"},
+				{"interface": "public", "region": "one", "url": "%s/swift"}
+			]}
+		]}}`, time.Now().Add(time.Hour).Format(time.RFC3339), f.url, f.url, f.url)
+		return
+	}
+
+	if r.Header.Get("X-Auth-Token") != f.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/swift/")
+	switch r.Method {
+	case "PUT":
+		if !strings.Contains(path, "/") {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		if manifest := r.Header.Get("X-Object-Manifest"); manifest != "" {
+			f.manifests[path] = manifest
+		} else {
+			buf, _ := ioutil.ReadAll(r.Body)
+			f.objects[path] = buf
+		}
+		w.WriteHeader(http.StatusCreated)
+
+	case "GET":
+		if manifest, ok := f.manifests[path]; ok {
+			names := []string{}
+			for name := range f.objects {
+				if strings.HasPrefix(name, manifest) {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				w.Write(f.objects[name])
+			}
+			return
+		}
+		buf, ok := f.objects[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(buf)
+	}
+}
+
+func newTestSwiftClient(t *testing.T, segmentSize int) (*fakeSwift, ObjectClient, func()) {
+	fake := &fakeSwift{
+		objects:   map[string][]byte{},
+		manifests: map[string]string{},
+	}
+	server := httptest.NewServer(fake)
+	fake.url = server.URL
+	client, err := NewSwiftClient(SwiftConfig{
+		AuthURL:       server.URL + "/v3",
+		Username:      "user",
+		Password:      "pass",
+		ProjectName:   "project",
+		RegionName:    "one",
+		ContainerName: "chunks",
+		SegmentSize:   segmentSize,
+		MaxRetries:    3,
+		Timeout:       time.Second,
+	})
+	require.NoError(t, err)
+	return fake, client, server.Close
+}
+
+func TestSwiftClient(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		segmentSize int
+		segmented   bool
+	}{
+		{"single object", 1 << 20, false},
+		{"segmented", 100, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake, client, cleanup := newTestSwiftClient(t, tc.segmentSize)
+			defer cleanup()
+
+			ctx := context.Background()
+			chunk := dummyObjectChunk(model.Now())
+			require.NoError(t, client.PutChunk(ctx, "userID", &chunk))
+
+			expectedSegments := 0
+			if tc.segmented {
+				r, err := chunk.reader()
+				require.NoError(t, err)
+				buf, err := ioutil.ReadAll(r)
+				require.NoError(t, err)
+				expectedSegments = (len(buf) + tc.segmentSize - 1) / tc.segmentSize
+			}
+			segments := 0
+			for name := range fake.objects {
+				if strings.HasPrefix(name, "chunks_segments/") {
+					segments++
+				}
+			}
+			assert.Equal(t, expectedSegments, segments)
+
+			// Expire the token; the client should re-authenticate.
+			fake.token = "revoked"
+
+			fetched := Chunk{ID: chunk.ID, From: chunk.From, Through: chunk.Through}
+			require.NoError(t, client.GetChunk(ctx, "userID", &fetched))
+			assert.Equal(t, chunk.Metric, fetched.Metric)
+			assert.Equal(t, 2, fake.auths)
+		})
+	}
+}
+
+func TestSwiftAuthRequest(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	client, err := NewSwiftClient(SwiftConfig{
+		AuthURL:           server.URL,
+		Username:          "user",
+		UserDomainName:    "users",
+		Password:          "pass",
+		ProjectName:       "project",
+		ProjectDomainName: "projects",
+		ContainerName:     "chunks",
+		SegmentSize:       1,
+		Timeout:           time.Second,
+	})
+	require.NoError(t, err)
+	chunk := dummyObjectChunk(0)
+	require.Error(t, client.PutChunk(context.Background(), "userID", &chunk))
+
+	expected := map[string]interface{}{"auth": map[string]interface{}{
+		"identity": map[string]interface{}{
+			"methods": []interface{}{"password"},
+			"password": map[string]interface{}{"user": map[string]interface{}{
+				"name": "user", "password": "pass", "domain": map[string]interface{}{"name": "users"},
+			}},
+		},
+		"scope": map[string]interface{}{"project": map[string]interface{}{
+			"name": "project", "domain": map[string]interface{}{"name": "projects"},
+		}},
+	}}
+	assert.Equal(t, expected, body)
+}
@@ -2,15 +2,19 @@ package chunk
 
 import (
 	"flag"
+	"fmt"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
 
 	"github.com/weaveworks/common/instrument"
 	"github.com/weaveworks/common/mtime"
@@ -34,20 +38,70 @@ var (
 		Name:      "dynamo_table_capacity_units",
 		Help:      "Per-table DynamoDB capacity, measured in DynamoDB capacity units.",
 	}, []string{"op", "table"})
+	desiredReadCapacity = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cortex",
+		Name:      "table_manager_desired_read_capacity",
+		Help:      "Per-table read capacity the table manager wants provisioned, in DynamoDB capacity units.",
+	}, []string{"table"})
+	desiredWriteCapacity = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cortex",
+		Name:      "table_manager_desired_write_capacity",
+		Help:      "Per-table write capacity the table manager wants provisioned, in DynamoDB capacity units.",
+	}, []string{"table"})
+	stuckTableUpdates = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cortex",
+		Name:      "table_manager_stuck_updates",
+		Help:      "Number of tables which have not become ACTIVE within -dynamodb.update-timeout of an update.",
+	})
+	tableBackups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "table_manager_backups_total",
+		Help:      "Total number of on-demand backups of active tables requested.",
+	}, []string{"table"})
+	tableBackupFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "table_manager_backup_failures_total",
+		Help:      "Total number of failures to enable point-in-time recovery on, or back up, active tables.",
+	}, []string{"table"})
+	unownedTables = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cortex",
+		Name:      "table_manager_unowned_tables",
+		Help:      "Number of tables the table manager would manage, but were not created by Cortex, so are left alone.",
+	})
 )
 
 func init() {
+	prometheus.MustRegister(syncTableDuration)
 	prometheus.MustRegister(tableCapacity)
+	prometheus.MustRegister(desiredReadCapacity)
+	prometheus.MustRegister(desiredWriteCapacity)
+	prometheus.MustRegister(stuckTableUpdates)
+	prometheus.MustRegister(unownedTables)
+	prometheus.MustRegister(tableBackups)
+	prometheus.MustRegister(tableBackupFailures)
 }
 
+// Tables created by the DynamoTableManager are tagged with this, so tables
+// which just happen to match its names can be told apart.
+const (
+	ownershipTagKey   = "managed-by"
+	ownershipTagValue = "cortex"
+)
+
 // TableManagerConfig is the config for a DynamoTableManager
 type TableManagerConfig struct {
 	DynamoDB             util.URLValue
 	DynamoDBPollInterval time.Duration
+	UpdateTimeout        time.Duration
+	SyncConcurrency      int
+	APIRateLimit         float64
 
-	mockDynamoDB  StorageClient
+	mockDynamoDB  TableClient
 	mockTableName string
 
+	// Clock the tables are calculated against; nil for the wall clock.
+	Clock Clock
+
 	PeriodicTableConfig
 
 	// duration a table will be created before it is needed.
@@ -57,12 +111,82 @@ type TableManagerConfig struct {
 	ProvisionedReadThroughput  int64
 	InactiveWriteThroughput    int64
 	InactiveReadThroughput     int64
+
+	// Encryption at rest for newly created tables.
+	SSEEnabled  bool
+	SSEKMSKeyID string
+
+	// DynamoDB Streams on newly created tables.
+	StreamsEnabled bool
+	StreamViewType string
+
+	// Backups of active tables: point-in-time recovery, and/or an on-demand
+	// backup every BackupPeriod.
+	PITREnabled  bool
+	BackupPeriod time.Duration
+
+	// Only update tables carrying our ownership tag.
+	RequireOwnershipTag bool
+
+	// YAML file of planned throughput changes, see ThroughputSchedule.
+	ThroughputScheduleFile string
+
+	// Non-periodic tables to manage alongside the chunk index tables.
+	ExtraTables ExtraTablesValue
+
+	// YAML file of isolated tenants, whose periodic tables are also managed.
+	TenantIsolationFile string
+}
+
+// Clock tells the DynamoTableManager the time, so which tables should exist,
+// and at what throughput, can be checked at any point in simulated time.
+type Clock interface {
+	Now() time.Time
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time { return mtime.Now() }
+
+// ManualClock is a Clock which only moves when told to.
+type ManualClock struct {
+	mtx sync.Mutex
+	now time.Time
+}
+
+// NewManualClock makes a ManualClock, stopped at now.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+// Now implements Clock.
+func (c *ManualClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+// Set moves the clock to now.
+func (c *ManualClock) Set(now time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = now
+}
+
+// Add moves the clock on by d.
+func (c *ManualClock) Add(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = c.now.Add(d)
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
 func (cfg *TableManagerConfig) RegisterFlags(f *flag.FlagSet) {
 	f.Var(&cfg.DynamoDB, "dynamodb.url", "DynamoDB endpoint URL.")
 	f.DurationVar(&cfg.DynamoDBPollInterval, "dynamodb.poll-interval", 2*time.Minute, "How frequently to poll DynamoDB to learn our capacity.")
+	f.IntVar(&cfg.SyncConcurrency, "dynamodb.sync-concurrency", 10, "Number of tables to create or update concurrently.")
+	f.Float64Var(&cfg.APIRateLimit, "dynamodb.table-api-rate", 10, "Maximum table management API requests per second to DynamoDB (0 for unlimited).")
+	f.DurationVar(&cfg.UpdateTimeout, "dynamodb.update-timeout", 30*time.Minute, "How long a table may stay UPDATING after we change its throughput before it is reported as stuck.")
 	f.DurationVar(&cfg.CreationGracePeriod, "dynamodb.periodic-table.grace-period", 10*time.Minute, "DynamoDB periodic tables grace period (duration which table will be created/deleted before/after it's needed).")
 	f.DurationVar(&cfg.MaxChunkAge, "ingester.max-chunk-age", 12*time.Hour, "Maximum chunk age time before flushing.")
 	f.Int64Var(&cfg.ProvisionedWriteThroughput, "dynamodb.periodic-table.write-throughput", 3000, "DynamoDB periodic tables write throughput")
@@ -70,9 +194,65 @@ func (cfg *TableManagerConfig) RegisterFlags(f *flag.FlagSet) {
 	f.Int64Var(&cfg.InactiveWriteThroughput, "dynamodb.periodic-table.inactive-write-throughput", 1, "DynamoDB periodic tables write throughput for inactive tables.")
 	f.Int64Var(&cfg.InactiveReadThroughput, "dynamodb.periodic-table.inactive-read-throughput", 300, "DynamoDB periodic tables read throughput for inactive tables")
 
+	f.BoolVar(&cfg.SSEEnabled, "dynamodb.sse-enabled", false, "Enable encryption at rest on newly created DynamoDB tables.")
+	f.StringVar(&cfg.SSEKMSKeyID, "dynamodb.sse-kms-key-id", "", "KMS key ARN to encrypt newly created DynamoDB tables with; defaults to the AWS-managed key.")
+	f.BoolVar(&cfg.StreamsEnabled, "dynamodb.streams-enabled", false, "Enable DynamoDB Streams on newly created tables, for change capture.")
+	f.StringVar(&cfg.StreamViewType, "dynamodb.streams-view-type", dynamodb.StreamViewTypeKeysOnly, "What the stream records of each changed item: KEYS_ONLY, NEW_IMAGE, OLD_IMAGE or NEW_AND_OLD_IMAGES.")
+	f.BoolVar(&cfg.PITREnabled, "dynamodb.pitr-enabled", false, "Enable point-in-time recovery on active tables.")
+	f.DurationVar(&cfg.BackupPeriod, "dynamodb.backup-period", 0, "How often to take an on-demand backup of each active table (0 to not take backups).")
+	f.BoolVar(&cfg.RequireOwnershipTag, "dynamodb.require-ownership-tag", false, "Only update the throughput of tables tagged "+ownershipTagKey+"="+ownershipTagValue+", as every table is when created; tables created before tagging must be tagged by hand.")
+	f.Var(&cfg.ExtraTables, "dynamodb.extra-table", "Additional table to create and provision, as name[:read:write]; throughput defaults to the periodic table throughput. May be repeated.")
+	f.StringVar(&cfg.ThroughputScheduleFile, "dynamodb.throughput-schedule", "", "YAML file of scheduled per-table provisioned throughput changes.")
+	f.StringVar(&cfg.TenantIsolationFile, "store.tenant-isolation-config", "", "YAML file of tenants whose chunks and index are stored separately from everyone else's.")
+
 	cfg.PeriodicTableConfig.RegisterFlags(f)
 }
 
+// ExtraTable is a non-periodic table managed by the DynamoTableManager.
+type ExtraTable struct {
+	Name                       string
+	ProvisionedReadThroughput  int64
+	ProvisionedWriteThroughput int64
+}
+
+// ExtraTablesValue is a list of ExtraTables that can be used as a repeated
+// flag, each value being name[:read:write].
+type ExtraTablesValue []ExtraTable
+
+// String implements flag.Value
+func (v ExtraTablesValue) String() string {
+	tables := make([]string, 0, len(v))
+	for _, t := range v {
+		tables = append(tables, fmt.Sprintf("%s:%d:%d", t.Name, t.ProvisionedReadThroughput, t.ProvisionedWriteThroughput))
+	}
+	return strings.Join(tables, ",")
+}
+
+// Set implements flag.Value
+func (v *ExtraTablesValue) Set(s string) error {
+	parts := strings.Split(s, ":")
+	if parts[0] == "" || (len(parts) != 1 && len(parts) != 3) {
+		return fmt.Errorf("invalid extra table %q, expected name[:read:write]", s)
+	}
+	table := ExtraTable{Name: parts[0]}
+	if len(parts) == 3 {
+		var err error
+		if table.ProvisionedReadThroughput, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+			return fmt.Errorf("invalid read throughput for extra table %q: %v", s, err)
+		}
+		if table.ProvisionedWriteThroughput, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+			return fmt.Errorf("invalid write throughput for extra table %q: %v", s, err)
+		}
+	}
+	for _, t := range *v {
+		if t.Name == table.Name {
+			return fmt.Errorf("duplicate extra table %q", table.Name)
+		}
+	}
+	*v = append(*v, table)
+	return nil
+}
+
 // PeriodicTableConfig for the use of periodic tables (ie, weekly talbes).  Can
 // control when to start the periodic tables, how long the period should be,
 // and the prefix to give the tables.
@@ -81,6 +261,10 @@ type PeriodicTableConfig struct {
 	TablePrefix          string
 	TablePeriod          time.Duration
 	PeriodicTableStartAt util.DayValue
+
+	// Chunks stored in DynamoDB go in periodic tables of their own, named
+	// with this prefix.
+	ChunkTablePrefix string
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
@@ -89,15 +273,38 @@ func (cfg *PeriodicTableConfig) RegisterFlags(f *flag.FlagSet) {
 	f.StringVar(&cfg.TablePrefix, "dynamodb.periodic-table.prefix", "cortex_", "DynamoDB table prefix for the periodic tables.")
 	f.DurationVar(&cfg.TablePeriod, "dynamodb.periodic-table.period", 7*24*time.Hour, "DynamoDB periodic tables period.")
 	f.Var(&cfg.PeriodicTableStartAt, "dynamodb.periodic-table.start", "DynamoDB periodic tables start time.")
+	f.StringVar(&cfg.ChunkTablePrefix, "dynamodb.chunk-table.prefix", "", "DynamoDB table prefix for the periodic tables of chunks, with -store.object-store=dynamodb; the table manager creates them if set.")
 }
 
 // DynamoTableManager creates and manages the provisioned throughput on DynamoDB tables
 type DynamoTableManager struct {
-	dynamoDB  StorageClient
+	dynamoDB  TableClient
 	tableName string
 	cfg       TableManagerConfig
+	schedule  ThroughputSchedule
+	isolation TenantIsolation
+	limiter   *rate.Limiter
 	done      chan struct{}
 	wait      sync.WaitGroup
+
+	// Tables we have issued an UpdateTable for, and when, which we don't
+	// touch again until they are ACTIVE.
+	updatingMtx sync.Mutex
+	updating    map[string]time.Time
+
+	// Tables we've seen our ownership tag on; unowned ones are checked
+	// every time, in case they've been tagged since.
+	ownedMtx sync.Mutex
+	owned    map[string]bool
+
+	// When we last synced the tables, and how it went, for Status.
+	syncedMtx sync.Mutex
+	synced    time.Time
+	syncErr   error
+
+	// The tables expected at the last sync, whose gauges are deleted once
+	// they aren't.  Only used by syncTables.
+	metricTables map[string]struct{}
 }
 
 // NewDynamoTableManager makes a new DynamoTableManager
@@ -111,11 +318,54 @@ func NewDynamoTableManager(cfg TableManagerConfig) (*DynamoTableManager, error)
 		}
 	}
 
+	var schedule ThroughputSchedule
+	if cfg.ThroughputScheduleFile != "" {
+		var err error
+		schedule, err = LoadThroughputSchedule(cfg.ThroughputScheduleFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var isolation TenantIsolation
+	if cfg.TenantIsolationFile != "" {
+		var err error
+		isolation, err = LoadTenantIsolation(cfg.TenantIsolationFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := isolation.validate(cfg.TablePrefix); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Clock == nil {
+		cfg.Clock = wallClock{}
+	}
+
+	if cfg.StreamsEnabled {
+		switch cfg.StreamViewType {
+		case dynamodb.StreamViewTypeKeysOnly, dynamodb.StreamViewTypeNewImage, dynamodb.StreamViewTypeOldImage, dynamodb.StreamViewTypeNewAndOldImages:
+		default:
+			return nil, fmt.Errorf("invalid DynamoDB Streams view type %q", cfg.StreamViewType)
+		}
+	}
+
+	limit := rate.Inf
+	if cfg.APIRateLimit > 0 {
+		limit = rate.Limit(cfg.APIRateLimit)
+	}
+
 	m := &DynamoTableManager{
 		cfg:       cfg,
 		dynamoDB:  dynamoDBClient,
 		tableName: tableName,
+		schedule:  schedule,
+		isolation: isolation,
+		limiter:   rate.NewLimiter(limit, 1),
 		done:      make(chan struct{}),
+		updating:  map[string]time.Time{},
+		owned:     map[string]bool{},
 	}
 	return m, nil
 }
@@ -138,29 +388,80 @@ func (m *DynamoTableManager) loop() {
 	ticker := time.NewTicker(m.cfg.DynamoDBPollInterval)
 	defer ticker.Stop()
 
-	if err := instrument.TimeRequestHistogram(context.Background(), "DynamoTableManager.syncTables", syncTableDuration, func(ctx context.Context) error {
-		return m.syncTables(ctx)
-	}); err != nil {
-		log.Errorf("Error syncing tables: %v", err)
-	}
-
+	m.sync()
 	for {
 		select {
 		case <-ticker.C:
-			if err := instrument.TimeRequestHistogram(context.Background(), "DynamoTableManager.syncTables", syncTableDuration, func(ctx context.Context) error {
-				return m.syncTables(ctx)
-			}); err != nil {
-				log.Errorf("Error syncing tables: %v", err)
-			}
+			m.sync()
 		case <-m.done:
 			return
 		}
 	}
 }
 
+func (m *DynamoTableManager) sync() {
+	err := instrument.TimeRequestHistogram(context.Background(), "DynamoTableManager.syncTables", syncTableDuration, func(ctx context.Context) error {
+		return m.syncTables(ctx)
+	})
+	if err != nil {
+		log.Errorf("Error syncing tables: %v", err)
+	}
+	m.syncedMtx.Lock()
+	m.synced, m.syncErr = m.cfg.Clock.Now(), err
+	m.syncedMtx.Unlock()
+}
+
+// TableStatus is a table the table manager expects there to be.
+type TableStatus struct {
+	Name             string
+	ProvisionedRead  int64
+	ProvisionedWrite int64
+	// Being written to, so backed up.
+	Active bool
+	// When we issued an UpdateTable for it which hasn't finished, if we have.
+	UpdatingSince time.Time
+}
+
+// Status returns the tables m expects there to be now, and when it last
+// synced them with DynamoDB, with the error if that failed.
+func (m *DynamoTableManager) Status() ([]TableStatus, time.Time, error) {
+	expected := m.calculateExpectedTables()
+	tables := make([]TableStatus, 0, len(expected))
+	m.updatingMtx.Lock()
+	for _, desc := range expected {
+		tables = append(tables, TableStatus{
+			Name:             desc.name,
+			ProvisionedRead:  desc.provisionedRead,
+			ProvisionedWrite: desc.provisionedWrite,
+			Active:           desc.active,
+			UpdatingSince:    m.updating[desc.name],
+		})
+	}
+	m.updatingMtx.Unlock()
+
+	m.syncedMtx.Lock()
+	defer m.syncedMtx.Unlock()
+	return tables, m.synced, m.syncErr
+}
+
 func (m *DynamoTableManager) syncTables(ctx context.Context) error {
 	expected := m.calculateExpectedTables()
 	log.Infof("Expecting %d tables", len(expected))
+	tables := make(map[string]struct{}, len(expected))
+	for _, desc := range expected {
+		tables[desc.name] = struct{}{}
+		desiredReadCapacity.WithLabelValues(desc.name).Set(float64(desc.provisionedRead))
+		desiredWriteCapacity.WithLabelValues(desc.name).Set(float64(desc.provisionedWrite))
+	}
+	for name := range m.metricTables {
+		if _, ok := tables[name]; !ok {
+			desiredReadCapacity.DeleteLabelValues(name)
+			desiredWriteCapacity.DeleteLabelValues(name)
+			tableCapacity.DeleteLabelValues(readLabel, name)
+			tableCapacity.DeleteLabelValues(writeLabel, name)
+		}
+	}
+	m.metricTables = tables
 
 	toCreate, toCheckThroughput, err := m.partitionTables(ctx, expected)
 	if err != nil {
@@ -171,13 +472,19 @@ func (m *DynamoTableManager) syncTables(ctx context.Context) error {
 		return err
 	}
 
-	return m.updateTables(ctx, toCheckThroughput)
+	err = m.updateTables(ctx, toCheckThroughput)
+	// Backups are a pass of their own, so failing to back a table up
+	// doesn't hold up its throughput, nor fail the sync.
+	m.backupTables(ctx, toCheckThroughput)
+	return err
 }
 
 type tableDescription struct {
 	name             string
 	provisionedRead  int64
 	provisionedWrite int64
+	// Being written to, so is backed up.
+	active bool
 }
 
 type byName []tableDescription
@@ -187,47 +494,88 @@ func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a byName) Less(i, j int) bool { return a[i].name < a[j].name }
 
 func (m *DynamoTableManager) calculateExpectedTables() []tableDescription {
+	result := m.calculateDefaultTables()
+	for _, prefix := range m.isolation.tablePrefixes() {
+		result = append(result, m.periodicTables(prefix)...)
+	}
+	if m.cfg.ChunkTablePrefix != "" {
+		result = append(result, m.periodicTables(m.cfg.ChunkTablePrefix)...)
+	}
+	for _, extra := range m.cfg.ExtraTables {
+		table := tableDescription{
+			name:             extra.Name,
+			provisionedRead:  extra.ProvisionedReadThroughput,
+			provisionedWrite: extra.ProvisionedWriteThroughput,
+			active:           true,
+		}
+		if table.provisionedRead == 0 && table.provisionedWrite == 0 {
+			table.provisionedRead = m.cfg.ProvisionedReadThroughput
+			table.provisionedWrite = m.cfg.ProvisionedWriteThroughput
+		}
+		result = append(result, table)
+	}
+	sort.Sort(byName(result))
+	m.schedule.apply(result, m.cfg.Clock.Now())
+	return result
+}
+
+func (m *DynamoTableManager) calculateDefaultTables() []tableDescription {
 	if !m.cfg.UsePeriodicTables {
 		return []tableDescription{
 			{
 				name:             m.tableName,
 				provisionedRead:  m.cfg.ProvisionedReadThroughput,
 				provisionedWrite: m.cfg.ProvisionedWriteThroughput,
+				active:           true,
 			},
 		}
 	}
 
-	result := []tableDescription{}
-
 	var (
 		tablePeriodSecs = int64(m.cfg.TablePeriod / time.Second)
 		gracePeriodSecs = int64(m.cfg.CreationGracePeriod / time.Second)
 		maxChunkAgeSecs = int64(m.cfg.MaxChunkAge / time.Second)
 		firstTable      = m.cfg.PeriodicTableStartAt.Unix() / tablePeriodSecs
-		lastTable       = (mtime.Now().Unix() + gracePeriodSecs) / tablePeriodSecs
-		now             = mtime.Now().Unix()
+		now             = m.cfg.Clock.Now().Unix()
 	)
 
 	// Add the legacy table
-	{
-		legacyTable := tableDescription{
-			name:             m.tableName,
-			provisionedRead:  m.cfg.InactiveReadThroughput,
-			provisionedWrite: m.cfg.InactiveWriteThroughput,
-		}
+	legacyTable := tableDescription{
+		name:             m.tableName,
+		provisionedRead:  m.cfg.InactiveReadThroughput,
+		provisionedWrite: m.cfg.InactiveWriteThroughput,
+	}
 
-		// if we are before the switch to periodic table, we need to give this table write throughput
-		if now < (firstTable*tablePeriodSecs)+gracePeriodSecs+maxChunkAgeSecs {
-			legacyTable.provisionedRead = m.cfg.ProvisionedReadThroughput
-			legacyTable.provisionedWrite = m.cfg.ProvisionedWriteThroughput
-		}
-		result = append(result, legacyTable)
+	// if we are before the switch to periodic table, we need to give this table write throughput
+	if now < (firstTable*tablePeriodSecs)+gracePeriodSecs+maxChunkAgeSecs {
+		legacyTable.provisionedRead = m.cfg.ProvisionedReadThroughput
+		legacyTable.provisionedWrite = m.cfg.ProvisionedWriteThroughput
+		legacyTable.active = true
 	}
 
+	result := append([]tableDescription{legacyTable}, m.periodicTables(m.cfg.TablePrefix)...)
+	sort.Sort(byName(result))
+	return result
+}
+
+// periodicTables returns the periodic tables with the given prefix that
+// should exist now.
+func (m *DynamoTableManager) periodicTables(prefix string) []tableDescription {
+	var (
+		tablePeriodSecs = int64(m.cfg.TablePeriod / time.Second)
+		gracePeriodSecs = int64(m.cfg.CreationGracePeriod / time.Second)
+		maxChunkAgeSecs = int64(m.cfg.MaxChunkAge / time.Second)
+		firstTable      = m.cfg.PeriodicTableStartAt.Unix() / tablePeriodSecs
+		now             = m.cfg.Clock.Now().Unix()
+		lastTable       = (now + gracePeriodSecs) / tablePeriodSecs
+		result          = []tableDescription{}
+	)
+
 	for i := firstTable; i <= lastTable; i++ {
 		table := tableDescription{
-			// Name construction needs to be consistent with chunk_store.bigBuckets
-			name:             m.cfg.TablePrefix + strconv.Itoa(int(i)),
+			// Name construction needs to be consistent with SchemaConfig.tableForBucket
+			// and dynamoDBChunkClient.tableFor
+			name:             prefix + strconv.Itoa(int(i)),
 			provisionedRead:  m.cfg.InactiveReadThroughput,
 			provisionedWrite: m.cfg.InactiveWriteThroughput,
 		}
@@ -236,18 +584,20 @@ func (m *DynamoTableManager) calculateExpectedTables() []tableDescription {
 		if (i*tablePeriodSecs)-gracePeriodSecs <= now && now < (i*tablePeriodSecs)+tablePeriodSecs+gracePeriodSecs+maxChunkAgeSecs {
 			table.provisionedRead = m.cfg.ProvisionedReadThroughput
 			table.provisionedWrite = m.cfg.ProvisionedWriteThroughput
+			table.active = true
 		}
 		result = append(result, table)
 	}
-
-	sort.Sort(byName(result))
 	return result
 }
 
 // partitionTables works out tables that need to be created vs tables that need to be updated
 func (m *DynamoTableManager) partitionTables(ctx context.Context, descriptions []tableDescription) ([]tableDescription, []tableDescription, error) {
+	if err := m.limiter.Wait(ctx); err != nil {
+		return nil, nil, err
+	}
 	var existingTables []string
-	if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.ListTablesPages", dynamoRequestDuration, func(_ context.Context) error {
+	if err := timeDynamoRequest(ctx, "DynamoDB.ListTablesPages", func(_ context.Context) error {
 		var err error
 		existingTables, err = m.dynamoDB.ListTables()
 		return err
@@ -280,50 +630,261 @@ func (m *DynamoTableManager) partitionTables(ctx context.Context, descriptions [
 	return toCreate, toCheckThroughput, nil
 }
 
-func (m *DynamoTableManager) createTables(ctx context.Context, descriptions []tableDescription) error {
+// forEachTable calls f for each table, SyncConcurrency at a time, and
+// returns all the errors.
+func (m *DynamoTableManager) forEachTable(ctx context.Context, descriptions []tableDescription, f func(context.Context, tableDescription) error) error {
+	concurrency := m.cfg.SyncConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	var (
+		errs util.MultiError
+		wg   sync.WaitGroup
+		work = make(chan tableDescription)
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for desc := range work {
+				errs.Add(f(ctx, desc))
+			}
+		}()
+	}
 	for _, desc := range descriptions {
-		log.Infof("Creating table %s", desc.name)
-		if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.CreateTable", dynamoRequestDuration, func(_ context.Context) error {
-			return m.dynamoDB.CreateTable(desc.name, desc.provisionedRead, desc.provisionedWrite)
-		}); err != nil {
+		work <- desc
+	}
+	close(work)
+	wg.Wait()
+	return errs.Err()
+}
+
+func (m *DynamoTableManager) createTables(ctx context.Context, descriptions []tableDescription) error {
+	return m.forEachTable(ctx, descriptions, m.createTable)
+}
+
+func (m *DynamoTableManager) createTable(ctx context.Context, desc tableDescription) error {
+	if err := m.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	log.Infof("Creating table %s", desc.name)
+	return timeDynamoRequest(ctx, "DynamoDB.CreateTable", func(_ context.Context) error {
+		return m.dynamoDB.CreateTable(desc.name, desc.provisionedRead, desc.provisionedWrite, TableOptions{
+			SSEEnabled:     m.cfg.SSEEnabled,
+			SSEKMSKeyID:    m.cfg.SSEKMSKeyID,
+			StreamViewType: m.streamViewType(),
+			Tags:           map[string]string{ownershipTagKey: ownershipTagValue},
+		})
+	})
+}
+
+func (m *DynamoTableManager) streamViewType() string {
+	if !m.cfg.StreamsEnabled {
+		return ""
+	}
+	return m.cfg.StreamViewType
+}
+
+func (m *DynamoTableManager) updateTables(ctx context.Context, descriptions []tableDescription) error {
+	var stuck, unowned int32
+	defer func() {
+		stuckTableUpdates.Set(float64(atomic.LoadInt32(&stuck)))
+		unownedTables.Set(float64(atomic.LoadInt32(&unowned)))
+	}()
+
+	return m.forEachTable(ctx, descriptions, func(ctx context.Context, desc tableDescription) error {
+		owned, err := m.ownsTable(ctx, desc.name)
+		if err != nil {
 			return err
 		}
+		if !owned {
+			log.Warnf("Not updating table %s: it is not tagged %s=%s, so was not created by Cortex", desc.name, ownershipTagKey, ownershipTagValue)
+			atomic.AddInt32(&unowned, 1)
+			return nil
+		}
+
+		isStuck, err := m.updateTable(ctx, desc)
+		if isStuck {
+			atomic.AddInt32(&stuck, 1)
+		}
+		return err
+	})
+}
+
+// ownsTable reports whether we created the named table, and so may change
+// it.  Every table is considered ours unless RequireOwnershipTag is set.
+func (m *DynamoTableManager) ownsTable(ctx context.Context, name string) (bool, error) {
+	if !m.cfg.RequireOwnershipTag {
+		return true, nil
 	}
-	return nil
+
+	m.ownedMtx.Lock()
+	owned := m.owned[name]
+	m.ownedMtx.Unlock()
+	if owned {
+		return true, nil
+	}
+
+	if err := m.limiter.Wait(ctx); err != nil {
+		return false, err
+	}
+	var tags map[string]string
+	if err := timeDynamoRequest(ctx, "DynamoDB.ListTagsOfResource", func(_ context.Context) error {
+		var err error
+		tags, err = m.dynamoDB.TableTags(name)
+		return err
+	}); err != nil {
+		return false, err
+	}
+	if tags[ownershipTagKey] != ownershipTagValue {
+		return false, nil
+	}
+
+	m.ownedMtx.Lock()
+	m.owned[name] = true
+	m.ownedMtx.Unlock()
+	return true, nil
 }
 
-func (m *DynamoTableManager) updateTables(ctx context.Context, descriptions []tableDescription) error {
-	for _, desc := range descriptions {
-		log.Infof("Checking provisioned throughput on table %s", desc.name)
-		var readCapacity, writeCapacity int64
-		var status string
-		if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.DescribeTable", dynamoRequestDuration, func(_ context.Context) error {
+// backupTables makes sure the active tables we own are backed up, logging
+// failures rather than returning them: they're retried on the next sync.
+func (m *DynamoTableManager) backupTables(ctx context.Context, descriptions []tableDescription) {
+	if !m.cfg.PITREnabled && m.cfg.BackupPeriod <= 0 {
+		return
+	}
+	m.forEachTable(ctx, descriptions, func(ctx context.Context, desc tableDescription) error {
+		if !desc.active {
+			return nil
+		}
+		owned, err := m.ownsTable(ctx, desc.name)
+		if err == nil && owned {
+			err = m.updateBackups(ctx, desc)
+		}
+		if err != nil {
+			log.Errorf("Error backing up table %s: %v", desc.name, err)
+			tableBackupFailures.WithLabelValues(desc.name).Inc()
+		}
+		return nil
+	})
+}
+
+// updateBackups makes sure an active table has point-in-time recovery
+// enabled, and a recent enough on-demand backup, as configured.
+func (m *DynamoTableManager) updateBackups(ctx context.Context, desc tableDescription) error {
+	if !desc.active {
+		return nil
+	}
+
+	if m.cfg.PITREnabled {
+		if err := m.limiter.Wait(ctx); err != nil {
+			return err
+		}
+		var enabled bool
+		if err := timeDynamoRequest(ctx, "DynamoDB.DescribeContinuousBackups", func(_ context.Context) error {
 			var err error
-			readCapacity, writeCapacity, status, err = m.dynamoDB.DescribeTable(desc.name)
+			enabled, err = m.dynamoDB.PointInTimeRecoveryEnabled(desc.name)
 			return err
 		}); err != nil {
 			return err
 		}
-
-		if status != dynamodb.TableStatusActive {
-			log.Infof("Skipping update on  table %s, not yet ACTIVE (%s)", desc.name, status)
-			continue
+		if !enabled {
+			if err := m.limiter.Wait(ctx); err != nil {
+				return err
+			}
+			log.Infof("  Enabling point-in-time recovery on table %s", desc.name)
+			if err := timeDynamoRequest(ctx, "DynamoDB.UpdateContinuousBackups", func(_ context.Context) error {
+				return m.dynamoDB.EnablePointInTimeRecovery(desc.name)
+			}); err != nil {
+				return err
+			}
 		}
+	}
 
-		tableCapacity.WithLabelValues(readLabel, desc.name).Set(float64(readCapacity))
-		tableCapacity.WithLabelValues(writeLabel, desc.name).Set(float64(writeCapacity))
-
-		if readCapacity == desc.provisionedRead && writeCapacity == desc.provisionedWrite {
-			log.Infof("  Provisioned throughput: read = %d, write = %d, skipping.", readCapacity, writeCapacity)
-			continue
+	if m.cfg.BackupPeriod > 0 {
+		if err := m.limiter.Wait(ctx); err != nil {
+			return err
 		}
-
-		log.Infof("  Updating provisioned throughput on table %s to read = %d, write = %d", desc.name, desc.provisionedRead, desc.provisionedWrite)
-		if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.DescribeTable", dynamoRequestDuration, func(_ context.Context) error {
-			return m.dynamoDB.UpdateTable(desc.name, desc.provisionedRead, desc.provisionedWrite)
+		now := m.cfg.Clock.Now()
+		var recent bool
+		if err := timeDynamoRequest(ctx, "DynamoDB.ListBackups", func(_ context.Context) error {
+			var err error
+			recent, err = m.dynamoDB.HasBackupSince(desc.name, now.Add(-m.cfg.BackupPeriod))
+			return err
 		}); err != nil {
 			return err
 		}
+		if !recent {
+			if err := m.limiter.Wait(ctx); err != nil {
+				return err
+			}
+			backupName := fmt.Sprintf("%s-%d", desc.name, now.Unix())
+			log.Infof("  Backing up table %s to %s", desc.name, backupName)
+			if err := timeDynamoRequest(ctx, "DynamoDB.CreateBackup", func(_ context.Context) error {
+				return m.dynamoDB.CreateBackup(desc.name, backupName)
+			}); err != nil {
+				return err
+			}
+			tableBackups.WithLabelValues(desc.name).Inc()
+		}
 	}
 	return nil
 }
+
+// updateTable makes desc's provisioned throughput match, and reports whether
+// a previous update has been in progress for longer than UpdateTimeout.
+func (m *DynamoTableManager) updateTable(ctx context.Context, desc tableDescription) (bool, error) {
+	if err := m.limiter.Wait(ctx); err != nil {
+		return false, err
+	}
+	log.Infof("Checking provisioned throughput on table %s", desc.name)
+	var readCapacity, writeCapacity int64
+	var status string
+	if err := timeDynamoRequest(ctx, "DynamoDB.DescribeTable", func(_ context.Context) error {
+		var err error
+		readCapacity, writeCapacity, status, err = m.dynamoDB.DescribeTable(desc.name)
+		return err
+	}); err != nil {
+		return false, err
+	}
+
+	m.updatingMtx.Lock()
+	started, updating := m.updating[desc.name]
+	if status == dynamodb.TableStatusActive {
+		delete(m.updating, desc.name)
+	}
+	m.updatingMtx.Unlock()
+
+	if status != dynamodb.TableStatusActive {
+		elapsed := m.cfg.Clock.Now().Sub(started)
+		stuck := updating && elapsed > m.cfg.UpdateTimeout
+		if stuck {
+			log.Errorf("Table %s still %s %s after updating its throughput", desc.name, status, elapsed)
+		}
+		log.Infof("Skipping update on  table %s, not yet ACTIVE (%s)", desc.name, status)
+		return stuck, nil
+	}
+
+	tableCapacity.WithLabelValues(readLabel, desc.name).Set(float64(readCapacity))
+	tableCapacity.WithLabelValues(writeLabel, desc.name).Set(float64(writeCapacity))
+
+	if readCapacity == desc.provisionedRead && writeCapacity == desc.provisionedWrite {
+		log.Infof("  Provisioned throughput: read = %d, write = %d, skipping.", readCapacity, writeCapacity)
+		return false, nil
+	}
+
+	if err := m.limiter.Wait(ctx); err != nil {
+		return false, err
+	}
+	log.Infof("  Updating provisioned throughput on table %s to read = %d, write = %d", desc.name, desc.provisionedRead, desc.provisionedWrite)
+	if err := timeDynamoRequest(ctx, "DynamoDB.DescribeTable", func(_ context.Context) error {
+		return m.dynamoDB.UpdateTable(desc.name, desc.provisionedRead, desc.provisionedWrite)
+	}); err != nil {
+		return false, err
+	}
+
+	m.updatingMtx.Lock()
+	m.updating[desc.name] = m.cfg.Clock.Now()
+	m.updatingMtx.Unlock()
+	return false, nil
+}
@@ -0,0 +1,171 @@
+package chunk
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// tableManagerScenario runs a DynamoTableManager through simulated time,
+// syncing its tables every tick as it would in production, and checking
+// which tables exist, at what throughput, at each check.
+type tableManagerScenario struct {
+	cfg TableManagerConfig
+	// YAML throughput schedule, see ThroughputSchedule.
+	schedule string
+	tick     time.Duration
+	checks   []scenarioCheck
+}
+
+// scenarioCheck is the tables expected at some time after the epoch.
+type scenarioCheck struct {
+	at       time.Duration
+	expected []tableDescription
+}
+
+func (s tableManagerScenario) run(t *testing.T) {
+	dynamoDB := NewMockStorage()
+	clock := NewManualClock(time.Unix(0, 0))
+	cfg := s.cfg
+	cfg.mockDynamoDB = dynamoDB
+	cfg.Clock = clock
+
+	if s.schedule != "" {
+		f, err := ioutil.TempFile("", "schedule")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(s.schedule)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		cfg.ThroughputScheduleFile = f.Name()
+	}
+
+	tableManager, err := NewDynamoTableManager(cfg)
+	require.NoError(t, err)
+
+	for _, check := range s.checks {
+		at := time.Unix(0, 0).Add(check.at)
+		for clock.Now().Add(s.tick).Before(at) {
+			clock.Add(s.tick)
+			require.NoError(t, tableManager.syncTables(context.Background()))
+		}
+		clock.Set(at)
+		ok := t.Run(check.at.String(), func(t *testing.T) {
+			require.NoError(t, tableManager.syncTables(context.Background()))
+			expectTables(t, dynamoDB, check.expected)
+		})
+		if !ok {
+			return
+		}
+	}
+}
+
+func scenarioConfig(startAt time.Duration) TableManagerConfig {
+	return TableManagerConfig{
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables: true,
+			TablePrefix:       tablePrefix,
+			TablePeriod:       tablePeriod,
+			PeriodicTableStartAt: util.DayValue{
+				Time: model.TimeFromUnix(int64(startAt / time.Second)),
+			},
+		},
+
+		CreationGracePeriod:        gracePeriod,
+		MaxChunkAge:                maxChunkAge,
+		ProvisionedWriteThroughput: write,
+		ProvisionedReadThroughput:  read,
+		InactiveWriteThroughput:    inactiveWrite,
+		InactiveReadThroughput:     inactiveRead,
+	}
+}
+
+func TestTableManagerScenarioMigrateToPeriodicTables(t *testing.T) {
+	var (
+		week   = tablePeriod
+		active = func(name string) tableDescription {
+			return tableDescription{name: name, provisionedRead: read, provisionedWrite: write}
+		}
+		inactive = func(name string) tableDescription {
+			return tableDescription{name: name, provisionedRead: inactiveRead, provisionedWrite: inactiveWrite}
+		}
+	)
+
+	tableManagerScenario{
+		cfg:  scenarioConfig(2 * week),
+		tick: time.Hour,
+		checks: []scenarioCheck{
+			// Before the switch, there's only the legacy table.
+			{0, []tableDescription{active("")}},
+			{2*week - gracePeriod - time.Second, []tableDescription{active("")}},
+			// The first periodic table is created a grace period early.
+			{2*week - gracePeriod, []tableDescription{active(""), active(tablePrefix + "2")}},
+			// The legacy table keeps its throughput until its last chunks are flushed.
+			{2*week + gracePeriod + maxChunkAge - time.Second, []tableDescription{active(""), active(tablePrefix + "2")}},
+			{2*week + gracePeriod + maxChunkAge, []tableDescription{inactive(""), active(tablePrefix + "2")}},
+			// Then a table a week, each going inactive once its last chunks are flushed.
+			{3*week - gracePeriod, []tableDescription{inactive(""), active(tablePrefix + "2"), active(tablePrefix + "3")}},
+			{3*week + gracePeriod + maxChunkAge, []tableDescription{inactive(""), inactive(tablePrefix + "2"), active(tablePrefix + "3")}},
+			{5 * week, []tableDescription{
+				inactive(""),
+				inactive(tablePrefix + "2"),
+				inactive(tablePrefix + "3"),
+				active(tablePrefix + "4"),
+				active(tablePrefix + "5"),
+			}},
+		},
+	}.run(t)
+}
+
+func TestTableManagerScenarioThroughputSchedule(t *testing.T) {
+	const scaledWrite = 5000
+	week := tablePeriod
+
+	tableManagerScenario{
+		cfg: scenarioConfig(0),
+		schedule: `
+schedule:
+- from: 1970-01-15
+  until: 1970-01-22
+  write_throughput: 5000
+`,
+		tick: 6 * time.Hour,
+		checks: []scenarioCheck{
+			{2*week - time.Second, []tableDescription{
+				{name: "", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+				{name: tablePrefix + "0", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+				{name: tablePrefix + "1", provisionedRead: read, provisionedWrite: write},
+				{name: tablePrefix + "2", provisionedRead: read, provisionedWrite: write},
+			}},
+			// The schedule applies to every table while it's in force...
+			{2 * week, []tableDescription{
+				{name: "", provisionedRead: inactiveRead, provisionedWrite: scaledWrite},
+				{name: tablePrefix + "0", provisionedRead: inactiveRead, provisionedWrite: scaledWrite},
+				{name: tablePrefix + "1", provisionedRead: read, provisionedWrite: scaledWrite},
+				{name: tablePrefix + "2", provisionedRead: read, provisionedWrite: scaledWrite},
+			}},
+			{3*week - gracePeriod, []tableDescription{
+				{name: "", provisionedRead: inactiveRead, provisionedWrite: scaledWrite},
+				{name: tablePrefix + "0", provisionedRead: inactiveRead, provisionedWrite: scaledWrite},
+				{name: tablePrefix + "1", provisionedRead: inactiveRead, provisionedWrite: scaledWrite},
+				{name: tablePrefix + "2", provisionedRead: read, provisionedWrite: scaledWrite},
+				{name: tablePrefix + "3", provisionedRead: read, provisionedWrite: scaledWrite},
+			}},
+			// ...and they go back to normal after.
+			{3 * week, []tableDescription{
+				{name: "", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+				{name: tablePrefix + "0", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+				{name: tablePrefix + "1", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+				{name: tablePrefix + "2", provisionedRead: read, provisionedWrite: write},
+				{name: tablePrefix + "3", provisionedRead: read, provisionedWrite: write},
+			}},
+		},
+	}.run(t)
+}
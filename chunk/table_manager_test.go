@@ -1,10 +1,16 @@
 package chunk
 
 import (
+	"fmt"
 	"sort"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/model"
 	"github.com/weaveworks/common/mtime"
 	"golang.org/x/net/context"
@@ -145,7 +151,7 @@ func TestDynamoTableManager(t *testing.T) {
 	)
 }
 
-func expectTables(t *testing.T, dynamo StorageClient, expected []tableDescription) {
+func expectTables(t *testing.T, dynamo TableClient, expected []tableDescription) {
 	tables, err := dynamo.ListTables()
 	if err != nil {
 		t.Fatal(err)
@@ -175,5 +181,528 @@ func expectTables(t *testing.T, dynamo StorageClient, expected []tableDescriptio
 		if write != desc.provisionedWrite {
 			t.Fatalf("Expected '%d', found '%d' for table '%s'", desc.provisionedWrite, write, desc.name)
 		}
+
+		if desired := gaugeValue(t, desiredReadCapacity.WithLabelValues(desc.name)); desired != float64(desc.provisionedRead) {
+			t.Fatalf("Expected desired read capacity '%d', found '%v' for table '%s'", desc.provisionedRead, desired, desc.name)
+		}
+
+		if desired := gaugeValue(t, desiredWriteCapacity.WithLabelValues(desc.name)); desired != float64(desc.provisionedWrite) {
+			t.Fatalf("Expected desired write capacity '%d', found '%v' for table '%s'", desc.provisionedWrite, desired, desc.name)
+		}
+	}
+}
+
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	var m dto.Metric
+	if err := g.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func TestDynamoTableManagerMetricsRegistered(t *testing.T) {
+	for _, c := range []prometheus.Collector{syncTableDuration, tableCapacity, desiredReadCapacity, desiredWriteCapacity} {
+		if _, ok := prometheus.Register(c).(prometheus.AlreadyRegisteredError); !ok {
+			t.Errorf("Expected %v to be registered", c)
+		}
+	}
+}
+
+func TestDynamoTableManagerDeletesMetrics(t *testing.T) {
+	tableManager, err := NewDynamoTableManager(TableManagerConfig{
+		mockDynamoDB: NewMockStorage(),
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables: true,
+			TablePrefix:       "metrics_old_",
+			TablePeriod:       tablePeriod,
+			PeriodicTableStartAt: util.DayValue{
+				Time: model.TimeFromUnix(0),
+			},
+		},
+		ProvisionedWriteThroughput: write,
+		ProvisionedReadThroughput:  read,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second sync checks the tables the first created.
+	for i := 0; i < 2; i++ {
+		if err := tableManager.syncTables(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []prometheus.Collector{tableCapacity, desiredReadCapacity, desiredWriteCapacity} {
+		if tables := gaugeTables(t, c, "metrics_old_"); tables == 0 {
+			t.Fatal("Expected gauges for the tables")
+		}
+	}
+
+	// Once the tables are no longer expected, their gauges go.
+	tableManager.cfg.TablePrefix = "metrics_new_"
+	if err := tableManager.syncTables(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []prometheus.Collector{tableCapacity, desiredReadCapacity, desiredWriteCapacity} {
+		if tables := gaugeTables(t, c, "metrics_old_"); tables != 0 {
+			t.Errorf("Expected no gauges for tables no longer expected, found %d", tables)
+		}
+	}
+	if tables := gaugeTables(t, desiredReadCapacity, "metrics_new_"); tables == 0 {
+		t.Fatal("Expected desired read capacity for the new tables")
+	}
+}
+
+// gaugeTables counts c's metrics for tables with the prefix.
+func gaugeTables(t *testing.T, c prometheus.Collector, prefix string) int {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	tables := 0
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range m.Label {
+			if l.GetName() == "table" && strings.HasPrefix(l.GetValue(), prefix) {
+				tables++
+			}
+		}
+	}
+	return tables
+}
+
+// updatingStorage leaves tables UPDATING after an UpdateTable, until
+// finishUpdates is called.
+type updatingStorage struct {
+	*MockStorage
+	updates  int
+	updating map[string]bool
+}
+
+func (s *updatingStorage) DescribeTable(name string) (int64, int64, string, error) {
+	read, write, status, err := s.MockStorage.DescribeTable(name)
+	if s.updating[name] {
+		status = dynamodb.TableStatusUpdating
+	}
+	return read, write, status, err
+}
+
+func (s *updatingStorage) UpdateTable(name string, read, write int64) error {
+	s.updates++
+	s.updating[name] = true
+	return s.MockStorage.UpdateTable(name, read, write)
+}
+
+func TestDynamoTableManagerInFlightUpdates(t *testing.T) {
+	dynamoDB := &updatingStorage{MockStorage: NewMockStorage(), updating: map[string]bool{}}
+	tableManager, err := NewDynamoTableManager(TableManagerConfig{
+		mockDynamoDB:               dynamoDB,
+		UpdateTimeout:              time.Hour,
+		ProvisionedWriteThroughput: write,
+		ProvisionedReadThroughput:  read,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mtime.NowReset()
+
+	syncAt := func(tm time.Time) {
+		mtime.NowForce(tm)
+		if err := tableManager.syncTables(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	syncAt(time.Unix(0, 0))
+	tableManager.cfg.ProvisionedWriteThroughput = write * 2
+	syncAt(time.Unix(0, 0))
+	if dynamoDB.updates != 1 {
+		t.Fatalf("Expected 1 update, got %d", dynamoDB.updates)
+	}
+
+	// While the table is UPDATING we shouldn't touch it again, but should
+	// report it as stuck once the timeout has passed.
+	tableManager.cfg.ProvisionedWriteThroughput = write * 3
+	syncAt(time.Unix(0, 0).Add(time.Minute))
+	if dynamoDB.updates != 1 || gaugeValue(t, stuckTableUpdates) != 0 {
+		t.Fatalf("Expected 1 update and no stuck tables, got %d, %v", dynamoDB.updates, gaugeValue(t, stuckTableUpdates))
+	}
+	syncAt(time.Unix(0, 0).Add(2 * time.Hour))
+	if dynamoDB.updates != 1 || gaugeValue(t, stuckTableUpdates) != 1 {
+		t.Fatalf("Expected 1 update and 1 stuck table, got %d, %v", dynamoDB.updates, gaugeValue(t, stuckTableUpdates))
+	}
+
+	// Once it's ACTIVE we carry on reconciling.
+	dynamoDB.updating = map[string]bool{}
+	syncAt(time.Unix(0, 0).Add(2 * time.Hour))
+	if dynamoDB.updates != 2 || gaugeValue(t, stuckTableUpdates) != 0 {
+		t.Fatalf("Expected 2 updates and no stuck tables, got %d, %v", dynamoDB.updates, gaugeValue(t, stuckTableUpdates))
+	}
+	expectTables(t, dynamoDB, []tableDescription{
+		{name: "", provisionedRead: read, provisionedWrite: write * 3},
+	})
+}
+
+func TestDynamoTableManagerOwnership(t *testing.T) {
+	dynamoDB := NewMockStorage()
+	// A table outside Cortex, which happens to have one of our names.
+	if err := dynamoDB.CreateTable(tablePrefix+"0", 1, 1, TableOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	tableManager, err := NewDynamoTableManager(TableManagerConfig{
+		mockDynamoDB: dynamoDB,
+		Clock:        NewManualClock(time.Unix(0, 0)),
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables: true,
+			TablePrefix:       tablePrefix,
+			TablePeriod:       tablePeriod,
+			PeriodicTableStartAt: util.DayValue{
+				Time: model.TimeFromUnix(0),
+			},
+		},
+		CreationGracePeriod:        gracePeriod,
+		MaxChunkAge:                maxChunkAge,
+		ProvisionedWriteThroughput: write,
+		ProvisionedReadThroughput:  read,
+		RequireOwnershipTag:        true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectThroughput := func(name string, expectedRead, expectedWrite int64) {
+		read, write, _, err := dynamoDB.DescribeTable(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read != expectedRead || write != expectedWrite {
+			t.Fatalf("Expected %d/%d on table '%s', found %d/%d", expectedRead, expectedWrite, name, read, write)
+		}
+	}
+
+	// The table we created is tagged and provisioned; the other is left alone.
+	if err := tableManager.syncTables(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if tags, _ := dynamoDB.TableTags(""); tags[ownershipTagKey] != ownershipTagValue {
+		t.Fatalf("Expected table '' to be tagged, found %v", tags)
+	}
+	expectThroughput("", read, write)
+	expectThroughput(tablePrefix+"0", 1, 1)
+	if unowned := gaugeValue(t, unownedTables); unowned != 1 {
+		t.Fatalf("Expected 1 unowned table, found %v", unowned)
+	}
+
+	// Once it's tagged, it's ours.
+	dynamoDB.tables[tablePrefix+"0"].options.Tags = map[string]string{ownershipTagKey: ownershipTagValue}
+	if err := tableManager.syncTables(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expectThroughput(tablePrefix+"0", read, write)
+	if unowned := gaugeValue(t, unownedTables); unowned != 0 {
+		t.Fatalf("Expected no unowned tables, found %v", unowned)
+	}
+}
+
+func TestDynamoTableManagerStreams(t *testing.T) {
+	dynamoDB := NewMockStorage()
+	cfg := TableManagerConfig{
+		mockDynamoDB:               dynamoDB,
+		ProvisionedWriteThroughput: write,
+		ProvisionedReadThroughput:  read,
+		StreamsEnabled:             true,
+		StreamViewType:             "EVERYTHING",
+	}
+	if _, err := NewDynamoTableManager(cfg); err == nil {
+		t.Fatal("Expected an error for an invalid stream view type")
+	}
+
+	cfg.StreamViewType = dynamodb.StreamViewTypeNewImage
+	tableManager, err := NewDynamoTableManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tableManager.syncTables(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if viewType := dynamoDB.tables[""].options.StreamViewType; viewType != dynamodb.StreamViewTypeNewImage {
+		t.Fatalf("Expected a %s stream, found '%s'", dynamodb.StreamViewTypeNewImage, viewType)
+	}
+}
+
+func TestDynamoTableManagerBackups(t *testing.T) {
+	dynamoDB := NewMockStorage()
+	tableManager, err := NewDynamoTableManager(TableManagerConfig{
+		mockDynamoDB: dynamoDB,
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables: true,
+			TablePrefix:       tablePrefix,
+			TablePeriod:       tablePeriod,
+			PeriodicTableStartAt: util.DayValue{
+				Time: model.TimeFromUnix(0),
+			},
+		},
+		CreationGracePeriod:        gracePeriod,
+		MaxChunkAge:                maxChunkAge,
+		ProvisionedWriteThroughput: write,
+		ProvisionedReadThroughput:  read,
+		InactiveWriteThroughput:    inactiveWrite,
+		InactiveReadThroughput:     inactiveRead,
+		PITREnabled:                true,
+		BackupPeriod:               24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mtime.NowReset()
+
+	test := func(name string, tm time.Time, expectedBackups map[string]int) {
+		t.Run(name, func(t *testing.T) {
+			mtime.NowForce(tm)
+			if err := tableManager.syncTables(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			for table, backups := range expectedBackups {
+				mockTable := dynamoDB.tables[table]
+				if len(mockTable.backups) != backups {
+					t.Fatalf("Expected %d backups of table '%s', found %d", backups, table, len(mockTable.backups))
+				}
+				if active := backups > 0; mockTable.pitr != active {
+					t.Fatalf("Expected point-in-time recovery %v on table '%s'", active, table)
+				}
+			}
+		})
+	}
+
+	newTables := time.Unix(0, 0).Add(tablePeriod).Add(gracePeriod).Add(maxChunkAge)
+	test("New tables aren't backed up until they exist", time.Unix(0, 0), map[string]int{"": 0, tablePrefix + "0": 0})
+	test("Active tables are backed up", time.Unix(0, 0).Add(time.Minute), map[string]int{"": 1, tablePrefix + "0": 1})
+	test("Only once per period", time.Unix(0, 0).Add(time.Hour), map[string]int{"": 1, tablePrefix + "0": 1})
+	test("Inactive tables aren't backed up", time.Unix(0, 0).Add(25*time.Hour), map[string]int{"": 1, tablePrefix + "0": 2})
+	test("Nor are new ones", newTables, map[string]int{"": 1, tablePrefix + "0": 2, tablePrefix + "1": 0})
+	test("Next table is backed up", newTables.Add(time.Minute), map[string]int{"": 1, tablePrefix + "0": 2, tablePrefix + "1": 1})
+}
+
+// failingStorage fails to update, or back up, some tables.
+type failingStorage struct {
+	*MockStorage
+	fail       map[string]bool
+	failBackup map[string]bool
+}
+
+func (s *failingStorage) CreateBackup(name, backupName string) error {
+	if s.failBackup[name] {
+		return fmt.Errorf("backup of %s failed", name)
+	}
+	return s.MockStorage.CreateBackup(name, backupName)
+}
+
+func (s *failingStorage) UpdateTable(name string, read, write int64) error {
+	if s.fail[name] {
+		return fmt.Errorf("update of %s failed", name)
+	}
+	return s.MockStorage.UpdateTable(name, read, write)
+}
+
+func TestDynamoTableManagerBackupFailures(t *testing.T) {
+	dynamoDB := &failingStorage{
+		MockStorage: NewMockStorage(),
+		failBackup:  map[string]bool{tablePrefix + "0": true},
+	}
+	tableManager, err := NewDynamoTableManager(TableManagerConfig{
+		mockDynamoDB: dynamoDB,
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables: true,
+			TablePrefix:       tablePrefix,
+			TablePeriod:       tablePeriod,
+			PeriodicTableStartAt: util.DayValue{
+				Time: model.TimeFromUnix(0),
+			},
+		},
+		CreationGracePeriod:        gracePeriod,
+		MaxChunkAge:                maxChunkAge,
+		ProvisionedWriteThroughput: write,
+		ProvisionedReadThroughput:  read,
+		InactiveWriteThroughput:    inactiveWrite,
+		InactiveReadThroughput:     inactiveRead,
+		BackupPeriod:               24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mtime.NowReset()
+
+	// Failing to back up one table fails neither the sync, nor the backups
+	// of other tables, nor changes to the table's throughput.
+	mtime.NowForce(time.Unix(0, 0).Add(time.Minute))
+	if err := tableManager.syncTables(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tableManager.syncTables(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if backups := len(dynamoDB.tables[""].backups); backups != 1 {
+		t.Fatalf("Expected 1 backup of table '', found %d", backups)
+	}
+	if backups := len(dynamoDB.tables[tablePrefix+"0"].backups); backups != 0 {
+		t.Fatalf("Expected no backups of table %s0, found %d", tablePrefix, backups)
+	}
+	tableManager.cfg.ProvisionedReadThroughput = read + 1
+	if err := tableManager.syncTables(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if r, _, _, err := dynamoDB.DescribeTable(tablePrefix + "0"); err != nil || r != read+1 {
+		t.Fatalf("Expected table %s0 to be scaled up, got read = %d, %v", tablePrefix, r, err)
+	}
+}
+
+func TestDynamoTableManagerConcurrentSync(t *testing.T) {
+	dynamoDB := &failingStorage{
+		MockStorage: NewMockStorage(),
+		fail:        map[string]bool{tablePrefix + "3": true, tablePrefix + "7": true},
+	}
+	cfg := TableManagerConfig{
+		mockDynamoDB: dynamoDB,
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables: true,
+			TablePrefix:       tablePrefix,
+			TablePeriod:       tablePeriod,
+			PeriodicTableStartAt: util.DayValue{
+				Time: model.TimeFromUnix(0),
+			},
+		},
+		SyncConcurrency:            4,
+		ProvisionedWriteThroughput: write,
+		ProvisionedReadThroughput:  read,
+		InactiveWriteThroughput:    inactiveWrite,
+		InactiveReadThroughput:     inactiveRead,
+	}
+	tableManager, err := NewDynamoTableManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mtime.NowReset()
+
+	// Create many tables at once, all active.
+	mtime.NowForce(time.Unix(0, 0).Add(10 * tablePeriod))
+	tableManager.cfg.InactiveReadThroughput, tableManager.cfg.InactiveWriteThroughput = read, write
+	if err := tableManager.syncTables(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	tables, err := dynamoDB.ListTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 12 {
+		t.Fatalf("Expected 12 tables, got %v", tables)
+	}
+
+	// Scaling down should update every table but the failing ones, and
+	// report both failures.
+	tableManager.cfg.InactiveReadThroughput, tableManager.cfg.InactiveWriteThroughput = inactiveRead, inactiveWrite
+	err = tableManager.syncTables(context.Background())
+	if err == nil || !strings.Contains(err.Error(), tablePrefix+"3") || !strings.Contains(err.Error(), tablePrefix+"7") {
+		t.Fatalf("Expected errors for both failing tables, got %v", err)
+	}
+	for i := 0; i < 9; i++ {
+		name := tablePrefix + strconv.Itoa(i)
+		if dynamoDB.fail[name] {
+			continue
+		}
+		r, w, _, err := dynamoDB.DescribeTable(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != inactiveRead || w != inactiveWrite {
+			t.Fatalf("Expected table %s to be scaled down, got read = %d, write = %d", name, r, w)
+		}
+	}
+}
+
+func TestDynamoTableManagerExtraTables(t *testing.T) {
+	var extra ExtraTablesValue
+	for _, v := range []string{"deletes", "ha_tracker:5:10"} {
+		if err := extra.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, v := range []string{"", "bad:1", "bad:x:1", "deletes"} {
+		if err := extra.Set(v); err == nil {
+			t.Fatalf("Expected error setting %q", v)
+		}
+	}
+
+	dynamoDB := NewMockStorage()
+	tableManager, err := NewDynamoTableManager(TableManagerConfig{
+		mockDynamoDB: dynamoDB,
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables: true,
+			TablePrefix:       tablePrefix,
+			TablePeriod:       tablePeriod,
+			PeriodicTableStartAt: util.DayValue{
+				Time: model.TimeFromUnix(0),
+			},
+		},
+		CreationGracePeriod:        gracePeriod,
+		MaxChunkAge:                maxChunkAge,
+		ProvisionedWriteThroughput: write,
+		ProvisionedReadThroughput:  read,
+		InactiveWriteThroughput:    inactiveWrite,
+		InactiveReadThroughput:     inactiveRead,
+		ExtraTables:                extra,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtime.NowForce(time.Unix(0, 0))
+	defer mtime.NowReset()
+	if err := tableManager.syncTables(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expectTables(t, dynamoDB, []tableDescription{
+		{name: "", provisionedRead: read, provisionedWrite: write},
+		{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: write},
+		{name: "deletes", provisionedRead: read, provisionedWrite: write},
+		{name: "ha_tracker", provisionedRead: 5, provisionedWrite: 10},
+	})
+}
+
+func TestDynamoTableManagerChunkTables(t *testing.T) {
+	dynamoDB := NewMockStorage()
+	tableManager, err := NewDynamoTableManager(TableManagerConfig{
+		mockDynamoDB: dynamoDB,
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables: true,
+			TablePrefix:       tablePrefix,
+			TablePeriod:       tablePeriod,
+			PeriodicTableStartAt: util.DayValue{
+				Time: model.TimeFromUnix(0),
+			},
+			ChunkTablePrefix: "chunks_",
+		},
+		CreationGracePeriod:        gracePeriod,
+		MaxChunkAge:                maxChunkAge,
+		ProvisionedWriteThroughput: write,
+		ProvisionedReadThroughput:  read,
+		InactiveWriteThroughput:    inactiveWrite,
+		InactiveReadThroughput:     inactiveRead,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtime.NowForce(time.Unix(0, 0))
+	defer mtime.NowReset()
+	if err := tableManager.syncTables(context.Background()); err != nil {
+		t.Fatal(err)
 	}
+	expectTables(t, dynamoDB, []tableDescription{
+		{name: "", provisionedRead: read, provisionedWrite: write},
+		{name: "chunks_0", provisionedRead: read, provisionedWrite: write},
+		{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: write},
+	})
 }
@@ -0,0 +1,82 @@
+package chunk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// TenantIsolation lists tenants whose chunks and index are kept apart from
+// everyone else's.  It is loaded from YAML, like:
+//
+//	tenants:
+//	  acme:
+//	    bucket: acme-chunks
+//	    prefix: cortex/
+//	    table_prefix: acme_
+//
+// Chunks go to the tenant's bucket (or the shared one if unset), with their
+// keys prefixed by prefix.  If table_prefix is set the tenant's index goes in
+// its own set of periodic tables, which the table manager creates alongside
+// the shared ones.
+type TenantIsolation struct {
+	Tenants map[string]TenantStorage `yaml:"tenants"`
+}
+
+// TenantStorage is where a single isolated tenant's data is kept.
+type TenantStorage struct {
+	Bucket      string `yaml:"bucket"`
+	Prefix      string `yaml:"prefix"`
+	TablePrefix string `yaml:"table_prefix"`
+}
+
+// LoadTenantIsolation reads a TenantIsolation from filename.
+func LoadTenantIsolation(filename string) (TenantIsolation, error) {
+	var isolation TenantIsolation
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return isolation, err
+	}
+	if err := yaml.Unmarshal(buf, &isolation); err != nil {
+		return isolation, err
+	}
+	return isolation, nil
+}
+
+// tablePrefixes returns the table prefix of each tenant with its own tables.
+func (t TenantIsolation) tablePrefixes() map[string]string {
+	result := map[string]string{}
+	for userID, storage := range t.Tenants {
+		if storage.TablePrefix != "" {
+			result[userID] = storage.TablePrefix
+		}
+	}
+	return result
+}
+
+// validate checks no two sets of periodic tables, including the shared ones
+// with sharedPrefix, could end up with the same table names.
+func (t TenantIsolation) validate(sharedPrefix string) error {
+	owners := map[string]string{sharedPrefix: "shared tables"}
+	for userID, prefix := range t.tablePrefixes() {
+		owners[prefix] = fmt.Sprintf("tenant %q", userID)
+	}
+	if len(owners) != len(t.tablePrefixes())+1 {
+		return fmt.Errorf("tenant table prefixes must be unique and differ from %q", sharedPrefix)
+	}
+
+	prefixes := make([]string, 0, len(owners))
+	for prefix := range owners {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for i := 1; i < len(prefixes); i++ {
+		if strings.HasPrefix(prefixes[i], prefixes[i-1]) {
+			return fmt.Errorf("table prefix %q of %s starts with table prefix %q of %s", prefixes[i], owners[prefixes[i]], prefixes[i-1], owners[prefixes[i-1]])
+		}
+	}
+	return nil
+}
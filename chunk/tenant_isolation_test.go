@@ -0,0 +1,159 @@
+package chunk
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/mtime"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+func writeTempFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "chunk")
+	require.NoError(t, err)
+	_, err = f.WriteString(content)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	return f.Name()
+}
+
+func TestS3ObjectClientTenantIsolation(t *testing.T) {
+	s3 := NewMockS3()
+	client := blobObjectClient{s3ObjectClient{
+		s3:         s3,
+		bucketName: "shared",
+		tenants: map[string]TenantStorage{
+			"acme":  {Bucket: "acme-chunks", Prefix: "cortex/"},
+			"other": {TablePrefix: "other_"},
+		},
+	}}
+
+	ctx := context.Background()
+	chunk := dummyObjectChunk(model.Now())
+	for _, userID := range []string{"acme", "other", "userID"} {
+		require.NoError(t, client.PutChunk(ctx, userID, &chunk))
+		fetched := Chunk{ID: chunk.ID, From: chunk.From, Through: chunk.Through}
+		require.NoError(t, client.GetChunk(ctx, userID, &fetched))
+		assert.Equal(t, chunk.Metric, fetched.Metric)
+	}
+
+	keys := func(bucket string) []string {
+		result := []string{}
+		if b, ok := s3.buckets[bucket]; ok {
+			for key := range b.objects {
+				result = append(result, key)
+			}
+		}
+		sort.Strings(result)
+		return result
+	}
+	assert.Equal(t, []string{"cortex/" + chunkName("acme", chunk.ID)}, keys("acme-chunks"))
+	assert.Equal(t, []string{chunkName("other", chunk.ID), chunkName("userID", chunk.ID)}, keys("shared"))
+}
+
+func TestTenantIsolationValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		tenants map[string]TenantStorage
+		valid   bool
+	}{
+		{"no tables", map[string]TenantStorage{"a": {Bucket: "a"}, "b": {Prefix: "b/"}}, true},
+		{"distinct", map[string]TenantStorage{"a": {TablePrefix: "a_"}, "b": {TablePrefix: "b_"}}, true},
+		{"duplicate", map[string]TenantStorage{"a": {TablePrefix: "x_"}, "b": {TablePrefix: "x_"}}, false},
+		{"shared", map[string]TenantStorage{"a": {TablePrefix: tablePrefix}}, false},
+		{"overlapping", map[string]TenantStorage{"a": {TablePrefix: "a_"}, "b": {TablePrefix: "a_1"}}, false},
+		{"overlapping shared", map[string]TenantStorage{"a": {TablePrefix: tablePrefix + "a"}}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := TenantIsolation{Tenants: tc.tenants}.validate(tablePrefix)
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestSchemaTenantTables(t *testing.T) {
+	cfg := SchemaConfig{
+		OriginalTableName: "table",
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables:    true,
+			TablePrefix:          tablePrefix,
+			TablePeriod:          tablePeriod,
+			PeriodicTableStartAt: util.NewDayValue(model.TimeFromUnix(int64(tablePeriod / time.Second))),
+		},
+		tenantTablePrefixes: map[string]string{"acme": "acme_"},
+	}
+	tables := func(userID string, from, through model.Time) []string {
+		entries, err := cfg.dailyBuckets(from, through, userID, "foo", func(_, _ uint32, tableName, _ string) ([]IndexEntry, error) {
+			return []IndexEntry{{TableName: tableName}}, nil
+		})
+		require.NoError(t, err)
+		result := []string{}
+		for _, entry := range entries {
+			if len(result) == 0 || result[len(result)-1] != entry.TableName {
+				result = append(result, entry.TableName)
+			}
+		}
+		return result
+	}
+
+	from, through := model.TimeFromUnix(0), model.TimeFromUnix(0).Add(2*tablePeriod)
+	assert.Equal(t, []string{"table", tablePrefix + "1", tablePrefix + "2"}, tables("userID", from, through))
+	assert.Equal(t, []string{"acme_1", "acme_2"}, tables("acme", from, through))
+}
+
+func TestDynamoTableManagerTenantIsolation(t *testing.T) {
+	filename := writeTempFile(t, `
+tenants:
+  acme:
+    table_prefix: acme_
+  beta:
+    bucket: beta-chunks
+`)
+	defer os.Remove(filename)
+
+	dynamoDB := NewMockStorage()
+	tableManager, err := NewDynamoTableManager(TableManagerConfig{
+		mockDynamoDB: dynamoDB,
+
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables: true,
+			TablePrefix:       tablePrefix,
+			TablePeriod:       tablePeriod,
+			PeriodicTableStartAt: util.DayValue{
+				Time: model.TimeFromUnix(0),
+			},
+		},
+
+		CreationGracePeriod:        gracePeriod,
+		MaxChunkAge:                maxChunkAge,
+		ProvisionedWriteThroughput: write,
+		ProvisionedReadThroughput:  read,
+		InactiveWriteThroughput:    inactiveWrite,
+		InactiveReadThroughput:     inactiveRead,
+		TenantIsolationFile:        filename,
+	})
+	require.NoError(t, err)
+
+	mtime.NowForce(time.Unix(0, 0).Add(tablePeriod))
+	defer mtime.NowReset()
+	require.NoError(t, tableManager.syncTables(context.Background()))
+	expectTables(t, dynamoDB, []tableDescription{
+		{name: "", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+		{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: write},
+		{name: tablePrefix + "1", provisionedRead: read, provisionedWrite: write},
+		{name: "acme_0", provisionedRead: read, provisionedWrite: write},
+		{name: "acme_1", provisionedRead: read, provisionedWrite: write},
+	})
+}
@@ -0,0 +1,179 @@
+package chunk
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// usageSegments is the number of segments tables are scanned in, of which a
+// sample are read to estimate tenants' usage.
+const usageSegments = 100
+
+// Bounds on the work of a TenantTables request: the tables of at most
+// maxTenantTablesPeriod are scanned, and at most maxScannedSegments
+// segments of them in all, i.e. five whole tables.
+const (
+	maxTenantTablesPeriod = 31 * 24 * time.Hour
+	maxScannedSegments    = 5 * usageSegments
+)
+
+var errTooManySegments = fmt.Errorf("would scan more than %d table segments; sample less, or a shorter period", maxScannedSegments)
+
+// TenantTableUsage is an estimate of how much of a tenant's index is in a
+// table, extrapolated from scanning a sample of it.  Their chunks' data,
+// kept in the object store, isn't counted.
+type TenantTableUsage struct {
+	Table string `json:"table"`
+	// Tables outside the retention may have been deleted already.
+	Exists bool `json:"exists"`
+	// Whether any of the tenant's entries were found; with less than the
+	// whole table sampled, a tenant with little data may be missed.
+	HasData      bool    `json:"has_data"`
+	IndexEntries int64   `json:"index_entries"`
+	IndexBytes   int64   `json:"index_bytes"`
+	Sampled      float64 `json:"sampled"`
+}
+
+// unwrappedIndex returns the client the index is kept with, beneath any
+// write queue.
+func (c *Store) unwrappedIndex() IndexClient {
+	if queue, ok := c.index.(*writeQueue); ok {
+		return queue.IndexClient
+	}
+	return c.index
+}
+
+// TenantTables estimates how much of userID's index is in each table which
+// could hold their data from between from and through, by scanning percent
+// of each (100 for exact counts).  It returns errTooManySegments rather than
+// scan more than maxScannedSegments.
+func (c *Store) TenantTables(ctx context.Context, userID string, from, through model.Time, percent int) ([]TenantTableUsage, error) {
+	if percent <= 0 || percent > usageSegments {
+		return nil, fmt.Errorf("invalid sample percentage %d", percent)
+	}
+	scanner, ok := c.unwrappedIndex().(IndexScanner)
+	if !ok {
+		return nil, fmt.Errorf("index store doesn't support scanning tables")
+	}
+	var existing map[string]bool
+	if tables, ok := scanner.(TableClient); ok {
+		names, err := tables.ListTables()
+		if err != nil {
+			return nil, err
+		}
+		existing = map[string]bool{}
+		for _, name := range names {
+			existing[name] = true
+		}
+	}
+
+	cfg := c.cfg.SchemaConfig
+	var tables []string
+	seen := map[string]bool{}
+	for day := from.Unix() / secondsInDay * secondsInDay; day <= through.Unix(); day += secondsInDay {
+		if table := cfg.tableForBucket(userID, day); !seen[table] {
+			seen[table] = true
+			tables = append(tables, table)
+		}
+	}
+	sort.Strings(tables)
+	if len(tables)*percent > maxScannedSegments {
+		return nil, errTooManySegments
+	}
+
+	prefix := userID + ":"
+	result := make([]TenantTableUsage, 0, len(tables))
+	for _, table := range tables {
+		usage := TenantTableUsage{
+			Table:   table,
+			Exists:  existing == nil || existing[table],
+			Sampled: float64(percent) / usageSegments,
+		}
+		if !usage.Exists {
+			result = append(result, usage)
+			continue
+		}
+		// Each segment is a random sample of the table's items.
+		for segment := 0; segment < percent; segment++ {
+			err := scanner.ScanPages(ctx, table, segment, usageSegments, nil, func(entries []IndexEntry, _ *ScanCursor) bool {
+				for _, entry := range entries {
+					if strings.HasPrefix(entry.HashValue, prefix) {
+						usage.IndexEntries++
+						usage.IndexBytes += int64(len(entry.HashValue) + len(entry.RangeValue))
+					}
+				}
+				return true
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		usage.HasData = usage.IndexEntries > 0
+		usage.IndexEntries = usage.IndexEntries * usageSegments / int64(percent)
+		usage.IndexBytes = usage.IndexBytes * usageSegments / int64(percent)
+		result = append(result, usage)
+	}
+	return result, nil
+}
+
+// TenantTablesHandler reports the tables which could hold a tenant's index
+// (the user parameter) between from and through (as YYYY-MM-DD, by default
+// the last week), and an estimate of how many index entries and bytes each
+// has, from scanning sample percent of them (by default 1, 100 for exact
+// counts).  It doesn't report the size of the tenant's chunks.
+// It's an admin API, so not scoped to a tenant, and must be served behind
+// admin authentication.  Periods longer than maxTenantTablesPeriod, and
+// samples of more than maxScannedSegments, are rejected.
+func (c *Store) TenantTablesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.FormValue("user")
+	if userID == "" {
+		http.Error(w, "user parameter required", http.StatusBadRequest)
+		return
+	}
+	now := model.Now()
+	from, through := util.NewDayValue(now.Add(-7*24*time.Hour)), util.NewDayValue(now)
+	for param, day := range map[string]*util.DayValue{"from": &from, "through": &through} {
+		if value := r.FormValue(param); value != "" {
+			if err := day.Set(value); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if through.Before(from.Time) || through.Sub(from.Time) > maxTenantTablesPeriod {
+		http.Error(w, fmt.Sprintf("from must be before through, and at most %v before", maxTenantTablesPeriod), http.StatusBadRequest)
+		return
+	}
+	percent := 1
+	if sample := r.FormValue("sample"); sample != "" {
+		var err error
+		if percent, err = strconv.Atoi(sample); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	usage, err := c.TenantTables(r.Context(), userID, from.Time, through.Time, percent)
+	if err == errTooManySegments {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(usage); err != nil {
+		log.Errorf("Error writing tenant tables: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package chunk
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestTenantTablesHandler(t *testing.T) {
+	dynamoDB := NewMockStorage()
+	setupDynamodb(t, dynamoDB)
+	now := model.Now()
+	cfg := StoreConfig{
+		mockDynamoDB:  dynamoDB,
+		mockS3:        NewMockS3(),
+		schemaFactory: v6Schema,
+	}
+	// Periodic tables start tomorrow, and haven't been created yet.
+	cfg.UsePeriodicTables = true
+	cfg.TablePrefix = "cortex_"
+	cfg.TablePeriod = 24 * time.Hour
+	cfg.PeriodicTableStartAt = util.NewDayValue(now.Add(24 * time.Hour))
+	store, err := NewStore(cfg)
+	require.NoError(t, err)
+
+	data, err := chunk.New().Add(model.SamplePair{Timestamp: now, Value: 0})
+	require.NoError(t, err)
+	c := NewChunk(model.Fingerprint(1), model.Metric{model.MetricNameLabel: "foo", "bar": "baz"}, data[0], now.Add(-time.Hour), now)
+	require.NoError(t, store.Put(user.Inject(context.Background(), "1"), []Chunk{c}))
+	entries, err := store.schema.GetWriteEntries(c.From, c.Through, "1", "foo", c.Metric, c.ID)
+	require.NoError(t, err)
+
+	get := func(url string) (int, []TenantTableUsage) {
+		rec := httptest.NewRecorder()
+		store.TenantTablesHandler(rec, httptest.NewRequest("GET", url, nil))
+		var result []TenantTableUsage
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+		}
+		return rec.Code, result
+	}
+	tomorrow := now.Add(24 * time.Hour).Time().UTC().Format("2006-01-02")
+	tomorrowsTable := cfg.TablePrefix + strconv.Itoa(int(now.Add(24*time.Hour).Unix()/secondsInDay))
+
+	// Scanning every segment counts the tenant's entries exactly.
+	code, usage := get("/tenant_tables?user=1&through=" + tomorrow + "&sample=100")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, usage, 2)
+	assert.Equal(t, TenantTableUsage{Table: "", Exists: true, HasData: true, IndexEntries: int64(len(entries)), IndexBytes: usage[0].IndexBytes, Sampled: 1}, usage[0])
+	assert.True(t, usage[0].IndexBytes > 0)
+	assert.Equal(t, TenantTableUsage{Table: tomorrowsTable, Sampled: 1}, usage[1])
+
+	code, usage = get("/tenant_tables?user=2&sample=100")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, usage, 1)
+	assert.False(t, usage[0].HasData)
+	assert.Zero(t, usage[0].IndexEntries)
+
+	// Sampled counts are scaled up to the whole table.
+	_, usage = get("/tenant_tables?user=1")
+	require.Len(t, usage, 1)
+	assert.Equal(t, 0.01, usage[0].Sampled)
+	assert.Zero(t, usage[0].IndexEntries%100)
+
+	// Requests must be bounded.
+	monthAgo := now.Add(-32 * 24 * time.Hour).Time().UTC().Format("2006-01-02")
+	weekLater := now.Add(7 * 24 * time.Hour).Time().UTC().Format("2006-01-02")
+	weekAgo := now.Add(-7 * 24 * time.Hour).Time().UTC().Format("2006-01-02")
+	for _, url := range []string{
+		"/tenant_tables",
+		"/tenant_tables?user=1&from=yesterday",
+		"/tenant_tables?user=1&sample=0",
+		"/tenant_tables?user=1&from=" + monthAgo,
+		"/tenant_tables?user=1&from=" + tomorrow + "&through=" + weekAgo,
+		"/tenant_tables?user=1&from=" + tomorrow + "&through=" + weekLater + "&sample=100",
+	} {
+		code, _ = get(url)
+		assert.NotEqual(t, http.StatusOK, code, url)
+	}
+}
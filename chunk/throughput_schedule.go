@@ -0,0 +1,103 @@
+package chunk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ThroughputSchedule is a list of planned provisioned throughput changes,
+// eg for known backfill windows.  It is loaded from YAML, like:
+//
+//	schedule:
+//	- tables: [cortex_2450, cortex_2451]
+//	  from: 2017-01-01
+//	  until: 2017-01-03T12:00:00Z
+//	  write_throughput: 5000
+//
+// An entry with no tables applies to every table.  Where several entries
+// apply to the same table the last one wins.
+type ThroughputSchedule struct {
+	Schedule []ThroughputScheduleEntry `yaml:"schedule"`
+}
+
+// ThroughputScheduleEntry overrides the provisioned throughput of some tables
+// during [From, Until).  Zero throughputs are left as they would otherwise be.
+type ThroughputScheduleEntry struct {
+	Tables          []string     `yaml:"tables"`
+	From            scheduleTime `yaml:"from"`
+	Until           scheduleTime `yaml:"until"`
+	ReadThroughput  int64        `yaml:"read_throughput"`
+	WriteThroughput int64        `yaml:"write_throughput"`
+}
+
+type scheduleTime struct {
+	time.Time
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler, accepting dates or RFC3339 times.
+func (t *scheduleTime) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if parsed, err := time.Parse(layout, s); err == nil {
+			t.Time = parsed
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid time %q, expected YYYY-MM-DD or RFC3339", s)
+}
+
+// LoadThroughputSchedule reads a ThroughputSchedule from filename.
+func LoadThroughputSchedule(filename string) (ThroughputSchedule, error) {
+	var schedule ThroughputSchedule
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return schedule, err
+	}
+	if err := yaml.Unmarshal(buf, &schedule); err != nil {
+		return schedule, err
+	}
+	for i, entry := range schedule.Schedule {
+		if !entry.Until.After(entry.From.Time) {
+			return schedule, fmt.Errorf("throughput schedule entry %d: until must be after from", i)
+		}
+	}
+	return schedule, nil
+}
+
+// apply overrides the throughput of descriptions with entries active at now.
+func (s ThroughputSchedule) apply(descriptions []tableDescription, now time.Time) {
+	for _, entry := range s.Schedule {
+		if now.Before(entry.From.Time) || !now.Before(entry.Until.Time) {
+			continue
+		}
+		for i := range descriptions {
+			if !entry.appliesTo(descriptions[i].name) {
+				continue
+			}
+			if entry.ReadThroughput > 0 {
+				descriptions[i].provisionedRead = entry.ReadThroughput
+			}
+			if entry.WriteThroughput > 0 {
+				descriptions[i].provisionedWrite = entry.WriteThroughput
+			}
+		}
+	}
+}
+
+func (e ThroughputScheduleEntry) appliesTo(table string) bool {
+	if len(e.Tables) == 0 {
+		return true
+	}
+	for _, t := range e.Tables {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package chunk
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/mtime"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestDynamoTableManagerThroughputSchedule(t *testing.T) {
+	f, err := ioutil.TempFile("", "schedule")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`
+schedule:
+- tables: [cortex_0]
+  from: 1970-01-02
+  until: 1970-01-03T00:00:00Z
+  write_throughput: 5000
+- from: 1970-01-02T12:00:00Z
+  until: 1970-01-03T00:00:00Z
+  read_throughput: 1000
+`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	dynamoDB := NewMockStorage()
+	tableManager, err := NewDynamoTableManager(TableManagerConfig{
+		mockDynamoDB: dynamoDB,
+
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables: true,
+			TablePrefix:       tablePrefix,
+			TablePeriod:       tablePeriod,
+			PeriodicTableStartAt: util.DayValue{
+				Time: model.TimeFromUnix(0),
+			},
+		},
+
+		CreationGracePeriod:        gracePeriod,
+		MaxChunkAge:                maxChunkAge,
+		ProvisionedWriteThroughput: write,
+		ProvisionedReadThroughput:  read,
+		InactiveWriteThroughput:    inactiveWrite,
+		InactiveReadThroughput:     inactiveRead,
+		ThroughputScheduleFile:     f.Name(),
+	})
+	require.NoError(t, err)
+
+	test := func(name string, tm time.Time, expected []tableDescription) {
+		t.Run(name, func(t *testing.T) {
+			mtime.NowForce(tm)
+			defer mtime.NowReset()
+			require.NoError(t, tableManager.syncTables(context.Background()))
+			expectTables(t, dynamoDB, expected)
+		})
+	}
+
+	day := 24 * time.Hour
+	test("Before schedule", time.Unix(0, 0).Add(day-time.Second), []tableDescription{
+		{name: "", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+		{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: write},
+	})
+	test("Write scaled up", time.Unix(0, 0).Add(day), []tableDescription{
+		{name: "", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+		{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: 5000},
+	})
+	test("Read scaled up everywhere", time.Unix(0, 0).Add(day+12*time.Hour), []tableDescription{
+		{name: "", provisionedRead: 1000, provisionedWrite: inactiveWrite},
+		{name: tablePrefix + "0", provisionedRead: 1000, provisionedWrite: 5000},
+	})
+	test("After schedule", time.Unix(0, 0).Add(2*day), []tableDescription{
+		{name: "", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+		{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: write},
+	})
+}
+
+func TestLoadThroughputScheduleInvalid(t *testing.T) {
+	f, err := ioutil.TempFile("", "schedule")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`
+schedule:
+- from: 1970-01-03
+  until: 1970-01-02
+`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = LoadThroughputSchedule(f.Name())
+	require.Error(t, err)
+}
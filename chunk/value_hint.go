@@ -0,0 +1,121 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/fnv"
+	"regexp/syntax"
+	"unicode/utf8"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// A valueHint is a 64 bit Bloom filter of the trigrams in a label value,
+// written into v6 schema range keys.  Regex matchers which require some
+// literal to appear in the value can skip entries whose hint doesn't have
+// all of that literal's trigrams, without decoding or matching the value.
+type valueHint uint64
+
+func (h valueHint) add(trigram []byte) valueHint {
+	hash := fnv.New32a()
+	hash.Write(trigram)
+	sum := hash.Sum32()
+	return h | 1<<(sum%64) | 1<<((sum>>16)%64)
+}
+
+func (h valueHint) addTrigrams(s []byte) valueHint {
+	for i := 0; i+3 <= len(s); i++ {
+		h = h.add(s[i : i+3])
+	}
+	return h
+}
+
+// mayContain returns false if a value with hint h cannot contain all the
+// trigrams in required.
+func (h valueHint) mayContain(required valueHint) bool {
+	return h&required == required
+}
+
+func hintForValue(value model.LabelValue) valueHint {
+	return valueHint(0).addTrigrams([]byte(value))
+}
+
+func encodeValueHint(h valueHint) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(h))
+	encoded := make([]byte, hex.EncodedLen(len(buf)))
+	hex.Encode(encoded, buf)
+	return encoded
+}
+
+func decodeValueHint(bs []byte) (valueHint, error) {
+	buf := make([]byte, 8)
+	if _, err := hex.Decode(buf, bs); err != nil {
+		return 0, err
+	}
+	return valueHint(binary.BigEndian.Uint64(buf)), nil
+}
+
+// rangeValueHint returns the value hint in a v6 range key, if there is one.
+func rangeValueHint(rangeValue []byte) (valueHint, bool) {
+	components := bytes.Split(rangeValue, []byte{0})
+	if len(components) < 5 || !bytes.Equal(components[3], rangeKeyV5) {
+		return 0, false
+	}
+	h, err := decodeValueHint(components[4])
+	if err != nil {
+		return 0, false
+	}
+	return h, true
+}
+
+// requiredHint returns the trigrams that must appear in any value matched by
+// matcher; zero means no entries can be skipped.
+func requiredHint(matcher *metric.LabelMatcher) valueHint {
+	if matcher == nil || matcher.Type != metric.RegexMatch {
+		return 0
+	}
+	re, err := syntax.Parse(string(matcher.Value), syntax.Perl)
+	if err != nil {
+		return 0
+	}
+	var h valueHint
+	for _, literal := range requiredLiterals(re.Simplify()) {
+		h = h.addTrigrams(literal)
+	}
+	return h
+}
+
+// requiredLiterals returns literal strings which must appear in every match
+// of re.  It only looks through concatenations, captures and repeats of at
+// least one, which covers the common `.*foo.*` style of matcher.
+func requiredLiterals(re *syntax.Regexp) [][]byte {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return nil
+		}
+		buf := make([]byte, 0, len(re.Rune))
+		for _, r := range re.Rune {
+			var enc [utf8.UTFMax]byte
+			n := utf8.EncodeRune(enc[:], r)
+			buf = append(buf, enc[:n]...)
+		}
+		return [][]byte{buf}
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiterals(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return requiredLiterals(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		var result [][]byte
+		for _, sub := range re.Sub {
+			result = append(result, requiredLiterals(sub)...)
+		}
+		return result
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package chunk
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValueHint(t *testing.T) {
+	for _, tc := range []struct {
+		regex, value string
+		skip         bool
+	}{
+		// Nothing required, so nothing can be skipped.
+		{".*", "foo", false},
+		{"foo|bar", "baz", false},
+		{"(?i).*FOO.*", "bar", false},
+		{".*fo.*", "bar", false},
+
+		{".*foo.*", "xfoox", false},
+		{".*foo.*", "bar", true},
+		{".*foo.*bar", "foo-bar", false},
+		{".*foo.*bar", "foo-baz", true},
+		{"(foo)+.*", "foofoo", false},
+		{"(foo)+.*", "fo", true},
+		{"(foo)?bar", "bar", false},
+		{".*ünï.*", "xünïx", false},
+	} {
+		matcher, err := metric.NewLabelMatcher(metric.RegexMatch, "bar", model.LabelValue(tc.regex))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hint, err := decodeValueHint(encodeValueHint(hintForValue(model.LabelValue(tc.value))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.skip, !hint.mayContain(requiredHint(matcher)), "%s =~ %s", tc.value, tc.regex)
+		if tc.skip {
+			assert.False(t, matcher.Match(model.LabelValue(tc.value)), "skipped matching value %s =~ %s", tc.value, tc.regex)
+		}
+	}
+}
+
+func TestRangeValueHint(t *testing.T) {
+	entries, err := v6Entries{}.GetWriteEntries(0, 0, "table", "hash", model.Metric{"bar": "baz"}, "chunk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, entries, 2)
+
+	_, ok := rangeValueHint(entries[0].RangeValue)
+	assert.False(t, ok)
+
+	hint, ok := rangeValueHint(entries[1].RangeValue)
+	assert.True(t, ok)
+	assert.Equal(t, hintForValue("baz"), hint)
+
+	value, chunkID, err := parseRangeValue(entries[1].RangeValue)
+	assert.NoError(t, err)
+	assert.Equal(t, model.LabelValue("baz"), value)
+	assert.Equal(t, "chunk", chunkID)
+}
@@ -0,0 +1,191 @@
+package chunk
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+)
+
+// WriteClass distinguishes the different kinds of index writes, so that
+// e.g. re-indexing chunks never starves chunk flushes.  Lower classes take
+// priority.
+type WriteClass int
+
+// Classes of write.
+const (
+	// Indexing newly flushed chunks.
+	FlushWrite WriteClass = iota
+	// Re-indexing chunks already stored: by the migrator, or an ingester
+	// retrying a flush.
+	RewriteWrite
+	PurgeWrite
+
+	numWriteClasses = int(PurgeWrite) + 1
+)
+
+var writeClassNames = [numWriteClasses]string{"flush", "rewrite", "purge"}
+
+func (c WriteClass) String() string {
+	return writeClassNames[c]
+}
+
+type contextKey int
+
+const writeClassKey contextKey = 0
+
+// WithWriteClass returns a context whose BatchWrites are queued as class c.
+// Writes default to FlushWrite.
+func WithWriteClass(ctx context.Context, c WriteClass) context.Context {
+	return context.WithValue(ctx, writeClassKey, c)
+}
+
+func writeClassFromContext(ctx context.Context) WriteClass {
+	if c, ok := ctx.Value(writeClassKey).(WriteClass); ok {
+		return c
+	}
+	return FlushWrite
+}
+
+var writeQueueWaitDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "cortex",
+	Name:      "dynamo_write_queue_wait_seconds",
+	Help:      "Time spent waiting in the write queue, by class of write.",
+	Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+}, []string{"class"})
+
+func init() {
+	prometheus.MustRegister(writeQueueWaitDuration)
+}
+
+// WriteQueueConfig configures the write queue.
+type WriteQueueConfig struct {
+	Concurrency int
+	Rates       [numWriteClasses]float64
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *WriteQueueConfig) RegisterFlags(f *flag.FlagSet) {
+	f.IntVar(&cfg.Concurrency, "dynamodb.write-concurrency", 0, "Maximum number of concurrent batch writes, queued by priority (0 to disable the queue).")
+	for c := FlushWrite; int(c) < numWriteClasses; c++ {
+		f.Float64Var(&cfg.Rates[c], "dynamodb."+c.String()+"-write-rate", 0, "Maximum "+c.String()+" write requests per second (0 for unlimited).")
+	}
+}
+
+// writeQueue is a StorageClient which limits the number of concurrent
+// BatchWrites, admitting waiting writes in priority order, and rate limits
+// each class of write separately.
+type writeQueue struct {
+	IndexClient
+
+	limiters [numWriteClasses]*rate.Limiter
+
+	mtx     sync.Mutex
+	cond    *sync.Cond
+	free    int
+	waiting [numWriteClasses]int
+}
+
+func newWriteQueue(cfg WriteQueueConfig, client IndexClient) *writeQueue {
+	q := &writeQueue{
+		IndexClient: client,
+		free:        cfg.Concurrency,
+	}
+	q.cond = sync.NewCond(&q.mtx)
+	for c, r := range cfg.Rates {
+		if r > 0 {
+			q.limiters[c] = rate.NewLimiter(rate.Limit(r), dynamoMaxBatchSize)
+		}
+	}
+	return q
+}
+
+func (q *writeQueue) BatchWrite(ctx context.Context, batch WriteBatch) error {
+	class := writeClassFromContext(ctx)
+	start := time.Now()
+	if err := q.wait(ctx, class, batch.Len()); err != nil {
+		return err
+	}
+	if err := q.acquire(ctx, class); err != nil {
+		return err
+	}
+	defer q.release()
+	writeQueueWaitDuration.WithLabelValues(class.String()).Observe(time.Since(start).Seconds())
+
+	return q.IndexClient.BatchWrite(ctx, batch)
+}
+
+// wait blocks until the class' rate limit allows n more requests.
+func (q *writeQueue) wait(ctx context.Context, class WriteClass, n int) error {
+	limiter := q.limiters[class]
+	if limiter == nil {
+		return nil
+	}
+	for n > 0 {
+		m := n
+		if m > limiter.Burst() {
+			m = limiter.Burst()
+		}
+		if err := limiter.WaitN(ctx, m); err != nil {
+			return err
+		}
+		n -= m
+	}
+	return nil
+}
+
+// acquire waits for a free slot, in priority order, until ctx is done.
+func (q *writeQueue) acquire(ctx context.Context, class WriteClass) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.free > 0 && !q.higherPriorityWaiting(class) {
+		q.free--
+		return nil
+	}
+
+	// The waiters are woken when ctx is done, so this one can give up.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			q.mtx.Lock()
+			q.cond.Broadcast()
+			q.mtx.Unlock()
+		case <-stop:
+		}
+	}()
+
+	q.waiting[class]++
+	for q.free == 0 || q.higherPriorityWaiting(class) {
+		if err := ctx.Err(); err != nil {
+			q.waiting[class]--
+			// Lower priority writes may no longer be waiting on this one.
+			q.cond.Broadcast()
+			return err
+		}
+		q.cond.Wait()
+	}
+	q.waiting[class]--
+	q.free--
+	return nil
+}
+
+func (q *writeQueue) higherPriorityWaiting(class WriteClass) bool {
+	for c := FlushWrite; c < class; c++ {
+		if q.waiting[c] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *writeQueue) release() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.free++
+	q.cond.Broadcast()
+}
@@ -0,0 +1,102 @@
+package chunk
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+type blockingStorage struct {
+	StorageClient
+	unblock chan struct{}
+
+	mtx   sync.Mutex
+	order []WriteClass
+}
+
+func (s *blockingStorage) BatchWrite(ctx context.Context, _ WriteBatch) error {
+	<-s.unblock
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.order = append(s.order, writeClassFromContext(ctx))
+	return nil
+}
+
+func TestWriteQueuePriority(t *testing.T) {
+	storage := &blockingStorage{
+		StorageClient: NewMockStorage(),
+		unblock:       make(chan struct{}),
+	}
+	q := newWriteQueue(WriteQueueConfig{Concurrency: 1}, storage)
+
+	var wg sync.WaitGroup
+	write := func(class WriteClass) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.BatchWrite(WithWriteClass(context.Background(), class), q.NewWriteBatch())
+		}()
+	}
+	waitFor := func(f func() bool) {
+		for {
+			q.mtx.Lock()
+			done := f()
+			q.mtx.Unlock()
+			if done {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Occupy the only slot, then queue a purge ahead of a flush.
+	write(PurgeWrite)
+	waitFor(func() bool { return q.free == 0 })
+	write(PurgeWrite)
+	waitFor(func() bool { return q.waiting[PurgeWrite] == 1 })
+	write(FlushWrite)
+	waitFor(func() bool { return q.waiting[FlushWrite] == 1 })
+
+	for i := 0; i < 3; i++ {
+		storage.unblock <- struct{}{}
+	}
+	wg.Wait()
+
+	assert.Equal(t, []WriteClass{PurgeWrite, FlushWrite, PurgeWrite}, storage.order)
+}
+
+func TestWriteQueueCancel(t *testing.T) {
+	storage := &blockingStorage{
+		StorageClient: NewMockStorage(),
+		unblock:       make(chan struct{}),
+	}
+	q := newWriteQueue(WriteQueueConfig{Concurrency: 1}, storage)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.BatchWrite(context.Background(), q.NewWriteBatch())
+	}()
+	for {
+		q.mtx.Lock()
+		free := q.free
+		q.mtx.Unlock()
+		if free == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Writes waiting for the queue give up when their context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, q.BatchWrite(ctx, q.NewWriteBatch()))
+	assert.Equal(t, 0, q.waiting[FlushWrite])
+
+	storage.unblock <- struct{}{}
+	<-done
+	assert.Equal(t, 1, q.free)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/prometheus/common/log"
+
+	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/agent"
+	"github.com/weaveworks/cortex/util"
+)
+
+func main() {
+	var (
+		serverConfig = server.Config{
+			MetricsNamespace: "cortex",
+		}
+		agentConfig     agent.Config
+		debugConfig     util.DebugConfig
+		adminAuthConfig util.AdminAuthConfig
+	)
+	util.RegisterFlags(&serverConfig, &debugConfig, &agentConfig, &adminAuthConfig)
+	flag.Parse()
+	adminAuth, err := util.NewAdminAuthMiddleware(adminAuthConfig)
+	if err != nil {
+		log.Fatalf("Error initializing admin auth: %v", err)
+	}
+	util.RegisterDebug(debugConfig, &serverConfig, adminAuth)
+
+	a, err := agent.New(agentConfig)
+	if err != nil {
+		log.Fatalf("Error initializing agent: %v", err)
+	}
+	defer a.Stop()
+
+	server, err := util.NewServer(serverConfig, nil)
+	if err != nil {
+		log.Fatalf("Error initializing server: %v", err)
+	}
+	defer server.Shutdown()
+
+	server.Run()
+}
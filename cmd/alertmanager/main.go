@@ -21,8 +21,10 @@ import (
 
 	"github.com/weaveworks/common/middleware"
 	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/admin"
 	"github.com/weaveworks/cortex/alertmanager"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/service"
 )
 
 func main() {
@@ -34,23 +36,53 @@ func main() {
 			},
 		}
 		alertmanagerConfig alertmanager.MultitenantAlertmanagerConfig
+		debugConfig        util.DebugConfig
+		authConfig         util.AuthConfig
+		adminAuthConfig    util.AdminAuthConfig
 	)
-	util.RegisterFlags(&serverConfig, &alertmanagerConfig)
+	util.RegisterFlags(&serverConfig, &debugConfig, &authConfig, &alertmanagerConfig, &adminAuthConfig)
 	flag.Parse()
 
+	authMiddleware, err := util.NewAuthMiddleware(authConfig)
+	if err != nil {
+		log.Fatalf("Error initializing auth: %v", err)
+	}
+	adminAuth, err := util.NewAdminAuthMiddleware(adminAuthConfig)
+	if err != nil {
+		log.Fatalf("Error initializing admin auth: %v", err)
+	}
+	util.RegisterDebug(debugConfig, &serverConfig, adminAuth)
+
+	services := service.NewManager()
+
 	multiAM, err := alertmanager.NewMultitenantAlertmanager(&alertmanagerConfig)
 	if err != nil {
 		log.Fatalf("Error initializing MultitenantAlertmanager: %v", err)
 	}
-	go multiAM.Run()
-	defer multiAM.Stop()
+	services.Add("alertmanager", service.Funcs{
+		StartFunc: func() error {
+			go multiAM.Run()
+			return nil
+		},
+		StopFunc: multiAM.Stop,
+	})
 
-	server, err := server.New(serverConfig)
+	server, err := util.NewServer(serverConfig, nil)
 	if err != nil {
 		log.Fatalf("Error initializing server: %v", err)
 	}
 	defer server.Shutdown()
 
-	server.HTTP.PathPrefix("/api/prom").Handler(middleware.AuthenticateUser.Wrap(multiAM))
+	server.HTTP.PathPrefix("/api/prom").Handler(authMiddleware.Wrap(multiAM))
+	server.HTTP.Handle("/services", services)
+
+	ui := admin.New("alertmanager", flag.CommandLine)
+	ui.Register("services", "Services", services)
+	server.HTTP.PathPrefix(admin.Prefix).Handler(adminAuth.Wrap(ui))
+
+	if err := services.Start(); err != nil {
+		log.Fatalf("Error starting services: %v", err)
+	}
+	defer services.Stop()
 	server.Run()
 }
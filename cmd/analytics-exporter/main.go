@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/analytics"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/distributor"
+	"github.com/weaveworks/cortex/querier"
+	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/util"
+)
+
+func main() {
+	var (
+		serverConfig = server.Config{
+			MetricsNamespace: "cortex",
+			GRPCMiddleware: []grpc.UnaryServerInterceptor{
+				middleware.ServerUserHeaderInterceptor,
+			},
+		}
+		ringConfig        ring.Config
+		distributorConfig distributor.Config
+		analyticsConfig   analytics.Config
+		chunkStoreConfig  chunk.StoreConfig
+		debugConfig       util.DebugConfig
+		adminAuthConfig   util.AdminAuthConfig
+	)
+	util.RegisterFlags(&serverConfig, &debugConfig, &ringConfig, &distributorConfig, &analyticsConfig, &chunkStoreConfig, &adminAuthConfig)
+	flag.Parse()
+	adminAuth, err := util.NewAdminAuthMiddleware(adminAuthConfig)
+	if err != nil {
+		log.Fatalf("Error initializing admin auth: %v", err)
+	}
+	util.RegisterDebug(debugConfig, &serverConfig, adminAuth)
+
+	chunkStore, err := chunk.NewStore(chunkStoreConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var store querier.ChunkStore = chunkStore
+	if chunkStoreConfig.Previous.Enabled() {
+		store, err = chunk.NewCutoverStore(chunkStoreConfig, chunkStore)
+		if err != nil {
+			log.Fatalf("Error initializing previous chunk store: %v", err)
+		}
+	}
+
+	r, err := ring.New(ringConfig)
+	if err != nil {
+		log.Fatalf("Error initializing ring: %v", err)
+	}
+	defer r.Stop()
+
+	dist, err := distributor.New(distributorConfig, r)
+	if err != nil {
+		log.Fatalf("Error initializing distributor: %v", err)
+	}
+	defer dist.Stop()
+	prometheus.MustRegister(dist)
+
+	exporter, err := analytics.New(analyticsConfig, querier.NewEngine(dist, store))
+	if err != nil {
+		log.Fatalf("Error initializing analytics exporter: %v", err)
+	}
+	exporter.Start()
+	defer exporter.Stop()
+
+	server, err := util.NewServer(serverConfig, nil)
+	if err != nil {
+		log.Fatalf("Error initializing server: %v", err)
+	}
+	defer server.Shutdown()
+
+	server.HTTP.Handle("/ring", r)
+	server.Run()
+}
@@ -10,9 +10,11 @@ import (
 
 	"github.com/weaveworks/common/middleware"
 	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/admin"
 	"github.com/weaveworks/cortex/distributor"
 	"github.com/weaveworks/cortex/ring"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/service"
 )
 
 func main() {
@@ -42,30 +44,96 @@ func main() {
 		}
 		ringConfig        ring.Config
 		distributorConfig distributor.Config
+		pushgatewayConfig distributor.PushgatewayConfig
+		debugConfig       util.DebugConfig
+		authConfig        util.AuthConfig
+		adminAuthConfig   util.AdminAuthConfig
 	)
-	util.RegisterFlags(&serverConfig, &ringConfig, &distributorConfig)
+	util.RegisterFlags(&serverConfig, &debugConfig, &authConfig, &ringConfig, &distributorConfig, &pushgatewayConfig, &adminAuthConfig)
 	flag.Parse()
 
+	authMiddleware, err := util.NewAuthMiddleware(authConfig)
+	if err != nil {
+		log.Fatalf("Error initializing auth: %v", err)
+	}
+	adminAuth, err := util.NewAdminAuthMiddleware(adminAuthConfig)
+	if err != nil {
+		log.Fatalf("Error initializing admin auth: %v", err)
+	}
+	util.RegisterDebug(debugConfig, &serverConfig, adminAuth)
+
+	services := service.NewManager()
+
 	r, err := ring.New(ringConfig)
 	if err != nil {
 		log.Fatalf("Error initializing ring: %v", err)
 	}
-	defer r.Stop()
+	services.Add("ring", service.Funcs{
+		StartFunc: r.WaitSynced,
+		StopFunc:  r.Stop,
+	})
+
+	if distributorConfig.DistributorRingEnabled {
+		distributorRingConfig := ringConfig
+		distributorRingConfig.Key = "distributors"
+		registration, err := ring.RegisterIngester(ring.IngesterRegistrationConfig{
+			Config:     distributorRingConfig,
+			ListenPort: &serverConfig.GRPCListenPort,
+		})
+		if err != nil {
+			log.Fatalf("Error registering in distributor ring: %v", err)
+		}
+		services.Add("distributor-ring", service.Funcs{
+			StartFunc: registration.Ring.WaitSynced,
+			StopFunc: func() {
+				registration.Unregister()
+				registration.Ring.Stop()
+			},
+		})
+		distributorConfig.DistributorRing = registration.Ring
+		pushgatewayConfig.Ring = registration.Ring
+		pushgatewayConfig.Addr = registration.Addr()
+	}
 
 	dist, err := distributor.New(distributorConfig, r)
 	if err != nil {
 		log.Fatalf("Error initializing distributor: %v", err)
 	}
-	defer dist.Stop()
 	prometheus.MustRegister(dist)
+	distributorDeps := []string{"ring"}
+	if distributorConfig.DistributorRing != nil {
+		distributorDeps = append(distributorDeps, "distributor-ring")
+	}
+	services.Add("distributor", service.Funcs{StopFunc: dist.Stop}, distributorDeps...)
 
-	server, err := server.New(serverConfig)
+	server, err := util.NewServer(serverConfig, nil)
 	if err != nil {
 		log.Fatalf("Error initializing server: %v", err)
 	}
 	defer server.Shutdown()
 
 	server.HTTP.Handle("/ring", r)
-	server.HTTP.Handle("/api/prom/push", middleware.AuthenticateUser.Wrap(http.HandlerFunc(dist.PushHandler)))
+	server.HTTP.Handle("/ring/safe-to-restart", r.SafeToRestartHandler(distributorConfig.ReplicationFactor))
+	server.HTTP.Handle("/api/prom/push", authMiddleware.Wrap(http.HandlerFunc(dist.PushHandler)))
+	if pushgatewayConfig.Enabled {
+		pushgatewayConfig.OverridesConfig = distributorConfig.OverridesConfig
+		pushgateway, err := distributor.NewPushgateway(pushgatewayConfig, dist)
+		if err != nil {
+			log.Fatalf("Error initializing pushgateway: %v", err)
+		}
+		services.Add("pushgateway", service.Funcs{StopFunc: pushgateway.Stop}, "distributor")
+		server.HTTP.PathPrefix("/api/prom/pushgateway/").Handler(authMiddleware.Wrap(pushgateway))
+	}
+	server.HTTP.Handle("/services", services)
+
+	ui := admin.New("distributor", flag.CommandLine)
+	ui.Register("ring", "Ring", r)
+	ui.Register("services", "Services", services)
+	server.HTTP.PathPrefix(admin.Prefix).Handler(adminAuth.Wrap(ui))
+
+	if err := services.Start(); err != nil {
+		log.Fatalf("Error starting services: %v", err)
+	}
+	defer services.Stop()
 	server.Run()
 }
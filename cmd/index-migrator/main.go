@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+)
+
+func main() {
+	var (
+		chunkStoreConfig chunk.StoreConfig
+		migrateConfig    chunk.MigrateConfig
+	)
+	util.RegisterFlags(&chunkStoreConfig, &migrateConfig)
+	flag.Parse()
+
+	chunkStore, err := chunk.NewStore(chunkStoreConfig)
+	if err != nil {
+		log.Fatalf("Error initializing chunk store: %v", err)
+	}
+
+	migrator, err := chunk.NewMigrator(migrateConfig, chunkStore)
+	if err != nil {
+		log.Fatalf("Error initializing migrator: %v", err)
+	}
+	err = migrator.Run(context.Background())
+	stats := migrator.Stats()
+	log.Infof("Scanned %d entries (%d skipped), found %d chunks, wrote %d entries, %d entries missing",
+		stats.EntriesScanned, stats.EntriesSkipped, stats.Chunks, stats.EntriesWritten, stats.EntriesMissing)
+	if err != nil {
+		log.Fatalf("Error migrating: %v", err)
+	}
+	if migrateConfig.Verify && stats.EntriesMissing > 0 {
+		log.Fatalf("%d entries are missing from the %s schema", stats.EntriesMissing, migrateConfig.ToSchema)
+	}
+}
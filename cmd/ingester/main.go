@@ -3,6 +3,8 @@ package main
 import (
 	"flag"
 	"net/http"
+	"sort"
+	"strconv"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
@@ -11,10 +13,12 @@ import (
 	"github.com/weaveworks/common/middleware"
 	"github.com/weaveworks/common/server"
 	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/admin"
 	"github.com/weaveworks/cortex/chunk"
 	"github.com/weaveworks/cortex/ingester"
 	"github.com/weaveworks/cortex/ring"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/service"
 )
 
 func main() {
@@ -28,41 +32,103 @@ func main() {
 		ingesterRegistrationConfig ring.IngesterRegistrationConfig
 		chunkStoreConfig           chunk.StoreConfig
 		ingesterConfig             ingester.Config
+		debugConfig                util.DebugConfig
+		authConfig                 util.AuthConfig
+		gcConfig                   util.GCConfig
+		adminAuthConfig            util.AdminAuthConfig
 	)
 	// IngesterRegistrator needs to know our gRPC listen port
 	ingesterRegistrationConfig.ListenPort = &serverConfig.GRPCListenPort
-	util.RegisterFlags(&serverConfig, &ingesterRegistrationConfig, &chunkStoreConfig, &ingesterConfig)
+	util.RegisterFlags(&serverConfig, &debugConfig, &authConfig, &gcConfig, &ingesterRegistrationConfig, &chunkStoreConfig, &ingesterConfig, &adminAuthConfig)
 	flag.Parse()
+	util.ApplyGC(gcConfig)
+
+	authMiddleware, err := util.NewAuthMiddleware(authConfig)
+	if err != nil {
+		log.Fatalf("Error initializing auth: %v", err)
+	}
+	adminAuth, err := util.NewAdminAuthMiddleware(adminAuthConfig)
+	if err != nil {
+		log.Fatalf("Error initializing admin auth: %v", err)
+	}
+	util.RegisterDebug(debugConfig, &serverConfig, adminAuth)
+
+	// Services are stopped in the reverse of the order they're started in:
+	// the ingester leaves the ring and flushes its chunks to the store before
+	// it's unregistered, and the ring and store stop after that.
+	services := service.NewManager()
 
 	registration, err := ring.RegisterIngester(ingesterRegistrationConfig)
 	if err != nil {
 		log.Fatalf("Could not register ingester: %v", err)
 	}
-	defer registration.Ring.Stop()
+	services.Add("ring", service.Funcs{
+		StartFunc: registration.Ring.WaitSynced,
+		StopFunc:  registration.Ring.Stop,
+	})
+	services.Add("registration", service.Funcs{StopFunc: registration.Unregister}, "ring")
 
 	chunkStore, err := chunk.NewStore(chunkStoreConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	ingester, err := ingester.New(ingesterConfig, chunkStore, registration.Ring)
+	var flushStore ingester.ChunkStore = chunkStore
+	if chunkStoreConfig.Mirror.Enabled() {
+		mirrorStore, err := chunk.NewMirrorStore(chunkStoreConfig, chunkStore)
+		if err != nil {
+			log.Fatal(err)
+		}
+		flushStore = mirrorStore
+		services.Add("store", service.Funcs{StopFunc: mirrorStore.Stop})
+	} else {
+		services.Add("store", service.Funcs{})
+	}
+
+	ingesterConfig.Addr = registration.Addr()
+	ingester, err := ingester.New(ingesterConfig, flushStore, registration.Ring)
 	if err != nil {
 		log.Fatal(err)
 	}
 	prometheus.MustRegister(ingester)
+	services.Add("ingester", service.Funcs{
+		StopFunc: func() {
+			registration.ChangeState(ring.LEAVING)
+			ingester.Stop()
+		},
+	}, "registration", "store")
 
-	server, err := server.New(serverConfig)
+	server, err := util.NewServer(serverConfig, ingester.IsReady)
 	if err != nil {
 		log.Fatalf("Error initializing server: %v", err)
 	}
 	cortex.RegisterIngesterServer(server.GRPC, ingester)
 	server.HTTP.Handle("/ring", registration.Ring)
 	server.HTTP.Path("/ready").Handler(http.HandlerFunc(ingester.ReadinessHandler))
-	server.Run()
+	server.HTTP.Path("/activity").Handler(adminAuth.Wrap(http.HandlerFunc(chunkStore.ActivityHandler)))
+	server.HTTP.Path("/debug/series").Handler(authMiddleware.Wrap(http.HandlerFunc(ingester.SeriesHandler)))
+	server.HTTP.Handle("/services", services)
 
-	// Shutdown order is important!
-	registration.ChangeState(ring.LEAVING)
-	ingester.Stop()
-	registration.Unregister()
+	ui := admin.New("ingester", flag.CommandLine)
+	ui.Register("ring", "Ring", registration.Ring)
+	ui.Register("services", "Services", services)
+	ui.RegisterTable("tenants", "Tenants", []string{"Tenant", "Series", "Ingestion rate (samples/s)"}, func() ([][]string, error) {
+		stats := ingester.AllUserStats()
+		rows := make([][]string, 0, len(stats))
+		for userID, s := range stats {
+			rows = append(rows, []string{userID, strconv.FormatUint(s.NumSeries, 10), strconv.FormatFloat(s.IngestionRate, 'f', 2, 64)})
+		}
+		sort.Slice(rows, func(i, j int) bool { return rows[i][0] < rows[j][0] })
+		return rows, nil
+	})
+	server.HTTP.PathPrefix(admin.Prefix).Handler(adminAuth.Wrap(ui))
+
+	// The server only accepts pushes once everything the ingester depends on
+	// is running.
+	if err := services.Start(); err != nil {
+		log.Fatalf("Error starting services: %v", err)
+	}
+	server.Run()
+	services.Stop()
 	server.Shutdown()
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+
+	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/validation"
+)
+
+func main() {
+	var (
+		serverConfig = server.Config{
+			MetricsNamespace: "cortex",
+		}
+		overridesConfig validation.OverridesConfig
+		defaults        validation.Limits
+		debugConfig     util.DebugConfig
+		adminAuthConfig util.AdminAuthConfig
+	)
+	// The defaults are given by the same flags as in the components using
+	// them, so this can be run with the same arguments.
+	util.RegisterFlags(&serverConfig, &debugConfig, &overridesConfig, &defaults, &adminAuthConfig)
+	flag.Parse()
+	adminAuth, err := util.NewAdminAuthMiddleware(adminAuthConfig)
+	if err != nil {
+		log.Fatalf("Error initializing admin auth: %v", err)
+	}
+	util.RegisterDebug(debugConfig, &serverConfig, adminAuth)
+
+	if overridesConfig.File == "" {
+		log.Fatalf("-limits.per-user-override-config must be set")
+	}
+	overrides, err := validation.NewOverrides(overridesConfig, defaults)
+	if err != nil {
+		log.Fatalf("Error initializing overrides: %v", err)
+	}
+	defer overrides.Stop()
+	prometheus.MustRegister(validation.NewOverridesExporter(overrides))
+
+	server, err := util.NewServer(serverConfig, nil)
+	if err != nil {
+		log.Fatalf("Error initializing server: %v", err)
+	}
+	defer server.Shutdown()
+
+	server.Run()
+}
@@ -16,11 +16,15 @@ import (
 
 	"github.com/weaveworks/common/middleware"
 	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/admin"
 	"github.com/weaveworks/cortex/chunk"
 	"github.com/weaveworks/cortex/distributor"
+	"github.com/weaveworks/cortex/frontend"
 	"github.com/weaveworks/cortex/querier"
 	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/storegateway"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/service"
 )
 
 type dummyTargetRetriever struct{}
@@ -42,47 +46,154 @@ func main() {
 		ringConfig        ring.Config
 		distributorConfig distributor.Config
 		chunkStoreConfig  chunk.StoreConfig
+		querierConfig     querier.Config
+		workerConfig      frontend.WorkerConfig
+		gatewayConfig     storegateway.ClientConfig
+		debugConfig       util.DebugConfig
+		authConfig        util.AuthConfig
+		gcConfig          util.GCConfig
+		adminAuthConfig   util.AdminAuthConfig
 	)
-	util.RegisterFlags(&serverConfig, &ringConfig, &distributorConfig, &chunkStoreConfig)
+	util.RegisterFlags(&serverConfig, &debugConfig, &authConfig, &gcConfig, &ringConfig, &distributorConfig, &chunkStoreConfig, &querierConfig, &workerConfig, &gatewayConfig, &adminAuthConfig)
 	flag.Parse()
+	if err := gatewayConfig.Validate(); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	if err := querierConfig.Validate(); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	util.ApplyGC(gcConfig)
+	querierConfig.ApplyLookbackDelta()
+
+	authMiddleware, err := util.NewAuthMiddleware(authConfig)
+	if err != nil {
+		log.Fatalf("Error initializing auth: %v", err)
+	}
+	adminAuth, err := util.NewAdminAuthMiddleware(adminAuthConfig)
+	if err != nil {
+		log.Fatalf("Error initializing admin auth: %v", err)
+	}
+	util.RegisterDebug(debugConfig, &serverConfig, adminAuth)
+
+	querierConfig.OverridesConfig = distributorConfig.OverridesConfig
+
+	services := service.NewManager()
 
 	r, err := ring.New(ringConfig)
 	if err != nil {
 		log.Fatalf("Error initializing ring: %v", err)
 	}
-	defer r.Stop()
+	services.Add("ring", service.Funcs{
+		StartFunc: r.WaitSynced,
+		StopFunc:  r.Stop,
+	})
 
 	dist, err := distributor.New(distributorConfig, r)
 	if err != nil {
 		log.Fatalf("Error initializing distributor: %v", err)
 	}
-	defer dist.Stop()
 	prometheus.MustRegister(dist)
+	services.Add("distributor", service.Funcs{StopFunc: dist.Stop}, "ring")
 
-	server, err := server.New(serverConfig)
+	server, err := util.NewServer(serverConfig, nil)
 	if err != nil {
 		log.Fatalf("Error initializing server: %v", err)
 	}
 	defer server.Shutdown()
 	server.HTTP.Handle("/ring", r)
+	server.HTTP.Handle("/ring/safe-to-restart", r.SafeToRestartHandler(distributorConfig.ReplicationFactor))
 
-	chunkStore, err := chunk.NewStore(chunkStoreConfig)
+	limits, err := querierConfig.NewOverrides()
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("Error initializing limits: %v", err)
 	}
-
-	queryable := querier.NewQueryable(dist, chunkStore)
-	engine := promql.NewEngine(queryable, nil)
+	services.Add("limits", service.Funcs{StopFunc: limits.Stop})
+
+	var queryable querier.Queryable
+	var gatewayRing *ring.Ring
+	if gatewayConfig.RingEnabled {
+		gatewayRingConfig := ringConfig
+		gatewayRingConfig.Key = storegateway.RingKey
+		gatewayRing, err = ring.New(gatewayRingConfig)
+		if err != nil {
+			log.Fatalf("Error initializing store gateway ring: %v", err)
+		}
+		client := storegateway.NewShardedClient(gatewayConfig, gatewayRing)
+		services.Add("store-gateway-ring", service.Funcs{
+			StartFunc: gatewayRing.WaitSynced,
+			StopFunc: func() {
+				client.Stop()
+				gatewayRing.Stop()
+			},
+		})
+		queryable = querier.NewStoreGatewayQueryable(dist, client)
+	} else if gatewayConfig.Address != "" {
+		client, closeClient, err := storegateway.NewClient(gatewayConfig)
+		if err != nil {
+			log.Fatalf("Error initializing store gateway client: %v", err)
+		}
+		services.Add("store-gateway-client", service.Funcs{StopFunc: func() { closeClient() }})
+		queryable = querier.NewStoreGatewayQueryable(dist, client)
+	} else {
+		chunkStore, err := chunk.NewStore(chunkStoreConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var store querier.ChunkStore = chunkStore
+		if chunkStoreConfig.Previous.Enabled() {
+			store, err = chunk.NewCutoverStore(chunkStoreConfig, chunkStore)
+			if err != nil {
+				log.Fatalf("Error initializing previous chunk store: %v", err)
+			}
+		}
+		queryable = querier.NewQueryable(dist, store)
+		server.HTTP.Path("/tenant_tables").Handler(adminAuth.Wrap(http.HandlerFunc(chunkStore.TenantTablesHandler)))
+	}
+	engine := promql.NewEngine(queryable, querierConfig.EngineOptions())
 	api := v1.NewAPI(engine, querier.DummyStorage{Queryable: queryable}, dummyTargetRetriever{}, dummyAlertmanagerRetriever{})
 	promRouter := route.New(func(r *http.Request) (context.Context, error) {
 		return r.Context(), nil
 	}).WithPrefix("/api/prom/api/v1")
 	api.Register(promRouter)
 
+	slowQueryLog := querier.NewSlowQueryLog(querierConfig.SlowQueryLog)
 	subrouter := server.HTTP.PathPrefix("/api/prom").Subrouter()
-	subrouter.PathPrefix("/api/v1").Handler(middleware.AuthenticateUser.Wrap(promRouter))
-	subrouter.Path("/validate_expr").Handler(middleware.AuthenticateUser.Wrap(http.HandlerFunc(dist.ValidateExprHandler)))
-	subrouter.Path("/user_stats").Handler(middleware.AuthenticateUser.Wrap(http.HandlerFunc(dist.UserStatsHandler)))
+	subrouter.Path("/api/v1/status/buildinfo").Handler(http.HandlerFunc(querier.BuildInfoHandler))
+	// The flags are the whole querier's config, not the tenant's.
+	subrouter.Path("/api/v1/status/flags").Handler(adminAuth.Wrap(querier.FlagsHandler(flag.CommandLine)))
+	subrouter.PathPrefix("/api/v1").Handler(middleware.Merge(
+		authMiddleware,
+		querier.ReportQueryStats(),
+		slowQueryLog,
+		querier.MaxResponseSize(limits),
+		querier.BlockQueries(limits),
+		querier.ClampLookback(limits),
+		querier.MaxPointsPerSeries(querierConfig.MaxPointsPerSeries),
+	).Wrap(promRouter))
+	subrouter.Path("/validate_expr").Handler(authMiddleware.Wrap(http.HandlerFunc(dist.ValidateExprHandler)))
+	subrouter.Path("/user_stats").Handler(authMiddleware.Wrap(http.HandlerFunc(dist.UserStatsHandler)))
+	subrouter.Path("/federate").Handler(authMiddleware.Wrap(querier.FederateHandler(dist)))
+
+	if workerConfig.Address != "" {
+		worker, err := frontend.NewWorker(workerConfig, slowQueryLog.WrapQueryRange(querier.NewQueryRangeHandler(engine, querierConfig.MaxPointsPerSeries, limits)), server.HTTP)
+		if err != nil {
+			log.Fatalf("Error initializing frontend worker: %v", err)
+		}
+		services.Add("worker", service.Funcs{StopFunc: worker.Stop}, "distributor", "limits")
+	}
+	server.HTTP.Handle("/services", services)
 
+	ui := admin.New("querier", flag.CommandLine)
+	ui.Register("ring", "Ring", r)
+	if gatewayRing != nil {
+		ui.Register("store-gateway-ring", "Store gateway ring", gatewayRing)
+	}
+	ui.Register("services", "Services", services)
+	server.HTTP.PathPrefix(admin.Prefix).Handler(adminAuth.Wrap(ui))
+
+	if err := services.Start(); err != nil {
+		log.Fatalf("Error starting services: %v", err)
+	}
+	defer services.Stop()
 	server.Run()
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/prometheus/common/log"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/admin"
+	"github.com/weaveworks/cortex/frontend"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/service"
+)
+
+func main() {
+	var (
+		serverConfig = server.Config{
+			MetricsNamespace: "cortex",
+			GRPCMiddleware: []grpc.UnaryServerInterceptor{
+				middleware.ServerUserHeaderInterceptor,
+			},
+		}
+		frontendConfig  frontend.Config
+		debugConfig     util.DebugConfig
+		authConfig      util.AuthConfig
+		adminAuthConfig util.AdminAuthConfig
+	)
+	util.RegisterFlags(&serverConfig, &debugConfig, &authConfig, &frontendConfig, &adminAuthConfig)
+	flag.Parse()
+	if err := frontendConfig.Validate(); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+
+	authMiddleware, err := util.NewAuthMiddleware(authConfig)
+	if err != nil {
+		log.Fatalf("Error initializing auth: %v", err)
+	}
+	adminAuth, err := util.NewAdminAuthMiddleware(adminAuthConfig)
+	if err != nil {
+		log.Fatalf("Error initializing admin auth: %v", err)
+	}
+	util.RegisterDebug(debugConfig, &serverConfig, adminAuth)
+
+	services := service.NewManager()
+
+	limits, err := frontendConfig.NewOverrides()
+	if err != nil {
+		log.Fatalf("Error initializing limits: %v", err)
+	}
+	services.Add("limits", service.Funcs{StopFunc: limits.Stop})
+
+	f := frontend.New(frontendConfig, limits)
+
+	server, err := util.NewServer(serverConfig, nil)
+	if err != nil {
+		log.Fatalf("Error initializing server: %v", err)
+	}
+	defer server.Shutdown()
+
+	frontend.RegisterFrontendServer(server.GRPC, f)
+	server.HTTP.PathPrefix("/api/prom").Handler(middleware.Merge(
+		authMiddleware,
+		frontend.RateLimit(limits),
+		frontend.NewInstantQueryCache(frontendConfig.InstantQueryCache),
+	).Wrap(f))
+	server.HTTP.Handle("/services", services)
+
+	ui := admin.New("query-frontend", flag.CommandLine)
+	ui.Register("services", "Services", services)
+	server.HTTP.PathPrefix(admin.Prefix).Handler(adminAuth.Wrap(ui))
+
+	if err := services.Start(); err != nil {
+		log.Fatalf("Error starting services: %v", err)
+	}
+	defer services.Stop()
+	server.Run()
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"net/http"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
@@ -9,11 +10,14 @@ import (
 
 	"github.com/weaveworks/common/middleware"
 	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/admin"
 	"github.com/weaveworks/cortex/chunk"
 	"github.com/weaveworks/cortex/distributor"
+	"github.com/weaveworks/cortex/querier"
 	"github.com/weaveworks/cortex/ring"
 	"github.com/weaveworks/cortex/ruler"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/service"
 )
 
 func main() {
@@ -28,46 +32,128 @@ func main() {
 		distributorConfig distributor.Config
 		rulerConfig       ruler.Config
 		chunkStoreConfig  chunk.StoreConfig
+		debugConfig       util.DebugConfig
+		authConfig        util.AuthConfig
+		adminAuthConfig   util.AdminAuthConfig
 	)
-	util.RegisterFlags(&serverConfig, &ringConfig, &distributorConfig, &rulerConfig, &chunkStoreConfig)
+	util.RegisterFlags(&serverConfig, &debugConfig, &authConfig, &ringConfig, &distributorConfig, &rulerConfig, &chunkStoreConfig, &adminAuthConfig)
 	flag.Parse()
+	rulerConfig.OverridesConfig = distributorConfig.OverridesConfig
+
+	authMiddleware, err := util.NewAuthMiddleware(authConfig)
+	if err != nil {
+		log.Fatalf("Error initializing auth: %v", err)
+	}
+	adminAuth, err := util.NewAdminAuthMiddleware(adminAuthConfig)
+	if err != nil {
+		log.Fatalf("Error initializing admin auth: %v", err)
+	}
+	util.RegisterDebug(debugConfig, &serverConfig, adminAuth)
 
 	chunkStore, err := chunk.NewStore(chunkStoreConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
+	var store querier.ChunkStore = chunkStore
+	if chunkStoreConfig.Previous.Enabled() {
+		store, err = chunk.NewCutoverStore(chunkStoreConfig, chunkStore)
+		if err != nil {
+			log.Fatalf("Error initializing previous chunk store: %v", err)
+		}
+	}
+
+	services := service.NewManager()
 
 	r, err := ring.New(ringConfig)
 	if err != nil {
 		log.Fatalf("Error initializing ring: %v", err)
 	}
-	defer r.Stop()
+	services.Add("ring", service.Funcs{
+		StartFunc: r.WaitSynced,
+		StopFunc:  r.Stop,
+	})
+
+	evaluatorRingConfig := ringConfig
+	evaluatorRingConfig.Key = ruler.EvaluatorRingKey
+	rulerDeps := []string{"distributor"}
+	if rulerConfig.RemoteEvaluationMinRules > 0 {
+		evaluatorRing, err := ring.New(evaluatorRingConfig)
+		if err != nil {
+			log.Fatalf("Error initializing rule evaluator ring: %v", err)
+		}
+		services.Add("evaluator-ring", service.Funcs{
+			StartFunc: evaluatorRing.WaitSynced,
+			StopFunc:  evaluatorRing.Stop,
+		})
+		rulerConfig.RemoteEvaluationRing = evaluatorRing
+		rulerDeps = append(rulerDeps, "evaluator-ring")
+	}
 
 	dist, err := distributor.New(distributorConfig, r)
 	if err != nil {
 		log.Fatalf("Error initializing distributor: %v", err)
 	}
-	defer dist.Stop()
 	prometheus.MustRegister(dist)
+	services.Add("distributor", service.Funcs{StopFunc: dist.Stop}, "ring")
 
-	rlr, err := ruler.NewRuler(rulerConfig, dist, chunkStore)
+	rlr, err := ruler.NewRuler(rulerConfig, dist, store)
 	if err != nil {
 		log.Fatalf("Error initializing ruler: %v", err)
 	}
-	defer rlr.Stop()
+	services.Add("ruler", service.Funcs{StopFunc: rlr.Stop}, rulerDeps...)
 
-	rulerServer, err := ruler.NewServer(rulerConfig, rlr)
-	if err != nil {
-		log.Fatalf("Error initializing ruler server: %v", err)
+	// Rulers in the pool of rule evaluators serve it on a listener of its
+	// own, only reachable by other rulers, and join it once they're serving.
+	if rulerConfig.RemoteEvaluationListenPort > 0 {
+		evaluationServer, err := ruler.NewEvaluationServer(rulerConfig, rlr)
+		if err != nil {
+			log.Fatalf("Error initializing rule evaluation server: %v", err)
+		}
+		services.Add("evaluation-server", service.Funcs{StopFunc: evaluationServer.Stop}, "ruler")
+		registration, err := ring.RegisterIngester(ring.IngesterRegistrationConfig{
+			Config:     evaluatorRingConfig,
+			ListenPort: &rulerConfig.RemoteEvaluationListenPort,
+			NumTokens:  rulerConfig.RemoteEvaluationNumTokens,
+		})
+		if err != nil {
+			log.Fatalf("Error registering in rule evaluator ring: %v", err)
+		}
+		services.Add("evaluator-registration", service.Funcs{
+			StopFunc: func() {
+				registration.Unregister()
+				registration.Ring.Stop()
+			},
+		}, "evaluation-server")
 	}
-	defer rulerServer.Stop()
 
-	server, err := server.New(serverConfig)
+	// Rulers without workers only evaluate rule groups offloaded to them.
+	if rulerConfig.NumWorkers > 0 {
+		rulerServer, err := ruler.NewServer(rulerConfig, rlr)
+		if err != nil {
+			log.Fatalf("Error initializing ruler server: %v", err)
+		}
+		services.Add("ruler-server", service.Funcs{StopFunc: rulerServer.Stop}, "ruler")
+	}
+
+	server, err := util.NewServer(serverConfig, nil)
 	if err != nil {
 		log.Fatalf("Error initializing server: %v", err)
 	}
 	defer server.Shutdown()
 
 	server.HTTP.Handle("/ring", r)
+	server.HTTP.Handle("/api/prom/rules/test", authMiddleware.Wrap(http.HandlerFunc(rlr.TestRulesHandler)))
+
+	server.HTTP.Handle("/services", services)
+
+	ui := admin.New("ruler", flag.CommandLine)
+	ui.Register("ring", "Ring", r)
+	ui.Register("services", "Services", services)
+	server.HTTP.PathPrefix(admin.Prefix).Handler(adminAuth.Wrap(ui))
+
+	if err := services.Start(); err != nil {
+		log.Fatalf("Error starting services: %v", err)
+	}
+	defer services.Stop()
 	server.Run()
 }
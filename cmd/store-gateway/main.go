@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+
+	"github.com/prometheus/common/log"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/admin"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/storegateway"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/service"
+)
+
+func main() {
+	var (
+		serverConfig = server.Config{
+			MetricsNamespace: "cortex",
+			GRPCMiddleware: []grpc.UnaryServerInterceptor{
+				middleware.ServerUserHeaderInterceptor,
+			},
+		}
+		ringConfig       ring.Config
+		chunkStoreConfig chunk.StoreConfig
+		gatewayConfig    storegateway.Config
+		debugConfig      util.DebugConfig
+		gcConfig         util.GCConfig
+		adminAuthConfig  util.AdminAuthConfig
+	)
+	util.RegisterFlags(&serverConfig, &debugConfig, &gcConfig, &ringConfig, &chunkStoreConfig, &gatewayConfig, &adminAuthConfig)
+	flag.Parse()
+	util.ApplyGC(gcConfig)
+	adminAuth, err := util.NewAdminAuthMiddleware(adminAuthConfig)
+	if err != nil {
+		log.Fatalf("Error initializing admin auth: %v", err)
+	}
+	util.RegisterDebug(debugConfig, &serverConfig, adminAuth)
+
+	chunkStore, err := chunk.NewStore(chunkStoreConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var store storegateway.Store = chunkStore
+	if chunkStoreConfig.Previous.Enabled() {
+		store, err = chunk.NewCutoverStore(chunkStoreConfig, chunkStore)
+		if err != nil {
+			log.Fatalf("Error initializing previous chunk store: %v", err)
+		}
+	}
+
+	server, err := util.NewServer(serverConfig, nil)
+	if err != nil {
+		log.Fatalf("Error initializing server: %v", err)
+	}
+	defer server.Shutdown()
+
+	storegateway.RegisterStoreGatewayServer(server.GRPC, storegateway.New(gatewayConfig, store))
+	ui := admin.New("store-gateway", flag.CommandLine)
+
+	services := service.NewManager()
+	if gatewayConfig.RingEnabled {
+		gatewayRingConfig := ringConfig
+		gatewayRingConfig.Key = storegateway.RingKey
+		registration, err := ring.RegisterIngester(ring.IngesterRegistrationConfig{
+			Config:     gatewayRingConfig,
+			ListenPort: &serverConfig.GRPCListenPort,
+			NumTokens:  gatewayConfig.NumTokens,
+		})
+		if err != nil {
+			log.Fatalf("Error registering in store gateway ring: %v", err)
+		}
+		services.Add("ring", service.Funcs{
+			StartFunc: registration.Ring.WaitSynced,
+			StopFunc: func() {
+				registration.Unregister()
+				registration.Ring.Stop()
+			},
+		})
+		server.HTTP.Handle("/ring", registration.Ring)
+		ui.Register("ring", "Ring", registration.Ring)
+	}
+	server.HTTP.Handle("/services", services)
+	server.HTTP.Path("/tenant_tables").Handler(adminAuth.Wrap(http.HandlerFunc(chunkStore.TenantTablesHandler)))
+	ui.Register("services", "Services", services)
+	server.HTTP.PathPrefix(admin.Prefix).Handler(adminAuth.Wrap(ui))
+
+	if err := services.Start(); err != nil {
+		log.Fatalf("Error starting services: %v", err)
+	}
+	defer services.Stop()
+	server.Run()
+}
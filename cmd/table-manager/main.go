@@ -2,14 +2,18 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"strconv"
 
 	"github.com/prometheus/common/log"
 	"google.golang.org/grpc"
 
 	"github.com/weaveworks/common/middleware"
 	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/admin"
 	"github.com/weaveworks/cortex/chunk"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/service"
 )
 
 func main() {
@@ -21,22 +25,59 @@ func main() {
 			},
 		}
 		tableManagerConfig = chunk.TableManagerConfig{}
+		debugConfig        util.DebugConfig
+		adminAuthConfig    util.AdminAuthConfig
 	)
-	util.RegisterFlags(&serverConfig, &tableManagerConfig)
+	util.RegisterFlags(&serverConfig, &debugConfig, &tableManagerConfig, &adminAuthConfig)
 	flag.Parse()
+	adminAuth, err := util.NewAdminAuthMiddleware(adminAuthConfig)
+	if err != nil {
+		log.Fatalf("Error initializing admin auth: %v", err)
+	}
+	util.RegisterDebug(debugConfig, &serverConfig, adminAuth)
 
 	tableManager, err := chunk.NewDynamoTableManager(tableManagerConfig)
 	if err != nil {
 		log.Fatalf("Error initializing DynamoDB table manager: %v", err)
 	}
-	tableManager.Start()
-	defer tableManager.Stop()
+	services := service.NewManager()
+	services.Add("table-manager", service.Funcs{
+		StartFunc: func() error {
+			tableManager.Start()
+			return nil
+		},
+		StopFunc: tableManager.Stop,
+	})
 
-	server, err := server.New(serverConfig)
+	server, err := util.NewServer(serverConfig, nil)
 	if err != nil {
 		log.Fatalf("Error initializing server: %v", err)
 	}
 	defer server.Shutdown()
 
+	ui := admin.New("table-manager", flag.CommandLine)
+	ui.RegisterTable("tables", "Tables", []string{"Table", "Read capacity", "Write capacity", "Active", "Updating since"}, func() ([][]string, error) {
+		tables, synced, err := tableManager.Status()
+		rows := make([][]string, 0, len(tables))
+		for _, t := range tables {
+			updating := ""
+			if !t.UpdatingSince.IsZero() {
+				updating = t.UpdatingSince.String()
+			}
+			rows = append(rows, []string{t.Name, strconv.FormatInt(t.ProvisionedRead, 10), strconv.FormatInt(t.ProvisionedWrite, 10), strconv.FormatBool(t.Active), updating})
+		}
+		if err != nil {
+			err = fmt.Errorf("syncing tables at %s failed: %v", synced, err)
+		}
+		return rows, err
+	})
+	ui.Register("services", "Services", services)
+	server.HTTP.Handle("/services", services)
+	server.HTTP.PathPrefix(admin.Prefix).Handler(adminAuth.Wrap(ui))
+
+	if err := services.Start(); err != nil {
+		log.Fatalf("Error starting services: %v", err)
+	}
+	defer services.Stop()
 	server.Run()
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/prometheus/common/log"
+
+	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/testexporter"
+	"github.com/weaveworks/cortex/util"
+)
+
+func main() {
+	var (
+		serverConfig = server.Config{
+			MetricsNamespace: "cortex",
+		}
+		exporterConfig  testexporter.Config
+		debugConfig     util.DebugConfig
+		adminAuthConfig util.AdminAuthConfig
+	)
+	util.RegisterFlags(&serverConfig, &debugConfig, &exporterConfig, &adminAuthConfig)
+	flag.Parse()
+	adminAuth, err := util.NewAdminAuthMiddleware(adminAuthConfig)
+	if err != nil {
+		log.Fatalf("Error initializing admin auth: %v", err)
+	}
+	util.RegisterDebug(debugConfig, &serverConfig, adminAuth)
+
+	exporter, err := testexporter.New(exporterConfig)
+	if err != nil {
+		log.Fatalf("Error initializing test exporter: %v", err)
+	}
+	defer exporter.Stop()
+
+	server, err := util.NewServer(serverConfig, nil)
+	if err != nil {
+		log.Fatalf("Error initializing server: %v", err)
+	}
+	defer server.Shutdown()
+
+	server.Run()
+}
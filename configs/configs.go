@@ -65,16 +65,31 @@ func (c CortexConfigsResponse) GetLatestConfigID() ConfigID {
 }
 
 // GetRules gets the rules from the Cortex configuration.
-//
-// Strongly inspired by `loadGroups` in Prometheus.
 func (c CortexConfig) GetRules() ([]rules.Rule, error) {
+	namespaces, err := c.GetNamespacedRules()
+	if err != nil {
+		return nil, err
+	}
 	result := []rules.Rule{}
+	for _, rs := range namespaces {
+		result = append(result, rs...)
+	}
+	return result, nil
+}
+
+// GetNamespacedRules gets the rules from the Cortex configuration, by the
+// name of the rules file they're in.
+//
+// Strongly inspired by `loadGroups` in Prometheus.
+func (c CortexConfig) GetNamespacedRules() (map[string][]rules.Rule, error) {
+	result := map[string][]rules.Rule{}
 	for fn, content := range c.RulesFiles {
 		stmts, err := promql.ParseStmts(content)
 		if err != nil {
 			return nil, fmt.Errorf("error parsing %s: %s", fn, err)
 		}
 
+		rs := []rules.Rule{}
 		for _, stmt := range stmts {
 			var rule rules.Rule
 
@@ -88,8 +103,9 @@ func (c CortexConfig) GetRules() ([]rules.Rule, error) {
 			default:
 				return nil, fmt.Errorf("ruler.GetRules: unknown statement type")
 			}
-			result = append(result, rule)
+			rs = append(rs, rule)
 		}
+		result[fn] = rs
 	}
 	return result, nil
 }
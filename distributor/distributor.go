@@ -1,10 +1,10 @@
 package distributor
 
 import (
-	"errors"
 	"flag"
 	"fmt"
 	"hash/fnv"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -27,9 +27,12 @@ import (
 	"github.com/weaveworks/cortex"
 	"github.com/weaveworks/cortex/ring"
 	"github.com/weaveworks/cortex/util"
+	cortex_errors "github.com/weaveworks/cortex/util/errors"
+	"github.com/weaveworks/cortex/util/validation"
+	"github.com/weaveworks/cortex/validator"
 )
 
-var errIngestionRateLimitExceeded = errors.New("ingestion rate limit exceeded")
+var errIngestionRateLimitExceeded = cortex_errors.New(cortex_errors.RateLimited, "ingestion rate limit exceeded")
 
 var (
 	numClientsDesc = prometheus.NewDesc(
@@ -40,20 +43,36 @@ var (
 	labelNameBytes = []byte(model.MetricNameLabel)
 )
 
+const (
+	// Number of recent ingester query latencies to work out the hedging
+	// delay from, and the number needed before we start hedging.
+	queryHedgingWindowSize = 1000
+	queryHedgingMinSamples = 100
+)
+
 // Distributor is a storage.SampleAppender and a cortex.Querier which
 // forwards appends and queries to individual ingesters.
 type Distributor struct {
 	cfg        Config
 	ring       ReadRing
+	limits     *validation.Overrides
 	clientsMtx sync.RWMutex
 	clients    map[string]ingesterClient
 	quit       chan struct{}
 	done       chan struct{}
+	stopWatch  func()
 
 	// Per-user rate limiters.
 	ingestLimitersMtx sync.Mutex
 	ingestLimiters    map[string]*rate.Limiter
 
+	// Results of recent pushes, by idempotency key; nil if disabled.
+	idempotency *idempotencyCache
+
+	// Checks pushed series; nil if none is configured.
+	validator      validator.Validator
+	closeValidator func() error
+
 	queryDuration          *prometheus.HistogramVec
 	receivedSamples        prometheus.Counter
 	sendDuration           *prometheus.HistogramVec
@@ -61,6 +80,11 @@ type Distributor struct {
 	ingesterAppendFailures *prometheus.CounterVec
 	ingesterQueries        *prometheus.CounterVec
 	ingesterQueryFailures  *prometheus.CounterVec
+	hedgedIngesterQueries  prometheus.Counter
+	dedupedPushes          prometheus.Counter
+
+	// Recent ingester query latencies, to work out when to hedge queries.
+	queryLatencies *util.LatencyWindow
 }
 
 type ingesterClient struct {
@@ -75,6 +99,12 @@ type ReadRing interface {
 	Get(key uint32, n int, op ring.Operation) ([]*ring.IngesterDesc, error)
 	BatchGet(keys []uint32, n int, op ring.Operation) ([][]*ring.IngesterDesc, error)
 	GetAll() []*ring.IngesterDesc
+	Watch(f func(*ring.Snapshot)) (stop func())
+}
+
+// DistributorRing counts the live distributors.
+type DistributorRing interface {
+	ActiveCount() int
 }
 
 // Config contains the configuration require to
@@ -86,6 +116,47 @@ type Config struct {
 	ClientCleanupPeriod time.Duration
 	IngestionRateLimit  float64
 	IngestionBurstSize  int
+	IdempotencyWindow   time.Duration
+
+	// Shard series across ingesters by all their labels rather than just
+	// their metric name, so a few huge metrics don't overload a few
+	// ingesters.  Queries then go to every ingester.
+	//
+	// To switch without queriers missing recent samples, first run all
+	// distributors and queriers with ShardByAllLabelsMigration, which writes
+	// each sample to the ingesters for both schemes and queries every
+	// ingester.  Once all have been restarted with it, and ingesters have
+	// flushed everything received before (-ingester.max-chunk-age), switch
+	// to ShardByAllLabels.
+	ShardByAllLabels          bool
+	ShardByAllLabelsMigration bool
+
+	// Query only as many ingesters as we need responses from, querying
+	// another if one fails or hasn't responded within this percentile of
+	// recent ingester query latencies, to mask slow ingesters (e.g. during
+	// GC pauses) without querying every replica.  0 queries all replicas.
+	QueryHedgePercentile float64
+
+	// The availability zone of this querier.  If set, queries go to ingesters
+	// in the same zone first, and only go to other zones for as many more
+	// responses as a quorum needs, or when they fail, reducing inter-zone
+	// transfer.
+	Zone string
+
+	// The defaults of CreationGracePeriod and MaxSampleAge, and their
+	// overrides per tenant.
+	Limits          validation.Limits
+	OverridesConfig validation.OverridesConfig
+
+	// Register in a ring of the distributors, set as DistributorRing, and
+	// divide tenants' ingestion rate limits between those live, so the
+	// limits don't grow with the number of distributors.
+	DistributorRingEnabled bool
+	DistributorRing        DistributorRing
+
+	// Check pushed series with a validator, built in or a sidecar, which can
+	// reject them or rewrite their labels.
+	SeriesValidatorConfig validator.Config
 
 	// for testing
 	ingesterClientFactory func(string) cortex.IngesterClient
@@ -99,6 +170,15 @@ func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	flag.DurationVar(&cfg.ClientCleanupPeriod, "distributor.client-cleanup-period", 15*time.Second, "How frequently to clean up clients for ingesters that have gone away.")
 	flag.Float64Var(&cfg.IngestionRateLimit, "distributor.ingestion-rate-limit", 25000, "Per-user ingestion rate limit in samples per second.")
 	flag.IntVar(&cfg.IngestionBurstSize, "distributor.ingestion-burst-size", 50000, "Per-user allowed ingestion burst size (in number of samples).")
+	flag.DurationVar(&cfg.IdempotencyWindow, "distributor.idempotency-window", 0, "How long to remember pushes by their Idempotency-Key header, so retries of them aren't ingested again (0 to disable).  Each distributor remembers only the pushes it received, so retries are only deduped if they reach the same distributor.")
+	flag.BoolVar(&cfg.ShardByAllLabels, "distributor.shard-by-all-labels", false, "Distribute series to ingesters by all their labels, rather than just their metric name.")
+	flag.BoolVar(&cfg.ShardByAllLabelsMigration, "distributor.shard-by-all-labels.migrate", false, "Write samples to ingesters under both metric name and all labels sharding, and query all ingesters, while migrating to -distributor.shard-by-all-labels.")
+	flag.Float64Var(&cfg.QueryHedgePercentile, "distributor.query-hedge-percentile", 0, "Query only a quorum of ingesters, querying another if one takes longer than this percentile of recent ingester queries, eg 0.95 (0 to query all replicas).")
+	flag.StringVar(&cfg.Zone, "distributor.availability-zone", "", "The availability zone of this querier; queries prefer ingesters in the same zone (see -ingester.availability-zone).")
+	flag.BoolVar(&cfg.DistributorRingEnabled, "distributor.ring.enabled", false, "Register in a ring of the distributors, divide tenants' ingestion rate limits between the live distributors, and keep each tenant's Pushgateway groups on one of them.")
+	cfg.OverridesConfig.RegisterFlags(f)
+	cfg.Limits.RegisterDistributorFlags(f)
+	cfg.SeriesValidatorConfig.RegisterFlags(f)
 }
 
 // New constructs a new Distributor
@@ -106,13 +186,30 @@ func New(cfg Config, ring ReadRing) (*Distributor, error) {
 	if 0 > cfg.ReplicationFactor {
 		return nil, fmt.Errorf("ReplicationFactor must be greater than zero: %d", cfg.ReplicationFactor)
 	}
+	if cfg.ShardByAllLabels && cfg.ShardByAllLabelsMigration {
+		return nil, fmt.Errorf("-distributor.shard-by-all-labels and -distributor.shard-by-all-labels.migrate are mutually exclusive")
+	}
+	if cfg.QueryHedgePercentile < 0 || cfg.QueryHedgePercentile >= 1 {
+		return nil, fmt.Errorf("query hedging percentile must be in [0, 1): %v", cfg.QueryHedgePercentile)
+	}
+	limits, err := validation.NewOverrides(cfg.OverridesConfig, cfg.Limits)
+	if err != nil {
+		return nil, err
+	}
+	seriesValidator, closeValidator, err := validator.New(cfg.SeriesValidatorConfig)
+	if err != nil {
+		return nil, err
+	}
 	d := &Distributor{
 		cfg:            cfg,
 		ring:           ring,
+		limits:         limits,
 		clients:        map[string]ingesterClient{},
 		quit:           make(chan struct{}),
 		done:           make(chan struct{}),
 		ingestLimiters: map[string]*rate.Limiter{},
+		validator:      seriesValidator,
+		closeValidator: closeValidator,
 		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Namespace: "cortex",
 			Name:      "distributor_query_duration_seconds",
@@ -150,7 +247,22 @@ func New(cfg Config, ring ReadRing) (*Distributor, error) {
 			Name:      "distributor_ingester_query_failures_total",
 			Help:      "The total number of failed queries sent to ingesters.",
 		}, []string{"ingester"}),
+		hedgedIngesterQueries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "cortex",
+			Name:      "distributor_hedged_ingester_queries_total",
+			Help:      "The total number of queries sent to extra ingesters because others were slow.",
+		}),
+		dedupedPushes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "cortex",
+			Name:      "distributor_deduped_pushes_total",
+			Help:      "The total number of pushes not ingested because they repeated an earlier push's idempotency key.",
+		}),
+		queryLatencies: util.NewLatencyWindow(queryHedgingWindowSize, queryHedgingMinSamples),
+	}
+	if cfg.IdempotencyWindow > 0 {
+		d.idempotency = newIdempotencyCache(cfg.IdempotencyWindow)
 	}
+	d.stopWatch = ring.Watch(d.ringChanged)
 	go d.Run()
 	return d, nil
 }
@@ -161,7 +273,10 @@ func (d *Distributor) Run() {
 	for {
 		select {
 		case <-cleanupClients.C:
-			d.removeStaleIngesterClients()
+			d.removeStaleIngesterClients(d.ring.GetAll())
+			if d.idempotency != nil {
+				d.idempotency.prune()
+			}
 		case <-d.quit:
 			close(d.done)
 			return
@@ -171,16 +286,30 @@ func (d *Distributor) Run() {
 
 // Stop stops the distributor's maintenance loop.
 func (d *Distributor) Stop() {
+	d.stopWatch()
 	close(d.quit)
 	<-d.done
+	d.limits.Stop()
+	if d.validator != nil {
+		if err := d.closeValidator(); err != nil {
+			log.Errorf("Error closing series validator: %v", err)
+		}
+	}
 }
 
-func (d *Distributor) removeStaleIngesterClients() {
+// ringChanged drops clients for ingesters as soon as they leave the ring;
+// the periodic cleanup catches those that stop heartbeating.
+func (d *Distributor) ringChanged(snapshot *ring.Snapshot) {
+	d.removeStaleIngesterClients(snapshot.GetAll())
+}
+
+// removeStaleIngesterClients closes clients for ingesters not in live.
+func (d *Distributor) removeStaleIngesterClients(live []*ring.IngesterDesc) {
 	d.clientsMtx.Lock()
 	defer d.clientsMtx.Unlock()
 
 	ingesters := map[string]struct{}{}
-	for _, ing := range d.ring.GetAll() {
+	for _, ing := range live {
 		ingesters[ing.Addr] = struct{}{}
 	}
 
@@ -248,7 +377,53 @@ func tokenForLabels(userID string, labels []cortex.LabelPair) (uint32, error) {
 			return tokenFor(userID, label.Value), nil
 		}
 	}
-	return 0, fmt.Errorf("No metric name label")
+	return 0, util.ErrMissingMetricName
+}
+
+func metricNameForLabels(labels []cortex.LabelPair) string {
+	for _, label := range labels {
+		if label.Name.Equal(labelNameBytes) {
+			return string(label.Value)
+		}
+	}
+	return ""
+}
+
+// tokenForAllLabels hashes the whole labelset, in label name order, so it
+// doesn't depend on the order labels were sent in.
+func tokenForAllLabels(userID string, labels []cortex.LabelPair) (uint32, error) {
+	if _, err := tokenForLabels(userID, labels); err != nil {
+		return 0, err
+	}
+	sorted := make(util.ByLabelName, len(labels))
+	copy(sorted, labels)
+	sort.Sort(sorted)
+
+	h := fnv.New32()
+	h.Write([]byte(userID))
+	for _, label := range sorted {
+		h.Write(label.Name)
+		h.Write(labelSeparator)
+		h.Write(label.Value)
+		h.Write(labelSeparator)
+	}
+	return h.Sum32(), nil
+}
+
+var labelSeparator = []byte{0xff}
+
+// tokensForLabels returns the ring tokens a series should be written under.
+func (d *Distributor) tokensForLabels(userID string, labels []cortex.LabelPair) ([]uint32, error) {
+	if d.cfg.ShardByAllLabels {
+		token, err := tokenForAllLabels(userID, labels)
+		return []uint32{token}, err
+	}
+	token, err := tokenForLabels(userID, labels)
+	if err != nil || !d.cfg.ShardByAllLabelsMigration {
+		return []uint32{token}, err
+	}
+	allLabelsToken, err := tokenForAllLabels(userID, labels)
+	return []uint32{token, allLabelsToken}, err
 }
 
 func tokenFor(userID string, name []byte) uint32 {
@@ -261,6 +436,7 @@ func tokenFor(userID string, name []byte) uint32 {
 type sampleTracker struct {
 	labels      []cortex.LabelPair
 	sample      cortex.Sample
+	index       int // of the sample in the request; repeated when double writing
 	minSuccess  int
 	maxFailures int
 	succeeded   int32
@@ -284,29 +460,65 @@ func (d *Distributor) Push(ctx context.Context, req *cortex.WriteRequest) (*cort
 	// First we flatten out the request into a list of samples.
 	// We use the heuristic of 1 sample per TS to size the array.
 	// We also work out the hash value at the same time.
+	// Samples failing validation are dropped, and reported together once the
+	// rest have been pushed.
+	discards := validation.NewDiscards(userID)
+	now := model.Now()
 	samples := make([]sampleTracker, 0, len(req.Timeseries))
 	keys := make([]uint32, 0, len(req.Timeseries))
+	numSamples := 0
+	timeseries := make([]cortex.TimeSeries, 0, len(req.Timeseries))
 	for _, ts := range req.Timeseries {
-		key, err := tokenForLabels(userID, ts.Labels)
+		labels, reason, err := validation.NormalizeLabels(ts.Labels)
 		if err != nil {
+			for range ts.Samples {
+				discards.AddSeries(ts.Labels, reason, err)
+			}
+			continue
+		}
+		ts.Labels = labels
+		timeseries = append(timeseries, ts)
+	}
+	if d.validator != nil && len(timeseries) > 0 {
+		if timeseries, err = d.validateSeries(ctx, userID, timeseries, discards); err != nil {
 			return nil, err
 		}
+	}
+	for _, ts := range timeseries {
+		tokens, err := d.tokensForLabels(userID, ts.Labels)
+		if err != nil {
+			return nil, err
+		}
+		if reason, err := d.limits.ValidateMetricName(userID, metricNameForLabels(ts.Labels)); err != nil {
+			for range ts.Samples {
+				discards.AddSeries(ts.Labels, reason, err)
+			}
+			continue
+		}
 		for _, s := range ts.Samples {
-			keys = append(keys, key)
-			samples = append(samples, sampleTracker{
-				labels: ts.Labels,
-				sample: s,
-			})
+			if reason, err := d.limits.ValidateTimestamp(userID, now, model.Time(s.TimestampMs)); err != nil {
+				discards.AddSeries(ts.Labels, reason, err)
+				continue
+			}
+			for _, token := range tokens {
+				keys = append(keys, token)
+				samples = append(samples, sampleTracker{
+					labels: ts.Labels,
+					sample: s,
+					index:  numSamples,
+				})
+			}
+			numSamples++
 		}
 	}
-	d.receivedSamples.Add(float64(len(samples)))
+	d.receivedSamples.Add(float64(numSamples))
 
 	if len(samples) == 0 {
-		return &cortex.WriteResponse{}, nil
+		return &cortex.WriteResponse{}, discards.Err()
 	}
 
 	limiter := d.getOrCreateIngestLimiter(userID)
-	if !limiter.AllowN(time.Now(), len(samples)) {
+	if !limiter.AllowN(time.Now(), numSamples) {
 		return nil, errIngestionRateLimitExceeded
 	}
 
@@ -342,7 +554,7 @@ func (d *Distributor) Push(ctx context.Context, req *cortex.WriteRequest) (*cort
 		// This is just a shortcut - if there are not minSuccess available ingesters,
 		// after filtering out dead ones, don't even bother trying.
 		if len(liveIngesters) < minSuccess {
-			return nil, fmt.Errorf("wanted at least %d live ingesters to process write, had %d",
+			return nil, cortex_errors.Errorf(cortex_errors.Unavailable, "wanted at least %d live ingesters to process write, had %d",
 				minSuccess, len(liveIngesters))
 		}
 
@@ -366,7 +578,7 @@ func (d *Distributor) Push(ctx context.Context, req *cortex.WriteRequest) (*cort
 	case err := <-pushTracker.err:
 		return nil, err
 	case <-pushTracker.done:
-		return &cortex.WriteResponse{}, nil
+		return &cortex.WriteResponse{}, discards.Err()
 	}
 }
 
@@ -374,15 +586,31 @@ func (d *Distributor) getOrCreateIngestLimiter(userID string) *rate.Limiter {
 	d.ingestLimitersMtx.Lock()
 	defer d.ingestLimitersMtx.Unlock()
 
+	limit := d.ingestionRateLimit()
 	if limiter, ok := d.ingestLimiters[userID]; ok {
+		if limiter.Limit() != limit {
+			limiter.SetLimit(limit)
+		}
 		return limiter
 	}
 
-	limiter := rate.NewLimiter(rate.Limit(d.cfg.IngestionRateLimit), d.cfg.IngestionBurstSize)
+	limiter := rate.NewLimiter(limit, d.cfg.IngestionBurstSize)
 	d.ingestLimiters[userID] = limiter
 	return limiter
 }
 
+// ingestionRateLimit is this distributor's share of tenants' ingestion rate
+// limit.
+func (d *Distributor) ingestionRateLimit() rate.Limit {
+	limit := d.cfg.IngestionRateLimit
+	if d.cfg.DistributorRing != nil {
+		if distributors := d.cfg.DistributorRing.ActiveCount(); distributors > 1 {
+			limit /= float64(distributors)
+		}
+	}
+	return rate.Limit(limit)
+}
+
 func (d *Distributor) sendSamples(ctx context.Context, ingester *ring.IngesterDesc, sampleTrackers []*sampleTracker, pushTracker *pushTracker) {
 	err := d.sendSamplesErr(ctx, ingester, sampleTrackers)
 
@@ -423,7 +651,14 @@ func (d *Distributor) sendSamplesErr(ctx context.Context, ingester *ring.Ingeste
 	req := &cortex.WriteRequest{
 		Timeseries: make([]cortex.TimeSeries, 0, len(samples)),
 	}
+	sent := make(map[int]struct{}, len(samples))
 	for _, s := range samples {
+		// When double writing, both placements of a sample can include this
+		// ingester; send it once, and let the result count for both.
+		if _, ok := sent[s.index]; ok {
+			continue
+		}
+		sent[s.index] = struct{}{}
 		req.Timeseries = append(req.Timeseries, cortex.TimeSeries{
 			Labels:  s.labels,
 			Samples: []cortex.Sample{s.sample},
@@ -460,54 +695,90 @@ func (d *Distributor) Query(ctx context.Context, from, to model.Time, matchers .
 			return err
 		}
 
+		if d.cfg.ShardByAllLabels || d.cfg.ShardByAllLabelsMigration {
+			// The metric's series could be on any ingester.
+			ingesters := d.ring.GetAll()
+			result, err = d.queryIngesters(ctx, ingesters, d.cfg.ReplicationFactor/2, req)
+			return err
+		}
+
 		ingesters, err := d.ring.Get(tokenFor(userID, []byte(metricName)), d.cfg.ReplicationFactor, ring.Read)
 		if err != nil {
 			return err
 		}
 
-		result, err = d.queryIngesters(ctx, ingesters, req)
+		// We need a response from a quorum of ingesters, which is n/2 + 1.
+		result, err = d.queryIngesters(ctx, ingesters, len(ingesters)-(len(ingesters)/2+1), req)
 		return err
 	})
 	return result, err
 }
 
-// Query implements Querier.
-func (d *Distributor) queryIngesters(ctx context.Context, ingesters []*ring.IngesterDesc, req *cortex.QueryRequest) (model.Matrix, error) {
-	// We need a response from a quorum of ingesters, which is n/2 + 1.
-	minSuccess := (len(ingesters) / 2) + 1
-	maxErrs := len(ingesters) - minSuccess
-	if len(ingesters) < minSuccess {
-		return nil, fmt.Errorf("could only find %d ingesters for query. Need at least %d", len(ingesters), minSuccess)
-	}
-
-	// Fetch samples from multiple ingesters
-	var numErrs int32
-	errReceived := make(chan error)
-	results := make(chan model.Matrix, len(ingesters))
-
-	for _, ing := range ingesters {
+// queryIngesters queries ingesters, failing if more than maxErrs fail.  With
+// hedging or zone-aware reads, only as many are queried as we need results
+// from to start with, preferring those in our zone, and the rest are kept in
+// reserve for when one fails or is slow.
+func (d *Distributor) queryIngesters(ctx context.Context, ingesters []*ring.IngesterDesc, maxErrs int, req *cortex.QueryRequest) (model.Matrix, error) {
+	minSuccess := len(ingesters) - maxErrs
+	if minSuccess < 1 || len(ingesters) < minSuccess {
+		return nil, cortex_errors.Errorf(cortex_errors.Unavailable, "could only find %d ingesters for query. Need at least %d", len(ingesters), maxErrs+1)
+	}
+
+	// Fetch samples from multiple ingesters, cancelling the outstanding
+	// queries once we have enough.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type queryResult struct {
+		result model.Matrix
+		err    error
+	}
+	results := make(chan queryResult, len(ingesters))
+	next := 0
+	query := func() {
 		go func(ing *ring.IngesterDesc) {
 			result, err := d.queryIngester(ctx, ing, req)
-			if err != nil {
-				if atomic.AddInt32(&numErrs, 1) == int32(maxErrs+1) {
-					errReceived <- err
-				}
-			} else {
-				results <- result
-			}
-		}(ing)
+			results <- queryResult{result, err}
+		}(ingesters[next])
+		next++
+	}
+
+	initial := len(ingesters)
+	if d.cfg.Zone != "" {
+		ingesters = sameZoneFirst(ingesters, d.cfg.Zone)
+		initial = minSuccess
+	}
+	var hedge <-chan time.Time
+	if d.cfg.QueryHedgePercentile > 0 {
+		initial = minSuccess
+		if delay, ok := d.queryLatencies.Percentile(d.cfg.QueryHedgePercentile); ok && initial < len(ingesters) {
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			hedge = timer.C
+		}
+	}
+	for next < initial {
+		query()
 	}
 
 	// Only wait for minSuccess ingesters (or an error), and accumulate the samples
 	// by fingerprint, merging them into any existing samples.
 	fpToSampleStream := map[model.Fingerprint]*model.SampleStream{}
-	for i := 0; i < minSuccess; i++ {
+	numErrs := 0
+	for successes := 0; successes < minSuccess; {
 		select {
-		case err := <-errReceived:
-			return nil, err
-
-		case result := <-results:
-			for _, ss := range result {
+		case r := <-results:
+			if r.err != nil {
+				numErrs++
+				if numErrs > maxErrs {
+					return nil, r.err
+				}
+				if next < len(ingesters) {
+					query()
+				}
+				continue
+			}
+			successes++
+			for _, ss := range r.result {
 				fp := ss.Metric.Fingerprint()
 				mss, ok := fpToSampleStream[fp]
 				if !ok {
@@ -518,6 +789,14 @@ func (d *Distributor) queryIngesters(ctx context.Context, ingesters []*ring.Inge
 				}
 				mss.Values = util.MergeSamples(mss.Values, ss.Values)
 			}
+
+		case <-hedge:
+			// Don't hedge again; the next query in reserve is for failures.
+			hedge = nil
+			if next < len(ingesters) {
+				d.hedgedIngesterQueries.Inc()
+				query()
+			}
 		}
 	}
 
@@ -528,13 +807,33 @@ func (d *Distributor) queryIngesters(ctx context.Context, ingesters []*ring.Inge
 	return result, nil
 }
 
+// sameZoneFirst returns a copy of ingesters, with those in zone first.
+func sameZoneFirst(ingesters []*ring.IngesterDesc, zone string) []*ring.IngesterDesc {
+	result := make([]*ring.IngesterDesc, 0, len(ingesters))
+	for _, ing := range ingesters {
+		if ing.Zone == zone {
+			result = append(result, ing)
+		}
+	}
+	for _, ing := range ingesters {
+		if ing.Zone != zone {
+			result = append(result, ing)
+		}
+	}
+	return result
+}
+
 func (d *Distributor) queryIngester(ctx context.Context, ing *ring.IngesterDesc, req *cortex.QueryRequest) (model.Matrix, error) {
 	client, err := d.getClientFor(ing)
 	if err != nil {
 		return nil, err
 	}
 
+	start := time.Now()
 	resp, err := client.Query(ctx, req)
+	// Failures and timeouts count too, or the hedging delay would only
+	// reflect the ingesters answering quickly.
+	d.queryLatencies.Observe(time.Since(start))
 	d.ingesterQueries.WithLabelValues(ing.Addr).Inc()
 	if err != nil {
 		d.ingesterQueryFailures.WithLabelValues(ing.Addr).Inc()
@@ -671,6 +970,8 @@ func (d *Distributor) Describe(ch chan<- *prometheus.Desc) {
 	d.ingesterAppendFailures.Describe(ch)
 	d.ingesterQueries.Describe(ch)
 	d.ingesterQueryFailures.Describe(ch)
+	ch <- d.hedgedIngesterQueries.Desc()
+	ch <- d.dedupedPushes.Desc()
 }
 
 // Collect implements prometheus.Collector.
@@ -683,6 +984,8 @@ func (d *Distributor) Collect(ch chan<- prometheus.Metric) {
 	d.ingesterAppendFailures.Collect(ch)
 	d.ingesterQueries.Collect(ch)
 	d.ingesterQueryFailures.Collect(ch)
+	ch <- d.hedgedIngesterQueries
+	ch <- d.dedupedPushes
 	d.clientsMtx.RLock()
 	defer d.clientsMtx.RUnlock()
 	ch <- prometheus.MustNewConstMetric(
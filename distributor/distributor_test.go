@@ -1,20 +1,32 @@
 package distributor
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/metric"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
 
 	"github.com/weaveworks/common/user"
 	"github.com/weaveworks/cortex"
 	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/util"
+	cortex_errors "github.com/weaveworks/cortex/util/errors"
+	"github.com/weaveworks/cortex/util/validation"
+	"github.com/weaveworks/cortex/validator"
 )
 
 // mockRing doesn't do any consistent hashing, just returns same ingesters for every query.
@@ -39,6 +51,10 @@ func (r mockRing) GetAll() []*ring.IngesterDesc {
 	return r.ingesters
 }
 
+func (r mockRing) Watch(func(*ring.Snapshot)) func() {
+	return func() {}
+}
+
 type mockIngester struct {
 	happy bool
 }
@@ -90,6 +106,10 @@ func (i mockIngester) MetricsForLabelMatchers(ctx context.Context, in *cortex.Me
 	return nil, nil
 }
 
+func (i mockIngester) TransferChunks(ctx context.Context, in *cortex.TransferChunksRequest, opts ...grpc.CallOption) (*cortex.TransferChunksResponse, error) {
+	return nil, nil
+}
+
 func TestDistributorPush(t *testing.T) {
 	ctx := user.Inject(context.Background(), "user")
 	for i, tc := range []struct {
@@ -287,3 +307,572 @@ func TestDistributorQuery(t *testing.T) {
 		})
 	}
 }
+
+func TestTokenForAllLabels(t *testing.T) {
+	labels := []cortex.LabelPair{
+		{Name: []byte("__name__"), Value: []byte("foo")},
+		{Name: []byte("bar"), Value: []byte("baz")},
+	}
+	reordered := []cortex.LabelPair{labels[1], labels[0]}
+	other := []cortex.LabelPair{labels[0], {Name: []byte("bar"), Value: []byte("qux")}}
+
+	token, err := tokenForAllLabels("user", labels)
+	assert.NoError(t, err)
+	reorderedToken, err := tokenForAllLabels("user", reordered)
+	assert.NoError(t, err)
+	otherToken, err := tokenForAllLabels("user", other)
+	assert.NoError(t, err)
+	assert.Equal(t, token, reorderedToken)
+	assert.NotEqual(t, token, otherToken)
+
+	_, err = tokenForAllLabels("user", labels[1:])
+	assert.Equal(t, util.ErrMissingMetricName, err)
+}
+
+// tokenRing puts each token on a single ingester, by token modulo the number
+// of ingesters.
+type tokenRing struct {
+	mockRing
+}
+
+func (r tokenRing) BatchGet(keys []uint32, n int, op ring.Operation) ([][]*ring.IngesterDesc, error) {
+	result := [][]*ring.IngesterDesc{}
+	for _, key := range keys {
+		result = append(result, []*ring.IngesterDesc{r.ingesters[int(key%uint32(len(r.ingesters)))]})
+	}
+	return result, nil
+}
+
+type recordingIngester struct {
+	mockIngester
+	mtx    sync.Mutex
+	series []string
+}
+
+func (i *recordingIngester) Push(ctx context.Context, in *cortex.WriteRequest, opts ...grpc.CallOption) (*cortex.WriteResponse, error) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	for _, ts := range in.Timeseries {
+		i.series = append(i.series, string(ts.Labels[2].Value))
+	}
+	return &cortex.WriteResponse{}, nil
+}
+
+func TestDistributorShardByAllLabelsMigration(t *testing.T) {
+	ctx := user.Inject(context.Background(), "user")
+	ingesterDescs := []*ring.IngesterDesc{}
+	ingesters := map[string]*recordingIngester{}
+	for i := 0; i < 4; i++ {
+		addr := fmt.Sprintf("%d", i)
+		ingesterDescs = append(ingesterDescs, &ring.IngesterDesc{
+			Addr:      addr,
+			Timestamp: time.Now().Unix(),
+		})
+		ingesters[addr] = &recordingIngester{}
+	}
+
+	d, err := New(Config{
+		ReplicationFactor:         1,
+		HeartbeatTimeout:          1 * time.Minute,
+		RemoteTimeout:             1 * time.Minute,
+		ClientCleanupPeriod:       1 * time.Minute,
+		IngestionRateLimit:        10000,
+		IngestionBurstSize:        10000,
+		ShardByAllLabelsMigration: true,
+
+		ingesterClientFactory: func(addr string) cortex.IngesterClient {
+			return ingesters[addr]
+		},
+	}, tokenRing{mockRing{
+		Counter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "foo",
+		}),
+		ingesters: ingesterDescs,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	request := &cortex.WriteRequest{}
+	for i := 0; i < 20; i++ {
+		request.Timeseries = append(request.Timeseries, cortex.TimeSeries{
+			Labels: []cortex.LabelPair{
+				{Name: []byte("__name__"), Value: []byte("foo")},
+				{Name: []byte("bar"), Value: []byte("baz")},
+				{Name: []byte("sample"), Value: []byte(fmt.Sprintf("%d", i))},
+			},
+			Samples: []cortex.Sample{{Value: float64(i), TimestampMs: int64(i)}},
+		})
+	}
+	_, err = d.Push(ctx, request)
+	assert.NoError(t, err)
+
+	for _, ts := range request.Timeseries {
+		nameToken, err := tokenForLabels("user", ts.Labels)
+		assert.NoError(t, err)
+		allLabelsToken, err := tokenForAllLabels("user", ts.Labels)
+		assert.NoError(t, err)
+
+		// Each sample goes to the ingesters for both tokens, once.
+		expected := map[string]int{
+			fmt.Sprintf("%d", nameToken%4):      1,
+			fmt.Sprintf("%d", allLabelsToken%4): 1,
+		}
+		for addr, ingester := range ingesters {
+			count := 0
+			for _, series := range ingester.series {
+				if series == string(ts.Labels[2].Value) {
+					count++
+				}
+			}
+			assert.Equal(t, expected[addr], count, "series %s on ingester %s", ts.Labels[2].Value, addr)
+		}
+	}
+}
+
+func TestDistributorQueryShardByAllLabels(t *testing.T) {
+	ctx := user.Inject(context.Background(), "user")
+	for i, tc := range []struct {
+		ingesters []mockIngester
+		succeeds  bool
+	}{
+		{[]mockIngester{{true}, {true}, {true}, {true}, {true}}, true},
+		{[]mockIngester{{}, {true}, {true}, {true}, {true}}, true},
+		{[]mockIngester{{}, {}, {true}, {true}, {true}}, false},
+	} {
+		t.Run(fmt.Sprintf("[%d]", i), func(t *testing.T) {
+			ingesterDescs := []*ring.IngesterDesc{}
+			ingesters := map[string]mockIngester{}
+			for i, ingester := range tc.ingesters {
+				addr := fmt.Sprintf("%d", i)
+				ingesterDescs = append(ingesterDescs, &ring.IngesterDesc{
+					Addr:      addr,
+					Timestamp: time.Now().Unix(),
+				})
+				ingesters[addr] = ingester
+			}
+
+			d, err := New(Config{
+				ReplicationFactor:   3,
+				HeartbeatTimeout:    1 * time.Minute,
+				RemoteTimeout:       1 * time.Minute,
+				ClientCleanupPeriod: 1 * time.Minute,
+				IngestionRateLimit:  10000,
+				IngestionBurstSize:  10000,
+				ShardByAllLabels:    true,
+
+				ingesterClientFactory: func(addr string) cortex.IngesterClient {
+					return ingesters[addr]
+				},
+			}, mockRing{
+				Counter: prometheus.NewCounter(prometheus.CounterOpts{
+					Name: "foo",
+				}),
+				ingesters: ingesterDescs,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Stop()
+
+			matcher, err := metric.NewLabelMatcher(metric.Equal, model.LabelName("__name__"), model.LabelValue("foo"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// With a replication factor of 3, a quorum of every series'
+			// replicas survives one failed ingester, but not two.
+			_, err = d.Query(ctx, 0, 10, matcher)
+			if tc.succeeds {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestDistributorPushDiscards(t *testing.T) {
+	ctx := user.Inject(context.Background(), "user")
+	ingester := &recordingIngester{}
+	d, err := New(Config{
+		ReplicationFactor:   1,
+		HeartbeatTimeout:    1 * time.Minute,
+		RemoteTimeout:       1 * time.Minute,
+		ClientCleanupPeriod: 1 * time.Minute,
+		IngestionRateLimit:  10000,
+		IngestionBurstSize:  10000,
+		Limits:              validation.Limits{CreationGracePeriod: 10 * time.Minute, MaxSampleAge: time.Hour},
+
+		ingesterClientFactory: func(addr string) cortex.IngesterClient {
+			return ingester
+		},
+	}, mockRing{
+		Counter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "foo",
+		}),
+		ingesters: []*ring.IngesterDesc{{Addr: "0", Timestamp: time.Now().Unix()}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	now := model.Now()
+	request := &cortex.WriteRequest{}
+	for i, ts := range []model.Time{now, now.Add(-2 * time.Hour), now.Add(time.Hour), now.Add(-3 * time.Hour)} {
+		request.Timeseries = append(request.Timeseries, cortex.TimeSeries{
+			Labels: []cortex.LabelPair{
+				{Name: []byte("__name__"), Value: []byte("foo")},
+				{Name: []byte("bar"), Value: []byte("baz")},
+				{Name: []byte("sample"), Value: []byte(fmt.Sprintf("%d", i))},
+			},
+			Samples: []cortex.Sample{{Value: float64(i), TimestampMs: int64(ts)}},
+		})
+	}
+
+	// The valid sample is still pushed, and the rest reported by reason.
+	_, err = d.Push(ctx, request)
+	assert.Equal(t, cortex_errors.Validation, cortex_errors.TypeOf(err))
+	assert.Contains(t, err.Error(), "discarded 3 samples: 2 greater_than_max_sample_age (")
+	assert.Contains(t, err.Error(), "; 1 too_far_in_future (")
+	assert.Equal(t, []string{"0"}, ingester.series)
+
+	// And the discarded ones are detailed in the response.
+	rec := httptest.NewRecorder()
+	writePushError(rec, err)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	var resp struct {
+		ErrorType string                    `json:"errorType"`
+		Details   validation.DiscardDetails `json:"details"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "validation", resp.ErrorType)
+	assert.Equal(t, 3, resp.Details.Discarded)
+	require.Len(t, resp.Details.Series, 3)
+	assert.Equal(t, `{__name__="foo", bar="baz", sample="1"}`, resp.Details.Series[0].Series)
+	assert.Equal(t, validation.TooOld, resp.Details.Series[0].Reason)
+}
+
+func TestWritePushErrorStatus(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status int
+	}{
+		{errIngestionRateLimitExceeded, http.StatusTooManyRequests},
+		{cortex_errors.Errorf(cortex_errors.Unavailable, "no ingesters"), http.StatusServiceUnavailable},
+		// Retrying won't help, so clients mustn't.
+		{util.ErrUserSeriesLimitExceeded, http.StatusBadRequest},
+		{fmt.Errorf("unknown"), http.StatusInternalServerError},
+	} {
+		rec := httptest.NewRecorder()
+		writePushError(rec, tc.err)
+		assert.Equal(t, tc.status, rec.Code, tc.err.Error())
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	}
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// slowIngester answers queries like a happy mockIngester, after a delay.
+type slowIngester struct {
+	mockIngester
+	delay   time.Duration
+	queried int32
+}
+
+func (i *slowIngester) Query(ctx context.Context, in *cortex.QueryRequest, opts ...grpc.CallOption) (*cortex.QueryResponse, error) {
+	atomic.AddInt32(&i.queried, 1)
+	select {
+	case <-time.After(i.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return i.mockIngester.Query(ctx, in, opts...)
+}
+
+func TestDistributorQueryHedging(t *testing.T) {
+	ctx := user.Inject(context.Background(), "user")
+	matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name            string
+		ingesters       []*slowIngester
+		expectedQueried []int32
+		expectedHedged  float64
+	}{
+		{
+			name:            "fast",
+			ingesters:       []*slowIngester{{mockIngester: mockIngester{true}}, {mockIngester: mockIngester{true}}, {mockIngester: mockIngester{true}}},
+			expectedQueried: []int32{1, 1, 0},
+		},
+		{
+			name:            "slow",
+			ingesters:       []*slowIngester{{mockIngester: mockIngester{true}, delay: time.Minute}, {mockIngester: mockIngester{true}}, {mockIngester: mockIngester{true}}},
+			expectedQueried: []int32{1, 1, 1},
+			expectedHedged:  1,
+		},
+		{
+			name:            "failed",
+			ingesters:       []*slowIngester{{}, {mockIngester: mockIngester{true}}, {mockIngester: mockIngester{true}}},
+			expectedQueried: []int32{1, 1, 1},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ingesterDescs := []*ring.IngesterDesc{}
+			ingesters := map[string]*slowIngester{}
+			for i, ingester := range tc.ingesters {
+				addr := fmt.Sprintf("%d", i)
+				ingesterDescs = append(ingesterDescs, &ring.IngesterDesc{
+					Addr:      addr,
+					Timestamp: time.Now().Unix(),
+				})
+				ingesters[addr] = ingester
+			}
+
+			d, err := New(Config{
+				ReplicationFactor:    3,
+				HeartbeatTimeout:     1 * time.Minute,
+				RemoteTimeout:        1 * time.Minute,
+				ClientCleanupPeriod:  1 * time.Minute,
+				IngestionRateLimit:   10000,
+				IngestionBurstSize:   10000,
+				QueryHedgePercentile: 0.95,
+
+				ingesterClientFactory: func(addr string) cortex.IngesterClient {
+					return ingesters[addr]
+				},
+			}, mockRing{
+				Counter: prometheus.NewCounter(prometheus.CounterOpts{
+					Name: "foo",
+				}),
+				ingesters: ingesterDescs,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Stop()
+			for i := 0; i < queryHedgingMinSamples; i++ {
+				d.queryLatencies.Observe(time.Millisecond)
+			}
+
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			response, err := d.Query(ctx, 0, 10, matcher)
+			assert.NoError(t, err)
+			assert.Len(t, response, 1)
+			for i, ingester := range tc.ingesters {
+				assert.Equal(t, tc.expectedQueried[i], atomic.LoadInt32(&ingester.queried), "ingester %d", i)
+			}
+			assert.Equal(t, tc.expectedHedged, counterValue(t, d.hedgedIngesterQueries))
+		})
+	}
+}
+
+func TestDistributorQueryLatenciesIncludeFailures(t *testing.T) {
+	ctx := user.Inject(context.Background(), "user")
+	for _, tc := range []struct {
+		name     string
+		ingester *slowIngester
+		timeout  time.Duration
+	}{
+		{"failed", &slowIngester{delay: 20 * time.Millisecond}, time.Minute},
+		{"timed out", &slowIngester{mockIngester: mockIngester{true}, delay: time.Minute}, 20 * time.Millisecond},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			desc := &ring.IngesterDesc{Addr: "0", Timestamp: time.Now().Unix()}
+			d, err := New(Config{
+				ReplicationFactor:   1,
+				HeartbeatTimeout:    1 * time.Minute,
+				RemoteTimeout:       1 * time.Minute,
+				ClientCleanupPeriod: 1 * time.Minute,
+				IngestionRateLimit:  10000,
+				IngestionBurstSize:  10000,
+
+				ingesterClientFactory: func(addr string) cortex.IngesterClient {
+					return tc.ingester
+				},
+			}, mockRing{
+				Counter: prometheus.NewCounter(prometheus.CounterOpts{
+					Name: "foo",
+				}),
+				ingesters: []*ring.IngesterDesc{desc},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Stop()
+			for i := 0; i < queryHedgingMinSamples-1; i++ {
+				d.queryLatencies.Observe(time.Millisecond)
+			}
+
+			ctx, cancel := context.WithTimeout(ctx, tc.timeout)
+			defer cancel()
+			_, err = d.queryIngester(ctx, desc, &cortex.QueryRequest{})
+			assert.Error(t, err)
+			slowest, ok := d.queryLatencies.Percentile(1)
+			assert.True(t, ok)
+			assert.True(t, slowest >= 20*time.Millisecond, "slowest latency %v", slowest)
+		})
+	}
+}
+
+func TestDistributorQueryZoneAware(t *testing.T) {
+	ctx := user.Inject(context.Background(), "user")
+	matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name            string
+		happy           []bool
+		expectedQueried []int32
+	}{
+		{"same zone first", []bool{true, true, true}, []int32{1, 0, 1}},
+		{"fall back across zones", []bool{true, true, false}, []int32{1, 1, 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ingesterDescs := []*ring.IngesterDesc{}
+			ingesters := map[string]*slowIngester{}
+			for i, zone := range []string{"b", "c", "a"} {
+				addr := fmt.Sprintf("%d", i)
+				ingesterDescs = append(ingesterDescs, &ring.IngesterDesc{
+					Addr:      addr,
+					Timestamp: time.Now().Unix(),
+					Zone:      zone,
+				})
+				ingesters[addr] = &slowIngester{mockIngester: mockIngester{tc.happy[i]}}
+			}
+
+			d, err := New(Config{
+				ReplicationFactor:   3,
+				HeartbeatTimeout:    1 * time.Minute,
+				RemoteTimeout:       1 * time.Minute,
+				ClientCleanupPeriod: 1 * time.Minute,
+				IngestionRateLimit:  10000,
+				IngestionBurstSize:  10000,
+				Zone:                "a",
+
+				ingesterClientFactory: func(addr string) cortex.IngesterClient {
+					return ingesters[addr]
+				},
+			}, mockRing{
+				Counter: prometheus.NewCounter(prometheus.CounterOpts{
+					Name: "foo",
+				}),
+				ingesters: ingesterDescs,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Stop()
+
+			response, err := d.Query(ctx, 0, 10, matcher)
+			assert.NoError(t, err)
+			assert.Len(t, response, 1)
+			for i, addr := range []string{"0", "1", "2"} {
+				assert.Equal(t, tc.expectedQueried[i], atomic.LoadInt32(&ingesters[addr].queried), "ingester %d", i)
+			}
+		})
+	}
+}
+
+type fixedDistributorRing int
+
+func (r fixedDistributorRing) ActiveCount() int { return int(r) }
+
+func TestDistributorRingDividesIngestionRateLimit(t *testing.T) {
+	d := &Distributor{
+		cfg:            Config{IngestionRateLimit: 300, IngestionBurstSize: 10},
+		ingestLimiters: map[string]*rate.Limiter{},
+	}
+	assert.Equal(t, rate.Limit(300), d.getOrCreateIngestLimiter("user").Limit())
+
+	// Limiters already made follow the number of distributors.
+	d.cfg.DistributorRing = fixedDistributorRing(3)
+	assert.Equal(t, rate.Limit(100), d.getOrCreateIngestLimiter("user").Limit())
+	d.cfg.DistributorRing = fixedDistributorRing(0)
+	assert.Equal(t, rate.Limit(300), d.getOrCreateIngestLimiter("user").Limit())
+}
+
+func TestDistributorPushSeriesValidator(t *testing.T) {
+	validator.Register("test-team", validator.SeriesFunc(func(userID string, labels []cortex.LabelPair) ([]cortex.LabelPair, string) {
+		for _, l := range labels {
+			if string(l.Name) == "sample" && string(l.Value) == "1" {
+				return nil, "sample 1 isn't allowed"
+			}
+		}
+		return append(labels, cortex.LabelPair{Name: []byte("team"), Value: []byte(userID)}), ""
+	}))
+
+	ctx := user.Inject(context.Background(), "user")
+	ingester := &labelsIngester{}
+	d, err := New(Config{
+		ReplicationFactor:     1,
+		HeartbeatTimeout:      1 * time.Minute,
+		RemoteTimeout:         1 * time.Minute,
+		ClientCleanupPeriod:   1 * time.Minute,
+		IngestionRateLimit:    10000,
+		IngestionBurstSize:    10000,
+		SeriesValidatorConfig: validator.Config{Name: "test-team"},
+
+		ingesterClientFactory: func(addr string) cortex.IngesterClient {
+			return ingester
+		},
+	}, mockRing{
+		Counter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "foo",
+		}),
+		ingesters: []*ring.IngesterDesc{{Addr: "0", Timestamp: time.Now().Unix()}},
+	})
+	require.NoError(t, err)
+	defer d.Stop()
+
+	request := &cortex.WriteRequest{}
+	for i := 0; i < 2; i++ {
+		request.Timeseries = append(request.Timeseries, cortex.TimeSeries{
+			Labels: []cortex.LabelPair{
+				{Name: []byte("__name__"), Value: []byte("foo")},
+				{Name: []byte("sample"), Value: []byte(fmt.Sprintf("%d", i))},
+			},
+			Samples: []cortex.Sample{{Value: float64(i), TimestampMs: int64(model.Now())}},
+		})
+	}
+
+	// Rejected series are discarded, and the rest pushed with their labels
+	// rewritten.
+	_, err = d.Push(ctx, request)
+	assert.Equal(t, cortex_errors.Validation, cortex_errors.TypeOf(err))
+	assert.Contains(t, err.Error(), "discarded 1 samples: 1 series_rejected (series rejected: sample 1 isn't allowed)")
+	assert.Equal(t, []string{`foo{sample="0", team="user"}`}, ingester.series)
+}
+
+// labelsIngester records the labels of the series pushed to it.
+type labelsIngester struct {
+	mockIngester
+	mtx    sync.Mutex
+	series []string
+}
+
+func (i *labelsIngester) Push(ctx context.Context, in *cortex.WriteRequest, opts ...grpc.CallOption) (*cortex.WriteResponse, error) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	for _, ts := range in.Timeseries {
+		metric := model.Metric{}
+		for _, l := range ts.Labels {
+			metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+		}
+		i.series = append(i.series, metric.String())
+	}
+	return &cortex.WriteResponse{}, nil
+}
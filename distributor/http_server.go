@@ -10,19 +10,28 @@ import (
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/snappy"
 	"golang.org/x/net/context"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
 
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/prometheus/promql"
 
 	"github.com/weaveworks/common/instrument"
 	"github.com/weaveworks/cortex"
-	"github.com/weaveworks/cortex/util"
+	cortex_errors "github.com/weaveworks/cortex/util/errors"
 )
 
-// PushHandler is a http.Handler which accepts WriteRequests.
+// PushHandler is a http.Handler which accepts WriteRequests, or remote write
+// 2.0 requests if the Content-Type says so.
 func (d *Distributor) PushHandler(w http.ResponseWriter, r *http.Request) {
+	message, err := remoteWriteProto(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if message == remoteWriteV2Proto {
+		d.pushV2(w, r)
+		return
+	}
+
 	var req cortex.WriteRequest
 	if err := ParseProtoRequest(r.Context(), w, r, &req, true); err != nil {
 		log.Errorf(err.Error())
@@ -30,27 +39,45 @@ func (d *Distributor) PushHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, err := d.Push(r.Context(), &req); err != nil {
-		if grpc.Code(err) == codes.ResourceExhausted {
-			switch grpc.ErrorDesc(err) {
-			case util.ErrUserSeriesLimitExceeded.Error():
-				err = util.ErrUserSeriesLimitExceeded
-			case util.ErrMetricSeriesLimitExceeded.Error():
-				err = util.ErrMetricSeriesLimitExceeded
-			}
-		}
-
-		var code int
-		switch err {
-		case errIngestionRateLimitExceeded:
-			code = http.StatusTooManyRequests
-		case util.ErrUserSeriesLimitExceeded, util.ErrMetricSeriesLimitExceeded:
-			code = http.StatusInsufficientStorage
-		default:
-			code = http.StatusInternalServerError
-		}
-		http.Error(w, err.Error(), code)
-		log.Errorf("append err: %v", err)
+	if err := d.pushIdempotent(r.Context(), r.Header.Get(IdempotencyKeyHeader), &req); err != nil {
+		writePushError(w, err)
+	}
+}
+
+// pushErrorResponse is the body of the response to a failed push.
+type pushErrorResponse struct {
+	Status    string      `json:"status"`
+	ErrorType string      `json:"errorType"`
+	Error     string      `json:"error"`
+	Details   interface{} `json:"details,omitempty"`
+}
+
+// writePushError answers a failed push with the error, and its details, such
+// as which series were discarded.  Remote write clients retry pushes failing
+// with 5xx statuses and drop those failing with 4xx, so errors which won't be
+// fixed by retrying are always 4xx.  When some samples were discarded, the
+// rest were written.
+func writePushError(w http.ResponseWriter, err error) {
+	err = cortex_errors.FromGRPC(err)
+	log.Errorf("append err: %v", err)
+
+	t := cortex_errors.TypeOf(err)
+	code := t.HTTPStatus()
+	if code >= 500 && !t.Retryable() {
+		code = http.StatusBadRequest
+	}
+	resp := pushErrorResponse{
+		Status:    "error",
+		ErrorType: t.String(),
+		Error:     err.Error(),
+	}
+	if e, ok := err.(*cortex_errors.DetailedError); ok {
+		resp.Details = e.Details
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Errorf("Error writing push error: %v", err)
 	}
 }
 
@@ -0,0 +1,124 @@
+package distributor
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	cortex_errors "github.com/weaveworks/cortex/util/errors"
+)
+
+// IdempotencyKeyHeader is the header by which clients identify a push, so
+// that retries of it are only ingested once.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyCache remembers the results of recent pushes by user and key.
+// Retries whose first attempt succeeded, or failed in a way retrying won't
+// fix, get the same result without being ingested again; those arriving
+// while it's in flight wait for it.  It's in memory, so it only dedupes
+// retries reaching the same distributor.
+type idempotencyCache struct {
+	window time.Duration
+
+	mtx      sync.Mutex
+	requests map[idempotencyKey]*idempotentRequest
+}
+
+type idempotencyKey struct {
+	userID, key string
+}
+
+type idempotentRequest struct {
+	done    chan struct{}
+	err     error
+	expires time.Time
+}
+
+func newIdempotencyCache(window time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		window:   window,
+		requests: map[idempotencyKey]*idempotentRequest{},
+	}
+}
+
+// expired is true once the request has finished, longer than the window ago.
+func (r *idempotentRequest) expired(now time.Time) bool {
+	select {
+	case <-r.done:
+		return now.After(r.expires)
+	default:
+		return false
+	}
+}
+
+// do calls push, unless a request with the same key has already been made by
+// the user within the window, returning whether it was a duplicate, and its
+// result.
+func (c *idempotencyCache) do(userID, key string, push func() error) (bool, error) {
+	k := idempotencyKey{userID, key}
+	var req *idempotentRequest
+	for {
+		c.mtx.Lock()
+		existing, ok := c.requests[k]
+		if !ok || existing.expired(time.Now()) {
+			req = &idempotentRequest{done: make(chan struct{})}
+			c.requests[k] = req
+			c.mtx.Unlock()
+			break
+		}
+		c.mtx.Unlock()
+
+		<-existing.done
+		if existing.err == nil || !cortex_errors.Retryable(existing.err) {
+			return true, existing.err
+		}
+		// The first attempt failed in a way that's worth retrying; start
+		// again, unless another retry got there first.
+		c.mtx.Lock()
+		if c.requests[k] == existing {
+			delete(c.requests, k)
+		}
+		c.mtx.Unlock()
+	}
+
+	err := push()
+	req.err = err
+	req.expires = time.Now().Add(c.window)
+	close(req.done)
+	return false, err
+}
+
+// pushIdempotent pushes req, unless it repeats the key of an earlier push.
+func (d *Distributor) pushIdempotent(ctx context.Context, key string, req *cortex.WriteRequest) error {
+	if d.idempotency == nil || key == "" {
+		_, err := d.Push(ctx, req)
+		return err
+	}
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return err
+	}
+	duplicate, err := d.idempotency.do(userID, key, func() error {
+		_, err := d.Push(ctx, req)
+		return err
+	})
+	if duplicate {
+		d.dedupedPushes.Inc()
+	}
+	return err
+}
+
+// prune forgets requests older than the window.
+func (c *idempotencyCache) prune() {
+	now := time.Now()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for k, req := range c.requests {
+		if req.expired(now) {
+			delete(c.requests, k)
+		}
+	}
+}
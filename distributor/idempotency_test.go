@@ -0,0 +1,96 @@
+package distributor
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	cortex_errors "github.com/weaveworks/cortex/util/errors"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	c := newIdempotencyCache(time.Hour)
+	calls := 0
+	push := func(err error) func() error {
+		return func() error {
+			calls++
+			return err
+		}
+	}
+
+	// Successful pushes are only made once per user and key.
+	duplicate, err := c.do("1", "a", push(nil))
+	assert.False(t, duplicate)
+	assert.NoError(t, err)
+	duplicate, err = c.do("1", "a", push(nil))
+	assert.True(t, duplicate)
+	assert.NoError(t, err)
+	duplicate, _ = c.do("2", "a", push(nil))
+	assert.False(t, duplicate)
+	assert.Equal(t, 2, calls)
+
+	// Failures worth retrying are retried; others aren't.
+	rateLimited := cortex_errors.New(cortex_errors.RateLimited, "slow down")
+	_, err = c.do("1", "b", push(rateLimited))
+	assert.Equal(t, rateLimited, err)
+	duplicate, err = c.do("1", "b", push(nil))
+	assert.False(t, duplicate)
+	assert.NoError(t, err)
+	invalid := cortex_errors.New(cortex_errors.Validation, "bad sample")
+	_, err = c.do("1", "c", push(invalid))
+	assert.Equal(t, invalid, err)
+	duplicate, err = c.do("1", "c", push(nil))
+	assert.True(t, duplicate)
+	assert.Equal(t, invalid, err)
+	assert.Equal(t, 5, calls)
+
+	// Retries arriving while the push is in flight wait for it.
+	started, release := make(chan struct{}), make(chan struct{})
+	var concurrentCalls int
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.do("1", "d", func() error {
+			concurrentCalls++
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+	results := make(chan bool, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			duplicate, _ := c.do("1", "d", func() error {
+				return fmt.Errorf("pushed twice")
+			})
+			results <- duplicate
+		}()
+	}
+	close(release)
+	wg.Wait()
+	close(results)
+	for duplicate := range results {
+		assert.True(t, duplicate)
+	}
+	assert.Equal(t, 1, concurrentCalls)
+}
+
+func TestIdempotencyCacheExpiry(t *testing.T) {
+	c := newIdempotencyCache(10 * time.Millisecond)
+	duplicate, _ := c.do("1", "a", func() error { return nil })
+	assert.False(t, duplicate)
+	time.Sleep(20 * time.Millisecond)
+	duplicate, _ = c.do("1", "a", func() error { return nil })
+	assert.False(t, duplicate)
+
+	time.Sleep(20 * time.Millisecond)
+	c.prune()
+	assert.Empty(t, c.requests)
+}
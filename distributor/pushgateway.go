@@ -0,0 +1,548 @@
+package distributor
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-opentracing/go/otgrpc"
+	"github.com/mwitkow/go-grpc-middleware"
+	"github.com/opentracing/opentracing-go"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/httpgrpc"
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/util"
+	cortex_errors "github.com/weaveworks/cortex/util/errors"
+	"github.com/weaveworks/cortex/util/validation"
+)
+
+// pushTimeMetric is added to every group, as by the Pushgateway, with the
+// time it was last pushed to.
+const pushTimeMetric = "push_time_seconds"
+
+// Pushes forwarded to the distributor owning the tenant's groups carry
+// this header, so they're kept by it even if it doesn't think it owns them,
+// e.g. while the ring changes.
+const pushgatewayForwardedHeader = "X-Cortex-Pushgateway-Forwarded"
+
+// PushgatewayConfig configures a Pushgateway.
+type PushgatewayConfig struct {
+	Enabled  bool
+	Interval time.Duration
+	GroupTTL time.Duration
+
+	// The defaults of PushgatewayMaxGroups and PushgatewayMaxSeries.
+	Limits validation.Limits
+
+	// Set by the caller: the distributor's overrides of the limits per
+	// tenant, and the ring of distributors, with this one's address in it,
+	// if it registers in one.
+	OverridesConfig validation.OverridesConfig
+	Ring            PushgatewayRing
+	Addr            string
+
+	// For testing.
+	dial func(addr string) (httpgrpc.HTTPClient, func() error, error)
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *PushgatewayConfig) RegisterFlags(f *flag.FlagSet) {
+	f.BoolVar(&cfg.Enabled, "distributor.pushgateway.enabled", false, "Serve a Pushgateway-compatible API under /api/prom/pushgateway, for batch jobs.")
+	f.DurationVar(&cfg.Interval, "distributor.pushgateway.interval", 15*time.Second, "How often to write the latest values of every pushed group, as if the Pushgateway were scraped.")
+	f.DurationVar(&cfg.GroupTTL, "distributor.pushgateway.group-ttl", 24*time.Hour, "Forget groups not pushed to for this long, marking their series stale (0 to keep them until deleted).")
+	cfg.Limits.RegisterPushgatewayFlags(f)
+}
+
+// PushgatewayRing is the ring of distributors, which picks the one owning
+// each tenant's groups.
+type PushgatewayRing interface {
+	Get(key uint32, n int, op ring.Operation) ([]*ring.IngesterDesc, error)
+	GetAll() []*ring.IngesterDesc
+}
+
+// pusher is the part of the Distributor the Pushgateway writes to.
+type pusher interface {
+	Push(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error)
+}
+
+// Pushgateway accepts metrics pushed by batch jobs in groups, per tenant, like
+// the Prometheus Pushgateway, and writes each group's latest values every
+// interval, as a Prometheus scraping the Pushgateway would.  Series which
+// leave a group, when it's replaced or deleted, are marked stale.
+//
+// Groups are only kept in memory.  With a ring of the distributors, each
+// tenant's are kept by the one distributor owning the tenant in the ring,
+// which the others forward pushes to; without one, by whichever they were
+// pushed to.  Groups are lost when the distributor keeping them restarts, or
+// the ring hands the tenant to another: their series end, without being
+// marked stale, until they're pushed again.
+type Pushgateway struct {
+	cfg    PushgatewayConfig
+	pusher pusher
+	limits *validation.Overrides
+
+	mtx sync.Mutex
+	// By tenant, then grouping key.
+	groups map[string]map[string]*pushGroup
+
+	// Of the distributors pushes are forwarded to, by address.
+	clientsMtx sync.Mutex
+	clients    map[string]pushgatewayClient
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+type pushgatewayClient struct {
+	httpgrpc.HTTPClient
+	close func() error
+}
+
+type pushGroup struct {
+	labels model.LabelSet
+	// Samples by metric family name.
+	families map[string]model.Vector
+	pushed   time.Time
+}
+
+// NewPushgateway makes a new Pushgateway, writing to pusher.
+func NewPushgateway(cfg PushgatewayConfig, pusher pusher) (*Pushgateway, error) {
+	limits, err := validation.NewOverrides(cfg.OverridesConfig, cfg.Limits)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.dial == nil {
+		cfg.dial = dialPushgateway
+	}
+	p := &Pushgateway{
+		cfg:     cfg,
+		pusher:  pusher,
+		limits:  limits,
+		groups:  map[string]map[string]*pushGroup{},
+		clients: map[string]pushgatewayClient{},
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go p.loop()
+	return p, nil
+}
+
+func dialPushgateway(addr string) (httpgrpc.HTTPClient, func() error, error) {
+	conn, err := grpc.Dial(addr,
+		grpc.WithInsecure(),
+		grpc.WithUnaryInterceptor(grpc_middleware.ChainUnaryClient(
+			otgrpc.OpenTracingClientInterceptor(opentracing.GlobalTracer()),
+			middleware.ClientUserHeaderInterceptor,
+		)),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return httpgrpc.NewHTTPClient(conn), conn.Close, nil
+}
+
+// Stop stops the Pushgateway's loop.
+func (p *Pushgateway) Stop() {
+	close(p.quit)
+	<-p.done
+	p.limits.Stop()
+
+	p.clientsMtx.Lock()
+	defer p.clientsMtx.Unlock()
+	for addr, client := range p.clients {
+		client.close()
+		delete(p.clients, addr)
+	}
+}
+
+func (p *Pushgateway) loop() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			p.writeAll(now)
+			p.removeStaleClients()
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// writeAll writes every group's latest values, and forgets those past their
+// TTL.
+func (p *Pushgateway) writeAll(now time.Time) {
+	ts := model.TimeFromUnixNano(now.UnixNano())
+	samples := map[string][]model.Sample{}
+	p.mtx.Lock()
+	for userID, groups := range p.groups {
+		for key, group := range groups {
+			if p.cfg.GroupTTL > 0 && now.Sub(group.pushed) > p.cfg.GroupTTL {
+				samples[userID] = appendSamples(samples[userID], group.families, ts, true)
+				delete(groups, key)
+				continue
+			}
+			samples[userID] = appendSamples(samples[userID], group.families, ts, false)
+		}
+		if len(groups) == 0 {
+			delete(p.groups, userID)
+		}
+	}
+	p.mtx.Unlock()
+
+	for userID, ss := range samples {
+		ctx, cancel := context.WithTimeout(user.Inject(context.Background(), userID), p.cfg.Interval)
+		if _, err := p.pusher.Push(ctx, util.ToWriteRequest(ss)); err != nil {
+			log.Warnf("Error writing pushed metrics for %s: %v", userID, err)
+		}
+		cancel()
+	}
+}
+
+// ServeHTTP implements the Pushgateway's push API, for paths ending
+// /metrics/job/<job>{/<label>/<value>}: PUT replaces a group, POST replaces
+// the metrics of the same names in it, and DELETE deletes it.  It must be
+// wrapped in authentication, so the tenant is known.
+func (p *Pushgateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	userID, err := user.Extract(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if owner := p.owner(userID); owner != "" && r.Header.Get(pushgatewayForwardedHeader) == "" {
+		p.forward(w, r, owner)
+		return
+	}
+	labels, err := parseGroupingKey(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	ts := model.TimeFromUnixNano(now.UnixNano())
+	var families map[string]model.Vector
+	switch r.Method {
+	case "PUT", "POST":
+		families, err = decodeFamilies(r, labels, ts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		families[pushTimeMetric] = model.Vector{{
+			Metric:    model.Metric(labels.Merge(model.LabelSet{model.MetricNameLabel: pushTimeMetric})),
+			Value:     model.SampleValue(float64(now.UnixNano()) / 1e9),
+			Timestamp: ts,
+		}}
+	case "DELETE":
+	default:
+		http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	samples, err := p.update(userID, labels, r.Method, families, now)
+	if err != nil {
+		writePushError(w, err)
+		return
+	}
+	if len(samples) > 0 {
+		if _, err := p.pusher.Push(r.Context(), util.ToWriteRequest(samples)); err != nil {
+			writePushError(w, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// owner returns the address of the distributor owning userID's groups, or
+// "" if it's this one, or there's no ring.
+func (p *Pushgateway) owner(userID string) string {
+	if p.cfg.Ring == nil {
+		return ""
+	}
+	descs, err := p.cfg.Ring.Get(tokenFor(userID, nil), 1, ring.Write)
+	if err != nil || len(descs) == 0 || descs[0].Addr == p.cfg.Addr {
+		return ""
+	}
+	return descs[0].Addr
+}
+
+// forward sends a push to the distributor at addr, and writes its response.
+func (p *Pushgateway) forward(w http.ResponseWriter, r *http.Request, addr string) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	client, err := p.client(addr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	req := &httpgrpc.HTTPRequest{
+		Method: r.Method,
+		Url:    r.RequestURI,
+		Body:   body,
+		Headers: []*httpgrpc.Header{
+			{Key: pushgatewayForwardedHeader, Values: []string{"true"}},
+		},
+	}
+	for key, values := range r.Header {
+		req.Headers = append(req.Headers, &httpgrpc.Header{Key: key, Values: values})
+	}
+	resp, err := client.Handle(r.Context(), req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	for _, h := range resp.Headers {
+		w.Header()[h.Key] = h.Values
+	}
+	w.WriteHeader(int(resp.Code))
+	w.Write(resp.Body)
+}
+
+func (p *Pushgateway) client(addr string) (pushgatewayClient, error) {
+	p.clientsMtx.Lock()
+	defer p.clientsMtx.Unlock()
+	if client, ok := p.clients[addr]; ok {
+		return client, nil
+	}
+	c, closer, err := p.cfg.dial(addr)
+	if err != nil {
+		return pushgatewayClient{}, err
+	}
+	client := pushgatewayClient{c, closer}
+	p.clients[addr] = client
+	return client, nil
+}
+
+// removeStaleClients closes the clients of distributors gone from the ring.
+func (p *Pushgateway) removeStaleClients() {
+	if p.cfg.Ring == nil {
+		return
+	}
+	live := map[string]struct{}{}
+	for _, desc := range p.cfg.Ring.GetAll() {
+		live[desc.Addr] = struct{}{}
+	}
+	p.clientsMtx.Lock()
+	defer p.clientsMtx.Unlock()
+	for addr, client := range p.clients {
+		if _, ok := live[addr]; !ok {
+			client.close()
+			delete(p.clients, addr)
+		}
+	}
+}
+
+// update applies a push (or delete) to a group, returning the samples to
+// write: the group's new values, and stale markers for the series that left
+// it.  Pushes which would take the tenant over its limits are rejected.
+func (p *Pushgateway) update(userID string, labels model.LabelSet, method string, families map[string]model.Vector, now time.Time) ([]model.Sample, error) {
+	ts := model.TimeFromUnixNano(now.UnixNano())
+	key := groupKey(labels)
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	groups := p.groups[userID]
+	group, ok := groups[key]
+	if !ok {
+		if maxGroups := p.limits.PushgatewayMaxGroups(userID); method != "DELETE" && maxGroups > 0 && len(groups) >= maxGroups {
+			return nil, cortex_errors.Errorf(cortex_errors.LimitExceeded, "pushgateway group limit of %d exceeded", maxGroups)
+		}
+		group = &pushGroup{labels: labels, families: map[string]model.Vector{}}
+	}
+
+	// The group's families once updated, and those being replaced, to mark
+	// what's gone from them stale.
+	updated := map[string]model.Vector{}
+	replaced := map[string]model.Vector{}
+	switch method {
+	case "PUT", "DELETE":
+		replaced = group.families
+	case "POST":
+		for name, vector := range group.families {
+			updated[name] = vector
+		}
+		for name := range families {
+			replaced[name] = group.families[name]
+		}
+	}
+	for name, vector := range families {
+		updated[name] = vector
+	}
+	if maxSeries := p.limits.PushgatewayMaxSeries(userID); method != "DELETE" && maxSeries > 0 {
+		series := countSeries(updated)
+		for k, g := range groups {
+			if k != key {
+				series += countSeries(g.families)
+			}
+		}
+		if series > maxSeries {
+			return nil, cortex_errors.Errorf(cortex_errors.LimitExceeded, "pushgateway series limit of %d exceeded", maxSeries)
+		}
+	}
+	group.families = updated
+	group.pushed = now
+
+	if groups == nil {
+		groups = map[string]*pushGroup{}
+		p.groups[userID] = groups
+	}
+
+	if method == "DELETE" {
+		delete(groups, key)
+		if len(groups) == 0 {
+			delete(p.groups, userID)
+		}
+	} else {
+		groups[key] = group
+	}
+
+	current := map[model.Fingerprint]struct{}{}
+	for _, vector := range group.families {
+		for _, s := range vector {
+			current[s.Metric.Fingerprint()] = struct{}{}
+		}
+	}
+	samples := appendSamples(nil, families, ts, false)
+	for _, vector := range replaced {
+		for _, s := range vector {
+			if _, ok := current[s.Metric.Fingerprint()]; !ok {
+				samples = append(samples, staleSample(s.Metric, ts))
+			}
+		}
+	}
+	return samples, nil
+}
+
+func countSeries(families map[string]model.Vector) int {
+	count := 0
+	for _, vector := range families {
+		count += len(vector)
+	}
+	return count
+}
+
+// appendSamples appends the samples of families at ts, or stale markers for
+// them.
+func appendSamples(samples []model.Sample, families map[string]model.Vector, ts model.Time, stale bool) []model.Sample {
+	for _, vector := range families {
+		for _, s := range vector {
+			if stale {
+				samples = append(samples, staleSample(s.Metric, ts))
+				continue
+			}
+			samples = append(samples, model.Sample{Metric: s.Metric, Value: s.Value, Timestamp: ts})
+		}
+	}
+	return samples
+}
+
+func staleSample(metric model.Metric, ts model.Time) model.Sample {
+	return model.Sample{
+		Metric:    metric,
+		Value:     model.SampleValue(math.Float64frombits(util.StaleNaN)),
+		Timestamp: ts,
+	}
+}
+
+// decodeFamilies decodes the metric families in a push, in the text or
+// protobuf format, labelling their samples with the grouping labels.
+func decodeFamilies(r *http.Request, labels model.LabelSet, ts model.Time) (map[string]model.Vector, error) {
+	format := expfmt.ResponseFormat(r.Header)
+	if format == expfmt.FmtUnknown {
+		format = expfmt.FmtText
+	}
+	dec := expfmt.NewDecoder(r.Body, format)
+	families := map[string]model.Vector{}
+	for {
+		var mf dto.MetricFamily
+		if err := dec.Decode(&mf); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		for _, m := range mf.Metric {
+			if m.TimestampMs != nil {
+				return nil, fmt.Errorf("pushed metrics must not have timestamps: %s", mf.GetName())
+			}
+		}
+		vector := expfmt.ExtractSamples(&expfmt.DecodeOptions{Timestamp: ts}, &mf)
+		for _, s := range vector {
+			for name, value := range labels {
+				s.Metric[name] = value
+			}
+		}
+		families[mf.GetName()] = append(families[mf.GetName()], vector...)
+	}
+	return families, nil
+}
+
+// parseGroupingKey parses the labels of a group from a path ending
+// /metrics/job/<job>{/<label>/<value>}.  Labels whose names end @base64 have
+// URL-safe base64 encoded values.
+func parseGroupingKey(path string) (model.LabelSet, error) {
+	const prefix = "/metrics/"
+	i := strings.Index(path, prefix+"job")
+	if i < 0 {
+		return nil, fmt.Errorf("path must end /metrics/job/<job>{/<label>/<value>}")
+	}
+	parts := strings.Split(strings.TrimSuffix(path[i+len(prefix):], "/"), "/")
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("odd number of grouping key components")
+	}
+	labels := model.LabelSet{}
+	for j := 0; j < len(parts); j += 2 {
+		name, value := parts[j], parts[j+1]
+		if strings.HasSuffix(name, "@base64") {
+			name = strings.TrimSuffix(name, "@base64")
+			decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+			if err != nil {
+				return nil, fmt.Errorf("invalid base64 value for label %s: %v", name, err)
+			}
+			value = string(decoded)
+		}
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return nil, fmt.Errorf("invalid grouping label name %q", name)
+		}
+		labels[model.LabelName(name)] = model.LabelValue(value)
+	}
+	if labels[model.JobLabel] == "" {
+		return nil, fmt.Errorf("job name must not be empty")
+	}
+	return labels, nil
+}
+
+// groupKey identifies a group by its labels.
+func groupKey(labels model.LabelSet) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		parts = append(parts, name, string(labels[model.LabelName(name)]))
+	}
+	return strings.Join(parts, "\xff")
+}
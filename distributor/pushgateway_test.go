@@ -0,0 +1,190 @@
+package distributor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/httpgrpc"
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/validation"
+)
+
+type recordingPusher struct {
+	mtx     sync.Mutex
+	samples []model.Sample
+}
+
+func (p *recordingPusher) Push(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.samples = append(p.samples, util.FromWriteRequest(req)...)
+	return &cortex.WriteResponse{}, nil
+}
+
+// values returns the last value pushed for each series, by its string, with
+// push_time_seconds left out.
+func (p *recordingPusher) values() map[string]float64 {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	result := map[string]float64{}
+	for _, s := range p.samples {
+		if s.Metric[model.MetricNameLabel] == pushTimeMetric {
+			continue
+		}
+		result[s.Metric.String()] = float64(s.Value)
+		if util.IsStaleNaN(s.Value) {
+			result[s.Metric.String()] = -1
+		}
+	}
+	p.samples = nil
+	return result
+}
+
+func TestPushgateway(t *testing.T) {
+	pusher := &recordingPusher{}
+	p, err := NewPushgateway(PushgatewayConfig{Interval: time.Hour, GroupTTL: time.Minute}, pusher)
+	require.NoError(t, err)
+	defer p.Stop()
+
+	push := func(method, path, body string) int {
+		req := httptest.NewRequest(method, "/api/prom/pushgateway/metrics/job/"+path, strings.NewReader(body))
+		req = req.WithContext(user.Inject(req.Context(), "1"))
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Pushed metrics are written straight away, with the grouping labels.
+	require.Equal(t, http.StatusAccepted, push("PUT", "batch/instance/a", "foo 1\nbar{x=\"y\"} 2\n"))
+	assert.Equal(t, map[string]float64{
+		`foo{instance="a", job="batch"}`:        1,
+		`bar{instance="a", job="batch", x="y"}`: 2,
+	}, pusher.values())
+
+	// POST replaces only the metrics it pushes, marking series gone from them stale...
+	require.Equal(t, http.StatusAccepted, push("POST", "batch/instance/a", "bar{x=\"z\"} 3\n"))
+	assert.Equal(t, map[string]float64{
+		`bar{instance="a", job="batch", x="z"}`: 3,
+		`bar{instance="a", job="batch", x="y"}`: -1,
+	}, pusher.values())
+
+	// ...and every group's latest values are written every interval.
+	require.Equal(t, http.StatusAccepted, push("PUT", "other", "baz 4\n"))
+	pusher.values()
+	p.writeAll(time.Now())
+	assert.Equal(t, map[string]float64{
+		`foo{instance="a", job="batch"}`:        1,
+		`bar{instance="a", job="batch", x="z"}`: 3,
+		`baz{job="other"}`:                      4,
+	}, pusher.values())
+
+	// Deleting a group marks all its series stale.
+	require.Equal(t, http.StatusAccepted, push("DELETE", "batch/instance/a", ""))
+	assert.Equal(t, map[string]float64{
+		`foo{instance="a", job="batch"}`:        -1,
+		`bar{instance="a", job="batch", x="z"}`: -1,
+	}, pusher.values())
+
+	// As do groups past their TTL.
+	p.writeAll(time.Now().Add(2 * time.Minute))
+	assert.Equal(t, map[string]float64{`baz{job="other"}`: -1}, pusher.values())
+	p.writeAll(time.Now().Add(2 * time.Minute))
+	assert.Empty(t, pusher.values())
+
+	// Invalid grouping keys and metrics with timestamps are rejected.
+	assert.Equal(t, http.StatusBadRequest, push("PUT", "", "foo 1\n"))
+	assert.Equal(t, http.StatusBadRequest, push("PUT", "batch/instance", "foo 1\n"))
+	assert.Equal(t, http.StatusBadRequest, push("PUT", "batch", "foo 1 1000\n"))
+	assert.Equal(t, http.StatusAccepted, push("PUT", "batch/instance@base64/YS9i", "foo 1\n"))
+	assert.Equal(t, map[string]float64{`foo{instance="a/b", job="batch"}`: 1}, pusher.values())
+}
+
+func pushTo(p *Pushgateway, userID, method, path, body string) int {
+	req := httptest.NewRequest(method, "/api/prom/pushgateway/metrics/job/"+path, strings.NewReader(body))
+	req = req.WithContext(user.Inject(req.Context(), userID))
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestPushgatewayLimits(t *testing.T) {
+	pusher := &recordingPusher{}
+	p, err := NewPushgateway(PushgatewayConfig{Interval: time.Hour, Limits: validation.Limits{PushgatewayMaxGroups: 2, PushgatewayMaxSeries: 4}}, pusher)
+	require.NoError(t, err)
+	defer p.Stop()
+
+	require.Equal(t, http.StatusAccepted, pushTo(p, "1", "PUT", "a", "foo 1\n"))
+	require.Equal(t, http.StatusAccepted, pushTo(p, "1", "PUT", "b", "foo 1\n"))
+	assert.Equal(t, http.StatusBadRequest, pushTo(p, "1", "PUT", "c", "foo 1\n"))
+	// Each group has push_time_seconds too, so there's room for no more.
+	assert.Equal(t, http.StatusBadRequest, pushTo(p, "1", "POST", "a", "bar 1\n"))
+	// Replacing a group counts only its new series.
+	assert.Equal(t, http.StatusAccepted, pushTo(p, "1", "PUT", "a", "bar 1\n"))
+	// Limits are per tenant.
+	assert.Equal(t, http.StatusAccepted, pushTo(p, "2", "PUT", "c", "foo 1\n"))
+	require.Equal(t, http.StatusAccepted, pushTo(p, "1", "DELETE", "b", ""))
+	assert.Equal(t, http.StatusAccepted, pushTo(p, "1", "PUT", "c", "foo 1\n"))
+}
+
+type fixedPushgatewayRing []*ring.IngesterDesc
+
+func (r fixedPushgatewayRing) Get(key uint32, n int, op ring.Operation) ([]*ring.IngesterDesc, error) {
+	return []*ring.IngesterDesc{r[int(key)%len(r)]}, nil
+}
+
+func (r fixedPushgatewayRing) GetAll() []*ring.IngesterDesc {
+	return r
+}
+
+type localHTTPClient struct {
+	*httpgrpc.Server
+}
+
+func (c localHTTPClient) Handle(ctx context.Context, req *httpgrpc.HTTPRequest, _ ...grpc.CallOption) (*httpgrpc.HTTPResponse, error) {
+	return c.Server.Handle(ctx, req)
+}
+
+func TestPushgatewayForwardsToOwner(t *testing.T) {
+	r := fixedPushgatewayRing{{Addr: "a"}, {Addr: "b"}}
+	pushers := map[string]*recordingPusher{}
+	pushgateways := map[string]*Pushgateway{}
+	for _, addr := range []string{"a", "b"} {
+		pushers[addr] = &recordingPusher{}
+		p, err := NewPushgateway(PushgatewayConfig{
+			Interval: time.Hour,
+			Ring:     r,
+			Addr:     addr,
+			dial: func(addr string) (httpgrpc.HTTPClient, func() error, error) {
+				return localHTTPClient{httpgrpc.NewServer(pushgateways[addr])}, func() error { return nil }, nil
+			},
+		}, pushers[addr])
+		require.NoError(t, err)
+		defer p.Stop()
+		pushgateways[addr] = p
+	}
+
+	// Every tenant's pushes end up with its owner, whichever distributor
+	// they're sent to.
+	for _, userID := range []string{"1", "2", "3", "4"} {
+		owner := r[int(tokenFor(userID, nil))%len(r)].Addr
+		for _, addr := range []string{"a", "b"} {
+			require.Equal(t, http.StatusAccepted, pushTo(pushgateways[addr], userID, "PUT", addr, "foo 1\n"))
+		}
+		assert.Len(t, pushgateways[owner].groups[userID], 2, userID)
+	}
+	assert.Len(t, pushgateways["a"].groups, 2)
+	assert.Len(t, pushgateways["b"].groups, 2)
+}
@@ -0,0 +1,141 @@
+package distributor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/log"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util/wire"
+)
+
+// The messages of the Prometheus remote write protocols, as named in the
+// proto parameter of a push's Content-Type, and the headers a 2.0 push is
+// answered with.
+const (
+	remoteWriteV1Proto = "prometheus.WriteRequest"
+	remoteWriteV2Proto = "io.prometheus.write.v2.Request"
+
+	samplesWrittenHeader    = "X-Prometheus-Remote-Write-Samples-Written"
+	histogramsWrittenHeader = "X-Prometheus-Remote-Write-Histograms-Written"
+	exemplarsWrittenHeader  = "X-Prometheus-Remote-Write-Exemplars-Written"
+)
+
+// remoteWriteProto returns the message a push's Content-Type says it has.
+// Pushes not saying are remote write 1.0, as older clients don't.
+func remoteWriteProto(contentType string) (string, error) {
+	if contentType == "" {
+		return remoteWriteV1Proto, nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", err
+	}
+	if mediaType != "application/x-protobuf" {
+		return remoteWriteV1Proto, nil
+	}
+	switch message := params["proto"]; message {
+	case "", remoteWriteV1Proto:
+		return remoteWriteV1Proto, nil
+	case remoteWriteV2Proto:
+		return remoteWriteV2Proto, nil
+	default:
+		return "", fmt.Errorf("unsupported remote write message %s", message)
+	}
+}
+
+// pushV2 handles a remote write 2.0 push, answering with how much of it was
+// written.
+func (d *Distributor) pushV2(w http.ResponseWriter, r *http.Request) {
+	reqV2, err := parseWriteRequestV2(r)
+	if err != nil {
+		log.Errorf("Error parsing remote write 2.0 request: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req, err := fromWriteRequestV2(reqV2)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := d.pushIdempotent(r.Context(), r.Header.Get(IdempotencyKeyHeader), req); err != nil {
+		writePushError(w, err)
+		return
+	}
+
+	samples := 0
+	for _, ts := range req.Timeseries {
+		samples += len(ts.Samples)
+	}
+	w.Header().Set(samplesWrittenHeader, strconv.Itoa(samples))
+	w.Header().Set(histogramsWrittenHeader, "0")
+	w.Header().Set(exemplarsWrittenHeader, "0")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseWriteRequestV2 parses a remote write 2.0 request, which is always
+// block (not stream) snappy compressed.
+func parseWriteRequestV2(r *http.Request) (*cortex.WriteRequestV2, error) {
+	compressed, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, err
+	}
+	var req cortex.WriteRequestV2
+	if err := proto.Unmarshal(buf, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// fromWriteRequestV2 resolves the labels of a remote write 2.0 request's
+// series from its symbols, returning a WriteRequest of their samples.
+// Native histograms, exemplars, metadata and created timestamps can't be
+// stored, so are dropped.
+func fromWriteRequestV2(req *cortex.WriteRequestV2) (*cortex.WriteRequest, error) {
+	symbol := func(ref uint32) (wire.Bytes, error) {
+		if int(ref) >= len(req.Symbols) {
+			return nil, fmt.Errorf("symbol reference %d out of range, there are %d symbols", ref, len(req.Symbols))
+		}
+		return wire.Bytes(req.Symbols[ref]), nil
+	}
+
+	result := &cortex.WriteRequest{
+		Timeseries: make([]cortex.TimeSeries, 0, len(req.Timeseries)),
+	}
+	for _, ts := range req.Timeseries {
+		if len(ts.LabelsRefs)%2 != 0 {
+			return nil, fmt.Errorf("odd number of label references")
+		}
+		if len(ts.Samples) == 0 {
+			continue
+		}
+		labels := make([]cortex.LabelPair, 0, len(ts.LabelsRefs)/2)
+		for i := 0; i < len(ts.LabelsRefs); i += 2 {
+			name, err := symbol(ts.LabelsRefs[i])
+			if err != nil {
+				return nil, err
+			}
+			value, err := symbol(ts.LabelsRefs[i+1])
+			if err != nil {
+				return nil, err
+			}
+			labels = append(labels, cortex.LabelPair{Name: name, Value: value})
+		}
+		result.Timeseries = append(result.Timeseries, cortex.TimeSeries{
+			Labels:  labels,
+			Samples: ts.Samples,
+		})
+	}
+	return result, nil
+}
@@ -0,0 +1,74 @@
+package distributor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util/wire"
+)
+
+func TestRemoteWriteProto(t *testing.T) {
+	for _, tc := range []struct {
+		contentType string
+		expected    string
+		err         bool
+	}{
+		{"", remoteWriteV1Proto, false},
+		{"application/x-protobuf", remoteWriteV1Proto, false},
+		{"application/x-protobuf;proto=prometheus.WriteRequest", remoteWriteV1Proto, false},
+		{"application/x-protobuf; proto=io.prometheus.write.v2.Request", remoteWriteV2Proto, false},
+		{"application/x-protobuf;proto=io.prometheus.write.v3.Request", "", true},
+		{"application/octet-stream", remoteWriteV1Proto, false},
+	} {
+		message, err := remoteWriteProto(tc.contentType)
+		if tc.err {
+			assert.Error(t, err, tc.contentType)
+			continue
+		}
+		require.NoError(t, err, tc.contentType)
+		assert.Equal(t, tc.expected, message, tc.contentType)
+	}
+}
+
+func TestFromWriteRequestV2(t *testing.T) {
+	samples := []cortex.Sample{{Value: 1, TimestampMs: 1000}}
+	req, err := fromWriteRequestV2(&cortex.WriteRequestV2{
+		Symbols: []string{"", "__name__", "up", "job", "a", "b"},
+		Timeseries: []cortex.TimeSeriesV2{
+			{LabelsRefs: []uint32{1, 2, 3, 4}, Samples: samples, Exemplars: []cortex.ExemplarV2{{Value: 1}}},
+			{LabelsRefs: []uint32{1, 2, 3, 5}, Samples: samples},
+			// Series of only histograms have nothing we can write.
+			{LabelsRefs: []uint32{1, 2, 3, 5}, Histograms: []cortex.HistogramV2{{}}},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &cortex.WriteRequest{
+		Timeseries: []cortex.TimeSeries{
+			{
+				Labels: []cortex.LabelPair{
+					{Name: wire.Bytes("__name__"), Value: wire.Bytes("up")},
+					{Name: wire.Bytes("job"), Value: wire.Bytes("a")},
+				},
+				Samples: samples,
+			},
+			{
+				Labels: []cortex.LabelPair{
+					{Name: wire.Bytes("__name__"), Value: wire.Bytes("up")},
+					{Name: wire.Bytes("job"), Value: wire.Bytes("b")},
+				},
+				Samples: samples,
+			},
+		},
+	}, req)
+
+	for _, refs := range [][]uint32{{1, 2, 3}, {1, 6}} {
+		_, err := fromWriteRequestV2(&cortex.WriteRequestV2{
+			Symbols:    []string{"", "__name__", "up"},
+			Timeseries: []cortex.TimeSeriesV2{{LabelsRefs: refs, Samples: samples}},
+		})
+		assert.Error(t, err, "%v", refs)
+	}
+}
@@ -0,0 +1,61 @@
+package distributor
+
+import (
+	"fmt"
+
+	"github.com/weaveworks/common/instrument"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex"
+	cortex_errors "github.com/weaveworks/cortex/util/errors"
+	"github.com/weaveworks/cortex/util/validation"
+	"github.com/weaveworks/cortex/validator"
+)
+
+// validateSeries has the validator check timeseries, returning them with the
+// labels it rewrote, less those it rejected, whose samples are added to
+// discards.  If the validator fails the whole push fails, rather than
+// ingesting series it may have rejected.
+func (d *Distributor) validateSeries(ctx context.Context, userID string, timeseries []cortex.TimeSeries, discards *validation.Discards) ([]cortex.TimeSeries, error) {
+	req := &validator.ValidateRequest{
+		UserId: userID,
+		Series: make([]validator.Series, 0, len(timeseries)),
+	}
+	for _, ts := range timeseries {
+		req.Series = append(req.Series, validator.Series{Labels: ts.Labels})
+	}
+	var resp *validator.ValidateResponse
+	if err := instrument.TimeRequestHistogram(ctx, "Distributor.Push[validate]", nil, func(ctx context.Context) error {
+		var err error
+		resp, err = d.validator.Validate(ctx, req)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("error validating series: %v", err)
+	}
+	if len(resp.Results) != len(timeseries) {
+		return nil, fmt.Errorf("series validator returned %d results for %d series", len(resp.Results), len(timeseries))
+	}
+
+	result := make([]cortex.TimeSeries, 0, len(timeseries))
+	for i, ts := range timeseries {
+		r := resp.Results[i]
+		if r.Rejection != "" {
+			err := cortex_errors.Errorf(cortex_errors.Validation, "series rejected: %s", r.Rejection)
+			for range ts.Samples {
+				discards.AddSeries(ts.Labels, validation.SeriesRejected, err)
+			}
+			continue
+		}
+		// Rewritten labels must be as valid as those pushed.
+		labels, reason, err := validation.NormalizeLabels(r.Labels)
+		if err != nil {
+			for range ts.Samples {
+				discards.AddSeries(r.Labels, reason, err)
+			}
+			continue
+		}
+		ts.Labels = labels
+		result = append(result, ts)
+	}
+	return result, nil
+}
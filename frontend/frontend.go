@@ -0,0 +1,439 @@
+package frontend
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/weaveworks/common/httpgrpc"
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util/validation"
+)
+
+var (
+	errTooManyRequests = errors.New("too many outstanding requests")
+
+	queueDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "query_frontend_queue_duration_seconds",
+		Help:      "Time spent by requests queued, waiting for a querier.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	queueLength = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cortex",
+		Name:      "query_frontend_queue_length",
+		Help:      "Number of queued requests.",
+	})
+	cancelledRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "query_frontend_cancelled_requests_total",
+		Help:      "The total number of requests whose clients gave up, by whether they were still queued or executing.",
+	}, []string{"stage"})
+	responsesTooLarge = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "query_frontend_responses_too_large_total",
+		Help:      "The total number of range queries rejected as their merged responses were larger than the user's limit.",
+	}, []string{"user"})
+)
+
+// Stages of a request, for cancelledRequests.
+const (
+	stageQueued    = "queued"
+	stageExecuting = "executing"
+)
+
+func init() {
+	prometheus.MustRegister(queueDuration)
+	prometheus.MustRegister(queueLength)
+	prometheus.MustRegister(cancelledRequests)
+	prometheus.MustRegister(responsesTooLarge)
+}
+
+// Config configures a Frontend.
+type Config struct {
+	MaxOutstandingPerTenant int
+
+	// Relative shares of the queriers of each class of query (see
+	// QueryClassHeader), when all have requests queued.
+	RulerWeight     int
+	AlertWeight     int
+	DashboardWeight int
+	AdhocWeight     int
+	// Where QueryClassHeader is trusted from: the ruler, and other internal
+	// callers.
+	TrustedClassNetworks NetworksValue
+
+	// Range queries are split into subqueries per interval, executed in
+	// parallel, up to that many at once.
+	SplitQueriesByInterval  time.Duration
+	SplitQueriesParallelism int
+	// Whether to round range queries' start and end down to their step, and
+	// to drop the points of subqueries overlapping the previous one's rather
+	// than execute the query over its full range.
+	AlignQueriesWithStep         bool
+	SplitQueriesDedupeBoundaries bool
+	// Range queries which can be are sharded into this many queries, by
+	// series, executed in parallel.
+	ShardQueries int
+
+	// The defaults of the per-tenant rate limit of requests (see RateLimit)
+	// and response size limit, and their overrides.
+	Limits          validation.Limits
+	OverridesConfig validation.OverridesConfig
+
+	InstantQueryCache InstantQueryCacheConfig
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.IntVar(&cfg.MaxOutstandingPerTenant, "querier.max-outstanding-requests-per-tenant", 100, "Maximum number of outstanding requests per tenant, per class of query; more are rejected with 429.")
+	f.IntVar(&cfg.RulerWeight, "querier.priority-weight.ruler", 10, "Relative share of queriers for queries from the ruler (0 to only run them when no other queries are queued).")
+	f.IntVar(&cfg.AlertWeight, "querier.priority-weight.alert", 10, "Relative share of queriers for queries from alerts.")
+	f.IntVar(&cfg.DashboardWeight, "querier.priority-weight.dashboard", 4, "Relative share of queriers for queries from dashboards.")
+	f.IntVar(&cfg.AdhocWeight, "querier.priority-weight.adhoc", 1, "Relative share of queriers for ad hoc queries, without a "+QueryClassHeader+" header.")
+	f.Var(&cfg.TrustedClassNetworks, "querier.priority-trusted-networks", "Comma-separated CIDR networks of the internal callers, like the ruler, whose "+QueryClassHeader+" headers are trusted; queries from anywhere else are ad hoc.")
+	f.DurationVar(&cfg.SplitQueriesByInterval, "querier.split-queries-by-interval", 0, "Split range queries into subqueries of at most this interval, aligned to it, executed in parallel (0 to not split them).")
+	f.IntVar(&cfg.SplitQueriesParallelism, "querier.split-queries-parallelism", 4, "Maximum number of a split range query's subqueries to queue at once.")
+	f.BoolVar(&cfg.AlignQueriesWithStep, "querier.align-queries-with-step", false, "Round range queries' start and end down to a multiple of their step, so their points, and so the subqueries they're split into, are the same whenever they're run.")
+	f.BoolVar(&cfg.SplitQueriesDedupeBoundaries, "querier.split-queries-dedupe-boundaries", false, "Drop the points of a split range query's subqueries at or before the last of the previous subquery's, instead of executing the query over its full range.")
+	f.IntVar(&cfg.ShardQueries, "querier.shard-queries", 0, "Number of shards, by series, to split range queries into where that preserves their results, executed in parallel (0 or 1 to not shard them).  Each shard still fetches every series the query selects.")
+	cfg.Limits.RegisterFrontendFlags(f)
+	cfg.OverridesConfig.RegisterFlags(f)
+	cfg.InstantQueryCache.RegisterFlags(f)
+}
+
+// Validate checks cfg is usable.
+func (cfg Config) Validate() error {
+	if cfg.SplitQueriesByInterval != 0 && cfg.SplitQueriesByInterval < time.Millisecond {
+		return fmt.Errorf("-querier.split-queries-by-interval must be 0, or at least 1ms: %v", cfg.SplitQueriesByInterval)
+	}
+	return nil
+}
+
+// NewOverrides makes the per-tenant limits for requests, defaulting to cfg.
+func (cfg Config) NewOverrides() (*validation.Overrides, error) {
+	return validation.NewOverrides(cfg.OverridesConfig, cfg.Limits)
+}
+
+// Frontend queues the HTTP requests it's given per tenant, for queriers to
+// pull over gRPC (see Worker) and execute, so queries are spread evenly
+// across queriers, and one tenant can't starve the others.  Each class of
+// query (see QueryClassHeader) is queued separately, and gets a weighted
+// share of the queriers, so e.g. rule evaluations aren't held up behind
+// giant ad hoc queries.  Range queries
+// are parsed here and sent, and their results returned, as protos, saving
+// the querier from encoding (and us from decoding) JSON; they may be split
+// by time (see queryRange).
+type Frontend struct {
+	cfg    Config
+	limits *validation.Overrides
+
+	mtx  sync.Mutex
+	cond *sync.Cond
+	// Per tenant, per class.
+	queues [numClasses]map[string]chan *request
+}
+
+type request struct {
+	enqueueTime time.Time
+	class       queryClass
+	originalCtx context.Context
+	request     *ProcessRequest
+	err         chan error
+	response    chan *ProcessResponse
+}
+
+// New makes a new Frontend, limiting the size of range queries' responses
+// per limits, if not nil.
+func New(cfg Config, limits *validation.Overrides) *Frontend {
+	f := &Frontend{
+		cfg:    cfg,
+		limits: limits,
+	}
+	for c := range f.queues {
+		f.queues[c] = map[string]chan *request{}
+	}
+	f.cond = sync.NewCond(&f.mtx)
+	return f
+}
+
+// ServeHTTP queues a request, and writes the response once a querier has
+// executed it.  It must be wrapped in authentication.
+func (f *Frontend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	userID, err := user.Extract(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Parsing the form consumes the body, which we may yet need to forward.
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	processRequest := &ProcessRequest{}
+	if queryRange, ok := parseQueryRange(r, userID); ok {
+		processRequest.QueryRangeRequest = queryRange
+	} else {
+		processRequest.HttpRequest = &httpgrpc.HTTPRequest{
+			Method:  r.Method,
+			Url:     r.RequestURI,
+			Body:    body,
+			Headers: fromHeader(r.Header),
+		}
+	}
+	var resp *ProcessResponse
+	if processRequest.QueryRangeRequest != nil {
+		resp, err = f.queryRange(r.Context(), userID, f.classOf(r), processRequest.QueryRangeRequest)
+	} else {
+		resp, err = f.roundTrip(r.Context(), userID, f.classOf(r), processRequest)
+	}
+	if err != nil {
+		// If the client gave up, there's no one to respond to.
+		if r.Context().Err() == nil {
+			http.Error(w, err.Error(), errorStatus(err))
+		}
+		return
+	}
+	switch {
+	case resp.QueryRangeResponse != nil:
+		f.writeQueryRangeResponse(w, r, userID, resp.QueryRangeResponse, time.Since(start))
+	case resp.HttpResponse != nil:
+		toHeader(resp.HttpResponse.Headers, w.Header())
+		w.WriteHeader(int(resp.HttpResponse.Code))
+		if _, err := w.Write(resp.HttpResponse.Body); err != nil {
+			log.Errorf("Error writing response: %v", err)
+		}
+	default:
+		http.Error(w, "empty response from querier", http.StatusBadGateway)
+	}
+}
+
+// roundTrip queues a request, and waits for a querier to execute it.  If ctx
+// is done first, the request is removed from the queue, so it doesn't use up
+// the tenant's outstanding requests; if it's executing, Process cancels it.
+func (f *Frontend) roundTrip(ctx context.Context, userID string, class queryClass, processRequest *ProcessRequest) (*ProcessResponse, error) {
+	req := &request{
+		enqueueTime: time.Now(),
+		class:       class,
+		originalCtx: ctx,
+		request:     processRequest,
+		// Buffered, so the querier's loop never blocks on a request whose
+		// client has gone away.
+		err:      make(chan error, 1),
+		response: make(chan *ProcessResponse, 1),
+	}
+	if err := f.queueRequest(ctx, req); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		if f.dequeue(userID, req) {
+			cancelledRequests.WithLabelValues(stageQueued).Inc()
+		}
+		return nil, ctx.Err()
+	case err := <-req.err:
+		return nil, querierError{err}
+	case resp := <-req.response:
+		return resp, nil
+	}
+}
+
+// querierError is an error from the querier executing a request, rather than
+// from queueing it.
+type querierError struct {
+	error
+}
+
+func errorStatus(err error) int {
+	switch err.(type) {
+	case querierError:
+		return http.StatusBadGateway
+	}
+	if err == errTooManyRequests {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// Process implements FrontendServer, handing requests to a querier one at a
+// time until it disconnects.  If a request's client gives up while the
+// querier is executing it, the stream is ended, cancelling the querier's
+// execution of it (see Worker); the querier reconnects straight away.
+func (f *Frontend) Process(server Frontend_ProcessServer) error {
+	ctx, cancel := context.WithCancel(server.Context())
+	defer cancel()
+	go func() {
+		// Wake getNextRequest when the querier goes away.
+		<-ctx.Done()
+		f.mtx.Lock()
+		f.cond.Broadcast()
+		f.mtx.Unlock()
+	}()
+
+	for {
+		req, err := f.getNextRequest(ctx)
+		if err != nil {
+			return err
+		}
+
+		if err := server.Send(req.request); err != nil {
+			req.err <- err
+			return err
+		}
+		// Buffered, so the receive doesn't leak if the client gives up.
+		recvd := make(chan error, 1)
+		var resp *ProcessResponse
+		go func() {
+			var err error
+			resp, err = server.Recv()
+			recvd <- err
+		}()
+		select {
+		case err := <-recvd:
+			if err != nil {
+				req.err <- err
+				return err
+			}
+			req.response <- resp
+		case <-req.originalCtx.Done():
+			cancelledRequests.WithLabelValues(stageExecuting).Inc()
+			return errRequestCancelled
+		}
+	}
+}
+
+// errRequestCancelled ends a querier's stream when the client of the request
+// it's executing gives up.
+var errRequestCancelled = grpc.Errorf(codes.Canceled, "request cancelled by client")
+
+func (f *Frontend) queueRequest(ctx context.Context, req *request) error {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return err
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	queues := f.queues[req.class]
+	queue, ok := queues[userID]
+	if !ok {
+		queue = make(chan *request, f.cfg.MaxOutstandingPerTenant)
+		queues[userID] = queue
+	}
+	select {
+	case queue <- req:
+		queueLength.Inc()
+		f.cond.Signal()
+		return nil
+	default:
+		return errTooManyRequests
+	}
+}
+
+// getNextRequest takes the next request from a tenant's queue, skipping
+// those whose clients have given up.  The class is picked by weight, then
+// tenants in random order (of map iteration), so each gets a fair share of
+// the queriers.
+func (f *Frontend) getNextRequest(ctx context.Context) (*request, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	weights := f.cfg.weights()
+	for {
+		var pending [numClasses]bool
+		for {
+			queued := false
+			for c, queues := range f.queues {
+				pending[c] = len(queues) > 0
+				queued = queued || pending[c]
+			}
+			if queued || ctx.Err() != nil {
+				break
+			}
+			f.cond.Wait()
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		class, _ := pickClass(weights, pending)
+		queues := f.queues[class]
+		for userID, queue := range queues {
+			req := <-queue
+			if len(queue) == 0 {
+				delete(queues, userID)
+			}
+			queueLength.Dec()
+			if req.originalCtx.Err() != nil {
+				cancelledRequests.WithLabelValues(stageQueued).Inc()
+				break
+			}
+			queueDuration.Observe(time.Since(req.enqueueTime).Seconds())
+			dequeuedRequests.WithLabelValues(class.String()).Inc()
+			return req, nil
+		}
+	}
+}
+
+// dequeue removes req from its tenant's queue, returning whether it was still
+// queued.
+func (f *Frontend) dequeue(userID string, req *request) bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	queues := f.queues[req.class]
+	queue, ok := queues[userID]
+	if !ok {
+		return false
+	}
+
+	// Cycle through the queue, keeping the others in order.
+	found := false
+	for n := len(queue); n > 0; n-- {
+		r := <-queue
+		if r == req {
+			found = true
+			continue
+		}
+		queue <- r
+	}
+	if len(queue) == 0 {
+		delete(queues, userID)
+	}
+	if found {
+		queueLength.Dec()
+	}
+	return found
+}
+
+func toHeader(hs []*httpgrpc.Header, header http.Header) {
+	for _, h := range hs {
+		header[h.Key] = h.Values
+	}
+}
+
+func fromHeader(hs http.Header) []*httpgrpc.Header {
+	result := make([]*httpgrpc.Header, 0, len(hs))
+	for k, vs := range hs {
+		result = append(result, &httpgrpc.Header{
+			Key:    k,
+			Values: vs,
+		})
+	}
+	return result
+}
@@ -0,0 +1,348 @@
+package frontend
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/httpgrpc"
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util/wire"
+)
+
+// pipe connects a worker's stream to a Frontend's, in-process.  Like a gRPC
+// stream, it ends when the Frontend's Process returns, with its error.
+type pipe struct {
+	ctx       context.Context
+	requests  chan *ProcessRequest
+	responses chan *ProcessResponse
+	done      chan struct{}
+	err       error
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	*pipe
+}
+
+func (s serverStream) Context() context.Context { return s.ctx }
+
+func (s serverStream) Send(req *ProcessRequest) error {
+	select {
+	case s.requests <- req:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+func (s serverStream) Recv() (*ProcessResponse, error) {
+	select {
+	case resp := <-s.responses:
+		return resp, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+type clientStream struct {
+	grpc.ClientStream
+	*pipe
+}
+
+func (s clientStream) Send(resp *ProcessResponse) error {
+	select {
+	case s.responses <- resp:
+		return nil
+	case <-s.done:
+		return io.EOF
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+func (s clientStream) Recv() (*ProcessRequest, error) {
+	select {
+	case req := <-s.requests:
+		return req, nil
+	case <-s.done:
+		return nil, s.err
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+type localFrontendClient struct {
+	frontend *Frontend
+}
+
+func (c localFrontendClient) Process(ctx context.Context, opts ...grpc.CallOption) (Frontend_ProcessClient, error) {
+	p := &pipe{
+		ctx:       ctx,
+		requests:  make(chan *ProcessRequest),
+		responses: make(chan *ProcessResponse),
+		done:      make(chan struct{}),
+	}
+	go func() {
+		p.err = c.frontend.Process(serverStream{pipe: p})
+		close(p.done)
+	}()
+	return clientStream{pipe: p}, nil
+}
+
+// userQueryRangeHandler returns a series labelled with the query and user.
+type userQueryRangeHandler struct{}
+
+func (userQueryRangeHandler) QueryRange(ctx context.Context, req *QueryRangeRequest) *QueryRangeResponse {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return &QueryRangeResponse{Code: http.StatusUnauthorized, ErrorType: "bad_data", Error: err.Error()}
+	}
+	return &QueryRangeResponse{
+		Code: http.StatusOK,
+		Matrix: []cortex.TimeSeries{{
+			Labels: []cortex.LabelPair{
+				{Name: wire.Bytes("query"), Value: wire.Bytes(req.Query)},
+				{Name: wire.Bytes("user"), Value: wire.Bytes(userID)},
+			},
+			Samples: []cortex.Sample{
+				{TimestampMs: req.StartTimestampMs, Value: 1},
+				{TimestampMs: req.EndTimestampMs, Value: float64(req.StepMs)},
+			},
+		}},
+	}
+}
+
+func TestFrontendWorker(t *testing.T) {
+	frontends := map[string]*Frontend{
+		"10.0.0.1:9095": New(Config{MaxOutstandingPerTenant: 10}, nil),
+		"10.0.0.2:9095": New(Config{MaxOutstandingPerTenant: 10}, nil),
+	}
+
+	var mtx sync.Mutex
+	hosts := []string{"10.0.0.1", "10.0.0.2"}
+	handler := middleware.AuthenticateUser.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := user.Extract(r.Context())
+		require.NoError(t, err)
+		fmt.Fprintf(w, "%s %s", userID, r.URL.Path)
+	}))
+	worker, err := NewWorker(WorkerConfig{
+		Address:         "frontend:9095",
+		Parallelism:     2,
+		DNSLookupPeriod: 10 * time.Millisecond,
+		lookupHost: func(host string) ([]string, error) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			return hosts, nil
+		},
+		dial: func(addr string) (FrontendClient, func() error, error) {
+			return localFrontendClient{frontends[addr]}, func() error { return nil }, nil
+		},
+	}, userQueryRangeHandler{}, handler)
+	require.NoError(t, err)
+	defer worker.Stop()
+
+	query := func(frontend *Frontend, userID, path string) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-Scope-OrgID", userID)
+		rec := httptest.NewRecorder()
+		middleware.AuthenticateUser.Wrap(frontend).ServeHTTP(rec, req)
+		body, err := ioutil.ReadAll(rec.Body)
+		require.NoError(t, err)
+		return rec.Code, string(body)
+	}
+
+	for addr, frontend := range frontends {
+		for _, userID := range []string{"1", "2"} {
+			code, body := query(frontend, userID, "/api/prom/api/v1/query")
+			assert.Equal(t, http.StatusOK, code, addr)
+			assert.Equal(t, userID+" /api/prom/api/v1/query", body, addr)
+		}
+	}
+
+	// Range queries are parsed by the frontend, and executed by the
+	// QueryRangeHandler; invalid ones are left to the querier's API.
+	code, body := query(frontends["10.0.0.1:9095"], "1", "/api/prom/api/v1/query_range?query=up&start=0&end=30&step=15s")
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"query":"up","user":"1"},"values":[[0,"1"],[30,"15000"]]}]}}`, body)
+	code, body = query(frontends["10.0.0.1:9095"], "1", "/api/prom/api/v1/query_range?query=up&start=0&end=30&step=0")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "1 /api/prom/api/v1/query_range", body)
+	code, body = query(frontends["10.0.0.1:9095"], "1", "/api/prom/api/v1/query_range?query=up&start=0&end=30&step=0.0001")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "1 /api/prom/api/v1/query_range", body)
+
+	// Frontends which go away are dropped.
+	mtx.Lock()
+	hosts = hosts[:1]
+	mtx.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	code, _ = query(frontends["10.0.0.1:9095"], "1", "/api/prom/api/v1/query")
+	assert.Equal(t, http.StatusOK, code)
+	ctx, cancel := context.WithTimeout(user.Inject(context.Background(), "1"), 50*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("GET", "/api/prom/api/v1/query", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	frontends["10.0.0.2:9095"].ServeHTTP(rec, req)
+	assert.Equal(t, 0, rec.Body.Len())
+}
+
+func TestFrontendMaxOutstanding(t *testing.T) {
+	f := New(Config{MaxOutstandingPerTenant: 1}, nil)
+	ctx := user.Inject(context.Background(), "1")
+	newRequest := func() *request {
+		return &request{originalCtx: ctx, err: make(chan error, 1)}
+	}
+	require.NoError(t, f.queueRequest(ctx, newRequest()))
+	assert.Equal(t, errTooManyRequests, f.queueRequest(ctx, newRequest()))
+
+	// Other tenants have their own queues.
+	require.NoError(t, f.queueRequest(user.Inject(context.Background(), "2"), newRequest()))
+}
+
+func TestFrontendCancelQueued(t *testing.T) {
+	f := New(Config{MaxOutstandingPerTenant: 1}, nil)
+	ctx, cancel := context.WithCancel(user.Inject(context.Background(), "1"))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest("GET", "/api/prom/api/v1/query", nil).WithContext(ctx)
+		f.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	for queued := 0; queued == 0; {
+		time.Sleep(time.Millisecond)
+		f.mtx.Lock()
+		queued = len(f.queues[adhocClass]["1"])
+		f.mtx.Unlock()
+	}
+
+	// Requests whose clients give up are removed from the queue, so don't
+	// count towards the tenant's outstanding requests.
+	cancel()
+	<-done
+	f.mtx.Lock()
+	assert.Empty(t, f.queues[adhocClass])
+	f.mtx.Unlock()
+	ctx = user.Inject(context.Background(), "1")
+	assert.NoError(t, f.queueRequest(ctx, &request{originalCtx: ctx, err: make(chan error, 1)}))
+}
+
+func TestFrontendCancelExecuting(t *testing.T) {
+	f := New(Config{MaxOutstandingPerTenant: 10}, nil)
+	started := make(chan struct{}, 1)
+	cancelled := make(chan struct{}, 1)
+	handler := middleware.AuthenticateUser.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/slow" {
+			fmt.Fprint(w, "ok")
+			return
+		}
+		started <- struct{}{}
+		<-r.Context().Done()
+		cancelled <- struct{}{}
+	}))
+	worker, err := NewWorker(WorkerConfig{
+		Address:         "frontend:9095",
+		Parallelism:     1,
+		DNSLookupPeriod: time.Minute,
+		lookupHost: func(host string) ([]string, error) {
+			return []string{"10.0.0.1"}, nil
+		},
+		dial: func(addr string) (FrontendClient, func() error, error) {
+			return localFrontendClient{f}, func() error { return nil }, nil
+		},
+	}, userQueryRangeHandler{}, handler)
+	require.NoError(t, err)
+	defer worker.Stop()
+
+	ctx, cancel := context.WithCancel(user.Inject(context.Background(), "1"))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest("GET", "/slow", nil).WithContext(ctx)
+		req.Header.Set("X-Scope-OrgID", "1")
+		f.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	<-started
+
+	// The querier's execution of a request is cancelled when its client
+	// gives up, and the querier goes on to the next.
+	cancel()
+	<-done
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("executing request not cancelled")
+	}
+	req := httptest.NewRequest("GET", "/fast", nil).WithContext(user.Inject(context.Background(), "1"))
+	req.Header.Set("X-Scope-OrgID", "1")
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "ok", rec.Body.String())
+}
+
+// scriptedStream receives requests, then fails with err.
+type scriptedStream struct {
+	grpc.ClientStream
+	requests []*ProcessRequest
+	err      error
+}
+
+func (s *scriptedStream) Send(*ProcessResponse) error { return nil }
+
+func (s *scriptedStream) Recv() (*ProcessRequest, error) {
+	if len(s.requests) == 0 {
+		return nil, s.err
+	}
+	req := s.requests[0]
+	s.requests = s.requests[1:]
+	return req, nil
+}
+
+func TestWorkerProcessReportsProcessed(t *testing.T) {
+	w := &Worker{queryRange: userQueryRangeHandler{}}
+	streamErr := fmt.Errorf("stream failed")
+
+	// Streams failing before any requests back off as before; those which
+	// processed some reset the backoff.
+	processed, err := w.process(context.Background(), &scriptedStream{err: streamErr})
+	assert.False(t, processed)
+	assert.Equal(t, streamErr, err)
+
+	processed, err = w.process(context.Background(), &scriptedStream{
+		requests: []*ProcessRequest{{QueryRangeRequest: &QueryRangeRequest{UserId: "1"}}},
+		err:      streamErr,
+	})
+	assert.True(t, processed)
+	assert.Equal(t, streamErr, err)
+}
+
+func TestWorkerHandle(t *testing.T) {
+	w := &Worker{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusTeapot)
+		fmt.Fprint(w, "short and stout")
+	})}
+	resp := w.handle(context.Background(), &ProcessRequest{HttpRequest: &httpgrpc.HTTPRequest{Method: "GET", Url: "/"}}, &bytes.Buffer{})
+	assert.Equal(t, int32(http.StatusTeapot), resp.HttpResponse.Code)
+	assert.Equal(t, []*httpgrpc.Header{{Key: "Content-Type", Values: []string{"text/plain"}}}, resp.HttpResponse.Headers)
+	assert.Equal(t, "short and stout", string(resp.HttpResponse.Body))
+
+	// Responses written without a status are OKs.
+	w.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	resp = w.handle(context.Background(), &ProcessRequest{HttpRequest: &httpgrpc.HTTPRequest{Method: "GET", Url: "/"}}, &bytes.Buffer{})
+	assert.Equal(t, int32(http.StatusOK), resp.HttpResponse.Code)
+}
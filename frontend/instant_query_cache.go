@@ -0,0 +1,180 @@
+package frontend
+
+import (
+	"bytes"
+	"container/list"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+var instantQueryCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "query_frontend_instant_query_cache_requests_total",
+	Help:      "Instant queries served from (hit) or missing from (miss) the instant query cache.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(instantQueryCacheRequests)
+}
+
+// InstantQueryCacheConfig configures the cache of instant query results.
+type InstantQueryCacheConfig struct {
+	Size int
+	TTL  time.Duration
+	Step time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *InstantQueryCacheConfig) RegisterFlags(f *flag.FlagSet) {
+	f.IntVar(&cfg.Size, "querier.instant-query-cache-size", 0, "Number of instant query results to cache (0 to disable).")
+	f.DurationVar(&cfg.TTL, "querier.instant-query-cache-ttl", 10*time.Second, "How long to cache instant query results.")
+	f.DurationVar(&cfg.Step, "querier.instant-query-cache-step", 10*time.Second, "Instant queries are evaluated at their time rounded down to a multiple of this, so repeats within it share a result.")
+}
+
+// InstantQueryCache caches the responses to instant queries for a short
+// time, keyed by tenant and the request's parameters, with its time rounded
+// to the step.  Rules and
+// dashboard templating issue the same instant queries many times a minute.
+// It wraps the Frontend, so repeats are served without being queued, and
+// are shared by all the queriers.
+type InstantQueryCache struct {
+	cfg InstantQueryCacheConfig
+
+	mtx     sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type instantQueryCacheEntry struct {
+	key         string
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+// NewInstantQueryCache makes a new InstantQueryCache.
+func NewInstantQueryCache(cfg InstantQueryCacheConfig) *InstantQueryCache {
+	return &InstantQueryCache{
+		cfg:     cfg,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// Wrap implements middleware.Interface.  It must be wrapped in
+// authentication, so the tenant is known.
+func (c *InstantQueryCache) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := user.Extract(r.Context())
+		if c.cfg.Size <= 0 || err != nil || !strings.HasSuffix(r.URL.Path, "/query") || r.ParseForm() != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := mtime.Now()
+		ts := model.TimeFromUnixNano(now.UnixNano())
+		if t := r.Form.Get("time"); t != "" {
+			if ts, err = util.ParseTime(t); err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if step := int64(c.cfg.Step / time.Millisecond); step > 0 {
+			ts -= ts % model.Time(step)
+		}
+		// Evaluate the query at the rounded time, so the result is right
+		// for every request sharing it.  The request is forwarded to the
+		// querier as a GET of the parsed form, the body having been read.
+		r.Form.Set("time", strconv.FormatFloat(float64(ts)/1e3, 'f', -1, 64))
+		r.Method = "GET"
+		r.URL.RawQuery = r.Form.Encode()
+		r.RequestURI = r.URL.RequestURI()
+		r.Body = ioutil.NopCloser(&bytes.Buffer{})
+		r.ContentLength = 0
+		r.Header.Del("Content-Type")
+		r.Header.Del("Content-Length")
+
+		// Every parameter may affect the result (timeout, lookback...),
+		// so the key is all of them.
+		key := strings.Join([]string{userID, r.URL.Path, r.URL.RawQuery}, "\xff")
+		if entry, ok := c.get(key, now); ok {
+			w.Header().Set("Content-Type", entry.contentType)
+			w.Write(entry.body)
+			return
+		}
+
+		rec := &recordingResponseWriter{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if rec.code == http.StatusOK {
+			c.put(&instantQueryCacheEntry{
+				key:         key,
+				contentType: w.Header().Get("Content-Type"),
+				body:        rec.body.Bytes(),
+				expires:     now.Add(c.cfg.TTL),
+			})
+		}
+	})
+}
+
+func (c *InstantQueryCache) get(key string, now time.Time) (*instantQueryCacheEntry, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	elem, ok := c.entries[key]
+	if ok {
+		entry := elem.Value.(*instantQueryCacheEntry)
+		if now.Before(entry.expires) {
+			c.lru.MoveToFront(elem)
+			instantQueryCacheRequests.WithLabelValues("hit").Inc()
+			return entry, true
+		}
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+	}
+	instantQueryCacheRequests.WithLabelValues("miss").Inc()
+	return nil, false
+}
+
+func (c *InstantQueryCache) put(entry *instantQueryCacheEntry) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if elem, ok := c.entries[entry.key]; ok {
+		c.lru.Remove(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.cfg.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*instantQueryCacheEntry).key)
+	}
+}
+
+// recordingResponseWriter passes a response through, keeping a copy.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recordingResponseWriter) Write(buf []byte) (int, error) {
+	w.body.Write(buf)
+	return w.ResponseWriter.Write(buf)
+}
@@ -0,0 +1,74 @@
+package frontend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/common/user"
+)
+
+func TestInstantQueryCache(t *testing.T) {
+	calls := 0
+	cache := NewInstantQueryCache(InstantQueryCacheConfig{Size: 10, TTL: 10 * time.Second, Step: 5 * time.Second})
+	handler := cache.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(r.FormValue("time")))
+	}))
+
+	query := func(userID, url string) string {
+		req := httptest.NewRequest("GET", url, nil)
+		req = req.WithContext(user.Inject(context.Background(), userID))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+
+	mtime.NowForce(time.Unix(1000, 0))
+	defer mtime.NowReset()
+
+	// Queries within a step are evaluated at, and share, the same time.
+	assert.Equal(t, "1000", query("1", "/api/v1/query?query=up&time=1001.5"))
+	assert.Equal(t, "1000", query("1", "/api/v1/query?query=up&time=1004"))
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, "1000", query("1", "/api/v1/query?query=up"))
+	assert.Equal(t, 1, calls)
+
+	// Other tenants, queries and steps aren't shared.
+	query("2", "/api/v1/query?query=up&time=1001")
+	query("1", "/api/v1/query?query=down&time=1001")
+	assert.Equal(t, "1005", query("1", "/api/v1/query?query=up&time=1005"))
+	assert.Equal(t, 4, calls)
+
+	// Nor are those with other parameters.
+	query("1", "/api/v1/query?query=up&time=1001&timeout=1s")
+	assert.Equal(t, "1000", query("1", "/api/v1/query?time=1001&query=up"))
+	assert.Equal(t, 5, calls)
+
+	// Range queries aren't cached.
+	query("1", "/api/v1/query_range?query=up&start=0&end=1000&step=1")
+	query("1", "/api/v1/query_range?query=up&start=0&end=1000&step=1")
+	assert.Equal(t, 7, calls)
+
+	// Forms posted are forwarded as a GET, with the rounded time.
+	req := httptest.NewRequest("POST", "/api/v1/query", strings.NewReader("query=up&time=1021"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = req.WithContext(user.Inject(context.Background(), "1"))
+	forwarded := cache.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "GET", r.Method)
+		assert.Equal(t, "/api/v1/query?query=up&time=1020", r.RequestURI)
+	}))
+	forwarded.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Results expire.
+	mtime.NowForce(time.Unix(1011, 0))
+	query("1", "/api/v1/query?query=up&time=1001")
+	assert.Equal(t, 8, calls)
+}
@@ -0,0 +1,124 @@
+package frontend
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util/validation"
+)
+
+var rateLimitedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "query_frontend_rate_limited_requests_total",
+	Help:      "The total number of requests rejected for exceeding the user's query rate limit.",
+}, []string{"user"})
+
+func init() {
+	prometheus.MustRegister(rateLimitedRequests)
+}
+
+// How often to forget the limiters of users who've stopped querying.
+const rateLimiterPrunePeriod = time.Minute
+
+// RateLimit rejects requests beyond the user's query rate limit with 429,
+// saying when to retry, so e.g. a dashboard refreshing in a tight loop
+// can't swamp the queriers.  It's separate from limits on the samples
+// queried, as cheap queries made often enough are just as much of a
+// problem.
+func RateLimit(limits *validation.Overrides) middleware.Interface {
+	l := &rateLimiter{
+		limits:   limits,
+		limiters: map[string]*userLimiter{},
+	}
+	return middleware.Func(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, err := user.Extract(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if limit, delay := l.reserve(userID, time.Now()); delay > 0 {
+				rateLimitedRequests.WithLabelValues(userID).Inc()
+				w.Header().Set("X-RateLimit-Limit", strconv.FormatFloat(limit, 'g', -1, 64))
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+				http.Error(w, fmt.Sprintf("query rate limit (%v/s) exceeded", limit), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+}
+
+type rateLimiter struct {
+	limits *validation.Overrides
+
+	mtx        sync.Mutex
+	limiters   map[string]*userLimiter
+	lastPruned time.Time
+}
+
+type userLimiter struct {
+	*rate.Limiter
+	lastUsed time.Time
+}
+
+// idle reports whether the limiter has refilled since it was last used, so
+// it's no different from a new one.
+func (l *userLimiter) idle(now time.Time) bool {
+	refill := time.Duration(float64(l.Burst()) / float64(l.Limit()) * float64(time.Second))
+	return now.Sub(l.lastUsed) >= refill
+}
+
+// reserve takes one of the user's requests at now, returning their limit,
+// and how long they must wait if they can't make it now.
+func (l *rateLimiter) reserve(userID string, now time.Time) (float64, time.Duration) {
+	limit := l.limits.QueryRateLimit(userID)
+	if limit <= 0 {
+		return limit, 0
+	}
+	// Every request needs a token, so there must be room for one.
+	burst := l.limits.QueryBurstSize(userID)
+	if burst < 1 {
+		burst = 1
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if now.Sub(l.lastPruned) >= rateLimiterPrunePeriod {
+		l.prune(now)
+	}
+	limiter, ok := l.limiters[userID]
+	// The limits may have been overridden since the limiter was made.
+	if !ok || limiter.Limit() != rate.Limit(limit) || limiter.Burst() != burst {
+		limiter = &userLimiter{Limiter: rate.NewLimiter(rate.Limit(limit), burst)}
+		l.limiters[userID] = limiter
+	}
+	limiter.lastUsed = now
+	reservation := limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay > 0 {
+		// Rejected requests don't count against the limit.
+		reservation.CancelAt(now)
+	}
+	return limit, delay
+}
+
+// prune forgets the limiters of users who haven't queried for long enough
+// that theirs have refilled.  It must be called with mtx held.
+func (l *rateLimiter) prune(now time.Time) {
+	for userID, limiter := range l.limiters {
+		if limiter.idle(now) {
+			delete(l.limiters, userID)
+		}
+	}
+	l.lastPruned = now
+}
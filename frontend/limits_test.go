@@ -0,0 +1,82 @@
+package frontend
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util/validation"
+)
+
+func TestRateLimit(t *testing.T) {
+	file, err := ioutil.TempFile("", "overrides")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(`
+overrides:
+  unlimited:
+    query_rate_limit: 0
+`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	cfg := Config{Limits: validation.Limits{QueryRateLimit: 0.01, QueryBurstSize: 2}}
+	cfg.OverridesConfig.File = file.Name()
+	cfg.OverridesConfig.Period = time.Hour
+	limits, err := cfg.NewOverrides()
+	require.NoError(t, err)
+	defer limits.Stop()
+
+	handler := RateLimit(limits).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	query := func(userID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/prom/api/v1/query?query=up", nil)
+		if userID != "" {
+			req = req.WithContext(user.Inject(req.Context(), userID))
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The burst is allowed, then one request every 100s.
+	assert.Equal(t, http.StatusOK, query("1").Code)
+	assert.Equal(t, http.StatusOK, query("1").Code)
+	rec := query("1")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "0.01", rec.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "100", rec.Header().Get("Retry-After"))
+	// Rejected requests don't push the next allowed one back.
+	assert.Equal(t, "100", query("1").Header().Get("Retry-After"))
+
+	// Each user has their own limit.
+	assert.Equal(t, http.StatusOK, query("2").Code)
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, query("unlimited").Code)
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, query("").Code)
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	limits, err := validation.NewOverrides(validation.OverridesConfig{}, validation.Limits{QueryRateLimit: 1, QueryBurstSize: 10})
+	require.NoError(t, err)
+	defer limits.Stop()
+
+	l := &rateLimiter{limits: limits, limiters: map[string]*userLimiter{}}
+	now := time.Unix(1000, 0)
+	l.reserve("1", now)
+	l.reserve("2", now.Add(5*time.Second))
+	assert.Len(t, l.limiters, 2)
+
+	// Once user 1's limiter has refilled, it's forgotten.
+	l.reserve("2", now.Add(rateLimiterPrunePeriod))
+	assert.Len(t, l.limiters, 1)
+	assert.Contains(t, l.limiters, "2")
+}
@@ -0,0 +1,155 @@
+package frontend
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// QueryClassHeader says where a query comes from, to prioritise it: one of
+// "ruler", "alert" or "dashboard".  Queries without it are ad hoc, as are
+// those from outside -querier.priority-trusted-networks, so tenants can't
+// jump the queue by setting it.  Cortex's own ruler evaluates rules
+// in-process, so "ruler" is for other rule evaluators querying via the
+// frontend, which must set it.
+const QueryClassHeader = "X-Cortex-Query-Class"
+
+// queryClass is the class of a request, each with its own queues.
+type queryClass int
+
+const (
+	adhocClass queryClass = iota
+	dashboardClass
+	alertClass
+	rulerClass
+	numClasses
+)
+
+var classNames = [numClasses]string{"adhoc", "dashboard", "alert", "ruler"}
+
+func (c queryClass) String() string {
+	return classNames[c]
+}
+
+var dequeuedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "query_frontend_dequeued_requests_total",
+	Help:      "The total number of requests handed to queriers, by the class of query.",
+}, []string{"class"})
+
+func init() {
+	prometheus.MustRegister(dequeuedRequests)
+}
+
+// NetworksValue is a flag.Value of comma-separated CIDR networks.
+type NetworksValue []*net.IPNet
+
+// String implements flag.Value.
+func (v NetworksValue) String() string {
+	cidrs := make([]string, 0, len(v))
+	for _, network := range v {
+		cidrs = append(cidrs, network.String())
+	}
+	return strings.Join(cidrs, ",")
+}
+
+// Set implements flag.Value.
+func (v *NetworksValue) Set(s string) error {
+	var networks NetworksValue
+	for _, cidr := range strings.Split(s, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid network %q: %v", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	*v = networks
+	return nil
+}
+
+// contains returns whether addr, a host:port, is in one of the networks.
+func (v NetworksValue) contains(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range v {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// classOf returns the class of r, from its QueryClassHeader if it's from a
+// trusted network.
+func (f *Frontend) classOf(r *http.Request) queryClass {
+	if !f.cfg.TrustedClassNetworks.contains(r.RemoteAddr) {
+		return adhocClass
+	}
+	name := strings.ToLower(strings.TrimSpace(r.Header.Get(QueryClassHeader)))
+	for c, className := range classNames {
+		if name == className {
+			return queryClass(c)
+		}
+	}
+	return adhocClass
+}
+
+// weights returns the share of queriers each class gets when they all
+// have requests queued.
+func (cfg Config) weights() [numClasses]int {
+	return [numClasses]int{
+		adhocClass:     cfg.AdhocWeight,
+		dashboardClass: cfg.DashboardWeight,
+		alertClass:     cfg.AlertWeight,
+		rulerClass:     cfg.RulerWeight,
+	}
+}
+
+// pickClass picks one of the classes for which pending is true, at random
+// in proportion to their weights.  Classes of weight 0 are only picked
+// when no others are pending.
+func pickClass(weights [numClasses]int, pending [numClasses]bool) (queryClass, bool) {
+	total := 0
+	var unweighted []queryClass
+	for c := queryClass(0); c < numClasses; c++ {
+		if !pending[c] {
+			continue
+		}
+		if weights[c] > 0 {
+			total += weights[c]
+		} else {
+			unweighted = append(unweighted, c)
+		}
+	}
+	if total == 0 {
+		if len(unweighted) == 0 {
+			return 0, false
+		}
+		return unweighted[rand.Intn(len(unweighted))], true
+	}
+
+	n := rand.Intn(total)
+	for c := queryClass(0); c < numClasses; c++ {
+		if !pending[c] || weights[c] <= 0 {
+			continue
+		}
+		if n < weights[c] {
+			return c, true
+		}
+		n -= weights[c]
+	}
+	panic("unreachable")
+}
@@ -0,0 +1,81 @@
+package frontend
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+)
+
+func TestClassOf(t *testing.T) {
+	var trusted NetworksValue
+	require.NoError(t, trusted.Set("192.0.2.0/24, 10.0.0.0/8"))
+	f := New(Config{TrustedClassNetworks: trusted}, nil)
+	for header, class := range map[string]queryClass{
+		"":          adhocClass,
+		"Ruler":     rulerClass,
+		"alert":     alertClass,
+		"dashboard": dashboardClass,
+		"bogus":     adhocClass,
+	} {
+		req := httptest.NewRequest("GET", "/api/prom/api/v1/query", nil)
+		req.Header.Set(QueryClassHeader, header)
+		assert.Equal(t, class, f.classOf(req), header)
+
+		// Untrusted callers' queries are all ad hoc.
+		req.RemoteAddr = "198.51.100.1:1234"
+		assert.Equal(t, adhocClass, f.classOf(req), header)
+	}
+}
+
+func TestFrontendPriority(t *testing.T) {
+	f := New(Config{MaxOutstandingPerTenant: 10, RulerWeight: 1, AlertWeight: 1}, nil)
+	queue := func(userID string, class queryClass) *request {
+		ctx := user.Inject(context.Background(), userID)
+		req := &request{originalCtx: ctx, class: class, err: make(chan error, 1)}
+		require.NoError(t, f.queueRequest(ctx, req))
+		return req
+	}
+	for i := 0; i < 5; i++ {
+		queue("1", adhocClass)
+	}
+	rule := queue("1", rulerClass)
+	alert := queue("2", alertClass)
+
+	// Ad hoc queries, of weight 0, wait for the others.
+	have := map[*request]bool{}
+	for i := 0; i < 2; i++ {
+		req, err := f.getNextRequest(context.Background())
+		require.NoError(t, err)
+		have[req] = true
+	}
+	assert.Equal(t, map[*request]bool{rule: true, alert: true}, have)
+	for i := 0; i < 5; i++ {
+		req, err := f.getNextRequest(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, adhocClass, req.class)
+	}
+}
+
+func TestPickClass(t *testing.T) {
+	weights := [numClasses]int{adhocClass: 1, rulerClass: 3}
+	counts := map[queryClass]int{}
+	for i := 0; i < 4000; i++ {
+		c, ok := pickClass(weights, [numClasses]bool{adhocClass: true, rulerClass: true, alertClass: true})
+		require.True(t, ok)
+		counts[c]++
+	}
+	assert.Equal(t, 0, counts[alertClass])
+	assert.InDelta(t, 3000, counts[rulerClass], 200)
+	assert.InDelta(t, 1000, counts[adhocClass], 200)
+
+	c, ok := pickClass(weights, [numClasses]bool{alertClass: true})
+	assert.True(t, ok)
+	assert.Equal(t, alertClass, c)
+	_, ok = pickClass(weights, [numClasses]bool{})
+	assert.False(t, ok)
+}
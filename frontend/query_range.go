@@ -0,0 +1,139 @@
+package frontend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+// QueryRangeHandler executes range queries the frontend has parsed, on the
+// querier.
+type QueryRangeHandler interface {
+	QueryRange(ctx context.Context, req *QueryRangeRequest) *QueryRangeResponse
+}
+
+// parseQueryRange parses a range query request, returning false for requests
+// which aren't, or which are invalid; those are passed on to the querier's
+// API, to be rejected there.
+func parseQueryRange(r *http.Request, userID string) (*QueryRangeRequest, bool) {
+	if !strings.HasSuffix(r.URL.Path, "/api/v1/query_range") {
+		return nil, false
+	}
+	start, err := util.ParseTime(r.FormValue("start"))
+	if err != nil {
+		return nil, false
+	}
+	end, err := util.ParseTime(r.FormValue("end"))
+	if err != nil || end.Before(start) {
+		return nil, false
+	}
+	step, err := util.ParseDuration(r.FormValue("step"))
+	// Steps under a millisecond would be zero.
+	if err != nil || step < time.Millisecond {
+		return nil, false
+	}
+	return &QueryRangeRequest{
+		UserId:           userID,
+		StartTimestampMs: int64(start),
+		EndTimestampMs:   int64(end),
+		StepMs:           int64(step / time.Millisecond),
+		Query:            r.FormValue("query"),
+	}, true
+}
+
+// writeQueryRangeResponse writes a range query's result in the format of the
+// Prometheus API, or an error if it's larger than the user's
+// max_query_response_size_bytes.  What it fetched is reported as by
+// querier.ReportQueryStats, with the wall time it took here.
+func (f *Frontend) writeQueryRangeResponse(w http.ResponseWriter, r *http.Request, userID string, resp *QueryRangeResponse, wallTime time.Duration) {
+	var stats *StatsResponse
+	if resp.Stats != nil {
+		SetStatsHeaders(w.Header(), *resp.Stats, wallTime.Seconds())
+		if r.FormValue("stats") == "all" {
+			stats = NewStatsResponse(*resp.Stats, wallTime.Seconds())
+		}
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(queryRangeBody(resp, stats)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if f.limits != nil && resp.ErrorType == "" {
+		if limit := f.limits.MaxQueryResponseSize(userID); limit > 0 && buf.Len() > limit {
+			responsesTooLarge.WithLabelValues(userID).Inc()
+			resp = &QueryRangeResponse{
+				Code:      http.StatusUnprocessableEntity,
+				ErrorType: "execution",
+				Error:     fmt.Sprintf("query response of at least %d bytes is larger than the limit of %d bytes: narrow the query's selectors, aggregate it, or shorten its time range", buf.Len(), limit),
+			}
+			buf.Reset()
+			if err := json.NewEncoder(&buf).Encode(queryRangeBody(resp, nil)); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(int(resp.Code))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Errorf("Error writing response: %v", err)
+	}
+}
+
+// ResponseSize returns the size in bytes of a range query's result in the
+// format of the Prometheus API, which is what response size limits apply
+// to, wherever they're checked.
+func ResponseSize(resp *QueryRangeResponse) int {
+	var w countingWriter
+	json.NewEncoder(&w).Encode(queryRangeBody(resp, nil))
+	return int(w)
+}
+
+type countingWriter int
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	*w += countingWriter(len(b))
+	return len(b), nil
+}
+
+// queryRangeBody returns the body of the Prometheus API's response with
+// resp's result, and stats if not nil.
+func queryRangeBody(resp *QueryRangeResponse, stats *StatsResponse) interface{} {
+	body := struct {
+		Status    string      `json:"status"`
+		Data      interface{} `json:"data,omitempty"`
+		ErrorType string      `json:"errorType,omitempty"`
+		Error     string      `json:"error,omitempty"`
+		Warnings  []string    `json:"warnings,omitempty"`
+	}{
+		Status:    "success",
+		ErrorType: resp.ErrorType,
+		Error:     resp.Error,
+		Warnings:  resp.Warnings,
+	}
+	if resp.ErrorType != "" {
+		body.Status = "error"
+	} else {
+		body.Data = struct {
+			ResultType model.ValueType `json:"resultType"`
+			Result     model.Matrix    `json:"result"`
+			Stats      *StatsResponse  `json:"stats,omitempty"`
+		}{
+			ResultType: model.ValMatrix,
+			Result:     util.FromQueryResponse(&cortex.QueryResponse{Timeseries: resp.Matrix}),
+			Stats:      stats,
+		}
+	}
+	return body
+}
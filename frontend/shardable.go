@@ -0,0 +1,236 @@
+package frontend
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+var (
+	shardabilityTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "query_frontend_query_shardability_total",
+		Help:      "Range queries analysed for sharding, by whether they can be sharded, and why not.",
+	}, []string{"shardable", "reason"})
+	shardFallbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "query_frontend_shard_fallbacks_total",
+		Help:      "The total number of shardable range queries executed unsharded, as their shards' results couldn't be merged, by reason.",
+	}, []string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(shardabilityTotal)
+	prometheus.MustRegister(shardFallbacks)
+}
+
+// A mergeFunc combines the values of a series at the same time from two
+// shards.
+type mergeFunc func(a, b model.SampleValue) model.SampleValue
+
+// Aggregations whose results over each shard can be merged by applying them
+// again (summing, for count).  NaNs are skipped by min and max, as promql
+// does.
+var mergeableAggregations = map[string]mergeFunc{
+	"sum":   func(a, b model.SampleValue) model.SampleValue { return a + b },
+	"count": func(a, b model.SampleValue) model.SampleValue { return a + b },
+	"min": func(a, b model.SampleValue) model.SampleValue {
+		if b < a || math.IsNaN(float64(a)) {
+			return b
+		}
+		return a
+	},
+	"max": func(a, b model.SampleValue) model.SampleValue {
+		if b > a || math.IsNaN(float64(a)) {
+			return b
+		}
+		return a
+	},
+}
+
+// Functions whose result for a series depends on other series.
+var crossSeriesFunctions = map[string]bool{
+	"absent":             true,
+	"count_scalar":       true,
+	"drop_common_labels": true,
+	"histogram_quantile": true,
+	"scalar":             true,
+	"sort":               true,
+	"sort_desc":          true,
+	"vector":             true,
+}
+
+// shardable reports whether evaluating expr over disjoint shards of the
+// series and merging the results gives the same result as evaluating it
+// over all of them; if not, it returns why.  That's the case if expr is a
+// per-series expression, whose results for each shard can be concatenated,
+// or a mergeable aggregation of one.
+func shardable(expr promql.Expr) (bool, string) {
+	expr = unparen(expr)
+	if expr.Type() != model.ValVector {
+		return false, "not_vector"
+	}
+	if agg, ok := expr.(*promql.AggregateExpr); ok {
+		if mergeableAggregations[agg.Op.String()] == nil || agg.KeepCommonLabels {
+			return false, "aggregation:" + agg.Op.String()
+		}
+		expr = agg.Expr
+	}
+
+	reason := ""
+	promql.Inspect(expr, func(node promql.Node) bool {
+		switch n := node.(type) {
+		case *promql.AggregateExpr:
+			reason = "inner_aggregation"
+		case *promql.Call:
+			if crossSeriesFunctions[n.Func.Name] {
+				reason = "function:" + n.Func.Name
+			}
+		case *promql.BinaryExpr:
+			// Series to be matched may be in different shards.
+			if n.LHS.Type() == model.ValVector && n.RHS.Type() == model.ValVector {
+				reason = "vector_matching"
+			}
+		}
+		return reason == ""
+	})
+	return reason == "", reason
+}
+
+// shardMerge parses query and reports whether it can be sharded, recording
+// the result, and if so how to merge its shards' series with the same
+// labels: nil if there shouldn't be any.  Queries which don't parse aren't
+// shardable, so they're evaluated as they are, and the querier reports the
+// error.
+func shardMerge(query string) (mergeFunc, bool) {
+	expr, err := promql.ParseExpr(query)
+	if err != nil {
+		shardabilityTotal.WithLabelValues("false", "parse_error").Inc()
+		return nil, false
+	}
+	ok, reason := shardable(expr)
+	shardabilityTotal.WithLabelValues(strconv.FormatBool(ok), reason).Inc()
+	if !ok {
+		return nil, false
+	}
+	if agg, isAgg := unparen(expr).(*promql.AggregateExpr); isAgg {
+		return mergeableAggregations[agg.Op.String()], true
+	}
+	return nil, true
+}
+
+func unparen(expr promql.Expr) promql.Expr {
+	for {
+		paren, ok := expr.(*promql.ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = paren.Expr
+	}
+}
+
+// shardedQueryRange executes a range query as ShardQueries queries, in
+// parallel, each over the series whose fingerprints are its shard (see
+// QueryRangeRequest.Shard), and each split like any other range query.  It
+// returns false if their results can't be merged, for the query to be
+// executed unsharded.
+func (f *Frontend) shardedQueryRange(ctx context.Context, userID string, class queryClass, req *QueryRangeRequest, merge mergeFunc) (*ProcessResponse, bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	n := f.cfg.ShardQueries
+	resps := make([]*ProcessResponse, n)
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			shard := *req
+			shard.Shard, shard.ShardCount = uint32(i), uint32(n)
+			var err error
+			resps[i], err = f.splitQueryRange(ctx, userID, class, &shard)
+			errs <- err
+		}(i)
+	}
+	var firstErr error
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	if firstErr != nil {
+		return nil, true, firstErr
+	}
+
+	for _, resp := range resps {
+		if resp.QueryRangeResponse == nil || resp.QueryRangeResponse.ErrorType != "" {
+			return resp, true, nil
+		}
+	}
+	merged, ok := mergeShardResponses(resps, merge)
+	if !ok {
+		return nil, false, nil
+	}
+	return &ProcessResponse{QueryRangeResponse: merged}, true, nil
+}
+
+// mergeShardResponses merges the results of a query's shards, combining the
+// values of series with the same labels at the same time with merge, or
+// returning false if merge is nil.
+func mergeShardResponses(resps []*ProcessResponse, merge mergeFunc) (*QueryRangeResponse, bool) {
+	series := map[model.Fingerprint]*model.SampleStream{}
+	for _, resp := range resps {
+		matrix := util.FromQueryResponse(&cortex.QueryResponse{Timeseries: resp.QueryRangeResponse.Matrix})
+		for _, ss := range matrix {
+			fp := ss.Metric.Fingerprint()
+			merged, ok := series[fp]
+			if !ok {
+				series[fp] = ss
+				continue
+			}
+			if merge == nil {
+				return nil, false
+			}
+			merged.Values = mergeValues(merged.Values, ss.Values, merge)
+		}
+	}
+
+	matrix := make(model.Matrix, 0, len(series))
+	for _, ss := range series {
+		matrix = append(matrix, ss)
+	}
+	sort.Sort(matrix)
+	return &QueryRangeResponse{
+		Code:     int32(http.StatusOK),
+		Matrix:   util.ToQueryResponse(matrix).Timeseries,
+		Warnings: mergeWarnings(resps),
+		Stats:    mergeStats(resps),
+	}, true
+}
+
+// mergeValues merges two series' values, in order, combining those at the
+// same time with merge.
+func mergeValues(a, b []model.SamplePair, merge mergeFunc) []model.SamplePair {
+	result := make([]model.SamplePair, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0].Timestamp.Before(b[0].Timestamp):
+			result, a = append(result, a[0]), a[1:]
+		case b[0].Timestamp.Before(a[0].Timestamp):
+			result, b = append(result, b[0]), b[1:]
+		default:
+			result = append(result, model.SamplePair{Timestamp: a[0].Timestamp, Value: merge(a[0].Value, b[0].Value)})
+			a, b = a[1:], b[1:]
+		}
+	}
+	result = append(result, a...)
+	return append(result, b...)
+}
@@ -0,0 +1,129 @@
+package frontend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util/wire"
+)
+
+func TestShardable(t *testing.T) {
+	for _, tc := range []struct {
+		query  string
+		reason string
+	}{
+		{`up`, ""},
+		{`rate(http_requests_total{job="api"}[5m]) * 2`, ""},
+		{`label_replace(up, "foo", "$1", "job", "(.*)")`, ""},
+		{`sum by (job) (rate(http_requests_total[5m]))`, ""},
+		{`(max(up))`, ""},
+		{`count without (instance) (up > 0)`, ""},
+		{`absent(up)`, "function:absent"},
+		{`topk(5, up)`, "aggregation:topk"},
+		{`avg(up)`, "aggregation:avg"},
+		{`sum(up) / 2`, "inner_aggregation"},
+		{`sum(max by (job) (up))`, "inner_aggregation"},
+		{`histogram_quantile(0.9, rate(latency_bucket[5m]))`, "function:histogram_quantile"},
+		{`up / on (job) group_left up`, "vector_matching"},
+		{`sum(up and up)`, "vector_matching"},
+		{`1 + 1`, "not_vector"},
+	} {
+		expr, err := promql.ParseExpr(tc.query)
+		require.NoError(t, err, tc.query)
+		ok, reason := shardable(expr)
+		assert.Equal(t, tc.reason == "", ok, tc.query)
+		assert.Equal(t, tc.reason, reason, tc.query)
+	}
+
+	_, ok := shardMerge(`sum(`)
+	assert.False(t, ok)
+	merge, ok := shardMerge(`up`)
+	assert.True(t, ok)
+	assert.Nil(t, merge)
+	merge, ok = shardMerge(`(count(up))`)
+	require.True(t, ok)
+	assert.Equal(t, model.SampleValue(3), merge(1, 2))
+}
+
+func TestMergeValues(t *testing.T) {
+	a := []model.SamplePair{{Timestamp: 0, Value: 1}, {Timestamp: 2, Value: 5}}
+	b := []model.SamplePair{{Timestamp: 1, Value: 2}, {Timestamp: 2, Value: 3}, {Timestamp: 3, Value: 4}}
+	assert.Equal(t, []model.SamplePair{{Timestamp: 0, Value: 1}, {Timestamp: 1, Value: 2}, {Timestamp: 2, Value: 3}, {Timestamp: 3, Value: 4}}, mergeValues(a, b, mergeableAggregations["min"]))
+	assert.Equal(t, []model.SamplePair{{Timestamp: 0, Value: 1}, {Timestamp: 1, Value: 2}, {Timestamp: 2, Value: 8}, {Timestamp: 3, Value: 4}}, mergeValues(a, b, mergeableAggregations["sum"]))
+}
+
+// shardQueryRangeHandler returns a series valued its shard plus one, labelled
+// with the shard for queries of up, so shards' series are disjoint.
+type shardQueryRangeHandler struct{}
+
+func (shardQueryRangeHandler) QueryRange(ctx context.Context, req *QueryRangeRequest) *QueryRangeResponse {
+	labels := []cortex.LabelPair{}
+	if req.Query == "up" {
+		labels = append(labels, cortex.LabelPair{Name: wire.Bytes("shard"), Value: wire.Bytes(fmt.Sprint(req.Shard))})
+	}
+	return &QueryRangeResponse{
+		Code: http.StatusOK,
+		Matrix: []cortex.TimeSeries{{
+			Labels:  labels,
+			Samples: []cortex.Sample{{TimestampMs: req.StartTimestampMs, Value: float64(req.Shard + 1)}},
+		}},
+	}
+}
+
+func TestFrontendShardQueries(t *testing.T) {
+	f := New(Config{MaxOutstandingPerTenant: 10, ShardQueries: 3}, nil)
+	worker, err := NewWorker(WorkerConfig{
+		Address:         "frontend:9095",
+		Parallelism:     3,
+		DNSLookupPeriod: time.Minute,
+		lookupHost: func(host string) ([]string, error) {
+			return []string{"10.0.0.1"}, nil
+		},
+		dial: func(addr string) (FrontendClient, func() error, error) {
+			return localFrontendClient{f}, func() error { return nil }, nil
+		},
+	}, shardQueryRangeHandler{}, http.NotFoundHandler())
+	require.NoError(t, err)
+	defer worker.Stop()
+
+	for _, tc := range []struct {
+		query    string
+		expected string
+	}{
+		// Shards' aggregations are merged.
+		{"sum(up)", `[{"metric":{},"values":[[0,"6"]]}]`},
+		{"max(up)", `[{"metric":{},"values":[[0,"3"]]}]`},
+		// Shards' series are concatenated.
+		{"up", `[{"metric":{"shard":"0"},"values":[[0,"1"]]},{"metric":{"shard":"1"},"values":[[0,"2"]]},{"metric":{"shard":"2"},"values":[[0,"3"]]}]`},
+		// Unless they're the same, when the query's executed unsharded.
+		{"up + 1", `[{"metric":{},"values":[[0,"1"]]}]`},
+		// As are queries which can't be sharded.
+		{"topk(1, up)", `[{"metric":{},"values":[[0,"1"]]}]`},
+	} {
+		req := httptest.NewRequest("GET", "/api/prom/api/v1/query_range?start=0&end=0&step=30&query="+url.QueryEscape(tc.query), nil)
+		req.Header.Set("X-Scope-OrgID", "1")
+		rec := httptest.NewRecorder()
+		middleware.AuthenticateUser.Wrap(f).ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code, tc.query)
+		var resp struct {
+			Data struct {
+				Result json.RawMessage `json:"result"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp), tc.query)
+		assert.JSONEq(t, tc.expected, string(resp.Data.Result), tc.query)
+	}
+}
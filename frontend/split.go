@@ -0,0 +1,262 @@
+package frontend
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+var (
+	splitQueries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "query_frontend_split_queries_total",
+		Help:      "The total number of range queries split by interval.",
+	})
+	splitDroppedPoints = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "query_frontend_split_dropped_points_total",
+		Help:      "The total number of points dropped from split range queries' subqueries, for overlapping the previous subquery's.",
+	})
+	splitFallbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "query_frontend_split_fallbacks_total",
+		Help:      "The total number of range queries executed over their full range, as splitting them couldn't be relied on to preserve their results, by reason.",
+	}, []string{"reason"})
+)
+
+// Reasons for splitFallbacks.
+const (
+	fallbackParseError    = "parse_error"
+	fallbackMergeConflict = "merge_conflict"
+)
+
+func init() {
+	prometheus.MustRegister(splitQueries)
+	prometheus.MustRegister(splitDroppedPoints)
+	prometheus.MustRegister(splitFallbacks)
+}
+
+// queryRange executes a range query, split into subqueries per
+// SplitQueriesByInterval if it spans more than one.  Each step of a range
+// query is evaluated independently of the others, so splitting it on steps
+// preserves its results: a subquery's first steps look back (by the
+// querier's staleness delta) before its start, as they would have in the
+// full query, and the querier fetches the samples they need.  Where the
+// frontend can't tell that splitting preserves the results (the query
+// doesn't parse) or the subqueries' results show it didn't (series have
+// points out of order, or twice, across a boundary), the query is executed
+// over its full range instead, unless SplitQueriesDedupeBoundaries.
+//
+// With AlignQueriesWithStep, the query's start and end are rounded down to
+// its step first, so when the step divides the interval, subqueries start
+// on the interval's boundaries.
+//
+// With ShardQueries, queries which can be (see shardable) are also sharded
+// by series, each shard split as above, and executed unsharded if their
+// shards' results can't be merged.
+func (f *Frontend) queryRange(ctx context.Context, userID string, class queryClass, req *QueryRangeRequest) (*ProcessResponse, error) {
+	if f.cfg.AlignQueriesWithStep {
+		req = alignWithStep(req)
+	}
+	if f.cfg.ShardQueries > 1 {
+		if merge, ok := shardMerge(req.Query); ok {
+			resp, ok, err := f.shardedQueryRange(ctx, userID, class, req, merge)
+			if ok || err != nil {
+				return resp, err
+			}
+			shardFallbacks.WithLabelValues(fallbackMergeConflict).Inc()
+		}
+	}
+	return f.splitQueryRange(ctx, userID, class, req)
+}
+
+func (f *Frontend) splitQueryRange(ctx context.Context, userID string, class queryClass, req *QueryRangeRequest) (*ProcessResponse, error) {
+	full := func() (*ProcessResponse, error) {
+		return f.roundTrip(ctx, userID, class, &ProcessRequest{QueryRangeRequest: req})
+	}
+	if f.cfg.SplitQueriesByInterval < time.Millisecond {
+		return full()
+	}
+	reqs := splitByInterval(req, f.cfg.SplitQueriesByInterval)
+	if len(reqs) < 2 {
+		return full()
+	}
+	if _, err := promql.ParseExpr(req.Query); err != nil {
+		// Leave the querier to report the error, for the whole query.
+		splitFallbacks.WithLabelValues(fallbackParseError).Inc()
+		return full()
+	}
+	splitQueries.Inc()
+
+	resps, err := f.roundTripAll(ctx, userID, class, reqs)
+	if err != nil {
+		return nil, err
+	}
+	for _, resp := range resps {
+		if resp.QueryRangeResponse == nil || resp.QueryRangeResponse.ErrorType != "" {
+			return resp, nil
+		}
+	}
+	merged, ok := mergeQueryRangeResponses(resps, f.cfg.SplitQueriesDedupeBoundaries)
+	if !ok {
+		splitFallbacks.WithLabelValues(fallbackMergeConflict).Inc()
+		return full()
+	}
+	return &ProcessResponse{QueryRangeResponse: merged}, nil
+}
+
+// roundTripAll executes reqs, SplitQueriesParallelism at a time, returning
+// their responses in order, or the first error, cancelling the rest.
+func (f *Frontend) roundTripAll(ctx context.Context, userID string, class queryClass, reqs []*QueryRangeRequest) ([]*ProcessResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	parallelism := f.cfg.SplitQueriesParallelism
+	if parallelism <= 0 || parallelism > len(reqs) {
+		parallelism = len(reqs)
+	}
+	next := make(chan int)
+	go func() {
+		defer close(next)
+		for i := range reqs {
+			select {
+			case next <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	resps := make([]*ProcessResponse, len(reqs))
+	errs := make(chan error, parallelism)
+	for j := 0; j < parallelism; j++ {
+		go func() {
+			for i := range next {
+				resp, err := f.roundTrip(ctx, userID, class, &ProcessRequest{QueryRangeRequest: reqs[i]})
+				if err != nil {
+					errs <- err
+					return
+				}
+				resps[i] = resp
+			}
+			errs <- nil
+		}()
+	}
+	var firstErr error
+	for j := 0; j < parallelism; j++ {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	return resps, firstErr
+}
+
+// alignWithStep returns req with its start and end rounded down to a
+// multiple of its step.
+func alignWithStep(req *QueryRangeRequest) *QueryRangeRequest {
+	aligned := *req
+	aligned.StartTimestampMs = floorTo(req.StartTimestampMs, req.StepMs)
+	aligned.EndTimestampMs = floorTo(req.EndTimestampMs, req.StepMs)
+	return &aligned
+}
+
+func floorTo(t, multiple int64) int64 {
+	floor := t / multiple * multiple
+	if floor > t {
+		floor -= multiple
+	}
+	return floor
+}
+
+// splitByInterval splits req into subqueries with the same steps, one per
+// interval (counting from the epoch) that it has steps in.
+func splitByInterval(req *QueryRangeRequest, interval time.Duration) []*QueryRangeRequest {
+	intervalMs := int64(interval / time.Millisecond)
+	var reqs []*QueryRangeRequest
+	for start := req.StartTimestampMs; start <= req.EndTimestampMs; {
+		// The last step before the next interval.
+		next := (start/intervalMs + 1) * intervalMs
+		end := start + (next-1-start)/req.StepMs*req.StepMs
+		if end > req.EndTimestampMs {
+			end = req.EndTimestampMs
+		}
+		reqs = append(reqs, &QueryRangeRequest{
+			UserId:           req.UserId,
+			StartTimestampMs: start,
+			EndTimestampMs:   end,
+			StepMs:           req.StepMs,
+			Query:            req.Query,
+			Shard:            req.Shard,
+			ShardCount:       req.ShardCount,
+		})
+		start = end + req.StepMs
+	}
+	return reqs
+}
+
+// mergeQueryRangeResponses merges the results of the subqueries of a split
+// query, in order, returning false if a series' points from one don't all
+// follow those from the previous, unless dedupe, when those which don't are
+// dropped.
+func mergeQueryRangeResponses(resps []*ProcessResponse, dedupe bool) (*QueryRangeResponse, bool) {
+	series := map[model.Fingerprint]*model.SampleStream{}
+	for _, resp := range resps {
+		matrix := util.FromQueryResponse(&cortex.QueryResponse{Timeseries: resp.QueryRangeResponse.Matrix})
+		for _, ss := range matrix {
+			fp := ss.Metric.Fingerprint()
+			merged, ok := series[fp]
+			if !ok {
+				series[fp] = ss
+				continue
+			}
+			values := ss.Values
+			if len(merged.Values) > 0 {
+				last := merged.Values[len(merged.Values)-1].Timestamp
+				for len(values) > 0 && !last.Before(values[0].Timestamp) {
+					if !dedupe {
+						return nil, false
+					}
+					values = values[1:]
+					splitDroppedPoints.Inc()
+				}
+			}
+			merged.Values = append(merged.Values, values...)
+		}
+	}
+
+	matrix := make(model.Matrix, 0, len(series))
+	for _, ss := range series {
+		matrix = append(matrix, ss)
+	}
+	sort.Sort(matrix)
+	return &QueryRangeResponse{
+		Code:     int32(http.StatusOK),
+		Matrix:   util.ToQueryResponse(matrix).Timeseries,
+		Warnings: mergeWarnings(resps),
+		Stats:    mergeStats(resps),
+	}, true
+}
+
+// mergeWarnings returns the distinct warnings of resps, in order.
+func mergeWarnings(resps []*ProcessResponse) []string {
+	var warnings []string
+	seen := map[string]bool{}
+	for _, resp := range resps {
+		for _, warning := range resp.QueryRangeResponse.Warnings {
+			if !seen[warning] {
+				seen[warning] = true
+				warnings = append(warnings, warning)
+			}
+		}
+	}
+	return warnings
+}
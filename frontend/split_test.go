@@ -0,0 +1,209 @@
+package frontend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util/validation"
+	"github.com/weaveworks/cortex/util/wire"
+)
+
+func TestSplitByInterval(t *testing.T) {
+	for _, tc := range []struct {
+		start, end, step int64
+		expected         [][2]int64
+	}{
+		{0, 50000, 10000, [][2]int64{{0, 50000}}},
+		{0, 150000, 30000, [][2]int64{{0, 30000}, {60000, 90000}, {120000, 150000}}},
+		// Subqueries start on the query's steps, not the interval's.
+		{10000, 130000, 40000, [][2]int64{{10000, 50000}, {90000, 90000}, {130000, 130000}}},
+		{59000, 61000, 1000, [][2]int64{{59000, 59000}, {60000, 61000}}},
+	} {
+		reqs := splitByInterval(&QueryRangeRequest{StartTimestampMs: tc.start, EndTimestampMs: tc.end, StepMs: tc.step, Query: "up"}, time.Minute)
+		var ranges [][2]int64
+		for _, req := range reqs {
+			assert.Equal(t, tc.step, req.StepMs)
+			assert.Equal(t, "up", req.Query)
+			ranges = append(ranges, [2]int64{req.StartTimestampMs, req.EndTimestampMs})
+		}
+		assert.Equal(t, tc.expected, ranges, "%v", tc)
+	}
+}
+
+func TestAlignWithStep(t *testing.T) {
+	req := alignWithStep(&QueryRangeRequest{StartTimestampMs: 10000, EndTimestampMs: 130000, StepMs: 60000, Query: "up"})
+	assert.Equal(t, QueryRangeRequest{StartTimestampMs: 0, EndTimestampMs: 120000, StepMs: 60000, Query: "up"}, *req)
+	req = alignWithStep(&QueryRangeRequest{StartTimestampMs: -10000, EndTimestampMs: 0, StepMs: 60000})
+	assert.Equal(t, int64(-60000), req.StartTimestampMs)
+	assert.Equal(t, int64(0), req.EndTimestampMs)
+}
+
+// overlappingQueryRangeHandler returns points a step either side of the
+// query's start, so split queries' results overlap.
+type overlappingQueryRangeHandler struct{}
+
+func (overlappingQueryRangeHandler) QueryRange(ctx context.Context, req *QueryRangeRequest) *QueryRangeResponse {
+	return &QueryRangeResponse{
+		Code: http.StatusOK,
+		Matrix: []cortex.TimeSeries{{
+			Labels: []cortex.LabelPair{{Name: wire.Bytes("query"), Value: wire.Bytes(req.Query)}},
+			Samples: []cortex.Sample{
+				{TimestampMs: req.StartTimestampMs - req.StepMs, Value: 1},
+				{TimestampMs: req.StartTimestampMs + req.StepMs, Value: 2},
+			},
+		}},
+	}
+}
+
+func TestFrontendSplitQueries(t *testing.T) {
+	for _, tc := range []struct {
+		handler  QueryRangeHandler
+		cfg      Config
+		query    string
+		expected string
+	}{
+		// Subqueries' results are merged.
+		{userQueryRangeHandler{}, Config{}, "query=up&start=0&end=150&step=30",
+			`[{"metric":{"query":"up","user":"1"},"values":[[0,"1"],[30,"30000"],[60,"1"],[90,"30000"],[120,"1"],[150,"30000"]]}]`},
+		// Unless they overlap, when the query's executed over its full range.
+		{overlappingQueryRangeHandler{}, Config{}, "query=up&start=60&end=150&step=30",
+			`[{"metric":{"query":"up"},"values":[[30,"1"],[90,"2"]]}]`},
+		// Or the overlapping points are dropped.
+		{overlappingQueryRangeHandler{}, Config{SplitQueriesDedupeBoundaries: true}, "query=up&start=60&end=150&step=30",
+			`[{"metric":{"query":"up"},"values":[[30,"1"],[90,"2"],[150,"2"]]}]`},
+		// As are queries which don't parse.
+		{userQueryRangeHandler{}, Config{}, "query=up{&start=0&end=150&step=30",
+			`[{"metric":{"query":"up{","user":"1"},"values":[[0,"1"],[150,"30000"]]}]`},
+		// Queries may be aligned with their step first.
+		{userQueryRangeHandler{}, Config{AlignQueriesWithStep: true}, "query=up&start=10&end=100&step=30",
+			`[{"metric":{"query":"up","user":"1"},"values":[[0,"1"],[30,"30000"],[60,"1"],[90,"30000"]]}]`},
+	} {
+		cfg := tc.cfg
+		cfg.MaxOutstandingPerTenant = 10
+		cfg.SplitQueriesByInterval = time.Minute
+		cfg.SplitQueriesParallelism = 2
+		f := New(cfg, nil)
+		worker, err := NewWorker(WorkerConfig{
+			Address:         "frontend:9095",
+			Parallelism:     2,
+			DNSLookupPeriod: time.Minute,
+			lookupHost: func(host string) ([]string, error) {
+				return []string{"10.0.0.1"}, nil
+			},
+			dial: func(addr string) (FrontendClient, func() error, error) {
+				return localFrontendClient{f}, func() error { return nil }, nil
+			},
+		}, tc.handler, http.NotFoundHandler())
+		require.NoError(t, err)
+
+		req := httptest.NewRequest("GET", "/api/prom/api/v1/query_range?"+tc.query, nil)
+		req.Header.Set("X-Scope-OrgID", "1")
+		rec := httptest.NewRecorder()
+		middleware.AuthenticateUser.Wrap(f).ServeHTTP(rec, req)
+		body, err := ioutil.ReadAll(rec.Body)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code, tc.query)
+		assert.JSONEq(t, fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":%s}}`, tc.expected), string(body), tc.query)
+		worker.Stop()
+	}
+}
+
+func TestFrontendSplitQueriesResponseSize(t *testing.T) {
+	query := func(maxResponseSize int) (int, string) {
+		cfg := Config{MaxOutstandingPerTenant: 10, SplitQueriesByInterval: time.Minute, Limits: validation.Limits{MaxQueryResponseSize: maxResponseSize}}
+		limits, err := cfg.NewOverrides()
+		require.NoError(t, err)
+		defer limits.Stop()
+		f := New(cfg, limits)
+		worker, err := NewWorker(WorkerConfig{
+			Address:         "frontend:9095",
+			Parallelism:     1,
+			DNSLookupPeriod: time.Minute,
+			lookupHost: func(host string) ([]string, error) {
+				return []string{"10.0.0.1"}, nil
+			},
+			dial: func(addr string) (FrontendClient, func() error, error) {
+				return localFrontendClient{f}, func() error { return nil }, nil
+			},
+		}, userQueryRangeHandler{}, http.NotFoundHandler())
+		require.NoError(t, err)
+		defer worker.Stop()
+
+		req := httptest.NewRequest("GET", "/api/prom/api/v1/query_range?query=up&start=0&end=150&step=30", nil)
+		req.Header.Set("X-Scope-OrgID", "1")
+		rec := httptest.NewRecorder()
+		middleware.AuthenticateUser.Wrap(f).ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	// The limit applies to the merged response, as it's written.
+	code, body := query(0)
+	require.Equal(t, http.StatusOK, code)
+	code, _ = query(len(body))
+	assert.Equal(t, http.StatusOK, code)
+	code, errBody := query(len(body) - 1)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	assert.Contains(t, errBody, `"errorType":"execution"`)
+	assert.Contains(t, errBody, fmt.Sprintf("at least %d bytes", len(body)))
+}
+
+// statsQueryRangeHandler is a userQueryRangeHandler whose queries each fetch
+// one series with one chunk and two samples from the store.
+type statsQueryRangeHandler struct {
+	userQueryRangeHandler
+}
+
+func (h statsQueryRangeHandler) QueryRange(ctx context.Context, req *QueryRangeRequest) *QueryRangeResponse {
+	resp := h.userQueryRangeHandler.QueryRange(ctx, req)
+	resp.Stats = &QueryStats{StoreSeries: 1, StoreChunks: 1, StoreSamples: 2}
+	return resp
+}
+
+func TestFrontendSplitQueriesStats(t *testing.T) {
+	f := New(Config{MaxOutstandingPerTenant: 10, SplitQueriesByInterval: time.Minute}, nil)
+	worker, err := NewWorker(WorkerConfig{
+		Address:         "frontend:9095",
+		Parallelism:     1,
+		DNSLookupPeriod: time.Minute,
+		lookupHost: func(host string) ([]string, error) {
+			return []string{"10.0.0.1"}, nil
+		},
+		dial: func(addr string) (FrontendClient, func() error, error) {
+			return localFrontendClient{f}, func() error { return nil }, nil
+		},
+	}, statsQueryRangeHandler{}, http.NotFoundHandler())
+	require.NoError(t, err)
+	defer worker.Stop()
+
+	// The query is split in three, and their stats summed.
+	req := httptest.NewRequest("GET", "/api/prom/api/v1/query_range?query=up&start=0&end=150&step=30&stats=all", nil)
+	req.Header.Set("X-Scope-OrgID", "1")
+	rec := httptest.NewRecorder()
+	middleware.AuthenticateUser.Wrap(f).ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "3", rec.Header().Get(seriesHeader))
+	assert.Equal(t, "3", rec.Header().Get(chunksHeader))
+	assert.Equal(t, "6", rec.Header().Get(samplesHeader))
+	assert.NotEmpty(t, rec.Header().Get(wallTimeHeader))
+
+	var resp struct {
+		Data struct {
+			Stats *StatsResponse `json:"stats"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.NotNil(t, resp.Data.Stats)
+	assert.Equal(t, int64(6), resp.Data.Stats.Samples.TotalQueryableSamples)
+	assert.Equal(t, QueryStats{StoreSeries: 3, StoreChunks: 3, StoreSamples: 6}, resp.Data.Stats.Cortex)
+}
@@ -0,0 +1,74 @@
+package frontend
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Response headers reporting what a query fetched, set by SetStatsHeaders.
+// Chunks are only fetched from the store.
+const (
+	seriesHeader          = "X-Cortex-Query-Series"
+	chunksHeader          = "X-Cortex-Query-Chunks"
+	samplesHeader         = "X-Cortex-Query-Samples"
+	ingesterSeriesHeader  = "X-Cortex-Query-Ingester-Series"
+	ingesterSamplesHeader = "X-Cortex-Query-Ingester-Samples"
+	storeSeriesHeader     = "X-Cortex-Query-Store-Series"
+	storeSamplesHeader    = "X-Cortex-Query-Store-Samples"
+	wallTimeHeader        = "X-Cortex-Query-Wall-Time-Seconds"
+)
+
+// SetStatsHeaders sets the headers reporting what a query fetched, and how
+// long it took, in seconds.
+func SetStatsHeaders(header http.Header, s QueryStats, wallTime float64) {
+	header.Set(seriesHeader, strconv.FormatInt(s.IngesterSeries+s.StoreSeries, 10))
+	header.Set(chunksHeader, strconv.FormatInt(s.StoreChunks, 10))
+	header.Set(samplesHeader, strconv.FormatInt(s.IngesterSamples+s.StoreSamples, 10))
+	header.Set(ingesterSeriesHeader, strconv.FormatInt(s.IngesterSeries, 10))
+	header.Set(ingesterSamplesHeader, strconv.FormatInt(s.IngesterSamples, 10))
+	header.Set(storeSeriesHeader, strconv.FormatInt(s.StoreSeries, 10))
+	header.Set(storeSamplesHeader, strconv.FormatInt(s.StoreSamples, 10))
+	header.Set(wallTimeHeader, strconv.FormatFloat(wallTime, 'f', -1, 64))
+}
+
+// StatsResponse is the stats section added to the data of responses to
+// queries with stats=all, laid out like Prometheus'.
+type StatsResponse struct {
+	Timings struct {
+		ExecTotalTime float64 `json:"execTotalTime"`
+	} `json:"timings"`
+	Samples struct {
+		TotalQueryableSamples int64 `json:"totalQueryableSamples"`
+	} `json:"samples"`
+	Cortex QueryStats `json:"cortex"`
+}
+
+// NewStatsResponse returns the stats section for a query which fetched s,
+// and took wallTime seconds.
+func NewStatsResponse(s QueryStats, wallTime float64) *StatsResponse {
+	sr := &StatsResponse{Cortex: s}
+	sr.Timings.ExecTotalTime = wallTime
+	sr.Samples.TotalQueryableSamples = s.IngesterSamples + s.StoreSamples
+	return sr
+}
+
+// mergeStats returns the sum of what a split query's subqueries fetched, or
+// nil if none of them said.
+func mergeStats(resps []*ProcessResponse) *QueryStats {
+	var merged *QueryStats
+	for _, resp := range resps {
+		s := resp.QueryRangeResponse.Stats
+		if s == nil {
+			continue
+		}
+		if merged == nil {
+			merged = &QueryStats{}
+		}
+		merged.IngesterSeries += s.IngesterSeries
+		merged.IngesterSamples += s.IngesterSamples
+		merged.StoreSeries += s.StoreSeries
+		merged.StoreChunks += s.StoreChunks
+		merged.StoreSamples += s.StoreSamples
+	}
+	return merged
+}
@@ -0,0 +1,312 @@
+package frontend
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/weaveworks/common/httpgrpc"
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+// WorkerConfig configures a querier's Worker.
+type WorkerConfig struct {
+	Address         string
+	Parallelism     int
+	DNSLookupPeriod time.Duration
+
+	// For testing.
+	lookupHost func(string) ([]string, error)
+	dial       func(addr string) (FrontendClient, func() error, error)
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *WorkerConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Address, "querier.frontend-address", "", "host:port of the query frontends; the host is resolved by DNS to every frontend (empty to not pull queries from frontends).")
+	f.IntVar(&cfg.Parallelism, "querier.worker-parallelism", 10, "Number of queries to execute at once, per frontend.")
+	f.DurationVar(&cfg.DNSLookupPeriod, "querier.dns-lookup-period", 10*time.Second, "How often to look up the frontends' addresses.")
+}
+
+// Worker pulls requests from every frontend, and executes them against a
+// querier's QueryRangeHandler, or its HTTP handler.  Frontends are rediscovered periodically, so they
+// can be scaled up and down.
+type Worker struct {
+	cfg        WorkerConfig
+	handler    http.Handler
+	queryRange QueryRangeHandler
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// Only used on the watchDNS goroutine.
+	frontends map[string]context.CancelFunc
+}
+
+// NewWorker makes a new Worker, executing range queries against queryRange,
+// and other requests against handler.
+func NewWorker(cfg WorkerConfig, queryRange QueryRangeHandler, handler http.Handler) (*Worker, error) {
+	if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+		return nil, fmt.Errorf("invalid frontend address %q: %v", cfg.Address, err)
+	}
+	if cfg.lookupHost == nil {
+		cfg.lookupHost = net.LookupHost
+	}
+	if cfg.dial == nil {
+		cfg.dial = dialFrontend
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Worker{
+		cfg:        cfg,
+		handler:    handler,
+		queryRange: queryRange,
+		ctx:        ctx,
+		cancel:     cancel,
+		frontends:  map[string]context.CancelFunc{},
+	}
+	w.wg.Add(1)
+	go w.watchDNS()
+	return w, nil
+}
+
+func dialFrontend(addr string) (FrontendClient, func() error, error) {
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewFrontendClient(conn), conn.Close, nil
+}
+
+// Stop stops the Worker, waiting for the requests it's executing.
+func (w *Worker) Stop() {
+	w.cancel()
+	w.wg.Wait()
+}
+
+func (w *Worker) watchDNS() {
+	defer w.wg.Done()
+	host, port, _ := net.SplitHostPort(w.cfg.Address)
+
+	ticker := time.NewTicker(w.cfg.DNSLookupPeriod)
+	defer ticker.Stop()
+	for {
+		addrs, err := w.cfg.lookupHost(host)
+		if err != nil {
+			log.Errorf("Error looking up frontends %s: %v", host, err)
+		} else {
+			w.updateFrontends(addrs, port)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+// updateFrontends starts workers for new frontends, and stops those for
+// frontends which have gone away.
+func (w *Worker) updateFrontends(hosts []string, port string) {
+	current := map[string]bool{}
+	for _, host := range hosts {
+		addr := net.JoinHostPort(host, port)
+		current[addr] = true
+		if _, ok := w.frontends[addr]; ok {
+			continue
+		}
+
+		log.Infof("Adding frontend %s", addr)
+		client, closeClient, err := w.cfg.dial(addr)
+		if err != nil {
+			log.Errorf("Error connecting to frontend %s: %v", addr, err)
+			continue
+		}
+		ctx, cancel := context.WithCancel(w.ctx)
+		w.frontends[addr] = cancel
+
+		var wg sync.WaitGroup
+		for i := 0; i < w.cfg.Parallelism; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w.runOne(ctx, addr, client)
+			}()
+		}
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			wg.Wait()
+			if err := closeClient(); err != nil {
+				log.Errorf("Error closing connection to frontend %s: %v", addr, err)
+			}
+		}()
+	}
+
+	for addr, cancel := range w.frontends {
+		if !current[addr] {
+			log.Infof("Removing frontend %s", addr)
+			cancel()
+			delete(w.frontends, addr)
+		}
+	}
+}
+
+// runOne processes requests from a frontend, one at a time, reconnecting
+// with backoff when the stream fails.  The backoff is reset by streams
+// which processed any requests, so the occasional failure of long-lived
+// streams doesn't build it up.
+func (w *Worker) runOne(ctx context.Context, addr string, client FrontendClient) {
+	backoff := minBackoff
+	for ctx.Err() == nil {
+		stream, err := client.Process(ctx)
+		processed := false
+		if err == nil {
+			processed, err = w.process(ctx, stream)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if processed {
+			backoff = minBackoff
+		}
+		if grpc.Code(err) == codes.Canceled {
+			// The frontend cancelled a request we were executing.
+			backoff = minBackoff
+			continue
+		}
+
+		log.Errorf("Error processing requests from frontend %s, backing off %s: %v", addr, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 10 * time.Second
+)
+
+// process executes requests from a stream until it fails, returning whether
+// it executed any.  The stream is received from while a request executes, as
+// the frontend ends it when the request's client gives up, and the request
+// is then cancelled.
+func (w *Worker) process(ctx context.Context, stream Frontend_ProcessClient) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	requests := make(chan *ProcessRequest)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				cancel()
+				return
+			}
+			select {
+			case requests <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	processed := false
+	for {
+		var req *ProcessRequest
+		select {
+		case req = <-requests:
+		case err := <-errs:
+			return processed, err
+		}
+		processed = true
+
+		body := responseBuffers.Get()
+		err := stream.Send(w.handle(ctx, req, body))
+		// Send has serialised the response, so its body can be reused.
+		responseBuffers.Put(body)
+		if err != nil {
+			// Send fails with io.EOF when the frontend ended the stream; why
+			// it did is received.
+			select {
+			case err = <-errs:
+			case <-time.After(time.Second):
+			}
+			return processed, err
+		}
+	}
+}
+
+// responseBuffers hold the bodies of HTTP responses, until they're sent.
+var responseBuffers = util.NewBufferPool("querier_worker_response")
+
+// handle executes req, writing any HTTP response's body to body.
+func (w *Worker) handle(ctx context.Context, req *ProcessRequest, body *bytes.Buffer) *ProcessResponse {
+	if req.QueryRangeRequest != nil {
+		ctx = user.Inject(ctx, req.QueryRangeRequest.UserId)
+		return &ProcessResponse{QueryRangeResponse: w.queryRange.QueryRange(ctx, req.QueryRangeRequest)}
+	}
+
+	r, err := http.NewRequest(req.HttpRequest.Method, req.HttpRequest.Url, ioutil.NopCloser(bytes.NewReader(req.HttpRequest.Body)))
+	if err != nil {
+		return &ProcessResponse{HttpResponse: &httpgrpc.HTTPResponse{
+			Code: http.StatusInternalServerError,
+			Body: []byte(err.Error()),
+		}}
+	}
+	r = r.WithContext(ctx)
+	toHeader(req.HttpRequest.Headers, r.Header)
+	r.RequestURI = req.HttpRequest.Url
+
+	rw := &responseWriter{header: http.Header{}, body: body}
+	w.handler.ServeHTTP(rw, r)
+	if rw.code == 0 {
+		rw.code = http.StatusOK
+	}
+	return &ProcessResponse{HttpResponse: &httpgrpc.HTTPResponse{
+		Code:    int32(rw.code),
+		Headers: fromHeader(rw.header),
+		Body:    body.Bytes(),
+	}}
+}
+
+// responseWriter buffers an HTTP response, to be sent to the frontend.
+type responseWriter struct {
+	header http.Header
+	code   int
+	body   *bytes.Buffer
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
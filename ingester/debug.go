@@ -0,0 +1,137 @@
+package ingester
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+
+	"github.com/weaveworks/common/user"
+)
+
+const defaultDebugSeriesLimit = 1000
+
+// debugSeries describes a series held in memory.
+type debugSeries struct {
+	Fingerprint   string       `json:"fingerprint"`
+	Labels        model.Metric `json:"labels"`
+	Chunks        int          `json:"chunks"`
+	SpilledChunks int          `json:"spilled_chunks"`
+	FirstTime     model.Time   `json:"first_time"`
+	LastTime      model.Time   `json:"last_time"`
+	HeadChunk     struct {
+		FirstTime model.Time `json:"first_time"`
+		LastTime  model.Time `json:"last_time"`
+		Closed    bool       `json:"closed"`
+	} `json:"head_chunk"`
+	// Chunks in memory, and labels.
+	MemoryBytes int `json:"memory_bytes"`
+}
+
+// SeriesHandler lists the user's in-memory series matching the match[]
+// selectors (all series if there are none), with their chunks, for
+// debugging.  It must be wrapped in authentication.  At most limit series
+// (1000 by default) are listed, biggest first.
+func (i *Ingester) SeriesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := user.Extract(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := defaultDebugSeriesLimit
+	if s := r.FormValue("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	selectors := r.Form["match[]"]
+	if len(selectors) == 0 {
+		selectors = []string{`{__name__=~".+"}`}
+	}
+	matcherSets := make([]metric.LabelMatchers, 0, len(selectors))
+	for _, s := range selectors {
+		matchers, err := promql.ParseMetricSelector(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+
+	result := struct {
+		Total  int           `json:"total"`
+		Series []debugSeries `json:"series"`
+	}{Series: []debugSeries{}}
+	// Looked up without creating the user, unlike queries.
+	if state, ok := i.userStates.get(userID); ok {
+		seen := map[model.Fingerprint]struct{}{}
+		for _, matchers := range matcherSets {
+			err := state.forSeriesMatching(matchers, func(fp model.Fingerprint, series *memorySeries) error {
+				if _, ok := seen[fp]; !ok {
+					seen[fp] = struct{}{}
+					result.Series = append(result.Series, describeSeries(fp, series))
+				}
+				return nil
+			})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	result.Total = len(result.Series)
+	sort.Slice(result.Series, func(i, j int) bool {
+		if result.Series[i].MemoryBytes != result.Series[j].MemoryBytes {
+			return result.Series[i].MemoryBytes > result.Series[j].MemoryBytes
+		}
+		return result.Series[i].Fingerprint < result.Series[j].Fingerprint
+	})
+	if len(result.Series) > limit {
+		result.Series = result.Series[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Errorf("Error writing series: %v", err)
+	}
+}
+
+// describeSeries describes series; the caller must have locked fp.
+func describeSeries(fp model.Fingerprint, series *memorySeries) debugSeries {
+	d := debugSeries{
+		Fingerprint: fp.String(),
+		Labels:      series.metric,
+		Chunks:      len(series.chunkDescs),
+	}
+	for name, value := range series.metric {
+		d.MemoryBytes += len(name) + len(value)
+	}
+	for _, desc := range series.chunkDescs {
+		if desc.C == nil {
+			d.SpilledChunks++
+		} else {
+			d.MemoryBytes += chunk.ChunkLen
+		}
+	}
+	if len(series.chunkDescs) > 0 {
+		head := series.head()
+		d.FirstTime = series.firstTime()
+		d.LastTime = head.LastTime
+		d.HeadChunk.FirstTime = head.FirstTime
+		d.HeadChunk.LastTime = head.LastTime
+		d.HeadChunk.Closed = series.headChunkClosed
+	}
+	return d
+}
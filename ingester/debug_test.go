@@ -0,0 +1,83 @@
+package ingester
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/validation"
+)
+
+func TestSeriesHandler(t *testing.T) {
+	ing, err := New(Config{
+		FlushCheckPeriod: 99999 * time.Hour,
+		Limits:           validation.Limits{MaxChunkIdle: 99999 * time.Hour},
+	}, &testStore{chunks: map[string][]chunk.Chunk{}}, nil)
+	require.NoError(t, err)
+	defer ing.Stop()
+
+	ctx := user.Inject(context.Background(), "1")
+	_, err = ing.Push(ctx, util.ToWriteRequest(matrixToSamples(buildTestMatrix(3, 10, 0))))
+	require.NoError(t, err)
+
+	query := func(userID, url string) (int, []debugSeries, int) {
+		req := httptest.NewRequest("GET", url, nil)
+		req = req.WithContext(user.Inject(req.Context(), userID))
+		rec := httptest.NewRecorder()
+		ing.SeriesHandler(rec, req)
+		var result struct {
+			Total  int           `json:"total"`
+			Series []debugSeries `json:"series"`
+		}
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+		}
+		return rec.Code, result.Series, result.Total
+	}
+
+	code, series, total := query("1", "/debug/series")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 3, total)
+	assert.Len(t, series, 3)
+
+	code, series, total = query("1", `/debug/series?match[]=testmetric_1&match[]={__name__="testmetric_2"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 2, total)
+
+	code, series, total = query("1", "/debug/series?match[]=testmetric_1")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, series, 1)
+	s := series[0]
+	assert.Equal(t, "testmetric_1", string(s.Labels["__name__"]))
+	assert.Equal(t, 1, s.Chunks)
+	assert.Equal(t, 0, s.SpilledChunks)
+	assert.Equal(t, 1, int(s.HeadChunk.FirstTime))
+	assert.Equal(t, 10, int(s.HeadChunk.LastTime))
+	assert.False(t, s.HeadChunk.Closed)
+	assert.True(t, s.MemoryBytes > 1024, s.MemoryBytes)
+
+	code, series, total = query("1", "/debug/series?limit=1")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 3, total)
+	assert.Len(t, series, 1)
+
+	// Other users' series aren't visible.
+	code, series, total = query("2", "/debug/series")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 0, total)
+	assert.Empty(t, series)
+
+	code, _, _ = query("1", "/debug/series?match[]={")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _, _ = query("1", "/debug/series?limit=0")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
@@ -0,0 +1,88 @@
+package ingester
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// flushHealth tracks whether flushing is failing persistently: more than
+// budget of the flushes in each flush period failing, for longer than
+// deadline.  Chunks can't leave memory while it is, so the ingester would
+// eventually run out.
+type flushHealth struct {
+	deadline time.Duration
+	budget   float64
+
+	mtx                 sync.Mutex
+	successes, failures int
+	failingSince        time.Time
+	unhealthy           bool
+}
+
+func newFlushHealth(deadline time.Duration, budget float64) *flushHealth {
+	return &flushHealth{
+		deadline: deadline,
+		budget:   budget,
+	}
+}
+
+// record counts a flush, failed if err isn't nil.
+func (h *flushHealth) record(err error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if err != nil {
+		h.failures++
+	} else {
+		h.successes++
+	}
+}
+
+// update ends the period of flushes since it was last called, at now,
+// returning whether flushing is unhealthy.  Periods without flushes leave
+// things as they were.
+func (h *flushHealth) update(now time.Time) bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	total := h.successes + h.failures
+	if total > 0 {
+		if float64(h.failures)/float64(total) > h.budget {
+			if h.failingSince.IsZero() {
+				h.failingSince = now
+			}
+		} else {
+			h.failingSince = time.Time{}
+		}
+	}
+	h.successes, h.failures = 0, 0
+
+	unhealthy := !h.failingSince.IsZero() && now.Sub(h.failingSince) > h.deadline
+	if unhealthy != h.unhealthy {
+		if unhealthy {
+			log.Errorf("Flushes have been failing since %v, marking ingester not ready", h.failingSince)
+		} else {
+			log.Infof("Flushes have recovered, marking ingester ready")
+		}
+	}
+	h.unhealthy = unhealthy
+	return unhealthy
+}
+
+func (h *flushHealth) healthy() bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return !h.unhealthy
+}
+
+// updateFlushHealth ends the flush period, if flush health is tracked.
+func (i *Ingester) updateFlushHealth() {
+	if i.flushHealth == nil {
+		return
+	}
+	if i.flushHealth.update(time.Now()) {
+		i.flushUnhealthy.Set(1)
+	} else {
+		i.flushUnhealthy.Set(0)
+	}
+}
@@ -0,0 +1,104 @@
+package ingester
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/validation"
+)
+
+func TestFlushHealth(t *testing.T) {
+	h := newFlushHealth(time.Minute, 0.5)
+	start := time.Now()
+	for _, tc := range []struct {
+		successes, failures int
+		after               time.Duration
+		unhealthy           bool
+	}{
+		// Within the budget.
+		{1, 1, 0, false},
+		// Failing, but not for long enough.
+		{1, 2, time.Minute, false},
+		{0, 1, 2*time.Minute + time.Second, true},
+		// No flushes tells us nothing.
+		{0, 0, 3 * time.Minute, true},
+		// Recovered.
+		{2, 1, 4 * time.Minute, false},
+		// The deadline restarts.
+		{0, 1, 5 * time.Minute, false},
+	} {
+		for i := 0; i < tc.successes; i++ {
+			h.record(nil)
+		}
+		for i := 0; i < tc.failures; i++ {
+			h.record(errFlush)
+		}
+		if unhealthy := h.update(start.Add(tc.after)); unhealthy != tc.unhealthy || h.healthy() == tc.unhealthy {
+			t.Errorf("after %v, expected unhealthy %v, got %v", tc.after, tc.unhealthy, unhealthy)
+		}
+	}
+}
+
+var errFlush = fmt.Errorf("flush failed")
+
+func TestIngesterNotReadyWhileFlushesFail(t *testing.T) {
+	store := &partialStore{
+		testStore: testStore{chunks: map[string][]chunk.Chunk{}},
+		failIndex: true,
+	}
+	ing, err := New(Config{
+		FlushCheckPeriod:     99999 * time.Hour,
+		Limits:               validation.Limits{MaxChunkIdle: 99999 * time.Hour},
+		FlushFailureDeadline: time.Nanosecond,
+	}, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ing.Stop()
+
+	ctx := user.Inject(context.Background(), "1")
+	if _, err := ing.Push(ctx, util.ToWriteRequest(matrixToSamples(buildTestMatrix(1, 10, 0)))); err != nil {
+		t.Fatal(err)
+	}
+	userState, _ := ing.userStates.get("1")
+	var fp model.Fingerprint
+	for pair := range userState.fpToSeries.iter() {
+		fp = pair.fp
+	}
+
+	flush := func() {
+		ing.flushUserSeries("1", fp, true)
+		ing.updateFlushHealth()
+	}
+	flush()
+	flush()
+	rec := httptest.NewRecorder()
+	ing.ReadinessHandler(rec, httptest.NewRequest("GET", "/ready", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected the ingester not to be ready, got %d", rec.Code)
+	}
+	if ing.flushHealth.healthy() {
+		t.Fatal("expected flushing to be unhealthy")
+	}
+
+	store.mtx.Lock()
+	store.failIndex = false
+	store.mtx.Unlock()
+	flush()
+	if !ing.flushHealth.healthy() {
+		t.Fatal("expected flushing to have recovered")
+	}
+
+	if _, err := New(Config{FlushFailureDeadline: time.Minute, FlushErrorBudget: 1}, nil, nil); err == nil {
+		t.Error("expected a flush error budget of 1 to be rejected")
+	}
+}
@@ -7,9 +7,6 @@ import (
 	"sync"
 	"time"
 
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
@@ -22,22 +19,18 @@ import (
 	cortex_chunk "github.com/weaveworks/cortex/chunk"
 	"github.com/weaveworks/cortex/ring"
 	"github.com/weaveworks/cortex/util"
+	cortex_errors "github.com/weaveworks/cortex/util/errors"
+	"github.com/weaveworks/cortex/util/validation"
 )
 
 const (
 	ingesterSubsystem  = "ingester"
 	discardReasonLabel = "reason"
 
-	// Reasons to discard samples.
-	outOfOrderTimestamp = "timestamp_out_of_order"
-	duplicateSample     = "multiple_values_for_timestamp"
-
 	// DefaultConcurrentFlush is the number of series to flush concurrently
 	DefaultConcurrentFlush = 50
 	// DefaultMaxSeriesPerUser is the maximum number of series allowed per user.
 	DefaultMaxSeriesPerUser = 5000000
-	// DefaultMaxSeriesPerMetric is the maximum number of series in one metric (of a single user).
-	DefaultMaxSeriesPerMetric = 50000
 
 	minReadyDuration = 1 * time.Minute
 )
@@ -76,12 +69,17 @@ type Ingester struct {
 	chunkStore ChunkStore
 	userStates *userStates
 	ring       *ring.Ring
+	limits     *validation.Overrides
 
 	stopLock sync.RWMutex
 	stopped  bool
 	quit     chan struct{}
 	done     sync.WaitGroup
 
+	// Flushes are made in flushCtx, so they can be abandoned on shutdown.
+	flushCtx      context.Context
+	cancelFlushes context.CancelFunc
+
 	readyLock sync.Mutex
 	startTime time.Time
 	ready     bool
@@ -90,13 +88,26 @@ type Ingester struct {
 	// pick a queue.
 	flushQueues []*util.PriorityQueue
 
+	// Flushed chunks to be read back; nil if none are.
+	readbacks chan readback
+
+	// Whether flushes are failing persistently; nil if not tracked.
+	flushHealth *flushHealth
+
 	ingestedSamples  prometheus.Counter
 	chunkUtilization prometheus.Histogram
 	chunkLength      prometheus.Histogram
 	chunkAge         prometheus.Histogram
+	flushedChunkAge  *prometheus.HistogramVec
+	flushedChunkSize *prometheus.HistogramVec
 	queries          prometheus.Counter
 	queriedSamples   prometheus.Counter
 	memoryChunks     prometheus.Gauge
+	spilledChunks    prometheus.Gauge
+	chunkReadbacks   *prometheus.CounterVec
+	flushFailures    *prometheus.CounterVec
+	uploadsSkipped   prometheus.Counter
+	flushUnhealthy   prometheus.Gauge
 }
 
 // ChunkStore is the interface we need to store chunks
@@ -104,26 +115,104 @@ type ChunkStore interface {
 	Put(ctx context.Context, chunks []cortex_chunk.Chunk) error
 }
 
+// PartialChunkStore is implemented by ChunkStores which can store chunks and
+// index them separately, so when indexing fails the retry needn't upload the
+// chunks again.
+type PartialChunkStore interface {
+	PutChunks(ctx context.Context, chunks []cortex_chunk.Chunk) error
+	PutIndex(ctx context.Context, chunks []cortex_chunk.Chunk) error
+}
+
+// Shutdown policies.  Chunks left unflushed, by any of them, are persisted to
+// the spill dir, and flushed by the next ingester to start with it.
+const (
+	// ShutdownFlush flushes every chunk before stopping.
+	ShutdownFlush = "flush"
+	// ShutdownHandover hands every chunk over to another active ingester,
+	// which flushes them.  Until then, they're only queried if that
+	// ingester is one of their series' replicas.
+	ShutdownHandover = "handover"
+	// ShutdownAbandon stops without flushing the chunks in memory.
+	ShutdownAbandon = "abandon"
+)
+
+// Reasons chunks are flushed, for flushedChunkAge and flushedChunkSize.
+const (
+	flushReasonFull     = "full"
+	flushReasonMaxAge   = "max_age"
+	flushReasonIdle     = "idle"
+	flushReasonShutdown = "shutdown"
+)
+
+// Stages of a flush, for flushFailures.
+const (
+	flushStageChunks = "chunks"
+	flushStageIndex  = "index"
+)
+
 // Config configures an Ingester.
 type Config struct {
 	FlushCheckPeriod  time.Duration
-	MaxChunkIdle      time.Duration
-	MaxChunkAge       time.Duration
 	ConcurrentFlushes int
 	ChunkEncoding     string
 	UserStatesConfig  UserStatesConfig
+
+	// Closed chunks beyond this many bytes in memory are spilled to SpillDir.
+	MaxChunkMemoryBytes int
+	SpillDir            string
+
+	// Fraction of flushed chunks to read back from the store, after
+	// ReadbackDelay, and compare to what was flushed.
+	ReadbackFraction float64
+	ReadbackDelay    time.Duration
+
+	// What to do with the chunks in memory on shutdown, and how long to
+	// spend doing it before abandoning what's left.
+	ShutdownPolicy      string
+	MaxShutdownDuration time.Duration
+
+	// This ingester's address in the ring, so it doesn't hand chunks over
+	// to itself.
+	Addr string
+
+	// The ingester isn't ready while more than FlushErrorBudget of the
+	// flushes in each FlushCheckPeriod have failed for longer than
+	// FlushFailureDeadline.
+	FlushFailureDeadline time.Duration
+	FlushErrorBudget     float64
+
+	// The defaults of MaxChunkAge, MaxChunkIdle and MaxSeriesPerMetric, and
+	// their overrides per tenant.  A tenant's max_sample_age tells samples
+	// too old for their series from those merely out of order.
+	Limits          validation.Limits
+	OverridesConfig validation.OverridesConfig
+
+	// For testing: the ingester to hand chunks over to, rather than one from
+	// the ring.
+	handoverClient cortex.IngesterClient
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
 func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	f.DurationVar(&cfg.FlushCheckPeriod, "ingester.flush-period", 1*time.Minute, "Period with which to attempt to flush chunks.")
-	f.DurationVar(&cfg.MaxChunkIdle, "ingester.max-chunk-idle", 1*time.Hour, "Maximum chunk idle time before flushing.")
-	f.DurationVar(&cfg.MaxChunkAge, "ingester.max-chunk-age", 12*time.Hour, "Maximum chunk age time before flushing.")
 	f.IntVar(&cfg.ConcurrentFlushes, "ingester.concurrent-flushes", DefaultConcurrentFlush, "Number of concurrent goroutines flushing to dynamodb.")
 	f.StringVar(&cfg.ChunkEncoding, "ingester.chunk-encoding", "1", "Encoding version to use for chunks.")
 	f.DurationVar(&cfg.UserStatesConfig.RateUpdatePeriod, "ingester.rate-update-period", 15*time.Second, "Period with which to update the per-user ingestion rates.")
 	f.IntVar(&cfg.UserStatesConfig.MaxSeriesPerUser, "ingester.max-series-per-user", DefaultMaxSeriesPerUser, "Maximum number of active series per user.")
-	f.IntVar(&cfg.UserStatesConfig.MaxSeriesPerMetric, "ingester.max-series-per-metric", DefaultMaxSeriesPerMetric, "Maximum number of active series per metric name.")
+	f.IntVar(&cfg.UserStatesConfig.MaxGlobalSeriesPerUser, "ingester.max-global-series-per-user", 0, "Approximate maximum number of active series per user across all ingesters, enforced by each allowing the limit times -distributor.replication-factor over the number of healthy ingesters; requires -distributor.shard-by-all-labels (0 to disable).")
+	// Shared with the distributor, which does the replicating, so it's
+	// configured once.
+	f.IntVar(&cfg.UserStatesConfig.ReplicationFactor, "distributor.replication-factor", 3, "The number of ingesters to write to and read from.")
+	f.IntVar(&cfg.MaxChunkMemoryBytes, "ingester.max-chunk-memory-bytes", 0, "Memory used by chunks beyond which the oldest closed chunks are spilled to disk until flushed (0 to disable).")
+	f.StringVar(&cfg.SpillDir, "ingester.spill-dir", "", "Directory to spill chunks to, required by -ingester.max-chunk-memory-bytes, and to persist the chunks not flushed or handed over by shutdown in, to be flushed on restart; use a persistent volume to keep them across pods (empty to drop them).")
+	f.Float64Var(&cfg.ReadbackFraction, "ingester.chunk-readback-fraction", 0, "Fraction of flushed chunks to read back from the store and compare to what was flushed, to catch storage corruption (0 to disable).")
+	f.DurationVar(&cfg.ReadbackDelay, "ingester.chunk-readback-delay", time.Minute, "How long after flushing a chunk to read it back.")
+	f.StringVar(&cfg.ShutdownPolicy, "ingester.shutdown-policy", ShutdownFlush, "What to do with the chunks in memory on shutdown: flush them, hand them over to another active ingester to flush, or abandon them, stopping at once; chunks left unflushed are persisted to -ingester.spill-dir.")
+	f.DurationVar(&cfg.MaxShutdownDuration, "ingester.max-shutdown-duration", 0, "Stop flushing or handing over chunks this long after shutdown starts, persisting the chunks left to -ingester.spill-dir, so the ingester stops before it's killed (0 for no limit).")
+	f.DurationVar(&cfg.FlushFailureDeadline, "ingester.flush-failure-deadline", 0, "Mark the ingester not ready once flushes have been failing for longer than this, so it's noticed before memory runs out (0 to disable).")
+	f.Float64Var(&cfg.FlushErrorBudget, "ingester.flush-error-budget", 0.1, "Fraction of the flushes in each -ingester.flush-period which may fail without flushing counting as failing.")
+	cfg.OverridesConfig.RegisterFlags(f)
+	cfg.Limits.RegisterIngesterFlags(f)
 }
 
 type flushOp struct {
@@ -146,8 +235,8 @@ func New(cfg Config, chunkStore ChunkStore, ring *ring.Ring) (*Ingester, error)
 	if cfg.FlushCheckPeriod == 0 {
 		cfg.FlushCheckPeriod = 1 * time.Minute
 	}
-	if cfg.MaxChunkIdle == 0 {
-		cfg.MaxChunkIdle = 1 * time.Hour
+	if cfg.Limits.MaxChunkIdle == 0 {
+		cfg.Limits.MaxChunkIdle = 1 * time.Hour
 	}
 	if cfg.ConcurrentFlushes <= 0 {
 		cfg.ConcurrentFlushes = DefaultConcurrentFlush
@@ -155,29 +244,51 @@ func New(cfg Config, chunkStore ChunkStore, ring *ring.Ring) (*Ingester, error)
 	if cfg.ChunkEncoding == "" {
 		cfg.ChunkEncoding = "1"
 	}
+	switch cfg.ShutdownPolicy {
+	case "":
+		cfg.ShutdownPolicy = ShutdownFlush
+	case ShutdownFlush, ShutdownHandover, ShutdownAbandon:
+	default:
+		return nil, fmt.Errorf("unknown shutdown policy %q, must be %s, %s or %s", cfg.ShutdownPolicy, ShutdownFlush, ShutdownHandover, ShutdownAbandon)
+	}
 	if cfg.UserStatesConfig.RateUpdatePeriod == 0 {
 		cfg.UserStatesConfig.RateUpdatePeriod = 15 * time.Second
 	}
 	if cfg.UserStatesConfig.MaxSeriesPerUser <= 0 {
 		cfg.UserStatesConfig.MaxSeriesPerUser = DefaultMaxSeriesPerUser
 	}
-	if cfg.UserStatesConfig.MaxSeriesPerMetric <= 0 {
-		cfg.UserStatesConfig.MaxSeriesPerMetric = DefaultMaxSeriesPerMetric
+	if cfg.Limits.MaxSeriesPerMetric <= 0 {
+		cfg.Limits.MaxSeriesPerMetric = validation.DefaultMaxSeriesPerMetric
 	}
 
 	if err := chunk.DefaultEncoding.Set(cfg.ChunkEncoding); err != nil {
 		return nil, err
 	}
 
+	if cfg.MaxChunkMemoryBytes > 0 {
+		if cfg.SpillDir == "" {
+			return nil, fmt.Errorf("spilling chunks beyond -ingester.max-chunk-memory-bytes requires -ingester.spill-dir")
+		}
+		if err := cleanSpillDir(cfg.SpillDir); err != nil {
+			return nil, err
+		}
+	}
+
+	limits, err := validation.NewOverrides(cfg.OverridesConfig, cfg.Limits)
+	if err != nil {
+		return nil, err
+	}
+
 	i := &Ingester{
 		cfg:        cfg,
 		chunkStore: chunkStore,
 		quit:       make(chan struct{}),
 		ring:       ring,
+		limits:     limits,
 
 		startTime: time.Now(),
 
-		userStates:  newUserStates(&cfg.UserStatesConfig),
+		userStates:  newUserStates(&cfg.UserStatesConfig, limits),
 		flushQueues: make([]*util.PriorityQueue, cfg.ConcurrentFlushes, cfg.ConcurrentFlushes),
 
 		ingestedSamples: prometheus.NewCounter(prometheus.CounterOpts{
@@ -199,10 +310,24 @@ func New(cfg Config, chunkStore ChunkStore, ring *ring.Ring) (*Ingester, error)
 			Help:    "Distribution of chunk ages (when stored).",
 			Buckets: prometheus.ExponentialBuckets(60, 2, 10), // biggest bucket is 60*2^(10-1) = 30720 = 8:32 hrs
 		}),
+		flushedChunkAge: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "cortex_ingester_flushed_chunk_age_seconds",
+			Help:    "Distribution of chunk ages when flushed, by why they were flushed.",
+			Buckets: prometheus.ExponentialBuckets(60, 2, 10),
+		}, []string{"reason"}),
+		flushedChunkSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "cortex_ingester_flushed_chunk_size_bytes",
+			Help:    "Distribution of the bytes used by chunks when flushed, by why they were flushed.",
+			Buckets: prometheus.ExponentialBuckets(16, 2, 7), // biggest bucket is 16*2^(7-1) = 1024, the chunk length
+		}, []string{"reason"}),
 		memoryChunks: prometheus.NewGauge(prometheus.GaugeOpts{
 			Name: "cortex_ingester_memory_chunks",
 			Help: "The total number of chunks in memory.",
 		}),
+		spilledChunks: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_ingester_spilled_chunks",
+			Help: "The total number of chunks spilled to disk awaiting flush.",
+		}),
 		queries: prometheus.NewCounter(prometheus.CounterOpts{
 			Name: "cortex_ingester_queries_total",
 			Help: "The total number of queries the ingester has handled.",
@@ -211,6 +336,53 @@ func New(cfg Config, chunkStore ChunkStore, ring *ring.Ring) (*Ingester, error)
 			Name: "cortex_ingester_queried_samples_total",
 			Help: "The total number of samples returned from queries.",
 		}),
+		chunkReadbacks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_ingester_chunk_readbacks_total",
+			Help: "The total number of flushed chunks sampled to be read back from the store, by whether they matched what was flushed.",
+		}, []string{"result"}),
+		flushFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_ingester_flush_failures_total",
+			Help: "The total number of failed flushes, by the stage that failed; when indexing fails, the chunks are stored but not yet indexed.",
+		}, []string{"stage"}),
+		uploadsSkipped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingester_chunk_uploads_skipped_total",
+			Help: "The total number of chunks not uploaded again when retrying a flush, as they were stored by a flush whose indexing failed.",
+		}),
+		flushUnhealthy: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_ingester_flush_unhealthy",
+			Help: "Whether flushes have been failing for longer than -ingester.flush-failure-deadline, so the ingester isn't ready.",
+		}),
+	}
+
+	i.flushCtx, i.cancelFlushes = context.WithCancel(context.Background())
+	if ring != nil {
+		i.userStates.healthyIngesters = ring.ActiveCount
+		i.userStates.updateRates()
+	}
+
+	if cfg.FlushFailureDeadline > 0 {
+		if cfg.FlushErrorBudget < 0 || cfg.FlushErrorBudget >= 1 {
+			return nil, fmt.Errorf("flush error budget must be in [0, 1): %v", cfg.FlushErrorBudget)
+		}
+		i.flushHealth = newFlushHealth(cfg.FlushFailureDeadline, cfg.FlushErrorBudget)
+	}
+
+	if cfg.ReadbackFraction > 0 {
+		fetcher, ok := chunkStore.(ChunkFetcher)
+		if !ok {
+			return nil, fmt.Errorf("chunks can't be read back from this chunk store")
+		}
+		i.readbacks = make(chan readback, maxPendingReadbacks)
+		i.done.Add(1)
+		go i.readbackLoop(fetcher)
+	}
+
+	if cfg.SpillDir != "" {
+		if loaded, err := i.loadChunks(); err != nil {
+			log.Errorf("Error loading chunks persisted by the last shutdown: %v", err)
+		} else if loaded > 0 {
+			log.Infof("Loaded %d chunks persisted by the last shutdown", loaded)
+		}
 	}
 
 	i.done.Add(cfg.ConcurrentFlushes)
@@ -228,14 +400,20 @@ func New(cfg Config, chunkStore ChunkStore, ring *ring.Ring) (*Ingester, error)
 // the addition removal of another ingester. Returns 204 when the ingester is
 // ready, 500 otherwise.
 func (i *Ingester) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
-	if i.isReady() {
+	if i.IsReady() {
 		w.WriteHeader(http.StatusNoContent)
 	} else {
 		w.WriteHeader(http.StatusInternalServerError)
 	}
 }
 
-func (i *Ingester) isReady() bool {
+// IsReady returns whether the ingester is ready, as ReadinessHandler and
+// gRPC health checks report.
+func (i *Ingester) IsReady() bool {
+	if i.flushHealth != nil && !i.flushHealth.healthy() {
+		return false
+	}
+
 	i.readyLock.Lock()
 	defer i.readyLock.Unlock()
 
@@ -255,24 +433,36 @@ func (i *Ingester) isReady() bool {
 
 // Push implements cortex.IngesterServer
 func (i *Ingester) Push(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
-	var lastPartialErr error
+	var lastLimitErr error
+	userID, _ := user.Extract(ctx) // ignore err, userID will be empty string if err
+	discards := validation.NewDiscards(userID)
 	samples := util.FromWriteRequest(req)
 	for j := range samples {
-		if err := i.append(ctx, &samples[j]); err != nil {
-			if err == util.ErrUserSeriesLimitExceeded || err == util.ErrMetricSeriesLimitExceeded {
-				lastPartialErr = grpc.Errorf(codes.ResourceExhausted, err.Error())
+		if err := i.append(ctx, userID, &samples[j], discards); err != nil {
+			if cortex_errors.TypeOf(err) == cortex_errors.LimitExceeded {
+				lastLimitErr = err
 				continue
 			}
 			return nil, err
 		}
 	}
 
-	return &cortex.WriteResponse{}, lastPartialErr
+	// The limit error takes precedence, keeping its type, but the discards
+	// are still reported.
+	discardsErr := discards.Err()
+	switch {
+	case lastLimitErr != nil && discardsErr != nil:
+		return &cortex.WriteResponse{}, cortex_errors.ToGRPC(cortex_errors.Errorf(cortex_errors.LimitExceeded, "%v; %v", lastLimitErr, discardsErr))
+	case lastLimitErr != nil:
+		return &cortex.WriteResponse{}, cortex_errors.ToGRPC(lastLimitErr)
+	}
+	return &cortex.WriteResponse{}, cortex_errors.ToGRPC(discardsErr)
 }
 
-func (i *Ingester) append(ctx context.Context, sample *model.Sample) error {
+// append appends sample to its series, recording it in discards if it can't
+// be appended after the samples already there.
+func (i *Ingester) append(ctx context.Context, userID string, sample *model.Sample, discards *validation.Discards) error {
 	if err := util.ValidateSample(sample); err != nil {
-		userID, _ := user.Extract(ctx) // ignore err, userID will be empty string if err
 		log.Errorf("Error validating sample from user '%s': %v", userID, err)
 		return nil
 	}
@@ -298,10 +488,19 @@ func (i *Ingester) append(ctx context.Context, sample *model.Sample) error {
 	}()
 
 	prevNumChunks := len(series.chunkDescs)
+	newest := series.lastTime
 	if err := series.add(model.SamplePair{
 		Value:     sample.Value,
 		Timestamp: sample.Timestamp,
 	}); err != nil {
+		switch err {
+		case ErrOutOfOrderSample:
+			discards.Add(i.limits.ValidateSeriesTimestamp(userID, newest, sample.Timestamp))
+			return nil
+		case ErrDuplicateSampleForTimestamp:
+			discards.Add(validation.DuplicateSample, cortex_errors.Errorf(cortex_errors.Validation, "%v at %v for series %v", err, sample.Timestamp, sample.Metric))
+			return nil
+		}
 		return err
 	}
 
@@ -415,22 +614,92 @@ func (i *Ingester) UserStats(ctx context.Context, req *cortex.UserStatsRequest)
 	}, nil
 }
 
+// AllUserStats returns ingestion statistics for every user with series in
+// memory.
+func (i *Ingester) AllUserStats() map[string]*cortex.UserStatsResponse {
+	states := i.userStates.cp()
+	result := make(map[string]*cortex.UserStatsResponse, len(states))
+	for userID, state := range states {
+		result[userID] = &cortex.UserStatsResponse{
+			IngestionRate: state.ingestedSamples.rate(),
+			NumSeries:     uint64(state.fpToSeries.length()),
+		}
+	}
+	return result
+}
+
 // Stop stops the Ingester.
 func (i *Ingester) Stop() {
 	i.stopLock.Lock()
 	i.stopped = true
 	i.stopLock.Unlock()
 
+	ctx := context.Background()
+	if i.cfg.MaxShutdownDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, i.cfg.MaxShutdownDuration)
+		defer cancel()
+	}
+	if i.cfg.ShutdownPolicy != ShutdownFlush {
+		i.cancelFlushes()
+	}
+
 	// Closing i.quit triggers i.loop() to exit; i.loop() exiting
 	// will trigger i.flushLoop()s to exit.
 	close(i.quit)
 
-	i.done.Wait()
+	done := make(chan struct{})
+	go func() {
+		i.done.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warnf("Ingester took longer than %v to flush, abandoning the rest", i.cfg.MaxShutdownDuration)
+		i.cancelFlushes()
+		<-done
+	}
+	i.cancelFlushes()
+
+	if i.cfg.ShutdownPolicy == ShutdownHandover {
+		if transferred, err := i.transferChunks(ctx); err != nil {
+			log.Errorf("Error handing chunks over, after handing %d over: %v", transferred, err)
+		} else {
+			log.Infof("Handed %d chunks over", transferred)
+		}
+	}
+
+	if chunks := i.unflushedChunks(); chunks > 0 {
+		if i.cfg.SpillDir == "" {
+			log.Warnf("Ingester stopped with %d chunks not flushed", chunks)
+		} else if persisted, err := i.persistChunks(); err != nil {
+			log.Errorf("Error persisting %d chunks not flushed to %s: %v", chunks, i.cfg.SpillDir, err)
+		} else {
+			log.Infof("Persisted %d chunks not flushed to %s, to be flushed on restart", persisted, i.cfg.SpillDir)
+		}
+	}
+	i.limits.Stop()
+}
+
+// unflushedChunks counts the chunks in memory, or spilled.
+func (i *Ingester) unflushedChunks() int {
+	chunks := 0
+	for _, state := range i.userStates.cp() {
+		for pair := range state.fpToSeries.iter() {
+			state.fpLocker.Lock(pair.fp)
+			chunks += len(pair.series.chunkDescs)
+			state.fpLocker.Unlock(pair.fp)
+		}
+	}
+	return chunks
 }
 
 func (i *Ingester) loop() {
 	defer func() {
-		i.sweepUsers(true)
+		if i.cfg.ShutdownPolicy == ShutdownFlush {
+			i.sweepUsers(true)
+		}
 
 		// We close flush queue here to ensure the flushLoops pick
 		// up all the flushes triggered by the last run
@@ -448,6 +717,8 @@ func (i *Ingester) loop() {
 		select {
 		case <-flushTick:
 			i.sweepUsers(false)
+			i.spillChunks()
+			i.updateFlushHealth()
 		case <-rateUpdateTick:
 			i.userStates.updateRates()
 		case <-i.quit:
@@ -481,7 +752,7 @@ func (i *Ingester) sweepSeries(userID string, fp model.Fingerprint, series *memo
 	}
 
 	firstTime := series.firstTime()
-	flush := i.shouldFlushSeries(series, immediate)
+	flush := i.shouldFlushSeries(userID, series, immediate)
 
 	if flush {
 		flushQueueIndex := int(uint64(fp) % uint64(i.cfg.ConcurrentFlushes))
@@ -489,7 +760,7 @@ func (i *Ingester) sweepSeries(userID string, fp model.Fingerprint, series *memo
 	}
 }
 
-func (i *Ingester) shouldFlushSeries(series *memorySeries, immediate bool) bool {
+func (i *Ingester) shouldFlushSeries(userID string, series *memorySeries, immediate bool) bool {
 	// Series should be scheduled for flushing if they have more than one chunk
 	if immediate || len(series.chunkDescs) > 1 {
 		return true
@@ -497,20 +768,20 @@ func (i *Ingester) shouldFlushSeries(series *memorySeries, immediate bool) bool
 
 	// Or if the only existing chunk need flushing
 	if len(series.chunkDescs) > 0 {
-		return i.shouldFlushChunk(series.chunkDescs[0])
+		return i.shouldFlushChunk(userID, series.chunkDescs[0])
 	}
 
 	return false
 }
 
-func (i *Ingester) shouldFlushChunk(c *desc) bool {
+func (i *Ingester) shouldFlushChunk(userID string, c *desc) bool {
 	// Chunks should be flushed if their oldest entry is older than MaxChunkAge
-	if model.Now().Sub(c.FirstTime) > i.cfg.MaxChunkAge {
+	if model.Now().Sub(c.FirstTime) > i.limits.MaxChunkAge(userID) {
 		return true
 	}
 
 	// Chunk should be flushed if their last entry is older then MaxChunkIdle
-	if model.Now().Sub(c.LastTime) > i.cfg.MaxChunkIdle {
+	if model.Now().Sub(c.LastTime) > i.limits.MaxChunkIdle(userID) {
 		return true
 	}
 
@@ -529,14 +800,19 @@ func (i *Ingester) flushLoop(j int) {
 			return
 		}
 		op := o.(*flushOp)
+		if i.flushCtx.Err() != nil {
+			// Flushes are being abandoned; drain the queue.
+			continue
+		}
 
 		err := i.flushUserSeries(op.userID, op.fp, op.immediate)
 		if err != nil {
 			log.Errorf("Failed to flush user: %v", err)
 		}
 
-		// If we're exiting & we failed to flush, keep trying.
-		for op.immediate && err != nil {
+		// If we're exiting & we failed to flush, keep trying, unless flushes
+		// are abandoned.
+		for op.immediate && err != nil && i.flushCtx.Err() == nil {
 			err = i.flushUserSeries(op.userID, op.fp, op.immediate)
 			if err != nil {
 				log.Errorf("Failed to flush user: %v", err)
@@ -557,18 +833,25 @@ func (i *Ingester) flushUserSeries(userID string, fp model.Fingerprint, immediat
 	}
 
 	userState.fpLocker.Lock(fp)
-	if !i.shouldFlushSeries(series, immediate) {
+	if !i.shouldFlushSeries(userID, series, immediate) {
 		userState.fpLocker.Unlock(fp)
 		return nil
 	}
 
 	// Assume we're going to flush everything, and maybe don't flush the head chunk if it doesn't need it.
 	chunks := series.chunkDescs
-	if immediate || (len(chunks) > 0 && i.shouldFlushChunk(series.head())) {
+	if immediate || (len(chunks) > 0 && i.shouldFlushChunk(userID, series.head())) {
 		series.closeHead()
 	} else {
 		chunks = chunks[:len(chunks)-1]
 	}
+	// Take copies, as the chunks may be spilled while we're flushing them.
+	chunkCopies := make([]*desc, 0, len(chunks))
+	for j, cd := range chunks {
+		cdCopy := *cd
+		cdCopy.flushReason = i.flushReason(userID, cd, j == len(series.chunkDescs)-1, immediate)
+		chunkCopies = append(chunkCopies, &cdCopy)
+	}
 	userState.fpLocker.Unlock(fp)
 
 	if len(chunks) == 0 {
@@ -576,16 +859,32 @@ func (i *Ingester) flushUserSeries(userID string, fp model.Fingerprint, immediat
 	}
 
 	// flush the chunks without locking the series, as we don't want to hold the series lock for the duration of the dynamo/s3 rpcs.
-	ctx := user.Inject(context.Background(), userID)
-	err := i.flushChunks(ctx, fp, series.metric, chunks)
+	ctx := user.Inject(i.flushCtx, userID)
+	err := i.flushChunks(ctx, fp, series.metric, chunkCopies)
+	if i.flushHealth != nil {
+		i.flushHealth.record(err)
+	}
 	if err != nil {
+		// Remember which chunks were stored, so the retry only indexes them.
+		userState.fpLocker.Lock(fp)
+		for j, cd := range chunks {
+			cd.stored = chunkCopies[j].stored
+		}
+		userState.fpLocker.Unlock(fp)
 		return err
 	}
 
 	// now remove the chunks
 	userState.fpLocker.Lock(fp)
+	for _, cd := range series.chunkDescs[:len(chunks)] {
+		if cd.C == nil {
+			i.spilledChunks.Dec()
+		} else {
+			i.memoryChunks.Dec()
+		}
+		cd.removeSpill()
+	}
 	series.chunkDescs = series.chunkDescs[len(chunks):]
-	i.memoryChunks.Sub(float64(len(chunks)))
 	if len(series.chunkDescs) == 0 {
 		userState.removeSeries(fp, series.metric)
 	}
@@ -593,15 +892,82 @@ func (i *Ingester) flushUserSeries(userID string, fp model.Fingerprint, immediat
 	return nil
 }
 
+// flushReason is why a chunk of a series is being flushed.  Chunks other
+// than the head are only closed once they're full.
+func (i *Ingester) flushReason(userID string, c *desc, head, immediate bool) string {
+	switch {
+	case immediate:
+		return flushReasonShutdown
+	case !head:
+		return flushReasonFull
+	case model.Now().Sub(c.FirstTime) > i.limits.MaxChunkAge(userID):
+		return flushReasonMaxAge
+	default:
+		return flushReasonIdle
+	}
+}
+
 func (i *Ingester) flushChunks(ctx context.Context, fp model.Fingerprint, metric model.Metric, chunkDescs []*desc) error {
 	wireChunks := make([]cortex_chunk.Chunk, 0, len(chunkDescs))
 	for _, chunkDesc := range chunkDescs {
-		i.chunkUtilization.Observe(chunkDesc.C.Utilization())
-		i.chunkLength.Observe(float64(chunkDesc.C.Len()))
+		c, err := chunkDesc.chunk()
+		if err != nil {
+			return err
+		}
+		i.chunkUtilization.Observe(c.Utilization())
+		i.chunkLength.Observe(float64(c.Len()))
 		i.chunkAge.Observe(model.Now().Sub(chunkDesc.FirstTime).Seconds())
-		wireChunks = append(wireChunks, cortex_chunk.NewChunk(fp, metric, chunkDesc.C, chunkDesc.FirstTime, chunkDesc.LastTime))
+		i.flushedChunkAge.WithLabelValues(chunkDesc.flushReason).Observe(model.Now().Sub(chunkDesc.FirstTime).Seconds())
+		i.flushedChunkSize.WithLabelValues(chunkDesc.flushReason).Observe(c.Utilization() * chunk.ChunkLen)
+		wireChunks = append(wireChunks, cortex_chunk.NewChunk(fp, metric, c, chunkDesc.FirstTime, chunkDesc.LastTime))
+	}
+	if err := i.putChunks(ctx, chunkDescs, wireChunks); err != nil {
+		return err
+	}
+	i.sampleReadbacks(ctx, wireChunks)
+	return nil
+}
+
+// putChunks stores and indexes the chunks of chunkDescs, marking those
+// stored so a retry after indexing fails skips uploading them.
+func (i *Ingester) putChunks(ctx context.Context, chunkDescs []*desc, chunks []cortex_chunk.Chunk) error {
+	store, ok := i.chunkStore.(PartialChunkStore)
+	if !ok {
+		if err := i.chunkStore.Put(ctx, chunks); err != nil {
+			i.flushFailures.WithLabelValues(flushStageChunks).Inc()
+			return err
+		}
+		return nil
 	}
-	return i.chunkStore.Put(ctx, wireChunks)
+
+	toStore := make([]cortex_chunk.Chunk, 0, len(chunks))
+	for j, chunkDesc := range chunkDescs {
+		if chunkDesc.stored {
+			i.uploadsSkipped.Inc()
+			continue
+		}
+		toStore = append(toStore, chunks[j])
+	}
+	if len(toStore) > 0 {
+		if err := store.PutChunks(ctx, toStore); err != nil {
+			i.flushFailures.WithLabelValues(flushStageChunks).Inc()
+			return err
+		}
+	}
+	for _, chunkDesc := range chunkDescs {
+		chunkDesc.stored = true
+	}
+
+	// Re-indexing chunks stored by an earlier attempt queues behind other
+	// flushes.
+	if len(toStore) < len(chunks) {
+		ctx = cortex_chunk.WithWriteClass(ctx, cortex_chunk.RewriteWrite)
+	}
+	if err := store.PutIndex(ctx, chunks); err != nil {
+		i.flushFailures.WithLabelValues(flushStageIndex).Inc()
+		return err
+	}
+	return nil
 }
 
 // Describe implements prometheus.Collector.
@@ -613,9 +979,16 @@ func (i *Ingester) Describe(ch chan<- *prometheus.Desc) {
 	ch <- i.chunkUtilization.Desc()
 	ch <- i.chunkLength.Desc()
 	ch <- i.chunkAge.Desc()
+	i.flushedChunkAge.Describe(ch)
+	i.flushedChunkSize.Describe(ch)
 	ch <- i.queries.Desc()
 	ch <- i.queriedSamples.Desc()
 	ch <- i.memoryChunks.Desc()
+	ch <- i.spilledChunks.Desc()
+	i.chunkReadbacks.Describe(ch)
+	i.flushFailures.Describe(ch)
+	ch <- i.uploadsSkipped.Desc()
+	ch <- i.flushUnhealthy.Desc()
 }
 
 // Collect implements prometheus.Collector.
@@ -647,7 +1020,14 @@ func (i *Ingester) Collect(ch chan<- prometheus.Metric) {
 	ch <- i.chunkUtilization
 	ch <- i.chunkLength
 	ch <- i.chunkAge
+	i.flushedChunkAge.Collect(ch)
+	i.flushedChunkSize.Collect(ch)
 	ch <- i.queries
 	ch <- i.queriedSamples
 	ch <- i.memoryChunks
+	ch <- i.spilledChunks
+	i.chunkReadbacks.Collect(ch)
+	i.flushFailures.Collect(ch)
+	ch <- i.uploadsSkipped
+	ch <- i.flushUnhealthy
 }
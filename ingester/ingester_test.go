@@ -2,21 +2,30 @@ package ingester
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"google.golang.org/grpc"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/metric"
 	"golang.org/x/net/context"
 
 	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
 	"github.com/weaveworks/cortex/chunk"
 	"github.com/weaveworks/cortex/util"
+	cortex_errors "github.com/weaveworks/cortex/util/errors"
+	"github.com/weaveworks/cortex/util/validation"
 )
 
 type testStore struct {
@@ -78,7 +87,7 @@ func matrixToSamples(m model.Matrix) []model.Sample {
 func TestIngesterAppend(t *testing.T) {
 	cfg := Config{
 		FlushCheckPeriod: 99999 * time.Hour,
-		MaxChunkIdle:     99999 * time.Hour,
+		Limits:           validation.Limits{MaxChunkIdle: 99999 * time.Hour},
 	}
 	store := &testStore{
 		chunks: map[string][]chunk.Chunk{},
@@ -148,7 +157,7 @@ func TestIngesterAppend(t *testing.T) {
 func TestIngesterUserSeriesLimitExceeded(t *testing.T) {
 	cfg := Config{
 		FlushCheckPeriod: 99999 * time.Hour,
-		MaxChunkIdle:     99999 * time.Hour,
+		Limits:           validation.Limits{MaxChunkIdle: 99999 * time.Hour},
 		UserStatesConfig: UserStatesConfig{
 			MaxSeriesPerUser: 1,
 		},
@@ -234,10 +243,7 @@ func TestIngesterUserSeriesLimitExceeded(t *testing.T) {
 func TestIngesterMetricSeriesLimitExceeded(t *testing.T) {
 	cfg := Config{
 		FlushCheckPeriod: 99999 * time.Hour,
-		MaxChunkIdle:     99999 * time.Hour,
-		UserStatesConfig: UserStatesConfig{
-			MaxSeriesPerMetric: 1,
-		},
+		Limits:           validation.Limits{MaxChunkIdle: 99999 * time.Hour, MaxSeriesPerMetric: 1},
 	}
 	store := &testStore{
 		chunks: map[string][]chunk.Chunk{},
@@ -316,3 +322,494 @@ func TestIngesterMetricSeriesLimitExceeded(t *testing.T) {
 		t.Fatalf("unexpected query result\n\nwant:\n\n%v\n\ngot:\n\n%v\n\n", expected, res)
 	}
 }
+
+func TestIngesterDiscardedSamples(t *testing.T) {
+	f, err := ioutil.TempFile("", "overrides")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("overrides:\n  1:\n    max_sample_age: 1h\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{
+		FlushCheckPeriod: 99999 * time.Hour,
+		Limits:           validation.Limits{MaxChunkIdle: 99999 * time.Hour},
+		OverridesConfig:  validation.OverridesConfig{File: f.Name(), Period: time.Hour},
+	}
+	store := &testStore{
+		chunks: map[string][]chunk.Chunk{},
+	}
+	ing, err := New(cfg, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := model.Metric{model.MetricNameLabel: "testmetric", "foo": "bar"}
+	newest := model.TimeFromUnix(10 * 3600)
+	samples := []model.Sample{
+		{Metric: m, Timestamp: newest, Value: 1},
+		{Metric: m, Timestamp: newest.Add(-time.Minute), Value: 2},
+		{Metric: m, Timestamp: newest.Add(-2 * time.Hour), Value: 3},
+		{Metric: m, Timestamp: newest, Value: 4},
+		{Metric: m, Timestamp: newest.Add(time.Minute), Value: 5},
+	}
+
+	// Unacceptable samples are discarded, and reported by reason, but the
+	// rest are still appended.
+	ctx := user.Inject(context.Background(), "1")
+	_, err = ing.Push(ctx, util.ToWriteRequest(samples))
+	if cortex_errors.TypeOf(cortex_errors.FromGRPC(err)) != cortex_errors.Validation {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+	for _, reason := range []string{validation.DuplicateSample, validation.OutOfOrderTimestamp, validation.TooOldForSeries} {
+		if !strings.Contains(grpc.ErrorDesc(err), "1 "+reason) {
+			t.Errorf("expected error to report %s, got %v", reason, err)
+		}
+	}
+
+	matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "testmetric")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := util.ToQueryRequest(model.Earliest, model.Latest, []*metric.LabelMatcher{matcher})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ing.Query(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := model.Matrix{
+		{
+			Metric: m,
+			Values: []model.SamplePair{
+				{Timestamp: samples[0].Timestamp, Value: samples[0].Value},
+				{Timestamp: samples[4].Timestamp, Value: samples[4].Value},
+			},
+		},
+	}
+	if res := util.FromQueryResponse(resp); !reflect.DeepEqual(res, expected) {
+		t.Fatalf("unexpected query result\n\nwant:\n\n%v\n\ngot:\n\n%v\n\n", expected, res)
+	}
+}
+
+func TestIngesterDiscardedSamplesWithLimitExceeded(t *testing.T) {
+	cfg := Config{
+		FlushCheckPeriod: 99999 * time.Hour,
+		Limits:           validation.Limits{MaxChunkIdle: 99999 * time.Hour},
+		UserStatesConfig: UserStatesConfig{
+			MaxSeriesPerUser: 1,
+		},
+	}
+	store := &testStore{
+		chunks: map[string][]chunk.Chunk{},
+	}
+	ing, err := New(cfg, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m1 := model.Metric{model.MetricNameLabel: "testmetric", "foo": "bar"}
+	m2 := model.Metric{model.MetricNameLabel: "testmetric", "foo": "biz"}
+	samples := []model.Sample{
+		{Metric: m1, Timestamp: 10, Value: 1},
+		{Metric: m1, Timestamp: 5, Value: 2},
+		{Metric: m2, Timestamp: 10, Value: 3},
+	}
+
+	// The limit takes precedence, but the discards are still reported.
+	ctx := user.Inject(context.Background(), "1")
+	_, err = ing.Push(ctx, util.ToWriteRequest(samples))
+	if cortex_errors.TypeOf(cortex_errors.FromGRPC(err)) != cortex_errors.LimitExceeded {
+		t.Fatalf("expected limit exceeded error, got %v", err)
+	}
+	if !strings.Contains(grpc.ErrorDesc(err), "1 "+validation.OutOfOrderTimestamp) {
+		t.Errorf("expected error to report %s, got %v", validation.OutOfOrderTimestamp, err)
+	}
+}
+
+func TestIngesterMetricSeriesLimitOverride(t *testing.T) {
+	f, err := ioutil.TempFile("", "overrides")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("overrides:\n  big:\n    max_series_per_metric: 3\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{
+		FlushCheckPeriod: 99999 * time.Hour,
+		Limits:           validation.Limits{MaxChunkIdle: 99999 * time.Hour, MaxSeriesPerMetric: 1},
+		OverridesConfig:  validation.OverridesConfig{File: f.Name(), Period: time.Hour},
+	}
+	store := &testStore{
+		chunks: map[string][]chunk.Chunk{},
+	}
+	ing, err := New(cfg, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	push := func(userID string, metricName, value model.LabelValue) error {
+		ctx := user.Inject(context.Background(), userID)
+		_, err := ing.Push(ctx, util.ToWriteRequest([]model.Sample{{
+			Metric:    model.Metric{model.MetricNameLabel: metricName, "foo": value},
+			Timestamp: 0,
+			Value:     1,
+		}}))
+		return err
+	}
+	for _, c := range []struct {
+		userID     string
+		metricName model.LabelValue
+		value      model.LabelValue
+		allowed    bool
+	}{
+		{"small", "testmetric", "a", true},
+		{"small", "testmetric", "b", false},
+		{"small", "othermetric", "a", true},
+		{"big", "testmetric", "a", true},
+		{"big", "testmetric", "b", true},
+		{"big", "testmetric", "c", true},
+		{"big", "testmetric", "d", false},
+	} {
+		err := push(c.userID, c.metricName, c.value)
+		if c.allowed && err != nil {
+			t.Errorf("%s %s{foo=%q}: unexpected error %v", c.userID, c.metricName, c.value, err)
+		} else if !c.allowed && grpc.ErrorDesc(err) != util.ErrMetricSeriesLimitExceeded.Error() {
+			t.Errorf("%s %s{foo=%q}: expected error about exceeding series per metric, got %v", c.userID, c.metricName, c.value, err)
+		}
+	}
+}
+
+// partialStore stores and indexes chunks separately, failing to index while
+// failIndex is set.
+type partialStore struct {
+	testStore
+	uploads   int
+	failIndex bool
+}
+
+func (s *partialStore) PutChunks(ctx context.Context, chunks []chunk.Chunk) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.uploads += len(chunks)
+	return nil
+}
+
+func (s *partialStore) PutIndex(ctx context.Context, chunks []chunk.Chunk) error {
+	s.mtx.Lock()
+	failIndex := s.failIndex
+	s.mtx.Unlock()
+	if failIndex {
+		return fmt.Errorf("index write failed")
+	}
+	return s.testStore.Put(ctx, chunks)
+}
+
+func TestIngesterFlushRetriesOnlyIndex(t *testing.T) {
+	store := &partialStore{
+		testStore: testStore{chunks: map[string][]chunk.Chunk{}},
+		failIndex: true,
+	}
+	ing, err := New(Config{FlushCheckPeriod: 99999 * time.Hour, Limits: validation.Limits{MaxChunkIdle: 99999 * time.Hour}}, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ing.Stop()
+
+	ctx := user.Inject(context.Background(), "1")
+	if _, err := ing.Push(ctx, util.ToWriteRequest(matrixToSamples(buildTestMatrix(1, 10, 0)))); err != nil {
+		t.Fatal(err)
+	}
+	userState, _ := ing.userStates.get("1")
+	var fp model.Fingerprint
+	for pair := range userState.fpToSeries.iter() {
+		fp = pair.fp
+	}
+
+	// The chunk is stored, but not indexed, so isn't removed from memory.
+	if err := ing.flushUserSeries("1", fp, true); err == nil {
+		t.Fatal("expected the flush to fail")
+	}
+	if store.uploads != 1 || len(store.chunks["1"]) != 0 || userState.fpToSeries.length() != 1 {
+		t.Fatalf("expected 1 upload and the series in memory, got %d uploads, %d indexed, %d series", store.uploads, len(store.chunks["1"]), userState.fpToSeries.length())
+	}
+
+	// The retry only indexes it.
+	store.mtx.Lock()
+	store.failIndex = false
+	store.mtx.Unlock()
+	if err := ing.flushUserSeries("1", fp, true); err != nil {
+		t.Fatal(err)
+	}
+	if store.uploads != 1 || len(store.chunks["1"]) != 1 || userState.fpToSeries.length() != 0 {
+		t.Fatalf("expected 1 upload and the series flushed, got %d uploads, %d indexed, %d series", store.uploads, len(store.chunks["1"]), userState.fpToSeries.length())
+	}
+}
+
+// blockingStore fails to store chunks once its context is done.
+type blockingStore struct{}
+
+func (blockingStore) Put(ctx context.Context, chunks []chunk.Chunk) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestIngesterShutdownPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cfg   Config
+		store ChunkStore
+	}{
+		{"abandon", Config{ShutdownPolicy: ShutdownAbandon}, &testStore{chunks: map[string][]chunk.Chunk{}}},
+		{"max shutdown duration", Config{MaxShutdownDuration: 10 * time.Millisecond}, blockingStore{}},
+	} {
+		tc.cfg.FlushCheckPeriod = 99999 * time.Hour
+		tc.cfg.Limits.MaxChunkIdle = 99999 * time.Hour
+		ing, err := New(tc.cfg, tc.store, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := user.Inject(context.Background(), "1")
+		if _, err := ing.Push(ctx, util.ToWriteRequest(matrixToSamples(buildTestMatrix(10, 10, 0)))); err != nil {
+			t.Fatal(err)
+		}
+
+		ing.Stop()
+		if chunks := ing.unflushedChunks(); chunks != 10 {
+			t.Errorf("%s: expected 10 chunks left unflushed, got %d", tc.name, chunks)
+		}
+		if store, ok := tc.store.(*testStore); ok && len(store.chunks["1"]) != 0 {
+			t.Errorf("%s: expected no chunks flushed, got %d", tc.name, len(store.chunks["1"]))
+		}
+	}
+
+	if _, err := New(Config{ShutdownPolicy: "drain"}, nil, nil); err == nil {
+		t.Error("expected an unknown shutdown policy to be rejected")
+	}
+}
+
+// transferClient hands chunks over to an ingester in the same process.
+type transferClient struct {
+	cortex.IngesterClient
+	ing *Ingester
+}
+
+func (c transferClient) TransferChunks(ctx context.Context, req *cortex.TransferChunksRequest, opts ...grpc.CallOption) (*cortex.TransferChunksResponse, error) {
+	return c.ing.TransferChunks(ctx, req)
+}
+
+func TestIngesterHandover(t *testing.T) {
+	cfg := Config{
+		FlushCheckPeriod: 99999 * time.Hour,
+		Limits:           validation.Limits{MaxChunkIdle: 99999 * time.Hour},
+	}
+	targetStore := &testStore{chunks: map[string][]chunk.Chunk{}}
+	target, err := New(cfg, targetStore, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := user.Inject(context.Background(), "1")
+	// The target already has a sample of the first series, in the middle of
+	// the chunk handed over.
+	if _, err := target.Push(ctx, util.ToWriteRequest(matrixToSamples(buildTestMatrix(1, 1, 5)))); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg.ShutdownPolicy = ShutdownHandover
+	cfg.SpillDir = dir
+	cfg.handoverClient = transferClient{ing: target}
+	store := &testStore{chunks: map[string][]chunk.Chunk{}}
+	ing, err := New(cfg, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matrix := buildTestMatrix(10, 10, 0)
+	if _, err := ing.Push(ctx, util.ToWriteRequest(matrixToSamples(matrix))); err != nil {
+		t.Fatal(err)
+	}
+	ing.Stop()
+	if chunks := ing.unflushedChunks(); chunks != 0 || len(store.chunks["1"]) != 0 {
+		t.Fatalf("expected every chunk handed over, got %d left and %d flushed", chunks, len(store.chunks["1"]))
+	}
+
+	// The chunk overlapping the target's is flushed at once, and the rest
+	// are queryable on the target.
+	if len(targetStore.chunks["1"]) != 1 {
+		t.Errorf("expected the overlapping chunk flushed, got %d chunks", len(targetStore.chunks["1"]))
+	}
+	matcher, err := metric.NewLabelMatcher(metric.RegexMatch, model.MetricNameLabel, "testmetric_[1-9]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := target.query(ctx, 0, model.Latest, []*metric.LabelMatcher{matcher})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Sort(result)
+	if !reflect.DeepEqual(matrix[1:], result) {
+		t.Fatalf("expected %v, got %v", matrix[1:], result)
+	}
+	target.Stop()
+	if len(targetStore.chunks["1"]) != 11 {
+		t.Errorf("expected 11 chunks flushed by the target, got %d", len(targetStore.chunks["1"]))
+	}
+
+	// Chunks which can't be handed over, as the target has stopped, are
+	// persisted.
+	ing, err = New(cfg, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ing.Push(ctx, util.ToWriteRequest(matrixToSamples(matrix))); err != nil {
+		t.Fatal(err)
+	}
+	ing.Stop()
+	if _, err := os.Stat(filepath.Join(dir, persistedChunksFile)); err != nil {
+		t.Errorf("expected the chunks not handed over to be persisted, got %v", err)
+	}
+}
+
+func flushedChunks(t *testing.T, ing *Ingester, reason string) uint64 {
+	var m dto.Metric
+	if err := ing.flushedChunkAge.WithLabelValues(reason).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestIngesterFlushReasons(t *testing.T) {
+	store := &testStore{chunks: map[string][]chunk.Chunk{}}
+	ing, err := New(Config{FlushCheckPeriod: 99999 * time.Hour, Limits: validation.Limits{MaxChunkIdle: 99999 * time.Hour, MaxChunkAge: time.Hour}}, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := model.Now()
+	for _, tc := range []struct {
+		first, last model.Time
+		head        bool
+		immediate   bool
+		expected    string
+	}{
+		{now.Add(-2 * time.Hour), now, true, false, flushReasonMaxAge},
+		{now.Add(-time.Minute), now, true, false, flushReasonIdle},
+		{now.Add(-2 * time.Hour), now, false, false, flushReasonFull},
+		{now.Add(-time.Minute), now, true, true, flushReasonShutdown},
+	} {
+		if reason := ing.flushReason("1", newDesc(nil, tc.first, tc.last), tc.head, tc.immediate); reason != tc.expected {
+			t.Errorf("expected %s, got %s", tc.expected, reason)
+		}
+	}
+
+	ctx := user.Inject(context.Background(), "1")
+	if _, err := ing.Push(ctx, util.ToWriteRequest(matrixToSamples(buildTestMatrix(3, 10, 0)))); err != nil {
+		t.Fatal(err)
+	}
+	ing.Stop()
+	if flushed := flushedChunks(t, ing, flushReasonShutdown); flushed != 3 {
+		t.Errorf("expected 3 chunks flushed on shutdown, got %d", flushed)
+	}
+}
+
+func TestMaxSeriesPerUser(t *testing.T) {
+	for _, tc := range []struct {
+		local, global, ingesters int
+		expected                 int
+		expectedErr              error
+	}{
+		{100, 0, 10, 100, util.ErrUserSeriesLimitExceeded},
+		// 10 ingesters each get 3/10 of the global limit, at replication factor 3.
+		{100, 200, 10, 60, util.ErrUserGlobalSeriesLimitExceeded},
+		{50, 200, 10, 50, util.ErrUserSeriesLimitExceeded},
+		// With no more ingesters than replicas, each has every series.
+		{1000, 200, 2, 200, util.ErrUserGlobalSeriesLimitExceeded},
+		{100, 200, 0, 100, util.ErrUserSeriesLimitExceeded},
+	} {
+		ingesters := tc.ingesters
+		us := newUserStates(&UserStatesConfig{
+			MaxSeriesPerUser:       tc.local,
+			MaxGlobalSeriesPerUser: tc.global,
+			ReplicationFactor:      3,
+		}, nil)
+		us.healthyIngesters = func() int { return ingesters }
+		us.updateRates()
+		max, err := us.maxSeriesPerUser()
+		if max != tc.expected || err != tc.expectedErr {
+			t.Errorf("%+v: expected %d (%v), got %d (%v)", tc, tc.expected, tc.expectedErr, max, err)
+		}
+	}
+}
+
+func TestIngesterPersistsUnflushedChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{
+		ShutdownPolicy:   ShutdownAbandon,
+		SpillDir:         dir,
+		FlushCheckPeriod: 99999 * time.Hour,
+		Limits:           validation.Limits{MaxChunkIdle: 99999 * time.Hour},
+	}
+	ing, err := New(cfg, &testStore{chunks: map[string][]chunk.Chunk{}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := user.Inject(context.Background(), "1")
+	matrix := buildTestMatrix(10, 10, 0)
+	if _, err := ing.Push(ctx, util.ToWriteRequest(matrixToSamples(matrix))); err != nil {
+		t.Fatal(err)
+	}
+	ing.Stop()
+
+	// The next ingester loads the chunks, so they're queryable, and flushes
+	// them on shutdown.
+	store := &testStore{chunks: map[string][]chunk.Chunk{}}
+	cfg.ShutdownPolicy = ShutdownFlush
+	ing, err = New(cfg, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matcher, err := metric.NewLabelMatcher(metric.RegexMatch, model.JobLabel, ".+")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := ing.query(ctx, 0, model.Latest, []*metric.LabelMatcher{matcher})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Sort(result)
+	if !reflect.DeepEqual(matrix, result) {
+		t.Fatalf("expected %v, got %v", matrix, result)
+	}
+
+	// Loaded series take new samples in new chunks.
+	if _, err := ing.Push(ctx, util.ToWriteRequest(matrixToSamples(buildTestMatrix(1, 1, 100)))); err != nil {
+		t.Fatal(err)
+	}
+	ing.Stop()
+	if len(store.chunks["1"]) != 11 {
+		t.Errorf("expected 11 chunks flushed, got %d", len(store.chunks["1"]))
+	}
+	if _, err := os.Stat(filepath.Join(dir, persistedChunksFile)); !os.IsNotExist(err) {
+		t.Errorf("expected persisted chunks to be removed once loaded, got %v", err)
+	}
+}
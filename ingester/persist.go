@@ -0,0 +1,137 @@
+package ingester
+
+import (
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+)
+
+// Chunks not flushed by the time the ingester stops are persisted to this
+// file in the spill dir, and loaded back into memory on start, to be flushed
+// as usual.
+const persistedChunksFile = "unflushed-chunks"
+
+type persistedSeries struct {
+	UserID string
+	Metric model.Metric
+	Chunks []persistedChunk
+}
+
+type persistedChunk struct {
+	FirstTime model.Time
+	LastTime  model.Time
+	Encoding  byte
+	Data      []byte
+}
+
+// persistChunks writes every chunk left in memory, or spilled, to the spill
+// dir, returning how many it wrote.  The caller must have stopped the
+// ingester's loops.
+func (i *Ingester) persistChunks() (int, error) {
+	if err := os.MkdirAll(i.cfg.SpillDir, 0777); err != nil {
+		return 0, err
+	}
+	f, err := ioutil.TempFile(i.cfg.SpillDir, persistedChunksFile)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	enc := gob.NewEncoder(f)
+	persisted := 0
+	for userID, state := range i.userStates.cp() {
+		for pair := range state.fpToSeries.iter() {
+			series := persistedSeries{UserID: userID, Metric: pair.series.metric}
+			for _, cd := range pair.series.chunkDescs {
+				c, err := cd.chunk()
+				if err != nil {
+					f.Close()
+					return 0, err
+				}
+				buf := make([]byte, chunk.ChunkLen)
+				if err := c.MarshalToBuf(buf); err != nil {
+					f.Close()
+					return 0, err
+				}
+				series.Chunks = append(series.Chunks, persistedChunk{
+					FirstTime: cd.FirstTime,
+					LastTime:  cd.LastTime,
+					Encoding:  byte(c.Encoding()),
+					Data:      buf,
+				})
+			}
+			if err := enc.Encode(series); err != nil {
+				f.Close()
+				return 0, err
+			}
+			persisted += len(series.Chunks)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	if persisted == 0 {
+		return 0, nil
+	}
+	return persisted, os.Rename(f.Name(), filepath.Join(i.cfg.SpillDir, persistedChunksFile))
+}
+
+// loadChunks loads the chunks persisted by the last ingester to stop with
+// this spill dir, returning how many it loaded, to be flushed like any other
+// closed chunk.
+func (i *Ingester) loadChunks() (int, error) {
+	filename := filepath.Join(i.cfg.SpillDir, persistedChunksFile)
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	dec := gob.NewDecoder(f)
+	loaded := 0
+	for {
+		var series persistedSeries
+		if err := dec.Decode(&series); err == io.EOF {
+			break
+		} else if err != nil {
+			return loaded, err
+		}
+		if len(series.Chunks) == 0 {
+			continue
+		}
+		descs := make([]*desc, 0, len(series.Chunks))
+		for _, pc := range series.Chunks {
+			c, err := chunk.NewForEncoding(chunk.Encoding(pc.Encoding))
+			if err != nil {
+				return loaded, err
+			}
+			if err := c.UnmarshalFromBuf(pc.Data); err != nil {
+				return loaded, err
+			}
+			descs = append(descs, newDesc(c, pc.FirstTime, pc.LastTime))
+		}
+
+		ctx := user.Inject(context.Background(), series.UserID)
+		if err := i.addChunks(ctx, series.Metric, descs); err != nil {
+			log.Errorf("Dropping %d persisted chunks of %s for %s: %v", len(descs), series.Metric, series.UserID, err)
+			continue
+		}
+		loaded += len(descs)
+	}
+
+	// Once loaded, they'll be persisted again if not flushed by the next
+	// shutdown.
+	f.Close()
+	return loaded, os.Remove(filename)
+}
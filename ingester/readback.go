@@ -0,0 +1,139 @@
+package ingester
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	cortex_chunk "github.com/weaveworks/cortex/chunk"
+)
+
+// Results of reading back a chunk.
+const (
+	readbackMatch    = "match"
+	readbackMismatch = "mismatch"
+	readbackError    = "error"
+	readbackDropped  = "dropped"
+)
+
+// Flushed chunks held for reading back beyond this many are dropped.
+const maxPendingReadbacks = 1000
+
+// ChunkFetcher is implemented by ChunkStores chunks can be read back from.
+type ChunkFetcher interface {
+	Fetch(ctx context.Context, chunks []cortex_chunk.Chunk) ([]cortex_chunk.Chunk, error)
+}
+
+type readback struct {
+	userID string
+	chunk  cortex_chunk.Chunk
+	due    time.Time
+}
+
+// sampleReadbacks queues a random cfg.ReadbackFraction of the chunks just
+// flushed to be read back once cfg.ReadbackDelay has passed.
+func (i *Ingester) sampleReadbacks(ctx context.Context, chunks []cortex_chunk.Chunk) {
+	if i.readbacks == nil {
+		return
+	}
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return
+	}
+	for _, c := range chunks {
+		if rand.Float64() >= i.cfg.ReadbackFraction {
+			continue
+		}
+		select {
+		case i.readbacks <- readback{userID: userID, chunk: c, due: time.Now().Add(i.cfg.ReadbackDelay)}:
+		default:
+			i.chunkReadbacks.WithLabelValues(readbackDropped).Inc()
+		}
+	}
+}
+
+// readbackLoop reads back queued chunks, in the order they were flushed,
+// until the ingester stops; those still queued are abandoned.
+func (i *Ingester) readbackLoop(fetcher ChunkFetcher) {
+	defer i.done.Done()
+	for {
+		select {
+		case r := <-i.readbacks:
+			select {
+			case <-time.After(r.due.Sub(time.Now())):
+			case <-i.quit:
+				return
+			}
+			result := readbackMatch
+			if err := i.readBack(fetcher, r); err != nil {
+				result = readbackError
+				if _, ok := err.(readbackMismatchError); ok {
+					result = readbackMismatch
+				}
+				log.Errorf("Error reading back chunk %s for %s: %v", r.chunk.ID, r.userID, err)
+			}
+			i.chunkReadbacks.WithLabelValues(result).Inc()
+		case <-i.quit:
+			return
+		}
+	}
+}
+
+type readbackMismatchError string
+
+func (e readbackMismatchError) Error() string { return string(e) }
+
+// readBack fetches r's chunk from the store, and compares it to the chunk
+// we flushed.
+func (i *Ingester) readBack(fetcher ChunkFetcher, r readback) error {
+	ctx := user.Inject(context.Background(), r.userID)
+	query := r.chunk
+	query.Data = nil
+	fetched, err := fetcher.Fetch(ctx, []cortex_chunk.Chunk{query})
+	if err != nil {
+		return err
+	}
+	if len(fetched) != 1 {
+		return fmt.Errorf("fetched %d chunks, expected 1", len(fetched))
+	}
+	stored := fetched[0]
+	if !stored.Metric.Equal(r.chunk.Metric) || stored.From != r.chunk.From || stored.Through != r.chunk.Through {
+		return readbackMismatchError(fmt.Sprintf("stored metadata %v [%v, %v] differs from flushed %v [%v, %v]",
+			stored.Metric, stored.From, stored.Through, r.chunk.Metric, r.chunk.From, r.chunk.Through))
+	}
+
+	want, err := cortex_chunk.ChunksToMatrix([]cortex_chunk.Chunk{r.chunk})
+	if err != nil {
+		return err
+	}
+	have, err := cortex_chunk.ChunksToMatrix([]cortex_chunk.Chunk{stored})
+	if err != nil {
+		return readbackMismatchError(fmt.Sprintf("error decoding stored chunk: %v", err))
+	}
+	return compareSamples(values(want), values(have))
+}
+
+// values returns the samples of a matrix of (at most) one series.
+func values(m model.Matrix) []model.SamplePair {
+	if len(m) == 0 {
+		return nil
+	}
+	return m[0].Values
+}
+
+func compareSamples(want, have []model.SamplePair) error {
+	if len(want) != len(have) {
+		return readbackMismatchError(fmt.Sprintf("stored chunk has %d samples, flushed %d", len(have), len(want)))
+	}
+	for j := range want {
+		if want[j].Timestamp != have[j].Timestamp || !want[j].Value.Equal(have[j].Value) {
+			return readbackMismatchError(fmt.Sprintf("stored sample %d is %v, flushed %v", j, have[j], want[j]))
+		}
+	}
+	return nil
+}
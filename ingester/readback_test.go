@@ -0,0 +1,98 @@
+package ingester
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	cortex_chunk "github.com/weaveworks/cortex/chunk"
+)
+
+// fetchingStore returns stored chunks by ID, or substitutes for them.
+type fetchingStore struct {
+	testStore
+	substitutes map[string]cortex_chunk.Chunk
+}
+
+func (s *fetchingStore) Fetch(ctx context.Context, chunks []cortex_chunk.Chunk) ([]cortex_chunk.Chunk, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var result []cortex_chunk.Chunk
+	for _, c := range chunks {
+		if substitute, ok := s.substitutes[c.ID]; ok {
+			result = append(result, substitute)
+			continue
+		}
+		for _, stored := range s.chunks[userID] {
+			if stored.ID == c.ID {
+				result = append(result, stored)
+			}
+		}
+	}
+	return result, nil
+}
+
+func newTestChunk(t *testing.T, metric model.Metric, values ...model.SampleValue) cortex_chunk.Chunk {
+	c := chunk.New()
+	for j, v := range values {
+		cs, err := c.Add(model.SamplePair{Timestamp: model.Time(j), Value: v})
+		require.NoError(t, err)
+		require.Len(t, cs, 1)
+		c = cs[0]
+	}
+	return cortex_chunk.NewChunk(metric.Fingerprint(), metric, c, 0, model.Time(len(values)-1))
+}
+
+func TestChunkReadback(t *testing.T) {
+	store := &fetchingStore{
+		testStore:   testStore{chunks: map[string][]cortex_chunk.Chunk{}},
+		substitutes: map[string]cortex_chunk.Chunk{},
+	}
+	ing, err := New(Config{FlushCheckPeriod: 99999 * time.Hour}, store, nil)
+	require.NoError(t, err)
+	defer ing.Stop()
+	// Without the loop reading them back, so we can.
+	ing.cfg.ReadbackFraction = 1
+	ing.readbacks = make(chan readback, 1)
+
+	ctx := user.Inject(context.Background(), "1")
+	metric := model.Metric{model.MetricNameLabel: "foo"}
+	good := newTestChunk(t, metric, 1, 2, 3)
+	require.NoError(t, store.Put(ctx, []cortex_chunk.Chunk{good}))
+	ing.sampleReadbacks(ctx, []cortex_chunk.Chunk{good})
+	r := <-ing.readbacks
+	assert.Equal(t, "1", r.userID)
+	require.NoError(t, ing.readBack(store, r))
+
+	// Chunks whose samples or metadata differ are mismatches.
+	store.substitutes[good.ID] = newTestChunk(t, metric, 1, 2, 4)
+	err = ing.readBack(store, r)
+	assert.IsType(t, readbackMismatchError(""), err)
+	assert.Contains(t, err.Error(), "stored sample 2")
+
+	store.substitutes[good.ID] = newTestChunk(t, model.Metric{model.MetricNameLabel: "bar"}, 1, 2, 3)
+	err = ing.readBack(store, r)
+	assert.IsType(t, readbackMismatchError(""), err)
+
+	// Missing chunks are errors.
+	delete(store.substitutes, good.ID)
+	err = ing.readBack(store, readback{userID: "2", chunk: good})
+	require.Error(t, err)
+	_, mismatch := err.(readbackMismatchError)
+	assert.False(t, mismatch)
+}
+
+func TestChunkReadbackUnsupportedStore(t *testing.T) {
+	_, err := New(Config{ReadbackFraction: 0.1}, &testStore{}, nil)
+	assert.Error(t, err)
+}
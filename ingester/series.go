@@ -7,6 +7,8 @@ import (
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/local/chunk"
 	"github.com/prometheus/prometheus/storage/metric"
+
+	"github.com/weaveworks/cortex/util/validation"
 )
 
 var discardedSamples = prometheus.NewCounterVec(
@@ -62,11 +64,11 @@ func (s *memorySeries) add(v model.SamplePair) error {
 		return nil
 	}
 	if v.Timestamp == s.lastTime {
-		discardedSamples.WithLabelValues(duplicateSample).Inc()
+		discardedSamples.WithLabelValues(validation.DuplicateSample).Inc()
 		return ErrDuplicateSampleForTimestamp // Caused by the caller.
 	}
 	if v.Timestamp < s.lastTime {
-		discardedSamples.WithLabelValues(outOfOrderTimestamp).Inc()
+		discardedSamples.WithLabelValues(validation.OutOfOrderTimestamp).Inc()
 		return ErrOutOfOrderSample // Caused by the caller.
 	}
 
@@ -97,6 +99,10 @@ func (s *memorySeries) add(v model.SamplePair) error {
 		}
 	}
 
+	// Later samples are checked against this one.
+	s.lastTime = v.Timestamp
+	s.lastSampleValue = v.Value
+	s.lastSampleValueSet = true
 	return nil
 }
 
@@ -147,8 +153,11 @@ func (s *memorySeries) samplesForRange(from, through model.Time) ([]model.Sample
 		NewestInclusive: through,
 	}
 	for idx := fromIdx; idx <= throughIdx; idx++ {
-		cd := s.chunkDescs[idx]
-		chValues, err := chunk.RangeValues(cd.C.NewIterator(), in)
+		c, err := s.chunkDescs[idx].chunk()
+		if err != nil {
+			return nil, err
+		}
+		chValues, err := chunk.RangeValues(c.NewIterator(), in)
 		if err != nil {
 			return nil, err
 		}
@@ -158,9 +167,13 @@ func (s *memorySeries) samplesForRange(from, through model.Time) ([]model.Sample
 }
 
 type desc struct {
-	C         chunk.Chunk // nil if chunk is evicted.
+	C         chunk.Chunk // nil if chunk is spilled.
 	FirstTime model.Time  // Populated at creation. Immutable.
 	LastTime  model.Time  // Populated at creation & on append.
+	spillFile string      // Set once the chunk is spilled to disk.
+	stored    bool        // Set once the chunk is in the store, if it's yet to be indexed.
+
+	flushReason string // Set on the copies of chunks being flushed.
 }
 
 func newDesc(c chunk.Chunk, firstTime model.Time, lastTime model.Time) *desc {
@@ -0,0 +1,31 @@
+package ingester
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestMemorySeriesAddOrder(t *testing.T) {
+	s := newMemorySeries(model.Metric{model.MetricNameLabel: "testmetric"})
+	for _, tc := range []struct {
+		sample   model.SamplePair
+		expected error
+	}{
+		{model.SamplePair{Timestamp: 10, Value: 1}, nil},
+		{model.SamplePair{Timestamp: 20, Value: 2}, nil},
+		// Samples are checked against the last one added, not the first.
+		{model.SamplePair{Timestamp: 15, Value: 3}, ErrOutOfOrderSample},
+		{model.SamplePair{Timestamp: 20, Value: 4}, ErrDuplicateSampleForTimestamp},
+		// Appending the last sample again is a no-op.
+		{model.SamplePair{Timestamp: 20, Value: 2}, nil},
+		{model.SamplePair{Timestamp: 30, Value: 5}, nil},
+	} {
+		if err := s.add(tc.sample); err != tc.expected {
+			t.Errorf("adding %v: expected %v, got %v", tc.sample, tc.expected, err)
+		}
+	}
+	if s.lastTime != 30 || s.lastSampleValue != 5 {
+		t.Errorf("expected last sample 5 @ 30, got %v @ %v", s.lastSampleValue, s.lastTime)
+	}
+}
@@ -0,0 +1,206 @@
+package ingester
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// Chunks are spilled to files holding the encoding byte followed by the
+// marshalled chunk.
+const spillFilePrefix = "chunk-"
+
+// spillBuffers hold chunks being written to and read back from disk, as
+// queries read every spilled chunk they touch.
+var spillBuffers = util.NewBufferPool("ingester_spill_buffer")
+
+// spill writes the chunk to a new file in dir, and drops it from memory.
+// The caller must have locked the fingerprint of the series, and the chunk
+// must be closed.
+func (d *desc) spill(dir string) error {
+	b := spillBuffers.Get()
+	defer spillBuffers.Put(b)
+	b.Grow(chunk.ChunkLen + 1)
+	buf := b.Bytes()[:chunk.ChunkLen+1]
+	buf[0] = byte(d.C.Encoding())
+	if err := d.C.MarshalToBuf(buf[1:]); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, spillFilePrefix)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	d.spillFile = f.Name()
+	d.C = nil
+	return nil
+}
+
+// chunk returns the chunk, reading it back from disk if it has been
+// spilled.
+func (d *desc) chunk() (chunk.Chunk, error) {
+	if d.C != nil {
+		return d.C, nil
+	}
+
+	f, err := os.Open(d.spillFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b := spillBuffers.Get()
+	defer spillBuffers.Put(b)
+	if _, err := b.ReadFrom(f); err != nil {
+		return nil, err
+	}
+	buf := b.Bytes()
+	if len(buf) == 0 {
+		return nil, fmt.Errorf("empty spill file %s", d.spillFile)
+	}
+	c, err := chunk.NewForEncoding(chunk.Encoding(buf[0]))
+	if err != nil {
+		return nil, err
+	}
+	// UnmarshalFromBuf copies buf, so it can be reused.
+	if err := c.UnmarshalFromBuf(buf[1:]); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// removeSpill deletes the spilled copy of the chunk, if any, once it has
+// been flushed.
+func (d *desc) removeSpill() {
+	if d.spillFile == "" {
+		return
+	}
+	if err := os.Remove(d.spillFile); err != nil {
+		log.Warnf("Error removing spilled chunk %s: %v", d.spillFile, err)
+	}
+}
+
+// cleanSpillDir removes chunks spilled by a previous run; those not flushed
+// were persisted on shutdown, see persistChunks.
+func cleanSpillDir(dir string) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), spillFilePrefix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, file.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type spillCandidate struct {
+	state *userState
+	fp    model.Fingerprint
+	desc  *desc
+}
+
+type byFirstTime []spillCandidate
+
+func (cs byFirstTime) Len() int           { return len(cs) }
+func (cs byFirstTime) Swap(i, j int)      { cs[i], cs[j] = cs[j], cs[i] }
+func (cs byFirstTime) Less(i, j int) bool { return cs[i].desc.FirstTime < cs[j].desc.FirstTime }
+
+// spillChunks spills the oldest closed chunks to disk until the chunks
+// held in memory fit in MaxChunkMemoryBytes.  Spilled chunks are still
+// queryable and are flushed from disk as usual.
+func (i *Ingester) spillChunks() {
+	if i.cfg.MaxChunkMemoryBytes <= 0 {
+		return
+	}
+	var (
+		inMemory   int
+		candidates byFirstTime
+	)
+	for _, state := range i.userStates.cp() {
+		for pair := range state.fpToSeries.iter() {
+			state.fpLocker.Lock(pair.fp)
+			for j, cd := range pair.series.chunkDescs {
+				if cd.C == nil {
+					continue
+				}
+				inMemory++
+				if j == len(pair.series.chunkDescs)-1 && !pair.series.headChunkClosed {
+					continue
+				}
+				candidates = append(candidates, spillCandidate{state, pair.fp, cd})
+			}
+			state.fpLocker.Unlock(pair.fp)
+		}
+	}
+
+	excess := inMemory - i.cfg.MaxChunkMemoryBytes/chunk.ChunkLen
+	if excess <= 0 {
+		return
+	}
+	sort.Sort(candidates)
+
+	spilled := 0
+	for _, c := range candidates {
+		if spilled >= excess {
+			break
+		}
+		ok, err := i.spillChunk(c)
+		if err != nil {
+			log.Errorf("Error spilling chunk: %v", err)
+			return
+		}
+		if ok {
+			spilled++
+		}
+	}
+}
+
+// spillChunk spills a candidate, provided it is still in memory and hasn't
+// been flushed in the meantime.
+func (i *Ingester) spillChunk(c spillCandidate) (bool, error) {
+	c.state.fpLocker.Lock(c.fp)
+	defer c.state.fpLocker.Unlock(c.fp)
+
+	series, ok := c.state.fpToSeries.get(c.fp)
+	if !ok || c.desc.C == nil {
+		return false, nil
+	}
+	for _, cd := range series.chunkDescs {
+		if cd != c.desc {
+			continue
+		}
+		if err := cd.spill(i.cfg.SpillDir); err != nil {
+			return false, err
+		}
+		i.memoryChunks.Dec()
+		i.spilledChunks.Inc()
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,47 @@
+package ingester
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpillChunk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	series := newMemorySeries(model.Metric{model.MetricNameLabel: "foo"})
+	for ts := model.Time(0); ts < 100; ts++ {
+		require.NoError(t, series.add(model.SamplePair{Timestamp: ts, Value: model.SampleValue(ts)}))
+	}
+	series.closeHead()
+	want, err := series.samplesForRange(0, 100)
+	require.NoError(t, err)
+
+	cd := series.head()
+	require.NoError(t, cd.spill(dir))
+	assert.Nil(t, cd.C)
+
+	// Still queryable once spilled.
+	have, err := series.samplesForRange(0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, want, have)
+
+	c, err := cd.chunk()
+	require.NoError(t, err)
+	values, err := chunk.RangeValues(c.NewIterator(), metric.Interval{OldestInclusive: 0, NewestInclusive: 100})
+	require.NoError(t, err)
+	assert.Equal(t, want, values)
+
+	cd.removeSpill()
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
@@ -0,0 +1,192 @@
+package ingester
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/util"
+)
+
+// Chunks are handed over in requests of about this many, to keep them well
+// under gRPC's message size limit.
+const transferBatchChunks = 1000
+
+// TransferChunks takes over chunks handed over by a leaving ingester, to be
+// flushed like any others.
+func (i *Ingester) TransferChunks(ctx context.Context, req *cortex.TransferChunksRequest) (*cortex.TransferChunksResponse, error) {
+	i.stopLock.RLock()
+	defer i.stopLock.RUnlock()
+	if i.stopped {
+		return nil, fmt.Errorf("ingester stopping")
+	}
+
+	for _, ts := range req.Timeseries {
+		descs, err := fromWireChunks(ts.Chunks)
+		if err != nil {
+			return nil, err
+		}
+		if len(descs) == 0 {
+			continue
+		}
+		if err := i.addChunks(ctx, util.FromLabelPairs(ts.Labels), descs); err != nil {
+			return nil, err
+		}
+	}
+	return &cortex.TransferChunksResponse{}, nil
+}
+
+// addChunks adds chunks persisted or handed over by another ingester to
+// their series, to be flushed like any other closed chunk.  If the series
+// already has chunks which these don't all come before, as its samples are
+// being written here too, they're flushed at once instead.
+func (i *Ingester) addChunks(ctx context.Context, metric model.Metric, descs []*desc) error {
+	state, fp, series, err := i.userStates.getOrCreateSeries(ctx, metric)
+	if err != nil {
+		return err
+	}
+	if len(series.chunkDescs) > 0 && descs[len(descs)-1].LastTime >= series.firstTime() {
+		state.fpLocker.Unlock(fp)
+		for _, cd := range descs {
+			cd.flushReason = flushReasonShutdown
+		}
+		return i.flushChunks(ctx, fp, series.metric, descs)
+	}
+
+	if len(series.chunkDescs) == 0 {
+		series.closeHead()
+		series.lastTime = descs[len(descs)-1].LastTime
+	}
+	series.chunkDescs = append(descs, series.chunkDescs...)
+	state.fpLocker.Unlock(fp)
+	i.memoryChunks.Add(float64(len(descs)))
+	return nil
+}
+
+// transferChunks hands every chunk in memory, or spilled, over to another
+// active ingester, one user at a time, returning how many it handed over.
+// Series are dropped once handed over, so those left can be persisted.  The
+// caller must have stopped the ingester's loops.
+func (i *Ingester) transferChunks(ctx context.Context) (int, error) {
+	client := i.cfg.handoverClient
+	if client == nil {
+		addr, err := i.handoverTarget()
+		if err != nil {
+			return 0, err
+		}
+		conn, err := grpc.DialContext(ctx, addr,
+			grpc.WithInsecure(),
+			grpc.WithUnaryInterceptor(middleware.ClientUserHeaderInterceptor),
+		)
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+		client = cortex.NewIngesterClient(conn)
+	}
+
+	transferred := 0
+	for userID, state := range i.userStates.cp() {
+		ctx := user.Inject(ctx, userID)
+		var pairs []fingerprintSeriesPair
+		for pair := range state.fpToSeries.iter() {
+			pairs = append(pairs, pair)
+		}
+
+		for len(pairs) > 0 {
+			req := &cortex.TransferChunksRequest{}
+			chunks, n := 0, 0
+			for ; n < len(pairs) && chunks < transferBatchChunks; n++ {
+				wireChunks, err := toWireChunks(pairs[n].series.chunkDescs)
+				if err != nil {
+					return transferred, err
+				}
+				req.Timeseries = append(req.Timeseries, cortex.TimeSeriesChunks{
+					Labels: util.ToLabelPairs(pairs[n].series.metric),
+					Chunks: wireChunks,
+				})
+				chunks += len(wireChunks)
+			}
+			if _, err := client.TransferChunks(ctx, req); err != nil {
+				return transferred, err
+			}
+
+			for _, pair := range pairs[:n] {
+				for _, cd := range pair.series.chunkDescs {
+					if cd.C == nil {
+						i.spilledChunks.Dec()
+					} else {
+						i.memoryChunks.Dec()
+					}
+					cd.removeSpill()
+				}
+				state.removeSeries(pair.fp, pair.series.metric)
+			}
+			transferred += chunks
+			pairs = pairs[n:]
+		}
+	}
+	return transferred, nil
+}
+
+// handoverTarget picks an active ingester, other than this one, to hand
+// chunks over to.
+func (i *Ingester) handoverTarget() (string, error) {
+	if i.ring == nil {
+		return "", fmt.Errorf("no ring to find an ingester to hand chunks over to in")
+	}
+	var addrs []string
+	for _, ingester := range i.ring.GetAll() {
+		if ingester.State == ring.ACTIVE && ingester.Addr != i.cfg.Addr {
+			addrs = append(addrs, ingester.Addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("no active ingester to hand chunks over to")
+	}
+	return addrs[rand.Intn(len(addrs))], nil
+}
+
+func toWireChunks(descs []*desc) ([]cortex.Chunk, error) {
+	wireChunks := make([]cortex.Chunk, 0, len(descs))
+	for _, cd := range descs {
+		c, err := cd.chunk()
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, chunk.ChunkLen)
+		if err := c.MarshalToBuf(buf); err != nil {
+			return nil, err
+		}
+		wireChunks = append(wireChunks, cortex.Chunk{
+			StartTimestampMs: int64(cd.FirstTime),
+			EndTimestampMs:   int64(cd.LastTime),
+			Encoding:         int32(c.Encoding()),
+			Data:             buf,
+		})
+	}
+	return wireChunks, nil
+}
+
+func fromWireChunks(wireChunks []cortex.Chunk) ([]*desc, error) {
+	descs := make([]*desc, 0, len(wireChunks))
+	for _, wc := range wireChunks {
+		c, err := chunk.NewForEncoding(chunk.Encoding(wc.Encoding))
+		if err != nil {
+			return nil, err
+		}
+		if err := c.UnmarshalFromBuf(wc.Data); err != nil {
+			return nil, err
+		}
+		descs = append(descs, newDesc(c, model.Time(wc.StartTimestampMs), model.Time(wc.EndTimestampMs)))
+	}
+	return descs, nil
+}
@@ -2,7 +2,9 @@ package ingester
 
 import (
 	"fmt"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/common/model"
@@ -11,12 +13,21 @@ import (
 
 	"github.com/weaveworks/common/user"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/validation"
 )
 
 type userStates struct {
 	mtx    sync.RWMutex
 	states map[string]*userState
 	cfg    *UserStatesConfig
+	limits *validation.Overrides
+
+	// Counts the ring's healthy, active ingesters, to share
+	// MaxGlobalSeriesPerUser between; nil if there's no ring.  Only called
+	// by updateRates, which caches the count in numIngesters, as it's
+	// needed for every new series.
+	healthyIngesters func() int
+	numIngesters     int64
 }
 
 type userState struct {
@@ -33,15 +44,27 @@ type userState struct {
 
 // UserStatesConfig configures userStates properties.
 type UserStatesConfig struct {
-	RateUpdatePeriod   time.Duration
-	MaxSeriesPerUser   int
-	MaxSeriesPerMetric int
+	RateUpdatePeriod time.Duration
+	MaxSeriesPerUser int
+
+	// Limit on a user's series across all ingesters.  It's approximate:
+	// ingesters don't share their counts, but each allows its share,
+	// MaxGlobalSeriesPerUser * ReplicationFactor / the healthy ingesters in
+	// the ring, assuming series are spread evenly over them.  That only
+	// holds with -distributor.shard-by-all-labels: sharded by metric name, a
+	// user's series are concentrated on a few ingesters, which hit their
+	// share long before the user hits the global limit.  It may be off
+	// either way during rollouts too, as ingesters leave and join and
+	// series move between them.
+	MaxGlobalSeriesPerUser int
+	ReplicationFactor      int
 }
 
-func newUserStates(cfg *UserStatesConfig) *userStates {
+func newUserStates(cfg *UserStatesConfig, limits *validation.Overrides) *userStates {
 	return &userStates{
 		states: map[string]*userState{},
 		cfg:    cfg,
+		limits: limits,
 	}
 }
 
@@ -67,6 +90,10 @@ func (us *userStates) gc() {
 }
 
 func (us *userStates) updateRates() {
+	if us.healthyIngesters != nil {
+		atomic.StoreInt64(&us.numIngesters, int64(us.healthyIngesters()))
+	}
+
 	us.mtx.RLock()
 	defer us.mtx.RUnlock()
 
@@ -134,7 +161,7 @@ func (us *userStates) getOrCreateSeries(ctx context.Context, metric model.Metric
 	us.mtx.RLock()
 	state, ok = us.states[userID]
 	if ok {
-		fp, series, err = state.unlockedGet(metric, us.cfg)
+		fp, series, err = state.unlockedGet(metric, us)
 		if err != nil {
 			us.mtx.RUnlock()
 			return nil, fp, nil, err
@@ -148,7 +175,7 @@ func (us *userStates) getOrCreateSeries(ctx context.Context, metric model.Metric
 	us.mtx.Lock()
 	defer us.mtx.Unlock()
 	state = us.unlockedGetOrCreate(userID)
-	fp, series, err = state.unlockedGet(metric, us.cfg)
+	fp, series, err = state.unlockedGet(metric, us)
 	return state, fp, series, err
 }
 
@@ -169,7 +196,30 @@ func (us *userStates) unlockedGetOrCreate(userID string) *userState {
 	return state
 }
 
-func (u *userState) unlockedGet(metric model.Metric, cfg *UserStatesConfig) (model.Fingerprint, *memorySeries, error) {
+// maxSeriesPerUser returns the most series a user may have in this ingester,
+// and the error for exceeding it: MaxSeriesPerUser, or this ingester's share
+// of MaxGlobalSeriesPerUser if that's lower.  The share is of the healthy
+// ingesters as of the last rate update, and is only an estimate.
+func (us *userStates) maxSeriesPerUser() (int, error) {
+	max := us.cfg.MaxSeriesPerUser
+	if us.cfg.MaxGlobalSeriesPerUser <= 0 {
+		return max, util.ErrUserSeriesLimitExceeded
+	}
+	ingesters := int(atomic.LoadInt64(&us.numIngesters))
+	if ingesters <= 0 {
+		return max, util.ErrUserSeriesLimitExceeded
+	}
+	share := us.cfg.MaxGlobalSeriesPerUser
+	if us.cfg.ReplicationFactor < ingesters {
+		share = int(math.Ceil(float64(us.cfg.MaxGlobalSeriesPerUser) * float64(us.cfg.ReplicationFactor) / float64(ingesters)))
+	}
+	if share < max {
+		return share, util.ErrUserGlobalSeriesLimitExceeded
+	}
+	return max, util.ErrUserSeriesLimitExceeded
+}
+
+func (u *userState) unlockedGet(metric model.Metric, us *userStates) (model.Fingerprint, *memorySeries, error) {
 	rawFP := metric.FastFingerprint()
 	u.fpLocker.Lock(rawFP)
 	fp := u.mapper.mapFP(rawFP, metric)
@@ -188,9 +238,9 @@ func (u *userState) unlockedGet(metric model.Metric, cfg *UserStatesConfig) (mod
 	// all proceed to add a new series. This is likely not worth addressing,
 	// as this should happen rarely (all samples from one push are added
 	// serially), and the overshoot in allowed series would be minimal.
-	if u.fpToSeries.length() >= cfg.MaxSeriesPerUser {
+	if max, err := us.maxSeriesPerUser(); u.fpToSeries.length() >= max {
 		u.fpLocker.Unlock(fp)
-		return fp, nil, util.ErrUserSeriesLimitExceeded
+		return fp, nil, err
 	}
 
 	metricName, err := util.ExtractMetricNameFromMetric(metric)
@@ -199,7 +249,7 @@ func (u *userState) unlockedGet(metric model.Metric, cfg *UserStatesConfig) (mod
 		return fp, nil, err
 	}
 
-	if !u.canAddSeriesFor(metricName, cfg) {
+	if !u.canAddSeriesFor(metricName, us.limits.MaxSeriesPerMetric(u.userID)) {
 		u.fpLocker.Unlock(fp)
 		return fp, nil, util.ErrMetricSeriesLimitExceeded
 	}
@@ -210,11 +260,11 @@ func (u *userState) unlockedGet(metric model.Metric, cfg *UserStatesConfig) (mod
 	return fp, series, nil
 }
 
-func (u *userState) canAddSeriesFor(metric model.LabelValue, cfg *UserStatesConfig) bool {
+func (u *userState) canAddSeriesFor(metric model.LabelValue, maxSeries int) bool {
 	u.seriesInMetricMtx.Lock()
 	defer u.seriesInMetricMtx.Unlock()
 
-	if u.seriesInMetric[metric] >= cfg.MaxSeriesPerMetric {
+	if u.seriesInMetric[metric] >= maxSeries {
 		return false
 	}
 	u.seriesInMetric[metric]++
@@ -0,0 +1,137 @@
+package querier
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/metric"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+var federationErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "querier_federation_errors_total",
+	Help:      "The total number of federation requests which failed.",
+})
+
+func init() {
+	prometheus.MustRegister(federationErrors)
+}
+
+// FederateHandler serves /federate like Prometheus, so other Prometheus
+// servers can scrape the latest sample of each of the user's series
+// matching the match[] selectors, each of which must name a metric.  Only the ingesters are queried, as no
+// sample older than the staleness delta is returned anyway.
+func FederateHandler(ingesters Querier) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		var matcherSets []metric.LabelMatchers
+		for _, s := range r.Form["match[]"] {
+			matchers, err := promql.ParseMetricSelector(s)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// The ingesters are queried by metric name, so selectors without
+			// one are the client's mistake, not ours.
+			if _, _, err := util.ExtractMetricNameFromMatchers(append([]*metric.LabelMatcher(nil), matchers...)); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			matcherSets = append(matcherSets, matchers)
+		}
+
+		now := model.Now()
+		series := map[model.Fingerprint]*model.Sample{}
+		for _, matchers := range matcherSets {
+			matrix, err := ingesters.Query(r.Context(), now.Add(-promql.StalenessDelta), now, matchers...)
+			if err != nil {
+				federationErrors.Inc()
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, ss := range matrix {
+				if len(ss.Values) == 0 {
+					continue
+				}
+				last := ss.Values[len(ss.Values)-1]
+				series[ss.Metric.Fingerprint()] = &model.Sample{Metric: ss.Metric, Value: last.Value, Timestamp: last.Timestamp}
+			}
+		}
+		vector := make(model.Vector, 0, len(series))
+		for _, s := range series {
+			vector = append(vector, s)
+		}
+		sort.Sort(byName(vector))
+
+		format := expfmt.Negotiate(r.Header)
+		w.Header().Set("Content-Type", string(format))
+		enc := expfmt.NewEncoder(w, format)
+		for _, family := range metricFamilies(vector) {
+			if err := enc.Encode(family); err != nil {
+				federationErrors.Inc()
+				log.Errorf("Error writing federation response: %v", err)
+				return
+			}
+		}
+	})
+}
+
+// metricFamilies groups the samples of vector, sorted by name, into untyped
+// metric families; samples without a name are dropped.
+func metricFamilies(vector model.Vector) []*dto.MetricFamily {
+	var families []*dto.MetricFamily
+	for _, s := range vector {
+		name, ok := s.Metric[model.MetricNameLabel]
+		if !ok || name == "" {
+			continue
+		}
+		if len(families) == 0 || families[len(families)-1].GetName() != string(name) {
+			families = append(families, &dto.MetricFamily{
+				Type: dto.MetricType_UNTYPED.Enum(),
+				Name: proto.String(string(name)),
+			})
+		}
+
+		m := &dto.Metric{
+			Untyped:     &dto.Untyped{Value: proto.Float64(float64(s.Value))},
+			TimestampMs: proto.Int64(int64(s.Timestamp)),
+		}
+		for ln, lv := range s.Metric {
+			if ln == model.MetricNameLabel || lv == "" {
+				continue
+			}
+			m.Label = append(m.Label, &dto.LabelPair{
+				Name:  proto.String(string(ln)),
+				Value: proto.String(string(lv)),
+			})
+		}
+		sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+		family := families[len(families)-1]
+		family.Metric = append(family.Metric, m)
+	}
+	return families
+}
+
+// byName sorts a model.Vector by metric name, then labels, so the output is
+// stable.
+type byName model.Vector
+
+func (vec byName) Len() int      { return len(vec) }
+func (vec byName) Swap(i, j int) { vec[i], vec[j] = vec[j], vec[i] }
+
+func (vec byName) Less(i, j int) bool {
+	ni, nj := vec[i].Metric[model.MetricNameLabel], vec[j].Metric[model.MetricNameLabel]
+	if ni != nj {
+		return ni < nj
+	}
+	return vec[i].Metric.Before(vec[j].Metric)
+}
@@ -0,0 +1,59 @@
+package querier
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFederateHandler(t *testing.T) {
+	ingesters := matrixQuerier{
+		{
+			Metric: model.Metric{model.MetricNameLabel: "foo", "job": "b"},
+			Values: []model.SamplePair{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 2}},
+		},
+		{
+			Metric: model.Metric{model.MetricNameLabel: "bar", "job": "a", "instance": "x"},
+			Values: []model.SamplePair{{Timestamp: 3000, Value: 3}},
+		},
+		{
+			Metric: model.Metric{model.MetricNameLabel: "foo", "job": "a"},
+			Values: []model.SamplePair{{Timestamp: 1000, Value: 4}},
+		},
+		// Nameless series, and empty ones, are dropped.
+		{
+			Metric: model.Metric{"job": "a"},
+			Values: []model.SamplePair{{Timestamp: 1000, Value: 5}},
+		},
+		{
+			Metric: model.Metric{model.MetricNameLabel: "baz"},
+		},
+	}
+	h := FederateHandler(ingesters)
+
+	// Series matched by more than one selector are only returned once.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", `/federate?match[]=foo&match[]={__name__="bar",job="a"}`, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `# TYPE bar untyped
+bar{instance="x",job="a"} 3 3000
+# TYPE foo untyped
+foo{job="a"} 4 1000
+foo{job="b"} 2 2000
+`, rec.Body.String())
+
+	// Selectors without a metric name can't be queried.
+	for _, match := range []string{`{job="a"}`, `{__name__=~"foo|bar"}`} {
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/federate?match[]="+url.QueryEscape(match), nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, match)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", `/federate?match[]=foo{`, nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
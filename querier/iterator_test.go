@@ -0,0 +1,40 @@
+package querier
+
+import (
+	"math"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestStaleMarkers(t *testing.T) {
+	stale := model.SampleValue(math.Float64frombits(util.StaleNaN))
+	it := sampleStreamIterator{
+		ss: &model.SampleStream{
+			Values: []model.SamplePair{
+				{Timestamp: 1, Value: 1},
+				{Timestamp: 2, Value: 2},
+				{Timestamp: 3, Value: stale},
+				{Timestamp: 5, Value: 5},
+			},
+		},
+	}
+
+	assert.Equal(t, model.SamplePair{Timestamp: 2, Value: 2}, it.ValueAtOrBeforeTime(2))
+	assert.Equal(t, model.SamplePair{Timestamp: model.Earliest}, it.ValueAtOrBeforeTime(3))
+	assert.Equal(t, model.SamplePair{Timestamp: model.Earliest}, it.ValueAtOrBeforeTime(4))
+	assert.Equal(t, model.SamplePair{Timestamp: 5, Value: 5}, it.ValueAtOrBeforeTime(5))
+
+	assert.Equal(t, []model.SamplePair{
+		{Timestamp: 2, Value: 2},
+		{Timestamp: 5, Value: 5},
+	}, it.RangeValues(metric.Interval{OldestInclusive: 2, NewestInclusive: 5}))
+	assert.Equal(t, []model.SamplePair{
+		{Timestamp: 1, Value: 1},
+		{Timestamp: 2, Value: 2},
+	}, it.RangeValues(metric.Interval{OldestInclusive: 1, NewestInclusive: 2}))
+}
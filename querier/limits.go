@@ -0,0 +1,113 @@
+package querier
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/validation"
+)
+
+var blockedQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "querier_blocked_queries_total",
+	Help:      "The total number of queries rejected as blocked for the user.",
+}, []string{"user"})
+
+func init() {
+	prometheus.MustRegister(blockedQueries)
+}
+
+// MaxPointsPerSeries rejects range queries which would return more than
+// maxPoints points per series, before they reach the query engine, telling
+// the user the smallest step they could use instead.  Malformed queries are
+// passed on, for the API to reject.
+func MaxPointsPerSeries(maxPoints int) middleware.Interface {
+	return middleware.Func(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if maxPoints <= 0 || !strings.HasSuffix(r.URL.Path, "/query_range") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			start, errStart := util.ParseTime(r.FormValue("start"))
+			end, errEnd := util.ParseTime(r.FormValue("end"))
+			step, errStep := util.ParseDuration(r.FormValue("step"))
+			if errStart != nil || errEnd != nil || errStep != nil || step <= 0 || end.Before(start) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if err := checkPointsPerSeries(start, end, step, maxPoints); err != nil {
+				writeError(w, http.StatusUnprocessableEntity, "bad_data", err.Error())
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+}
+
+// BlockQueries rejects queries the user's blocked_queries match, with the
+// reason given for blocking them.
+func BlockQueries(limits *validation.Overrides) middleware.Interface {
+	return middleware.Func(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, err := user.Extract(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if err := checkBlocked(limits, userID, r.FormValue("query")); err != nil {
+				writeError(w, http.StatusUnprocessableEntity, "bad_data", err.Error())
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+}
+
+func checkBlocked(limits *validation.Overrides, userID, query string) error {
+	if query == "" {
+		return nil
+	}
+	reason, blocked := limits.BlockedQuery(userID, query)
+	if !blocked {
+		return nil
+	}
+	blockedQueries.WithLabelValues(userID).Inc()
+	if reason == "" {
+		return errors.New("query blocked by an administrator")
+	}
+	return fmt.Errorf("query blocked by an administrator: %s", reason)
+}
+
+// checkPointsPerSeries counts points like the Prometheus API's own limit.
+func checkPointsPerSeries(start, end model.Time, step time.Duration, maxPoints int) error {
+	queryRange := end.Sub(start)
+	if points := int64(queryRange / step); points > int64(maxPoints) {
+		minStep := time.Duration(math.Ceil(queryRange.Seconds()/float64(maxPoints))) * time.Second
+		return fmt.Errorf(
+			"query would return %d points per series, more than the maximum of %d: increase the step to at least %s, or shorten the time range",
+			points, maxPoints, minStep)
+	}
+	return nil
+}
+
+// writeError writes an error in the format of the Prometheus API.
+func writeError(w http.ResponseWriter, code int, errorType, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Status    string `json:"status"`
+		ErrorType string `json:"errorType"`
+		Error     string `json:"error"`
+	}{"error", errorType, msg})
+}
@@ -0,0 +1,70 @@
+package querier
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util/validation"
+)
+
+func TestMaxPointsPerSeries(t *testing.T) {
+	handler := MaxPointsPerSeries(100).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, tc := range []struct {
+		url  string
+		code int
+	}{
+		{"/api/v1/query_range?query=up&start=0&end=3600&step=60", http.StatusOK},
+		{"/api/v1/query_range?query=up&start=0&end=3600&step=36", http.StatusOK},
+		{"/api/v1/query_range?query=up&start=0&end=3600&step=35", http.StatusUnprocessableEntity},
+		{"/api/v1/query_range?query=up&start=1970-01-01T00:00:00Z&end=1970-01-02T00:00:00Z&step=1m", http.StatusUnprocessableEntity},
+		{"/api/v1/query_range?query=up&start=0&end=3600&step=0", http.StatusOK},
+		{"/api/v1/query_range?query=up&start=foo&end=3600&step=1", http.StatusOK},
+		{"/api/v1/query?query=up&start=0&end=3600&step=1", http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", tc.url, nil))
+		assert.Equal(t, tc.code, rec.Code, tc.url)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/query_range?query=up&start=0&end=86400&step=60", nil))
+	assert.True(t, strings.Contains(rec.Body.String(), "increase the step to at least 14m24s"), rec.Body.String())
+}
+
+func TestBlockQueries(t *testing.T) {
+	limits, err := validation.NewOverrides(validation.OverridesConfig{}, validation.Limits{
+		BlockedQueries: []validation.BlockedQuery{{Pattern: "expensive", Reason: "see incident 42"}},
+	})
+	require.NoError(t, err)
+	handler := BlockQueries(limits).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, tc := range []struct {
+		url  string
+		code int
+	}{
+		{"/api/v1/query?query=expensive", http.StatusUnprocessableEntity},
+		{"/api/v1/query_range?query=expensive&start=0&end=3600&step=60", http.StatusUnprocessableEntity},
+		{"/api/v1/query?query=cheap", http.StatusOK},
+		{"/api/v1/label/__name__/values", http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", tc.url, nil)
+		req = req.WithContext(user.Inject(req.Context(), "1"))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, tc.code, rec.Code, tc.url)
+		if tc.code != http.StatusOK {
+			assert.Contains(t, rec.Body.String(), "query blocked by an administrator: see incident 42")
+		}
+	}
+}
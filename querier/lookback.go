@@ -0,0 +1,171 @@
+package querier
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/validation"
+)
+
+var clampedQueries = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "querier_clamped_queries_total",
+	Help:      "The total number of queries whose start was clamped to the user's max query lookback.",
+})
+
+func init() {
+	prometheus.MustRegister(clampedQueries)
+}
+
+// clampStart clamps the start of a range query to lookback before now, on
+// the query's step so the points returned are the same, returning the new
+// start and a warning if it was clamped.  The new start may be after end, if
+// the whole range is too old.
+func clampStart(start, end model.Time, step, lookback time.Duration, now model.Time) (model.Time, string) {
+	if lookback <= 0 {
+		return start, ""
+	}
+	oldest := now.Add(-lookback)
+	if !start.Before(oldest) {
+		return start, ""
+	}
+	if step > 0 {
+		steps := (oldest.Sub(start) + step - 1) / step
+		start = start.Add(steps * step)
+	} else {
+		start = oldest
+	}
+	clampedQueries.Inc()
+	return start, lookbackWarning(lookback)
+}
+
+// lookbackWarning says only the lookback, not when it started, so the
+// warning is the same for every query, and can be matched on or cached.
+func lookbackWarning(lookback time.Duration) string {
+	return fmt.Sprintf("data older than %s isn't kept, so the query's range was shortened to start after it", model.Duration(lookback))
+}
+
+// ClampLookback clamps the start of range queries to the user's
+// max_query_lookback, adding a warning to their responses saying so, so
+// users don't take the missing data for data loss.  Instant queries of
+// older times are only warned about.
+func ClampLookback(limits *validation.Overrides) middleware.Interface {
+	return middleware.Func(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, err := user.Extract(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			lookback := limits.MaxQueryLookback(userID)
+			if lookback <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			now := model.Now()
+			var warning string
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/query_range"):
+				start, errStart := util.ParseTime(r.FormValue("start"))
+				end, errEnd := util.ParseTime(r.FormValue("end"))
+				step, errStep := util.ParseDuration(r.FormValue("step"))
+				if errStart != nil || errEnd != nil || errStep != nil || step <= 0 || end.Before(start) {
+					break
+				}
+				var clamped model.Time
+				clamped, warning = clampStart(start, end, step, lookback, now)
+				if warning == "" {
+					break
+				}
+				if clamped.After(end) {
+					writeEmptyMatrix(w, warning)
+					return
+				}
+				r.Form.Set("start", formatTime(clamped))
+			case strings.HasSuffix(r.URL.Path, "/query"):
+				ts, err := util.ParseTime(r.FormValue("time"))
+				if oldest := now.Add(-lookback); err == nil && r.FormValue("time") != "" && ts.Before(oldest) {
+					warning = lookbackWarning(lookback)
+				}
+			}
+
+			if warning == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(&warningWriter{ResponseWriter: w, warning: warning, code: http.StatusOK}, r)
+		})
+	})
+}
+
+func formatTime(t model.Time) string {
+	return strconv.FormatFloat(float64(t)/1e3, 'f', -1, 64)
+}
+
+func writeEmptyMatrix(w http.ResponseWriter, warning string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Status   string      `json:"status"`
+		Data     interface{} `json:"data"`
+		Warnings []string    `json:"warnings"`
+	}{
+		Status: "success",
+		Data: struct {
+			ResultType model.ValueType `json:"resultType"`
+			Result     model.Matrix    `json:"result"`
+		}{model.ValMatrix, model.Matrix{}},
+		Warnings: []string{warning},
+	})
+}
+
+// warningWriter adds a warning to a successful Prometheus API response, by
+// inserting a warnings field at the start of its JSON object, so it needn't
+// be decoded and encoded again.
+type warningWriter struct {
+	http.ResponseWriter
+	warning string
+
+	code    int
+	started bool
+}
+
+func (w *warningWriter) WriteHeader(code int) {
+	if !w.started {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *warningWriter) Write(b []byte) (int, error) {
+	if w.started || len(b) == 0 {
+		return w.ResponseWriter.Write(b)
+	}
+	w.started = true
+	if w.code/100 != 2 || b[0] != '{' {
+		return w.ResponseWriter.Write(b)
+	}
+	warnings, err := json.Marshal([]string{w.warning})
+	if err != nil {
+		return 0, err
+	}
+	prefix := `{"warnings":` + string(warnings)
+	if len(b) > 1 && b[1] != '}' {
+		prefix += ","
+	}
+	if _, err := w.ResponseWriter.Write([]byte(prefix)); err != nil {
+		return 0, err
+	}
+	n, err := w.ResponseWriter.Write(b[1:])
+	return n + 1, err
+}
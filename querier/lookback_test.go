@@ -0,0 +1,80 @@
+package querier
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util/validation"
+)
+
+func TestClampStart(t *testing.T) {
+	now := model.TimeFromUnix(10000)
+	for _, tc := range []struct {
+		start, end model.Time
+		step       time.Duration
+		lookback   time.Duration
+		expected   model.Time
+		clamped    bool
+	}{
+		{model.TimeFromUnix(0), now, time.Minute, 0, model.TimeFromUnix(0), false},
+		{model.TimeFromUnix(9000), now, time.Minute, time.Hour, model.TimeFromUnix(9000), false},
+		// Clamped to the first step after now-1h, 6400.
+		{model.TimeFromUnix(0), now, time.Minute, time.Hour, model.TimeFromUnix(6420), true},
+		{model.TimeFromUnix(40), now, time.Minute, time.Hour, model.TimeFromUnix(6400), true},
+		{model.TimeFromUnix(0), model.TimeFromUnix(100), time.Minute, time.Hour, model.TimeFromUnix(6420), true},
+	} {
+		start, warning := clampStart(tc.start, tc.end, tc.step, tc.lookback, now)
+		assert.Equal(t, tc.expected, start, "%v", tc)
+		assert.Equal(t, tc.clamped, warning != "", "%v", tc)
+	}
+}
+
+func TestClampLookback(t *testing.T) {
+	limits, err := validation.NewOverrides(validation.OverridesConfig{}, validation.Limits{
+		MaxQueryLookback: time.Hour,
+	})
+	require.NoError(t, err)
+	handler := ClampLookback(limits).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"status":"success","data":%q}`, r.FormValue("start"))
+	}))
+	now := time.Now().Unix()
+	query := func(url string) string {
+		req := httptest.NewRequest("GET", url, nil)
+		req = req.WithContext(user.Inject(req.Context(), "1"))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code, url)
+		return rec.Body.String()
+	}
+
+	// Recent queries are untouched.
+	url := fmt.Sprintf("/api/v1/query_range?query=up&start=%d&end=%d&step=1", now-60, now)
+	assert.Equal(t, fmt.Sprintf(`{"status":"success","data":"%d"}`, now-60), query(url))
+
+	// Older ones are clamped, with a warning.
+	url = fmt.Sprintf("/api/v1/query_range?query=up&start=%d&end=%d&step=1", now-7200, now)
+	body := query(url)
+	assert.Contains(t, body, `{"warnings":["data older than 1h`)
+	assert.NotContains(t, body, fmt.Sprintf(`"data":"%d"`, now-7200))
+
+	// Those entirely too old return nothing.
+	url = fmt.Sprintf("/api/v1/query_range?query=up&start=%d&end=%d&step=1", now-7200, now-3700)
+	body = query(url)
+	assert.Contains(t, body, `{"status":"success","data":{"resultType":"matrix","result":[]},"warnings":["data older than 1h`)
+
+	// Instant queries of older times are only warned about.
+	body = query(fmt.Sprintf("/api/v1/query?query=up&time=%d", now-7200))
+	assert.Contains(t, body, `{"warnings":["data older than 1h`)
+	assert.Contains(t, body, `"status":"success"`)
+
+	// The warning is the same whatever the query's range.
+	assert.Contains(t, query(fmt.Sprintf("/api/v1/query?query=up&time=%d", now-9000)), `{"warnings":["data older than 1h isn't kept, so the query's range was shortened to start after it"],`)
+}
@@ -1,6 +1,7 @@
 package querier
 
 import (
+	"flag"
 	"fmt"
 	"time"
 
@@ -13,6 +14,7 @@ import (
 
 	"github.com/weaveworks/cortex/chunk"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/validation"
 )
 
 // ChunkStore is the interface we need to get chunks
@@ -20,6 +22,57 @@ type ChunkStore interface {
 	Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]chunk.Chunk, error)
 }
 
+// Config configures a querier.
+type Config struct {
+	Timeout            time.Duration
+	MaxConcurrent      int
+	MaxPointsPerSeries int
+	LookbackDelta      time.Duration
+	SlowQueryLog       SlowQueryLogConfig
+
+	// The defaults of MaxQueryResponseSize and MaxQueryLookback.
+	Limits validation.Limits
+	// Not registered as flags: the querier shares the distributor's overrides.
+	OverridesConfig validation.OverridesConfig
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.DurationVar(&cfg.Timeout, "querier.timeout", 2*time.Minute, "The timeout for a query.")
+	f.IntVar(&cfg.MaxConcurrent, "querier.max-concurrent", 20, "The maximum number of concurrent queries.")
+	f.IntVar(&cfg.MaxPointsPerSeries, "querier.max-points-per-series", 11000, "Reject range queries which would return more points per series than this, before evaluating them (at most 11000).")
+	f.DurationVar(&cfg.LookbackDelta, "querier.lookback-delta", promql.StalenessDelta, "How far back each step of a query looks for series' latest samples.  Split range queries' subqueries look back as far before their start, so their results are the same as the full query's.")
+	cfg.SlowQueryLog.RegisterFlags(f)
+	cfg.Limits.RegisterQuerierFlags(f)
+}
+
+// Validate validates the config.
+func (cfg Config) Validate() error {
+	if cfg.LookbackDelta <= 0 {
+		return fmt.Errorf("lookback delta must be positive: %v", cfg.LookbackDelta)
+	}
+	return nil
+}
+
+// ApplyLookbackDelta sets how far back each step of a query looks.  It's
+// global in promql, so it applies to every engine in the process.
+func (cfg Config) ApplyLookbackDelta() {
+	promql.StalenessDelta = cfg.LookbackDelta
+}
+
+// NewOverrides makes the per-tenant limits for queries, defaulting to cfg.
+func (cfg Config) NewOverrides() (*validation.Overrides, error) {
+	return validation.NewOverrides(cfg.OverridesConfig, cfg.Limits)
+}
+
+// EngineOptions returns the promql.EngineOptions for cfg.
+func (cfg Config) EngineOptions() *promql.EngineOptions {
+	return &promql.EngineOptions{
+		MaxConcurrentQueries: cfg.MaxConcurrent,
+		Timeout:              cfg.Timeout,
+	}
+}
+
 // NewEngine creates a new promql.Engine for cortex.
 func NewEngine(distributor Querier, chunkStore ChunkStore) *promql.Engine {
 	queryable := NewQueryable(distributor, chunkStore)
@@ -31,7 +84,7 @@ func NewQueryable(distributor Querier, chunkStore ChunkStore) Queryable {
 	return Queryable{
 		Q: MergeQuerier{
 			Queriers: []Querier{
-				distributor,
+				ingesterQuerier{distributor},
 				&ChunkQuerier{
 					Store: chunkStore,
 				},
@@ -62,7 +115,12 @@ func (q *ChunkQuerier) Query(ctx context.Context, from, to model.Time, matchers
 		return nil, err
 	}
 
-	return chunk.ChunksToMatrix(chunks)
+	matrix, err := chunk.ChunksToMatrix(chunks)
+	if err != nil {
+		return nil, err
+	}
+	QueryStatsFromContext(ctx).addStore(len(chunks), matrix)
+	return matrix, nil
 }
 
 // LabelValuesForLabelName returns all of the label values that are associated with a given label name.
@@ -120,6 +178,9 @@ func (qm MergeQuerier) QueryRange(ctx context.Context, from, to model.Time, matc
 		case matrix := <-matrices:
 			for _, ss := range matrix {
 				fp := ss.Metric.Fingerprint()
+				if !inShard(ctx, fp) {
+					continue
+				}
 				if it, ok := fpToIt[fp]; !ok {
 					fpToIt[fp] = sampleStreamIterator{
 						ss: ss,
@@ -0,0 +1,112 @@
+package querier
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/frontend"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/validation"
+)
+
+// The Prometheus API's own limit, which range queries from the frontend
+// bypass along with the rest of the API.
+const prometheusMaxPointsPerSeries = 11000
+
+var errPrometheusMaxPoints = errors.New("exceeded maximum resolution of 11,000 points per timeseries. Try decreasing the query resolution (?step=XX)")
+
+// QueryRangeHandler executes range queries sent by the query frontend
+// directly on the engine, returning their results as protos instead of JSON.
+// Errors are reported like the Prometheus API would.
+type QueryRangeHandler struct {
+	engine             *promql.Engine
+	maxPointsPerSeries int
+	limits             *validation.Overrides
+}
+
+// NewQueryRangeHandler makes a new QueryRangeHandler.
+func NewQueryRangeHandler(engine *promql.Engine, maxPointsPerSeries int, limits *validation.Overrides) *QueryRangeHandler {
+	return &QueryRangeHandler{
+		engine:             engine,
+		maxPointsPerSeries: maxPointsPerSeries,
+		limits:             limits,
+	}
+}
+
+// QueryRange implements frontend.QueryRangeHandler.  Successful responses
+// carry what the query fetched, for the frontend to report.  Sharded queries
+// are evaluated over only their shard's series, though they're all fetched.
+func (h *QueryRangeHandler) QueryRange(ctx context.Context, req *frontend.QueryRangeRequest) *frontend.QueryRangeResponse {
+	ctx, stats := WithQueryStats(ctx)
+	if req.ShardCount > 1 {
+		ctx = withShard(ctx, req.Shard, req.ShardCount)
+	}
+	start := model.Time(req.StartTimestampMs)
+	end := model.Time(req.EndTimestampMs)
+	step := time.Duration(req.StepMs) * time.Millisecond
+	if err := checkBlocked(h.limits, req.UserId, req.Query); err != nil {
+		return errorResponse(http.StatusUnprocessableEntity, "bad_data", err)
+	}
+	if step <= 0 {
+		return errorResponse(http.StatusBadRequest, "bad_data", errors.New("zero or negative query resolution step widths are not accepted. Try a positive integer"))
+	}
+	if h.maxPointsPerSeries > 0 {
+		if err := checkPointsPerSeries(start, end, step, h.maxPointsPerSeries); err != nil {
+			return errorResponse(http.StatusUnprocessableEntity, "bad_data", err)
+		}
+	}
+	if end.Sub(start)/step > prometheusMaxPointsPerSeries {
+		return errorResponse(http.StatusBadRequest, "bad_data", errPrometheusMaxPoints)
+	}
+	var warnings []string
+	start, warning := clampStart(start, end, step, h.limits.MaxQueryLookback(req.UserId), model.Now())
+	if warning != "" {
+		warnings = append(warnings, warning)
+		if start.After(end) {
+			return &frontend.QueryRangeResponse{Code: http.StatusOK, Warnings: warnings}
+		}
+	}
+
+	query, err := h.engine.NewRangeQuery(req.Query, start, end, step)
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, "bad_data", err)
+	}
+	res := query.Exec(ctx)
+	if res.Err != nil {
+		switch res.Err.(type) {
+		case promql.ErrQueryCanceled:
+			return errorResponse(http.StatusServiceUnavailable, "canceled", res.Err)
+		case promql.ErrQueryTimeout:
+			return errorResponse(http.StatusServiceUnavailable, "timeout", res.Err)
+		}
+		return errorResponse(http.StatusUnprocessableEntity, "execution", res.Err)
+	}
+	matrix, err := res.Matrix()
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "internal", err)
+	}
+	resp := &frontend.QueryRangeResponse{
+		Code:     http.StatusOK,
+		Matrix:   util.ToQueryResponse(matrix).Timeseries,
+		Warnings: warnings,
+	}
+	s := frontend.QueryStats(stats.load())
+	resp.Stats = &s
+	if err := checkResponseSize(req.UserId, resp, h.limits.MaxQueryResponseSize(req.UserId)); err != nil {
+		return errorResponse(http.StatusUnprocessableEntity, "execution", err)
+	}
+	return resp
+}
+
+func errorResponse(code int32, errorType string, err error) *frontend.QueryRangeResponse {
+	return &frontend.QueryRangeResponse{
+		Code:      code,
+		ErrorType: errorType,
+		Error:     err.Error(),
+	}
+}
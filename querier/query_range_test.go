@@ -0,0 +1,133 @@
+package querier
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/frontend"
+	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/validation"
+)
+
+type matrixQuerier model.Matrix
+
+func (q matrixQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	return model.Matrix(q), nil
+}
+
+func (q matrixQuerier) LabelValuesForLabelName(context.Context, model.LabelName) (model.LabelValues, error) {
+	return nil, nil
+}
+
+func (q matrixQuerier) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
+	return nil, nil
+}
+
+func TestQueryRangeHandler(t *testing.T) {
+	series := &model.SampleStream{
+		Metric: model.Metric{model.MetricNameLabel: "foo"},
+		Values: []model.SamplePair{{Timestamp: 0, Value: 1}, {Timestamp: 30000, Value: 2}},
+	}
+	queryable := Queryable{Q: MergeQuerier{Queriers: []Querier{matrixQuerier{series}}}}
+	engine := promql.NewEngine(queryable, nil)
+	h := NewQueryRangeHandler(engine, 10, newLimits(t, 1000))
+
+	req := &frontend.QueryRangeRequest{
+		UserId:           "1",
+		StartTimestampMs: 0,
+		EndTimestampMs:   30000,
+		StepMs:           15000,
+		Query:            "foo",
+	}
+	resp := h.QueryRange(context.Background(), req)
+	require.Equal(t, "", resp.Error)
+	assert.Equal(t, int32(http.StatusOK), resp.Code)
+	expected := model.Matrix{&model.SampleStream{
+		Metric: series.Metric,
+		Values: []model.SamplePair{{Timestamp: 0, Value: 1}, {Timestamp: 15000, Value: 1}, {Timestamp: 30000, Value: 2}},
+	}}
+	assert.Equal(t, util.ToQueryResponse(expected).Timeseries, resp.Matrix)
+	require.NotNil(t, resp.Stats)
+
+	for _, tc := range []struct {
+		req       frontend.QueryRangeRequest
+		code      int32
+		errorType string
+	}{
+		{frontend.QueryRangeRequest{EndTimestampMs: 30000, StepMs: 15000, Query: "foo{"}, http.StatusBadRequest, "bad_data"},
+		{frontend.QueryRangeRequest{EndTimestampMs: 30000, StepMs: 0, Query: "foo"}, http.StatusBadRequest, "bad_data"},
+		{frontend.QueryRangeRequest{EndTimestampMs: 300000, StepMs: 1000, Query: "foo"}, http.StatusUnprocessableEntity, "bad_data"},
+	} {
+		resp := h.QueryRange(context.Background(), &tc.req)
+		assert.Equal(t, tc.code, resp.Code, tc.req.String())
+		assert.Equal(t, tc.errorType, resp.ErrorType, tc.req.String())
+		assert.Empty(t, resp.Matrix)
+	}
+
+	// The limit applies to the result as JSON.
+	size := frontend.ResponseSize(resp)
+	resp = NewQueryRangeHandler(engine, 10, newLimits(t, size)).QueryRange(context.Background(), req)
+	assert.Equal(t, int32(http.StatusOK), resp.Code)
+	resp = NewQueryRangeHandler(engine, 10, newLimits(t, size-1)).QueryRange(context.Background(), req)
+	assert.Equal(t, int32(http.StatusUnprocessableEntity), resp.Code)
+	assert.Equal(t, "execution", resp.ErrorType)
+	assert.Contains(t, resp.Error, fmt.Sprintf("at least %d bytes", size))
+	assert.Empty(t, resp.Matrix)
+
+	blocking, err := validation.NewOverrides(validation.OverridesConfig{}, validation.Limits{
+		BlockedQueries: []validation.BlockedQuery{{Pattern: "foo"}},
+	})
+	require.NoError(t, err)
+	resp = NewQueryRangeHandler(engine, 10, blocking).QueryRange(context.Background(), req)
+	assert.Equal(t, int32(http.StatusUnprocessableEntity), resp.Code)
+	assert.Equal(t, "query blocked by an administrator", resp.Error)
+}
+
+func TestQueryRangeHandlerShards(t *testing.T) {
+	var series model.Matrix
+	for i := 0; i < 10; i++ {
+		series = append(series, &model.SampleStream{
+			Metric: model.Metric{model.MetricNameLabel: "foo", "i": model.LabelValue(fmt.Sprint(i))},
+			Values: []model.SamplePair{{Timestamp: 0, Value: 1}},
+		})
+	}
+	queryable := Queryable{Q: MergeQuerier{Queriers: []Querier{matrixQuerier(series)}}}
+	h := NewQueryRangeHandler(promql.NewEngine(queryable, nil), 0, newLimits(t, 0))
+
+	// Every series is in exactly one shard.
+	seen := map[string]int{}
+	for shard := uint32(0); shard < 3; shard++ {
+		resp := h.QueryRange(context.Background(), &frontend.QueryRangeRequest{
+			UserId:     "1",
+			StepMs:     15000,
+			Query:      "foo",
+			Shard:      shard,
+			ShardCount: 3,
+		})
+		require.Equal(t, "", resp.Error)
+		assert.True(t, len(resp.Matrix) < len(series))
+		for _, ts := range resp.Matrix {
+			seen[fmt.Sprint(ts.Labels)]++
+		}
+	}
+	assert.Len(t, seen, len(series))
+	for labels, n := range seen {
+		assert.Equal(t, 1, n, labels)
+	}
+}
+
+func newLimits(t *testing.T, maxResponseSize int) *validation.Overrides {
+	limits, err := validation.NewOverrides(validation.OverridesConfig{}, validation.Limits{
+		MaxQueryResponseSize: maxResponseSize,
+	})
+	require.NoError(t, err)
+	return limits
+}
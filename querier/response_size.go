@@ -0,0 +1,122 @@
+package querier
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/frontend"
+	"github.com/weaveworks/cortex/util/validation"
+)
+
+var (
+	responseSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "querier_response_size_bytes",
+		Help:      "Size of query responses, before any limit is applied.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+	})
+	responsesTooLarge = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "querier_responses_too_large_total",
+		Help:      "The total number of queries rejected as their responses were larger than the user's limit.",
+	}, []string{"user"})
+)
+
+func init() {
+	prometheus.MustRegister(responseSize)
+	prometheus.MustRegister(responsesTooLarge)
+}
+
+func errResponseTooLarge(size, limit int) error {
+	return fmt.Errorf("query response of at least %d bytes is larger than the limit of %d bytes: narrow the query's selectors, aggregate it, or shorten its time range", size, limit)
+}
+
+// MaxResponseSize rejects responses larger than the user's
+// max_query_response_size_bytes, replacing them with an error.  The
+// Prometheus API writes each response in one go, so the status is held
+// back until the first write; anything larger found after that is cut off.
+func MaxResponseSize(limits *validation.Overrides) middleware.Interface {
+	return middleware.Func(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, err := user.Extract(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			sw := &sizeLimitWriter{
+				ResponseWriter: w,
+				userID:         userID,
+				limit:          limits.MaxQueryResponseSize(userID),
+				code:           http.StatusOK,
+			}
+			next.ServeHTTP(sw, r)
+			sw.finish()
+		})
+	})
+}
+
+type sizeLimitWriter struct {
+	http.ResponseWriter
+	userID string
+	limit  int
+
+	code     int
+	size     int
+	started  bool
+	exceeded bool
+}
+
+func (w *sizeLimitWriter) WriteHeader(code int) {
+	if !w.started {
+		w.code = code
+	}
+}
+
+func (w *sizeLimitWriter) Write(b []byte) (int, error) {
+	w.size += len(b)
+	if w.exceeded {
+		return 0, errResponseTooLarge(w.size, w.limit)
+	}
+	if w.limit > 0 && w.size > w.limit {
+		w.exceeded = true
+		responsesTooLarge.WithLabelValues(w.userID).Inc()
+		err := errResponseTooLarge(w.size, w.limit)
+		if !w.started {
+			w.started = true
+			writeError(w.ResponseWriter, http.StatusUnprocessableEntity, "execution", err.Error())
+		}
+		return 0, err
+	}
+	w.start()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *sizeLimitWriter) start() {
+	if !w.started {
+		w.started = true
+		w.ResponseWriter.WriteHeader(w.code)
+	}
+}
+
+// finish writes the status of responses with no body.
+func (w *sizeLimitWriter) finish() {
+	w.start()
+	responseSize.Observe(float64(w.size))
+}
+
+// checkResponseSize checks the size of the response sent back to the
+// frontend for a range query, as the JSON the frontend would write, which the
+// frontend in turn checks once it's merged the responses to split queries.
+func checkResponseSize(userID string, resp *frontend.QueryRangeResponse, limit int) error {
+	size := frontend.ResponseSize(resp)
+	responseSize.Observe(float64(size))
+	if limit > 0 && size > limit {
+		responsesTooLarge.WithLabelValues(userID).Inc()
+		return errResponseTooLarge(size, limit)
+	}
+	return nil
+}
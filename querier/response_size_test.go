@@ -0,0 +1,44 @@
+package querier
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/weaveworks/common/user"
+)
+
+func TestMaxResponseSize(t *testing.T) {
+	handler := MaxResponseSize(newLimits(t, 10)).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(r.FormValue("body")))
+		w.Write([]byte(r.FormValue("more")))
+	}))
+	query := func(url string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		req = req.WithContext(user.Inject(req.Context(), "1"))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := query("/api/v1/query?body=0123456789")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "0123456789", rec.Body.String())
+
+	rec = query("/api/v1/query?body=0123456789a")
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"errorType":"execution"`)
+	assert.Contains(t, rec.Body.String(), "at least 11 bytes is larger than the limit of 10 bytes")
+
+	// Once part of the response is written, the rest is cut off.
+	rec = query("/api/v1/query?body=01234&more=56789a")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "01234", rec.Body.String())
+
+	// Responses without a body keep their status.
+	rec = query("/api/v1/query")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+}
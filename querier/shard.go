@@ -0,0 +1,24 @@
+package querier
+
+import (
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+)
+
+const shardKey contextKey = 1
+
+type shard struct {
+	index, count uint32
+}
+
+// withShard returns a context whose queries only return the series whose
+// fingerprints are index modulo count.
+func withShard(ctx context.Context, index, count uint32) context.Context {
+	return context.WithValue(ctx, shardKey, shard{index, count})
+}
+
+// inShard reports whether the series fp is in ctx's shard, if any.
+func inShard(ctx context.Context, fp model.Fingerprint) bool {
+	s, ok := ctx.Value(shardKey).(shard)
+	return !ok || s.count < 2 || uint64(fp)%uint64(s.count) == uint64(s.index)
+}
@@ -0,0 +1,145 @@
+package querier
+
+import (
+	"flag"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/frontend"
+)
+
+var slowQueries = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "querier_slow_queries_total",
+	Help:      "The total number of queries slower than the slow query threshold, logged or not.",
+})
+
+func init() {
+	prometheus.MustRegister(slowQueries)
+}
+
+// SlowQueryLogConfig configures the log of slow queries.
+type SlowQueryLogConfig struct {
+	Threshold  time.Duration
+	SampleRate int
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *SlowQueryLogConfig) RegisterFlags(f *flag.FlagSet) {
+	f.DurationVar(&cfg.Threshold, "querier.slow-query-threshold", 0, "Log queries taking longer than this, with their stats (0 to disable).")
+	f.IntVar(&cfg.SampleRate, "querier.slow-query-log-sample-rate", 1, "Only log one in this many slow queries.")
+}
+
+// SlowQueryLog logs queries taking longer than the threshold to their own
+// log, with their tenant, PromQL, time range and (if wrapped in
+// ReportQueryStats) stats.
+type SlowQueryLog struct {
+	cfg    SlowQueryLogConfig
+	logger log.Logger
+	count  uint64
+}
+
+// NewSlowQueryLog makes a new SlowQueryLog.
+func NewSlowQueryLog(cfg SlowQueryLogConfig) *SlowQueryLog {
+	return &SlowQueryLog{
+		cfg:    cfg,
+		logger: log.With("log", "slow_queries"),
+	}
+}
+
+// Wrap implements middleware.Interface.  It must be wrapped in
+// authentication, so the tenant is known.
+func (l *SlowQueryLog) Wrap(next http.Handler) http.Handler {
+	if l.cfg.Threshold <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		logger, ok := l.sample(time.Since(start))
+		if !ok {
+			return
+		}
+
+		userID, _ := user.Extract(r.Context())
+		logger = logger.
+			With("tenant", userID).
+			With("path", r.URL.Path).
+			With("query", r.FormValue("query"))
+		for _, param := range []string{"time", "start", "end", "step"} {
+			if v := r.FormValue(param); v != "" {
+				logger = logger.With(param, v)
+			}
+		}
+		if stats := QueryStatsFromContext(r.Context()); stats != nil {
+			logger = withStats(logger, frontend.QueryStats(stats.load()))
+		}
+		logger.Warn("Slow query")
+	})
+}
+
+// WrapQueryRange logs the slow range queries next executes for the
+// frontend, which bypass the API and so Wrap.
+func (l *SlowQueryLog) WrapQueryRange(next frontend.QueryRangeHandler) frontend.QueryRangeHandler {
+	if l.cfg.Threshold <= 0 {
+		return next
+	}
+	return slowQueryRangeHandler{log: l, next: next}
+}
+
+type slowQueryRangeHandler struct {
+	log  *SlowQueryLog
+	next frontend.QueryRangeHandler
+}
+
+func (h slowQueryRangeHandler) QueryRange(ctx context.Context, req *frontend.QueryRangeRequest) *frontend.QueryRangeResponse {
+	start := time.Now()
+	resp := h.next.QueryRange(ctx, req)
+	logger, ok := h.log.sample(time.Since(start))
+	if !ok {
+		return resp
+	}
+	logger = logger.
+		With("tenant", req.UserId).
+		With("path", "/api/v1/query_range").
+		With("via", "frontend").
+		With("query", req.Query).
+		With("start", model.Time(req.StartTimestampMs)).
+		With("end", model.Time(req.EndTimestampMs)).
+		With("step", strconv.FormatFloat(float64(req.StepMs)/1000, 'f', -1, 64))
+	if resp.Stats != nil {
+		logger = withStats(logger, *resp.Stats)
+	}
+	logger.Warn("Slow query")
+	return resp
+}
+
+// sample counts a query which took took, returning the logger to log it
+// with if it's slow and sampled.
+func (l *SlowQueryLog) sample(took time.Duration) (log.Logger, bool) {
+	if took < l.cfg.Threshold {
+		return nil, false
+	}
+	slowQueries.Inc()
+	if n := atomic.AddUint64(&l.count, 1); l.cfg.SampleRate > 1 && n%uint64(l.cfg.SampleRate) != 0 {
+		return nil, false
+	}
+	return l.logger.With("duration", took), true
+}
+
+func withStats(logger log.Logger, s frontend.QueryStats) log.Logger {
+	return logger.
+		With("ingester_series", s.IngesterSeries).
+		With("ingester_samples", s.IngesterSamples).
+		With("store_series", s.StoreSeries).
+		With("store_chunks", s.StoreChunks).
+		With("store_samples", s.StoreSamples)
+}
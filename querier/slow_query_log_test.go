@@ -0,0 +1,73 @@
+package querier
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/frontend"
+)
+
+func TestSlowQueryLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewSlowQueryLog(SlowQueryLogConfig{Threshold: 10 * time.Millisecond, SampleRate: 2})
+	l.logger = log.NewLogger(&buf)
+
+	var delay time.Duration
+	handler := ReportQueryStats().Wrap(l.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		QueryStatsFromContext(r.Context()).addStore(7, nil)
+		time.Sleep(delay)
+	})))
+	query := func() {
+		req := httptest.NewRequest("GET", "/api/v1/query_range?query=up&start=1&end=2&step=1", nil)
+		req = req.WithContext(user.Inject(req.Context(), "1"))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Fast queries aren't logged...
+	query()
+	assert.Empty(t, buf.String())
+
+	// ...and only one in two slow ones are.
+	delay = 20 * time.Millisecond
+	query()
+	query()
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 1)
+	for _, field := range []string{"tenant=1", "query=up", "start=1", "end=2", "step=1", "store_chunks=7"} {
+		assert.Contains(t, lines[0], field)
+	}
+}
+
+// delayedQueryRangeHandler takes delay, and fetches seven chunks.
+type delayedQueryRangeHandler struct {
+	delay time.Duration
+}
+
+func (h delayedQueryRangeHandler) QueryRange(ctx context.Context, req *frontend.QueryRangeRequest) *frontend.QueryRangeResponse {
+	time.Sleep(h.delay)
+	return &frontend.QueryRangeResponse{Code: http.StatusOK, Stats: &frontend.QueryStats{StoreChunks: 7}}
+}
+
+func TestSlowQueryLogQueryRange(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewSlowQueryLog(SlowQueryLogConfig{Threshold: 10 * time.Millisecond})
+	l.logger = log.NewLogger(&buf)
+	req := &frontend.QueryRangeRequest{UserId: "1", StartTimestampMs: 1000, EndTimestampMs: 2500, StepMs: 500, Query: "up"}
+
+	l.WrapQueryRange(delayedQueryRangeHandler{}).QueryRange(context.Background(), req)
+	assert.Empty(t, buf.String())
+
+	l.WrapQueryRange(delayedQueryRangeHandler{20 * time.Millisecond}).QueryRange(context.Background(), req)
+	for _, field := range []string{"tenant=1", "query=up", "start=1", "end=2.5", "step=0.5", "store_chunks=7"} {
+		assert.Contains(t, buf.String(), field)
+	}
+}
@@ -0,0 +1,163 @@
+package querier
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/cortex/frontend"
+)
+
+// QueryStats counts what a query fetched, from the ingesters and from the
+// chunk store, as it's executed.
+type QueryStats frontend.QueryStats
+
+type contextKey int
+
+const queryStatsKey contextKey = 0
+
+// WithQueryStats returns a context whose queries are counted in the
+// returned QueryStats.
+func WithQueryStats(ctx context.Context) (context.Context, *QueryStats) {
+	stats := &QueryStats{}
+	return context.WithValue(ctx, queryStatsKey, stats), stats
+}
+
+// QueryStatsFromContext returns the QueryStats queries in ctx are counted
+// in, or nil.
+func QueryStatsFromContext(ctx context.Context) *QueryStats {
+	stats, _ := ctx.Value(queryStatsKey).(*QueryStats)
+	return stats
+}
+
+func (s *QueryStats) addIngester(matrix model.Matrix) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.IngesterSeries, int64(len(matrix)))
+	atomic.AddInt64(&s.IngesterSamples, int64(countSamples(matrix)))
+}
+
+func (s *QueryStats) addStore(chunks int, matrix model.Matrix) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.StoreChunks, int64(chunks))
+	atomic.AddInt64(&s.StoreSeries, int64(len(matrix)))
+	atomic.AddInt64(&s.StoreSamples, int64(countSamples(matrix)))
+}
+
+// load returns a consistent copy of s, once the query is done.
+func (s *QueryStats) load() QueryStats {
+	return QueryStats{
+		IngesterSeries:  atomic.LoadInt64(&s.IngesterSeries),
+		IngesterSamples: atomic.LoadInt64(&s.IngesterSamples),
+		StoreSeries:     atomic.LoadInt64(&s.StoreSeries),
+		StoreChunks:     atomic.LoadInt64(&s.StoreChunks),
+		StoreSamples:    atomic.LoadInt64(&s.StoreSamples),
+	}
+}
+
+func countSamples(matrix model.Matrix) int {
+	samples := 0
+	for _, ss := range matrix {
+		samples += len(ss.Values)
+	}
+	return samples
+}
+
+// ingesterQuerier counts the series and samples the distributor fetches from
+// the ingesters in the query's QueryStats.
+type ingesterQuerier struct {
+	Querier
+}
+
+func (q ingesterQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	matrix, err := q.Querier.Query(ctx, from, to, matchers...)
+	if err == nil {
+		QueryStatsFromContext(ctx).addIngester(matrix)
+	}
+	return matrix, err
+}
+
+// ReportQueryStats counts what each query fetches, and returns it, with the
+// query's wall time, in the response's headers, and in a stats section of
+// its data if the request has stats=all, as the frontend does for range
+// queries.  Responses are held back until the query is done.
+func ReportQueryStats() middleware.Interface {
+	return middleware.Func(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			statsAll := r.URL.Query().Get("stats") == "all"
+			if statsAll {
+				// We need the JSON to add the stats to.
+				r.Header.Del("Accept-Encoding")
+			}
+			ctx, stats := WithQueryStats(r.Context())
+			bw := &bufferedResponseWriter{ResponseWriter: w, code: http.StatusOK}
+			next.ServeHTTP(bw, r.WithContext(ctx))
+
+			s := frontend.QueryStats(stats.load())
+			wallTime := time.Since(start).Seconds()
+			frontend.SetStatsHeaders(w.Header(), s, wallTime)
+
+			body := bw.body.Bytes()
+			if statsAll && bw.code == http.StatusOK {
+				if withStats, err := addStats(body, frontend.NewStatsResponse(s, wallTime)); err != nil {
+					log.Warnf("Error adding stats to query response: %v", err)
+				} else {
+					body = withStats
+				}
+			}
+			w.WriteHeader(bw.code)
+			if _, err := w.Write(body); err != nil {
+				log.Errorf("Error writing response: %v", err)
+			}
+		})
+	})
+}
+
+// addStats adds stats to the data of a Prometheus API response.
+func addStats(body []byte, stats *frontend.StatsResponse) ([]byte, error) {
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(resp["data"], &data); err != nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(stats)
+	if err != nil {
+		return nil, err
+	}
+	data["stats"] = buf
+	if resp["data"], err = json.Marshal(data); err != nil {
+		return nil, err
+	}
+	return json.Marshal(resp)
+}
+
+// bufferedResponseWriter holds back a response, so headers can be added
+// once it's complete.
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) WriteHeader(code int) {
+	w.code = code
+}
+
+func (w *bufferedResponseWriter) Write(buf []byte) (int, error) {
+	return w.body.Write(buf)
+}
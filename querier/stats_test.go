@@ -0,0 +1,66 @@
+package querier
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/cortex/frontend"
+)
+
+func TestReportQueryStats(t *testing.T) {
+	matrix := model.Matrix{
+		{Metric: model.Metric{"foo": "bar"}, Values: []model.SamplePair{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}}},
+	}
+	handler := ReportQueryStats().Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := QueryStatsFromContext(r.Context())
+		require.NotNil(t, stats)
+		stats.addIngester(matrix)
+		stats.addStore(3, append(matrix, matrix...))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+
+	for _, stats := range []bool{false, true} {
+		url := "/api/v1/query_range"
+		if stats {
+			url += "?stats=all"
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "3", rec.Header().Get("X-Cortex-Query-Series"))
+		assert.Equal(t, "3", rec.Header().Get("X-Cortex-Query-Chunks"))
+		assert.Equal(t, "6", rec.Header().Get("X-Cortex-Query-Samples"))
+		assert.Equal(t, "1", rec.Header().Get("X-Cortex-Query-Ingester-Series"))
+		assert.Equal(t, "4", rec.Header().Get("X-Cortex-Query-Store-Samples"))
+		assert.NotEmpty(t, rec.Header().Get("X-Cortex-Query-Wall-Time-Seconds"))
+
+		var resp struct {
+			Data struct {
+				ResultType string                  `json:"resultType"`
+				Stats      *frontend.StatsResponse `json:"stats"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		assert.Equal(t, "matrix", resp.Data.ResultType)
+		if !stats {
+			assert.Nil(t, resp.Data.Stats)
+			continue
+		}
+		require.NotNil(t, resp.Data.Stats)
+		assert.Equal(t, int64(6), resp.Data.Stats.Samples.TotalQueryableSamples)
+		assert.Equal(t, frontend.QueryStats{
+			IngesterSeries:  1,
+			IngesterSamples: 2,
+			StoreSeries:     2,
+			StoreChunks:     3,
+			StoreSamples:    4,
+		}, resp.Data.Stats.Cortex)
+	}
+}
@@ -0,0 +1,49 @@
+package querier
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/version"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// BuildInfoHandler serves /api/v1/status/buildinfo like Prometheus, for
+// clients which use it to detect features.
+func BuildInfoHandler(w http.ResponseWriter, r *http.Request) {
+	writeSuccess(w, map[string]string{
+		"version":   version.Version,
+		"revision":  version.Revision,
+		"branch":    version.Branch,
+		"buildUser": version.BuildUser,
+		"buildDate": version.BuildDate,
+		"goVersion": version.GoVersion,
+	})
+}
+
+// FlagsHandler serves /api/v1/status/flags like Prometheus, with the values
+// of the flags in fs, and secrets redacted; see util.RedactFlag.  It must be
+// wrapped in admin authentication, as the rest of the config isn't for
+// tenants either.
+func FlagsHandler(fs *flag.FlagSet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flags := map[string]string{}
+		fs.VisitAll(func(f *flag.Flag) {
+			flags[f.Name] = util.RedactFlag(f.Name, f.Value.String())
+		})
+		writeSuccess(w, flags)
+	})
+}
+
+func writeSuccess(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		Status string      `json:"status"`
+		Data   interface{} `json:"data"`
+	}{"success", data}); err != nil {
+		log.Errorf("Error writing response: %v", err)
+	}
+}
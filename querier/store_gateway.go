@@ -0,0 +1,56 @@
+package querier
+
+import (
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/storegateway"
+	"github.com/weaveworks/cortex/util"
+	cortex_errors "github.com/weaveworks/cortex/util/errors"
+)
+
+// NewStoreGatewayQueryable creates a new Queryable for cortex, reading from
+// the chunk store through the store gateways rather than directly.
+func NewStoreGatewayQueryable(distributor Querier, client storegateway.StoreGatewayClient) Queryable {
+	return Queryable{
+		Q: MergeQuerier{
+			Queriers: []Querier{
+				ingesterQuerier{distributor},
+				StoreGatewayQuerier{Client: client},
+			},
+		},
+	}
+}
+
+// A StoreGatewayQuerier is a Querier that fetches samples from the chunk
+// store through the store gateways.
+type StoreGatewayQuerier struct {
+	Client storegateway.StoreGatewayClient
+}
+
+// Query implements Querier.
+func (q StoreGatewayQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	req, err := util.ToQueryRequest(from, to, matchers)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := q.Client.Query(ctx, req)
+	if err != nil {
+		return nil, cortex_errors.FromGRPC(err)
+	}
+	matrix := util.FromQueryResponse(resp)
+	// The gateways fetch the chunks, so we can't count them here.
+	QueryStatsFromContext(ctx).addStore(0, matrix)
+	return matrix, nil
+}
+
+// LabelValuesForLabelName is a noop, as for ChunkQuerier.
+func (q StoreGatewayQuerier) LabelValuesForLabelName(ctx context.Context, ln model.LabelName) (model.LabelValues, error) {
+	return nil, nil
+}
+
+// MetricsForLabelMatchers is a noop, as for ChunkQuerier.
+func (q StoreGatewayQuerier) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
+	return nil, nil
+}
@@ -3,6 +3,8 @@ package ring
 import (
 	"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"time"
 
 	"github.com/golang/protobuf/proto"
@@ -17,16 +19,78 @@ const (
 
 // ConsulConfig to create a ConsulClient
 type ConsulConfig struct {
-	Host   string
-	Prefix string
+	Host       string
+	Prefix     string
+	ACLToken   string
+	Datacenter string
+	AllowStale bool
+
+	TLSEnabled            bool
+	TLSCAPath             string
+	TLSCertPath           string
+	TLSKeyPath            string
+	TLSServerName         string
+	TLSInsecureSkipVerify bool
 
 	mock ConsulClient
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
 func (cfg *ConsulConfig) RegisterFlags(f *flag.FlagSet) {
-	f.StringVar(&cfg.Host, "consul.hostname", "localhost:8500", "Hostname and port of Consul.")
-	f.StringVar(&cfg.Prefix, "consul.prefix", "collectors/", "Prefix for keys in Consul.")
+	cfg.RegisterFlagsWithPrefix("", f)
+}
+
+// RegisterFlagsWithPrefix adds the flags required to config this to the
+// given FlagSet, with their names prefixed.
+func (cfg *ConsulConfig) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet) {
+	f.StringVar(&cfg.Host, prefix+"consul.hostname", "localhost:8500", "Hostname and port of Consul.")
+	f.StringVar(&cfg.Prefix, prefix+"consul.prefix", "collectors/", "Prefix for keys in Consul.")
+	f.StringVar(&cfg.ACLToken, prefix+"consul.acl-token", "", "ACL token for Consul.")
+	f.StringVar(&cfg.Datacenter, prefix+"consul.datacenter", "", "Consul datacenter to use (empty for the agent's).")
+	f.BoolVar(&cfg.AllowStale, prefix+"consul.allow-stale", false, "Let any Consul server, not just the leader, answer watches (e.g. of the ring), so they work without a leader, at the cost of possibly stale values.  CAS always reads consistently.")
+	f.BoolVar(&cfg.TLSEnabled, prefix+"consul.tls-enabled", false, "Connect to Consul over TLS.")
+	f.StringVar(&cfg.TLSCAPath, prefix+"consul.tls-ca-path", "", "Path to the CA certificates to verify Consul with (empty for the system's).")
+	f.StringVar(&cfg.TLSCertPath, prefix+"consul.tls-cert-path", "", "Path to the client certificate to authenticate to Consul with.")
+	f.StringVar(&cfg.TLSKeyPath, prefix+"consul.tls-key-path", "", "Path to the key of the client certificate.")
+	f.StringVar(&cfg.TLSServerName, prefix+"consul.tls-server-name", "", "Server name to verify Consul's certificate against (empty for the host of -consul.hostname).")
+	f.BoolVar(&cfg.TLSInsecureSkipVerify, prefix+"consul.tls-insecure-skip-verify", false, "Skip verifying Consul's certificate.")
+}
+
+// httpClient returns the client to connect to Consul with, or nil for
+// Consul's default.
+func (cfg *ConsulConfig) httpClient() (*http.Client, error) {
+	if !cfg.TLSEnabled {
+		return nil, nil
+	}
+	if (cfg.TLSCertPath == "") != (cfg.TLSKeyPath == "") {
+		return nil, fmt.Errorf("-consul.tls-cert-path and -consul.tls-key-path must be set together")
+	}
+	address := cfg.TLSServerName
+	if address == "" {
+		address = cfg.Host
+	}
+	tlsConfig, err := consul.SetupTLSConfig(&consul.TLSConfig{
+		Address:            address,
+		CAFile:             cfg.TLSCAPath,
+		CertFile:           cfg.TLSCertPath,
+		KeyFile:            cfg.TLSKeyPath,
+		InsecureSkipVerify: cfg.TLSInsecureSkipVerify,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}, nil
 }
 
 // ConsulClient is a high-level client for Consul, that exposes operations
@@ -57,7 +121,8 @@ type kv interface {
 
 type consulClient struct {
 	kv
-	codec Codec
+	codec      Codec
+	allowStale bool
 }
 
 // NewConsulClient returns a new ConsulClient.
@@ -66,16 +131,28 @@ func NewConsulClient(cfg ConsulConfig, codec Codec) (ConsulClient, error) {
 		return cfg.mock, nil
 	}
 
+	httpClient, err := cfg.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	scheme := "http"
+	if cfg.TLSEnabled {
+		scheme = "https"
+	}
 	client, err := consul.NewClient(&consul.Config{
-		Address: cfg.Host,
-		Scheme:  "http",
+		Address:    cfg.Host,
+		Scheme:     scheme,
+		Datacenter: cfg.Datacenter,
+		Token:      cfg.ACLToken,
+		HttpClient: httpClient,
 	})
 	if err != nil {
 		return nil, err
 	}
 	var c ConsulClient = &consulClient{
-		kv:    client.KV(),
-		codec: codec,
+		kv:         client.KV(),
+		codec:      codec,
+		allowStale: cfg.AllowStale,
 	}
 	if cfg.Prefix != "" {
 		c = PrefixClient(c, cfg.Prefix)
@@ -223,6 +300,16 @@ func isClosed(done <-chan struct{}) bool {
 	}
 }
 
+// watchOptions are the options for long polls for changes after index.
+func (c *consulClient) watchOptions(index uint64) *consul.QueryOptions {
+	return &consul.QueryOptions{
+		RequireConsistent: !c.allowStale,
+		AllowStale:        c.allowStale,
+		WaitIndex:         index,
+		WaitTime:          longPollDuration,
+	}
+}
+
 // WatchPrefix will watch a given prefix in consul for changes. When a value
 // under said prefix changes, the f callback is called with the deserialised
 // value. To construct the deserialised value, a factory function should be
@@ -238,11 +325,7 @@ func (c *consulClient) WatchPrefix(prefix string, done <-chan struct{}, f func(s
 		if isClosed(done) {
 			return
 		}
-		kvps, meta, err := c.kv.List(prefix, &consul.QueryOptions{
-			RequireConsistent: true,
-			WaitIndex:         index,
-			WaitTime:          longPollDuration,
-		})
+		kvps, meta, err := c.kv.List(prefix, c.watchOptions(index))
 		if err != nil {
 			log.Errorf("Error getting path %s: %v", prefix, err)
 			backoff.wait()
@@ -285,11 +368,7 @@ func (c *consulClient) WatchKey(key string, done <-chan struct{}, f func(interfa
 		if isClosed(done) {
 			return
 		}
-		kvp, meta, err := c.kv.Get(key, &consul.QueryOptions{
-			RequireConsistent: true,
-			WaitIndex:         index,
-			WaitTime:          longPollDuration,
-		})
+		kvp, meta, err := c.kv.Get(key, c.watchOptions(index))
 		if err != nil {
 			log.Errorf("Error getting path %s: %v", key, err)
 			backoff.wait()
@@ -1,7 +1,9 @@
 package ring
 
 import (
+	"net/http"
 	"sync"
+	"testing"
 	"time"
 
 	consul "github.com/hashicorp/consul/api"
@@ -139,3 +141,34 @@ func (m *mockKV) List(prefix string, q *consul.QueryOptions) (consul.KVPairs, *c
 	}
 	return result, &consul.QueryMeta{LastIndex: m.current}, nil
 }
+
+func TestConsulHTTPClient(t *testing.T) {
+	cfg := ConsulConfig{Host: "consul.example.com:8501"}
+	if client, err := cfg.httpClient(); err != nil || client != nil {
+		t.Fatalf("expected Consul's default client without TLS, got %v, %v", client, err)
+	}
+
+	cfg.TLSEnabled = true
+	cfg.TLSInsecureSkipVerify = true
+	client, err := cfg.httpClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := client.Transport.(*http.Transport).TLSClientConfig
+	if tlsConfig.ServerName != "consul.example.com" || !tlsConfig.InsecureSkipVerify {
+		t.Fatalf("unexpected TLS config: %+v", tlsConfig)
+	}
+
+	cfg.TLSServerName = "consul.service"
+	if client, err = cfg.httpClient(); err != nil {
+		t.Fatal(err)
+	}
+	if name := client.Transport.(*http.Transport).TLSClientConfig.ServerName; name != "consul.service" {
+		t.Fatalf("unexpected server name: %s", name)
+	}
+
+	cfg.TLSCertPath = "cert.pem"
+	if _, err := cfg.httpClient(); err == nil {
+		t.Fatal("expected an error for a certificate without a key")
+	}
+}
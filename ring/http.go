@@ -29,6 +29,7 @@ const tpl = `
 						<th>Ingester</th>
 						<th>State</th>
 						<th>Address</th>
+						<th>Zone</th>
 						<th>Last Heartbeat</th>
 						<th>Tokens</th>
 						<th>Ownership</th>
@@ -41,6 +42,7 @@ const tpl = `
 						<td>{{ .ID }}</td>
 						<td>{{ .State }}</td>
 						<td>{{ .Address }}</td>
+						<td>{{ .Zone }}</td>
 						<td>{{ .Timestamp }}</td>
 						<td>{{ .Tokens }}</td>
 						<td>{{ .Ownership }}%</td>
@@ -74,7 +76,7 @@ func (r *Ring) forget(id string) error {
 		ringDesc.removeIngester(id)
 		return ringDesc, true, nil
 	}
-	return r.consul.CAS(consulKey, unregister)
+	return r.consul.CAS(r.key, unregister)
 }
 
 func (r *Ring) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -109,13 +111,14 @@ func (r *Ring) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 
 		ingesters = append(ingesters, struct {
-			ID, State, Address, Timestamp string
-			Tokens                        uint32
-			Ownership                     float64
+			ID, State, Address, Zone, Timestamp string
+			Tokens                              uint32
+			Ownership                           float64
 		}{
 			ID:        id,
 			State:     state,
 			Address:   ing.Addr,
+			Zone:      ing.Zone,
 			Timestamp: timestamp.String(),
 			Tokens:    tokens[id],
 			Ownership: (float64(owned[id]) / float64(math.MaxUint32)) * 100,
@@ -137,3 +140,21 @@ func (r *Ring) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 }
+
+// SafeToRestartHandler reports whether the ingester given by the ingester
+// parameter can be restarted now (see Snapshot.SafeToRestart), with a 200,
+// or why not, with a 503, so deployment tooling can wait for it.
+func (r *Ring) SafeToRestartHandler(replicationFactor int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.FormValue("ingester")
+		if id == "" {
+			http.Error(w, "ingester parameter required", http.StatusBadRequest)
+			return
+		}
+		if err := r.Snapshot().SafeToRestart(id, replicationFactor); err != nil {
+			http.Error(w, fmt.Sprintf("Not safe to restart %s: %v", id, err), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "Safe to restart %s\n", id)
+	})
+}
@@ -39,6 +39,7 @@ type IngesterRegistrationConfig struct {
 
 	ListenPort *int
 	NumTokens  int
+	Zone       string
 
 	// For testing
 	Addr           string
@@ -51,6 +52,7 @@ type IngesterRegistrationConfig struct {
 func (cfg *IngesterRegistrationConfig) RegisterFlags(f *flag.FlagSet) {
 	cfg.Config.RegisterFlags(f)
 	f.IntVar(&cfg.NumTokens, "ingester.num-tokens", 128, "Number of tokens for each ingester.")
+	f.StringVar(&cfg.Zone, "ingester.availability-zone", "", "The availability zone of this ingester, so queriers can prefer ingesters in their own zone.")
 }
 
 // IngesterRegistration manages the connection between the ingester and Consul.
@@ -58,11 +60,13 @@ type IngesterRegistration struct {
 	Ring *Ring
 
 	consul         ConsulClient
+	key            string
 	numTokens      int
 	skipUnregister bool
 
 	id   string
 	addr string
+	zone string
 	quit chan struct{}
 	wait sync.WaitGroup
 
@@ -105,6 +109,7 @@ func RegisterIngester(cfg IngesterRegistrationConfig) (*IngesterRegistration, er
 		Ring: ring,
 
 		consul:         ring.consul,
+		key:            ring.key,
 		numTokens:      cfg.NumTokens,
 		skipUnregister: cfg.skipUnregister,
 
@@ -112,6 +117,7 @@ func RegisterIngester(cfg IngesterRegistrationConfig) (*IngesterRegistration, er
 		// hostname is the ip+port of this instance, written to consul so
 		// the distributors know where to connect.
 		addr: fmt.Sprintf("%s:%d", addr, *cfg.ListenPort),
+		zone: cfg.Zone,
 		quit: make(chan struct{}),
 
 		// Only read/written on actor goroutine.
@@ -124,6 +130,11 @@ func RegisterIngester(cfg IngesterRegistrationConfig) (*IngesterRegistration, er
 	return r, nil
 }
 
+// Addr returns the address this is registered in the ring with.
+func (r *IngesterRegistration) Addr() string {
+	return r.addr
+}
+
 // ChangeState changes the state of an ingester in the ring.
 func (r *IngesterRegistration) ChangeState(state IngesterState) {
 	log.Infof("Changing ingester state to %v", state)
@@ -177,13 +188,13 @@ func (r *IngesterRegistration) pickTokens() ([]uint32, error) {
 		}
 
 		newTokens := generateTokens(r.numTokens-len(myTokens), takenTokens)
-		ringDesc.addIngester(r.id, r.addr, newTokens, r.state)
+		ringDesc.addIngester(r.id, r.addr, r.zone, newTokens, r.state)
 
 		tokens := append(myTokens, newTokens...)
 		sort.Sort(sortableUint32(tokens))
 		return ringDesc, true, nil
 	}
-	if err := r.consul.CAS(consulKey, pickTokens); err != nil {
+	if err := r.consul.CAS(r.key, pickTokens); err != nil {
 		return nil, err
 	}
 	log.Infof("Ingester added to consul")
@@ -204,11 +215,12 @@ func (r *IngesterRegistration) heartbeat(tokens []uint32) {
 		if !ok {
 			// consul must have restarted
 			log.Infof("Found empty ring, inserting tokens!")
-			ringDesc.addIngester(r.id, r.addr, tokens, r.state)
+			ringDesc.addIngester(r.id, r.addr, r.zone, tokens, r.state)
 		} else {
 			ingesterDesc.Timestamp = time.Now().Unix()
 			ingesterDesc.State = r.state
 			ingesterDesc.Addr = r.addr
+			ingesterDesc.Zone = r.zone
 
 			// Set ProtoRing back to true for the case where an existing ingester that didn't understand this field removed it whilst updating the ring.
 			ingesterDesc.ProtoRing = true
@@ -223,12 +235,12 @@ func (r *IngesterRegistration) heartbeat(tokens []uint32) {
 	for {
 		select {
 		case r.state = <-r.stateChange:
-			if err := r.consul.CAS(consulKey, updateConsul); err != nil {
+			if err := r.consul.CAS(r.key, updateConsul); err != nil {
 				log.Errorf("Failed to write to consul, sleeping: %v", err)
 			}
 		case <-ticker.C:
 			consulHeartbeats.Inc()
-			if err := r.consul.CAS(consulKey, updateConsul); err != nil {
+			if err := r.consul.CAS(r.key, updateConsul); err != nil {
 				log.Errorf("Failed to write to consul, sleeping: %v", err)
 			}
 		case <-r.quit:
@@ -247,7 +259,7 @@ func (r *IngesterRegistration) unregister() {
 		ringDesc.removeIngester(r.id)
 		return ringDesc, true, nil
 	}
-	if err := r.consul.CAS(consulKey, unregister); err != nil {
+	if err := r.consul.CAS(r.key, unregister); err != nil {
 		log.Fatalf("Failed to unregister from consul: %v", err)
 	}
 	log.Infof("Ingester removed from consul")
@@ -25,7 +25,7 @@ func newDesc() *Desc {
 	}
 }
 
-func (d *Desc) addIngester(id, addr string, tokens []uint32, state IngesterState) {
+func (d *Desc) addIngester(id, addr, zone string, tokens []uint32, state IngesterState) {
 	if d.Ingesters == nil {
 		d.Ingesters = map[string]*IngesterDesc{}
 	}
@@ -34,6 +34,7 @@ func (d *Desc) addIngester(id, addr string, tokens []uint32, state IngesterState
 		Timestamp: time.Now().Unix(),
 		State:     state,
 		ProtoRing: true,
+		Zone:      zone,
 	}
 
 	for _, token := range tokens {
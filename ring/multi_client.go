@@ -0,0 +1,311 @@
+package ring
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	multiPrimaryStore = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cortex_multikv_primary_store",
+		Help: "Whether each store is the one read from and written to first (1) or not (0).",
+	}, []string{"store"})
+	multiMirrorWrites = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cortex_multikv_mirror_writes_total",
+		Help: "The total number of writes mirrored to the secondary store.",
+	})
+	multiMirrorWriteErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cortex_multikv_mirror_write_errors_total",
+		Help: "The total number of writes which failed to be mirrored to the secondary store.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(multiPrimaryStore)
+	prometheus.MustRegister(multiMirrorWrites)
+	prometheus.MustRegister(multiMirrorWriteErrors)
+}
+
+// Names of the stores in a multi client.
+const (
+	primaryStore   = "primary"
+	secondaryStore = "secondary"
+)
+
+// MultiConfig configures a second store for the ring, to migrate it to.
+//
+// To migrate without downtime, run everything with the secondary store
+// configured and mirroring on, by default reading from the primary store.
+// Then switch every process to read from the secondary store by writing
+//
+//	primary: secondary
+//
+// to the runtime config file, and once all have reloaded it, restart them
+// on the new store alone.
+type MultiConfig struct {
+	Enabled           bool
+	Secondary         ConsulConfig
+	MirrorEnabled     bool
+	RuntimeConfigFile string
+	Period            time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *MultiConfig) RegisterFlags(f *flag.FlagSet) {
+	f.BoolVar(&cfg.Enabled, "multi.enabled", false, "Use a secondary store for the ring alongside the primary one, to migrate between them.")
+	cfg.Secondary.RegisterFlagsWithPrefix("multi.secondary.", f)
+	f.BoolVar(&cfg.MirrorEnabled, "multi.mirror-enabled", true, "Mirror writes to the ring to the secondary store.")
+	f.StringVar(&cfg.RuntimeConfigFile, "multi.runtime-config", "", "File choosing which store to read from (\"primary: primary\" or \"primary: secondary\"), and whether to mirror writes (\"mirror_enabled: false\"); reloaded periodically.")
+	f.DurationVar(&cfg.Period, "multi.runtime-config-period", 10*time.Second, "Period with which to reload the runtime config.")
+}
+
+// multiRuntimeConfig is the runtime config file, which overrides the flags.
+type multiRuntimeConfig struct {
+	Primary       string `yaml:"primary"`
+	MirrorEnabled *bool  `yaml:"mirror_enabled"`
+}
+
+// multiClient is a ConsulClient reading from, and writing to, whichever of
+// two stores is currently primary, mirroring writes to the other.  Watches
+// restart on the new primary when it is switched.
+type multiClient struct {
+	cfg    MultiConfig
+	stores map[string]ConsulClient
+	codec  Codec
+
+	mtx     sync.RWMutex
+	primary string
+	mirror  bool
+	// Closed, and replaced, when the primary is switched.
+	switched chan struct{}
+}
+
+// NewMultiClient makes a ConsulClient using primary and secondary, per cfg.
+func NewMultiClient(cfg MultiConfig, primary, secondary ConsulClient, codec Codec) (ConsulClient, error) {
+	c := &multiClient{
+		cfg: cfg,
+		stores: map[string]ConsulClient{
+			primaryStore:   primary,
+			secondaryStore: secondary,
+		},
+		codec:    codec,
+		primary:  primaryStore,
+		mirror:   cfg.MirrorEnabled,
+		switched: make(chan struct{}),
+	}
+	if cfg.RuntimeConfigFile != "" {
+		if err := c.reload(); err != nil {
+			return nil, err
+		}
+		if cfg.Period > 0 {
+			go c.loop()
+		}
+	}
+	c.updateMetrics()
+	return c, nil
+}
+
+// loop reloads the runtime config for the life of the process, as
+// ConsulClients are never stopped.
+func (c *multiClient) loop() {
+	for range time.Tick(c.cfg.Period) {
+		if err := c.reload(); err != nil {
+			log.Errorf("Error reloading multi KV runtime config from %s: %v", c.cfg.RuntimeConfigFile, err)
+		}
+	}
+}
+
+func (c *multiClient) reload() error {
+	buf, err := ioutil.ReadFile(c.cfg.RuntimeConfigFile)
+	if err != nil {
+		return err
+	}
+	var runtimeConfig multiRuntimeConfig
+	if err := yaml.Unmarshal(buf, &runtimeConfig); err != nil {
+		return err
+	}
+	primary := runtimeConfig.Primary
+	if primary == "" {
+		primary = primaryStore
+	}
+	if _, ok := c.stores[primary]; !ok {
+		return fmt.Errorf("invalid primary store %q, must be %q or %q", primary, primaryStore, secondaryStore)
+	}
+	mirror := c.cfg.MirrorEnabled
+	if runtimeConfig.MirrorEnabled != nil {
+		mirror = *runtimeConfig.MirrorEnabled
+	}
+	c.setPrimary(primary, mirror)
+	return nil
+}
+
+func (c *multiClient) setPrimary(primary string, mirror bool) {
+	c.mtx.Lock()
+	c.mirror = mirror
+	if primary != c.primary {
+		log.Infof("Switching primary KV store to %s", primary)
+		c.primary = primary
+		close(c.switched)
+		c.switched = make(chan struct{})
+	}
+	c.mtx.Unlock()
+	c.updateMetrics()
+}
+
+func (c *multiClient) updateMetrics() {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	for name := range c.stores {
+		value := 0.0
+		if name == c.primary {
+			value = 1
+		}
+		multiPrimaryStore.WithLabelValues(name).Set(value)
+	}
+}
+
+// current returns the primary store, the other (to mirror to, or nil), and
+// a channel closed when they're switched.
+func (c *multiClient) current() (primary, mirror ConsulClient, switched <-chan struct{}) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	for name, store := range c.stores {
+		if name == c.primary {
+			primary = store
+		} else if c.mirror {
+			mirror = store
+		}
+	}
+	return primary, mirror, c.switched
+}
+
+// CAS implements ConsulClient, CASing the primary store, and writing the
+// result to the other.
+func (c *multiClient) CAS(key string, f CASCallback) error {
+	primary, mirror, _ := c.current()
+	var result interface{}
+	err := primary.CAS(key, func(in interface{}) (interface{}, bool, error) {
+		out, retry, err := f(in)
+		result = out
+		return out, retry, err
+	})
+	if err != nil || mirror == nil {
+		return err
+	}
+
+	multiMirrorWrites.Inc()
+	buf, err := c.codec.Encode(result)
+	if err == nil {
+		err = mirror.PutBytes(key, buf)
+	}
+	if err != nil {
+		multiMirrorWriteErrors.Inc()
+		log.Warnf("Error mirroring %s to secondary KV store: %v", key, err)
+	}
+	return nil
+}
+
+// WatchPrefix implements ConsulClient.
+func (c *multiClient) WatchPrefix(prefix string, done <-chan struct{}, f func(string, interface{}) bool) {
+	c.watch(done, func(store ConsulClient, run *watchRun) bool {
+		more := true
+		store.WatchPrefix(prefix, run.stop, func(key string, value interface{}) bool {
+			return run.call(func() bool {
+				more = f(key, value)
+				return more
+			})
+		})
+		return more
+	})
+}
+
+// WatchKey implements ConsulClient.
+func (c *multiClient) WatchKey(key string, done <-chan struct{}, f func(interface{}) bool) {
+	c.watch(done, func(store ConsulClient, run *watchRun) bool {
+		more := true
+		store.WatchKey(key, run.stop, func(value interface{}) bool {
+			return run.call(func() bool {
+				more = f(value)
+				return more
+			})
+		})
+		return more
+	})
+}
+
+// watch runs watch against the primary store until done is closed or
+// watch's callback returns false, restarting it when the primary changes.
+// A watch can take a long poll to notice it's stopped, so we don't wait for
+// it, and drop anything it sees in the meantime.
+func (c *multiClient) watch(done <-chan struct{}, watch func(store ConsulClient, run *watchRun) bool) {
+	for {
+		primary, _, switched := c.current()
+		run := &watchRun{stop: make(chan struct{})}
+		result := make(chan bool, 1)
+		go func() {
+			result <- watch(primary, run)
+		}()
+
+		select {
+		case more := <-result:
+			run.close()
+			if !more {
+				return
+			}
+		case <-switched:
+			run.close()
+		case <-done:
+			run.close()
+			return
+		}
+	}
+}
+
+// watchRun is one run of a watch against one store.
+type watchRun struct {
+	stop    chan struct{}
+	mtx     sync.Mutex
+	stopped bool
+}
+
+// call calls f, unless the run has been stopped.
+func (w *watchRun) call(f func() bool) bool {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.stopped {
+		return false
+	}
+	return f()
+}
+
+func (w *watchRun) close() {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if !w.stopped {
+		w.stopped = true
+		close(w.stop)
+	}
+}
+
+// PutBytes implements ConsulClient, writing to both stores.
+func (c *multiClient) PutBytes(key string, buf []byte) error {
+	primary, mirror, _ := c.current()
+	if err := primary.PutBytes(key, buf); err != nil {
+		return err
+	}
+	if mirror != nil {
+		multiMirrorWrites.Inc()
+		if err := mirror.PutBytes(key, buf); err != nil {
+			multiMirrorWriteErrors.Inc()
+			log.Warnf("Error mirroring %s to secondary KV store: %v", key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package ring
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMultiClient(t *testing.T) {
+	codec := ProtoCodec{Factory: ProtoDescFactory}
+	primary, secondary := newMockConsulClient(), newMockConsulClient()
+	client, err := NewMultiClient(MultiConfig{MirrorEnabled: true}, primary, secondary, codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	multi := client.(*multiClient)
+
+	// CASs go to the primary, and are mirrored to the secondary.
+	addIngester := func(id string) {
+		err := client.CAS(consulKey, func(in interface{}) (interface{}, bool, error) {
+			desc, _ := in.(*Desc)
+			if desc == nil {
+				desc = newDesc()
+			}
+			desc.addIngester(id, id, "", nil, ACTIVE)
+			return desc, true, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	addIngester("a")
+	for _, store := range []ConsulClient{primary, secondary} {
+		poll(t, time.Second, []string{"a"}, func() interface{} {
+			return ingesterIDs(t, store)
+		})
+	}
+
+	watched := make(chan []string, 10)
+	done := make(chan struct{})
+	defer close(done)
+	go client.WatchKey(consulKey, done, func(value interface{}) bool {
+		watched <- descIngesterIDs(value.(*Desc))
+		return true
+	})
+	expectWatched(t, watched, []string{"a"})
+
+	// Switching the primary restarts watches on the new one, and sends
+	// writes there first.
+	put(t, secondary, "b")
+	multi.setPrimary(secondaryStore, true)
+	expectWatched(t, watched, []string{"b"})
+	addIngester("c")
+	expectWatched(t, watched, []string{"b", "c"})
+	poll(t, time.Second, []string{"b", "c"}, func() interface{} {
+		return ingesterIDs(t, primary)
+	})
+
+	// Without mirroring, writes no longer reach the other store.
+	multi.setPrimary(secondaryStore, false)
+	addIngester("d")
+	expectWatched(t, watched, []string{"b", "c", "d"})
+	if want, have := []string{"b", "c"}, ingesterIDs(t, primary); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%v != %v", want, have)
+	}
+}
+
+func TestMultiClientRuntimeConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "multi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("primary: secondary\nmirror_enabled: false\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	codec := ProtoCodec{Factory: ProtoDescFactory}
+	primary, secondary := newMockConsulClient(), newMockConsulClient()
+	client, err := NewMultiClient(MultiConfig{MirrorEnabled: true, RuntimeConfigFile: f.Name()}, primary, secondary, codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, mirror, _ := client.(*multiClient).current()
+	if current != secondary || mirror != nil {
+		t.Fatalf("expected the secondary without mirroring, got %v, %v", current, mirror)
+	}
+
+	if err := ioutil.WriteFile(f.Name(), []byte("primary: tertiary\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMultiClient(MultiConfig{RuntimeConfigFile: f.Name()}, primary, secondary, codec); err == nil {
+		t.Fatal("expected an error for an invalid primary store")
+	}
+}
+
+func put(t *testing.T, store ConsulClient, ids ...string) {
+	desc := newDesc()
+	for _, id := range ids {
+		desc.addIngester(id, id, "", nil, ACTIVE)
+	}
+	buf, err := ProtoCodec{}.Encode(desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutBytes(consulKey, buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func ingesterIDs(t *testing.T, store ConsulClient) []string {
+	var ids []string
+	err := store.CAS(consulKey, func(in interface{}) (interface{}, bool, error) {
+		desc, _ := in.(*Desc)
+		if desc == nil {
+			desc = newDesc()
+		}
+		ids = descIngesterIDs(desc)
+		return desc, false, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func descIngesterIDs(desc *Desc) []string {
+	ids := []string{}
+	for id := range desc.Ingesters {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func expectWatched(t *testing.T, watched <-chan []string, want []string) {
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case have := <-watched:
+			if reflect.DeepEqual(want, have) {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("didn't see %v", want)
+		}
+	}
+}
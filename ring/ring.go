@@ -5,6 +5,7 @@ package ring
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"math"
 	"sort"
 	"sync"
@@ -39,25 +40,42 @@ var ErrEmptyRing = errors.New("empty circle")
 // Config for a Ring
 type Config struct {
 	ConsulConfig
+	Multi MultiConfig
 
 	HeartbeatTimeout time.Duration
+	SyncTimeout      time.Duration
+
+	// The Consul key the ring is kept in; the ingesters' ring if empty.
+	Key string
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
 func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	cfg.ConsulConfig.RegisterFlags(f)
+	cfg.Multi.RegisterFlags(f)
 
 	f.DurationVar(&cfg.HeartbeatTimeout, "ring.heartbeat-timeout", time.Minute, "The heartbeat timeout after which ingesters are skipped for reads/writes.")
+	f.DurationVar(&cfg.SyncTimeout, "ring.sync-timeout", time.Minute, "How long to wait on start for the ring to be read from Consul, before giving up (0 to wait forever).")
 }
 
 // Ring holds the information about the members of the consistent hash circle.
+// It watches the ring in Consul, so lookups never go to Consul, and keep
+// being served from the last ring seen while Consul is unavailable.
 type Ring struct {
 	consul           ConsulClient
+	key              string
 	quit, done       chan struct{}
 	heartbeatTimeout time.Duration
+	syncTimeout      time.Duration
+
+	// Closed once the ring has first been read from Consul.
+	synced   chan struct{}
+	syncOnce sync.Once
 
 	mtx      sync.RWMutex
 	ringDesc *Desc
+	watchers map[int]func(*Snapshot)
+	nextID   int
 
 	ingesterOwnershipDesc *prometheus.Desc
 	numIngestersDesc      *prometheus.Desc
@@ -71,12 +89,29 @@ func New(cfg Config) (*Ring, error) {
 	if err != nil {
 		return nil, err
 	}
+	if cfg.Multi.Enabled {
+		secondary, err := NewConsulClient(cfg.Multi.Secondary, codec)
+		if err != nil {
+			return nil, err
+		}
+		if consul, err = NewMultiClient(cfg.Multi, consul, secondary, codec); err != nil {
+			return nil, err
+		}
+	}
+	key := cfg.Key
+	if key == "" {
+		key = consulKey
+	}
 	r := &Ring{
 		consul:           consul,
+		key:              key,
 		heartbeatTimeout: cfg.HeartbeatTimeout,
+		syncTimeout:      cfg.SyncTimeout,
 		quit:             make(chan struct{}),
 		done:             make(chan struct{}),
+		synced:           make(chan struct{}),
 		ringDesc:         &Desc{},
+		watchers:         map[int]func(*Snapshot){},
 		ingesterOwnershipDesc: prometheus.NewDesc(
 			"cortex_ring_ingester_ownership_percent",
 			"The percent ownership of the ring by ingester",
@@ -105,36 +140,122 @@ func (r *Ring) Stop() {
 
 func (r *Ring) loop() {
 	defer close(r.done)
-	r.consul.WatchKey(consulKey, r.quit, func(value interface{}) bool {
+	r.consul.WatchKey(r.key, r.quit, func(value interface{}) bool {
+		defer r.syncOnce.Do(func() { close(r.synced) })
 		if value == nil {
 			log.Infof("Ring doesn't exist in consul yet.")
 			return true
 		}
 
-		ringDesc := value.(*Desc)
-		r.mtx.Lock()
-		defer r.mtx.Unlock()
-		r.ringDesc = ringDesc
+		r.update(value.(*Desc))
 		return true
 	})
 }
 
-// Get returns n (or more) ingesters which form the replicas for the given key.
-func (r *Ring) Get(key uint32, n int, op Operation) ([]*IngesterDesc, error) {
+// WaitSynced waits until the ring has been read from Consul, failing if it
+// isn't within the sync timeout, or the ring is stopped first.
+func (r *Ring) WaitSynced() error {
+	var timeout <-chan time.Time
+	if r.syncTimeout > 0 {
+		timer := time.NewTimer(r.syncTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-r.synced:
+		return nil
+	case <-r.done:
+		return fmt.Errorf("ring %s stopped before it was read from Consul", r.key)
+	case <-timeout:
+		return fmt.Errorf("timed out after %v reading ring %s from Consul", r.syncTimeout, r.key)
+	}
+}
+
+// update replaces the ring, and tells the watchers.  Descs are never
+// modified once decoded, so snapshots can share them.
+func (r *Ring) update(ringDesc *Desc) {
+	r.mtx.Lock()
+	r.ringDesc = ringDesc
+	watchers := make([]func(*Snapshot), 0, len(r.watchers))
+	for _, f := range r.watchers {
+		watchers = append(watchers, f)
+	}
+	r.mtx.Unlock()
+
+	snapshot := r.newSnapshot(ringDesc)
+	for _, f := range watchers {
+		f(snapshot)
+	}
+}
+
+// Watch calls f with a snapshot of the ring whenever it changes, on the
+// goroutine watching Consul, until the returned function is called.
+func (r *Ring) Watch(f func(*Snapshot)) (stop func()) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	id := r.nextID
+	r.nextID++
+	r.watchers[id] = f
+	return func() {
+		r.mtx.Lock()
+		defer r.mtx.Unlock()
+		delete(r.watchers, id)
+	}
+}
+
+// Snapshot returns the current ring, which won't change under the caller,
+// so several lookups can be made against the same ring.
+func (r *Ring) Snapshot() *Snapshot {
 	r.mtx.RLock()
 	defer r.mtx.RUnlock()
-	return r.getInternal(key, n, op)
+	return r.newSnapshot(r.ringDesc)
+}
+
+func (r *Ring) newSnapshot(ringDesc *Desc) *Snapshot {
+	return &Snapshot{
+		ringDesc:         ringDesc,
+		heartbeatTimeout: r.heartbeatTimeout,
+	}
+}
+
+// Get returns n (or more) ingesters which form the replicas for the given key.
+func (r *Ring) Get(key uint32, n int, op Operation) ([]*IngesterDesc, error) {
+	return r.Snapshot().Get(key, n, op)
 }
 
 // BatchGet returns n (or more) ingesters which form the replicas for the given key.
 // The order of the result matches the order of the input.
 func (r *Ring) BatchGet(keys []uint32, n int, op Operation) ([][]*IngesterDesc, error) {
-	r.mtx.RLock()
-	defer r.mtx.RUnlock()
+	return r.Snapshot().BatchGet(keys, n, op)
+}
+
+// GetAll returns all available ingesters in the circle.
+func (r *Ring) GetAll() []*IngesterDesc {
+	return r.Snapshot().GetAll()
+}
+
+// Ready is true when all ingesters are active and healthy.
+func (r *Ring) Ready() bool {
+	return r.Snapshot().Ready()
+}
+
+// Snapshot is an unchanging view of the ring.
+type Snapshot struct {
+	ringDesc         *Desc
+	heartbeatTimeout time.Duration
+}
+
+// Get returns n (or more) ingesters which form the replicas for the given key.
+func (s *Snapshot) Get(key uint32, n int, op Operation) ([]*IngesterDesc, error) {
+	return s.getInternal(key, n, op)
+}
 
+// BatchGet returns n (or more) ingesters which form the replicas for the given key.
+// The order of the result matches the order of the input.
+func (s *Snapshot) BatchGet(keys []uint32, n int, op Operation) ([][]*IngesterDesc, error) {
 	result := make([][]*IngesterDesc, len(keys), len(keys))
 	for i, key := range keys {
-		ingesters, err := r.getInternal(key, n, op)
+		ingesters, err := s.getInternal(key, n, op)
 		if err != nil {
 			return nil, err
 		}
@@ -143,27 +264,27 @@ func (r *Ring) BatchGet(keys []uint32, n int, op Operation) ([][]*IngesterDesc,
 	return result, nil
 }
 
-func (r *Ring) getInternal(key uint32, n int, op Operation) ([]*IngesterDesc, error) {
-	if r.ringDesc == nil || len(r.ringDesc.Tokens) == 0 {
+func (s *Snapshot) getInternal(key uint32, n int, op Operation) ([]*IngesterDesc, error) {
+	if s.ringDesc == nil || len(s.ringDesc.Tokens) == 0 {
 		return nil, ErrEmptyRing
 	}
 
 	ingesters := make([]*IngesterDesc, 0, n)
 	distinctHosts := map[string]struct{}{}
-	start := r.search(key)
+	start := s.search(key)
 	iterations := 0
-	for i := start; len(distinctHosts) < n && iterations < len(r.ringDesc.Tokens); i++ {
+	for i := start; len(distinctHosts) < n && iterations < len(s.ringDesc.Tokens); i++ {
 		iterations++
 		// Wrap i around in the ring.
-		i %= len(r.ringDesc.Tokens)
+		i %= len(s.ringDesc.Tokens)
 
 		// We want n *distinct* ingesters.
-		token := r.ringDesc.Tokens[i]
+		token := s.ringDesc.Tokens[i]
 		if _, ok := distinctHosts[token.Ingester]; ok {
 			continue
 		}
 		distinctHosts[token.Ingester] = struct{}{}
-		ingester := r.ringDesc.Ingesters[token.Ingester]
+		ingester := s.ringDesc.Ingesters[token.Ingester]
 
 		// Ingesters that are Leaving do not count to the replication limit. We do
 		// not want to Write to them because they are about to go away, but we do
@@ -184,17 +305,14 @@ func (r *Ring) getInternal(key uint32, n int, op Operation) ([]*IngesterDesc, er
 }
 
 // GetAll returns all available ingesters in the circle.
-func (r *Ring) GetAll() []*IngesterDesc {
-	r.mtx.RLock()
-	defer r.mtx.RUnlock()
-
-	if r.ringDesc == nil {
+func (s *Snapshot) GetAll() []*IngesterDesc {
+	if s.ringDesc == nil {
 		return nil
 	}
 
-	ingesters := make([]*IngesterDesc, 0, len(r.ringDesc.Ingesters))
-	for _, ingester := range r.ringDesc.Ingesters {
-		if time.Now().Sub(time.Unix(ingester.Timestamp, 0)) > r.heartbeatTimeout {
+	ingesters := make([]*IngesterDesc, 0, len(s.ringDesc.Ingesters))
+	for _, ingester := range s.ringDesc.Ingesters {
+		if time.Now().Sub(time.Unix(ingester.Timestamp, 0)) > s.heartbeatTimeout {
 			continue
 		}
 		ingesters = append(ingesters, ingester)
@@ -203,30 +321,76 @@ func (r *Ring) GetAll() []*IngesterDesc {
 }
 
 // Ready is true when all ingesters are active and healthy.
-func (r *Ring) Ready() bool {
-	r.mtx.RLock()
-	defer r.mtx.RUnlock()
-
-	if r.ringDesc == nil {
+func (s *Snapshot) Ready() bool {
+	if s.ringDesc == nil {
 		return false
 	}
 
-	for _, ingester := range r.ringDesc.Ingesters {
-		if time.Now().Sub(time.Unix(ingester.Timestamp, 0)) > r.heartbeatTimeout {
+	for _, ingester := range s.ringDesc.Ingesters {
+		if time.Now().Sub(time.Unix(ingester.Timestamp, 0)) > s.heartbeatTimeout {
 			return false
 		} else if ingester.State != ACTIVE {
 			return false
 		}
 	}
 
-	return len(r.ringDesc.Tokens) > 0
+	return len(s.ringDesc.Tokens) > 0
+}
+
+// ActiveCount returns the number of active, healthy members of the ring.
+func (r *Ring) ActiveCount() int {
+	return r.Snapshot().ActiveCount()
+}
+
+// ActiveCount returns the number of active, healthy members of the ring.
+func (s *Snapshot) ActiveCount() int {
+	if s.ringDesc == nil {
+		return 0
+	}
+	count := 0
+	for _, ingester := range s.ringDesc.Ingesters {
+		if ingester.State == ACTIVE && time.Now().Sub(time.Unix(ingester.Timestamp, 0)) <= s.heartbeatTimeout {
+			count++
+		}
+	}
+	return count
+}
+
+// SafeToRestart returns nil if the ingester id can be restarted without
+// writes or reads failing: the ring has it, no other ingester is leaving or
+// unhealthy, and there are enough other active ingesters to take its
+// replicas in the meantime.  Otherwise it returns why not.
+func (s *Snapshot) SafeToRestart(id string, replicationFactor int) error {
+	if s.ringDesc == nil {
+		return ErrEmptyRing
+	}
+	if _, ok := s.ringDesc.Ingesters[id]; !ok {
+		return fmt.Errorf("ingester %s is not in the ring", id)
+	}
+	active := 0
+	for otherID, ingester := range s.ringDesc.Ingesters {
+		if otherID == id {
+			continue
+		}
+		switch {
+		case time.Now().Sub(time.Unix(ingester.Timestamp, 0)) > s.heartbeatTimeout:
+			return fmt.Errorf("ingester %s is unhealthy", otherID)
+		case ingester.State != ACTIVE:
+			return fmt.Errorf("ingester %s is %s", otherID, ingester.State)
+		}
+		active++
+	}
+	if active < replicationFactor {
+		return fmt.Errorf("only %d other active ingesters, fewer than the replication factor of %d", active, replicationFactor)
+	}
+	return nil
 }
 
-func (r *Ring) search(key uint32) int {
-	i := sort.Search(len(r.ringDesc.Tokens), func(x int) bool {
-		return r.ringDesc.Tokens[x].Token > key
+func (s *Snapshot) search(key uint32) int {
+	i := sort.Search(len(s.ringDesc.Tokens), func(x int) bool {
+		return s.ringDesc.Tokens[x].Token > key
 	})
-	if i >= len(r.ringDesc.Tokens) {
+	if i >= len(s.ringDesc.Tokens) {
 		i = 0
 	}
 	return i
@@ -2,7 +2,10 @@ package ring
 
 import (
 	"fmt"
+	"reflect"
+	"sort"
 	"testing"
+	"time"
 )
 
 const (
@@ -17,7 +20,7 @@ func BenchmarkRing(b *testing.B) {
 	for i := 0; i < numIngester; i++ {
 		tokens := generateTokens(numTokens, takenTokens)
 		takenTokens = append(takenTokens, tokens...)
-		desc.addIngester(fmt.Sprintf("%d", i), fmt.Sprintf("ingester%d", i), tokens, ACTIVE)
+		desc.addIngester(fmt.Sprintf("%d", i), fmt.Sprintf("ingester%d", i), "", tokens, ACTIVE)
 	}
 
 	consul := newMockConsulClient()
@@ -43,3 +46,158 @@ func BenchmarkRing(b *testing.B) {
 		r.BatchGet(keys, 3, Write)
 	}
 }
+
+func TestRingWatch(t *testing.T) {
+	consul := newMockConsulClient()
+	put := func(ids ...string) {
+		desc := newDesc()
+		for i, id := range ids {
+			desc.addIngester(id, id, "", []uint32{uint32(i)}, ACTIVE)
+		}
+		ringBytes, err := ProtoCodec{}.Encode(desc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		consul.PutBytes(consulKey, ringBytes)
+	}
+	addrs := func(s *Snapshot) []string {
+		result := []string{}
+		for _, ing := range s.GetAll() {
+			result = append(result, ing.Addr)
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	put("a", "b")
+	r, err := New(Config{
+		ConsulConfig: ConsulConfig{
+			mock: consul,
+		},
+		HeartbeatTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	poll(t, time.Second, []string{"a", "b"}, func() interface{} {
+		return addrs(r.Snapshot())
+	})
+	first := r.Snapshot()
+
+	snapshots := make(chan *Snapshot, 10)
+	stop := r.Watch(func(s *Snapshot) { snapshots <- s })
+	put("a")
+	select {
+	case s := <-snapshots:
+		if want, have := []string{"a"}, addrs(s); !reflect.DeepEqual(want, have) {
+			t.Fatalf("%v != %v", want, have)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no notification of ring change")
+	}
+	// Earlier snapshots don't change.
+	if want, have := []string{"a", "b"}, addrs(first); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%v != %v", want, have)
+	}
+
+	stop()
+	put("c")
+	poll(t, time.Second, []string{"c"}, func() interface{} {
+		return addrs(r.Snapshot())
+	})
+	select {
+	case <-snapshots:
+		t.Fatal("notified after stopping watch")
+	default:
+	}
+}
+
+// unreachableConsul never returns the ring.
+type unreachableConsul struct {
+	ConsulClient
+}
+
+func (unreachableConsul) WatchKey(key string, done <-chan struct{}, f func(interface{}) bool) {
+	<-done
+}
+
+func TestRingWaitSynced(t *testing.T) {
+	consul := newMockConsulClient()
+	ringBytes, err := ProtoCodec{}.Encode(newDesc())
+	if err != nil {
+		t.Fatal(err)
+	}
+	consul.PutBytes(consulKey, ringBytes)
+	r, err := New(Config{
+		ConsulConfig: ConsulConfig{
+			mock: consul,
+		},
+		SyncTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.WaitSynced(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = New(Config{
+		ConsulConfig: ConsulConfig{
+			mock: unreachableConsul{},
+		},
+		SyncTimeout: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	if err := r.WaitSynced(); err == nil {
+		t.Fatal("expected a timeout reading the ring")
+	}
+}
+
+func TestSafeToRestart(t *testing.T) {
+	desc := newDesc()
+	for i, id := range []string{"a", "b", "c", "d"} {
+		desc.addIngester(id, id, "", []uint32{uint32(i)}, ACTIVE)
+	}
+	snapshot := func() *Snapshot { return &Snapshot{ringDesc: desc, heartbeatTimeout: time.Minute} }
+
+	if err := snapshot().SafeToRestart("a", 3); err != nil {
+		t.Fatalf("expected a to be safe to restart: %v", err)
+	}
+	if err := snapshot().SafeToRestart("a", 4); err == nil {
+		t.Fatal("expected too few other ingesters for the replication factor")
+	}
+	if err := snapshot().SafeToRestart("e", 3); err == nil {
+		t.Fatal("expected an error for an unknown ingester")
+	}
+
+	desc.Ingesters["b"].State = LEAVING
+	if err := snapshot().SafeToRestart("a", 2); err == nil {
+		t.Fatal("expected another ingester leaving to be unsafe")
+	}
+	// The ingester's own state doesn't matter.
+	if err := snapshot().SafeToRestart("b", 3); err != nil {
+		t.Fatalf("expected b to be safe to restart: %v", err)
+	}
+
+	desc.Ingesters["b"].State = ACTIVE
+	desc.Ingesters["c"].Timestamp = time.Now().Add(-time.Hour).Unix()
+	if err := snapshot().SafeToRestart("a", 2); err == nil {
+		t.Fatal("expected another ingester being unhealthy to be unsafe")
+	}
+}
+
+func TestActiveCount(t *testing.T) {
+	desc := newDesc()
+	for _, id := range []string{"a", "b", "c"} {
+		desc.addIngester(id, id, "", nil, ACTIVE)
+	}
+	desc.Ingesters["b"].State = LEAVING
+	desc.Ingesters["c"].Timestamp = time.Now().Add(-time.Hour).Unix()
+	snapshot := &Snapshot{ringDesc: desc, heartbeatTimeout: time.Minute}
+	if count := snapshot.ActiveCount(); count != 1 {
+		t.Fatalf("expected 1 active member, got %d", count)
+	}
+}
@@ -0,0 +1,124 @@
+package ruler
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/rules"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// alertForStateMetricName is the series recording when each active alert
+// became active, as in later versions of Prometheus.
+const alertForStateMetricName = "ALERTS_FOR_STATE"
+
+// persistAlertState writes an ALERTS_FOR_STATE sample for every active
+// alert, valued with the (Unix) time it became active, so its state can be
+// restored by another ruler.
+func (r *Ruler) persistAlertState(ctx context.Context, rs []rules.Rule, now model.Time) {
+	var samples []model.Sample
+	for _, rule := range rs {
+		alertingRule, ok := rule.(*rules.AlertingRule)
+		if !ok {
+			continue
+		}
+		for _, alert := range alertingRule.ActiveAlerts() {
+			metric := model.Metric(alert.Labels.Clone())
+			metric[model.MetricNameLabel] = alertForStateMetricName
+			samples = append(samples, model.Sample{
+				Metric:    metric,
+				Timestamp: now,
+				Value:     model.SampleValue(alert.ActiveAt.Unix()),
+			})
+		}
+	}
+	if len(samples) == 0 {
+		return
+	}
+	if _, err := r.pusher.Push(ctx, util.ToWriteRequest(samples)); err != nil {
+		log.Warnf("Error persisting alert state: %v", err)
+	}
+}
+
+// restoreAlertState restores the state of alerting rules this ruler hasn't
+// evaluated before, from the ALERTS_FOR_STATE series written within the
+// outage tolerance, so their for clauses needn't start again.  The rules
+// keep no state we can set, so instead they're evaluated at each time their
+// alerts became active, oldest first: the alerts which were active then, and
+// still are, keep those times.
+func (r *Ruler) restoreAlertState(ctx context.Context, rs []rules.Rule, now model.Time) {
+	if r.forOutageTolerance <= 0 {
+		return
+	}
+	for _, rule := range rs {
+		alertingRule, ok := rule.(*rules.AlertingRule)
+		if !ok || !r.markRestored(alertingRule) {
+			continue
+		}
+
+		query, err := r.engine.NewInstantQuery(fmt.Sprintf("max_over_time(%s{%s=%q}[%s])",
+			alertForStateMetricName, model.AlertNameLabel, alertingRule.Name(), model.Duration(r.forOutageTolerance)), now)
+		if err != nil {
+			log.Warnf("Error restoring state of alert %s: %v", alertingRule.Name(), err)
+			continue
+		}
+		vector, err := query.Exec(ctx).Vector()
+		if err != nil {
+			log.Warnf("Error restoring state of alert %s: %v", alertingRule.Name(), err)
+			continue
+		}
+
+		activeAts := map[model.Time]struct{}{}
+		for _, sample := range vector {
+			if activeAt := model.TimeFromUnix(int64(sample.Value)); activeAt.Before(now) {
+				activeAts[activeAt] = struct{}{}
+			}
+		}
+		times := make([]model.Time, 0, len(activeAts))
+		for activeAt := range activeAts {
+			times = append(times, activeAt)
+		}
+		sort.Sort(timesAscending(times))
+
+		for _, activeAt := range times {
+			if _, err := alertingRule.Eval(ctx, activeAt, r.engine, r.alertURL.Path); err != nil {
+				log.Warnf("Error restoring state of alert %s: %v", alertingRule.Name(), err)
+				break
+			}
+		}
+	}
+}
+
+// markRestored returns whether rule is yet to have its state restored,
+// marking it as restored.
+func (r *Ruler) markRestored(rule *rules.AlertingRule) bool {
+	r.restoredMtx.Lock()
+	defer r.restoredMtx.Unlock()
+	if _, ok := r.restored[rule]; ok {
+		return false
+	}
+	r.restored[rule] = struct{}{}
+	return true
+}
+
+// forgetRestored forgets that rules have had their state restored, as
+// they've been replaced, so aren't evaluated any more.
+func (r *Ruler) forgetRestored(rs []rules.Rule) {
+	r.restoredMtx.Lock()
+	defer r.restoredMtx.Unlock()
+	for _, rule := range rs {
+		if alertingRule, ok := rule.(*rules.AlertingRule); ok {
+			delete(r.restored, alertingRule)
+		}
+	}
+}
+
+type timesAscending []model.Time
+
+func (t timesAscending) Len() int           { return len(t) }
+func (t timesAscending) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t timesAscending) Less(i, j int) bool { return t[i].Before(t[j]) }
@@ -1,11 +1,17 @@
 package ruler
 
 import (
+	"time"
+
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
 	"golang.org/x/net/context"
 
+	"github.com/weaveworks/common/user"
 	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/querier"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/validation"
 )
 
 // Pusher is an ingester server that accepts pushes.
@@ -32,3 +38,40 @@ func (a appenderAdapter) Append(sample *model.Sample) error {
 func (a appenderAdapter) NeedsThrottling() bool {
 	return false
 }
+
+// delayedQuerier queries data as of the user's evaluation delay ago, shifting
+// it forward so rules see it as current, to allow for samples arriving late.
+type delayedQuerier struct {
+	querier.Querier
+	limits *validation.Overrides
+}
+
+func (q delayedQuerier) delay(ctx context.Context) time.Duration {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return 0
+	}
+	return q.limits.RulerEvaluationDelay(userID)
+}
+
+func (q delayedQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	delay := q.delay(ctx)
+	if delay == 0 {
+		return q.Querier.Query(ctx, from, to, matchers...)
+	}
+	matrix, err := q.Querier.Query(ctx, from.Add(-delay), to.Add(-delay), matchers...)
+	if err != nil {
+		return nil, err
+	}
+	for _, ss := range matrix {
+		for i := range ss.Values {
+			ss.Values[i].Timestamp = ss.Values[i].Timestamp.Add(delay)
+		}
+	}
+	return matrix, nil
+}
+
+func (q delayedQuerier) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
+	delay := q.delay(ctx)
+	return q.Querier.MetricsForLabelMatchers(ctx, from.Add(-delay), through.Add(-delay), matcherSets...)
+}
@@ -0,0 +1,59 @@
+package ruler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util/validation"
+)
+
+type recordingQuerier struct {
+	from, to model.Time
+}
+
+func (q *recordingQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	q.from, q.to = from, to
+	return model.Matrix{&model.SampleStream{
+		Values: []model.SamplePair{{Timestamp: to, Value: 1}},
+	}}, nil
+}
+
+func (q *recordingQuerier) LabelValuesForLabelName(context.Context, model.LabelName) (model.LabelValues, error) {
+	return nil, nil
+}
+
+func (q *recordingQuerier) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
+	q.from, q.to = from, through
+	return nil, nil
+}
+
+func TestDelayedQuerier(t *testing.T) {
+	limits, err := validation.NewOverrides(validation.OverridesConfig{}, validation.Limits{
+		RulerEvaluationDelay: time.Minute,
+	})
+	require.NoError(t, err)
+	defer limits.Stop()
+
+	inner := &recordingQuerier{}
+	q := delayedQuerier{Querier: inner, limits: limits}
+	ctx := user.Inject(context.Background(), "user")
+	now := model.Now()
+
+	matrix, err := q.Query(ctx, now.Add(-time.Hour), now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(-time.Hour-time.Minute), inner.from)
+	assert.Equal(t, now.Add(-time.Minute), inner.to)
+	assert.Equal(t, now, matrix[0].Values[0].Timestamp)
+
+	_, err = q.MetricsForLabelMatchers(ctx, now.Add(-time.Hour), now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(-time.Hour-time.Minute), inner.from)
+	assert.Equal(t, now.Add(-time.Minute), inner.to)
+}
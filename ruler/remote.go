@@ -0,0 +1,209 @@
+package ruler
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/rules"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/configs"
+	"github.com/weaveworks/cortex/ring"
+)
+
+var remoteEvaluations = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "ruler_remote_evaluations_total",
+	Help:      "The total number of rule groups offloaded to the remote evaluation pool, by status.",
+}, []string{"status"})
+
+func init() {
+	prometheus.MustRegister(remoteEvaluations)
+}
+
+// EvaluatorRingKey is the Consul key the ring of rulers evaluating rule
+// groups offloaded by others is kept in.
+const EvaluatorRingKey = "rule-evaluators"
+
+// EvaluatePath is where the pool's rulers serve EvaluateHandler, on their
+// internal evaluation listener.
+const EvaluatePath = "/api/prom/rules/evaluate"
+
+// Offloaded rules not evaluated for this many evaluation intervals are
+// forgotten, e.g. once their user has moved to another ruler in the pool.
+const offloadedIntervals = 10
+
+// EvaluatorRing is the ring of the pool of rule evaluators.
+type EvaluatorRing interface {
+	Get(key uint32, n int, op ring.Operation) ([]*ring.IngesterDesc, error)
+}
+
+// remoteEvaluator offloads the evaluation of heavy rule groups to a pool of
+// rulers serving EvaluateHandler, so rule evaluation can be scaled
+// separately from queries.  Each user's groups go to the ruler owning the
+// user in the pool's ring, so it keeps their alerts' state between
+// evaluations.
+type remoteEvaluator struct {
+	ring     EvaluatorRing
+	minRules int
+	client   *http.Client
+}
+
+// offloads returns whether rs should be evaluated remotely.  It's safe to
+// call on a nil remoteEvaluator, which offloads nothing.
+func (e *remoteEvaluator) offloads(rs []rules.Rule) bool {
+	return e != nil && len(rs) >= e.minRules
+}
+
+// evaluate has the pool evaluate rs, as the user in ctx.
+func (e *remoteEvaluator) evaluate(ctx context.Context, rs []rules.Rule) error {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return err
+	}
+	descs, err := e.ring.Get(userToken(userID), 1, ring.Read)
+	if err != nil {
+		return err
+	}
+	if len(descs) == 0 {
+		return fmt.Errorf("no rule evaluators in the ring")
+	}
+
+	var buf bytes.Buffer
+	for _, rule := range rs {
+		fmt.Fprintln(&buf, rule.String())
+	}
+	req, err := http.NewRequest("POST", "http://"+descs[0].Addr+EvaluatePath, &buf)
+	if err != nil {
+		return err
+	}
+	if err := user.InjectIntoHTTPRequest(ctx, req); err != nil {
+		return err
+	}
+	resp, err := ctxhttp.Do(ctx, e.client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("remote evaluation failed: %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// userToken returns the token of userID in the pool's ring.
+func userToken(userID string) uint32 {
+	h := fnv.New32()
+	h.Write([]byte(userID))
+	return h.Sum32()
+}
+
+// offloadedKey identifies a rules file a user has had evaluated by this
+// ruler.  A user can offload several groups, so they're cached by content.
+type offloadedKey struct {
+	userID  string
+	content string
+}
+
+// cachedRules are the rules parsed from a rules file offloaded to this
+// ruler, and when they were last evaluated.
+type cachedRules struct {
+	rules    []rules.Rule
+	lastUsed time.Time
+}
+
+// offloadedRules returns the rules parsed from content, reusing those parsed
+// for the user last time if it's unchanged, so alerts keep their state
+// between evaluations.  Rules not evaluated within offloadedTTL are
+// forgotten.
+func (r *Ruler) offloadedRules(userID, content string) ([]rules.Rule, error) {
+	r.offloadedMtx.Lock()
+	defer r.offloadedMtx.Unlock()
+	now := time.Now()
+	for key, cached := range r.offloaded {
+		if now.Sub(cached.lastUsed) > r.offloadedTTL {
+			delete(r.offloaded, key)
+			r.forgetRestored(cached.rules)
+		}
+	}
+
+	key := offloadedKey{userID, content}
+	if cached, ok := r.offloaded[key]; ok {
+		cached.lastUsed = now
+		return cached.rules, nil
+	}
+	rs, err := configs.CortexConfig{RulesFiles: map[string]string{"offloaded": content}}.GetRules()
+	if err != nil {
+		return nil, err
+	}
+	r.offloaded[key] = &cachedRules{rules: rs, lastUsed: now}
+	return rs, nil
+}
+
+// EvaluationServer serves EvaluateHandler on its own listener, which should
+// only be reachable by other rulers, as it trusts the user in each request.
+type EvaluationServer struct {
+	server *http.Server
+}
+
+// NewEvaluationServer starts serving r's EvaluateHandler on
+// cfg.RemoteEvaluationListenPort.
+func NewEvaluationServer(cfg Config, r *Ruler) (*EvaluationServer, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.RemoteEvaluationListenPort))
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(EvaluatePath, middleware.Merge(middleware.Log{}, middleware.AuthenticateUser).Wrap(http.HandlerFunc(r.EvaluateHandler)))
+	s := &EvaluationServer{server: &http.Server{Handler: mux}}
+	go s.server.Serve(listener)
+	return s, nil
+}
+
+// Stop stops serving.
+func (s *EvaluationServer) Stop() {
+	s.server.Close()
+}
+
+// EvaluateHandler evaluates the rule group posted to it, in the rules file
+// format, as if it were this ruler's own: writing the rules' output and
+// sending their notifications.  It serves rulers offloading heavy groups to
+// this one, and trusts the user in the request, so it must only be served
+// to them, by an EvaluationServer.
+func (r *Ruler) EvaluateHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := user.Extract(req.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(req.Body, maxRulesSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(content) > maxRulesSize {
+		http.Error(w, fmt.Sprintf("rules larger than %d bytes", maxRulesSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	rs, err := r.offloadedRules(userID, string(content))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := r.evaluateLocally(req.Context(), rs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
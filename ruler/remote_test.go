@@ -0,0 +1,119 @@
+package ruler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/rules"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/configs"
+	"github.com/weaveworks/cortex/querier"
+	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/util/validation"
+)
+
+type mockPusher struct {
+	mtx     sync.Mutex
+	samples map[string][]model.LabelValue
+}
+
+func (p *mockPusher) Push(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for _, ts := range req.Timeseries {
+		for _, l := range ts.Labels {
+			if string(l.Name) == model.MetricNameLabel {
+				p.samples[userID] = append(p.samples[userID], model.LabelValue(string(l.Value)))
+			}
+		}
+	}
+	return &cortex.WriteResponse{}, nil
+}
+
+// fixedEvaluatorRing is an EvaluatorRing of one ruler.
+type fixedEvaluatorRing string
+
+func (r fixedEvaluatorRing) Get(uint32, int, ring.Operation) ([]*ring.IngesterDesc, error) {
+	return []*ring.IngesterDesc{{Addr: string(r)}}, nil
+}
+
+func TestRemoteEvaluation(t *testing.T) {
+	limits, err := validation.NewOverrides(validation.OverridesConfig{}, validation.Limits{})
+	require.NoError(t, err)
+	pusher := &mockPusher{samples: map[string][]model.LabelValue{}}
+	pool := &Ruler{
+		engine:       promql.NewEngine(querier.Queryable{Q: querier.MergeQuerier{Queriers: []querier.Querier{&recordingQuerier{}}}}, nil),
+		pusher:       pusher,
+		alertURL:     &url.URL{},
+		notifierCfg:  &config.Config{},
+		limits:       limits,
+		notifiers:    map[string]*rulerNotifier{},
+		restored:     map[*rules.AlertingRule]struct{}{},
+		offloaded:    map[offloadedKey]*cachedRules{},
+		offloadedTTL: time.Hour,
+	}
+	defer pool.Stop()
+	server := httptest.NewServer(middleware.AuthenticateUser.Wrap(http.HandlerFunc(pool.EvaluateHandler)))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	r := &Ruler{
+		remote: &remoteEvaluator{ring: fixedEvaluatorRing(u.Host), minRules: 2, client: http.DefaultClient},
+	}
+	rs, err := configs.CortexConfig{RulesFiles: map[string]string{"rules": "always = vector(1)\nsometimes = vector(1)"}}.GetRules()
+	require.NoError(t, err)
+
+	// Heavy groups are evaluated, and their output written, by the pool.
+	assert.False(t, r.remote.offloads(rs[:1]))
+	require.True(t, r.remote.offloads(rs))
+	ctx := user.Inject(context.Background(), "1")
+	r.Evaluate(ctx, rs)
+	assert.Len(t, pusher.samples["1"], 2)
+	assert.Contains(t, pusher.samples["1"], model.LabelValue("always"))
+	assert.Contains(t, pusher.samples["1"], model.LabelValue("sometimes"))
+
+	// The pool keeps the rules it's given, while they're unchanged.
+	require.Len(t, pool.offloaded, 1)
+	var cached []rules.Rule
+	for _, c := range pool.offloaded {
+		cached = c.rules
+	}
+	r.Evaluate(ctx, rs)
+	require.Len(t, pool.offloaded, 1)
+	for _, c := range pool.offloaded {
+		assert.Equal(t, cached, c.rules)
+	}
+	assert.Len(t, pusher.samples["1"], 4)
+
+	// Each of a user's groups is kept, and forgotten once it's no longer
+	// evaluated.
+	other, err := configs.CortexConfig{RulesFiles: map[string]string{"rules": "often = vector(1)\nrarely = vector(1)"}}.GetRules()
+	require.NoError(t, err)
+	r.Evaluate(ctx, other)
+	assert.Len(t, pool.offloaded, 2)
+	pool.offloadedTTL = 0
+	time.Sleep(time.Millisecond)
+	r.Evaluate(ctx, other)
+	assert.Len(t, pool.offloaded, 1)
+
+	var none *remoteEvaluator
+	assert.False(t, none.offloads(rs))
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"sort"
 	"sync"
 	"time"
 
@@ -19,11 +20,11 @@ import (
 	"golang.org/x/net/context/ctxhttp"
 
 	"github.com/weaveworks/common/user"
-	"github.com/weaveworks/cortex/chunk"
 	"github.com/weaveworks/cortex/configs"
 	"github.com/weaveworks/cortex/distributor"
 	"github.com/weaveworks/cortex/querier"
 	"github.com/weaveworks/cortex/util"
+	"github.com/weaveworks/cortex/util/validation"
 )
 
 var (
@@ -37,6 +38,11 @@ var (
 		Name:      "rules_processed_total",
 		Help:      "How many rules have been processed.",
 	})
+	rulesDisabled = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "rules_disabled_total",
+		Help:      "How many rules haven't been processed, as they're disabled for their user.",
+	})
 	blockedWorkers = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "cortex",
 		Name:      "blocked_workers",
@@ -47,6 +53,7 @@ var (
 func init() {
 	prometheus.MustRegister(evalDuration)
 	prometheus.MustRegister(rulesProcessed)
+	prometheus.MustRegister(rulesDisabled)
 	prometheus.MustRegister(blockedWorkers)
 }
 
@@ -73,6 +80,26 @@ type Config struct {
 	NotificationQueueCapacity int
 	// HTTP timeout duration when sending notifications to the Alertmanager.
 	NotificationTimeout time.Duration
+
+	// The default of how far behind real time to evaluate rules, to allow
+	// for samples arriving late; see RulerEvaluationDelay.
+	Limits validation.Limits
+	// How long after a ruler restart alerts' state can still be restored.
+	ForOutageTolerance time.Duration
+
+	// Rulers with a RemoteEvaluationListenPort join the pool of rule
+	// evaluators; rule groups with at least RemoteEvaluationMinRules rules
+	// are offloaded to the pool.
+	RemoteEvaluationListenPort int
+	RemoteEvaluationNumTokens  int
+	RemoteEvaluationMinRules   int
+	RemoteEvaluationTimeout    time.Duration
+
+	// Set by the caller to offload rule groups: the ring of the pool.
+	RemoteEvaluationRing EvaluatorRing
+
+	// Not registered as flags: the ruler shares the distributor's overrides.
+	OverridesConfig validation.OverridesConfig
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
@@ -82,10 +109,16 @@ func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	f.Var(&cfg.ExternalURL, "ruler.external.url", "URL of alerts return path.")
 	f.DurationVar(&cfg.EvaluationInterval, "ruler.evaluation-interval", 15*time.Second, "How frequently to evaluate rules")
 	f.DurationVar(&cfg.ClientTimeout, "ruler.client-timeout", 5*time.Second, "Timeout for requests to Weave Cloud configs service.")
-	f.IntVar(&cfg.NumWorkers, "ruler.num-workers", 1, "Number of rule evaluator worker routines in this process")
+	f.IntVar(&cfg.NumWorkers, "ruler.num-workers", 1, "Number of rule evaluator worker routines in this process (0 to only evaluate rule groups offloaded by other rulers)")
 	f.StringVar(&cfg.AlertmanagerURL, "ruler.alertmanager-url", "", "URL of the Alertmanager to send notifications to.")
 	f.IntVar(&cfg.NotificationQueueCapacity, "ruler.notification-queue-capacity", 10000, "Capacity of the queue for notifications to be sent to the Alertmanager.")
 	f.DurationVar(&cfg.NotificationTimeout, "ruler.notification-timeout", 10*time.Second, "HTTP timeout duration when sending notifications to the Alertmanager.")
+	f.DurationVar(&cfg.ForOutageTolerance, "ruler.for-outage-tolerance", time.Hour, "Restore the state of alerts with a for clause which were active this recently, when the ruler restarts (0 to not restore it).")
+	cfg.Limits.RegisterRulerFlags(f)
+	f.IntVar(&cfg.RemoteEvaluationListenPort, "ruler.remote-evaluation.listen-port", 0, "Port to evaluate rule groups offloaded by other rulers on, joining the pool of rule evaluators (0 to not join it).  It must only be reachable by other rulers.")
+	f.IntVar(&cfg.RemoteEvaluationNumTokens, "ruler.remote-evaluation.num-tokens", 128, "Number of tokens for each ruler in the pool of rule evaluators' ring.")
+	f.IntVar(&cfg.RemoteEvaluationMinRules, "ruler.remote-evaluation.min-rules", 0, "Offload the evaluation of rule groups with at least this many rules to the pool of rule evaluators (0 to evaluate every group locally).")
+	f.DurationVar(&cfg.RemoteEvaluationTimeout, "ruler.remote-evaluation.timeout", time.Minute, "Timeout for offloaded rule group evaluations.")
 }
 
 // Ruler evaluates rules.
@@ -95,25 +128,72 @@ type Ruler struct {
 	alertURL      *url.URL
 	notifierCfg   *config.Config
 	queueCapacity int
+	limits        *validation.Overrides
+
+	forOutageTolerance time.Duration
+	restoredMtx        sync.Mutex
+	restored           map[*rules.AlertingRule]struct{}
+
+	// Where to offload heavy rule groups, if anywhere, and the rules other
+	// rulers have offloaded to this one, by user.
+	remote       *remoteEvaluator
+	offloadedMtx sync.Mutex
+	offloaded    map[offloadedKey]*cachedRules
+	offloadedTTL time.Duration
 
 	// Per-user notifiers with separate queues.
 	notifiersMtx sync.Mutex
-	notifiers    map[string]*notifier.Notifier
+	notifiers    map[string]*rulerNotifier
+}
+
+// rulerNotifier is a user's notifier, and the external labels it was last
+// configured with.
+type rulerNotifier struct {
+	*notifier.Notifier
+	externalLabels model.LabelSet
 }
 
 // NewRuler creates a new ruler from a distributor and chunk store.
-func NewRuler(cfg Config, d *distributor.Distributor, c *chunk.Store) (*Ruler, error) {
+func NewRuler(cfg Config, d *distributor.Distributor, c querier.ChunkStore) (*Ruler, error) {
 	ncfg, err := buildNotifierConfig(&cfg)
 	if err != nil {
 		return nil, err
 	}
+	limits, err := validation.NewOverrides(cfg.OverridesConfig, cfg.Limits)
+	if err != nil {
+		return nil, err
+	}
+	queryable := querier.Queryable{
+		Q: querier.MergeQuerier{
+			Queriers: []querier.Querier{
+				delayedQuerier{Querier: d, limits: limits},
+				delayedQuerier{Querier: &querier.ChunkQuerier{Store: c}, limits: limits},
+			},
+		},
+	}
+	var remote *remoteEvaluator
+	if cfg.RemoteEvaluationRing != nil && cfg.RemoteEvaluationMinRules > 0 {
+		remote = &remoteEvaluator{
+			ring:     cfg.RemoteEvaluationRing,
+			minRules: cfg.RemoteEvaluationMinRules,
+			client:   &http.Client{Timeout: cfg.RemoteEvaluationTimeout},
+		}
+	}
 	return &Ruler{
-		engine:        querier.NewEngine(d, c),
+		engine:        promql.NewEngine(queryable, nil),
 		pusher:        d,
 		alertURL:      cfg.ExternalURL.URL,
 		notifierCfg:   ncfg,
 		queueCapacity: cfg.NotificationQueueCapacity,
-		notifiers:     map[string]*notifier.Notifier{},
+		limits:        limits,
+		notifiers:     map[string]*rulerNotifier{},
+
+		forOutageTolerance: cfg.ForOutageTolerance,
+		restored:           map[*rules.AlertingRule]struct{}{},
+
+		remote:       remote,
+		offloaded:    map[offloadedKey]*cachedRules{},
+		offloadedTTL: offloadedIntervals * cfg.EvaluationInterval,
 	}, nil
 }
 
@@ -181,51 +261,67 @@ func (r *Ruler) newGroup(ctx context.Context, rs []rules.Rule) (*rules.Group, er
 		QueryEngine:    r.engine,
 		Context:        ctx,
 		ExternalURL:    r.alertURL,
-		Notifier:       notifier,
+		Notifier:       notifier.Notifier,
 	}
 	delay := 0 * time.Second // Unused, so 0 value is fine.
 	return rules.NewGroup("default", delay, rs, opts), nil
 }
 
-func (r *Ruler) getOrCreateNotifier(userID string) (*notifier.Notifier, error) {
+// getOrCreateNotifier returns the user's notifier, reconfiguring it if their
+// external labels have changed.
+func (r *Ruler) getOrCreateNotifier(userID string) (*rulerNotifier, error) {
+	externalLabels := r.limits.RulerExternalLabels(userID)
+
 	r.notifiersMtx.Lock()
 	defer r.notifiersMtx.Unlock()
 
 	n, ok := r.notifiers[userID]
-	if ok {
+	if ok && n.externalLabels.Equal(externalLabels) {
 		return n, nil
 	}
 
-	n = notifier.New(&notifier.Options{
-		QueueCapacity: r.queueCapacity,
-		Do: func(ctx context.Context, client *http.Client, req *http.Request) (*http.Response, error) {
-			if err := user.InjectIntoHTTPRequest(ctx, req); err != nil {
-				return nil, err
-			}
-			return ctxhttp.Do(ctx, client, req)
-		},
-	})
+	if !ok {
+		n = &rulerNotifier{
+			Notifier: notifier.New(&notifier.Options{
+				QueueCapacity: r.queueCapacity,
+				Do: func(ctx context.Context, client *http.Client, req *http.Request) (*http.Response, error) {
+					if err := user.InjectIntoHTTPRequest(ctx, req); err != nil {
+						return nil, err
+					}
+					return ctxhttp.Do(ctx, client, req)
+				},
+			}),
+		}
+		go n.Run()
+
+		// TODO: Remove notifiers for stale users. Right now this is a slow leak.
+		r.notifiers[userID] = n
+	}
 
 	// This should never fail, unless there's a programming mistake.
-	if err := n.ApplyConfig(r.notifierCfg); err != nil {
+	cfg := *r.notifierCfg
+	cfg.GlobalConfig.ExternalLabels = externalLabels
+	if err := n.ApplyConfig(&cfg); err != nil {
 		return nil, err
 	}
-	go n.Run()
-
-	// TODO: Remove notifiers for stale users. Right now this is a slow leak.
-	r.notifiers[userID] = n
+	n.externalLabels = externalLabels
 	return n, nil
 }
 
-// Evaluate a list of rules in the given context.
+// Evaluate a list of rules in the given context, offloading them to the
+// remote evaluation pool if they're heavy enough.
 func (r *Ruler) Evaluate(ctx context.Context, rs []rules.Rule) {
 	log.Debugf("Evaluating %d rules...", len(rs))
 	start := time.Now()
-	g, err := r.newGroup(ctx, rs)
-	if err != nil {
+	if r.remote.offloads(rs) {
+		if err := r.remote.evaluate(ctx, rs); err != nil {
+			log.Errorf("Failed to evaluate rule group remotely: %v", err)
+			remoteEvaluations.WithLabelValues("failure").Inc()
+		} else {
+			remoteEvaluations.WithLabelValues("success").Inc()
+		}
+	} else if err := r.evaluateLocally(ctx, rs); err != nil {
 		log.Errorf("Failed to create rule group: %v", err)
-	} else {
-		g.Eval()
 	}
 	// The prometheus routines we're calling have their own instrumentation
 	// but, a) it's rule-based, not group-based, b) it's a summary, not a
@@ -234,6 +330,36 @@ func (r *Ruler) Evaluate(ctx context.Context, rs []rules.Rule) {
 	rulesProcessed.Add(float64(len(rs)))
 }
 
+// enabledRules returns the user's rules in the namespaces not disabled for
+// them, in order of namespace, so a group is the same each time.
+func (r *Ruler) enabledRules(userID string, namespaces map[string][]rules.Rule) []rules.Rule {
+	names := make([]string, 0, len(namespaces))
+	for name, rs := range namespaces {
+		if r.limits.RulerNamespaceDisabled(userID, name) {
+			rulesDisabled.Add(float64(len(rs)))
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var result []rules.Rule
+	for _, name := range names {
+		result = append(result, namespaces[name]...)
+	}
+	return result
+}
+
+func (r *Ruler) evaluateLocally(ctx context.Context, rs []rules.Rule) error {
+	g, err := r.newGroup(ctx, rs)
+	if err != nil {
+		return err
+	}
+	r.restoreAlertState(ctx, rs, model.Now())
+	g.Eval()
+	r.persistAlertState(ctx, rs, model.Now())
+	return nil
+}
+
 // Stop stops the Ruler.
 func (r *Ruler) Stop() {
 	r.notifiersMtx.Lock()
@@ -242,6 +368,7 @@ func (r *Ruler) Stop() {
 	for _, n := range r.notifiers {
 		n.Stop()
 	}
+	r.limits.Stop()
 }
 
 // Server is a rules server.
@@ -258,6 +385,7 @@ func NewServer(cfg Config, ruler *Ruler) (*Server, error) {
 	}
 	// TODO: Separate configuration for polling interval.
 	s := newScheduler(c, cfg.EvaluationInterval, cfg.EvaluationInterval)
+	s.forget = ruler.forgetRestored
 	if cfg.NumWorkers <= 0 {
 		return nil, fmt.Errorf("must have at least 1 worker, got %d", cfg.NumWorkers)
 	}
@@ -331,7 +459,9 @@ func (w *worker) Run() {
 		}
 		log.Debugf("Processing %v", item)
 		ctx := user.Inject(context.Background(), item.userID)
-		w.ruler.Evaluate(ctx, item.rules)
+		if rs := w.ruler.enabledRules(item.userID, item.namespaces); len(rs) > 0 {
+			w.ruler.Evaluate(ctx, rs)
+		}
 		w.scheduler.workItemDone(*item)
 		log.Debugf("%v handed back to queue", item)
 	}
@@ -0,0 +1,52 @@
+package ruler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/rules"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/cortex/configs"
+	"github.com/weaveworks/cortex/util/validation"
+)
+
+func TestEnabledRules(t *testing.T) {
+	limits, err := validation.NewOverrides(validation.OverridesConfig{}, validation.Limits{
+		RulerDisabledNamespaces: []string{"disabled"},
+	})
+	require.NoError(t, err)
+	defer limits.Stop()
+	r := &Ruler{limits: limits}
+
+	namespaces, err := configs.CortexConfig{RulesFiles: map[string]string{
+		"b":        "b = vector(1)",
+		"a":        "a = vector(1)",
+		"disabled": "disabled = vector(1)",
+	}}.GetNamespacedRules()
+	require.NoError(t, err)
+	rs := r.enabledRules("user", namespaces)
+	require.Len(t, rs, 2)
+	assert.Equal(t, "a", rs[0].Name())
+	assert.Equal(t, "b", rs[1].Name())
+}
+
+func TestForgetRestoredOnReload(t *testing.T) {
+	r := &Ruler{restored: map[*rules.AlertingRule]struct{}{}}
+	s := newScheduler(configs.API{}, time.Minute, time.Minute)
+	s.forget = r.forgetRestored
+	config := func(rules string) map[string]configs.CortexConfigView {
+		return map[string]configs.CortexConfigView{"1": {Config: configs.CortexConfig{RulesFiles: map[string]string{"rules": rules}}}}
+	}
+
+	s.addNewConfigs(time.Now(), config("ALERT Down IF up == 0"))
+	alert := s.rules["1"]["rules"][0].(*rules.AlertingRule)
+	assert.True(t, r.markRestored(alert))
+	assert.False(t, r.markRestored(alert))
+
+	// Rules replaced by a new config are forgotten.
+	s.addNewConfigs(time.Now(), config("ALERT Down IF up == 0 FOR 5m"))
+	assert.Empty(t, r.restored)
+	assert.True(t, r.markRestored(s.rules["1"]["rules"][0].(*rules.AlertingRule)))
+}
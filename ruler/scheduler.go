@@ -41,9 +41,10 @@ func init() {
 }
 
 type workItem struct {
-	userID    string
-	rules     []rules.Rule
-	scheduled time.Time
+	userID string
+	// The user's rules, by the name of the rules file they're in.
+	namespaces map[string][]rules.Rule
+	scheduled  time.Time
 }
 
 // Key implements ScheduledItem
@@ -58,7 +59,7 @@ func (w workItem) Scheduled() time.Time {
 
 // Defer returns a copy of this work item, rescheduled to a later time.
 func (w workItem) Defer(interval time.Duration) workItem {
-	return workItem{w.userID, w.rules, w.scheduled.Add(interval)}
+	return workItem{w.userID, w.namespaces, w.scheduled.Add(interval)}
 }
 
 type scheduler struct {
@@ -69,6 +70,11 @@ type scheduler struct {
 	// All the configurations that we have. Only used for instrumentation.
 	cfgs map[string]configs.CortexConfig
 
+	// The rules of each user's current configuration, passed to forget when
+	// it's replaced.
+	rules  map[string]map[string][]rules.Rule
+	forget func([]rules.Rule)
+
 	pollInterval time.Duration
 
 	latestConfig configs.ConfigID
@@ -86,6 +92,7 @@ func newScheduler(configsAPI configs.API, evaluationInterval, pollInterval time.
 		pollInterval:       pollInterval,
 		q:                  NewSchedulingQueue(clockwork.NewRealClock()),
 		cfgs:               map[string]configs.CortexConfig{},
+		rules:              map[string]map[string][]rules.Rule{},
 
 		stop: make(chan struct{}),
 		done: make(chan struct{}),
@@ -171,7 +178,7 @@ func (s *scheduler) addNewConfigs(now time.Time, cfgs map[string]configs.CortexC
 	// TODO: instrument how many configs we have, both valid & invalid.
 	log.Debugf("Adding %d configurations", len(cfgs))
 	for userID, config := range cfgs {
-		rules, err := config.Config.GetRules()
+		namespaces, err := config.Config.GetNamespacedRules()
 		if err != nil {
 			// XXX: This means that if a user has a working configuration and
 			// they submit a broken one, we'll keep processing the last known
@@ -181,8 +188,14 @@ func (s *scheduler) addNewConfigs(now time.Time, cfgs map[string]configs.CortexC
 			continue
 		}
 
-		s.addWorkItem(workItem{userID, rules, now})
+		s.addWorkItem(workItem{userID, namespaces, now})
 		s.cfgs[userID] = config.Config
+		if old, ok := s.rules[userID]; ok && s.forget != nil {
+			for _, rs := range old {
+				s.forget(rs)
+			}
+		}
+		s.rules[userID] = namespaces
 	}
 	totalConfigs.Set(float64(len(s.cfgs)))
 }
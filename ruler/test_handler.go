@@ -0,0 +1,166 @@
+package ruler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/rules"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/configs"
+	"github.com/weaveworks/cortex/util"
+)
+
+const (
+	// Limits on what a rules test may do, like the Prometheus API's own
+	// limit on points per series, and on the rules posted to the ruler.
+	maxTestEvaluations = 11000
+	maxRulesSize       = 1 << 20
+
+	defaultTestStep = time.Minute
+)
+
+// testResult is what a rules test returns: the series its rules would have
+// written, and the alerts firing or pending at the end.
+type testResult struct {
+	Series model.Matrix `json:"series"`
+	Alerts []testAlert  `json:"alerts"`
+}
+
+type testAlert struct {
+	State       string            `json:"state"`
+	Labels      model.LabelSet    `json:"labels"`
+	Annotations model.LabelSet    `json:"annotations"`
+	Value       model.SampleValue `json:"value"`
+	ActiveAt    model.Time        `json:"activeAt"`
+}
+
+// TestRulesHandler evaluates the rules posted to it, in the rules file
+// format, every step from start to end (as in a range query; the step
+// defaults to a minute), returning the series they'd write and the alerts
+// active at the end.  Nothing is written, nor are notifications sent, so
+// rules can be tried out on historical data before deploying them.  It must
+// be wrapped in authentication.
+func (r *Ruler) TestRulesHandler(w http.ResponseWriter, req *http.Request) {
+	start, err := util.ParseTime(req.FormValue("start"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("invalid start: %v", err))
+		return
+	}
+	end, err := util.ParseTime(req.FormValue("end"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("invalid end: %v", err))
+		return
+	}
+	step := defaultTestStep
+	if s := req.FormValue("step"); s != "" {
+		if step, err = util.ParseDuration(s); err != nil || step <= 0 {
+			writeError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("invalid step %q", s))
+			return
+		}
+	}
+	if end.Before(start) {
+		writeError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("end is before start"))
+		return
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(req.Body, maxRulesSize+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	if len(content) > maxRulesSize {
+		writeError(w, http.StatusRequestEntityTooLarge, "bad_data", fmt.Errorf("rules larger than %d bytes", maxRulesSize))
+		return
+	}
+	rs, err := configs.CortexConfig{RulesFiles: map[string]string{"test": string(content)}}.GetRules()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	// Each rule is evaluated every step.
+	if steps := int64(end.Sub(start)/step) + 1; steps*int64(len(rs)) > maxTestEvaluations {
+		writeError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("more than %d evaluations: increase the step, shorten the time range, or test fewer rules", maxTestEvaluations))
+		return
+	}
+
+	result, err := testRules(req.Context(), r.engine, rs, start, end, step, r.alertURL.Path)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "execution", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		Status string     `json:"status"`
+		Data   testResult `json:"data"`
+	}{"success", result}); err != nil {
+		log.Errorf("Error writing rules test result: %v", err)
+	}
+}
+
+// testRules evaluates rs every step from start to end, collecting their
+// output instead of writing it.
+func testRules(ctx context.Context, engine *promql.Engine, rs []rules.Rule, start, end model.Time, step time.Duration, externalURLPath string) (testResult, error) {
+	series := map[model.Fingerprint]*model.SampleStream{}
+	for ts := start; !ts.After(end); ts = ts.Add(step) {
+		for _, rule := range rs {
+			vector, err := rule.Eval(ctx, ts, engine, externalURLPath)
+			if err != nil {
+				return testResult{}, fmt.Errorf("error evaluating %s at %s: %v", rule.Name(), ts, err)
+			}
+			for _, s := range vector {
+				fp := s.Metric.Fingerprint()
+				ss, ok := series[fp]
+				if !ok {
+					ss = &model.SampleStream{Metric: s.Metric}
+					series[fp] = ss
+				}
+				ss.Values = append(ss.Values, model.SamplePair{Timestamp: s.Timestamp, Value: s.Value})
+			}
+		}
+	}
+
+	result := testResult{
+		Series: make(model.Matrix, 0, len(series)),
+		Alerts: []testAlert{},
+	}
+	for _, ss := range series {
+		result.Series = append(result.Series, ss)
+	}
+	sort.Sort(result.Series)
+	for _, rule := range rs {
+		alerting, ok := rule.(*rules.AlertingRule)
+		if !ok {
+			continue
+		}
+		for _, a := range alerting.ActiveAlerts() {
+			result.Alerts = append(result.Alerts, testAlert{
+				State:       a.State.String(),
+				Labels:      a.Labels,
+				Annotations: a.Annotations,
+				Value:       a.Value,
+				ActiveAt:    a.ActiveAt,
+			})
+		}
+	}
+	return result, nil
+}
+
+// writeError writes an error in the format of the Prometheus API.
+func writeError(w http.ResponseWriter, code int, errorType string, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Status    string `json:"status"`
+		ErrorType string `json:"errorType"`
+		Error     string `json:"error"`
+	}{"error", errorType, err.Error()})
+}
@@ -0,0 +1,65 @@
+package ruler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/cortex/querier"
+)
+
+func TestTestRulesHandler(t *testing.T) {
+	r := &Ruler{
+		engine:   promql.NewEngine(querier.Queryable{Q: querier.MergeQuerier{Queriers: []querier.Querier{&recordingQuerier{}}}}, nil),
+		alertURL: &url.URL{},
+	}
+	post := func(query, rules string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r.TestRulesHandler(rec, httptest.NewRequest("POST", "/api/prom/rules/test?"+query, strings.NewReader(rules)))
+		return rec
+	}
+
+	for _, tc := range []struct {
+		query, rules string
+		code         int
+	}{
+		{"start=0&end=600", "always = vector(1)", http.StatusOK},
+		{"start=foo&end=600", "always = vector(1)", http.StatusBadRequest},
+		{"start=0&end=600&step=0", "always = vector(1)", http.StatusBadRequest},
+		{"start=600&end=0", "always = vector(1)", http.StatusBadRequest},
+		{"start=0&end=86400&step=1", "always = vector(1)", http.StatusBadRequest},
+		// The limit is on evaluations of every rule, not steps.
+		{"start=0&end=6000&step=1", "always = vector(1)", http.StatusOK},
+		{"start=0&end=6000&step=1", "always = vector(1)\nnever = vector(0)", http.StatusBadRequest},
+		{"start=0&end=600", "not a rule", http.StatusBadRequest},
+	} {
+		assert.Equal(t, tc.code, post(tc.query, tc.rules).Code, "%s %s", tc.query, tc.rules)
+	}
+
+	// Recording rules' series, and alerts, are returned, not written.
+	rec := post("start=0&end=300&step=60", "always = vector(1)\nALERT Always IF vector(1) > 0 FOR 2m")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp struct {
+		Data testResult `json:"data"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	var recorded *model.SampleStream
+	for _, ss := range resp.Data.Series {
+		if ss.Metric[model.MetricNameLabel] == "always" {
+			recorded = ss
+		}
+	}
+	require.NotNil(t, recorded)
+	assert.Len(t, recorded.Values, 6)
+	require.Len(t, resp.Data.Alerts, 1)
+	assert.Equal(t, "firing", resp.Data.Alerts[0].State)
+	assert.Equal(t, model.Time(0), resp.Data.Alerts[0].ActiveAt)
+}
@@ -0,0 +1,155 @@
+package storegateway
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-opentracing/go/otgrpc"
+	"github.com/mwitkow/go-grpc-middleware"
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/common/log"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/naming"
+
+	"github.com/weaveworks/common/middleware"
+)
+
+// ClientConfig configures a querier's connection to the store gateways.
+type ClientConfig struct {
+	Address         string
+	DNSLookupPeriod time.Duration
+
+	RingEnabled bool
+	ShardPeriod time.Duration
+
+	// For testing.
+	lookupHost func(string) ([]string, error)
+	dial       func(addr string) (StoreGatewayClient, func() error, error)
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *ClientConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Address, "querier.store-gateway-address", "", "host:port of the store gateways; the host is resolved by DNS to every gateway (empty to query the chunk store directly).")
+	f.DurationVar(&cfg.DNSLookupPeriod, "querier.store-gateway-dns-lookup-period", 10*time.Second, "How often to look up the store gateways' addresses.")
+	f.BoolVar(&cfg.RingEnabled, "querier.store-gateway-ring-enabled", false, "Find the store gateways in their ring, rather than at -querier.store-gateway-address, and send each period of a query to the gateway owning it.")
+	f.DurationVar(&cfg.ShardPeriod, "querier.store-gateway-shard-period", 24*time.Hour, "The period of data each gateway in the ring owns, per tenant; the chunk index is bucketed daily, and tables by -dynamodb.periodic-table.period.")
+}
+
+// Validate checks cfg is usable.
+func (cfg ClientConfig) Validate() error {
+	if cfg.RingEnabled && (cfg.ShardPeriod < time.Millisecond || cfg.ShardPeriod%time.Millisecond != 0) {
+		return fmt.Errorf("-querier.store-gateway-shard-period must be a positive whole number of milliseconds: %v", cfg.ShardPeriod)
+	}
+	return nil
+}
+
+// NewClient dials the store gateways, balancing queries across them.
+func NewClient(cfg ClientConfig) (StoreGatewayClient, func() error, error) {
+	if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+		return nil, nil, fmt.Errorf("invalid store gateway address %q: %v", cfg.Address, err)
+	}
+	if cfg.lookupHost == nil {
+		cfg.lookupHost = net.LookupHost
+	}
+	return dial(cfg.Address, grpc.WithBalancer(grpc.RoundRobin(dnsResolver{cfg})))
+}
+
+func dial(addr string, opts ...grpc.DialOption) (StoreGatewayClient, func() error, error) {
+	conn, err := grpc.Dial(addr, append(opts,
+		grpc.WithInsecure(),
+		grpc.WithUnaryInterceptor(grpc_middleware.ChainUnaryClient(
+			otgrpc.OpenTracingClientInterceptor(opentracing.GlobalTracer()),
+			middleware.ClientUserHeaderInterceptor,
+		)),
+	)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewStoreGatewayClient(conn), conn.Close, nil
+}
+
+// dnsResolver is a naming.Resolver looking up every address of a host
+// periodically.
+type dnsResolver struct {
+	cfg ClientConfig
+}
+
+func (r dnsResolver) Resolve(target string) (naming.Watcher, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &dnsWatcher{
+		cfg:     r.cfg,
+		host:    host,
+		port:    port,
+		ctx:     ctx,
+		cancel:  cancel,
+		current: map[string]bool{},
+	}, nil
+}
+
+type dnsWatcher struct {
+	cfg        ClientConfig
+	host, port string
+	ctx        context.Context
+	cancel     context.CancelFunc
+
+	// Only used by Next, which the balancer doesn't call concurrently.
+	looked  bool
+	current map[string]bool
+}
+
+// Next implements naming.Watcher, returning the addresses added and removed
+// since the last lookup, once they change.
+func (w *dnsWatcher) Next() ([]*naming.Update, error) {
+	for {
+		if w.looked {
+			select {
+			case <-time.After(w.cfg.DNSLookupPeriod):
+			case <-w.ctx.Done():
+				return nil, w.ctx.Err()
+			}
+		}
+		w.looked = true
+
+		hosts, err := w.cfg.lookupHost(w.host)
+		if err != nil {
+			log.Errorf("Error looking up store gateways %s: %v", w.host, err)
+			continue
+		}
+		if updates := w.update(hosts); len(updates) > 0 {
+			return updates, nil
+		}
+	}
+}
+
+func (w *dnsWatcher) update(hosts []string) []*naming.Update {
+	var updates []*naming.Update
+	addrs := map[string]bool{}
+	for _, host := range hosts {
+		addr := net.JoinHostPort(host, w.port)
+		addrs[addr] = true
+		if !w.current[addr] {
+			log.Infof("Adding store gateway %s", addr)
+			updates = append(updates, &naming.Update{Op: naming.Add, Addr: addr})
+		}
+	}
+	for addr := range w.current {
+		if !addrs[addr] {
+			log.Infof("Removing store gateway %s", addr)
+			updates = append(updates, &naming.Update{Op: naming.Delete, Addr: addr})
+		}
+	}
+	w.current = addrs
+	return updates
+}
+
+// Close implements naming.Watcher.
+func (w *dnsWatcher) Close() {
+	w.cancel()
+}
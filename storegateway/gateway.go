@@ -0,0 +1,123 @@
+package storegateway
+
+import (
+	"flag"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+	cortex_errors "github.com/weaveworks/cortex/util/errors"
+)
+
+var errTooManyQueries = cortex_errors.New(cortex_errors.RateLimited, "too many outstanding store gateway queries")
+
+var (
+	inflightQueries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cortex",
+		Name:      "store_gateway_inflight_queries",
+		Help:      "The number of queries the store gateway is executing, or has queued.",
+	})
+	rejectedQueries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "store_gateway_rejected_queries_total",
+		Help:      "The total number of queries rejected by the store gateway, for its queue being full.",
+	})
+	queriedChunks = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "store_gateway_chunks_per_query",
+		Help:      "The number of chunks fetched per query by the store gateway.",
+		Buckets:   prometheus.ExponentialBuckets(10, 4, 8),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(inflightQueries)
+	prometheus.MustRegister(rejectedQueries)
+	prometheus.MustRegister(queriedChunks)
+}
+
+// Store is the interface the Gateway needs to get chunks.
+type Store interface {
+	Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]chunk.Chunk, error)
+}
+
+// Config configures a Gateway.
+type Config struct {
+	MaxConcurrent int
+	MaxQueued     int
+
+	RingEnabled bool
+	NumTokens   int
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.IntVar(&cfg.MaxConcurrent, "store-gateway.max-concurrent-queries", 20, "The maximum number of queries to execute against the chunk store at once.")
+	f.IntVar(&cfg.MaxQueued, "store-gateway.max-queued-queries", 100, "The maximum number of queries to queue, beyond those executing, before rejecting them.")
+	f.BoolVar(&cfg.RingEnabled, "store-gateway.ring.enabled", false, "Register in the store gateways' ring, so queriers with -querier.store-gateway-ring-enabled send this gateway the periods of data it owns.")
+	f.IntVar(&cfg.NumTokens, "store-gateway.ring.num-tokens", 128, "Number of tokens for each store gateway in the ring.")
+}
+
+// Gateway serves reads from the chunk store to queriers over gRPC, so the
+// store's read capacity (and its caches) can be scaled independently of
+// queriers' PromQL evaluation.
+type Gateway struct {
+	store Store
+
+	// Admits queries to execute, or queue.
+	admitted chan struct{}
+	// Admits queries to execute.
+	executing chan struct{}
+}
+
+// New makes a new Gateway, reading from store.
+func New(cfg Config, store Store) *Gateway {
+	return &Gateway{
+		store:     store,
+		admitted:  make(chan struct{}, cfg.MaxConcurrent+cfg.MaxQueued),
+		executing: make(chan struct{}, cfg.MaxConcurrent),
+	}
+}
+
+// Query implements StoreGatewayServer.
+func (g *Gateway) Query(ctx context.Context, req *cortex.QueryRequest) (*cortex.QueryResponse, error) {
+	select {
+	case g.admitted <- struct{}{}:
+	default:
+		rejectedQueries.Inc()
+		return nil, cortex_errors.ToGRPC(errTooManyQueries)
+	}
+	inflightQueries.Inc()
+	defer func() {
+		inflightQueries.Dec()
+		<-g.admitted
+	}()
+
+	select {
+	case g.executing <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-g.executing }()
+
+	from, through, matchers, err := util.FromQueryRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := g.store.Get(ctx, from, through, matchers...)
+	if err != nil {
+		return nil, cortex_errors.ToGRPC(err)
+	}
+	queriedChunks.Observe(float64(len(chunks)))
+
+	matrix, err := chunk.ChunksToMatrix(chunks)
+	if err != nil {
+		return nil, err
+	}
+	return util.ToQueryResponse(matrix), nil
+}
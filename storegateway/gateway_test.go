@@ -0,0 +1,151 @@
+package storegateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/naming"
+
+	"github.com/weaveworks/common/user"
+	cortex_chunk "github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+	cortex_errors "github.com/weaveworks/cortex/util/errors"
+)
+
+// testStore returns its chunks for user "1", once release is closed.
+type testStore struct {
+	chunks  []cortex_chunk.Chunk
+	release chan struct{}
+}
+
+func (s *testStore) Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]cortex_chunk.Chunk, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	<-s.release
+	if userID != "1" {
+		return nil, nil
+	}
+	return s.chunks, nil
+}
+
+func newTestChunk(t *testing.T, metric model.Metric, values ...model.SampleValue) cortex_chunk.Chunk {
+	c := chunk.New()
+	for j, v := range values {
+		cs, err := c.Add(model.SamplePair{Timestamp: model.Time(j), Value: v})
+		require.NoError(t, err)
+		require.Len(t, cs, 1)
+		c = cs[0]
+	}
+	return cortex_chunk.NewChunk(metric.Fingerprint(), metric, c, 0, model.Time(len(values)-1))
+}
+
+func TestGatewayQuery(t *testing.T) {
+	m := model.Metric{model.MetricNameLabel: "foo", "bar": "baz"}
+	store := &testStore{
+		chunks:  []cortex_chunk.Chunk{newTestChunk(t, m, 1, 2)},
+		release: make(chan struct{}),
+	}
+	close(store.release)
+	g := New(Config{MaxConcurrent: 1}, store)
+
+	matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	require.NoError(t, err)
+	req, err := util.ToQueryRequest(0, 10, []*metric.LabelMatcher{matcher})
+	require.NoError(t, err)
+
+	resp, err := g.Query(user.Inject(context.Background(), "1"), req)
+	require.NoError(t, err)
+	assert.Equal(t, model.Matrix{{
+		Metric: m,
+		Values: []model.SamplePair{{Timestamp: 0, Value: 1}, {Timestamp: 1, Value: 2}},
+	}}, util.FromQueryResponse(resp))
+
+	resp, err = g.Query(user.Inject(context.Background(), "2"), req)
+	require.NoError(t, err)
+	assert.Empty(t, util.FromQueryResponse(resp))
+}
+
+func TestGatewayLimits(t *testing.T) {
+	store := &testStore{release: make(chan struct{})}
+	g := New(Config{MaxConcurrent: 1, MaxQueued: 1}, store)
+	ctx := user.Inject(context.Background(), "1")
+	req, err := util.ToQueryRequest(0, 10, nil)
+	require.NoError(t, err)
+
+	errs := make(chan error)
+	query := func(admitted int) {
+		go func() {
+			_, err := g.Query(ctx, req)
+			errs <- err
+		}()
+		for deadline := time.Now().Add(5 * time.Second); len(g.admitted) < admitted; {
+			require.True(t, time.Now().Before(deadline), "query wasn't admitted")
+			time.Sleep(time.Millisecond)
+		}
+	}
+	query(1)
+
+	// Queued queries are abandoned with their context.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = g.Query(cancelled, req)
+	assert.Equal(t, context.Canceled, err)
+
+	// With one query executing and one queued, more are rejected.
+	query(2)
+	_, err = g.Query(ctx, req)
+	assert.Equal(t, errTooManyQueries, cortex_errors.FromGRPC(err))
+
+	close(store.release)
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, <-errs)
+	}
+}
+
+func TestDNSWatcher(t *testing.T) {
+	lookups := [][]string{
+		{"10.0.0.1", "10.0.0.2"},
+		{"10.0.0.2", "10.0.0.1"},
+		{"10.0.0.2", "10.0.0.3"},
+	}
+	cfg := ClientConfig{
+		DNSLookupPeriod: time.Millisecond,
+		lookupHost: func(host string) ([]string, error) {
+			assert.Equal(t, "store-gateway", host)
+			hosts := lookups[0]
+			if len(lookups) > 1 {
+				lookups = lookups[1:]
+			}
+			return hosts, nil
+		},
+	}
+	w, err := dnsResolver{cfg}.Resolve("store-gateway:9095")
+	require.NoError(t, err)
+
+	updates, err := w.Next()
+	require.NoError(t, err)
+	assert.Equal(t, []*naming.Update{
+		{Op: naming.Add, Addr: "10.0.0.1:9095"},
+		{Op: naming.Add, Addr: "10.0.0.2:9095"},
+	}, updates)
+
+	// Lookups which don't change the addresses are skipped.
+	updates, err = w.Next()
+	require.NoError(t, err)
+	assert.Equal(t, []*naming.Update{
+		{Op: naming.Add, Addr: "10.0.0.3:9095"},
+		{Op: naming.Delete, Addr: "10.0.0.1:9095"},
+	}, updates)
+
+	w.Close()
+	_, err = w.Next()
+	assert.Equal(t, context.Canceled, err)
+}
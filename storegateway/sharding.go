@@ -0,0 +1,233 @@
+package storegateway
+
+import (
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/util"
+	cortex_errors "github.com/weaveworks/cortex/util/errors"
+)
+
+// RingKey is the Consul key the store gateways' ring is kept in.
+const RingKey = "store-gateways"
+
+// replicas is the number of gateways each shard is tried on, in ring order,
+// so a shard's owner failing doesn't fail the query.
+const replicas = 2
+
+var (
+	shardsPerQuery = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "store_gateway_client_shards_per_query",
+		Help:      "The number of shards each query is split into, one per period, to send to the store gateways owning them.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 8),
+	})
+	shardFailovers = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "store_gateway_client_failovers_total",
+		Help:      "The total number of shards retried on another store gateway, after failing on their owner.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(shardsPerQuery)
+	prometheus.MustRegister(shardFailovers)
+}
+
+// ReadRing is the read interface to the store gateways' ring.
+type ReadRing interface {
+	Get(key uint32, n int, op ring.Operation) ([]*ring.IngesterDesc, error)
+	Watch(f func(*ring.Snapshot)) (stop func())
+}
+
+// ShardedClient is a StoreGatewayClient splitting queries by ShardPeriod,
+// and sending each period to the gateway owning that period of the tenant's
+// data in the ring.  Each gateway's caches then cover a disjoint part of the
+// store, so hit rates improve as gateways are added, rather than every
+// gateway caching the same data.
+type ShardedClient struct {
+	cfg       ClientConfig
+	ring      ReadRing
+	stopWatch func()
+
+	mtx     sync.Mutex
+	clients map[string]gatewayClient
+}
+
+type gatewayClient struct {
+	StoreGatewayClient
+	close func() error
+}
+
+// NewShardedClient makes a new ShardedClient, finding the gateways in r.
+func NewShardedClient(cfg ClientConfig, r ReadRing) *ShardedClient {
+	if cfg.dial == nil {
+		cfg.dial = func(addr string) (StoreGatewayClient, func() error, error) {
+			return dial(addr)
+		}
+	}
+	c := &ShardedClient{
+		cfg:     cfg,
+		ring:    r,
+		clients: map[string]gatewayClient{},
+	}
+	c.stopWatch = r.Watch(c.removeStaleClients)
+	return c
+}
+
+// Stop closes the connections to the gateways.
+func (c *ShardedClient) Stop() {
+	c.stopWatch()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for addr, client := range c.clients {
+		client.close()
+		delete(c.clients, addr)
+	}
+}
+
+// Query implements StoreGatewayClient, merging the shards' responses.
+func (c *ShardedClient) Query(ctx context.Context, req *cortex.QueryRequest, opts ...grpc.CallOption) (*cortex.QueryResponse, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	shards := c.shards(req)
+	shardsPerQuery.Observe(float64(len(shards)))
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		matrix model.Matrix
+		err    error
+	}
+	results := make(chan result, len(shards))
+	for period, shard := range shards {
+		go func(period int64, shard *cortex.QueryRequest) {
+			resp, err := c.queryShard(ctx, shardToken(userID, period), shard, opts...)
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			results <- result{matrix: util.FromQueryResponse(resp)}
+		}(period, shard)
+	}
+
+	// The other shards are cancelled once one fails.
+	series := map[model.Fingerprint]*model.SampleStream{}
+	for range shards {
+		result := <-results
+		if result.err != nil {
+			return nil, result.err
+		}
+		// Chunks spanning periods are returned by each of their gateways.
+		for _, ss := range result.matrix {
+			fp := ss.Metric.Fingerprint()
+			if merged, ok := series[fp]; ok {
+				merged.Values = util.MergeSamples(merged.Values, ss.Values)
+			} else {
+				series[fp] = ss
+			}
+		}
+	}
+
+	matrix := make(model.Matrix, 0, len(series))
+	for _, ss := range series {
+		matrix = append(matrix, ss)
+	}
+	return util.ToQueryResponse(matrix), nil
+}
+
+// shards splits req by ShardPeriod, counting from the epoch, keyed by
+// period.
+func (c *ShardedClient) shards(req *cortex.QueryRequest) map[int64]*cortex.QueryRequest {
+	periodMs := int64(c.cfg.ShardPeriod / time.Millisecond)
+	shards := map[int64]*cortex.QueryRequest{}
+	for period := req.StartTimestampMs / periodMs; period*periodMs <= req.EndTimestampMs; period++ {
+		shard := *req
+		shard.StartTimestampMs = util.Max64(req.StartTimestampMs, period*periodMs)
+		shard.EndTimestampMs = util.Min64(req.EndTimestampMs, (period+1)*periodMs-1)
+		shards[period] = &shard
+	}
+	return shards
+}
+
+func shardToken(userID string, period int64) uint32 {
+	h := fnv.New32()
+	h.Write([]byte(userID))
+	h.Write([]byte(":"))
+	h.Write([]byte(strconv.FormatInt(period, 10)))
+	return h.Sum32()
+}
+
+// queryShard sends req to the gateway owning key, or failing that, the
+// next in the ring.
+func (c *ShardedClient) queryShard(ctx context.Context, key uint32, req *cortex.QueryRequest, opts ...grpc.CallOption) (*cortex.QueryResponse, error) {
+	gateways, err := c.ring.Get(key, replicas, ring.Read)
+	if err != nil {
+		return nil, err
+	}
+	for i, gateway := range gateways {
+		if i > 0 {
+			shardFailovers.Inc()
+		}
+		var client StoreGatewayClient
+		client, err = c.getClient(gateway.Addr)
+		if err != nil {
+			continue
+		}
+		var resp *cortex.QueryResponse
+		resp, err = client.Query(ctx, req, opts...)
+		if err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil || !cortex_errors.Retryable(err) {
+			return nil, err
+		}
+		log.Warnf("Error querying store gateway %s: %v", gateway.Addr, err)
+	}
+	return nil, err
+}
+
+func (c *ShardedClient) getClient(addr string) (StoreGatewayClient, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if client, ok := c.clients[addr]; ok {
+		return client, nil
+	}
+	client, closeClient, err := c.cfg.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	c.clients[addr] = gatewayClient{StoreGatewayClient: client, close: closeClient}
+	return client, nil
+}
+
+// removeStaleClients closes the connections to gateways which have left the
+// ring.
+func (c *ShardedClient) removeStaleClients(s *ring.Snapshot) {
+	current := map[string]bool{}
+	for _, gateway := range s.GetAll() {
+		current[gateway.Addr] = true
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for addr, client := range c.clients {
+		if !current[addr] {
+			log.Infof("Removing store gateway %s", addr)
+			client.close()
+			delete(c.clients, addr)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package storegateway
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/util"
+	cortex_errors "github.com/weaveworks/cortex/util/errors"
+)
+
+// mockRing assigns keys to its gateways modulo their number.
+type mockRing []string
+
+func (r mockRing) Get(key uint32, n int, op ring.Operation) ([]*ring.IngesterDesc, error) {
+	var gateways []*ring.IngesterDesc
+	for i := 0; i < n && i < len(r); i++ {
+		gateways = append(gateways, &ring.IngesterDesc{Addr: r[(int(key%uint32(len(r)))+i)%len(r)]})
+	}
+	return gateways, nil
+}
+
+func (r mockRing) Watch(f func(*ring.Snapshot)) func() {
+	return func() {}
+}
+
+type clientFunc func(ctx context.Context, req *cortex.QueryRequest) (*cortex.QueryResponse, error)
+
+func (f clientFunc) Query(ctx context.Context, req *cortex.QueryRequest, opts ...grpc.CallOption) (*cortex.QueryResponse, error) {
+	return f(ctx, req)
+}
+
+type shardCall struct {
+	addr       string
+	start, end int64
+}
+
+func TestShardedClient(t *testing.T) {
+	gateways := mockRing{"a", "b", "c"}
+	m := model.Metric{model.MetricNameLabel: "foo"}
+	var (
+		mtx   sync.Mutex
+		calls []shardCall
+		errs  = map[string]error{}
+	)
+	cfg := ClientConfig{
+		ShardPeriod: 24 * time.Hour,
+		dial: func(addr string) (StoreGatewayClient, func() error, error) {
+			return clientFunc(func(ctx context.Context, req *cortex.QueryRequest) (*cortex.QueryResponse, error) {
+				mtx.Lock()
+				defer mtx.Unlock()
+				calls = append(calls, shardCall{addr, req.StartTimestampMs, req.EndTimestampMs})
+				if err := errs[addr]; err != nil {
+					return nil, err
+				}
+				// Every gateway returns the first sample, as if from a
+				// chunk spanning the periods.
+				return util.ToQueryResponse(model.Matrix{{
+					Metric: m,
+					Values: []model.SamplePair{{Timestamp: 0, Value: 0}, {Timestamp: model.Time(req.StartTimestampMs), Value: 1}},
+				}}), nil
+			}), func() error { return nil }, nil
+		},
+	}
+	c := NewShardedClient(cfg, gateways)
+	defer c.Stop()
+	ctx := user.Inject(context.Background(), "1")
+	day := int64(24 * time.Hour / time.Millisecond)
+	req := &cortex.QueryRequest{StartTimestampMs: day / 2, EndTimestampMs: 2 * day}
+	owner := func(period int64) string {
+		return gateways[shardToken("1", period)%uint32(len(gateways))]
+	}
+	sortCalls := func() {
+		sort.Slice(calls, func(i, j int) bool { return calls[i].start < calls[j].start })
+	}
+
+	// Each period goes to its owner, and their samples are merged.
+	resp, err := c.Query(ctx, req)
+	require.NoError(t, err)
+	sortCalls()
+	assert.Equal(t, []shardCall{
+		{owner(0), day / 2, day - 1},
+		{owner(1), day, 2*day - 1},
+		{owner(2), 2 * day, 2 * day},
+	}, calls)
+	assert.Equal(t, model.Matrix{{
+		Metric: m,
+		Values: []model.SamplePair{{Timestamp: 0, Value: 0}, {Timestamp: model.Time(day / 2), Value: 1}, {Timestamp: model.Time(day), Value: 1}, {Timestamp: model.Time(2 * day), Value: 1}},
+	}}, util.FromQueryResponse(resp))
+
+	// Shards are retried on the next gateway when their owner's unavailable.
+	calls = nil
+	errs[owner(1)] = cortex_errors.ToGRPC(cortex_errors.Errorf(cortex_errors.Unavailable, "unavailable"))
+	_, err = c.Query(ctx, &cortex.QueryRequest{StartTimestampMs: day, EndTimestampMs: day})
+	require.NoError(t, err)
+	require.Len(t, calls, 2)
+	assert.Equal(t, owner(1), calls[0].addr)
+	assert.NotEqual(t, owner(1), calls[1].addr)
+
+	// But not when the query can't succeed.
+	calls = nil
+	errs[owner(1)] = cortex_errors.ToGRPC(cortex_errors.Errorf(cortex_errors.TooManyChunks, "too many chunks"))
+	_, err = c.Query(ctx, &cortex.QueryRequest{StartTimestampMs: day, EndTimestampMs: day})
+	assert.Equal(t, cortex_errors.TooManyChunks, cortex_errors.TypeOf(err))
+	assert.Len(t, calls, 1)
+}
+
+func TestShardedClientCancelsShards(t *testing.T) {
+	day := int64(24 * time.Hour / time.Millisecond)
+	cancelled := make(chan struct{}, 3)
+	cfg := ClientConfig{
+		ShardPeriod: 24 * time.Hour,
+		dial: func(addr string) (StoreGatewayClient, func() error, error) {
+			return clientFunc(func(ctx context.Context, req *cortex.QueryRequest) (*cortex.QueryResponse, error) {
+				if req.StartTimestampMs == 0 {
+					return nil, cortex_errors.ToGRPC(cortex_errors.Errorf(cortex_errors.TooManyChunks, "too many chunks"))
+				}
+				// The others wait until they're cancelled.
+				<-ctx.Done()
+				cancelled <- struct{}{}
+				return nil, ctx.Err()
+			}), func() error { return nil }, nil
+		},
+	}
+	c := NewShardedClient(cfg, mockRing{"a", "b", "c"})
+	defer c.Stop()
+
+	_, err := c.Query(user.Inject(context.Background(), "1"), &cortex.QueryRequest{StartTimestampMs: 0, EndTimestampMs: 2 * day})
+	assert.Equal(t, cortex_errors.TooManyChunks, cortex_errors.TypeOf(err))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-cancelled:
+		case <-time.After(time.Second):
+			t.Fatal("shard not cancelled")
+		}
+	}
+}
+
+func TestClientConfigValidate(t *testing.T) {
+	for period, valid := range map[time.Duration]bool{
+		24 * time.Hour:          true,
+		time.Millisecond:        true,
+		0:                       false,
+		-time.Hour:              false,
+		time.Microsecond:        false,
+		1500 * time.Microsecond: false,
+	} {
+		err := ClientConfig{RingEnabled: true, ShardPeriod: period}.Validate()
+		assert.Equal(t, valid, err == nil, "%v", period)
+	}
+	assert.NoError(t, ClientConfig{}.Validate())
+}
@@ -0,0 +1,311 @@
+package testexporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+
+	"github.com/weaveworks/cortex/distributor"
+	"github.com/weaveworks/cortex/util"
+)
+
+const metricName = "cortex_test_exporter_synthetic"
+
+var (
+	samplesWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cortex_test_exporter_samples_written_total",
+		Help: "The total number of synthetic samples written.",
+	})
+	writeFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cortex_test_exporter_write_failures_total",
+		Help: "The total number of failed writes of synthetic samples.",
+	})
+	queries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cortex_test_exporter_queries_total",
+		Help: "The total number of queries verifying the synthetic samples, by whether they succeeded.",
+	}, []string{"result"})
+	samplesVerified = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cortex_test_exporter_samples_verified_total",
+		Help: "The total number of written samples checked by queries, by whether they were returned correctly, incorrectly, or not at all.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(samplesWritten)
+	prometheus.MustRegister(writeFailures)
+	prometheus.MustRegister(queries)
+	prometheus.MustRegister(samplesVerified)
+}
+
+// Config configures an Exporter.
+type Config struct {
+	PushURL       string
+	QueryURL      string
+	UserID        string
+	Instance      string
+	NumSeries     int
+	WriteInterval time.Duration
+	QueryInterval time.Duration
+	QueryRange    time.Duration
+	Timeout       time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	hostname, _ := os.Hostname()
+	f.StringVar(&cfg.PushURL, "test-exporter.push-url", "", "URL to push synthetic samples to, e.g. http://distributor/api/prom/push.")
+	f.StringVar(&cfg.QueryURL, "test-exporter.query-url", "", "URL of the Prometheus API to verify the samples through, e.g. http://querier/api/prom.")
+	f.StringVar(&cfg.UserID, "test-exporter.user", "test-exporter", "Tenant to write and query the samples as.")
+	f.StringVar(&cfg.Instance, "test-exporter.instance", hostname, "Value of the instance label of the samples, so several exporters can share a tenant.")
+	f.IntVar(&cfg.NumSeries, "test-exporter.num-series", 100, "Number of synthetic series to write.")
+	f.DurationVar(&cfg.WriteInterval, "test-exporter.write-interval", 15*time.Second, "Interval between samples of each series.")
+	f.DurationVar(&cfg.QueryInterval, "test-exporter.query-interval", time.Minute, "How often to query and verify the samples.")
+	f.DurationVar(&cfg.QueryRange, "test-exporter.query-range", time.Hour, "How far back to verify the samples.")
+	f.DurationVar(&cfg.Timeout, "test-exporter.timeout", 10*time.Second, "Timeout for writes and queries.")
+}
+
+// Exporter writes deterministic synthetic series through the write path,
+// at timestamps aligned to the write interval, and continuously checks
+// that queries return exactly what was written.  Samples which weren't
+// written successfully aren't checked.
+type Exporter struct {
+	cfg    Config
+	client *http.Client
+	quit   chan struct{}
+	done   sync.WaitGroup
+
+	// Replaced for testing.
+	push func(ts model.Time, samples []model.Sample) error
+
+	mtx sync.Mutex
+	// Timestamps written successfully, within the query range.
+	written map[model.Time]struct{}
+}
+
+// New makes a new Exporter, and starts it writing and verifying.
+func New(cfg Config) (*Exporter, error) {
+	if cfg.PushURL == "" || cfg.QueryURL == "" {
+		return nil, fmt.Errorf("both the push and query URLs must be set")
+	}
+	if cfg.NumSeries <= 0 || cfg.WriteInterval <= 0 {
+		return nil, fmt.Errorf("the number of series and write interval must be positive")
+	}
+	e := newExporter(cfg)
+	e.done.Add(2)
+	go e.loop(cfg.WriteInterval, e.write)
+	go e.loop(cfg.QueryInterval, e.verify)
+	return e, nil
+}
+
+func newExporter(cfg Config) *Exporter {
+	e := &Exporter{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		quit:    make(chan struct{}),
+		written: map[model.Time]struct{}{},
+	}
+	e.push = e.pushHTTP
+	return e
+}
+
+// Stop stops the Exporter.
+func (e *Exporter) Stop() {
+	close(e.quit)
+	e.done.Wait()
+}
+
+func (e *Exporter) loop(interval time.Duration, f func(now time.Time) error) {
+	defer e.done.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := f(now); err != nil {
+				log.Errorf("Error in test exporter: %v", err)
+			}
+		case <-e.quit:
+			return
+		}
+	}
+}
+
+// value is the value of series at ts; a sawtooth, exactly representable.
+func value(series int, ts model.Time) model.SampleValue {
+	return model.SampleValue(series*1000 + int(int64(ts)/1000%1000))
+}
+
+func (e *Exporter) metric(series int) model.Metric {
+	return model.Metric{
+		model.MetricNameLabel: metricName,
+		model.InstanceLabel:   model.LabelValue(e.cfg.Instance),
+		"series":              model.LabelValue(strconv.Itoa(series)),
+	}
+}
+
+// write writes a sample of every series, at now truncated to the write
+// interval.
+func (e *Exporter) write(now time.Time) error {
+	ts := model.TimeFromUnixNano(now.Truncate(e.cfg.WriteInterval).UnixNano())
+	samples := make([]model.Sample, 0, e.cfg.NumSeries)
+	for i := 0; i < e.cfg.NumSeries; i++ {
+		samples = append(samples, model.Sample{Metric: e.metric(i), Timestamp: ts, Value: value(i, ts)})
+	}
+	if err := e.push(ts, samples); err != nil {
+		writeFailures.Inc()
+		return err
+	}
+	samplesWritten.Add(float64(len(samples)))
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.written[ts] = struct{}{}
+	for t := range e.written {
+		if ts.Sub(t) > e.cfg.QueryRange {
+			delete(e.written, t)
+		}
+	}
+	return nil
+}
+
+func (e *Exporter) pushHTTP(ts model.Time, samples []model.Sample) error {
+	buf, err := proto.Marshal(util.ToWriteRequest(samples))
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	w := snappy.NewWriter(&body)
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", e.cfg.PushURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Scope-OrgID", e.cfg.UserID)
+	// Retried writes of the same samples are harmless.
+	req.Header.Set(distributor.IdempotencyKeyHeader, fmt.Sprintf("%s-%d", e.cfg.Instance, ts))
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("push failed with status %d: %s", resp.StatusCode, msg)
+	}
+	return nil
+}
+
+// verify queries the samples written within the query range, and checks
+// each is returned with the right value.
+func (e *Exporter) verify(now time.Time) error {
+	e.mtx.Lock()
+	written := make(map[model.Time]struct{}, len(e.written))
+	var start, end model.Time
+	for ts := range e.written {
+		written[ts] = struct{}{}
+		if start == 0 || ts < start {
+			start = ts
+		}
+		if ts > end {
+			end = ts
+		}
+	}
+	e.mtx.Unlock()
+	if len(written) == 0 {
+		return nil
+	}
+
+	matrix, err := e.queryRange(start, end)
+	if err != nil {
+		queries.WithLabelValues("failure").Inc()
+		return err
+	}
+	queries.WithLabelValues("success").Inc()
+
+	returned := make(map[string]*model.SampleStream, len(matrix))
+	for _, stream := range matrix {
+		returned[string(stream.Metric["series"])] = stream
+	}
+	var correct, incorrect, missing int
+	for i := 0; i < e.cfg.NumSeries; i++ {
+		values := map[model.Time]model.SampleValue{}
+		if stream, ok := returned[strconv.Itoa(i)]; ok {
+			for _, pair := range stream.Values {
+				values[pair.Timestamp] = pair.Value
+			}
+		}
+		for ts := range written {
+			v, ok := values[ts]
+			switch {
+			case !ok:
+				missing++
+			case v != value(i, ts):
+				incorrect++
+			default:
+				correct++
+			}
+		}
+	}
+	samplesVerified.WithLabelValues("correct").Add(float64(correct))
+	samplesVerified.WithLabelValues("incorrect").Add(float64(incorrect))
+	samplesVerified.WithLabelValues("missing").Add(float64(missing))
+	if incorrect > 0 || missing > 0 {
+		return fmt.Errorf("%d samples were incorrect and %d missing, of %d written", incorrect, missing, correct+incorrect+missing)
+	}
+	return nil
+}
+
+func (e *Exporter) queryRange(start, end model.Time) (model.Matrix, error) {
+	query := fmt.Sprintf("%s{%s=%q}", metricName, model.InstanceLabel, e.cfg.Instance)
+	u := fmt.Sprintf("%s/api/v1/query_range?%s", e.cfg.QueryURL, url.Values{
+		"query": {query},
+		"start": {start.String()},
+		"end":   {end.String()},
+		"step":  {strconv.FormatFloat(e.cfg.WriteInterval.Seconds(), 'f', -1, 64)},
+	}.Encode())
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Scope-OrgID", e.cfg.UserID)
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			Result model.Matrix `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error decoding response with status %d: %v", resp.StatusCode, err)
+	}
+	if result.Status != "success" {
+		return nil, fmt.Errorf("query failed with status %d: %s", resp.StatusCode, result.Error)
+	}
+	return result.Data.Result, nil
+}
@@ -0,0 +1,120 @@
+package testexporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCortex stores pushed samples, and returns them from range queries,
+// corrupted if it's told to.
+type fakeCortex struct {
+	mtx     sync.Mutex
+	samples map[model.Fingerprint]*model.SampleStream
+	corrupt bool
+}
+
+func (c *fakeCortex) push(userID string, samples []model.Sample) error {
+	if userID != "user" {
+		return fmt.Errorf("wrong user")
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, sample := range samples {
+		fp := sample.Metric.Fingerprint()
+		stream, ok := c.samples[fp]
+		if !ok {
+			stream = &model.SampleStream{Metric: sample.Metric}
+			c.samples[fp] = stream
+		}
+		stream.Values = append(stream.Values, model.SamplePair{Timestamp: sample.Timestamp, Value: sample.Value})
+	}
+	return nil
+}
+
+func (c *fakeCortex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Scope-OrgID") != "user" {
+		http.Error(w, "wrong user", http.StatusUnauthorized)
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	switch r.URL.Path {
+	case "/api/prom/api/v1/query_range":
+		matrix := model.Matrix{}
+		for _, stream := range c.samples {
+			values := append([]model.SamplePair{}, stream.Values...)
+			if c.corrupt {
+				values[0].Value++
+			}
+			matrix = append(matrix, &model.SampleStream{Metric: stream.Metric, Values: values})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   map[string]interface{}{"resultType": "matrix", "result": matrix},
+		})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestExporter(t *testing.T) {
+	fake := &fakeCortex{samples: map[model.Fingerprint]*model.SampleStream{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	e := newExporter(Config{
+		PushURL:       server.URL + "/api/prom/push",
+		QueryURL:      server.URL + "/api/prom",
+		UserID:        "user",
+		Instance:      "test",
+		NumSeries:     3,
+		WriteInterval: 15 * time.Second,
+		QueryRange:    time.Hour,
+	})
+	e.push = func(ts model.Time, samples []model.Sample) error {
+		return fake.push(e.cfg.UserID, samples)
+	}
+
+	// Nothing to verify before anything's written.
+	require.NoError(t, e.verify(time.Now()))
+
+	now := time.Unix(1500000000, 0)
+	for i := 0; i < 4; i++ {
+		require.NoError(t, e.write(now.Add(time.Duration(i)*15*time.Second)))
+	}
+	assert.Len(t, e.written, 4)
+	assert.Len(t, fake.samples, 3)
+	require.NoError(t, e.verify(now))
+
+	fake.corrupt = true
+	err := e.verify(now)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "3 samples were incorrect and 0 missing, of 12 written")
+	fake.corrupt = false
+
+	// Samples that failed to be written aren't expected, but those lost
+	// since are.
+	e.cfg.UserID = "other"
+	require.Error(t, e.write(now.Add(time.Minute)))
+	e.cfg.UserID = "user"
+	require.NoError(t, e.verify(now))
+	fake.samples = map[model.Fingerprint]*model.SampleStream{}
+	err = e.verify(now)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "0 samples were incorrect and 12 missing")
+
+	// Samples leave the query range.
+	require.NoError(t, e.write(now.Add(2*time.Hour)))
+	assert.Len(t, e.written, 1)
+}
@@ -0,0 +1,195 @@
+package util
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/user"
+)
+
+// orgIDHeaderName is the header requests' tenants are taken from.
+const orgIDHeaderName = "X-Scope-OrgID"
+
+// AuthConfig configures how requests' tenants are taken from their
+// X-Scope-OrgID headers.  Tenant IDs end up in chunk keys and index hash
+// keys, so those which could be confused with their separators are rejected.
+type AuthConfig struct {
+	// If false, every request is attributed to FakeTenantID.
+	Enabled      bool
+	FakeTenantID string
+
+	TenantIDPattern     string
+	TenantIDMaxLength   int
+	ReservedTenantIDs   string
+	TenantIDMappingFile string
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *AuthConfig) RegisterFlags(f *flag.FlagSet) {
+	f.BoolVar(&cfg.Enabled, "auth.enabled", true, "Take each request's tenant from its X-Scope-OrgID header; if false, run single-tenant, attributing every request to -auth.fake-tenant-id.")
+	f.StringVar(&cfg.FakeTenantID, "auth.fake-tenant-id", "fake", "Tenant every request is attributed to if -auth.enabled=false.")
+	f.StringVar(&cfg.TenantIDPattern, "auth.tenant-id-pattern", `^[a-zA-Z0-9!._*'()-]+$`, "Regexp tenant IDs must match; others are rejected with 400.")
+	f.IntVar(&cfg.TenantIDMaxLength, "auth.tenant-id-max-length", 150, "Maximum length of a tenant ID (0 for no limit).")
+	f.StringVar(&cfg.ReservedTenantIDs, "auth.reserved-tenant-ids", ".,..", "Comma-separated tenant IDs to reject.")
+	f.StringVar(&cfg.TenantIDMappingFile, "auth.tenant-id-mapping-file", "", "YAML file mapping legacy tenant IDs to the ones to use instead, applied before validation.")
+}
+
+// tenantIDMapping is the content of -auth.tenant-id-mapping-file, like:
+//
+//	tenants:
+//	  "legacy:id": legacy-id
+type tenantIDMapping struct {
+	Tenants map[string]string `yaml:"tenants"`
+}
+
+// tenantIDs validates and normalises tenant IDs.
+type tenantIDs struct {
+	pattern   *regexp.Regexp
+	maxLength int
+	reserved  map[string]struct{}
+	mapping   map[string]string
+}
+
+func newTenantIDs(cfg AuthConfig) (*tenantIDs, error) {
+	pattern, err := regexp.Compile(cfg.TenantIDPattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant ID pattern: %v", err)
+	}
+	t := &tenantIDs{
+		pattern:   pattern,
+		maxLength: cfg.TenantIDMaxLength,
+		reserved:  map[string]struct{}{},
+	}
+	for _, id := range strings.Split(cfg.ReservedTenantIDs, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			t.reserved[id] = struct{}{}
+		}
+	}
+	if cfg.TenantIDMappingFile != "" {
+		buf, err := ioutil.ReadFile(cfg.TenantIDMappingFile)
+		if err != nil {
+			return nil, err
+		}
+		var mapping tenantIDMapping
+		if err := yaml.Unmarshal(buf, &mapping); err != nil {
+			return nil, err
+		}
+		t.mapping = mapping.Tenants
+	}
+	return t, nil
+}
+
+// normalise maps legacy tenant IDs to their replacements, and returns an
+// error if the result isn't valid.
+func (t *tenantIDs) normalise(id string) (string, error) {
+	if mapped, ok := t.mapping[id]; ok {
+		id = mapped
+	}
+	switch {
+	case t.maxLength > 0 && len(id) > t.maxLength:
+		return "", fmt.Errorf("tenant ID too long: %d characters, the limit is %d", len(id), t.maxLength)
+	case !t.pattern.MatchString(id):
+		return "", fmt.Errorf("invalid tenant ID %q: must match %s", id, t.pattern)
+	}
+	if _, ok := t.reserved[id]; ok {
+		return "", fmt.Errorf("reserved tenant ID %q", id)
+	}
+	return id, nil
+}
+
+// NewAuthMiddleware returns middleware propagating the tenant from each
+// request's X-Scope-OrgID header to its context, like
+// middleware.AuthenticateUser, but normalising and validating it per cfg.
+// Requests without a tenant are rejected with 401, and those with an invalid
+// one with 400.  If auth is disabled, every request gets the fake tenant,
+// whatever its header.
+func NewAuthMiddleware(cfg AuthConfig) (middleware.Interface, error) {
+	tenants, err := newTenantIDs(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.Enabled {
+		fakeTenantID, err := tenants.normalise(cfg.FakeTenantID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fake tenant ID: %v", err)
+		}
+		return middleware.Func(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				serveAs(next, w, r, fakeTenantID)
+			})
+		}), nil
+	}
+	return middleware.Func(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, _, err := user.ExtractFromHTTPRequest(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			userID, err = tenants.normalise(userID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			serveAs(next, w, r, userID)
+		})
+	}), nil
+}
+
+func serveAs(next http.Handler, w http.ResponseWriter, r *http.Request, userID string) {
+	// Requests may be forwarded, e.g. by the query frontend.
+	r.Header.Set(orgIDHeaderName, userID)
+	next.ServeHTTP(w, r.WithContext(user.Inject(r.Context(), userID)))
+}
+
+// AdminAuthConfig configures the authentication of the endpoints for
+// operators: the admin UI, and those showing every tenant's data.
+type AdminAuthConfig struct {
+	TokenFile string
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *AdminAuthConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.TokenFile, "admin.token-file", "", "File holding the bearer token requests to admin endpoints, like /admin, must carry in their Authorization header; if unset, admin endpoints are disabled.")
+}
+
+// NewAdminAuthMiddleware returns middleware only passing on requests with
+// the admin token in an "Authorization: Bearer" header.  Others are rejected
+// with 401, or every request with 403 if there's no token file.
+func NewAdminAuthMiddleware(cfg AdminAuthConfig) (middleware.Interface, error) {
+	var token []byte
+	if cfg.TokenFile != "" {
+		buf, err := ioutil.ReadFile(cfg.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		if token = bytes.TrimSpace(buf); len(token) == 0 {
+			return nil, fmt.Errorf("admin token file %s is empty", cfg.TokenFile)
+		}
+	}
+	return middleware.Func(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == nil {
+				http.Error(w, "admin endpoints are disabled without -admin.token-file", http.StatusForbidden)
+				return
+			}
+			const prefix = "Bearer "
+			header := r.Header.Get("Authorization")
+			if !strings.HasPrefix(header, prefix) || subtle.ConstantTimeCompare([]byte(header[len(prefix):]), token) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "invalid or missing admin token", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}), nil
+}
@@ -0,0 +1,128 @@
+package util
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/common/user"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	f, err := ioutil.TempFile("", "tenants")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("tenants:\n  \"legacy:1\": legacy-1\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	var cfg AuthConfig
+	cfg.RegisterFlags(flag.NewFlagSet("test", flag.PanicOnError))
+	cfg.TenantIDMaxLength = 10
+	cfg.TenantIDMappingFile = f.Name()
+	auth, err := NewAuthMiddleware(cfg)
+	require.NoError(t, err)
+
+	handler := auth.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := user.Extract(r.Context())
+		require.NoError(t, err)
+		assert.Equal(t, userID, r.Header.Get(orgIDHeaderName))
+		w.Write([]byte(userID))
+	}))
+
+	for _, tc := range []struct {
+		userID   string
+		status   int
+		expected string
+	}{
+		{"", http.StatusUnauthorized, ""},
+		{"acme", http.StatusOK, "acme"},
+		{"legacy:1", http.StatusOK, "legacy-1"},
+		{"a:b", http.StatusBadRequest, ""},
+		{"a/b", http.StatusBadRequest, ""},
+		{"..", http.StatusBadRequest, ""},
+		{strings.Repeat("a", 11), http.StatusBadRequest, ""},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tc.userID != "" {
+			req.Header.Set(orgIDHeaderName, tc.userID)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, tc.status, rec.Code, tc.userID)
+		if tc.status == http.StatusOK {
+			assert.Equal(t, tc.expected, rec.Body.String())
+		}
+	}
+}
+
+func TestAuthMiddlewareDisabled(t *testing.T) {
+	var cfg AuthConfig
+	cfg.RegisterFlags(flag.NewFlagSet("test", flag.PanicOnError))
+	cfg.Enabled = false
+	auth, err := NewAuthMiddleware(cfg)
+	require.NoError(t, err)
+
+	handler := auth.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := user.Extract(r.Context())
+		require.NoError(t, err)
+		w.Write([]byte(userID))
+	}))
+	for _, userID := range []string{"", "acme"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if userID != "" {
+			req.Header.Set(orgIDHeaderName, userID)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "fake", rec.Body.String())
+	}
+
+	cfg.FakeTenantID = "a:b"
+	_, err = NewAuthMiddleware(cfg)
+	assert.Error(t, err)
+}
+
+func TestAdminAuthMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	serve := func(auth http.Handler, header string) int {
+		req := httptest.NewRequest("GET", "/admin", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		auth.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Without a token, admin endpoints are disabled.
+	auth, err := NewAdminAuthMiddleware(AdminAuthConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, serve(auth.Wrap(ok), "Bearer "))
+
+	f, err := ioutil.TempFile("", "token")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("s3cret\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	auth, err = NewAdminAuthMiddleware(AdminAuthConfig{TokenFile: f.Name()})
+	require.NoError(t, err)
+	for header, expected := range map[string]int{
+		"":               http.StatusUnauthorized,
+		"s3cret":         http.StatusUnauthorized,
+		"Bearer wrong":   http.StatusUnauthorized,
+		"Bearer s3cret":  http.StatusOK,
+		"Bearer s3cret2": http.StatusUnauthorized,
+	} {
+		assert.Equal(t, expected, serve(auth.Wrap(ok), header), header)
+	}
+}
@@ -0,0 +1,164 @@
+package util
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/server"
+)
+
+// DebugConfig configures the /debug endpoints every component serves.
+type DebugConfig struct {
+	Enabled              bool
+	BlockProfileRate     int
+	MutexProfileFraction int
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *DebugConfig) RegisterFlags(f *flag.FlagSet) {
+	f.BoolVar(&cfg.Enabled, "debug.endpoints-enabled", false, "Serve /debug/pprof, /debug/fgprof (wall-clock profiles) and /debug/goroutines (goroutine dumps), to requests with the admin token.")
+	f.IntVar(&cfg.BlockProfileRate, "debug.block-profile-rate", 0, "Fraction of goroutine blocking events to report in the block profile, as in runtime.SetBlockProfileRate (0 to disable).")
+	f.IntVar(&cfg.MutexProfileFraction, "debug.mutex-profile-fraction", 0, "Fraction of mutex contention events to report in the mutex profile, as in runtime.SetMutexProfileFraction (0 to disable).")
+}
+
+// RegisterDebug sets the runtime's profiling rates, and adds the profiling
+// endpoints to serverCfg, behind adminAuth, or hides those it always serves
+// if they're disabled.  Other /debug paths are left alone.  It must be
+// called before the server is made.
+func RegisterDebug(cfg DebugConfig, serverCfg *server.Config, adminAuth middleware.Interface) {
+	runtime.SetBlockProfileRate(cfg.BlockProfileRate)
+	runtime.SetMutexProfileFraction(cfg.MutexProfileFraction)
+
+	serverCfg.HTTPMiddleware = append(serverCfg.HTTPMiddleware, middleware.Func(func(next http.Handler) http.Handler {
+		profiling := adminAuth.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/debug/fgprof":
+				wallClockProfile(w, r)
+			case "/debug/goroutines":
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				pprof.Lookup("goroutine").WriteTo(w, 2)
+			default:
+				next.ServeHTTP(w, r)
+			}
+		}))
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case !isProfilingPath(r.URL.Path):
+				next.ServeHTTP(w, r)
+			case !cfg.Enabled:
+				http.NotFound(w, r)
+			default:
+				profiling.ServeHTTP(w, r)
+			}
+		})
+	}))
+}
+
+func isProfilingPath(path string) bool {
+	return path == "/debug/fgprof" || path == "/debug/goroutines" || path == "/debug/pprof" || strings.HasPrefix(path, "/debug/pprof/")
+}
+
+const (
+	defaultProfileDuration = 30 * time.Second
+	defaultProfileHz       = 99
+	maxProfileHz           = 1000
+)
+
+// wallClockProfile samples every goroutine's stack, whether running or
+// waiting (unlike the CPU profile), for ?seconds= at ?hz=, and writes how
+// often each stack was seen in Brendan Gregg's folded format, for flame
+// graphs; like github.com/felixge/fgprof.  ?hz= is capped at 1000, as each
+// sample stops the world.
+func wallClockProfile(w http.ResponseWriter, r *http.Request) {
+	duration, hz := defaultProfileDuration, defaultProfileHz
+	if s := r.FormValue("seconds"); s != "" {
+		seconds, err := strconv.ParseFloat(s, 64)
+		if err != nil || seconds <= 0 {
+			http.Error(w, fmt.Sprintf("invalid seconds %q", s), http.StatusBadRequest)
+			return
+		}
+		duration = time.Duration(seconds * float64(time.Second))
+	}
+	if s := r.FormValue("hz"); s != "" {
+		var err error
+		if hz, err = strconv.Atoi(s); err != nil || hz <= 0 {
+			http.Error(w, fmt.Sprintf("invalid hz %q", s), http.StatusBadRequest)
+			return
+		}
+		hz = Min(hz, maxProfileHz)
+	}
+
+	var (
+		counts   = map[string]int{}
+		records  []runtime.StackRecord
+		ticker   = time.NewTicker(time.Second / time.Duration(hz))
+		deadline = time.NewTimer(duration)
+	)
+	defer ticker.Stop()
+	defer deadline.Stop()
+	for done := false; !done; {
+		select {
+		case <-ticker.C:
+			records = sampleStacks(records, counts)
+		case <-deadline.C:
+			done = true
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	stacks := make([]string, 0, len(counts))
+	for stack := range counts {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, stack := range stacks {
+		fmt.Fprintf(w, "%s %d\n", stack, counts[stack])
+	}
+}
+
+// sampleStacks counts every goroutine's folded stack, reusing records if
+// they're big enough.
+func sampleStacks(records []runtime.StackRecord, counts map[string]int) []runtime.StackRecord {
+	n, ok := runtime.GoroutineProfile(records)
+	for !ok {
+		records = make([]runtime.StackRecord, n+n/10+1)
+		n, ok = runtime.GoroutineProfile(records)
+	}
+	for _, record := range records[:n] {
+		counts[foldStack(record.Stack())]++
+	}
+	return records
+}
+
+// foldStack formats a stack root first, with frames separated by ';'.
+func foldStack(pcs []uintptr) string {
+	var names []string
+	frames := runtime.CallersFrames(pcs)
+	for {
+		frame, more := frames.Next()
+		names = append(names, frame.Function)
+		if !more {
+			break
+		}
+	}
+
+	var buf bytes.Buffer
+	for i := len(names) - 1; i >= 0; i-- {
+		buf.WriteString(names[i])
+		if i > 0 {
+			buf.WriteByte(';')
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,82 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/server"
+)
+
+func TestDebugEndpoints(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("next"))
+	})
+	adminAuth := middleware.Func(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer s3cret" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	getAs := func(cfg DebugConfig, path, authorization string) (int, string) {
+		var serverCfg server.Config
+		RegisterDebug(cfg, &serverCfg, adminAuth)
+		require.Len(t, serverCfg.HTTPMiddleware, 1)
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", authorization)
+		serverCfg.HTTPMiddleware[0].Wrap(next).ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+	get := func(cfg DebugConfig, path string) (int, string) {
+		return getAs(cfg, path, "Bearer s3cret")
+	}
+
+	code, body := get(DebugConfig{Enabled: true}, "/debug/goroutines")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "TestDebugEndpoints")
+
+	code, body = get(DebugConfig{Enabled: true}, "/debug/fgprof?seconds=0.05&hz=100")
+	assert.Equal(t, http.StatusOK, code)
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		if strings.Contains(line, "testing.tRunner;") && strings.Contains(line, "wallClockProfile") {
+			found = true
+		}
+	}
+	assert.True(t, found, body)
+
+	code, _ = get(DebugConfig{Enabled: true}, "/debug/fgprof?hz=0")
+	assert.Equal(t, http.StatusBadRequest, code)
+	// Capped, rather than ticking every nanosecond.
+	code, _ = get(DebugConfig{Enabled: true}, "/debug/fgprof?seconds=0.05&hz=2000000000")
+	assert.Equal(t, http.StatusOK, code)
+
+	_, body = get(DebugConfig{Enabled: true}, "/debug/pprof/")
+	assert.Equal(t, "next", body)
+	code, _ = get(DebugConfig{Enabled: false}, "/debug/pprof/")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = get(DebugConfig{Enabled: false}, "/debug/goroutines")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	_, body = get(DebugConfig{Enabled: false}, "/metrics")
+	assert.Equal(t, "next", body)
+	// Other components' /debug endpoints aren't hidden.
+	_, body = get(DebugConfig{Enabled: false}, "/debug/series")
+	assert.Equal(t, "next", body)
+
+	// Profiling endpoints need the admin token.
+	for _, path := range []string{"/debug/goroutines", "/debug/fgprof", "/debug/pprof/"} {
+		code, _ = getAs(DebugConfig{Enabled: true}, path, "")
+		assert.Equal(t, http.StatusUnauthorized, code, path)
+	}
+	_, body = getAs(DebugConfig{Enabled: true}, "/debug/series", "")
+	assert.Equal(t, "next", body)
+}
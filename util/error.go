@@ -1,12 +1,15 @@
 package util
 
-import "github.com/weaveworks/common/errors"
+import (
+	cortex_errors "github.com/weaveworks/cortex/util/errors"
+)
 
 // Errors returned by Cortex components.
-const (
-	ErrMissingMetricName         = errors.Error("sample missing metric name")
-	ErrInvalidMetricName         = errors.Error("sample invalid metric name")
-	ErrInvalidLabel              = errors.Error("sample invalid label")
-	ErrUserSeriesLimitExceeded   = errors.Error("per-user series limit exceeded")
-	ErrMetricSeriesLimitExceeded = errors.Error("per-metric series limit exceeded")
+var (
+	ErrMissingMetricName             = cortex_errors.New(cortex_errors.Validation, "sample missing metric name")
+	ErrInvalidMetricName             = cortex_errors.New(cortex_errors.Validation, "sample invalid metric name")
+	ErrInvalidLabel                  = cortex_errors.New(cortex_errors.Validation, "sample invalid label")
+	ErrUserSeriesLimitExceeded       = cortex_errors.New(cortex_errors.LimitExceeded, "per-user series limit exceeded")
+	ErrUserGlobalSeriesLimitExceeded = cortex_errors.New(cortex_errors.LimitExceeded, "per-user global series limit exceeded")
+	ErrMetricSeriesLimitExceeded     = cortex_errors.New(cortex_errors.LimitExceeded, "per-metric series limit exceeded")
 )
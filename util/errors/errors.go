@@ -0,0 +1,218 @@
+// Package errors defines the typed errors returned by Cortex components, and
+// their mapping onto gRPC codes and HTTP statuses, so that clients can tell
+// retryable failures from permanent ones.
+package errors
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Type classifies an Error.
+type Type int
+
+// Types of Error.
+const (
+	// Internal is used for errors we know nothing else about.
+	Internal Type = iota
+	// Validation errors mean the request was malformed and will never succeed.
+	Validation
+	// RateLimited errors mean the request should be retried later.
+	RateLimited
+	// LimitExceeded errors mean a tenant has hit a hard limit, such as the
+	// number of series; retrying won't help until the limit is raised.
+	LimitExceeded
+	// Unavailable errors mean not enough replicas or backends were available.
+	Unavailable
+	// TooManyChunks errors mean a query touched more chunks than allowed.
+	TooManyChunks
+)
+
+var typeNames = map[Type]string{
+	Internal:      "internal",
+	Validation:    "validation",
+	RateLimited:   "rate_limited",
+	LimitExceeded: "limit_exceeded",
+	Unavailable:   "unavailable",
+	TooManyChunks: "too_many_chunks",
+}
+
+func (t Type) String() string {
+	return typeNames[t]
+}
+
+// GRPCCode returns the gRPC code used to transport errors of this type.
+func (t Type) GRPCCode() codes.Code {
+	switch t {
+	case Validation:
+		return codes.InvalidArgument
+	case RateLimited, LimitExceeded:
+		return codes.ResourceExhausted
+	case Unavailable:
+		return codes.Unavailable
+	case TooManyChunks:
+		return codes.FailedPrecondition
+	default:
+		return codes.Internal
+	}
+}
+
+// HTTPStatus returns the HTTP status code used for errors of this type.
+func (t Type) HTTPStatus() int {
+	switch t {
+	case Validation:
+		return http.StatusBadRequest
+	case RateLimited:
+		return http.StatusTooManyRequests
+	case LimitExceeded:
+		return http.StatusInsufficientStorage
+	case Unavailable:
+		return http.StatusServiceUnavailable
+	case TooManyChunks:
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Retryable returns true if a request failing with this type of error may
+// succeed if sent again later.
+func (t Type) Retryable() bool {
+	switch t {
+	case Validation, LimitExceeded, TooManyChunks:
+		return false
+	default:
+		return true
+	}
+}
+
+func typeForCode(code codes.Code) Type {
+	switch code {
+	case codes.InvalidArgument:
+		return Validation
+	case codes.ResourceExhausted:
+		return RateLimited
+	case codes.Unavailable:
+		return Unavailable
+	case codes.FailedPrecondition:
+		return TooManyChunks
+	default:
+		return Internal
+	}
+}
+
+// Error is an error with a Type.
+type Error struct {
+	Type Type
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+// DetailedError is an Error with details, such as which samples of a push
+// failed, for HTTP clients.  The details don't survive ToGRPC.
+type DetailedError struct {
+	Type    Type
+	Msg     string
+	Details interface{}
+}
+
+func (e *DetailedError) Error() string {
+	return e.Msg
+}
+
+var (
+	knownMtx sync.RWMutex
+	known    = map[string]*Error{}
+)
+
+// New makes a new sentinel Error.  Sentinel errors survive a round trip
+// through ToGRPC and FromGRPC, so they can be compared by identity on
+// either side of a gRPC call.
+func New(t Type, msg string) *Error {
+	err := &Error{Type: t, Msg: msg}
+	knownMtx.Lock()
+	defer knownMtx.Unlock()
+	known[msg] = err
+	return err
+}
+
+// Errorf makes a new Error with a formatted message.
+func Errorf(t Type, format string, args ...interface{}) *Error {
+	return &Error{Type: t, Msg: fmt.Sprintf(format, args...)}
+}
+
+// TypeOf returns the Type of err, which may be an Error or an error returned
+// from a gRPC call.
+func TypeOf(err error) Type {
+	switch e := FromGRPC(err).(type) {
+	case *Error:
+		return e.Type
+	case *DetailedError:
+		return e.Type
+	default:
+		return Internal
+	}
+}
+
+// HTTPStatus returns the HTTP status code to use for err.
+func HTTPStatus(err error) int {
+	return TypeOf(err).HTTPStatus()
+}
+
+// Retryable returns true if the request that returned err may succeed if
+// sent again later.
+func Retryable(err error) bool {
+	return TypeOf(err).Retryable()
+}
+
+// ToGRPC converts err into an error suitable for returning from a gRPC
+// handler, preserving its Type as a gRPC code.
+func ToGRPC(err error) error {
+	switch e := err.(type) {
+	case *Error:
+		return grpc.Errorf(e.Type.GRPCCode(), "%s", e.Msg)
+	case *DetailedError:
+		return grpc.Errorf(e.Type.GRPCCode(), "%s", e.Msg)
+	}
+	return err
+}
+
+// FromGRPC converts an error returned from a gRPC call back into an Error,
+// returning the original sentinel where there is one. Errors which are not
+// gRPC errors are returned unchanged.
+func FromGRPC(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch err.(type) {
+	case *Error, *DetailedError:
+		return err
+	}
+	code := grpc.Code(err)
+	if code == codes.Unknown {
+		return err
+	}
+	desc := grpc.ErrorDesc(err)
+
+	knownMtx.RLock()
+	defer knownMtx.RUnlock()
+	if sentinel, ok := known[desc]; ok && sentinel.Type.GRPCCode() == code {
+		return sentinel
+	}
+	// Messages extending a sentinel's, like "<sentinel>; <more>", keep its
+	// type.
+	for msg, sentinel := range known {
+		if strings.HasPrefix(desc, msg+"; ") && sentinel.Type.GRPCCode() == code {
+			return &Error{Type: sentinel.Type, Msg: desc}
+		}
+	}
+	return &Error{Type: typeForCode(code), Msg: desc}
+}
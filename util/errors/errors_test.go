@@ -0,0 +1,64 @@
+package errors
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestRoundTrip(t *testing.T) {
+	sentinel := New(LimitExceeded, "test limit exceeded")
+
+	for _, c := range []struct {
+		err       error
+		expected  error
+		status    int
+		retryable bool
+	}{
+		{sentinel, sentinel, http.StatusInsufficientStorage, false},
+		{Errorf(Validation, "bad %s", "label"), &Error{Validation, "bad label"}, http.StatusBadRequest, false},
+		{Errorf(RateLimited, "slow down"), &Error{RateLimited, "slow down"}, http.StatusTooManyRequests, true},
+		{Errorf(Unavailable, "no replicas"), &Error{Unavailable, "no replicas"}, http.StatusServiceUnavailable, true},
+		{Errorf(TooManyChunks, "too many"), &Error{TooManyChunks, "too many"}, http.StatusUnprocessableEntity, false},
+		{Errorf(Validation, "bad label value %q", "100%s"), &Error{Validation, `bad label value "100%s"`}, http.StatusBadRequest, false},
+		{fmt.Errorf("boom"), fmt.Errorf("boom"), http.StatusInternalServerError, true},
+	} {
+		err := FromGRPC(ToGRPC(c.err))
+		assert.Equal(t, c.expected, err)
+		assert.Equal(t, c.status, HTTPStatus(err))
+		assert.Equal(t, c.retryable, Retryable(err))
+	}
+}
+
+func TestFromGRPCSentinelIdentity(t *testing.T) {
+	sentinel := New(RateLimited, "test rate limited")
+	err := FromGRPC(grpc.Errorf(codes.ResourceExhausted, "test rate limited"))
+	if err != sentinel {
+		t.Fatalf("expected sentinel, got %#v", err)
+	}
+
+	// Same message, different code: not the sentinel.
+	err = FromGRPC(grpc.Errorf(codes.Unavailable, "test rate limited"))
+	if err == sentinel || TypeOf(err) != Unavailable {
+		t.Fatalf("expected new unavailable error, got %#v", err)
+	}
+
+	// Extending the sentinel's message keeps its type.
+	limit := New(LimitExceeded, "test limit exceeded")
+	err = FromGRPC(ToGRPC(Errorf(LimitExceeded, "%v; and more", limit)))
+	if err == limit || TypeOf(err) != LimitExceeded {
+		t.Fatalf("expected new limit exceeded error, got %#v", err)
+	}
+}
+
+func TestDetailedError(t *testing.T) {
+	err := &DetailedError{Type: Validation, Msg: "bad samples (100%)", Details: []string{"a"}}
+	assert.Equal(t, Validation, TypeOf(err))
+	assert.Equal(t, http.StatusBadRequest, HTTPStatus(err))
+	// The details are lost through gRPC.
+	assert.Equal(t, &Error{Validation, "bad samples (100%)"}, FromGRPC(ToGRPC(err)))
+}
@@ -3,6 +3,7 @@ package util
 import (
 	"flag"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/prometheus/common/model"
@@ -22,6 +23,40 @@ func RegisterFlags(rs ...Registerer) {
 	}
 }
 
+// Flags whose names have any of these words, split on dots, dashes and
+// underscores, hold secrets, like -consul.acl-token.
+var secretFlagWords = map[string]bool{
+	"password":    true,
+	"secret":      true,
+	"token":       true,
+	"key":         true,
+	"credential":  true,
+	"credentials": true,
+}
+
+// RedactFlag returns the value of the flag named name to show, e.g. on a
+// status page: flags named as secrets are redacted, as are the passwords in
+// URLs, like the keys and secrets in AWS URLs.
+func RedactFlag(name, value string) string {
+	if value == "" {
+		return value
+	}
+	for _, word := range strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return r == '.' || r == '-' || r == '_'
+	}) {
+		if secretFlagWords[word] {
+			return "redacted"
+		}
+	}
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "redacted")
+			return u.String()
+		}
+	}
+	return value
+}
+
 // DayValue is a model.Time that can be used as a flag.
 // NB it only parses days!
 type DayValue struct {
@@ -80,3 +115,33 @@ func (v *URLValue) Set(s string) error {
 	v.URL = u
 	return nil
 }
+
+// TimeValue is a model.Time that can be used as a flag, parsed as RFC3339.
+type TimeValue struct {
+	model.Time
+	set bool
+}
+
+// String implements flag.Value
+func (v TimeValue) String() string {
+	if !v.set {
+		return ""
+	}
+	return v.Time.Time().UTC().Format(time.RFC3339)
+}
+
+// Set implements flag.Value
+func (v *TimeValue) Set(s string) error {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return err
+	}
+	v.Time = model.TimeFromUnixNano(t.UnixNano())
+	v.set = true
+	return nil
+}
+
+// IsSet returns true is the TimeValue has been set.
+func (v *TimeValue) IsSet() bool {
+	return v.set
+}
@@ -0,0 +1,37 @@
+package util
+
+import (
+	"flag"
+	"runtime/debug"
+
+	"github.com/prometheus/common/log"
+)
+
+// GCConfig configures the garbage collector.
+type GCConfig struct {
+	BallastBytes int
+	GCPercent    int
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *GCConfig) RegisterFlags(f *flag.FlagSet) {
+	f.IntVar(&cfg.BallastBytes, "mem-ballast-size-bytes", 0, "Size of memory ballast to allocate, raising the heap size the GC targets so it runs (and pauses) less often, without using physical memory.")
+	f.IntVar(&cfg.GCPercent, "gc-percent", 0, "Heap growth, in percent of the live heap, triggering a GC, as in GOGC (0 to use GOGC, or its default of 100; negative to disable GC).")
+}
+
+// ballast is never read, but is kept reachable so the GC counts it in the
+// live heap.  Untouched, its pages are never faulted in.
+var ballast []byte
+
+// ApplyGC allocates the ballast and sets the GC percent.  It should be
+// called once, early in main.
+func ApplyGC(cfg GCConfig) {
+	if cfg.BallastBytes > 0 {
+		ballast = make([]byte, cfg.BallastBytes)
+		log.Infof("Allocated %d byte memory ballast", len(ballast))
+	}
+	if cfg.GCPercent != 0 {
+		previous := debug.SetGCPercent(cfg.GCPercent)
+		log.Infof("Set GC percent to %d (was %d)", cfg.GCPercent, previous)
+	}
+}
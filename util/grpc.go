@@ -0,0 +1,60 @@
+package util
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+
+	"github.com/weaveworks/common/server"
+)
+
+const healthCheckMethod = "/grpc.health.v1.Health/Check"
+
+// NewServer makes a new server.Server, like server.New, which also serves the
+// standard gRPC health checking and reflection services, so load balancers,
+// Kubernetes probes and grpcurl work against any component.  Health checks
+// report the server as serving while ready returns true, or always if it's
+// nil.
+func NewServer(cfg server.Config, ready func() bool) (*server.Server, error) {
+	// Health checks don't carry a tenant, so they skip the component's own
+	// middleware, which may require one.
+	middleware := make([]grpc.UnaryServerInterceptor, 0, len(cfg.GRPCMiddleware))
+	for _, m := range cfg.GRPCMiddleware {
+		middleware = append(middleware, skipHealthChecks(m))
+	}
+	cfg.GRPCMiddleware = middleware
+
+	s, err := server.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	healthpb.RegisterHealthServer(s.GRPC, healthServer{ready})
+	reflection.Register(s.GRPC)
+	return s, nil
+}
+
+func skipHealthChecks(interceptor grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if info.FullMethod == healthCheckMethod {
+			return handler(ctx, req)
+		}
+		return interceptor(ctx, req, info, handler)
+	}
+}
+
+// healthServer reports the server's overall health, as whether it's ready.
+type healthServer struct {
+	ready func() bool
+}
+
+func (h healthServer) Check(_ context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if req.Service != "" {
+		return nil, grpc.Errorf(codes.NotFound, "unknown service")
+	}
+	if h.ready != nil && !h.ready() {
+		return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING}, nil
+	}
+	return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+}
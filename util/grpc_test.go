@@ -0,0 +1,47 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/weaveworks/common/middleware"
+)
+
+func TestSkipHealthChecks(t *testing.T) {
+	interceptor := skipHealthChecks(middleware.ServerUserHeaderInterceptor)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+
+	// Health checks don't need a tenant, but everything else still does.
+	resp, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: healthCheckMethod}, handler)
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", resp)
+	_, err = interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/cortex.Ingester/Push"}, handler)
+	assert.Error(t, err)
+}
+
+func TestHealthServer(t *testing.T) {
+	ready := false
+	h := healthServer{func() bool { return ready }}
+
+	resp, err := h.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.Status)
+
+	ready = true
+	resp, err = h.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+
+	resp, err = healthServer{}.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+
+	_, err = h.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "cortex.Ingester"})
+	assert.Error(t, err)
+}
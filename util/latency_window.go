@@ -0,0 +1,68 @@
+package util
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// LatencyWindow keeps the most recent latencies of some operation, to work
+// out percentiles of them, e.g. for hedging requests.
+type LatencyWindow struct {
+	minSamples int
+
+	mtx       sync.Mutex
+	latencies []time.Duration
+	next      int
+
+	// A sorted copy of latencies for percentiles, sorted again once a tenth
+	// of the window has been observed since, rather than on every call.
+	sorted   durations
+	unsorted int
+}
+
+// NewLatencyWindow makes a new LatencyWindow of the given size, which needs
+// minSamples latencies before it will return percentiles.
+func NewLatencyWindow(size, minSamples int) *LatencyWindow {
+	return &LatencyWindow{
+		minSamples: minSamples,
+		latencies:  make([]time.Duration, 0, size),
+	}
+}
+
+// Observe records a latency, replacing the oldest once the window is full.
+func (w *LatencyWindow) Observe(latency time.Duration) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.unsorted++
+	if len(w.latencies) < cap(w.latencies) {
+		w.latencies = append(w.latencies, latency)
+		return
+	}
+	w.latencies[w.next] = latency
+	w.next = (w.next + 1) % len(w.latencies)
+}
+
+// Percentile returns the given percentile of the latencies in the window,
+// if there are enough of them.  It may not reflect the latest tenth of the
+// window.
+func (w *LatencyWindow) Percentile(percentile float64) (time.Duration, bool) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if len(w.latencies) < w.minSamples || len(w.latencies) == 0 {
+		return 0, false
+	}
+	if w.sorted == nil || w.unsorted*10 >= cap(w.latencies) {
+		w.sorted = append(w.sorted[:0], w.latencies...)
+		sort.Sort(w.sorted)
+		w.unsorted = 0
+	}
+	idx := int(percentile * float64(len(w.sorted)-1))
+	return w.sorted[idx], true
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
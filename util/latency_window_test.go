@@ -0,0 +1,30 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyWindow(t *testing.T) {
+	w := NewLatencyWindow(20, 10)
+	for i := 1; i < 10; i++ {
+		w.Observe(time.Duration(i))
+	}
+	if _, ok := w.Percentile(0.5); ok {
+		t.Fatal("expected no percentile before minSamples latencies")
+	}
+	w.Observe(10)
+	if p, ok := w.Percentile(1); !ok || p != 10 {
+		t.Fatalf("expected 10, got %v (%v)", p, ok)
+	}
+
+	// The window isn't sorted again until a tenth of it is new.
+	w.Observe(100)
+	if p, _ := w.Percentile(1); p != 10 {
+		t.Fatalf("expected 10 until the window is sorted again, got %v", p)
+	}
+	w.Observe(200)
+	if p, _ := w.Percentile(1); p != 200 {
+		t.Fatalf("expected 200, got %v", p)
+	}
+}
@@ -0,0 +1,51 @@
+package util
+
+import (
+	"bytes"
+	"sync"
+)
+
+// MultiError collects errors from concurrent operations; it is safe for
+// concurrent use.
+type MultiError struct {
+	mtx  sync.Mutex
+	errs []error
+}
+
+// Add records err, if it isn't nil.
+func (m *MultiError) Add(err error) {
+	if err == nil {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.errs = append(m.errs, err)
+}
+
+// Err returns nil if no errors were added, the error if only one was, or
+// an error combining all of them.
+func (m *MultiError) Err() error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	switch len(m.errs) {
+	case 0:
+		return nil
+	case 1:
+		return m.errs[0]
+	}
+	return multiError(append([]error{}, m.errs...))
+}
+
+type multiError []error
+
+func (es multiError) Error() string {
+	var buf bytes.Buffer
+	buf.WriteString("multiple errors: ")
+	for i, err := range es {
+		if i > 0 {
+			buf.WriteString("; ")
+		}
+		buf.WriteString(err.Error())
+	}
+	return buf.String()
+}
@@ -0,0 +1,25 @@
+package util
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMultiError(t *testing.T) {
+	var errs MultiError
+	if err := errs.Err(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	errs.Add(nil)
+	first := fmt.Errorf("first")
+	errs.Add(first)
+	if err := errs.Err(); err != first {
+		t.Fatalf("Expected first error, got %v", err)
+	}
+
+	errs.Add(fmt.Errorf("second"))
+	if err := errs.Err(); err == nil || err.Error() != "multiple errors: first; second" {
+		t.Fatalf("Expected combined error, got %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package util
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var poolGets = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cortex_pool_gets_total",
+	Help: "The total number of objects got from pools, by whether they were reused (hit) or allocated (miss).",
+}, []string{"pool", "result"})
+
+func init() {
+	prometheus.MustRegister(poolGets)
+}
+
+// Pool is a sync.Pool which counts how often it reuses objects.
+type Pool struct {
+	pool         sync.Pool
+	new          func() interface{}
+	hits, misses prometheus.Counter
+}
+
+// NewPool makes a new Pool, named for its metrics, calling new when it has
+// nothing to reuse.
+func NewPool(name string, new func() interface{}) *Pool {
+	return &Pool{
+		new:    new,
+		hits:   poolGets.WithLabelValues(name, "hit"),
+		misses: poolGets.WithLabelValues(name, "miss"),
+	}
+}
+
+// Get returns an object from the pool, or a new one.
+func (p *Pool) Get() interface{} {
+	if x := p.pool.Get(); x != nil {
+		p.hits.Inc()
+		return x
+	}
+	p.misses.Inc()
+	return p.new()
+}
+
+// Put returns x to the pool; it must not be used afterwards.
+func (p *Pool) Put(x interface{}) {
+	p.pool.Put(x)
+}
+
+// Buffers bigger than this aren't pooled, so one huge response doesn't pin
+// its memory forever.
+const maxPooledBufferSize = 4 << 20
+
+// BufferPool is a Pool of bytes.Buffers.
+type BufferPool struct {
+	pool *Pool
+}
+
+// NewBufferPool makes a new BufferPool, named for its metrics.
+func NewBufferPool(name string) *BufferPool {
+	return &BufferPool{
+		pool: NewPool(name, func() interface{} {
+			return &bytes.Buffer{}
+		}),
+	}
+}
+
+// Get returns an empty buffer.
+func (p *BufferPool) Get() *bytes.Buffer {
+	buf := p.pool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// Put returns buf to the pool; neither it nor any slice of its contents may
+// be used afterwards.
+func (p *BufferPool) Put(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	p.pool.Put(buf)
+}
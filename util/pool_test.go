@@ -0,0 +1,24 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferPool(t *testing.T) {
+	pool := NewBufferPool("test")
+	buf := pool.Get()
+	assert.Equal(t, 0, buf.Len())
+	buf.WriteString("hello")
+	pool.Put(buf)
+
+	// Whether or not it was reused, the buffer we get is empty.
+	buf = pool.Get()
+	assert.Equal(t, 0, buf.Len())
+
+	// Huge buffers are dropped.
+	buf.Grow(maxPooledBufferSize + 1)
+	pool.Put(buf)
+	assert.True(t, pool.Get().Cap() <= maxPooledBufferSize)
+}
@@ -0,0 +1,213 @@
+// Package service orders the starting and stopping of a process'
+// components, by their dependencies on one another.
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/common/log"
+)
+
+// State is where a Service is in its lifecycle.
+type State int
+
+// States of a Service.
+const (
+	New State = iota
+	Starting
+	Running
+	Stopping
+	Terminated
+	Failed
+)
+
+func (s State) String() string {
+	switch s {
+	case New:
+		return "New"
+	case Starting:
+		return "Starting"
+	case Running:
+		return "Running"
+	case Stopping:
+		return "Stopping"
+	case Terminated:
+		return "Terminated"
+	case Failed:
+		return "Failed"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+// Service is a component of a process.
+type Service interface {
+	// Start returns once the service is ready to be depended on.
+	Start() error
+	// Stop returns once the service has stopped.
+	Stop()
+}
+
+// Funcs makes a Service of a pair of functions, either of which may be nil.
+type Funcs struct {
+	StartFunc func() error
+	StopFunc  func()
+}
+
+// Start implements Service.
+func (f Funcs) Start() error {
+	if f.StartFunc == nil {
+		return nil
+	}
+	return f.StartFunc()
+}
+
+// Stop implements Service.
+func (f Funcs) Stop() {
+	if f.StopFunc != nil {
+		f.StopFunc()
+	}
+}
+
+type entry struct {
+	service Service
+	deps    []string
+	state   State
+}
+
+// Manager starts services after those they depend on, and stops them in the
+// reverse order.
+type Manager struct {
+	mtx      sync.Mutex
+	services map[string]*entry
+	names    []string // In the order added.
+	started  []string // In the order started.
+}
+
+// NewManager makes a new Manager.
+func NewManager() *Manager {
+	return &Manager{
+		services: map[string]*entry{},
+	}
+}
+
+// Add adds a service, which depends on the services named deps.
+func (m *Manager) Add(name string, s Service, deps ...string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.services[name]; ok {
+		panic(fmt.Sprintf("service %q added twice", name))
+	}
+	m.services[name] = &entry{service: s, deps: deps}
+	m.names = append(m.names, name)
+}
+
+// Start starts every service, each once those it depends on are running.  If
+// one fails to start, those already running are stopped.
+func (m *Manager) Start() error {
+	order, err := m.order()
+	if err != nil {
+		return err
+	}
+	for _, name := range order {
+		m.setState(name, Starting)
+		log.Infof("Starting %s", name)
+		if err := m.services[name].service.Start(); err != nil {
+			m.setState(name, Failed)
+			m.Stop()
+			return fmt.Errorf("error starting %s: %v", name, err)
+		}
+		m.mtx.Lock()
+		m.services[name].state = Running
+		m.started = append(m.started, name)
+		m.mtx.Unlock()
+	}
+	return nil
+}
+
+// Stop stops the running services, each before those it depends on.
+func (m *Manager) Stop() {
+	m.mtx.Lock()
+	started := m.started
+	m.started = nil
+	m.mtx.Unlock()
+
+	for i := len(started) - 1; i >= 0; i-- {
+		name := started[i]
+		m.setState(name, Stopping)
+		log.Infof("Stopping %s", name)
+		m.services[name].service.Stop()
+		m.setState(name, Terminated)
+	}
+}
+
+// State returns the state of the named service.
+func (m *Manager) State(name string) State {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	e, ok := m.services[name]
+	if !ok {
+		return New
+	}
+	return e.state
+}
+
+// ServeHTTP lists the services and their states.
+func (m *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, name := range m.names {
+		fmt.Fprintf(w, "%s\t%v\n", name, m.services[name].state)
+	}
+}
+
+func (m *Manager) setState(name string, state State) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.services[name].state = state
+}
+
+// order returns the services in an order they can be started in: each after
+// those it depends on, and otherwise in the order added.
+func (m *Manager) order() ([]string, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	marks := map[string]int{}
+	order := make([]string, 0, len(m.names))
+	var visit func(name string, from string) error
+	visit = func(name string, from string) error {
+		e, ok := m.services[name]
+		if !ok {
+			return fmt.Errorf("%s depends on unknown service %s", from, name)
+		}
+		switch marks[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("dependency cycle through %s", name)
+		}
+		marks[name] = visiting
+		for _, dep := range e.deps {
+			if err := visit(dep, name); err != nil {
+				return err
+			}
+		}
+		marks[name] = visited
+		order = append(order, name)
+		return nil
+	}
+	for _, name := range m.names {
+		if err := visit(name, ""); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recorder struct {
+	events []string
+}
+
+func (r *recorder) service(name string, err error) Service {
+	return Funcs{
+		StartFunc: func() error {
+			r.events = append(r.events, "start "+name)
+			return err
+		},
+		StopFunc: func() {
+			r.events = append(r.events, "stop "+name)
+		},
+	}
+}
+
+func TestManager(t *testing.T) {
+	var r recorder
+	m := NewManager()
+	m.Add("ingester", r.service("ingester", nil), "ring", "store")
+	m.Add("store", r.service("store", nil))
+	m.Add("ring", r.service("ring", nil))
+	m.Add("server", r.service("server", nil), "ingester")
+
+	require.NoError(t, m.Start())
+	assert.Equal(t, []string{"start ring", "start store", "start ingester", "start server"}, r.events)
+	assert.Equal(t, Running, m.State("ingester"))
+
+	r.events = nil
+	m.Stop()
+	assert.Equal(t, []string{"stop server", "stop ingester", "stop store", "stop ring"}, r.events)
+	assert.Equal(t, Terminated, m.State("ingester"))
+
+	// Stopping again is a no-op.
+	r.events = nil
+	m.Stop()
+	assert.Empty(t, r.events)
+}
+
+func TestManagerStartFailure(t *testing.T) {
+	var r recorder
+	m := NewManager()
+	m.Add("ring", r.service("ring", nil))
+	m.Add("ingester", r.service("ingester", fmt.Errorf("boom")), "ring")
+	m.Add("server", r.service("server", nil), "ingester")
+
+	assert.Error(t, m.Start())
+	assert.Equal(t, []string{"start ring", "start ingester", "stop ring"}, r.events)
+	assert.Equal(t, Terminated, m.State("ring"))
+	assert.Equal(t, Failed, m.State("ingester"))
+	assert.Equal(t, New, m.State("server"))
+}
+
+func TestManagerInvalidDependencies(t *testing.T) {
+	var r recorder
+	m := NewManager()
+	m.Add("a", r.service("a", nil), "b")
+	m.Add("b", r.service("b", nil), "a")
+	assert.Error(t, m.Start())
+
+	m = NewManager()
+	m.Add("a", r.service("a", nil), "missing")
+	assert.Error(t, m.Start())
+	assert.Empty(t, r.events)
+}
@@ -0,0 +1,22 @@
+package util
+
+import (
+	"math"
+
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// StaleNaN is the bit pattern of the signalling NaN Prometheus uses to
+	// mark a series as stale, ie as having disappeared from its target.
+	StaleNaN uint64 = 0x7ff0000000000002
+
+	// Arithmetic on a signalling NaN (as done by the delta chunk encodings)
+	// sets its quiet bit, so we ignore it when looking for stale markers.
+	quietNaNBit uint64 = 0x0008000000000000
+)
+
+// IsStaleNaN returns true if v is a staleness marker.
+func IsStaleNaN(v model.SampleValue) bool {
+	return math.Float64bits(float64(v))&^quietNaNBit == StaleNaN
+}
@@ -0,0 +1,35 @@
+package util
+
+import (
+	"math"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsStaleNaN(t *testing.T) {
+	stale := model.SampleValue(math.Float64frombits(StaleNaN))
+	assert.True(t, IsStaleNaN(stale))
+	assert.False(t, IsStaleNaN(model.SampleValue(math.NaN())))
+	assert.False(t, IsStaleNaN(1))
+
+	// Staleness markers must survive being encoded into a chunk.
+	for _, encoding := range []chunk.Encoding{chunk.Delta, chunk.DoubleDelta, chunk.Varbit} {
+		c, err := chunk.NewForEncoding(encoding)
+		require.NoError(t, err)
+		cs, err := c.Add(model.SamplePair{Timestamp: 1, Value: 1})
+		require.NoError(t, err)
+		cs, err = cs[0].Add(model.SamplePair{Timestamp: 2, Value: stale})
+		require.NoError(t, err)
+
+		values, err := chunk.RangeValues(cs[0].NewIterator(), metric.Interval{OldestInclusive: 0, NewestInclusive: 3})
+		require.NoError(t, err)
+		require.Len(t, values, 2)
+		assert.False(t, IsStaleNaN(values[0].Value), "%v", encoding)
+		assert.True(t, IsStaleNaN(values[1].Value), "%v", encoding)
+	}
+}
@@ -0,0 +1,75 @@
+package validation
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	overridesDesc = prometheus.NewDesc(
+		"cortex_overrides",
+		"The effective value of each limit for users with overrides; durations in seconds.",
+		[]string{"limit_name", "user"}, nil,
+	)
+	overridesDefaultsDesc = prometheus.NewDesc(
+		"cortex_overrides_defaults",
+		"The default value of each limit; durations in seconds.",
+		[]string{"limit_name"}, nil,
+	)
+)
+
+// OverridesExporter exports the default limits, and the effective limits of
+// every user with overrides, so rules can compare usage against them.
+type OverridesExporter struct {
+	overrides *Overrides
+}
+
+// NewOverridesExporter makes a new OverridesExporter.
+func NewOverridesExporter(overrides *Overrides) *OverridesExporter {
+	return &OverridesExporter{overrides: overrides}
+}
+
+// Describe implements prometheus.Collector.
+func (e *OverridesExporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- overridesDesc
+	ch <- overridesDefaultsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (e *OverridesExporter) Collect(ch chan<- prometheus.Metric) {
+	e.overrides.mtx.RLock()
+	defer e.overrides.mtx.RUnlock()
+
+	forEachLimit(&e.overrides.defaults, func(name string, value float64) {
+		ch <- prometheus.MustNewConstMetric(overridesDefaultsDesc, prometheus.GaugeValue, value, name)
+	})
+	for userID, limits := range e.overrides.overrides {
+		forEachLimit(limits, func(name string, value float64) {
+			ch <- prometheus.MustNewConstMetric(overridesDesc, prometheus.GaugeValue, value, name, userID)
+		})
+	}
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// forEachLimit calls f with the name (as in the overrides file) and value of
+// every numeric limit.
+func forEachLimit(limits *Limits, f func(name string, value float64)) {
+	v := reflect.ValueOf(limits).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		field := v.Field(i)
+		switch {
+		case name == "":
+		case field.Type() == durationType:
+			f(name, time.Duration(field.Int()).Seconds())
+		case field.Kind() >= reflect.Int && field.Kind() <= reflect.Int64:
+			f(name, float64(field.Int()))
+		case field.Kind() == reflect.Float32 || field.Kind() == reflect.Float64:
+			f(name, field.Float())
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package validation
+
+import (
+	"flag"
+	"strings"
+	"time"
+)
+
+// DefaultMaxSeriesPerMetric is the maximum number of series in one metric
+// (of a single user), unless configured or overridden.
+const DefaultMaxSeriesPerMetric = 50000
+
+// The defaults of each component's Limits are given by these flags, so the
+// overrides exporter can be run with the same arguments as the components.
+
+// RegisterIngesterFlags adds the flags of the ingester's limits to the given
+// FlagSet.
+func (l *Limits) RegisterIngesterFlags(f *flag.FlagSet) {
+	f.DurationVar(&l.MaxChunkIdle, "ingester.max-chunk-idle", 1*time.Hour, "Maximum chunk idle time before flushing.")
+	f.DurationVar(&l.MaxChunkAge, "ingester.max-chunk-age", 12*time.Hour, "Maximum chunk age time before flushing.")
+	f.IntVar(&l.MaxSeriesPerMetric, "ingester.max-series-per-metric", DefaultMaxSeriesPerMetric, "Maximum number of active series per metric name, unless overridden for the user.")
+}
+
+// RegisterDistributorFlags adds the flags of the distributor's limits to the
+// given FlagSet.
+func (l *Limits) RegisterDistributorFlags(f *flag.FlagSet) {
+	f.DurationVar(&l.CreationGracePeriod, "distributor.creation-grace-period", 10*time.Minute, "Reject samples with timestamps further than this in the future (0 to disable).")
+	f.DurationVar(&l.MaxSampleAge, "distributor.max-sample-age", 0, "Reject samples with timestamps older than this (0 to disable).")
+}
+
+// RegisterPushgatewayFlags adds the flags of the distributor's Pushgateway's
+// limits to the given FlagSet.
+func (l *Limits) RegisterPushgatewayFlags(f *flag.FlagSet) {
+	f.IntVar(&l.PushgatewayMaxGroups, "distributor.pushgateway.max-groups-per-user", 1000, "Maximum number of groups per user, unless overridden for the user (0 for no limit).")
+	f.IntVar(&l.PushgatewayMaxSeries, "distributor.pushgateway.max-series-per-user", 100000, "Maximum number of series in all of a user's groups, unless overridden for the user (0 for no limit).")
+}
+
+// RegisterQuerierFlags adds the flags of the querier's limits to the given
+// FlagSet.
+func (l *Limits) RegisterQuerierFlags(f *flag.FlagSet) {
+	l.registerMaxQueryResponseSizeFlag(f)
+	f.DurationVar(&l.MaxQueryLookback, "querier.max-query-lookback", 0, "Clamp the start of queries to this long ago, with a warning, as older data isn't kept; unless overridden for the user (0 for no limit).")
+}
+
+// RegisterFrontendFlags adds the flags of the query frontend's limits to the
+// given FlagSet.
+func (l *Limits) RegisterFrontendFlags(f *flag.FlagSet) {
+	l.registerMaxQueryResponseSizeFlag(f)
+	l.registerQueryRateFlags(f)
+}
+
+// The querier and query frontend share the response size limit.
+func (l *Limits) registerMaxQueryResponseSizeFlag(f *flag.FlagSet) {
+	f.IntVar(&l.MaxQueryResponseSize, "querier.max-response-size-bytes", 0, "Reject queries whose responses are larger than this many bytes, unless overridden for the user; the query frontend limits range queries' merged responses (0 for no limit).")
+}
+
+func (l *Limits) registerQueryRateFlags(f *flag.FlagSet) {
+	f.Float64Var(&l.QueryRateLimit, "querier.query-rate-limit", 0, "Per-user rate limit of query requests, per second, unless overridden for the user (0 for no limit).")
+	f.IntVar(&l.QueryBurstSize, "querier.query-burst-size", 10, "Per-user burst of query requests allowed, unless overridden for the user.")
+}
+
+// RegisterRulerFlags adds the flags of the ruler's limits to the given
+// FlagSet.
+func (l *Limits) RegisterRulerFlags(f *flag.FlagSet) {
+	f.DurationVar(&l.RulerEvaluationDelay, "ruler.evaluation-delay-duration", 0, "How far behind real time to evaluate rules, to allow for samples arriving late (e.g. via remote write) unless overridden for the user.")
+}
+
+// RegisterAlertmanagerFlags adds the flags of the alertmanager's limits to
+// the given FlagSet.
+func (l *Limits) RegisterAlertmanagerFlags(f *flag.FlagSet) {
+	f.Float64Var(&l.AlertmanagerNotificationRateLimit, "alertmanager.notification-rate-limit", 0, "Per-user rate limit of notifications, per second, unless overridden for the user (0 for no limit).")
+	f.IntVar(&l.AlertmanagerNotificationBurstSize, "alertmanager.notification-burst-size", 1, "Per-user burst of notifications allowed, unless overridden for the user.")
+	f.Var((*stringsValue)(&l.AlertmanagerReceiversBlockCIDRNetworks), "alertmanager.receivers-firewall.block.cidr-networks", "Network, in CIDR notation, receivers may not send notifications to, unless overridden for the user (may be repeated).")
+	f.BoolVar(&l.AlertmanagerReceiversBlockPrivateAddresses, "alertmanager.receivers-firewall.block.private-addresses", false, "Block receivers from sending notifications to loopback, link-local and private addresses, unless overridden for the user.")
+}
+
+// RegisterFlags adds the flags of every component's limits to the given
+// FlagSet.
+func (l *Limits) RegisterFlags(f *flag.FlagSet) {
+	l.RegisterIngesterFlags(f)
+	l.RegisterDistributorFlags(f)
+	l.RegisterPushgatewayFlags(f)
+	l.RegisterQuerierFlags(f)
+	l.registerQueryRateFlags(f)
+	l.RegisterRulerFlags(f)
+	l.RegisterAlertmanagerFlags(f)
+}
+
+// stringsValue is a []string flag, appended to each time it's given.
+type stringsValue []string
+
+func (v *stringsValue) String() string {
+	return strings.Join(*v, ",")
+}
+
+func (v *stringsValue) Set(s string) error {
+	*v = append(*v, s)
+	return nil
+}
@@ -0,0 +1,48 @@
+package validation
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterFlags(t *testing.T) {
+	var l Limits
+	f := flag.NewFlagSet("test", flag.PanicOnError)
+	l.RegisterFlags(f)
+	require.NoError(t, f.Parse([]string{
+		"-ingester.max-chunk-idle=2h",
+		"-querier.max-response-size-bytes=100",
+		"-alertmanager.receivers-firewall.block.cidr-networks=10.0.0.0/8",
+		"-alertmanager.receivers-firewall.block.cidr-networks=192.168.0.0/16",
+	}))
+	assert.Equal(t, 2*time.Hour, l.MaxChunkIdle)
+	assert.Equal(t, DefaultMaxSeriesPerMetric, l.MaxSeriesPerMetric)
+	assert.Equal(t, 100, l.MaxQueryResponseSize)
+	assert.Equal(t, 10, l.QueryBurstSize)
+	assert.Equal(t, []string{"10.0.0.0/8", "192.168.0.0/16"}, l.AlertmanagerReceiversBlockCIDRNetworks)
+
+	// Each component registers the same flags as RegisterFlags.
+	for _, register := range []func(*Limits, *flag.FlagSet){
+		(*Limits).RegisterIngesterFlags,
+		(*Limits).RegisterDistributorFlags,
+		(*Limits).RegisterPushgatewayFlags,
+		(*Limits).RegisterQuerierFlags,
+		(*Limits).RegisterFrontendFlags,
+		(*Limits).RegisterRulerFlags,
+		(*Limits).RegisterAlertmanagerFlags,
+	} {
+		var component Limits
+		cf := flag.NewFlagSet("component", flag.PanicOnError)
+		register(&component, cf)
+		cf.VisitAll(func(cflag *flag.Flag) {
+			all := f.Lookup(cflag.Name)
+			if assert.NotNil(t, all, cflag.Name) {
+				assert.Equal(t, all.DefValue, cflag.DefValue, cflag.Name)
+			}
+		})
+	}
+}
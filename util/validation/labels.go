@@ -0,0 +1,70 @@
+package validation
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+	cortex_errors "github.com/weaveworks/cortex/util/errors"
+)
+
+// NormalizeLabels returns a series' labels sorted by name, without empty
+// values (which Prometheus treats as absent) or repeats of the same label,
+// sorting a copy if needed.  Label sets which can't be normalized, having
+// invalid label names, or repeated names with different values, are rejected
+// with the reason and a validation error, rather than being indexed under
+// labels they could never be queried by.
+func NormalizeLabels(labels []cortex.LabelPair) ([]cortex.LabelPair, string, error) {
+	normalized := true
+	for i, label := range labels {
+		if !model.LabelName(label.Name).IsValid() {
+			return nil, InvalidLabel, cortex_errors.Errorf(cortex_errors.Validation, "invalid label name %q in series %s", label.Name, formatLabels(labels))
+		}
+		if len(label.Value) == 0 || (i > 0 && bytes.Compare(labels[i-1].Name, label.Name) >= 0) {
+			normalized = false
+		}
+	}
+	if normalized {
+		return labels, "", nil
+	}
+
+	sorted := make(util.ByLabelName, 0, len(labels))
+	for _, label := range labels {
+		if len(label.Value) > 0 {
+			sorted = append(sorted, label)
+		}
+	}
+	sort.Stable(sorted)
+
+	result := sorted[:0]
+	for _, label := range sorted {
+		if n := len(result); n > 0 && bytes.Equal(result[n-1].Name, label.Name) {
+			if !bytes.Equal(result[n-1].Value, label.Value) {
+				return nil, DuplicateLabelNames, cortex_errors.Errorf(cortex_errors.Validation, "label %q has more than one value (%q and %q) in series %s", label.Name, result[n-1].Value, label.Value, formatLabels(labels))
+			}
+			continue
+		}
+		result = append(result, label)
+	}
+	return result, "", nil
+}
+
+// formatLabels formats labels in the order given, like a model.Metric.
+func formatLabels(labels []cortex.LabelPair) string {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, label := range labels {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.Write(label.Name)
+		buf.WriteString("=\"")
+		buf.Write(label.Value)
+		buf.WriteByte('"')
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
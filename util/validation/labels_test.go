@@ -0,0 +1,47 @@
+package validation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/weaveworks/cortex"
+	cortex_errors "github.com/weaveworks/cortex/util/errors"
+)
+
+func TestNormalizeLabels(t *testing.T) {
+	labels := func(nameValues ...string) []cortex.LabelPair {
+		result := []cortex.LabelPair{}
+		for i := 0; i < len(nameValues); i += 2 {
+			result = append(result, cortex.LabelPair{Name: []byte(nameValues[i]), Value: []byte(nameValues[i+1])})
+		}
+		return result
+	}
+
+	for _, c := range []struct {
+		in, out []cortex.LabelPair
+		reason  string
+	}{
+		{labels("__name__", "foo", "a", "1", "b", "2"), labels("__name__", "foo", "a", "1", "b", "2"), ""},
+		{labels("b", "2", "__name__", "foo", "a", "1"), labels("__name__", "foo", "a", "1", "b", "2"), ""},
+		{labels("__name__", "foo", "a", "", "b", "2"), labels("__name__", "foo", "b", "2"), ""},
+		{labels("__name__", "foo", "a", "1", "a", "1"), labels("__name__", "foo", "a", "1"), ""},
+		{labels("__name__", "foo", "a", "1", "b", "2", "a", "3"), nil, DuplicateLabelNames},
+		{labels("__name__", "foo", "a-b", "1"), nil, InvalidLabel},
+		{labels("__name__", "foo", "", "1"), nil, InvalidLabel},
+	} {
+		in := formatLabels(c.in)
+		out, reason, err := NormalizeLabels(c.in)
+		assert.Equal(t, c.reason, reason, in)
+		if c.reason == "" {
+			assert.NoError(t, err, in)
+			assert.Equal(t, c.out, out, in)
+		} else {
+			assert.Equal(t, cortex_errors.Validation, cortex_errors.TypeOf(err), in)
+		}
+		assert.Equal(t, in, formatLabels(c.in), "input modified")
+	}
+
+	_, _, err := NormalizeLabels(labels("__name__", "foo", "a", "1", "a", "2"))
+	assert.EqualError(t, err, `label "a" has more than one value ("1" and "2") in series {__name__="foo", a="1", a="2"}`)
+}
@@ -0,0 +1,154 @@
+package validation
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Limits describe the per-tenant settings which may be overridden at
+// runtime.  Defaults come from the command line flags of the component
+// using them; see Overrides.
+type Limits struct {
+	// Ingester.
+	MaxChunkAge  time.Duration `yaml:"max_chunk_age"`
+	MaxChunkIdle time.Duration `yaml:"max_chunk_idle"`
+
+	// A runaway metric, e.g. a histogram with an unbounded label, is more
+	// often the problem than a user's total series.
+	MaxSeriesPerMetric int `yaml:"max_series_per_metric"`
+
+	// Distributor.
+	CreationGracePeriod time.Duration `yaml:"creation_grace_period"`
+	MaxSampleAge        time.Duration `yaml:"max_sample_age"`
+	// Of the groups pushed to the Pushgateway, and the series in them; 0 for
+	// no limit.
+	PushgatewayMaxGroups int `yaml:"pushgateway_max_groups"`
+	PushgatewayMaxSeries int `yaml:"pushgateway_max_series"`
+
+	// Regexps of metric names, anchored at both ends.  If there is an
+	// allowlist, only metrics matching it are accepted; metrics matching the
+	// denylist never are.
+	MetricAllowlist []string `yaml:"metric_allowlist"`
+	MetricDenylist  []string `yaml:"metric_denylist"`
+
+	// Querier.  The size of a query's response in bytes, 0 for no limit.
+	MaxQueryResponseSize int `yaml:"max_query_response_size_bytes"`
+	// How far back queries may look, as older data isn't kept; 0 for no
+	// limit.
+	MaxQueryLookback time.Duration `yaml:"max_query_lookback"`
+	// Queries rejected outright, e.g. an expensive dashboard's during an
+	// incident.
+	BlockedQueries []BlockedQuery `yaml:"blocked_queries"`
+
+	// Query frontend.  The rate is of requests per second, 0 for no limit.
+	QueryRateLimit float64 `yaml:"query_rate_limit"`
+	QueryBurstSize int     `yaml:"query_burst_size"`
+
+	// Ruler.
+	RulerEvaluationDelay time.Duration  `yaml:"ruler_evaluation_delay_duration"`
+	RulerExternalLabels  model.LabelSet `yaml:"ruler_external_labels"`
+	// Switches to stop evaluating the user's rules, all of them or those in
+	// the named rules files, without deleting their configs, e.g. during an
+	// incident.
+	RulerDisabled           bool     `yaml:"ruler_disabled"`
+	RulerDisabledNamespaces []string `yaml:"ruler_disabled_namespaces"`
+
+	// Alertmanager.  The rate is of notifications per second, 0 for no limit.
+	AlertmanagerNotificationRateLimit float64 `yaml:"alertmanager_notification_rate_limit"`
+	AlertmanagerNotificationBurstSize int     `yaml:"alertmanager_notification_burst_size"`
+	// Drops the user's notifications, without deleting their config.
+	AlertmanagerNotificationsDisabled bool `yaml:"alertmanager_notifications_disabled"`
+	// Networks receivers may not send notifications to.
+	AlertmanagerReceiversBlockCIDRNetworks     []string `yaml:"alertmanager_receivers_firewall_block_cidr_networks"`
+	AlertmanagerReceiversBlockPrivateAddresses bool     `yaml:"alertmanager_receivers_firewall_block_private_addresses"`
+
+	metricAllowlist *regexp.Regexp
+	metricDenylist  *regexp.Regexp
+	blockedNetworks []*net.IPNet
+	blockedQueries  []*regexp.Regexp
+}
+
+// BlockedQuery is a query to reject, given exactly or as a regexp anchored
+// at both ends, and the reason to give the user.
+type BlockedQuery struct {
+	Pattern string `yaml:"pattern"`
+	Regex   bool   `yaml:"regex"`
+	Reason  string `yaml:"reason"`
+}
+
+// Loopback, link-local and private networks, which receivers may be
+// blocked from.
+var privateNetworks = mustParseCIDRs(
+	"127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16",
+	"::1/128", "fc00::/7", "fe80::/10",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// compile compiles the allow and deny lists, blocked networks and blocked
+// queries.
+func (l *Limits) compile() error {
+	var err error
+	if l.metricAllowlist, err = compilePatterns(l.MetricAllowlist); err != nil {
+		return fmt.Errorf("invalid metric_allowlist: %v", err)
+	}
+	if l.metricDenylist, err = compilePatterns(l.MetricDenylist); err != nil {
+		return fmt.Errorf("invalid metric_denylist: %v", err)
+	}
+	if l.blockedNetworks, err = parseCIDRs(l.AlertmanagerReceiversBlockCIDRNetworks); err != nil {
+		return fmt.Errorf("invalid alertmanager_receivers_firewall_block_cidr_networks: %v", err)
+	}
+	if l.AlertmanagerReceiversBlockPrivateAddresses {
+		l.blockedNetworks = append(l.blockedNetworks, privateNetworks...)
+	}
+	l.blockedQueries = make([]*regexp.Regexp, 0, len(l.BlockedQueries))
+	for _, q := range l.BlockedQueries {
+		pattern := regexp.QuoteMeta(strings.TrimSpace(q.Pattern))
+		if q.Regex {
+			pattern = q.Pattern
+		}
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid blocked_queries pattern %q: %v", q.Pattern, err)
+		}
+		l.blockedQueries = append(l.blockedQueries, re)
+	}
+	return nil
+}
+
+// compilePatterns compiles patterns into a single regexp matching any of
+// them entirely, or nil if there are none.
+func compilePatterns(patterns []string) (*regexp.Regexp, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	for _, pattern := range patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, err
+		}
+	}
+	return regexp.Compile("^(?:" + strings.Join(patterns, "|") + ")$")
+}
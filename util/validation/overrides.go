@@ -0,0 +1,257 @@
+package validation
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// OverridesConfig configures where per-tenant overrides are loaded from.
+type OverridesConfig struct {
+	File   string
+	Period time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *OverridesConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.File, "limits.per-user-override-config", "", "File name of per-user overrides.")
+	f.DurationVar(&cfg.Period, "limits.per-user-override-period", 10*time.Second, "Period with which to reload the overrides.")
+}
+
+// Overrides holds the default Limits and any per-tenant overrides of them,
+// periodically reloading the overrides file.
+//
+// The overrides file looks like:
+//
+//	overrides:
+//	  tenant1:
+//	    max_chunk_age: 2h
+//	    metric_denylist:
+//	    - bad_metric_.*
+//
+// Settings not given for a tenant keep their default value.
+type Overrides struct {
+	cfg      OverridesConfig
+	defaults Limits
+	quit     chan struct{}
+	done     sync.WaitGroup
+
+	mtx       sync.RWMutex
+	overrides map[string]*Limits
+}
+
+// NewOverrides makes a new Overrides, loading the overrides file (if any)
+// and reloading it every cfg.Period.
+func NewOverrides(cfg OverridesConfig, defaults Limits) (*Overrides, error) {
+	if err := defaults.compile(); err != nil {
+		return nil, err
+	}
+	o := &Overrides{
+		cfg:       cfg,
+		defaults:  defaults,
+		quit:      make(chan struct{}),
+		overrides: map[string]*Limits{},
+	}
+	if cfg.File == "" {
+		return o, nil
+	}
+
+	if err := o.reload(); err != nil {
+		return nil, err
+	}
+	if cfg.Period > 0 {
+		o.done.Add(1)
+		go o.loop()
+	}
+	return o, nil
+}
+
+// Stop stops reloading the overrides file.
+func (o *Overrides) Stop() {
+	close(o.quit)
+	o.done.Wait()
+}
+
+func (o *Overrides) loop() {
+	defer o.done.Done()
+
+	ticker := time.NewTicker(o.cfg.Period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := o.reload(); err != nil {
+				log.Errorf("Error reloading overrides from %s: %v", o.cfg.File, err)
+			}
+		case <-o.quit:
+			return
+		}
+	}
+}
+
+func (o *Overrides) reload() error {
+	buf, err := ioutil.ReadFile(o.cfg.File)
+	if err != nil {
+		return err
+	}
+	overrides, err := parseOverrides(buf, o.defaults)
+	if err != nil {
+		return err
+	}
+
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	o.overrides = overrides
+	return nil
+}
+
+// parseOverrides decodes each tenant's settings on top of a copy of the
+// defaults, so that unset settings keep their default value.
+func parseOverrides(buf []byte, defaults Limits) (map[string]*Limits, error) {
+	var file struct {
+		Overrides map[string]interface{} `yaml:"overrides"`
+	}
+	if err := yaml.Unmarshal(buf, &file); err != nil {
+		return nil, err
+	}
+
+	overrides := make(map[string]*Limits, len(file.Overrides))
+	for userID, raw := range file.Overrides {
+		tenantBuf, err := yaml.Marshal(raw)
+		if err != nil {
+			return nil, err
+		}
+		limits := defaults
+		if err := yaml.Unmarshal(tenantBuf, &limits); err != nil {
+			return nil, err
+		}
+		if err := limits.compile(); err != nil {
+			return nil, fmt.Errorf("overrides for %s: %v", userID, err)
+		}
+		overrides[userID] = &limits
+	}
+	return overrides, nil
+}
+
+func (o *Overrides) getLimits(userID string) *Limits {
+	o.mtx.RLock()
+	defer o.mtx.RUnlock()
+	if limits, ok := o.overrides[userID]; ok {
+		return limits
+	}
+	return &o.defaults
+}
+
+// MaxChunkAge returns the maximum age of a chunk before it is flushed for the given user.
+func (o *Overrides) MaxChunkAge(userID string) time.Duration {
+	return o.getLimits(userID).MaxChunkAge
+}
+
+// MaxChunkIdle returns the maximum idle time of a chunk before it is flushed for the given user.
+func (o *Overrides) MaxChunkIdle(userID string) time.Duration {
+	return o.getLimits(userID).MaxChunkIdle
+}
+
+// MaxSeriesPerMetric returns the maximum number of active series per metric name for the given user.
+func (o *Overrides) MaxSeriesPerMetric(userID string) int {
+	return o.getLimits(userID).MaxSeriesPerMetric
+}
+
+// PushgatewayMaxGroups returns the maximum number of Pushgateway groups for the given user, 0 for no limit.
+func (o *Overrides) PushgatewayMaxGroups(userID string) int {
+	return o.getLimits(userID).PushgatewayMaxGroups
+}
+
+// PushgatewayMaxSeries returns the maximum number of series in the given user's Pushgateway groups, 0 for no limit.
+func (o *Overrides) PushgatewayMaxSeries(userID string) int {
+	return o.getLimits(userID).PushgatewayMaxSeries
+}
+
+// MaxQueryResponseSize returns the maximum size in bytes of a query response for the given user, 0 for no limit.
+func (o *Overrides) MaxQueryResponseSize(userID string) int {
+	return o.getLimits(userID).MaxQueryResponseSize
+}
+
+// MaxQueryLookback returns how far back the given user's queries may look, 0 for no limit.
+func (o *Overrides) MaxQueryLookback(userID string) time.Duration {
+	return o.getLimits(userID).MaxQueryLookback
+}
+
+// BlockedQuery returns whether the given user's query is blocked, and why.
+func (o *Overrides) BlockedQuery(userID, query string) (reason string, blocked bool) {
+	limits := o.getLimits(userID)
+	query = strings.TrimSpace(query)
+	for j, re := range limits.blockedQueries {
+		if re.MatchString(query) {
+			return limits.BlockedQueries[j].Reason, true
+		}
+	}
+	return "", false
+}
+
+// QueryRateLimit returns the rate of query requests per second the given user may make, 0 for no limit.
+func (o *Overrides) QueryRateLimit(userID string) float64 {
+	return o.getLimits(userID).QueryRateLimit
+}
+
+// QueryBurstSize returns the burst of query requests the given user may make.
+func (o *Overrides) QueryBurstSize(userID string) int {
+	return o.getLimits(userID).QueryBurstSize
+}
+
+// RulerEvaluationDelay returns how far behind real time the ruler evaluates the given user's rules.
+func (o *Overrides) RulerEvaluationDelay(userID string) time.Duration {
+	return o.getLimits(userID).RulerEvaluationDelay
+}
+
+// RulerExternalLabels returns the labels the ruler attaches to the given user's alerts.
+func (o *Overrides) RulerExternalLabels(userID string) model.LabelSet {
+	return o.getLimits(userID).RulerExternalLabels
+}
+
+// RulerNamespaceDisabled returns whether the given user's rules in the named rules file are not to be evaluated.
+func (o *Overrides) RulerNamespaceDisabled(userID, namespace string) bool {
+	limits := o.getLimits(userID)
+	if limits.RulerDisabled {
+		return true
+	}
+	for _, disabled := range limits.RulerDisabledNamespaces {
+		if disabled == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// AlertmanagerNotificationRateLimit returns the rate of notifications per second the given user's Alertmanager may send, 0 for no limit.
+func (o *Overrides) AlertmanagerNotificationRateLimit(userID string) float64 {
+	return o.getLimits(userID).AlertmanagerNotificationRateLimit
+}
+
+// AlertmanagerNotificationBurstSize returns the burst of notifications the given user's Alertmanager may send.
+func (o *Overrides) AlertmanagerNotificationBurstSize(userID string) int {
+	return o.getLimits(userID).AlertmanagerNotificationBurstSize
+}
+
+// AlertmanagerNotificationsDisabled returns whether the given user's notifications are to be dropped.
+func (o *Overrides) AlertmanagerNotificationsDisabled(userID string) bool {
+	return o.getLimits(userID).AlertmanagerNotificationsDisabled
+}
+
+// AlertmanagerReceiverBlocked returns whether the given user's receivers are blocked from sending notifications to ip.
+func (o *Overrides) AlertmanagerReceiverBlocked(userID string, ip net.IP) bool {
+	for _, network := range o.getLimits(userID).blockedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package validation
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverrides(t *testing.T) {
+	f, err := ioutil.TempFile("", "overrides")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`
+overrides:
+  user1:
+    max_chunk_age: 2h
+  user2:
+    max_chunk_idle: 5m
+`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	o, err := NewOverrides(OverridesConfig{File: f.Name()}, Limits{
+		MaxChunkAge:  12 * time.Hour,
+		MaxChunkIdle: 1 * time.Hour,
+	})
+	require.NoError(t, err)
+	defer o.Stop()
+
+	assert.Equal(t, 2*time.Hour, o.MaxChunkAge("user1"))
+	assert.Equal(t, 1*time.Hour, o.MaxChunkIdle("user1"))
+	assert.Equal(t, 12*time.Hour, o.MaxChunkAge("user2"))
+	assert.Equal(t, 5*time.Minute, o.MaxChunkIdle("user2"))
+	assert.Equal(t, 12*time.Hour, o.MaxChunkAge("user3"))
+	assert.Equal(t, 1*time.Hour, o.MaxChunkIdle("user3"))
+}
+
+func TestOverridesExporter(t *testing.T) {
+	overrides, err := parseOverrides([]byte(`
+overrides:
+  user1:
+    max_chunk_age: 2h
+    max_series_per_metric: 100
+`), Limits{MaxChunkAge: 12 * time.Hour, MaxSeriesPerMetric: 10})
+	require.NoError(t, err)
+	o := &Overrides{
+		defaults:  Limits{MaxChunkAge: 12 * time.Hour, MaxSeriesPerMetric: 10},
+		overrides: overrides,
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(NewOverridesExporter(o))
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	values := map[string]float64{}
+	for _, family := range families {
+		for _, m := range family.Metric {
+			key := family.GetName()
+			for _, l := range m.Label {
+				key += " " + l.GetName() + "=" + l.GetValue()
+			}
+			values[key] = m.GetGauge().GetValue()
+		}
+	}
+	assert.Equal(t, 7200.0, values["cortex_overrides limit_name=max_chunk_age user=user1"])
+	assert.Equal(t, 100.0, values["cortex_overrides limit_name=max_series_per_metric user=user1"])
+	assert.Contains(t, values, "cortex_overrides limit_name=max_sample_age user=user1")
+	assert.Equal(t, 43200.0, values["cortex_overrides_defaults limit_name=max_chunk_age"])
+	assert.Equal(t, 10.0, values["cortex_overrides_defaults limit_name=max_series_per_metric"])
+}
+
+func TestAlertmanagerReceiverBlocked(t *testing.T) {
+	defaults := Limits{AlertmanagerReceiversBlockCIDRNetworks: []string{"192.0.2.0/24"}}
+	o, err := NewOverrides(OverridesConfig{}, defaults)
+	require.NoError(t, err)
+	defer o.Stop()
+	o.overrides, err = parseOverrides([]byte(`
+overrides:
+  user1:
+    alertmanager_receivers_firewall_block_private_addresses: true
+`), defaults)
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		userID, ip string
+		blocked    bool
+	}{
+		{"user1", "192.0.2.1", true},
+		{"user1", "10.1.2.3", true},
+		{"user1", "::1", true},
+		{"user1", "198.51.100.1", false},
+		{"user2", "192.0.2.1", true},
+		{"user2", "10.1.2.3", false},
+	} {
+		assert.Equal(t, c.blocked, o.AlertmanagerReceiverBlocked(c.userID, net.ParseIP(c.ip)), "%s %s", c.userID, c.ip)
+	}
+
+	_, err = parseOverrides([]byte(`
+overrides:
+  user1:
+    alertmanager_receivers_firewall_block_cidr_networks: [10.0.0.0]
+`), defaults)
+	assert.Error(t, err)
+}
+
+func TestBlockedQuery(t *testing.T) {
+	o, err := NewOverrides(OverridesConfig{}, Limits{})
+	require.NoError(t, err)
+	defer o.Stop()
+	o.overrides, err = parseOverrides([]byte(`
+overrides:
+  user1:
+    blocked_queries:
+    - pattern: sum(rate(http_requests_total[5m]))
+      reason: expensive dashboard, see incident 42
+    - pattern: 'count\(\{__name__=~".+"\}\)( by \(job\))?'
+      regex: true
+`), Limits{})
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		userID, query string
+		blocked       bool
+		reason        string
+	}{
+		{"user1", "sum(rate(http_requests_total[5m]))", true, "expensive dashboard, see incident 42"},
+		{"user1", "  sum(rate(http_requests_total[5m]))\n", true, "expensive dashboard, see incident 42"},
+		{"user1", "sum(rate(http_requests_total[1m]))", false, ""},
+		{"user1", `count({__name__=~".+"})`, true, ""},
+		{"user1", `count({__name__=~".+"}) by (job)`, true, ""},
+		{"user1", `count({__name__=~".+"}) > 0`, false, ""},
+		{"user2", "sum(rate(http_requests_total[5m]))", false, ""},
+	} {
+		reason, blocked := o.BlockedQuery(c.userID, c.query)
+		assert.Equal(t, c.blocked, blocked, "%s %s", c.userID, c.query)
+		assert.Equal(t, c.reason, reason, "%s %s", c.userID, c.query)
+	}
+
+	_, err = parseOverrides([]byte(`
+overrides:
+  user1:
+    blocked_queries:
+    - pattern: 'sum('
+      regex: true
+`), Limits{})
+	assert.Error(t, err)
+}
+
+func TestRulerNamespaceDisabled(t *testing.T) {
+	o, err := NewOverrides(OverridesConfig{}, Limits{})
+	require.NoError(t, err)
+	defer o.Stop()
+	o.overrides, err = parseOverrides([]byte(`
+overrides:
+  user1:
+    ruler_disabled: true
+  user2:
+    ruler_disabled_namespaces: [expensive]
+`), Limits{})
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		userID, namespace string
+		disabled          bool
+	}{
+		{"user1", "expensive", true},
+		{"user1", "cheap", true},
+		{"user2", "expensive", true},
+		{"user2", "cheap", false},
+		{"user3", "expensive", false},
+	} {
+		assert.Equal(t, c.disabled, o.RulerNamespaceDisabled(c.userID, c.namespace), "%s %s", c.userID, c.namespace)
+	}
+}
@@ -0,0 +1,222 @@
+package validation
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/weaveworks/cortex"
+	cortex_errors "github.com/weaveworks/cortex/util/errors"
+)
+
+const (
+	discardReasonLabel = "reason"
+
+	// Reasons to discard samples.
+	TooFarInFuture      = "too_far_in_future"
+	WrongTimestampUnit  = "timestamp_wrong_unit"
+	TooOld              = "greater_than_max_sample_age"
+	TooOldForSeries     = "too_old_for_series"
+	OutOfOrderTimestamp = "timestamp_out_of_order"
+	DuplicateSample     = "multiple_values_for_timestamp"
+	MetricNotAllowed    = "metric_not_allowed"
+	MetricDenied        = "metric_denied"
+	InvalidLabel        = "label_invalid"
+	DuplicateLabelNames = "duplicate_label_names"
+	SeriesRejected      = "series_rejected"
+)
+
+// DiscardedSamples is a metric of the number of discarded samples, by reason.
+var DiscardedSamples = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cortex_discarded_samples_total",
+		Help: "The total number of samples that were discarded.",
+	},
+	[]string{discardReasonLabel, "user"},
+)
+
+func init() {
+	prometheus.MustRegister(DiscardedSamples)
+}
+
+// unitTolerance is how near now a timestamp, taken to be in another unit,
+// must be for it to have been sent in that unit by mistake.
+const unitTolerance = int64(365 * 24 * time.Hour / time.Millisecond)
+
+// ValidateTimestamp returns the reason to discard a sample, and a validation
+// error describing it, if ts looks like it's in the wrong unit, or is
+// further in the future than the user's creation grace period, or older
+// than their max sample age, relative to now.  A zero bound is not
+// enforced.
+func (o *Overrides) ValidateTimestamp(userID string, now, ts model.Time) (string, error) {
+	if unit, asMs := mistakenUnit(now, ts); unit != "" {
+		return WrongTimestampUnit, cortex_errors.Errorf(cortex_errors.Validation, "sample timestamp %d looks like it's in %s rather than milliseconds since the epoch (%v, rather than %v)", int64(ts), unit, asMs, ts)
+	}
+
+	limits := o.getLimits(userID)
+
+	if limits.CreationGracePeriod > 0 && ts > now.Add(limits.CreationGracePeriod) {
+		return TooFarInFuture, cortex_errors.Errorf(cortex_errors.Validation, "sample timestamp too far in the future: %v, must be before %v", ts, now.Add(limits.CreationGracePeriod))
+	}
+
+	if limits.MaxSampleAge > 0 && ts < now.Add(-limits.MaxSampleAge) {
+		return TooOld, cortex_errors.Errorf(cortex_errors.Validation, "sample timestamp too old: %v, must be after %v", ts, now.Add(-limits.MaxSampleAge))
+	}
+
+	return "", nil
+}
+
+// mistakenUnit returns the unit ts seems to be in, and the timestamp it
+// would be in milliseconds, if it's far from now as milliseconds but near
+// now in seconds, microseconds or nanoseconds; such timestamps are almost
+// certainly a client's mistake.
+func mistakenUnit(now, ts model.Time) (string, model.Time) {
+	near := func(ms int64) bool {
+		return ms > int64(now)-unitTolerance && ms < int64(now)+unitTolerance
+	}
+	if near(int64(ts)) {
+		return "", 0
+	}
+	// Compare before converting, so large timestamps can't overflow.
+	switch {
+	case int64(ts) < int64(now)/100 && near(int64(ts)*1e3):
+		return "seconds", ts * 1e3
+	case int64(ts) > int64(now)*100 && near(int64(ts)/1e3):
+		return "microseconds", ts / 1e3
+	case int64(ts) > int64(now)*100 && near(int64(ts)/1e6):
+		return "nanoseconds", ts / 1e6
+	}
+	return "", 0
+}
+
+// ValidateMetricName returns the reason to discard samples of the named
+// metric, and a validation error describing it, if it isn't in the user's
+// allowlist (when they have one), or is in their denylist.
+func (o *Overrides) ValidateMetricName(userID string, name string) (string, error) {
+	limits := o.getLimits(userID)
+
+	if limits.metricAllowlist != nil && !limits.metricAllowlist.MatchString(name) {
+		return MetricNotAllowed, cortex_errors.Errorf(cortex_errors.Validation, "metric %q is not in the allowlist", name)
+	}
+
+	if limits.metricDenylist != nil && limits.metricDenylist.MatchString(name) {
+		return MetricDenied, cortex_errors.Errorf(cortex_errors.Validation, "metric %q is in the denylist", name)
+	}
+
+	return "", nil
+}
+
+// ValidateSeriesTimestamp returns the reason to discard a sample with
+// timestamp ts, and a validation error describing it, given the newest sample
+// already in its series.  Samples can't be appended before the newest one;
+// those more than the user's max sample age before it are reported as too
+// old, rather than out of order.
+func (o *Overrides) ValidateSeriesTimestamp(userID string, newest, ts model.Time) (string, error) {
+	if ts >= newest {
+		return "", nil
+	}
+	if maxAge := o.getLimits(userID).MaxSampleAge; maxAge > 0 && ts < newest.Add(-maxAge) {
+		return TooOldForSeries, cortex_errors.Errorf(cortex_errors.Validation, "sample timestamp too old: %v, more than %v before the newest sample in the series at %v", ts, maxAge, newest)
+	}
+	return OutOfOrderTimestamp, cortex_errors.Errorf(cortex_errors.Validation, "sample timestamp out of order: %v, before the newest sample in the series at %v", ts, newest)
+}
+
+// maxFailedSeries bounds the series a Discards details.
+const maxFailedSeries = 100
+
+// FailedSeries is why samples of a series in a push were discarded.
+type FailedSeries struct {
+	Series  string `json:"series"`
+	Reason  string `json:"reason"`
+	Error   string `json:"error"`
+	Samples int    `json:"samples"`
+}
+
+// DiscardDetails are the Details of the error a Discards returns: how many
+// samples were discarded, and from which series (up to maxFailedSeries).
+type DiscardDetails struct {
+	Discarded int            `json:"discarded"`
+	Series    []FailedSeries `json:"series,omitempty"`
+}
+
+// Discards accumulates the samples discarded from a single push, counting
+// them in DiscardedSamples, so they can be reported in one error.
+type Discards struct {
+	userID  string
+	counts  map[string]int
+	example map[string]error
+
+	// Indexes into failed, by series and reason.
+	failedIndex map[string]int
+	failed      []FailedSeries
+}
+
+// NewDiscards makes a new Discards for the given user.
+func NewDiscards(userID string) *Discards {
+	return &Discards{
+		userID:      userID,
+		counts:      map[string]int{},
+		example:     map[string]error{},
+		failedIndex: map[string]int{},
+	}
+}
+
+// Add records a sample discarded for reason, with err.
+func (d *Discards) Add(reason string, err error) {
+	DiscardedSamples.WithLabelValues(reason, d.userID).Inc()
+	d.counts[reason]++
+	d.example[reason] = err
+}
+
+// AddSeries records a sample of the series with labels discarded for reason,
+// with err, so the series can be detailed in the error.
+func (d *Discards) AddSeries(labels []cortex.LabelPair, reason string, err error) {
+	d.Add(reason, err)
+	series := formatLabels(labels)
+	key := series + "\xff" + reason
+	if i, ok := d.failedIndex[key]; ok {
+		d.failed[i].Samples++
+		return
+	}
+	if len(d.failed) >= maxFailedSeries {
+		return
+	}
+	d.failedIndex[key] = len(d.failed)
+	d.failed = append(d.failed, FailedSeries{
+		Series:  series,
+		Reason:  reason,
+		Error:   err.Error(),
+		Samples: 1,
+	})
+}
+
+// Err returns a validation error saying how many samples were discarded for
+// each reason, with an example of each; or nil if none were.
+func (d *Discards) Err() error {
+	if len(d.counts) == 0 {
+		return nil
+	}
+	reasons := make([]string, 0, len(d.counts))
+	for reason := range d.counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	total, descriptions := 0, make([]string, 0, len(reasons))
+	for _, reason := range reasons {
+		total += d.counts[reason]
+		descriptions = append(descriptions, fmt.Sprintf("%d %s (%v)", d.counts[reason], reason, d.example[reason]))
+	}
+	return &cortex_errors.DetailedError{
+		Type: cortex_errors.Validation,
+		Msg:  fmt.Sprintf("discarded %d samples: %s", total, strings.Join(descriptions, "; ")),
+		Details: &DiscardDetails{
+			Discarded: total,
+			Series:    d.failed,
+		},
+	}
+}
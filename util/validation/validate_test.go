@@ -0,0 +1,163 @@
+package validation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/cortex"
+	cortex_errors "github.com/weaveworks/cortex/util/errors"
+)
+
+func TestValidateTimestamp(t *testing.T) {
+	o, err := NewOverrides(OverridesConfig{}, Limits{
+		CreationGracePeriod: 10 * time.Minute,
+		MaxSampleAge:        24 * time.Hour,
+	})
+	require.NoError(t, err)
+	defer o.Stop()
+
+	now := model.Now()
+	for _, c := range []struct {
+		ts     model.Time
+		valid  bool
+		reason string
+	}{
+		{now, true, ""},
+		{now.Add(5 * time.Minute), true, ""},
+		{now.Add(-23 * time.Hour), true, ""},
+		{now.Add(11 * time.Minute), false, TooFarInFuture},
+		{now.Add(-25 * time.Hour), false, TooOld},
+		{0, false, TooOld},
+		{model.Time(now.Unix()), false, WrongTimestampUnit},
+		{now * 1e3, false, WrongTimestampUnit},
+		{now * 1e6, false, WrongTimestampUnit},
+		// Not mistaken for microseconds.
+		{now * 50, false, TooFarInFuture},
+	} {
+		reason, err := o.ValidateTimestamp("user", now, c.ts)
+		if c.valid {
+			assert.NoError(t, err, "%v", c.ts)
+		} else {
+			assert.Equal(t, cortex_errors.Validation, cortex_errors.TypeOf(err), "%v", c.ts)
+		}
+		assert.Equal(t, c.reason, reason, "%v", c.ts)
+	}
+}
+
+func TestValidateTimestampBeyond2038(t *testing.T) {
+	o, err := NewOverrides(OverridesConfig{}, Limits{CreationGracePeriod: 10 * time.Minute})
+	require.NoError(t, err)
+	defer o.Stop()
+
+	now := model.TimeFromUnix(time.Date(2040, 1, 1, 0, 0, 0, 0, time.UTC).Unix())
+	_, err = o.ValidateTimestamp("user", now, now)
+	assert.NoError(t, err)
+	reason, err := o.ValidateTimestamp("user", now, model.Time(now.Unix()))
+	assert.Equal(t, WrongTimestampUnit, reason)
+	assert.Contains(t, err.Error(), "seconds")
+}
+
+func TestValidateMetricName(t *testing.T) {
+	defaults := Limits{MetricDenylist: []string{"go_.*"}}
+	o, err := NewOverrides(OverridesConfig{}, defaults)
+	require.NoError(t, err)
+	defer o.Stop()
+	o.overrides, err = parseOverrides([]byte(`
+overrides:
+  user1:
+    metric_allowlist: [foo, bar_.*]
+  user2:
+    metric_denylist: []
+`), defaults)
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		userID, name, reason string
+	}{
+		{"user1", "foo", ""},
+		{"user1", "bar_total", ""},
+		{"user1", "foobar", MetricNotAllowed},
+		{"user1", "go_goroutines", MetricNotAllowed},
+		{"user2", "go_goroutines", ""},
+		{"user3", "go_goroutines", MetricDenied},
+		{"user3", "cargo_goroutines", ""},
+	} {
+		reason, err := o.ValidateMetricName(c.userID, c.name)
+		if c.reason == "" {
+			assert.NoError(t, err, "%s %s", c.userID, c.name)
+		} else {
+			assert.Equal(t, cortex_errors.Validation, cortex_errors.TypeOf(err), "%s %s", c.userID, c.name)
+		}
+		assert.Equal(t, c.reason, reason, "%s %s", c.userID, c.name)
+	}
+
+	_, err = parseOverrides([]byte(`
+overrides:
+  user1:
+    metric_denylist: ["foo("]
+`), defaults)
+	assert.Error(t, err)
+}
+
+func TestValidateSeriesTimestamp(t *testing.T) {
+	o, err := NewOverrides(OverridesConfig{}, Limits{
+		MaxSampleAge: time.Hour,
+	})
+	require.NoError(t, err)
+	defer o.Stop()
+
+	newest := model.Now()
+	for _, c := range []struct {
+		ts     model.Time
+		reason string
+	}{
+		{newest, ""},
+		{newest.Add(time.Minute), ""},
+		{newest.Add(-time.Minute), OutOfOrderTimestamp},
+		{newest.Add(-2 * time.Hour), TooOldForSeries},
+	} {
+		reason, err := o.ValidateSeriesTimestamp("user", newest, c.ts)
+		assert.Equal(t, c.reason, reason, "%v", c.ts)
+		if c.reason == "" {
+			assert.NoError(t, err, "%v", c.ts)
+		} else {
+			assert.Equal(t, cortex_errors.Validation, cortex_errors.TypeOf(err), "%v", c.ts)
+		}
+	}
+}
+
+func TestDiscards(t *testing.T) {
+	d := NewDiscards("user")
+	assert.NoError(t, d.Err())
+
+	d.Add(TooOld, cortex_errors.New(cortex_errors.Validation, "old"))
+	d.Add(OutOfOrderTimestamp, cortex_errors.New(cortex_errors.Validation, "first"))
+	d.Add(OutOfOrderTimestamp, cortex_errors.New(cortex_errors.Validation, "second"))
+	err := d.Err()
+	assert.Equal(t, cortex_errors.Validation, cortex_errors.TypeOf(err))
+	assert.Equal(t, "discarded 3 samples: 1 greater_than_max_sample_age (old); 2 timestamp_out_of_order (second)", err.Error())
+}
+
+func TestDiscardsSeries(t *testing.T) {
+	d := NewDiscards("user")
+	up := []cortex.LabelPair{{Name: []byte("__name__"), Value: []byte("up")}}
+	down := []cortex.LabelPair{{Name: []byte("__name__"), Value: []byte("down")}}
+	d.AddSeries(up, TooOld, cortex_errors.New(cortex_errors.Validation, "old"))
+	d.AddSeries(up, TooOld, cortex_errors.New(cortex_errors.Validation, "old"))
+	d.AddSeries(down, TooFarInFuture, cortex_errors.New(cortex_errors.Validation, "future"))
+	d.Add(OutOfOrderTimestamp, cortex_errors.New(cortex_errors.Validation, "out of order"))
+
+	err, ok := d.Err().(*cortex_errors.DetailedError)
+	require.True(t, ok)
+	assert.Equal(t, &DiscardDetails{
+		Discarded: 4,
+		Series: []FailedSeries{
+			{Series: `{__name__="up"}`, Reason: TooOld, Error: "old", Samples: 2},
+			{Series: `{__name__="down"}`, Reason: TooFarInFuture, Error: "future", Samples: 1},
+		},
+	}, err.Details)
+}
@@ -0,0 +1,115 @@
+package validator
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-opentracing/go/otgrpc"
+	"github.com/mwitkow/go-grpc-middleware"
+	"github.com/opentracing/opentracing-go"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/cortex"
+)
+
+// A Validator inspects the series of each push before the distributor
+// ingests them, and can reject them or rewrite their labels, e.g. to
+// require every series to have a team label.  It's the same as a
+// ValidatorServer, so a sidecar can serve one directly.
+type Validator interface {
+	Validate(context.Context, *ValidateRequest) (*ValidateResponse, error)
+}
+
+// SeriesFunc is a Validator of one series at a time, returning the labels to
+// ingest it with, or why it's rejected.
+type SeriesFunc func(userID string, labels []cortex.LabelPair) ([]cortex.LabelPair, string)
+
+// Validate implements Validator.
+func (f SeriesFunc) Validate(_ context.Context, req *ValidateRequest) (*ValidateResponse, error) {
+	resp := &ValidateResponse{Results: make([]Result, len(req.Series))}
+	for i, series := range req.Series {
+		resp.Results[i].Labels, resp.Results[i].Rejection = f(req.UserId, series.Labels)
+	}
+	return resp, nil
+}
+
+var (
+	validatorsMtx sync.RWMutex
+	validators    = map[string]Validator{}
+)
+
+// Register makes a Validator built into the binary available by name, for
+// -distributor.series-validator.  It's meant to be called from init
+// functions, and panics if the name is already taken.
+func Register(name string, v Validator) {
+	validatorsMtx.Lock()
+	defer validatorsMtx.Unlock()
+	if _, ok := validators[name]; ok {
+		panic(fmt.Sprintf("series validator %q registered twice", name))
+	}
+	validators[name] = v
+}
+
+// Config configures the Validator a distributor uses.
+type Config struct {
+	Name    string
+	Address string
+	Timeout time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Name, "distributor.series-validator", "", "Name of the series validator, built into the binary, to check pushed series with.")
+	f.StringVar(&cfg.Address, "distributor.series-validator-address", "", "host:port of a validator sidecar, serving the Validator gRPC service, to check pushed series with.")
+	f.DurationVar(&cfg.Timeout, "distributor.series-validator-timeout", time.Second, "Timeout for requests to the validator sidecar.")
+}
+
+// New returns the configured Validator, and a function to close it; or nil
+// if none is configured.
+func New(cfg Config) (Validator, func() error, error) {
+	switch {
+	case cfg.Name != "" && cfg.Address != "":
+		return nil, nil, fmt.Errorf("-distributor.series-validator and -distributor.series-validator-address are mutually exclusive")
+	case cfg.Name != "":
+		validatorsMtx.RLock()
+		defer validatorsMtx.RUnlock()
+		v, ok := validators[cfg.Name]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown series validator %q", cfg.Name)
+		}
+		return v, func() error { return nil }, nil
+	case cfg.Address != "":
+		if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+			return nil, nil, fmt.Errorf("invalid series validator address %q: %v", cfg.Address, err)
+		}
+		conn, err := grpc.Dial(cfg.Address,
+			grpc.WithInsecure(),
+			grpc.WithUnaryInterceptor(grpc_middleware.ChainUnaryClient(
+				otgrpc.OpenTracingClientInterceptor(opentracing.GlobalTracer()),
+				middleware.ClientUserHeaderInterceptor,
+			)),
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		return client{NewValidatorClient(conn), cfg.Timeout}, conn.Close, nil
+	}
+	return nil, nil, nil
+}
+
+// client is a Validator calling a sidecar.
+type client struct {
+	ValidatorClient
+	timeout time.Duration
+}
+
+func (c client) Validate(ctx context.Context, req *ValidateRequest) (*ValidateResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.ValidatorClient.Validate(ctx, req)
+}
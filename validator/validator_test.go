@@ -0,0 +1,36 @@
+package validator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/cortex"
+)
+
+func TestNew(t *testing.T) {
+	noop := SeriesFunc(func(userID string, labels []cortex.LabelPair) ([]cortex.LabelPair, string) {
+		return labels, ""
+	})
+	Register("noop", noop)
+	assert.Panics(t, func() { Register("noop", noop) })
+
+	v, _, err := New(Config{})
+	require.NoError(t, err)
+	assert.Nil(t, v)
+
+	v, closer, err := New(Config{Name: "noop"})
+	require.NoError(t, err)
+	assert.NotNil(t, v)
+	assert.NoError(t, closer())
+
+	for _, cfg := range []Config{
+		{Name: "unknown"},
+		{Address: "no-port"},
+		{Name: "noop", Address: "localhost:9095"},
+	} {
+		_, _, err := New(cfg)
+		assert.Error(t, err, "%+v", cfg)
+	}
+}